@@ -0,0 +1,711 @@
+package main
+
+import (
+	"context"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	iofs "io/fs"
+	"log/slog"
+	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/deploy"
+	"github.com/hohn/mrvacommander/pkg/state"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/backend"
+	"mrvaserver/pkg/backup"
+	"mrvaserver/pkg/bench"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/encryption"
+	"mrvaserver/pkg/etcd"
+	"mrvaserver/pkg/etcdstate"
+	"mrvaserver/pkg/fakeagent"
+	"mrvaserver/pkg/journal"
+	"mrvaserver/pkg/manifest"
+	"mrvaserver/pkg/mrvaclient"
+	"mrvaserver/pkg/mysqlstate"
+	"mrvaserver/pkg/pgstate"
+	"mrvaserver/pkg/preflight"
+	"mrvaserver/pkg/rabbitmq"
+	"mrvaserver/pkg/signing"
+	"mrvaserver/pkg/snapshot"
+)
+
+// runCommand dispatches a subcommand and returns the process exit code.
+func runCommand(name string, args []string) int {
+	switch name {
+	case "actions":
+		return actionsCommand(args)
+	case "backup":
+		return backupCommand(args)
+	case "restore":
+		return restoreCommand(args)
+	case "export-state":
+		return exportStateCommand(args)
+	case "import-state":
+		return importStateCommand(args)
+	case "config":
+		return configCommand(args)
+	case "deploy":
+		return deployCommand(args)
+	case "fakeagent":
+		return fakeagentCommand(args)
+	case "bench":
+		return benchCommand(args)
+	case "keygen":
+		return keygenCommand(args)
+	case "decrypt":
+		return decryptCommand(args)
+	default:
+		slog.Error("Unknown command", "name", name)
+		return 2
+	}
+}
+
+// actionsCommand submits a variant analysis from a GitHub Actions
+// workflow and, with --wait, waits for it.  It writes the session's ID,
+// status and outcome to the step's outputs and a summary to the job's, and
+// exits non-zero if the analysis did not succeed on every repository.
+func actionsCommand(args []string) int {
+	fs := flag.NewFlagSet("actions", flag.ExitOnError)
+	url := fs.String("url", os.Getenv("MRVA_URL"), "Base URL of the server")
+	token := fs.String("token", os.Getenv("MRVA_TOKEN"), "Bearer token to submit with")
+	language := fs.String("language", "", "Query language")
+	packFile := fs.String("query-pack", "", "Gzipped tar of the query pack")
+	reposFile := fs.String("repos-file", "", "File listing owner/repo names, one per line or comma-separated, # for comments")
+	repos := fs.String("repos", "", "Comma-separated owner/repo list, added to --repos-file's")
+	options := fs.String("options", "", "JSON object of further submission fields")
+	wait := fs.Bool("wait", false, "Wait for the analysis to finish")
+	timeout := fs.Duration("timeout", 6*time.Hour, "How long to wait for the analysis to finish")
+	poll := fs.Duration("poll", 30*time.Second, "Status polling interval")
+	allowErrors := fs.Bool("allow-errors", false, "Succeed when some repositories failed but others succeeded")
+	fs.Parse(args)
+
+	if *url == "" || *language == "" || *packFile == "" {
+		fs.Usage()
+		return 2
+	}
+	sub := mrvaclient.Submission{Language: *language, Repositories: mrvaclient.ParseRepoList([]byte(*repos))}
+	var err error
+	if sub.QueryPack, err = os.ReadFile(*packFile); err != nil {
+		slog.Error("Failed to read query pack", "error", err)
+		return 1
+	}
+	if *reposFile != "" {
+		data, err := os.ReadFile(*reposFile)
+		if err != nil {
+			slog.Error("Failed to read repository list", "error", err)
+			return 1
+		}
+		sub.Repositories = append(mrvaclient.ParseRepoList(data), sub.Repositories...)
+	}
+	if *options != "" {
+		if err := json.Unmarshal([]byte(*options), &sub.Options); err != nil {
+			slog.Error("Failed to parse --options", "error", err)
+			return 2
+		}
+	}
+
+	c := mrvaclient.New(*url, *token)
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+	va, err := c.Submit(ctx, sub)
+	if err != nil {
+		slog.Error("Failed to submit variant analysis", "error", err)
+		return 1
+	}
+	slog.Info("Variant analysis submitted", "session", va.ID, "repositories", len(sub.Repositories),
+		"status_url", c.StatusURL(va.ID))
+	if *wait {
+		va, err = c.Wait(ctx, va.ID, *poll, func(va api.VariantAnalysis) {
+			if va.Progress != nil {
+				slog.Info("Variant analysis in progress", "session", va.ID, "remaining", va.Progress.Remaining,
+					"eta", va.Progress.EstimatedCompletionAt)
+			}
+		})
+		if err != nil {
+			slog.Error("Failed to wait for variant analysis", "session", va.ID, "error", err)
+			return 1
+		}
+	}
+
+	outcome := ""
+	if va.Outcome != nil {
+		outcome = va.Outcome.State
+	}
+	writeActionsFile("GITHUB_OUTPUT", fmt.Sprintf("session-id=%d\nstatus=%s\noutcome=%s\nstatus-url=%s\n",
+		va.ID, va.Status, outcome, c.StatusURL(va.ID)))
+	if !*wait {
+		return 0
+	}
+	summary := fmt.Sprintf("### Variant analysis %d\n\nStatus: %s", va.ID, va.Status)
+	if o := va.Outcome; o != nil {
+		summary += fmt.Sprintf("\n\nOutcome: %s, %d succeeded, %d failed", o.State, o.Succeeded, o.Failed)
+		codes := make([]string, 0, len(o.Failures))
+		for code := range o.Failures {
+			codes = append(codes, code)
+		}
+		sort.Strings(codes)
+		for _, code := range codes {
+			summary += fmt.Sprintf("\n- %s: %d", code, o.Failures[code])
+		}
+	}
+	writeActionsFile("GITHUB_STEP_SUMMARY", summary+"\n")
+	slog.Info("Variant analysis finished", "session", va.ID, "status", va.Status, "outcome", outcome)
+	switch {
+	case outcome == api.OutcomeSucceeded, outcome == api.OutcomeCompletedWithErrors && *allowErrors:
+		return 0
+	case outcome == "" && va.Status == api.StatusSucceeded:
+		return 0
+	default:
+		return 1
+	}
+}
+
+// writeActionsFile appends s to the workflow command file named by the
+// environment variable key, if the step has one.
+func writeActionsFile(key, s string) {
+	name := os.Getenv(key)
+	if name == "" {
+		return
+	}
+	f, err := os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0o644)
+	if err != nil {
+		slog.Warn("Failed to open workflow file", "env", key, "error", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.WriteString(s); err != nil {
+		slog.Warn("Failed to write workflow file", "env", key, "error", err)
+	}
+}
+
+// backupDatabases are the databases a deployment uses, from the same
+// environment variables the server reads.
+func backupDatabases() []backup.Database {
+	dbs := []backup.Database{{Name: "state", DSN: os.Getenv("MRVA_STATE_DSN")}}
+	if dsn := os.Getenv("MRVA_STORE_DSN"); dsn != dbs[0].DSN {
+		dbs = append(dbs, backup.Database{Name: "store", DSN: dsn})
+	}
+	return dbs
+}
+
+// backupCommand writes a snapshot of the databases and artifacts to a
+// directory.
+func backupCommand(args []string) int {
+	fs := flag.NewFlagSet("backup", flag.ExitOnError)
+	dir := fs.String("dir", "", "Directory to write the backup to (must not exist or be empty)")
+	artifacts := fs.String("artifacts", "copy", "copy: store artifacts in the backup; reference: only list them")
+	fs.Parse(args)
+
+	if *dir == "" || (*artifacts != "copy" && *artifacts != "reference") {
+		fs.Usage()
+		return 2
+	}
+	client, err := backup.ArtifactClient()
+	if err != nil {
+		slog.Error("Failed to connect to artifact store", "error", err)
+		return 1
+	}
+	m, err := backup.Backup(context.Background(), backup.Options{
+		Dir:       *dir,
+		Databases: backupDatabases(),
+		Copy:      *artifacts == "copy",
+	}, client)
+	if err != nil {
+		slog.Error("Backup failed", "error", err)
+		return 1
+	}
+	fmt.Printf("Backed up %d databases and %d artifacts to %s\n", len(m.Databases), len(m.Artifacts), *dir)
+	return 0
+}
+
+// restoreCommand loads a backup written by backupCommand.
+func restoreCommand(args []string) int {
+	fs := flag.NewFlagSet("restore", flag.ExitOnError)
+	dir := fs.String("dir", "", "Directory holding the backup")
+	fs.Parse(args)
+
+	if *dir == "" {
+		fs.Usage()
+		return 2
+	}
+	client, err := backup.ArtifactClient()
+	if err != nil {
+		slog.Error("Failed to connect to artifact store", "error", err)
+		return 1
+	}
+	err = backup.Restore(context.Background(), backup.Options{
+		Dir:       *dir,
+		Databases: backupDatabases(),
+	}, client)
+	if err != nil {
+		slog.Error("Restore failed", "error", err)
+		return 1
+	}
+	fmt.Printf("Restored %s\n", *dir)
+	return 0
+}
+
+// openState opens a state backend as the server would (see config.State),
+// and returns it with a function that closes it.
+func openState(name, journalFile, etcdPrefix string) (state.ServerState, func(), error) {
+	switch name {
+	case "postgres":
+		s, err := pgstate.New(context.Background(), os.Getenv("MRVA_STATE_DSN"))
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, s.Close, nil
+	case "mysql":
+		s, err := mysqlstate.New(context.Background(), os.Getenv("MRVA_STATE_DSN"))
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, s.Close, nil
+	case "etcd":
+		c, err := etcd.FromEnv()
+		if err != nil {
+			return nil, nil, err
+		}
+		return etcdstate.New(c, etcdPrefix), func() {}, nil
+	case "journal":
+		s, err := journal.Open(journalFile, false)
+		if err != nil {
+			return nil, nil, err
+		}
+		return s, func() {
+			if err := s.Close(); err != nil {
+				slog.Error("Failed to close state journal", "error", err)
+			}
+		}, nil
+	case "commander":
+		return state.NewPGState(), func() {}, nil
+	default:
+		s, err := backend.OpenState(context.Background(), name)
+		if err != nil {
+			return nil, nil, err
+		}
+		if c, ok := s.(interface{ Close() }); ok {
+			return s, c.Close, nil
+		}
+		return s, func() {}, nil
+	}
+}
+
+// exportStateCommand writes every session and job of a state backend to a
+// bundle that importStateCommand can load into another.
+func exportStateCommand(args []string) int {
+	fs := flag.NewFlagSet("export-state", flag.ExitOnError)
+	backend := fs.String("backend", "commander", "State backend to export: commander, postgres, mysql, etcd or journal")
+	journalFile := fs.String("journal-file", "mrvaserver-state.journal", "Journal of the journal backend")
+	etcdPrefix := fs.String("etcd-prefix", "/mrvaserver/", "Key prefix of the etcd backend")
+	file := fs.String("file", "", "Bundle to write (must not exist)")
+	maxGap := fs.Int("max-gap", 1000, "Consecutive missing session IDs that end the scan of backends that cannot list sessions")
+	fs.Parse(args)
+
+	if *file == "" {
+		fs.Usage()
+		return 2
+	}
+	st, closeState, err := openState(*backend, *journalFile, *etcdPrefix)
+	if err != nil {
+		slog.Error("Failed to open state", "error", err)
+		return 1
+	}
+	defer closeState()
+
+	f, err := os.OpenFile(*file, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o640)
+	if err != nil {
+		slog.Error("Failed to create bundle", "error", err)
+		return 1
+	}
+	sum, err := snapshot.Export(st, f, snapshot.Options{MaxGap: *maxGap})
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		slog.Error("Export failed", "error", err)
+		os.Remove(*file)
+		return 1
+	}
+	fmt.Printf("Exported %d sessions and %d jobs to %s\n", sum.Sessions, sum.Jobs, *file)
+	return 0
+}
+
+// importStateCommand loads a bundle written by exportStateCommand into an
+// empty state backend.
+func importStateCommand(args []string) int {
+	fs := flag.NewFlagSet("import-state", flag.ExitOnError)
+	backend := fs.String("backend", "", "State backend to import into: commander, postgres, mysql, etcd or journal")
+	journalFile := fs.String("journal-file", "mrvaserver-state.journal", "Journal of the journal backend")
+	etcdPrefix := fs.String("etcd-prefix", "/mrvaserver/", "Key prefix of the etcd backend")
+	file := fs.String("file", "", "Bundle to read")
+	verify := fs.Bool("verify", false, "Only check that the bundle is complete")
+	fs.Parse(args)
+
+	if *file == "" || (*backend == "" && !*verify) {
+		fs.Usage()
+		return 2
+	}
+	f, err := os.Open(*file)
+	if err != nil {
+		slog.Error("Failed to open bundle", "error", err)
+		return 1
+	}
+	defer f.Close()
+
+	if *verify {
+		sum, err := snapshot.Verify(f)
+		if err != nil {
+			slog.Error("Bundle is not valid", "error", err)
+			return 1
+		}
+		fmt.Printf("%s holds %d sessions and %d jobs\n", *file, sum.Sessions, sum.Jobs)
+		return 0
+	}
+
+	st, closeState, err := openState(*backend, *journalFile, *etcdPrefix)
+	if err != nil {
+		slog.Error("Failed to open state", "error", err)
+		return 1
+	}
+	defer closeState()
+	sum, err := snapshot.Import(st, f)
+	if err != nil {
+		slog.Error("Import failed", "error", err)
+		return 1
+	}
+	fmt.Printf("Imported %d sessions and %d jobs from %s\n", sum.Sessions, sum.Jobs, *file)
+	return 0
+}
+
+// configCommand runs "config check", which loads a configuration strictly
+// and checks every backend it uses, printing a report per component.
+func configCommand(args []string) int {
+	if len(args) == 0 || args[0] != "check" {
+		slog.Error("Usage: config check [--config FILE]")
+		return 2
+	}
+	fs := flag.NewFlagSet("config check", flag.ExitOnError)
+	configFile := fs.String("config", flag.Lookup("config").Value.String(), "Path to the configuration file")
+	fs.Parse(args[1:])
+
+	cfg, err := config.Check(*configFile)
+	if err != nil {
+		fmt.Printf("FAIL  config\n      %v\n", err)
+		return 1
+	}
+	fmt.Printf("PASS  config  %s\n", *configFile)
+
+	results := preflight.Run(cfg)
+	failed := 0
+	for _, r := range results {
+		switch {
+		case r.Skipped:
+			fmt.Printf("SKIP  %s  %s\n", r.Component, r.Detail)
+		case r.Passed():
+			fmt.Printf("PASS  %s  %s\n", r.Component, r.Detail)
+		default:
+			failed++
+			fmt.Printf("FAIL  %s\n      %v\n", r.Component, r.Err)
+		}
+	}
+	fmt.Printf("%d checks, %d failed\n", len(results)+1, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+// deployCommand runs "deploy generate", which writes a docker-compose file
+// or Kubernetes manifests for a stack running the given configuration.
+func deployCommand(args []string) int {
+	if len(args) == 0 || args[0] != "generate" {
+		slog.Error("Usage: deploy generate --format compose|kubernetes [--config FILE]")
+		return 2
+	}
+	fs := flag.NewFlagSet("deploy generate", flag.ExitOnError)
+	configFile := fs.String("config", flag.Lookup("config").Value.String(), "Path to the configuration file")
+	format := fs.String("format", "compose", "compose or kubernetes")
+	output := fs.String("output", "", "File to write; empty writes to standard output")
+	serverImage := fs.String("server-image", "mrvaserver:latest", "Server image")
+	agentImage := fs.String("agent-image", "ghcr.io/hohn/mrva-agent:0.1.24", "Agent image")
+	agents := fs.Int("agents", 2, "Number of agents")
+	replicas := fs.Int("replicas", 1, "Number of server replicas (kubernetes only)")
+	namespace := fs.String("namespace", "", "Kubernetes namespace; empty uses the current one")
+	storage := fs.String("storage-size", "10Gi", "Size of each Kubernetes volume claim")
+	fs.Parse(args[1:])
+
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		slog.Error("Failed to load configuration", "error", err)
+		return 1
+	}
+	data, err := os.ReadFile(*configFile)
+	if err != nil && !errors.Is(err, iofs.ErrNotExist) {
+		slog.Error("Failed to read configuration", "error", err)
+		return 1
+	}
+
+	w := os.Stdout
+	if *output != "" {
+		f, err := os.Create(*output)
+		if err != nil {
+			slog.Error("Failed to create output", "error", err)
+			return 1
+		}
+		defer f.Close()
+		w = f
+	}
+	err = manifest.Generate(w, cfg, manifest.Options{
+		Format:      *format,
+		ServerImage: *serverImage,
+		AgentImage:  *agentImage,
+		Agents:      *agents,
+		Replicas:    *replicas,
+		Namespace:   *namespace,
+		StorageSize: *storage,
+		Config:      data,
+	})
+	if err != nil {
+		slog.Error("Failed to generate deployment", "error", err)
+		return 1
+	}
+	return 0
+}
+
+// fakeagentCommand runs agents that return synthetic results without
+// running CodeQL, for load and correctness tests.  They connect with the
+// server's MRVA_RABBITMQ_* and ARTIFACT_MINIO_* environment variables.
+func fakeagentCommand(args []string) int {
+	fs := flag.NewFlagSet("fakeagent", flag.ExitOnError)
+	name := fs.String("name", "", "Agent name; empty uses fakeagent-HOSTNAME")
+	agents := fs.Int("agents", 1, "Number of agents, named NAME-1 .. NAME-N when more than one")
+	pool := fs.String("pool", agentproto.DefaultPool, "Agent pool whose queue to consume")
+	concurrency := fs.Int("concurrency", 16, "Jobs each agent works on at once")
+	delaySpec := fs.String("delay", "1s-5s", "Analysis time: DURATION, MIN-MAX, exp:MEAN or normal:MEAN,DEVIATION")
+	failRate := fs.Float64("fail-rate", 0, "Fraction of jobs that fail")
+	maxResults := fs.Int("max-results", 10, "Most synthetic results per job")
+	signingKey := fs.String("signing-key", "", "File holding the agents' private key for signing results")
+	serverKey := fs.String("server-key", "", "The server's base64 public key; jobs it did not sign are dropped")
+	fs.Parse(args)
+
+	delay, err := fakeagent.ParseDelay(*delaySpec)
+	if err != nil || *agents < 1 || *concurrency < 1 || *maxResults < 0 || *failRate < 0 || *failRate > 1 {
+		if err != nil {
+			slog.Error("Invalid flags", "error", err)
+		}
+		fs.Usage()
+		return 2
+	}
+	if *name == "" {
+		host, _ := os.Hostname()
+		*name = "fakeagent-" + host
+	}
+	var key ed25519.PrivateKey
+	var server ed25519.PublicKey
+	if *signingKey != "" {
+		if key, err = signing.LoadPrivateKey(*signingKey); err != nil {
+			slog.Error("Invalid flags", "error", err)
+			return 2
+		}
+	}
+	if *serverKey != "" {
+		if server, err = signing.ParsePublicKey(*serverKey); err != nil {
+			slog.Error("Invalid flags", "error", fmt.Errorf("invalid --server-key: %w", err))
+			return 2
+		}
+	}
+	url, err := rabbitmq.URLFromEnv()
+	if err != nil {
+		slog.Error("Failed to configure RabbitMQ", "error", err)
+		return 1
+	}
+	artifacts, err := deploy.InitMinIOArtifactStore()
+	if err != nil {
+		slog.Error("Failed to connect to artifact store", "error", err)
+		return 1
+	}
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	errs := make(chan error, *agents)
+	for i := 1; i <= *agents; i++ {
+		opts := fakeagent.Options{
+			URL:         url,
+			Name:        *name,
+			Pool:        *pool,
+			Concurrency: *concurrency,
+			Delay:       delay,
+			FailRate:    *failRate,
+			MaxResults:  *maxResults,
+			SigningKey:  key,
+			ServerKey:   server,
+		}
+		if *agents > 1 {
+			opts.Name = fmt.Sprintf("%s-%d", *name, i)
+		}
+		go func() { errs <- fakeagent.Run(ctx, opts, artifacts) }()
+	}
+	code := 0
+	for i := 0; i < *agents; i++ {
+		if err := <-errs; err != nil && !errors.Is(err, context.Canceled) {
+			slog.Error("Fake agent failed", "error", err)
+			stop()
+			code = 1
+		}
+	}
+	return code
+}
+
+// benchCommand submits synthetic sessions to a running server and reports
+// request latencies, throughput and how long the queue took to drain.
+// "bench compare" compares runs of the in-process benchmarks instead.
+func benchCommand(args []string) int {
+	if len(args) > 0 {
+		switch args[0] {
+		case "compare":
+			return benchCompareCommand(args[1:])
+		}
+	}
+	fs := flag.NewFlagSet("bench", flag.ExitOnError)
+	url := fs.String("url", "http://localhost:8080", "Base URL of the running server")
+	controller := fs.String("controller", "mrva/controller", "Controller repository as owner/repo")
+	repos := fs.String("repos", "", "Comma-separated owner/repo list each session analyzes")
+	language := fs.String("language", "cpp", "Query language")
+	sessions := fs.Int("sessions", 100, "Number of sessions to submit")
+	concurrency := fs.Int("concurrency", 10, "Requests in flight at once")
+	timeout := fs.Duration("timeout", 30*time.Minute, "How long to wait for the queue to drain")
+	poll := fs.Duration("poll", time.Second, "Status polling interval")
+	asJSON := fs.Bool("json", false, "Print the report as JSON")
+	fs.Parse(args)
+
+	if *repos == "" || *sessions < 1 || *concurrency < 1 {
+		fs.Usage()
+		return 2
+	}
+	report, err := bench.Run(bench.Options{
+		BaseURL:        *url,
+		ControllerRepo: *controller,
+		Repositories:   strings.Split(*repos, ","),
+		Language:       *language,
+		Sessions:       *sessions,
+		Concurrency:    *concurrency,
+		Timeout:        *timeout,
+		Poll:           *poll,
+	})
+	if err != nil {
+		slog.Error("Benchmark failed", "error", err)
+		return 1
+	}
+	report.Print(os.Stdout, *asJSON)
+	if !report.Drained {
+		return 1
+	}
+	return 0
+}
+
+// benchCompareCommand compares two files of `go test -bench` output, a
+// baseline and a change, and fails if a benchmark regressed by more than
+// --threshold percent.  The hot-path benchmarks run with
+//
+//	go test -run '^$' -bench . -benchmem -count 10 ./pkg/... > base.txt
+func benchCompareCommand(args []string) int {
+	fs := flag.NewFlagSet("bench compare", flag.ExitOnError)
+	threshold := fs.Float64("threshold", 10, "Allowed slowdown or allocation growth, in percent")
+	fs.Parse(args)
+	if fs.NArg() != 2 {
+		slog.Error("Usage: bench compare [--threshold PERCENT] BASE.txt HEAD.txt")
+		return 2
+	}
+
+	deltas, regressed, err := bench.Compare(fs.Arg(0), fs.Arg(1), *threshold)
+	if err != nil {
+		slog.Error("Failed to read benchmark results", "error", err)
+		return 1
+	}
+	bench.PrintDeltas(os.Stdout, deltas)
+	if regressed {
+		return 1
+	}
+	return 0
+}
+
+// keygenCommand prints a new key pair for sealed results: the public key
+// goes in submissions, the private key to decrypt.  With --signing it is
+// an Ed25519 pair for message signing instead.
+func keygenCommand(args []string) int {
+	fs := flag.NewFlagSet("keygen", flag.ExitOnError)
+	forSigning := fs.Bool("signing", false, "Make a message signing key pair")
+	fs.Parse(args)
+	generate := encryption.GenerateKey
+	if *forSigning {
+		generate = signing.GenerateKey
+	}
+	private, public, err := generate()
+	if err != nil {
+		slog.Error("Failed to generate key", "error", err)
+		return 1
+	}
+	fmt.Printf("public_key:  %s\nprivate_key: %s\n", public, private)
+	return 0
+}
+
+// decryptCommand opens a sealed result archive with the private key, or
+// the AES key, in --key.
+func decryptCommand(args []string) int {
+	fs := flag.NewFlagSet("decrypt", flag.ExitOnError)
+	keyFile := fs.String("key", "", "File holding the base64 private key or AES key")
+	out := fs.String("out", "", "Where to write the archive (default: standard output)")
+	fs.Parse(args)
+	if *keyFile == "" || fs.NArg() != 1 {
+		slog.Error("Usage: decrypt --key FILE [--out FILE] SEALED")
+		return 2
+	}
+
+	secret, err := os.ReadFile(*keyFile)
+	if err != nil {
+		slog.Error("Failed to read key", "error", err)
+		return 1
+	}
+	sealed, err := os.Open(fs.Arg(0))
+	if err != nil {
+		slog.Error("Failed to read sealed archive", "error", err)
+		return 1
+	}
+	defer sealed.Close()
+	dst := os.Stdout
+	if *out != "" {
+		if dst, err = os.OpenFile(*out, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600); err != nil {
+			slog.Error("Failed to write archive", "error", err)
+			return 1
+		}
+	}
+	err = encryption.Open(dst, strings.TrimSpace(string(secret)), sealed)
+	if *out != "" {
+		if cerr := dst.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			// An archive that did not open is not left half written.
+			os.Remove(*out)
+		}
+	}
+	if err != nil {
+		slog.Error("Failed to decrypt", "error", err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"os"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/gateway"
+)
+
+// faultInjector wraps the result handler and the artifact store to inject
+// faults, and mounts the admin endpoints that set them.  Only a server
+// built with the chaos tag has one (faults_chaos.go); otherwise everything
+// is left as it is.
+type faultInjector interface {
+	Results(agentproto.ResultHandler) agentproto.ResultHandler
+	Artifacts(artifactstore.Store) artifactstore.Store
+	gateway.AdminMounter
+}
+
+// postgresDSNs are the distinct Postgres databases the server uses, for
+// the state and for the metadata store.
+func postgresDSNs(state, metadata bool) []string {
+	var dsns []string
+	if state {
+		dsns = append(dsns, os.Getenv("MRVA_STATE_DSN"))
+	}
+	if dsn := os.Getenv("MRVA_STORE_DSN"); metadata && !(state && dsn == dsns[0]) {
+		dsns = append(dsns, dsn)
+	}
+	return dsns
+}
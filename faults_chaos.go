@@ -0,0 +1,14 @@
+//go:build chaos
+
+package main
+
+import (
+	"log/slog"
+
+	"mrvaserver/pkg/chaos"
+)
+
+func newFaultInjector(pgDSNs []string) faultInjector {
+	slog.Warn("Fault injection is built in; faults are set through /admin/chaos")
+	return chaos.New(pgDSNs)
+}
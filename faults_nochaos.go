@@ -0,0 +1,21 @@
+//go:build !chaos
+
+package main
+
+import (
+	"github.com/gorilla/mux"
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"mrvaserver/pkg/agentproto"
+)
+
+type noFaults struct{}
+
+func newFaultInjector(pgDSNs []string) faultInjector {
+	return noFaults{}
+}
+
+func (noFaults) Results(h agentproto.ResultHandler) agentproto.ResultHandler { return h }
+
+func (noFaults) Artifacts(s artifactstore.Store) artifactstore.Store { return s }
+
+func (noFaults) RegisterAdmin(r *mux.Router) {}
@@ -4,25 +4,114 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"log"
 	"log/slog"
+	"net/http"
 	"os"
 	"os/signal"
 	"path/filepath"
 	"syscall"
+	"time"
 
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/common"
 	"github.com/hohn/mrvacommander/pkg/deploy"
+	"github.com/hohn/mrvacommander/pkg/qldbstore"
 	"github.com/hohn/mrvacommander/pkg/server"
 	"github.com/hohn/mrvacommander/pkg/state"
+	"github.com/minio/minio-go/v7"
+	"mrvaserver/pkg/actions"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/annotations"
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/artifactstream"
+	"mrvaserver/pkg/avscan"
+	"mrvaserver/pkg/backend"
+	"mrvaserver/pkg/background"
+	"mrvaserver/pkg/backup"
+	"mrvaserver/pkg/cas"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/devstack"
+	"mrvaserver/pkg/diagnostics"
+	"mrvaserver/pkg/discovery"
+	"mrvaserver/pkg/dispatch"
+	"mrvaserver/pkg/dropfolder"
+	"mrvaserver/pkg/egress"
+	"mrvaserver/pkg/encryption"
+	"mrvaserver/pkg/errorreport"
+	"mrvaserver/pkg/etcd"
+	"mrvaserver/pkg/etcdstate"
+	"mrvaserver/pkg/findings"
+	"mrvaserver/pkg/flags"
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/ingest"
+	"mrvaserver/pkg/instance"
+	"mrvaserver/pkg/issues"
+	"mrvaserver/pkg/journal"
+	"mrvaserver/pkg/lameduck"
+	"mrvaserver/pkg/leader"
+	"mrvaserver/pkg/lease"
+	"mrvaserver/pkg/lock"
+	"mrvaserver/pkg/logsink"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/middleware"
+	"mrvaserver/pkg/mysqlstate"
+	"mrvaserver/pkg/netaddr"
+	"mrvaserver/pkg/notify"
+	"mrvaserver/pkg/packscan"
+	"mrvaserver/pkg/pgstate"
+	"mrvaserver/pkg/pool"
+	"mrvaserver/pkg/prefetch"
+	"mrvaserver/pkg/provenance"
+	"mrvaserver/pkg/quarantine"
+	"mrvaserver/pkg/queuestats"
+	"mrvaserver/pkg/quickquery"
+	"mrvaserver/pkg/quota"
+	"mrvaserver/pkg/rabbitmq"
+	"mrvaserver/pkg/readonly"
+	"mrvaserver/pkg/redis"
+	"mrvaserver/pkg/replication"
+	"mrvaserver/pkg/repostats"
+	"mrvaserver/pkg/resources"
+	"mrvaserver/pkg/retry"
+	"mrvaserver/pkg/sample"
+	"mrvaserver/pkg/sandbox"
+	"mrvaserver/pkg/schedule"
+	"mrvaserver/pkg/sessionid"
+	"mrvaserver/pkg/shard"
+	"mrvaserver/pkg/signing"
+	"mrvaserver/pkg/startup"
+	"mrvaserver/pkg/statecache"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/telemetry"
+	"mrvaserver/pkg/templates"
+	"mrvaserver/pkg/tenant"
+	"mrvaserver/pkg/throttle"
+	"mrvaserver/pkg/tiering"
+	"mrvaserver/pkg/toolchain"
+	"mrvaserver/pkg/trash"
+	"mrvaserver/pkg/usage"
+	"mrvaserver/pkg/usagereport"
+	"mrvaserver/pkg/usagestats"
 )
 
 func main() {
 	// Define flags
 	helpFlag := flag.Bool("help", false, "Display help message")
 	logLevel := flag.String("loglevel", "debug", "Set log level: debug, info, warn, error")
-	mode := flag.String("mode", "container", "Set mode: standalone, container, cluster")
+	mode := flag.String("mode", "container", "Set mode: standalone, container, cluster, devstack")
 	dbPathRoot := flag.String("dbpath", "", "Set the root path for the database store if using standalone mode.")
+	configFile := flag.String("config", "mrvaserver.yaml", "Path to the configuration file")
+	quickQuery := flag.Bool("quick-query", false, "Also accept single-repository quick queries on /quick-queries")
+	listen := flag.String("listen", "", "Public listen address, host:port or unix:/path (overrides http.listen)")
+	replaces := flag.String("replaces", "", "Instance ID or base URL of a replica to put in lame-duck mode once this one is serving")
+	devstackDir := flag.String("devstack-dir", ".devstack", "Directory of the devstack mode's state, artifacts and databases")
+	devstackAgents := flag.Int("devstack-agents", 1, "Number of in-process agents in devstack mode")
+	migrateAndExit := flag.Bool("migrate-and-exit", false, "Apply the state and metadata schema migrations, then exit (for init containers)")
 
 	// Custom usage function for the help flag
 	flag.Usage = func() {
@@ -30,6 +119,21 @@ func main() {
 		flag.PrintDefaults()
 		log.Println("\nExamples:")
 		log.Println("go run main.go --loglevel=debug --mode=container --dbpath=/path/to/db_dir")
+		log.Println("go run main.go --migrate-and-exit --config=mrvaserver.yaml")
+		log.Println("go run main.go --mode=devstack --devstack-dir=.devstack")
+		log.Println("\nCommands:")
+		log.Println("actions --url URL --language LANG --query-pack FILE [--repos-file FILE --repos OWNER/REPO,... --wait]")
+		log.Println("backup --dir DIR [--artifacts copy|reference]")
+		log.Println("restore --dir DIR")
+		log.Println("export-state --backend commander|postgres|mysql|etcd|journal --file BUNDLE")
+		log.Println("import-state --backend commander|postgres|mysql|etcd|journal --file BUNDLE [--verify]")
+		log.Println("config check [--config FILE]")
+		log.Println("fakeagent [--agents N --pool POOL --concurrency N --delay 1s-5s --fail-rate F]")
+		log.Println("keygen [--signing]")
+		log.Println("decrypt --key FILE [--out FILE] SEALED")
+		log.Println("bench --repos OWNER/REPO,... [--url URL --sessions N --concurrency N --json]")
+		log.Println("bench compare [--threshold PERCENT] BASE.txt HEAD.txt")
+		log.Println("deploy generate --format compose|kubernetes [--config FILE --output FILE --agents N]")
 	}
 
 	// Parse the flags
@@ -41,20 +145,31 @@ func main() {
 		return
 	}
 
+	// Bare IPv6 literals in the endpoint variables are bracketed before
+	// any client reads them.
+	netaddr.NormalizeEnv()
+
+	// Handle subcommands
+	if flag.NArg() > 0 {
+		os.Exit(runCommand(flag.Arg(0), flag.Args()[1:]))
+	}
+
 	// Apply 'loglevel' flag
+	var level slog.Level
 	switch *logLevel {
 	case "debug":
-		slog.SetLogLoggerLevel(slog.LevelDebug)
+		level = slog.LevelDebug
 	case "info":
-		slog.SetLogLoggerLevel(slog.LevelInfo)
+		level = slog.LevelInfo
 	case "warn":
-		slog.SetLogLoggerLevel(slog.LevelWarn)
+		level = slog.LevelWarn
 	case "error":
-		slog.SetLogLoggerLevel(slog.LevelError)
+		level = slog.LevelError
 	default:
-		log.Printf("Invalid logging verbosity level: %s", *logLevel)
+		slog.Error("Invalid logging verbosity level", "level", *logLevel)
 		os.Exit(1)
 	}
+	slog.SetLogLoggerLevel(level)
 
 	// Process database root if standalone and not provided
 	if *mode == "standalone" && *dbPathRoot == "" {
@@ -70,13 +185,35 @@ func main() {
 		slog.Info("Using default database root path", "dbPathRoot", *dbPathRoot)
 	}
 
-	// // Read configuration
-	// config := mcc.LoadConfig("mcconfig.toml")
+	// Read configuration
+	cfg, err := config.Load(*configFile)
+	if err != nil {
+		slog.Error("Failed to load configuration", slog.Any("error", err))
+		os.Exit(1)
+	}
+	if err := egress.Install(cfg.Egress); err != nil {
+		slog.Error("Failed to configure outbound HTTP", slog.Any("error", err))
+		os.Exit(1)
+	}
+	var reporter *errorreport.Reporter
+	var reportLogs []slog.Handler
+	if cfg.Errors.Enabled {
+		reporter, err = errorreport.New(cfg.Errors)
+		if err != nil {
+			slog.Error("Failed to set up error reporting", slog.Any("error", err))
+			os.Exit(1)
+		}
+		defer reporter.Close()
+		reportLogs = append(reportLogs, reporter.Handler())
+	}
+	closeLogs, err := logsink.Setup(cfg.Logging, level, reportLogs...)
+	if err != nil {
+		slog.Error("Failed to set up logging", slog.Any("error", err))
+		os.Exit(1)
+	}
+	defer closeLogs()
 
-	// Output configuration summary
-	log.Printf("Help: %t\n", *helpFlag)
-	log.Printf("Log Level: %s\n", *logLevel)
-	log.Printf("Mode: %s\n", *mode)
+	slog.Info("Starting mrvaserver", "mode", *mode, "log_level", *logLevel)
 
 	// Handle signals
 	sigChan := make(chan os.Signal, 1)
@@ -88,28 +225,496 @@ func main() {
 		slog.Error("--mode standalone is deprecated. Allowed values are: container, cluster")
 		os.Exit(1)
 
-	case "container":
-		isAgent := false
+	case "container", "devstack":
+		// Devstack mode is container mode with embedded substitutes for
+		// every external service.
+		devstackMode := *mode == "devstack"
+		// A read-only replica serves reads from databases that may be read
+		// replicas, and writes nothing.
+		readOnly := cfg.ReadOnly.Enabled
+		if readOnly && *migrateAndExit {
+			slog.Error("--migrate-and-exit cannot apply migrations on a read-only replica")
+			os.Exit(1)
+		}
+		if devstackMode {
+			if err := devstack.Setup(cfg, *devstackDir, *devstackAgents); err != nil {
+				slog.Error("Failed to set up devstack", slog.Any("error", err))
+				os.Exit(1)
+			}
+		}
+
+		// The probe listener reports the startup phases until the public
+		// listener opens.
+		tracker := startup.New()
+		if cfg.HTTP.ProbeListen != "" && !*migrateAndExit {
+			go func() {
+				if err := tracker.ListenAndServe(cfg.HTTP.ProbeListen); err != nil {
+					slog.Error("Error starting probe listener", slog.Any("error", err))
+					os.Exit(1)
+				}
+			}()
+		}
+		tracker.Phase("state")
+
+		// Clients of backing services reset their connections when the
+		// services' addresses change.
+		watcher := discovery.New()
+
+		// The etcd backend keeps the metadata and locks in etcd too, so a
+		// deployment needs no Postgres.
+		var etcdClient *etcd.Client
+		if cfg.State.Backend == "etcd" {
+			etcdClient, err = etcd.FromEnv()
+			if err != nil {
+				slog.Error("Failed to initialize state", slog.Any("error", err))
+				os.Exit(1)
+			}
+			for _, e := range etcdClient.Endpoints() {
+				watcher.WatchURL("etcd", e, etcdClient.ResetConnections)
+			}
+		}
+
+		var serverState state.ServerState
+		switch cfg.State.Backend {
+		case "postgres":
+			newState := pgstate.New
+			if readOnly {
+				newState = pgstate.NewReadOnly
+			}
+			pgState, err := newState(context.Background(), os.Getenv("MRVA_STATE_DSN"))
+			if err != nil {
+				slog.Error("Failed to initialize state", slog.Any("error", err))
+				os.Exit(1)
+			}
+			defer pgState.Close()
+			watcher.WatchDSN("state", os.Getenv("MRVA_STATE_DSN"), pgState.ResetConnections)
+			serverState = pgState
+		case "mysql":
+			myState, err := mysqlstate.New(context.Background(), os.Getenv("MRVA_STATE_DSN"))
+			if err != nil {
+				slog.Error("Failed to initialize state", slog.Any("error", err))
+				os.Exit(1)
+			}
+			defer myState.Close()
+			serverState = myState
+		case "etcd":
+			serverState = etcdstate.New(etcdClient, cfg.State.EtcdPrefix)
+		case "journal":
+			journaled, err := journal.Open(cfg.State.JournalFile, cfg.State.JournalSync)
+			if err != nil {
+				slog.Error("Failed to initialize state", slog.Any("error", err))
+				os.Exit(1)
+			}
+			defer journaled.Close()
+			serverState = journaled
+		case "commander":
+			serverState = state.NewPGState()
+		default:
+			serverState, err = backend.OpenState(context.Background(), cfg.State.Backend)
+			if err != nil {
+				slog.Error("Failed to initialize state", slog.Any("error", err))
+				os.Exit(1)
+			}
+			if c, ok := serverState.(interface{ Close() }); ok {
+				defer c.Close()
+			}
+		}
+
+		// mrvaserver's own metadata lives in the same database as the
+		// commander state unless MRVA_STORE_DSN says otherwise.
+		tracker.Phase("metadata")
+		var metadata store.Store
+		if devstackMode {
+			metadata = store.NewMemoryStore()
+		} else if etcdClient != nil {
+			metadata = store.NewEtcdStore(etcdClient, cfg.State.EtcdPrefix)
+		} else {
+			newStore := store.NewPostgresStore
+			if readOnly {
+				newStore = store.NewReadOnlyPostgresStore
+			}
+			pgStore, err := newStore(context.Background(), os.Getenv("MRVA_STORE_DSN"))
+			if err != nil {
+				slog.Error("Failed to initialize metadata store", slog.Any("error", err))
+				os.Exit(1)
+			}
+			watcher.WatchDSN("metadata", os.Getenv("MRVA_STORE_DSN"), pgStore.ResetConnections)
+			metadata = pgStore
+		}
+		defer metadata.Close()
+
+		// Creating the state and metadata stores applied their migrations.
+		if *migrateAndExit {
+			slog.Info("Migrations applied", "state", cfg.State.Backend)
+			return
+		}
+
+		tracker.Phase("backends")
+		faults := newFaultInjector(postgresDSNs(cfg.State.Backend == "postgres", !devstackMode && etcdClient == nil))
+
+		if cfg.Cache.Enabled {
+			rc, err := redis.FromEnv()
+			if err != nil {
+				slog.Error("Failed to initialize state cache", slog.Any("error", err))
+				os.Exit(1)
+			}
+			defer rc.Close()
+			watcher.Watch("redis", rc.Addr(), rc.ResetConnections)
+			serverState = statecache.New(serverState, rc, cfg.Cache.TTL)
+			slog.Info("State cache enabled", "ttl", cfg.Cache.TTL)
+		}
+
+		// Results are applied to state by the queue's consumer pool, in
+		// batches, rather than by the commander's single consumer loop.
+		batcher := ingest.NewBatcher(cfg.Ingest, serverState)
+		var handleResult agentproto.ResultHandler = batcher.Handle
+
+		// Artifact and database transfers share the configured bandwidth.
+		var limit *throttle.Throttle
+		if cfg.Bandwidth.Enabled {
+			limit = throttle.New(cfg.Bandwidth)
+		}
+
+		var replicator *replication.Replicator
+		if cfg.Replication.Enabled {
+			replicator, err = initReplication(cfg.Replication)
+			if err != nil {
+				slog.Error("Failed to initialize artifact replication", slog.Any("error", err))
+				os.Exit(1)
+			}
+			replicator.SetThrottle(limit)
+			handleResult = func(r agentproto.Result) error {
+				if err := batcher.Handle(r); err != nil {
+					return err
+				}
+				if r.ResultLocation.Key != "" {
+					replicator.Enqueue(r.ResultLocation)
+				}
+				return nil
+			}
+		}
+
+		// Results are counted and measured as they are ingested, in their
+		// final place.
+		summaries := ingest.NewSummarizer(metadata)
+		handleResult = summaries.HandleResult(handleResult)
+
+		// Anonymized usage statistics are collected and sent only if the
+		// operator opts in.
+		var usageStats *usagestats.Reporter
+		if cfg.UsageStats.Enabled {
+			usageStats = usagestats.New(cfg, metadata)
+			handleResult = usageStats.HandleResult(handleResult)
+		}
+
+		// Query packs and results are stored once per content, and
+		// results move there before they are recorded.
+		var casStore *cas.Store
+		if cfg.CAS.Enabled {
+			mc, err := backup.ArtifactClient()
+			if err == nil {
+				casStore, err = cas.New(cfg.CAS, mc, metadata)
+			}
+			if err != nil {
+				slog.Error("Failed to initialize content-addressed storage", slog.Any("error", err))
+				os.Exit(1)
+			}
+			handleResult = casStore.HandleResult(handleResult)
+		}
+
+		// Artifacts of sessions left alone for long move to a cold tier
+		// and come back when read.
+		var tierer *tiering.Tierer
+		if cfg.Tiering.Enabled {
+			mc, err := backup.ArtifactClient()
+			if err == nil {
+				tierer, err = tiering.New(cfg.Tiering, mc, metadata, serverState)
+			}
+			if err != nil {
+				slog.Error("Failed to initialize artifact tiering", slog.Any("error", err))
+				os.Exit(1)
+			}
+			handleResult = tierer.HandleResult(handleResult)
+		}
+
+		// Storage is accounted per session and user, and results over
+		// their caps are rejected before they are stored for good.
+		var accountant *usage.Accountant
+		if cfg.Usage.Enabled {
+			mc, err := backup.ArtifactClient()
+			if err != nil {
+				slog.Error("Failed to initialize usage accounting", slog.Any("error", err))
+				os.Exit(1)
+			}
+			accountant = usage.New(cfg.Usage, metadata, mc)
+			handleResult = accountant.HandleResult(handleResult)
+		}
+
+		// Status ETags cover what the metadata store adds to a session's
+		// status; those keeping it touch the session when it changes.
+		metaVersions := gateway.NewMetadataVersions(metadata)
+
+		// Results of sessions submitted with a key are sealed before
+		// anything else stores or accounts for them.
+		var keys *encryption.Keys
+		if cfg.Encryption.Enabled {
+			mc, err := backup.ArtifactClient()
+			if err != nil {
+				slog.Error("Failed to initialize result encryption", slog.Any("error", err))
+				os.Exit(1)
+			}
+			keys, err = encryption.New(cfg.Encryption, mc, metadata)
+			if err != nil {
+				slog.Error("Failed to initialize result encryption", slog.Any("error", err))
+				os.Exit(1)
+			}
+			keys.SetVersions(metaVersions)
+			handleResult = keys.HandleResult(handleResult)
+		}
+
+		// Deleted sessions wait in the trash for their grace period, their
+		// artifacts tagged, before they are purged.
+		var trashMC *minio.Client
+		if cfg.Artifacts.Backend == "minio" {
+			if trashMC, err = backup.ArtifactClient(); err != nil {
+				slog.Warn("Artifacts of deleted sessions will not be tagged or removed", slog.Any("error", err))
+			}
+		}
+		shards := shard.New(metadata)
+		bin := trash.New(cfg.Trash, trashMC, metadata, serverState)
+		bin.SetShards(shards)
+		if casStore != nil {
+			bin.SetCAS(casStore)
+		}
+
+		// Agents that take leases get their jobs requeued if they stop
+		// renewing them.  The lease manager also tracks attempts, so it is
+		// used for retries even when leases are off.
+		var jobQueue backend.Queue
+		leases := lease.New(cfg.Leases, serverState, metadata, func(job agentproto.Job) error {
+			return jobQueue.Requeue(job)
+		})
+
+		// New jobs are held in a backlog and released to the agents' queues
+		// a window at a time.
+		dispatcher := dispatch.New(cfg.Dispatch, serverState, metadata, func(job agentproto.Job) error {
+			return jobQueue.Publish(job)
+		})
+		dispatcher.SetShards(shards)
+		dispatcher.SetVersions(metaVersions)
+		handleResult = dispatcher.HandleResult(handleResult)
+		leases.SetDrain(dispatcher.Draining)
+
+		// New subsystems are gated by feature flags, settable at run time.
+		featureFlags, err := flags.New(cfg.Flags, metadata)
+		if err != nil {
+			slog.Error("Failed to initialize feature flags", slog.Any("error", err))
+			os.Exit(1)
+		}
+		dispatcher.SetFlags(featureFlags)
+
+		// Jobs carry the agent image and CodeQL bundle of their language;
+		// the outcomes of canary releases are compared with stable ones'.
+		chains, err := toolchain.New(cfg.Toolchains, metadata)
+		if err != nil {
+			slog.Error("Failed to initialize toolchains", slog.Any("error", err))
+			os.Exit(1)
+		}
+		durations := func(js common.JobSpec) (time.Duration, bool) {
+			t, err := dispatcher.Timing(context.Background(), js)
+			return t.Duration(), err == nil
+		}
+		chains.SetDurations(durations)
+		handleResult = chains.HandleResult(handleResult)
+		repoStats := repostats.New(cfg.RepoStats, metadata)
+		repoStats.SetDurations(durations)
+		handleResult = repoStats.HandleResult(handleResult)
+
+		// Failures are retried according to their failure class.
+		retries := retry.New(cfg.Retries, serverState, metadata, leases, dispatcher)
+		handleResult = retries.HandleResult(handleResult)
+		if cfg.Leases.Enabled {
+			handleResult = leases.HandleResult(handleResult)
+		}
+
+		// Results must attest to the jobs' sandbox before the retry policy
+		// sees them, so that unattested ones are retried as failures.
+		if cfg.Sandbox.Enabled && cfg.Sandbox.Require {
+			handleResult = sandbox.Verify(cfg.Sandbox, handleResult)
+		}
+
+		// Redelivered and out-of-date results are dropped before they reach
+		// the lease manager or the state.
+		// Provenance and query telemetry are recorded for results that
+		// are not dropped.
+		handleResult = provenance.Record(metadata, handleResult)
+		handleResult = telemetry.Record(metadata, handleResult)
+		handleResult = ingest.Dedup(metadata, leases.Attempt, handleResult)
+		handleResult = faults.Results(handleResult)
 
-		rabbitMQQueue, err := deploy.InitRabbitMQ(isAgent)
+		// Jobs are routed to agent pools by their constraints.
+		router, err := pool.NewRouter(cfg.Routing, metadata)
 		if err != nil {
-			slog.Error("Failed to initialize RabbitMQ", slog.Any("error", err))
+			slog.Error("Failed to initialize job routing", slog.Any("error", err))
 			os.Exit(1)
 		}
-		defer rabbitMQQueue.Close()
 
-		artifacts, err := deploy.InitMinIOArtifactStore()
+		// Agent pools, quotas, retention policies and schedules may also be
+		// declared as resources, for infrastructure-as-code tools to manage.
+		declared := resources.New(metadata)
+		router.SetResources(declared)
+		quotas := quota.New(declared)
+		tenants := tenant.New(cfg, declared, metadata)
+		if accountant != nil {
+			accountant.SetUserCaps(func(ctx context.Context, user string) (int64, bool) {
+				if n, ok := tenants.UserCap(ctx, user); ok {
+					return n, true
+				}
+				return quotas.StorageCap(ctx, user)
+			})
+			accountant.SetSessionCaps(tenants.SessionCap)
+		}
+		scheduler := schedule.New(declared, metadata)
+
+		var queueStats *queuestats.Handler
+		var quarantined *quarantine.Quarantine
+		if readOnly {
+			jobQueue = readonly.Queue{}
+		} else if cfg.Queue.Backend == "rabbitmq" {
+			rabbitMQQueue, err := rabbitmq.Init(cfg.Queue, handleResult)
+			if err != nil {
+				slog.Error("Failed to initialize RabbitMQ", slog.Any("error", err))
+				os.Exit(1)
+			}
+			defer rabbitMQQueue.Close()
+			jobQueue = rabbitMQQueue
+			watcher.Watch("rabbitmq", os.Getenv("MRVA_RABBITMQ_HOST"), rabbitMQQueue.ResetConnections)
+
+			rabbitMQQueue.SetRouter(router)
+			rabbitMQQueue.SetDispatcher(dispatcher)
+			dispatcher.SetRoute(router.Route)
+			rabbitMQQueue.SetToolchains(chains)
+			if cfg.Sandbox.Enabled {
+				rabbitMQQueue.SetSandbox(sandbox.Policy(cfg.Sandbox))
+			}
+			if cfg.Signing.Enabled {
+				signer, verifier, err := initSigning(cfg.Signing)
+				if err != nil {
+					slog.Error("Failed to initialize message signing", slog.Any("error", err))
+					os.Exit(1)
+				}
+				rabbitMQQueue.SetSigning(signer, verifier)
+			}
+			if err := rabbitMQQueue.ConsumeAgents(router.HandleAgent); err != nil {
+				slog.Error("Failed to initialize RabbitMQ", slog.Any("error", err))
+				os.Exit(1)
+			}
+			if cfg.Leases.Enabled {
+				if err := rabbitMQQueue.ConsumeLeases(cfg.Leases.TTL, leases.Handle); err != nil {
+					slog.Error("Failed to initialize RabbitMQ", slog.Any("error", err))
+					os.Exit(1)
+				}
+			}
+			mgmt, err := rabbitmq.NewManagement(cfg.Queue.ManagementURL)
+			if err != nil {
+				slog.Error("Failed to initialize RabbitMQ", slog.Any("error", err))
+				os.Exit(1)
+			}
+			queueStats = queuestats.New("rabbitmq-management", mgmt)
+
+			// Poison messages are set aside for inspection rather than
+			// dropped or redelivered for ever.
+			if cfg.Queue.Quarantine.Enabled {
+				mc, err := backup.ArtifactClient()
+				if err == nil {
+					quarantined, err = quarantine.New(cfg.Queue.Quarantine, mc, metadata)
+				}
+				if err != nil {
+					slog.Error("Failed to initialize message quarantine", slog.Any("error", err))
+					os.Exit(1)
+				}
+				quarantined.SetRedriver(rabbitMQQueue)
+				rabbitMQQueue.SetQuarantine(quarantined)
+			}
+		} else {
+			tracker := queuestats.NewTracker(cfg.Queue.Backend)
+			jobQueue, err = backend.OpenQueue(context.Background(), cfg.Queue.Backend, tracker.HandleResult(handleResult))
+			if err != nil {
+				slog.Error("Failed to initialize queue", "backend", cfg.Queue.Backend, slog.Any("error", err))
+				os.Exit(1)
+			}
+			defer jobQueue.Close()
+			jobQueue = tracker.Wrap(jobQueue)
+			go tracker.Run(context.Background())
+			queueStats = queuestats.New("tracked", tracker)
+			if cfg.Leases.Enabled {
+				slog.Warn("Job leases are only tracked with the rabbitmq queue", "backend", cfg.Queue.Backend)
+			}
+			if cfg.Sandbox.Enabled {
+				slog.Warn("Sandbox policies are only sent with the rabbitmq queue", "backend", cfg.Queue.Backend)
+			}
+			if cfg.Signing.Enabled {
+				slog.Warn("Messages are only signed with the rabbitmq queue", "backend", cfg.Queue.Backend)
+			}
+		}
+
+		var artifacts artifactstore.Store
+		if cfg.Artifacts.Backend == "minio" {
+			artifacts, err = deploy.InitMinIOArtifactStore()
+			if err == nil {
+				var mc *minio.Client
+				if mc, err = backup.ArtifactClient(); err == nil {
+					artifacts = artifactstream.MinIO(artifacts, mc)
+				}
+			}
+		} else {
+			artifacts, err = backend.OpenArtifacts(context.Background(), cfg.Artifacts.Backend)
+		}
 		if err != nil {
 			slog.Error("Failed to initialize artifact store", slog.Any("error", err))
 			os.Exit(1)
 		}
+		if casStore != nil {
+			artifacts = cas.NewArtifacts(casStore, artifacts)
+		}
+		if tierer != nil {
+			artifacts = tiering.NewArtifacts(tierer, artifacts)
+		}
+		if accountant != nil {
+			artifacts = usage.NewArtifacts(accountant, artifacts)
+		}
+		artifacts = faults.Artifacts(artifacts)
+		summaries.SetArtifacts(artifacts)
 
-		databases, err := deploy.InitHEPCDatabaseStore()
+		var databases qldbstore.Store
+		if cfg.Databases.Backend == "hepc" {
+			databases, err = deploy.InitHEPCDatabaseStore()
+		} else {
+			databases, err = backend.OpenDatabases(context.Background(), cfg.Databases.Backend)
+		}
 		if err != nil {
 			slog.Error("Failed to initialize database store", slog.Any("error", err))
 			os.Exit(1)
 		}
 
+		// Databases are staged near the agents while their jobs wait.
+		var stager *prefetch.Stager
+		if cfg.Prefetch.Enabled {
+			mc, err := backup.ArtifactClient()
+			if err == nil {
+				stager, err = prefetch.New(cfg.Prefetch, databases, mc)
+			}
+			if err != nil {
+				slog.Error("Failed to initialize database prefetch", slog.Any("error", err))
+				os.Exit(1)
+			}
+			stager.SetThrottle(limit)
+			if cfg.MalwareScan.Enabled && cfg.MalwareScan.Databases {
+				stager.SetScanner(avscan.New(cfg.MalwareScan))
+			}
+			dispatcher.SetStager(stager)
+		}
+
 		// server.NewCommanderSingle(&server.Visibles{
 		// 	Queue:         rabbitMQQueue,
 		// 	State:         state.NewLocalState(config.Storage.StartingID),
@@ -117,19 +722,518 @@ func main() {
 		// 	CodeQLDBStore: databases,
 		// })
 
-		server.NewCommanderSingle(&server.Visibles{
-			Queue:         rabbitMQQueue,
-			State:         state.NewPGState(),
+		// Background tasks run on one replica at a time, coordinated
+		// through advisory locks in the metadata database.
+		var locker lock.Locker
+		if devstackMode || readOnly {
+			locker = lock.NewLocalLocker()
+		} else if etcdClient != nil {
+			locker = lock.NewEtcdLocker(etcdClient, cfg.State.EtcdPrefix)
+		} else {
+			pgLocker, err := lock.NewPostgresLocker(context.Background(), os.Getenv("MRVA_STORE_DSN"))
+			if err != nil {
+				slog.Error("Failed to initialize locks", slog.Any("error", err))
+				os.Exit(1)
+			}
+			defer pgLocker.Close()
+			watcher.WatchDSN("locks", os.Getenv("MRVA_STORE_DSN"), pgLocker.ResetConnections)
+			locker = pgLocker
+		}
+		runner := background.NewRunner(locker)
+		runner.SetLoops(cfg.Loops)
+
+		var elector leader.Elector
+		switch cfg.Leader.Backend {
+		case "kubernetes":
+			elector, err = leader.NewKubernetesElector(cfg.Leader.Namespace, cfg.Leader.LeaseName,
+				instance.ID(), cfg.Leader.LeaseDuration)
+			if err != nil {
+				slog.Error("Failed to initialize leader election", slog.Any("error", err))
+				os.Exit(1)
+			}
+		default:
+			elector = leader.NewLockElector(locker, cfg.Leader.LeaseDuration)
+		}
+		runner.SetElector(elector)
+		// The reaper, tiering, the findings index and the trash tasks run
+		// together on the leader: retention and purging act on the same
+		// trash, and a replica that loses leadership stops all of them at
+		// once.
+		if cfg.Leases.Enabled {
+			runner.Add(background.Task{
+				Name:       "lease-reaper",
+				Interval:   cfg.Leases.ReapInterval,
+				Run:        leases.Reap,
+				LeaderOnly: true,
+			})
+		}
+		runner.Add(background.Task{
+			Name:     "dispatch-reconcile",
+			Interval: 6 * cfg.Dispatch.Interval,
+			Run:      dispatcher.Reconcile,
+		})
+		runner.Add(background.Task{
+			Name:     "retry-dispatch",
+			Interval: cfg.Retries.Interval,
+			Run:      retries.Dispatch,
+		})
+		if stager != nil {
+			runner.Add(background.Task{
+				Name:     "prefetch-prune",
+				Interval: time.Hour,
+				Run:      stager.Prune,
+			})
+		}
+		if casStore != nil {
+			runner.Add(background.Task{
+				Name:     "cas-sweep",
+				Interval: cfg.CAS.SweepInterval,
+				Run:      casStore.Sweep,
+			})
+		}
+		if tierer != nil {
+			runner.Add(background.Task{
+				Name:       "artifact-tiering",
+				Interval:   cfg.Tiering.Interval,
+				Run:        tierer.Run,
+				LeaderOnly: true,
+			})
+		}
+		found := findings.New(metadata, serverState, artifacts)
+		found.SetShards(shards)
+		found.SetVersions(metaVersions)
+		runner.Add(background.Task{
+			Name:       "findings-index",
+			Interval:   cfg.Findings.IndexInterval,
+			Run:        found.Index,
+			LeaderOnly: true,
+		})
+		runner.Add(background.Task{
+			Name:       "trash-purge",
+			Interval:   cfg.Trash.PurgeInterval,
+			Run:        bin.Purge,
+			LeaderOnly: true,
+		})
+		runner.Add(background.Task{
+			Name:       "retention",
+			Interval:   cfg.Trash.PurgeInterval,
+			Run:        bin.Expire,
+			LeaderOnly: true,
+		})
+		runner.Add(background.Task{
+			Name:     "scheduled-analyses",
+			Interval: schedule.Interval,
+			Run:      scheduler.Run,
+		})
+		if replicator != nil {
+			runner.Add(background.Task{
+				Name:     "artifact-replication",
+				Interval: cfg.Replication.Interval,
+				Run:      replicator.Reconcile,
+			})
+		}
+
+		// Each week's or month's usage is reported, per tenant, for
+		// capacity planning.
+		var reports *usagereport.Reporter
+		if cfg.Reports.Enabled {
+			mc, err := backup.ArtifactClient()
+			if err == nil {
+				reports, err = usagereport.New(cfg.Reports, mc, metadata, serverState)
+			}
+			if err != nil {
+				slog.Error("Failed to initialize usage reports", slog.Any("error", err))
+				os.Exit(1)
+			}
+			if accountant != nil {
+				reports.SetUsage(accountant)
+			}
+			reports.SetTenants(tenants.Owner)
+			reports.SetDurations(durations)
+			runner.Add(background.Task{
+				Name:     "usage-reports",
+				Interval: usagereport.Interval,
+				Run:      reports.Run,
+			})
+		}
+
+		// The gateway takes over the public port; the commander moves to an
+		// internal one and is reached through the gateway's proxy.
+		publicPort := os.Getenv("SERVER_PORT")
+		if publicPort == "" {
+			publicPort = "8080"
+		}
+		commanderPort := os.Getenv("MRVA_COMMANDER_PORT")
+		if commanderPort == "" {
+			commanderPort = "8081"
+		}
+		os.Setenv("SERVER_PORT", commanderPort)
+
+		visibles := &server.Visibles{
+			Queue:         jobQueue,
+			State:         serverState,
 			Artifacts:     artifacts,
 			CodeQLDBStore: databases,
+		}
+		server.NewCommanderSingle(visibles)
+
+		gw, err := gateway.New(visibles, "localhost:"+commanderPort)
+		if err != nil {
+			slog.Error("Failed to initialize gateway", slog.Any("error", err))
+			os.Exit(1)
+		}
+		// Callers with a known bearer token are authenticated; the admin
+		// control endpoints answer only the configured admins.
+		tokens, err := middleware.LoadTokens(cfg.HTTP.Auth)
+		if err != nil {
+			slog.Error("Failed to load API tokens", slog.Any("error", err))
+			os.Exit(1)
+		}
+		gw.SetAdminAuth(middleware.RequireAdmin(cfg.HTTP.Auth))
+		gw.SetResultSizes(summaries)
+		gw.SetCaching(cfg.HTTP.Caching)
+		gw.SetMetadataVersions(metaVersions)
+		// Downloads are streamed rather than read whole by the commander.
+		downloads := artifactstream.NewServer(artifacts, cfg.HTTP.Downloads)
+		gw.SetDownloads(downloads)
+		gw.SetFlags(featureFlags)
+		gw.OnRepoTask(summaries.RepoTaskHook)
+		// Dry runs size databases through the database store if it can
+		// tell, else from their staged copies.
+		dbSizes, _ := databases.(gateway.DatabaseSizes)
+		if dbSizes == nil && stager != nil {
+			dbSizes = stager
+		}
+		gw.SetEstimates(dbSizes, dispatcher)
+		gw.SetSessions(cfg.Sessions, shards)
+		gw.Mount(shards)
+		gw.Mount(metrics.Default)
+		tpl := templates.New(metadata)
+		gw.Mount(tpl)
+		gw.OnSubmit(tpl.SubmitHook)
+		if cfg.PackScan.Enabled {
+			scanner, err := packscan.New(cfg.PackScan)
+			if err != nil {
+				slog.Error("Failed to initialize query pack scanning", slog.Any("error", err))
+				os.Exit(1)
+			}
+			gw.OnSubmit(scanner.SubmitHook)
+		}
+		if cfg.MalwareScan.Enabled {
+			gw.OnSubmit(avscan.New(cfg.MalwareScan).SubmitHook)
+		}
+		gw.Mount(repoStats)
+		gw.MountAdmin(repoStats)
+		gw.OnSubmit(repoStats.SubmitHook)
+		dbTimes, _ := databases.(sample.DatabaseTimes)
+		sampler := sample.New(metadata, serverState, artifacts, dbSizes, dbTimes, gw)
+		sampler.SetShards(shards)
+		sampler.SetVersions(metaVersions)
+		gw.Mount(sampler)
+		gw.OnSubmit(sampler.SubmitHook)
+		gw.OnSubmit(quotas.SubmitHook)
+		gw.OnSubmit(tenants.SubmitHook)
+		gw.MountAdmin(tenants)
+		if reports != nil {
+			gw.MountAdmin(reports)
+		}
+		if usageStats != nil {
+			gw.MountAdmin(usageStats)
+			gw.OnSubmit(usageStats.SubmitHook)
+		}
+		gw.OnVariantAnalysis(sampler.VariantAnalysisHook)
+		gw.MountAdmin(router)
+		gw.Mount(chains)
+		gw.MountAdmin(chains)
+		gw.MountAdmin(featureFlags)
+		gw.MountAdmin(leases)
+		gw.OnRepoTask(leases.RepoTaskHook)
+		gw.Mount(dispatcher)
+		gw.MountAdmin(dispatcher)
+		if queueStats != nil {
+			gw.MountAdmin(queueStats)
+		}
+		if quarantined != nil {
+			gw.MountAdmin(quarantined)
+		}
+		gw.OnRepoTask(dispatcher.RepoTaskHook)
+		gw.OnVariantAnalysis(dispatcher.VariantAnalysisHook)
+		gw.Mount(bin)
+		gw.MountAdmin(bin)
+		exporter := provenance.NewExporter(metadata, serverState, artifacts)
+		exporter.SetShards(shards)
+		gw.Mount(exporter)
+		gw.Mount(provenance.NewReplayer(metadata, exporter, gw))
+		gw.Mount(actions.New(gw))
+		gw.Mount(telemetry.New(metadata))
+		gw.Mount(found)
+		gw.OnSubmit(found.SubmitHook)
+		gw.OnRepoTask(found.RepoTaskHook)
+		if len(cfg.Issues.Trackers) > 0 {
+			filer, err := issues.New(cfg.Issues, metadata, found)
+			if err != nil {
+				slog.Error("Failed to initialize issue trackers", slog.Any("error", err))
+				os.Exit(1)
+			}
+			filer.SetTrackers(tenants.Trackers)
+			gw.Mount(filer)
+		}
+		if stager != nil {
+			gw.Mount(stager)
+		}
+		// The router records a session's routing before the dispatcher
+		// releases its jobs, After functions running in reverse.
+		gw.OnSubmit(dispatcher.SubmitHook)
+		gw.OnSubmit(router.SubmitHook)
+		ids := sessionid.New(metadata)
+		ids.SetVersions(metaVersions)
+		gw.OnSubmit(ids.SubmitHook)
+		gw.OnVariantAnalysis(ids.VariantAnalysisHook)
+
+		// Tenants are told when their sessions complete, at the webhook
+		// their settings or the configuration name.
+		notifier, err := notify.New(cfg.Notifications, serverState, metadata)
+		if err != nil {
+			slog.Error("Failed to initialize notifications", slog.Any("error", err))
+			os.Exit(1)
+		}
+		notifier.SetTargets(tenants.Notifications)
+		notifier.SetNames(ids)
+		gw.OnSubmit(notifier.SubmitHook)
+		runner.Add(background.Task{
+			Name:     "notifications",
+			Interval: notify.Interval,
+			Run:      notifier.Run,
+		})
+		notes := annotations.New(metadata, serverState)
+		notes.SetShards(shards)
+		notes.SetVersions(metaVersions)
+		gw.Mount(notes)
+		gw.OnSubmit(notes.SubmitHook)
+		gw.OnVariantAnalysis(notes.VariantAnalysisHook)
+		bin.SetRetention(declared, func(ctx context.Context, session int) (map[string]string, error) {
+			a, err := notes.Get(ctx, session)
+			if errors.Is(err, store.ErrNotFound) {
+				return nil, nil
+			}
+			return a.Tags, err
 		})
+		bin.SetTenantRetention(tenants.Retention)
+		gw.MountAdmin(declared)
+		scheduler.SetSubmitter(gw)
+		if keys != nil {
+			gw.OnSubmit(keys.SubmitHook)
+			gw.OnVariantAnalysis(keys.VariantAnalysisHook)
+		}
+		if accountant != nil {
+			gw.Mount(accountant)
+			gw.MountAdmin(accountant)
+			gw.OnSubmit(accountant.SubmitHook)
+			gw.OnRepoTask(accountant.RepoTaskHook)
+		}
+		if *quickQuery {
+			gw.Mount(quickquery.NewBroker(visibles, downloads))
+			slog.Info("Quick query mode enabled")
+		}
 
-		slog.Info("Started server in container mode.")
-		<-sigChan
+		// Batch pipelines submit by depositing session specs.
+		if cfg.DropFolder.Enabled {
+			var mc *minio.Client
+			if cfg.DropFolder.Bucket != "" {
+				if mc, err = backup.ArtifactClient(); err != nil {
+					slog.Error("Failed to initialize drop folder", slog.Any("error", err))
+					os.Exit(1)
+				}
+			}
+			drop := dropfolder.New(cfg.DropFolder, mc, metadata)
+			drop.SetSubmitter(gw)
+			runner.Add(background.Task{
+				Name:     "drop-folder",
+				Interval: cfg.DropFolder.Interval,
+				Run:      drop.Scan,
+			})
+		}
+
+		tracker.Phase("background")
+		ctx, cancel := context.WithCancel(context.Background())
+		if usageStats != nil {
+			go usageStats.Run(ctx)
+		}
+		if readOnly {
+			slog.Info("Read-only replica: serving status, listings and downloads only")
+		} else {
+			runner.Start(ctx)
+			go dispatcher.Run(ctx)
+			if stager != nil {
+				go stager.Run(ctx)
+			}
+		}
+
+		// In lame-duck mode the replica stops consuming results and hands
+		// its background tasks over before exiting.  A shutdown signal
+		// drains the same way.
+		lame := lameduck.New(instance.ID(), metadata,
+			jobQueue.StopConsuming,
+			func() {
+				cancel()
+				runner.Wait()
+			})
+		gw.Mount(lame)
+		gw.MountAdmin(lame)
+		gw.Mount(tracker)
+		gw.MountAdmin(faults)
+		diag := diagnostics.New(cfg)
+		diag.AddEndpoint("health/startup.json", "/startupz")
+		diag.AddEndpoint("health/ready.txt", "/readyz")
+		diag.AddEndpoint("health/lame-duck.json", "/admin/lame-duck")
+		diag.AddEndpoint("queues.json", "/admin/queues")
+		diag.AddEndpoint("drain.json", "/admin/drain")
+		diag.AddEndpoint("agents.json", "/admin/agents")
+		diag.AddEndpoint("pools.json", "/admin/pools")
+		diag.AddEndpoint("flags.json", "/admin/flags")
+		if !devstackMode {
+			diag.AddJSON("health/preflight.json", diagnostics.Preflight(cfg))
+		}
+		gw.Mount(diag)
+		gw.MountAdmin(diag)
+		go lame.Watch(ctx, 2*time.Second)
+
+		if cfg.HTTP.RateLimit.Enabled {
+			gw.Use(middleware.RateLimit(cfg.HTTP.RateLimit))
+		}
+		if limit != nil {
+			gw.Use(middleware.Bandwidth(limit))
+		}
+		if tierer != nil && !readOnly {
+			gw.Use(tierer.Middleware)
+		}
+		gw.Use(bin.Middleware)
+		// ULIDs in paths become numeric IDs before anything else sees them.
+		gw.Use(ids.Middleware)
+		if cfg.HTTP.Compression.Enabled {
+			gw.Use(middleware.Compress(cfg.HTTP.Compression))
+		}
+		if cfg.HTTP.Hardening.Enabled {
+			gw.Use(middleware.Harden(cfg.HTTP.Hardening))
+		}
+		if cfg.HTTP.Caching.Enabled {
+			gw.Use(middleware.CacheDownloads(func(ctx context.Context, session int) bool {
+				return keys != nil && keys.Sealed(ctx, session) || tenants.Private(ctx, session)
+			}))
+		}
+		if len(cfg.HTTP.AdminAllow) > 0 {
+			gw.Use(middleware.AdminAllow(cfg.HTTP))
+		}
+		// A read-only replica refuses changes before any handler that makes
+		// them sees the request.
+		if readOnly {
+			gw.Use(readonly.Middleware("/admin/lame-duck"))
+		}
+		// Every error response, the commander's included, is an error
+		// document with a machine-readable code, in the client's locale.
+		msgs, err := messages.New(cfg.Messages)
+		if err != nil {
+			slog.Error("Failed to load messages", slog.Any("error", err))
+			os.Exit(1)
+		}
+		gw.Mount(msgs)
+		if unguarded := gw.UnguardedAdminRoutes(); len(unguarded) > 0 {
+			slog.Error("Admin routes mounted without admin authorization", "routes", unguarded)
+			os.Exit(1)
+		}
+		// A panicking handler still answers, with an error document.
+		if reporter != nil {
+			gw.Use(reporter.Middleware)
+		}
+		// Answers, panics' included, count toward the usage statistics.
+		if usageStats != nil {
+			gw.Use(usageStats.Middleware)
+		}
+		gw.Use(apierr.Middleware(msgs))
+		if cfg.HTTP.AccessLog.Enabled {
+			gw.Use(middleware.AccessLog(cfg.HTTP.AccessLog))
+		}
+		gw.Use(middleware.Authenticate(tokens))
+		gw.Use(middleware.Forwarded(cfg.HTTP))
+
+		httpCfg := cfg.HTTP
+		if *listen != "" {
+			httpCfg.Listen = *listen
+		}
+		if httpCfg.Listen == "" {
+			httpCfg.Listen = ":" + publicPort
+		}
+		if cfg.Discovery.Interval > 0 {
+			go watcher.Run(context.Background(), cfg.Discovery.Interval)
+		}
+		go func() {
+			if err := gw.ListenAndServe(httpCfg); err != nil && !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("Error starting gateway", slog.Any("error", err))
+				os.Exit(1)
+			}
+		}()
+		tracker.Done()
+
+		if *replaces != "" {
+			var token string
+			if admins := cfg.HTTP.Auth.Admins; len(admins) > 0 {
+				token, _ = tokens.TokenOf(admins[0])
+			}
+			if err := lameduck.Signal(context.Background(), metadata, *replaces, instance.ID(), token); err != nil {
+				slog.Error("Failed to signal replaced replica", "replaces", *replaces, slog.Any("error", err))
+			} else {
+				slog.Info("Signalled replaced replica", "replaces", *replaces)
+			}
+		}
+
+		slog.Info("Started server in container mode.", "instance", instance.ID())
+		go func() {
+			<-sigChan
+			lame.Enter("signal")
+		}()
+		<-lame.Done()
+
+		shutdownCtx, stop := context.WithTimeout(context.Background(), 30*time.Second)
+		if err := gw.Shutdown(shutdownCtx); err != nil {
+			slog.Warn("Gateway shutdown incomplete", slog.Any("error", err))
+		}
+		stop()
 	default:
-		slog.Error("Invalid value for --mode. Allowed values are: standalone, container, cluster")
+		slog.Error("Invalid value for --mode. Allowed values are: standalone, container, cluster, devstack")
 		os.Exit(1)
 	}
 
 	slog.Info("Server shutdown complete")
 }
+
+// initReplication connects to the primary and secondary artifact stores.
+func initReplication(cfg config.Replication) (*replication.Replicator, error) {
+	src, err := backup.ArtifactClient()
+	if err != nil {
+		return nil, err
+	}
+	dst, err := replication.SecondaryClient()
+	if err != nil {
+		return nil, err
+	}
+	return replication.New(cfg, src, dst)
+}
+
+// initSigning loads the server's signing key and the agents' public keys.
+// Without agent keys results are not verified.
+func initSigning(cfg config.Signing) (*signing.Signer, *signing.Verifier, error) {
+	key, err := signing.LoadPrivateKey(cfg.KeyFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	signer := signing.NewSigner("mrvaserver", key)
+	if len(cfg.AgentKeys) == 0 {
+		slog.Warn("No agent keys configured; results are not verified")
+		return signer, nil, nil
+	}
+	verifier, err := signing.NewVerifier(cfg.AgentKeys)
+	if err != nil {
+		return nil, nil, err
+	}
+	return signer, verifier, nil
+}
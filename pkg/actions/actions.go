@@ -0,0 +1,182 @@
+// Package actions takes variant analyses submitted as HTML forms, for CI
+// workflows that have curl but no JSON tooling: the query pack a
+// workflow built and the repository list file are uploaded as they are.
+//
+//	curl -fsS -H "Authorization: Bearer $MRVA_TOKEN" \
+//	  -F language=cpp -F query_pack=@pack.tgz -F repositories=@repos.txt \
+//	  $MRVA_URL/actions/variant-analyses
+//
+// The response carries the new session's ID and the URL to poll for its
+// status until it is no longer in_progress; its outcome tells whether
+// every repository succeeded.  Package mrvaclient does the same from Go.
+package actions
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/mrvaclient"
+	"mrvaserver/pkg/web"
+)
+
+const (
+	sessionsPath = "/repositories/0/code-scanning/codeql/variant-analyses"
+
+	// maxForm bounds a form, query pack included; maxMemory of it is
+	// kept in memory and the rest in temporary files.
+	maxForm   = 512 << 20
+	maxMemory = 32 << 20
+)
+
+// Submitter submits forms through the gateway, so that the caller's
+// credentials, quotas and the submit hooks apply as to any submission.
+type Submitter struct {
+	submit http.Handler
+}
+
+func New(submit http.Handler) *Submitter {
+	return &Submitter{submit: submit}
+}
+
+// Submitted answers a form submission.
+type Submitted struct {
+	ID        string `json:"id"`
+	Status    string `json:"status"`
+	StatusURL string `json:"status_url"`
+}
+
+// Register adds POST /actions/variant-analyses, taking a multipart form:
+//
+//	language      the query language
+//	query_pack    the query pack, a gzipped tar
+//	repositories  owner/repo names separated by newlines or commas, with
+//	              # comments; a file or a field, and may be repeated
+//	options       optional, a JSON object of further submission fields
+func (s *Submitter) Register(r *mux.Router) {
+	r.HandleFunc("/actions/variant-analyses", s.post).Methods(http.MethodPost)
+}
+
+func (s *Submitter) post(w http.ResponseWriter, r *http.Request) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxForm)
+	if err := r.ParseMultipartForm(maxMemory); err != nil {
+		web.Fail(w, web.Msg(http.StatusBadRequest, apierr.InvalidRequest, "actions.invalid_form",
+			messages.Params{"error": err.Error()}), http.StatusBadRequest)
+		return
+	}
+	defer r.MultipartForm.RemoveAll()
+	body, err := submission(r.MultipartForm)
+	if err != nil {
+		web.Fail(w, err, http.StatusBadRequest)
+		return
+	}
+
+	req := r.Clone(r.Context())
+	req.URL.Path = sessionsPath
+	req.URL.RawPath = ""
+	req.URL.RawQuery = ""
+	req.RequestURI = req.URL.RequestURI()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.MultipartForm = nil
+	req.Form, req.PostForm = nil, nil
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	rec := httptest.NewRecorder()
+	s.submit.ServeHTTP(rec, req)
+	if rec.Code < 200 || rec.Code >= 300 {
+		// The submission's own error response, as it is.
+		for k, v := range rec.Header() {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(rec.Code)
+		w.Write(rec.Body.Bytes())
+		return
+	}
+	var va struct {
+		ID     int    `json:"id"`
+		Status string `json:"status"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &va); err != nil || va.ID == 0 {
+		http.Error(w, fmt.Sprintf("unexpected submission response: %s", rec.Body.Bytes()), http.StatusBadGateway)
+		return
+	}
+	name, err := web.SessionName(r.Context(), va.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, rec.Code, Submitted{
+		ID:        name,
+		Status:    va.Status,
+		StatusURL: fmt.Sprintf("%s%s/%s", web.ExternalBase(r), sessionsPath, name),
+	})
+}
+
+// submission is the JSON submission body of form f.
+func submission(f *multipart.Form) ([]byte, error) {
+	invalid := func(field string) error {
+		return web.Msg(http.StatusBadRequest, apierr.InvalidRequest, "actions.missing_field",
+			messages.Params{"field": field})
+	}
+	sub := map[string]any{}
+	if opts := f.Value["options"]; len(opts) > 0 {
+		if err := json.Unmarshal([]byte(opts[0]), &sub); err != nil {
+			return nil, web.Msg(http.StatusBadRequest, apierr.InvalidRequest, "actions.invalid_options",
+				messages.Params{"error": err.Error()})
+		}
+	}
+	if len(f.Value["language"]) == 0 || f.Value["language"][0] == "" {
+		return nil, invalid("language")
+	}
+	sub["language"] = f.Value["language"][0]
+	if _, ok := sub["action_repo_ref"]; !ok {
+		sub["action_repo_ref"] = "main"
+	}
+
+	packs := f.File["query_pack"]
+	if len(packs) == 0 {
+		return nil, invalid("query_pack")
+	}
+	pack, err := readFile(packs[0])
+	if err != nil {
+		return nil, err
+	}
+	sub["query_pack"] = base64.StdEncoding.EncodeToString(pack)
+
+	var repos []string
+	for _, v := range f.Value["repositories"] {
+		repos = append(repos, mrvaclient.ParseRepoList([]byte(v))...)
+	}
+	for _, fh := range f.File["repositories"] {
+		data, err := readFile(fh)
+		if err != nil {
+			return nil, err
+		}
+		repos = append(repos, mrvaclient.ParseRepoList(data)...)
+	}
+	// Without any, the repositories may come from options, such as a
+	// template's; the submission's validation decides.
+	if len(repos) > 0 {
+		sub["repositories"] = repos
+	}
+	return json.Marshal(sub)
+}
+
+func readFile(fh *multipart.FileHeader) ([]byte, error) {
+	f, err := fh.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return io.ReadAll(f)
+}
@@ -0,0 +1,229 @@
+// Package agentproto defines mrvaserver's extensions to the messages it
+// exchanges with agents over RabbitMQ.  Job and result messages embed the
+// commander's queue types, so their JSON is a superset of what
+// mrvacommander's agents send and expect: agents that predate an
+// extension ignore its fields, and the server treats their absence as the
+// old behaviour.
+package agentproto
+
+import (
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+)
+
+// LeasesQueueName is the queue agents publish LeaseMessages to.
+const LeasesQueueName = "leases"
+
+// TasksQueueName is the default pool's jobs queue, the one the commander's
+// agents consume.
+const TasksQueueName = "tasks"
+
+// DefaultPool names the pool of the tasks queue.
+const DefaultPool = "default"
+
+// AgentsQueueName is the queue agents publish AgentInfo to.
+const AgentsQueueName = "agents"
+
+// PoolQueueName returns the jobs queue of an agent pool.
+func PoolQueueName(pool string) string {
+	if pool == "" || pool == DefaultPool {
+		return TasksQueueName
+	}
+	return TasksQueueName + "." + pool
+}
+
+// AgentQueueName returns the jobs queue of a single agent, for jobs whose
+// database it has cached.  Jobs not taken from it in time move on to the
+// agent's pool queue.
+func AgentQueueName(agent string) string {
+	return TasksQueueName + ".agent." + agent
+}
+
+// Job is published on the tasks queue.
+type Job struct {
+	queue.AnalyzeJob
+
+	// Attempt counts dispatches of this job, starting at 1.
+	Attempt int `json:"attempt,omitempty"`
+
+	// LeaseTTLSeconds is how long a lease lasts unless renewed.  Agents
+	// that take leases should renew well within it.
+	LeaseTTLSeconds int `json:"lease_ttl_seconds,omitempty"`
+
+	// Pool is the agent pool the job was routed to; empty for the default
+	// pool.
+	Pool string `json:"pool,omitempty"`
+
+	// Agent is set on a job published to that agent's own queue because
+	// the agent has the job's database cached.
+	Agent string `json:"agent,omitempty"`
+
+	// Database is a staged copy of the job's database in the artifact
+	// store.  Agents should fetch it from there, falling back to the
+	// database store if it is gone.
+	Database *artifactstore.ArtifactLocation `json:"database,omitempty"`
+
+	// Preempted is set on a job requeued because its agent was preempted,
+	// and Checkpoint is whatever that agent saved to resume from.
+	Preempted  bool   `json:"preempted,omitempty"`
+	Checkpoint string `json:"checkpoint,omitempty"`
+
+	// Sandbox is the execution envelope the server requires.  Agents
+	// that enforce it say so in the result's SandboxAttestation.
+	Sandbox *Sandbox `json:"sandbox,omitempty"`
+
+	// Toolchain is the agent image and CodeQL bundle the job is to run
+	// with.  Agents that cannot honour it should fail the job rather than
+	// run it with another.
+	Toolchain *Toolchain `json:"toolchain,omitempty"`
+}
+
+// Toolchain names what a job runs with.
+type Toolchain struct {
+	Image  string `json:"image,omitempty"`
+	Bundle string `json:"bundle,omitempty"`
+
+	// Stage is "stable", or "canary" for a release being rolled out.
+	Stage string `json:"stage,omitempty"`
+}
+
+// Sandbox restricts a job's execution.
+type Sandbox struct {
+	// Network allows the CodeQL process to reach the network.
+	Network bool `json:"network"`
+
+	// ReadOnlyDatabase mounts the database read-only.
+	ReadOnlyDatabase bool `json:"read_only_database"`
+
+	// MemoryBytes is the memory cgroup limit; 0 is none.
+	MemoryBytes int64 `json:"memory_bytes,omitempty"`
+}
+
+// Satisfies reports whether an envelope s is at least as strict as want.
+func (s Sandbox) Satisfies(want Sandbox) bool {
+	switch {
+	case s.Network && !want.Network:
+		return false
+	case want.ReadOnlyDatabase && !s.ReadOnlyDatabase:
+		return false
+	case want.MemoryBytes > 0 && (s.MemoryBytes <= 0 || s.MemoryBytes > want.MemoryBytes):
+		return false
+	}
+	return true
+}
+
+// SandboxAttestation is an agent's account of the envelope a job ran in.
+type SandboxAttestation struct {
+	Sandbox
+
+	// Runtime names what enforced it, such as "bwrap" or "runc".
+	Runtime string `json:"runtime"`
+}
+
+// Result is consumed from the results queue.
+type Result struct {
+	queue.AnalyzeResult
+
+	// Attempt echoes the Job's attempt.  Zero means the agent does not
+	// know about attempts.
+	Attempt int `json:"attempt,omitempty"`
+
+	// Agent names the agent that produced the result.
+	Agent string `json:"agent,omitempty"`
+
+	// FailureClass says why a failed job failed, one of the Failure
+	// constants.  Empty is FailureUnknown.
+	FailureClass string `json:"failure_class,omitempty"`
+
+	// FailureMessage is the agent's description of the failure.
+	FailureMessage string `json:"failure_message,omitempty"`
+
+	// Sandbox is the agent's attestation of the job's sandbox, if it
+	// enforced one.
+	Sandbox *SandboxAttestation `json:"sandbox,omitempty"`
+
+	// CodeQLVersion and AgentImage, the digest of the agent's container
+	// image, record what produced the result, for provenance.
+	CodeQLVersion string `json:"codeql_version,omitempty"`
+	AgentImage    string `json:"agent_image,omitempty"`
+
+	// Telemetry is the agent's account of the query evaluation, if it
+	// collected one.
+	Telemetry *Telemetry `json:"telemetry,omitempty"`
+}
+
+// Telemetry is how a job's query evaluation went: its wall-clock and CPU
+// time, the tuples it produced, and, from the CodeQL evaluator log where
+// the agent keeps one, its slowest predicates.
+type Telemetry struct {
+	WallSeconds float64           `json:"wall_seconds"`
+	CPUSeconds  float64           `json:"cpu_seconds,omitempty"`
+	Tuples      int64             `json:"tuples,omitempty"`
+	Predicates  []PredicateTiming `json:"predicates,omitempty"`
+}
+
+// PredicateTiming is the evaluation of one predicate.
+type PredicateTiming struct {
+	Name    string  `json:"name"`
+	Seconds float64 `json:"seconds"`
+	Tuples  int64   `json:"tuples,omitempty"`
+}
+
+// Failure classes.
+const (
+	FailureOOM         = "oom"
+	FailureDBCorrupt   = "db_corrupt"
+	FailurePackCompile = "pack_compile"
+	FailureCLICrash    = "cli_crash"
+	FailureTimeout     = "timeout"
+	FailureSandbox     = "sandbox"
+	FailureUnknown     = "unknown"
+)
+
+// Failed reports whether the result is a failure.
+func (r Result) Failed() bool {
+	return r.Status == common.StatusError || r.Status == common.StatusFailed
+}
+
+// ResultHandler applies one result.  A nil error acknowledges the message;
+// otherwise it is returned to the queue.
+type ResultHandler func(Result) error
+
+// Lease message types.
+const (
+	LeaseAcquire = "acquire"
+	LeaseRenew   = "renew"
+	LeaseRelease = "release"
+	LeasePreempt = "preempt"
+)
+
+// LeaseMessage is sent by an agent when it starts a job (acquire), while
+// it works on it (renew) and if it gives it up without a result (release).
+// A job whose lease runs out is requeued.
+//
+// An agent about to be preempted sends preempt, and its jobs are requeued
+// at once, ahead of queued ones, without counting against their attempts.
+// A preempt with a zero Spec covers all of the agent's leases; one for a
+// single job may carry a Checkpoint for the next agent to resume from.
+type LeaseMessage struct {
+	Type       string         `json:"type"`
+	Spec       common.JobSpec `json:"spec"`
+	Agent      string         `json:"agent"`
+	Attempt    int            `json:"attempt"`
+	TTLSeconds int            `json:"ttl_seconds,omitempty"`
+	Checkpoint string         `json:"checkpoint,omitempty"`
+}
+
+// AgentInfo is sent by an agent when it starts and then periodically, to
+// register the pool whose queue it consumes and the labels it offers.
+//
+// CachedDatabases lists the repositories (owner/repo) whose databases the
+// agent holds locally.  An agent that reports them must also consume its
+// own queue, AgentQueueName(Agent), ahead of its pool's.
+type AgentInfo struct {
+	Agent           string            `json:"agent"`
+	Pool            string            `json:"pool,omitempty"`
+	Labels          map[string]string `json:"labels,omitempty"`
+	CachedDatabases []string          `json:"cached_databases,omitempty"`
+}
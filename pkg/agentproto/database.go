@@ -0,0 +1,141 @@
+package agentproto
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// DatabaseManifest describes a database served in chunks.  It is served at
+// the database's download URL plus "/manifest"; the chunks are fetched
+// from the download URL itself with Range requests.
+type DatabaseManifest struct {
+	Repository string          `json:"repository"`
+	Size       int64           `json:"size"`
+	ChunkSize  int64           `json:"chunk_size"`
+	SHA256     string          `json:"sha256"`
+	Chunks     []DatabaseChunk `json:"chunks"`
+}
+
+type DatabaseChunk struct {
+	Offset int64  `json:"offset"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// chunkAttempts is how often DownloadDatabase tries each chunk.
+const chunkAttempts = 3
+
+// DownloadDatabase fetches the database at url, the server's database
+// download URL for a repository, into f with up to parallel ranged
+// requests at a time.  Every chunk is checked against the manifest and
+// fetched again if it does not match.  It returns the manifest.
+func DownloadDatabase(ctx context.Context, client *http.Client, url string, f io.WriterAt, parallel int) (*DatabaseManifest, error) {
+	m, err := fetchManifest(ctx, client, url+"/manifest")
+	if err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chunks := make(chan DatabaseChunk)
+	errs := make(chan error, 1)
+	var wg sync.WaitGroup
+	for i := 0; i < max(parallel, 1); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range chunks {
+				var err error
+				for attempt := 0; attempt < chunkAttempts; attempt++ {
+					if err = fetchChunk(ctx, client, url, m.SHA256, c, f); err == nil || ctx.Err() != nil {
+						break
+					}
+				}
+				if err != nil {
+					select {
+					case errs <- fmt.Errorf("failed to fetch chunk at %d: %w", c.Offset, err):
+					default:
+					}
+					cancel()
+					return
+				}
+			}
+		}()
+	}
+feed:
+	for _, c := range m.Chunks {
+		select {
+		case chunks <- c:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(chunks)
+	wg.Wait()
+	select {
+	case err := <-errs:
+		return nil, err
+	default:
+	}
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func fetchManifest(ctx context.Context, client *http.Client, url string) (*DatabaseManifest, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch database manifest: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch database manifest: %s", resp.Status)
+	}
+	var m DatabaseManifest
+	if err := json.NewDecoder(resp.Body).Decode(&m); err != nil {
+		return nil, fmt.Errorf("failed to decode database manifest: %w", err)
+	}
+	return &m, nil
+}
+
+// fetchChunk fetches and checks one chunk.  If-Range makes the server
+// answer with the whole database, which is rejected, if it has changed
+// since the manifest was read.
+func fetchChunk(ctx context.Context, client *http.Client, url, etag string, c DatabaseChunk, f io.WriterAt) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Range", "bytes="+strconv.FormatInt(c.Offset, 10)+"-"+strconv.FormatInt(c.Offset+c.Size-1, 10))
+	req.Header.Set("If-Range", strconv.Quote(etag))
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("unexpected response %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, c.Size+1))
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if int64(len(data)) != c.Size || hex.EncodeToString(sum[:]) != c.SHA256 {
+		return fmt.Errorf("chunk does not match the manifest")
+	}
+	_, err = f.WriteAt(data, c.Offset)
+	return err
+}
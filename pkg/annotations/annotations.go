@@ -0,0 +1,251 @@
+// Package annotations lets teams organize sessions with key/value tags
+// and free-text notes, given in a submission's "tags" and "notes" fields
+// or set later:
+//
+//	"tags": {"cve": "CVE-2024-1234", "project": "libfoo"}
+//	"notes": "checking the fix in 2.1"
+//
+// Tags and notes appear in the session's status document, and the session
+// listing filters by them.
+package annotations
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/hohn/mrvacommander/pkg/state"
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/shard"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const ns = "annotations"
+
+const (
+	maxTags     = 50
+	maxKeyLen   = 64
+	maxValueLen = 256
+	maxNotesLen = 16 << 10
+)
+
+type Annotations struct {
+	Tags      map[string]string `json:"tags,omitempty"`
+	Notes     string            `json:"notes,omitempty"`
+	UpdatedBy string            `json:"updated_by,omitempty"`
+	UpdatedAt time.Time         `json:"updated_at"`
+}
+
+// Patch changes a session's annotations.  A null tag value removes the
+// tag; notes, if given, replace the session's.
+type Patch struct {
+	Tags  map[string]*string `json:"tags"`
+	Notes *string            `json:"notes"`
+}
+
+type Store struct {
+	store    store.Store
+	state    state.ServerState
+	shards   *shard.Map
+	versions *gateway.MetadataVersions
+}
+
+func New(s store.Store, st state.ServerState) *Store {
+	return &Store{store: s, state: st}
+}
+
+// SetShards annotates a split submission as one, under its parent session.
+func (s *Store) SetShards(m *shard.Map) {
+	s.shards = m
+}
+
+// SetVersions touches a session in v whenever its annotations change.
+func (s *Store) SetVersions(v *gateway.MetadataVersions) {
+	s.versions = v
+}
+
+// firstJobs returns the jobs of the first of the session's shards that has
+// any, or false if none has.
+func (s *Store) firstJobs(ctx context.Context, session int) ([]queue.AnalyzeJob, bool) {
+	for _, id := range s.shards.Sessions(ctx, session) {
+		if jobs, err := s.state.GetJobList(id); err == nil {
+			return jobs, true
+		}
+	}
+	return nil, false
+}
+
+func checkTag(k, v string) error {
+	switch {
+	case k == "" || len(k) > maxKeyLen:
+		return web.Msg(http.StatusBadRequest, "", "annotations.key_length", messages.Params{"max": maxKeyLen})
+	case strings.ContainsAny(k, "=,"):
+		return web.Msg(http.StatusBadRequest, "", "annotations.key_chars", messages.Params{"key": k})
+	case len(v) > maxValueLen:
+		return web.Msg(http.StatusBadRequest, "", "annotations.value_length", messages.Params{"key": k, "max": maxValueLen})
+	}
+	return nil
+}
+
+func check(a *Annotations) error {
+	if len(a.Tags) > maxTags {
+		return web.Msg(http.StatusBadRequest, "", "annotations.too_many", messages.Params{"max": maxTags})
+	}
+	for k, v := range a.Tags {
+		if err := checkTag(k, v); err != nil {
+			return err
+		}
+	}
+	if len(a.Notes) > maxNotesLen {
+		return web.Msg(http.StatusBadRequest, "", "annotations.notes_length", messages.Params{"max": maxNotesLen})
+	}
+	return nil
+}
+
+// Get returns the session's annotations, or store.ErrNotFound.
+func (s *Store) Get(ctx context.Context, session int) (Annotations, error) {
+	var a Annotations
+	err := store.GetJSON(ctx, s.store, ns, strconv.Itoa(session), &a)
+	return a, err
+}
+
+// Update applies p to the session's annotations.
+func (s *Store) Update(ctx context.Context, session int, p Patch, by string) (Annotations, error) {
+	var out Annotations
+	err := store.UpdateJSON(ctx, s.store, ns, strconv.Itoa(session), func(a *Annotations, found bool) error {
+		if a.Tags == nil {
+			a.Tags = make(map[string]string)
+		}
+		for k, v := range p.Tags {
+			if v == nil {
+				delete(a.Tags, k)
+			} else {
+				a.Tags[k] = *v
+			}
+		}
+		if p.Notes != nil {
+			a.Notes = *p.Notes
+		}
+		if err := check(a); err != nil {
+			return err
+		}
+		a.UpdatedBy, a.UpdatedAt = by, time.Now().UTC()
+		out = *a
+		return nil
+	})
+	if err == nil {
+		s.versions.Touch(ctx, session)
+	}
+	return out, err
+}
+
+// All returns the annotations of every annotated session, by session.
+func (s *Store) All(ctx context.Context) (map[int]Annotations, error) {
+	entries, err := s.store.List(ctx, ns, "")
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[int]Annotations, len(entries))
+	for _, e := range entries {
+		id, err := strconv.Atoi(e.Key)
+		if err != nil {
+			continue
+		}
+		var a Annotations
+		if err := json.Unmarshal(e.Value, &a); err != nil {
+			return nil, err
+		}
+		out[id] = a
+	}
+	return out, nil
+}
+
+// SubmitHook takes the "tags" and "notes" fields and records them for the
+// new session.
+func (s *Store) SubmitHook(r *http.Request, sub *gateway.Submission) error {
+	var a Annotations
+	if _, err := sub.TakeExtra("tags", &a.Tags); err != nil {
+		return err
+	}
+	if _, err := sub.TakeExtra("notes", &a.Notes); err != nil {
+		return err
+	}
+	if len(a.Tags) == 0 && a.Notes == "" {
+		return nil
+	}
+	if err := check(&a); err != nil {
+		return err
+	}
+	a.UpdatedBy, a.UpdatedAt = web.Identity(r), time.Now().UTC()
+	sub.After(func() {
+		if sub.Session == 0 {
+			return
+		}
+		if err := store.PutJSON(context.Background(), s.store, ns, strconv.Itoa(sub.Session), a); err != nil {
+			slog.Error("Failed to record session annotations", "session", sub.Session, "error", err)
+			return
+		}
+		s.versions.Touch(context.Background(), sub.Session)
+	})
+	return nil
+}
+
+// VariantAnalysisHook adds the session's tags and notes to its status
+// document.
+func (s *Store) VariantAnalysisHook(va *api.VariantAnalysis) {
+	a, err := s.Get(context.Background(), va.ID)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			slog.Warn("Failed to look up session annotations", "session", va.ID, "error", err)
+		}
+		return
+	}
+	va.Tags, va.Notes = a.Tags, a.Notes
+}
+
+// Filter selects sessions by their annotations: every tag filter, key=value
+// or a bare key for the tag's presence, must match, and the notes must
+// contain Text, ignoring case.
+type Filter struct {
+	Tags []string
+	Text string
+}
+
+func (f Filter) Empty() bool {
+	return len(f.Tags) == 0 && f.Text == ""
+}
+
+func (f Filter) Match(a Annotations) bool {
+	for _, t := range f.Tags {
+		k, v, hasValue := strings.Cut(t, "=")
+		got, ok := a.Tags[k]
+		if !ok || hasValue && got != v {
+			return false
+		}
+	}
+	return f.Text == "" || strings.Contains(strings.ToLower(a.Notes), strings.ToLower(f.Text))
+}
+
+func parseFilter(r *http.Request) (Filter, error) {
+	q := r.URL.Query()
+	f := Filter{Text: q.Get("q")}
+	for _, t := range q["tag"] {
+		for _, tt := range strings.Split(t, ",") {
+			if k, _, _ := strings.Cut(tt, "="); k == "" {
+				return f, fmt.Errorf("invalid tag filter %q", tt)
+			}
+			f.Tags = append(f.Tags, tt)
+		}
+	}
+	return f, nil
+}
@@ -0,0 +1,115 @@
+package annotations
+
+import (
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/snapshot"
+	"mrvaserver/pkg/web"
+)
+
+// maxGap bounds the probe for sessions of a state that cannot list them.
+const maxGap = 100
+
+// Register adds annotation changes and the session listing:
+//
+//	PATCH /repos/{owner}/{repo}/code-scanning/codeql/variant-analyses/{id}
+//	PATCH /repositories/{controller_repo_id}/code-scanning/codeql/variant-analyses/{id}
+//	PATCH /variant-analyses/{id}   {"tags": {"cve": "CVE-2024-1234", "old": null}, "notes": "..."}
+//	GET   /variant-analyses?tag=cve=CVE-2024-1234&tag=project&q=text
+func (s *Store) Register(r *mux.Router) {
+	r.HandleFunc("/repos/{owner}/{repo}/code-scanning/codeql/variant-analyses/{id:[0-9]+}", s.patch).Methods(http.MethodPatch)
+	r.HandleFunc("/repositories/{controller_repo_id}/code-scanning/codeql/variant-analyses/{id:[0-9]+}", s.patch).Methods(http.MethodPatch)
+	r.HandleFunc("/variant-analyses/{id:[0-9]+}", s.patch).Methods(http.MethodPatch)
+	r.HandleFunc("/variant-analyses", s.list).Methods(http.MethodGet)
+}
+
+func (s *Store) patch(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	id, err := s.shards.Parent(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, ok := s.firstJobs(r.Context(), id); !ok {
+		http.Error(w, "variant analysis not found", http.StatusNotFound)
+		return
+	}
+	var p Patch
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "invalid annotations: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	a, err := s.Update(r.Context(), id, p, web.Identity(r))
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, a)
+}
+
+type listEntry struct {
+	ID        string            `json:"id"`
+	CreatedAt string            `json:"created_at,omitempty"`
+	Tags      map[string]string `json:"tags,omitempty"`
+	Notes     string            `json:"notes,omitempty"`
+}
+
+// list returns sessions, newest first, split submissions under their
+// parent.  Filtered listings only consider annotated sessions.
+func (s *Store) list(w http.ResponseWriter, r *http.Request) {
+	f, err := parseFilter(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	all, err := s.All(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var ids []int
+	if f.Empty() {
+		if ids, err = snapshot.SessionIDs(s.state, maxGap); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		for id, a := range all {
+			if f.Match(a) {
+				ids = append(ids, id)
+			}
+		}
+	}
+	sort.Sort(sort.Reverse(sort.IntSlice(ids)))
+
+	web.WriteJSONArray(w, http.StatusOK, func(a *web.ArrayWriter) error {
+		for _, id := range ids {
+			// A split submission is listed once, under its parent.
+			if parent, err := s.shards.Parent(r.Context(), id); err != nil || parent != id {
+				continue
+			}
+			jobs, ok := s.firstJobs(r.Context(), id)
+			if !ok {
+				continue
+			}
+			name, err := web.SessionName(r.Context(), id)
+			if err != nil {
+				return err
+			}
+			e := listEntry{ID: name, Tags: all[id].Tags, Notes: all[id].Notes}
+			if len(jobs) > 0 {
+				if info, err := s.state.GetJobInfo(jobs[0].Spec); err == nil {
+					e.CreatedAt = info.CreatedAt
+				}
+			}
+			if err := a.Write(e); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
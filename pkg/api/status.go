@@ -0,0 +1,123 @@
+package api
+
+import "github.com/hohn/mrvacommander/pkg/common"
+
+// Values of VariantAnalysis.Status.  Note the spelling of "cancelled"; the
+// repo task enum below uses "canceled".  Both match the extension.
+const (
+	StatusInProgress = "in_progress"
+	StatusSucceeded  = "succeeded"
+	StatusFailed     = "failed"
+	StatusCancelled  = "cancelled"
+)
+
+// Values of ScannedRepository.AnalysisStatus and RepoTask.AnalysisStatus.
+const (
+	RepoStatusPending    = "pending"
+	RepoStatusInProgress = "in_progress"
+	RepoStatusSucceeded  = "succeeded"
+	RepoStatusFailed     = "failed"
+	RepoStatusCanceled   = "canceled"
+	RepoStatusTimedOut   = "timed_out"
+)
+
+// Values of Outcome.State.
+const (
+	OutcomeSucceeded           = "succeeded"
+	OutcomeCompletedWithErrors = "completed_with_errors"
+	OutcomeFailed              = "failed"
+	OutcomeCancelled           = "cancelled"
+)
+
+// Values of VariantAnalysis.FailureReason.
+const (
+	FailureNoReposQueried = "no_repos_queried"
+	FailureInternalError  = "internal_error"
+)
+
+// RepoStatus maps a commander job status to the extension's repo task enum.
+// common.Status.ToExternalString() yields "queued" and "error", neither of
+// which the extension accepts.
+func RepoStatus(s common.Status) string {
+	switch s {
+	case common.StatusQueued:
+		return RepoStatusPending
+	case common.StatusInProgress:
+		return RepoStatusInProgress
+	case common.StatusSuccess:
+		return RepoStatusSucceeded
+	default:
+		return RepoStatusFailed
+	}
+}
+
+// IsTerminalRepoStatus reports whether a repo task will not change again.
+func IsTerminalRepoStatus(s string) bool {
+	switch s {
+	case RepoStatusPending, RepoStatusInProgress:
+		return false
+	default:
+		return true
+	}
+}
+
+// SessionStatus derives the overall session status from its repo tasks.
+// The session is in progress while any repo is, failed if every repo failed,
+// and succeeded otherwise, as the extension knows no partial success; see
+// SessionOutcome.  A session without repos failed with
+// FailureNoReposQueried.
+func SessionStatus(repoStatuses []string) (status string, failureReason string) {
+	if len(repoStatuses) == 0 {
+		return StatusFailed, FailureNoReposQueried
+	}
+	failed := 0
+	for _, s := range repoStatuses {
+		if !IsTerminalRepoStatus(s) {
+			return StatusInProgress, ""
+		}
+		if s == RepoStatusFailed || s == RepoStatusTimedOut {
+			failed++
+		}
+	}
+	if failed == len(repoStatuses) {
+		return StatusFailed, FailureInternalError
+	}
+	return StatusSucceeded, ""
+}
+
+// SessionOutcome breaks down a finished session's repositories.  It
+// completed with errors if some of them succeeded and others failed or
+// were canceled.  Failed repositories without a failure code are counted
+// under unknown.
+func SessionOutcome(repos []ScannedRepository) *Outcome {
+	out := &Outcome{}
+	for _, r := range repos {
+		switch r.AnalysisStatus {
+		case RepoStatusSucceeded:
+			out.Succeeded++
+		case RepoStatusCanceled:
+			out.Canceled++
+		case RepoStatusFailed, RepoStatusTimedOut:
+			out.Failed++
+			code := r.FailureCode
+			if code == "" {
+				code = "unknown"
+			}
+			if out.Failures == nil {
+				out.Failures = make(map[string]int)
+			}
+			out.Failures[code]++
+		}
+	}
+	switch {
+	case out.Succeeded > 0 && out.Failed+out.Canceled == 0:
+		out.State = OutcomeSucceeded
+	case out.Succeeded > 0:
+		out.State = OutcomeCompletedWithErrors
+	case out.Failed > 0 || len(repos) == 0:
+		out.State = OutcomeFailed
+	default:
+		out.State = OutcomeCancelled
+	}
+	return out
+}
@@ -0,0 +1,144 @@
+// Package api holds the GitHub MRVA response shapes that the CodeQL VS Code
+// extension parses.  The commander's own common.* types predate several of
+// the fields the extension relies on, so the gateway renders these instead.
+package api
+
+import "github.com/hohn/mrvacommander/pkg/common"
+
+// Repository is the abbreviated repository form used in scanned repository
+// lists and repo task responses.
+type Repository struct {
+	ID              int    `json:"id"`
+	Name            string `json:"name"`
+	FullName        string `json:"full_name"`
+	Private         bool   `json:"private"`
+	StargazersCount int    `json:"stargazers_count"`
+	UpdatedAt       string `json:"updated_at"`
+}
+
+// Actor identifies the submitter of a variant analysis.
+type Actor struct {
+	ID        int    `json:"id"`
+	Login     string `json:"login"`
+	AvatarURL string `json:"avatar_url"`
+	URL       string `json:"url"`
+	HTMLURL   string `json:"html_url"`
+}
+
+// ScannedRepository is one entry of VariantAnalysis.ScannedRepositories.
+type ScannedRepository struct {
+	Repository          Repository `json:"repository"`
+	AnalysisStatus      string     `json:"analysis_status"`
+	ResultCount         int        `json:"result_count"`
+	SuppressedCount     int        `json:"suppressed_count,omitempty"`
+	ArtifactSizeInBytes int        `json:"artifact_size_in_bytes"`
+	FailureMessage      string     `json:"failure_message,omitempty"`
+	FailureCode         string     `json:"failure_code,omitempty"`
+}
+
+// VariantAnalysis is the session document returned by
+//
+//	GET /repositories/{controller_repo_id}/code-scanning/codeql/variant-analyses/{id}
+type VariantAnalysis struct {
+	ID                   int                        `json:"id"`
+	ULID                 string                     `json:"ulid,omitempty"`
+	Encryption           string                     `json:"encryption,omitempty"`
+	Tags                 map[string]string          `json:"tags,omitempty"`
+	Notes                string                     `json:"notes,omitempty"`
+	ControllerRepo       Repository                 `json:"controller_repo"`
+	Actor                Actor                      `json:"actor"`
+	QueryLanguage        string                     `json:"query_language"`
+	QueryPackURL         string                     `json:"query_pack_url"`
+	CreatedAt            string                     `json:"created_at"`
+	UpdatedAt            string                     `json:"updated_at"`
+	ActionsWorkflowRunID int                        `json:"actions_workflow_run_id"`
+	Status               string                     `json:"status"`
+	CompletedAt          string                     `json:"completed_at,omitempty"`
+	FailureReason        string                     `json:"failure_reason,omitempty"`
+	Outcome              *Outcome                   `json:"outcome,omitempty"`
+	Budget               *Budget                    `json:"budget,omitempty"`
+	Shards               []int                      `json:"shards,omitempty"`
+	Progress             *Progress                  `json:"progress,omitempty"`
+	Sample               *Sample                    `json:"sample,omitempty"`
+	PromotedFrom         int                        `json:"promoted_from,omitempty"`
+	ScannedRepositories  []ScannedRepository        `json:"scanned_repositories"`
+	SkippedRepositories  common.SkippedRepositories `json:"skipped_repositories"`
+}
+
+// Outcome breaks down how a finished session's repositories went, for
+// automation deciding whether its results are usable.  The extension only
+// knows Status, which stays succeeded for a session with some failed
+// repositories; State is completed_with_errors then.  Failures counts
+// failed repositories by failure code.
+type Outcome struct {
+	State     string         `json:"state"`
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	Canceled  int            `json:"canceled,omitempty"`
+	Failures  map[string]int `json:"failures,omitempty"`
+}
+
+// Budget is what a session with a budget may consume and has consumed.
+// Once it is exhausted, the repositories not yet analyzed are skipped:
+// canceled, with failure code SKIPPED_OVER_BUDGET.
+type Budget struct {
+	Jobs         int     `json:"jobs,omitempty"`
+	CPUHours     float64 `json:"cpu_hours,omitempty"`
+	UsedJobs     int     `json:"used_jobs"`
+	UsedCPUHours float64 `json:"used_cpu_hours"`
+	Exhausted    bool    `json:"exhausted"`
+	Skipped      int     `json:"skipped_over_budget"`
+}
+
+// Sample says a session analyzed Size of the Of repositories submitted,
+// picked by Strategy, and which session analyzes the rest once promoted.
+type Sample struct {
+	Strategy   string `json:"strategy"`
+	Size       int    `json:"size"`
+	Of         int    `json:"of"`
+	PromotedTo int    `json:"promoted_to,omitempty"`
+}
+
+// Progress estimates when an in-progress session completes.  Remaining
+// counts its unfinished repositories and QueueDepth the jobs of other
+// sessions ahead of them; both are worked through at Throughput.
+type Progress struct {
+	Remaining             int     `json:"remaining"`
+	QueueDepth            int     `json:"queue_depth"`
+	ThroughputPerMinute   float64 `json:"throughput_per_minute"`
+	EstimatedCompletionAt string  `json:"estimated_completion_at,omitempty"`
+}
+
+// Estimate answers a dry-run submission: the repositories it would
+// analyze, those without a database, and roughly what analyzing them would
+// cost.  Databases of unknown size are counted in UnsizedDatabases, not in
+// DatabaseBytes; without recent jobs in the language there is no compute
+// estimate.
+type Estimate struct {
+	DryRun                  bool     `json:"dry_run"`
+	Language                string   `json:"language"`
+	RepositoryCount         int      `json:"repository_count"`
+	Sessions                int      `json:"sessions"`
+	NoCodeqlDBRepos         []string `json:"no_codeql_db_repos"`
+	DatabaseBytes           int64    `json:"database_bytes"`
+	UnsizedDatabases        int      `json:"unsized_databases,omitempty"`
+	SecondsPerRepository    float64  `json:"seconds_per_repository,omitempty"`
+	EstimatedComputeSeconds float64  `json:"estimated_compute_seconds,omitempty"`
+}
+
+// RepoTask is the per-repository document returned by
+//
+//	GET /repositories/{controller_repo_id}/code-scanning/codeql/variant-analyses/{id}/repositories/{repo_id}
+type RepoTask struct {
+	Repository           Repository `json:"repository"`
+	AnalysisStatus       string     `json:"analysis_status"`
+	ArtifactSizeInBytes  int        `json:"artifact_size_in_bytes"`
+	ResultCount          int        `json:"result_count"`
+	SuppressedCount      int        `json:"suppressed_count,omitempty"`
+	DurationSeconds      float64    `json:"duration_seconds,omitempty"`
+	FailureMessage       string     `json:"failure_message,omitempty"`
+	FailureCode          string     `json:"failure_code,omitempty"`
+	DatabaseCommitSha    string     `json:"database_commit_sha"`
+	SourceLocationPrefix string     `json:"source_location_prefix"`
+	ArtifactURL          string     `json:"artifact_url,omitempty"`
+}
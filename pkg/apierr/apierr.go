@@ -0,0 +1,246 @@
+// Package apierr is the server's error model.  Every error response is a
+// JSON document with a human-readable message and a machine-readable
+// code, GitHub style:
+//
+//	{"message": "no baseline \"nightly\"", "code": "NOT_FOUND"}
+//
+// so that clients branch on the code rather than parse messages.
+// Handlers that know what went wrong name a specific code, through Write
+// or a web.Error carrying one; other errors get the generic code of their
+// status, as do the plain-text errors of handlers, and of the commander,
+// which Middleware rewrites.  Repository tasks that failed carry a code in
+// failure_code too, see ForFailure.
+//
+// Messages from the catalog (see package messages) carry their ID and
+// parameters too, and Middleware renders them in the request's locale:
+//
+//	{"message": "no baseline \"nightly\"", "code": "NOT_FOUND",
+//	 "message_id": "baseline.unknown", "params": {"name": "nightly"}}
+package apierr
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"mrvaserver/pkg/messages"
+)
+
+// Codes.
+const (
+	InvalidRequest     = "INVALID_REQUEST"
+	Unauthorized       = "UNAUTHORIZED"
+	Forbidden          = "FORBIDDEN"
+	NotFound           = "NOT_FOUND"
+	Conflict           = "CONFLICT"
+	Gone               = "GONE"
+	PreconditionFailed = "PRECONDITION_FAILED"
+	TooLarge           = "TOO_LARGE"
+	Unprocessable      = "UNPROCESSABLE"
+	RateLimited        = "RATE_LIMITED"
+	Internal           = "INTERNAL"
+	UpstreamFailed     = "UPSTREAM_FAILED"
+	Unavailable        = "UNAVAILABLE"
+	Timeout            = "TIMEOUT"
+
+	DBNotFound        = "DB_NOT_FOUND"
+	DBCorrupt         = "DB_CORRUPT"
+	PackInvalid       = "PACK_INVALID"
+	MalwareDetected   = "MALWARE_DETECTED"
+	QuotaExceeded     = "QUOTA_EXCEEDED"
+	SkippedOverBudget = "SKIPPED_OVER_BUDGET"
+	AgentTimeout      = "AGENT_TIMEOUT"
+	AgentOOM          = "AGENT_OOM"
+	AgentCrash        = "AGENT_CRASH"
+	SandboxFailed     = "SANDBOX_FAILED"
+	AnalysisError     = "ANALYSIS_ERROR"
+)
+
+// Body is an error response.
+type Body struct {
+	Message   string         `json:"message"`
+	Code      string         `json:"code"`
+	MessageID string         `json:"message_id,omitempty"`
+	Params    map[string]any `json:"params,omitempty"`
+}
+
+// ForStatus is the generic code of an HTTP status.
+func ForStatus(status int) string {
+	switch status {
+	case http.StatusBadRequest:
+		return InvalidRequest
+	case http.StatusUnauthorized:
+		return Unauthorized
+	case http.StatusForbidden:
+		return Forbidden
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return NotFound
+	case http.StatusConflict:
+		return Conflict
+	case http.StatusGone:
+		return Gone
+	case http.StatusPreconditionFailed:
+		return PreconditionFailed
+	case http.StatusRequestEntityTooLarge:
+		return TooLarge
+	case http.StatusUnprocessableEntity:
+		return Unprocessable
+	case http.StatusTooManyRequests:
+		return RateLimited
+	case http.StatusBadGateway:
+		return UpstreamFailed
+	case http.StatusServiceUnavailable:
+		return Unavailable
+	case http.StatusGatewayTimeout:
+		return Timeout
+	}
+	if status >= 500 {
+		return Internal
+	}
+	return InvalidRequest
+}
+
+// ForFailure is the code of an agent's failure class (see agentproto).
+func ForFailure(class string) string {
+	switch class {
+	case "oom":
+		return AgentOOM
+	case "db_corrupt":
+		return DBCorrupt
+	case "pack_compile":
+		return PackInvalid
+	case "cli_crash":
+		return AgentCrash
+	case "timeout":
+		return AgentTimeout
+	case "sandbox":
+		return SandboxFailed
+	}
+	return AnalysisError
+}
+
+// Write answers with an error document.  An empty code is the status's.
+func Write(w http.ResponseWriter, status int, b Body) {
+	if b.Code == "" {
+		b.Code = ForStatus(status)
+	}
+	body, _ := json.Marshal(b)
+	h := w.Header()
+	h.Del("Content-Length")
+	h.Set("Content-Type", "application/json")
+	h.Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	w.Write(body)
+}
+
+// maxRewrite bounds the error bodies Middleware rewrites; longer ones are
+// passed on as they are.
+const maxRewrite = 64 << 10
+
+// Middleware rewrites plain-text error responses, such as http.Error's,
+// as error documents, and renders the messages of error documents in the
+// request's locale.  Plain-text messages whose English text is in c are
+// rendered too.  Other responses pass through.
+func Middleware(c *messages.Catalog) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ew := &errorWriter{ResponseWriter: w}
+			next.ServeHTTP(ew, r)
+			ew.finish(c, r)
+		})
+	}
+}
+
+type errorWriter struct {
+	http.ResponseWriter
+	status int
+	buf    *bytes.Buffer
+	wrote  bool
+}
+
+func (ew *errorWriter) WriteHeader(code int) {
+	if ew.wrote {
+		return
+	}
+	ew.wrote = true
+	h := ew.Header()
+	ct := h.Get("Content-Type")
+	if code >= 400 && (strings.HasPrefix(ct, "text/plain") || strings.HasPrefix(ct, "application/json")) &&
+		h.Get("Content-Encoding") == "" {
+		ew.status, ew.buf = code, new(bytes.Buffer)
+		return
+	}
+	ew.ResponseWriter.WriteHeader(code)
+}
+
+func (ew *errorWriter) Write(p []byte) (int, error) {
+	if !ew.wrote {
+		ew.WriteHeader(http.StatusOK)
+	}
+	if ew.buf == nil {
+		return ew.ResponseWriter.Write(p)
+	}
+	if ew.buf.Len()+len(p) > maxRewrite {
+		// Too long to be an error message; give up rewriting it.
+		if err := ew.passOn(); err != nil {
+			return 0, err
+		}
+		return ew.ResponseWriter.Write(p)
+	}
+	return ew.buf.Write(p)
+}
+
+// passOn writes the buffered response as it is.
+func (ew *errorWriter) passOn() error {
+	buf := ew.buf
+	ew.buf = nil
+	ew.ResponseWriter.WriteHeader(ew.status)
+	_, err := ew.ResponseWriter.Write(buf.Bytes())
+	return err
+}
+
+func (ew *errorWriter) finish(c *messages.Catalog, r *http.Request) {
+	if ew.buf == nil {
+		return
+	}
+	var b Body
+	if strings.HasPrefix(ew.Header().Get("Content-Type"), "application/json") {
+		// JSON other than an error document, such as a conflicting
+		// resource, passes through.  Numbers are kept as they were
+		// written for rendering.
+		dec := json.NewDecoder(bytes.NewReader(ew.buf.Bytes()))
+		dec.UseNumber()
+		if dec.Decode(&b) != nil || b.Code == "" {
+			ew.passOn()
+			return
+		}
+	} else {
+		b.Message = strings.TrimSpace(ew.buf.String())
+	}
+	if b.MessageID == "" {
+		b.MessageID, _ = c.Lookup(b.Message)
+	}
+	if b.MessageID != "" {
+		if msg, locale, ok := c.Render(c.Negotiate(r), b.MessageID, b.Params); ok {
+			b.Message = msg
+			ew.Header().Set("Content-Language", locale)
+			ew.Header().Add("Vary", "Accept-Language")
+		}
+	}
+	Write(ew.ResponseWriter, ew.status, b)
+}
+
+func (ew *errorWriter) Flush() {
+	if ew.buf != nil {
+		return
+	}
+	if f, ok := ew.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (ew *errorWriter) Unwrap() http.ResponseWriter {
+	return ew.ResponseWriter
+}
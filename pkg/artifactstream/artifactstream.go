@@ -0,0 +1,59 @@
+// Package artifactstream reads and serves result archives as streams
+// rather than whole, so that a download takes a copy buffer's worth of
+// memory instead of the archive's, and bounds how many are served at
+// once.  Artifact stores that can open results implement Opener; the
+// stores wrapping another pass OpenResult through with Open, which reads
+// results whole only from stores that cannot open them.
+package artifactstream
+
+import (
+	"bytes"
+	"context"
+	"io"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/minio/minio-go/v7"
+)
+
+// Opener is implemented by artifact stores that can read a result as a
+// stream.  The size is -1 if the store cannot tell it up front.
+type Opener interface {
+	OpenResult(loc artifactstore.ArtifactLocation) (io.ReadCloser, int64, error)
+}
+
+// Open opens the result at loc in s.
+func Open(s artifactstore.Store, loc artifactstore.ArtifactLocation) (io.ReadCloser, int64, error) {
+	if o, ok := s.(Opener); ok {
+		return o.OpenResult(loc)
+	}
+	data, err := s.GetResult(loc)
+	if err != nil {
+		return nil, 0, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), nil
+}
+
+// MinIO gives store, whose artifacts are objects of mc, an OpenResult
+// reading them straight from mc.
+func MinIO(store artifactstore.Store, mc *minio.Client) artifactstore.Store {
+	return &minioStore{Store: store, mc: mc}
+}
+
+type minioStore struct {
+	artifactstore.Store
+	mc *minio.Client
+}
+
+func (s *minioStore) OpenResult(loc artifactstore.ArtifactLocation) (io.ReadCloser, int64, error) {
+	obj, err := s.mc.GetObject(context.Background(), loc.Bucket, loc.Key, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, 0, err
+	}
+	// Stat fetches the object's metadata, and fails if it does not exist.
+	info, err := obj.Stat()
+	if err != nil {
+		obj.Close()
+		return nil, 0, err
+	}
+	return obj, info.Size, nil
+}
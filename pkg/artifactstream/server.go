@@ -0,0 +1,106 @@
+package artifactstream
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/web"
+)
+
+var (
+	activeGauge = metrics.NewGauge("mrvaserver_downloads_active",
+		"Result downloads being served.")
+	refusedTotal = metrics.NewCounter("mrvaserver_downloads_refused_total",
+		"Result downloads refused because too many were being served.")
+)
+
+var bufPool = sync.Pool{New: func() any {
+	b := make([]byte, 32<<10)
+	return &b
+}}
+
+// Server serves the results of an artifact store, at most cfg.MaxConcurrent
+// at once.
+type Server struct {
+	store artifactstore.Store
+	slots chan struct{}
+	wait  time.Duration
+}
+
+func NewServer(store artifactstore.Store, cfg config.Downloads) *Server {
+	s := &Server{store: store, wait: cfg.Wait}
+	if cfg.MaxConcurrent > 0 {
+		s.slots = make(chan struct{}, cfg.MaxConcurrent)
+	}
+	return s
+}
+
+// acquire waits for a download slot, up to the configured wait.
+func (s *Server) acquire(ctx context.Context) bool {
+	if s.slots == nil {
+		return true
+	}
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	default:
+	}
+	timer := time.NewTimer(s.wait)
+	defer timer.Stop()
+	select {
+	case s.slots <- struct{}{}:
+		return true
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+	return false
+}
+
+func (s *Server) release() {
+	if s.slots != nil {
+		<-s.slots
+	}
+}
+
+// ServeResult sends the result archive at loc.
+func (s *Server) ServeResult(w http.ResponseWriter, r *http.Request, loc artifactstore.ArtifactLocation) {
+	if !s.acquire(r.Context()) {
+		refusedTotal.Inc()
+		w.Header().Set("Retry-After", strconv.Itoa(max(1, int(s.wait.Seconds()))))
+		web.Fail(w, web.Msg(http.StatusServiceUnavailable, apierr.Unavailable, "downloads.busy", nil),
+			http.StatusServiceUnavailable)
+		return
+	}
+	defer s.release()
+	activeGauge.Add(1)
+	defer activeGauge.Add(-1)
+
+	rc, size, err := Open(s.store, loc)
+	if err != nil {
+		slog.Error("Failed to retrieve artifact", "location", loc, "error", err)
+		http.Error(w, "Failed to retrieve artifact", http.StatusInternalServerError)
+		return
+	}
+	defer rc.Close()
+	w.Header().Set("Content-Type", "application/octet-stream")
+	if size >= 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
+	}
+	if r.Method == http.MethodHead {
+		return
+	}
+	buf := bufPool.Get().(*[]byte)
+	defer bufPool.Put(buf)
+	if _, err := io.CopyBuffer(w, rc, *buf); err != nil {
+		slog.Warn("Result download cut short", "location", loc, "error", err)
+	}
+}
@@ -0,0 +1,204 @@
+// Package avscan passes artifacts through a malware scanner before they
+// are stored or dispatched, as some enterprise security baselines
+// require: submitted query packs, and databases as the prefetch stager
+// copies them (see prefetch.Stager.SetScanner).  The scanner is clamd,
+// spoken to over its INSTREAM protocol, or an HTTP service that is POSTed
+// the file and answers
+//
+//	{"infected": true, "signature": "Eicar-Test-Signature"}
+package avscan
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/web"
+)
+
+// chunkSize is the size of the chunks streamed to clamd.
+const chunkSize = 64 << 10
+
+var (
+	scanned = metrics.NewCounterVec("mrvaserver_malware_scans_total",
+		"Artifacts passed through the malware scanner, by kind and result.", "kind", "result")
+	scanSeconds = metrics.NewCounter("mrvaserver_malware_scan_seconds_total",
+		"Time spent scanning artifacts for malware.")
+)
+
+// Kinds of artifact, for metrics.
+const (
+	KindPack     = "pack"
+	KindDatabase = "database"
+)
+
+// Infected is the error for an artifact the scanner found malware in.
+type Infected struct {
+	Name      string
+	Signature string
+}
+
+func (e *Infected) Error() string {
+	return fmt.Sprintf("malware detected in %s: %s", e.Name, e.Signature)
+}
+
+type Scanner struct {
+	cfg    config.MalwareScan
+	client *http.Client
+}
+
+func New(cfg config.MalwareScan) *Scanner {
+	return &Scanner{cfg: cfg, client: &http.Client{Timeout: cfg.Timeout}}
+}
+
+// Scan passes data, the artifact name of the given kind, through the
+// scanner.  It returns an *Infected for malware, and an error if the
+// scanner could not be asked, unless the scan fails open.
+func (s *Scanner) Scan(ctx context.Context, kind, name string, data []byte) error {
+	ctx, cancel := context.WithTimeout(ctx, s.cfg.Timeout)
+	defer cancel()
+	start := time.Now()
+	var signature string
+	var err error
+	if s.cfg.Kind == "http" {
+		signature, err = s.scanHTTP(ctx, name, data)
+	} else {
+		signature, err = s.scanClamd(ctx, data)
+	}
+	scanSeconds.Add(time.Since(start).Seconds())
+	switch {
+	case err != nil && s.cfg.FailOpen:
+		scanned.With(kind, "skipped").Inc()
+		slog.Warn("Malware scanner unavailable, passing artifact unscanned", "artifact", name, "error", err)
+		return nil
+	case err != nil:
+		scanned.With(kind, "error").Inc()
+		return fmt.Errorf("failed to scan %s for malware: %w", name, err)
+	case signature != "":
+		scanned.With(kind, "infected").Inc()
+		slog.Warn("Malware detected", "kind", kind, "artifact", name, "signature", signature)
+		return &Infected{Name: name, Signature: signature}
+	}
+	scanned.With(kind, "clean").Inc()
+	return nil
+}
+
+// scanClamd streams data to clamd and returns the signature it found, if
+// any.
+func (s *Scanner) scanClamd(ctx context.Context, data []byte) (string, error) {
+	network, addr := "tcp", s.cfg.Addr
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		network, addr = "unix", path
+	}
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, addr)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	w := bufio.NewWriter(conn)
+	w.WriteString("zINSTREAM\x00")
+	var size [4]byte
+	for len(data) > 0 {
+		n := min(len(data), chunkSize)
+		binary.BigEndian.PutUint32(size[:], uint32(n))
+		w.Write(size[:])
+		w.Write(data[:n])
+		data = data[n:]
+	}
+	binary.BigEndian.PutUint32(size[:], 0)
+	w.Write(size[:])
+	if err := w.Flush(); err != nil {
+		return "", err
+	}
+
+	// clamd answers "stream: OK", "stream: <signature> FOUND" or
+	// "<message> ERROR", NUL-terminated.
+	reply, err := bufio.NewReader(conn).ReadString(0)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	reply = strings.TrimSpace(strings.TrimSuffix(reply, "\x00"))
+	_, result, _ := strings.Cut(reply, ": ")
+	switch {
+	case result == "OK":
+		return "", nil
+	case strings.HasSuffix(result, " FOUND"):
+		return strings.TrimSuffix(result, " FOUND"), nil
+	}
+	return "", fmt.Errorf("clamd: %s", reply)
+}
+
+// scanHTTP posts data to the scanning service and returns the signature
+// it found, if any.
+func (s *Scanner) scanHTTP(ctx context.Context, name string, data []byte) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.cfg.URL, bytes.NewReader(data))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Artifact-Name", name)
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("scanning service answered %s", resp.Status)
+	}
+	var v struct {
+		Infected  bool   `json:"infected"`
+		Signature string `json:"signature"`
+	}
+	if err := json.NewDecoder(io.LimitReader(resp.Body, 64<<10)).Decode(&v); err != nil {
+		return "", fmt.Errorf("failed to decode scanning service response: %w", err)
+	}
+	if !v.Infected {
+		return "", nil
+	}
+	if v.Signature == "" {
+		v.Signature = "unknown"
+	}
+	return v.Signature, nil
+}
+
+// SubmitHook scans the submitted query pack, rejecting the submission if
+// it carries malware or, failing closed, if the scanner is unavailable.
+func (s *Scanner) SubmitHook(r *http.Request, sub *gateway.Submission) error {
+	pack, err := base64.StdEncoding.DecodeString(sub.Msg.QueryPack)
+	if err != nil {
+		return web.Msg(http.StatusBadRequest, apierr.PackInvalid, "pack.invalid", messages.Params{"error": err})
+	}
+	err = s.Scan(r.Context(), KindPack, "query pack", pack)
+	var inf *Infected
+	if errors.As(err, &inf) {
+		slog.Warn("Query pack rejected by malware scan", "client", web.Identity(r), "signature", inf.Signature)
+		return web.Msg(http.StatusUnprocessableEntity, apierr.MalwareDetected, "malware.pack_infected",
+			messages.Params{"signature": inf.Signature})
+	}
+	if err != nil {
+		slog.Error("Failed to scan query pack", "client", web.Identity(r), "error", err)
+		return web.Msg(http.StatusServiceUnavailable, "", "malware.unavailable", nil)
+	}
+	return nil
+}
@@ -0,0 +1,148 @@
+// Package backend is the registry of the server's pluggable backends: the
+// state, the job queue, the artifact store and the CodeQL database store.
+// The built-in backends are wired by the server itself; a fork adds its
+// own by registering them from an init function and naming them in the
+// configuration (state.backend, queue.backend, artifacts.backend,
+// databases.backend).  The registering package is usually linked in by a
+// file in package main behind a build tag, so the tree needs no patching:
+//
+//	//go:build acme
+//
+//	package main
+//
+//	import _ "example.com/acme/mrvabackends"
+//
+// Like the built-in backends, registered ones take their endpoints and
+// credentials from the environment.
+package backend
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/qldbstore"
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/hohn/mrvacommander/pkg/state"
+	"mrvaserver/pkg/agentproto"
+)
+
+// Queue is a job queue.  Beyond the commander's interface, the server
+// publishes jobs released by the dispatcher, requeues jobs whose lease
+// expired and stops consuming results when it drains.  Job routing, agent
+// heartbeats and leases are RabbitMQ features; with another queue the
+// jobs the commander creates are the queue's to deliver.
+type Queue interface {
+	queue.Queue
+	Publish(job agentproto.Job) error
+	Requeue(job agentproto.Job) error
+	StopConsuming()
+}
+
+type (
+	StateFactory     func(ctx context.Context) (state.ServerState, error)
+	ArtifactsFactory func(ctx context.Context) (artifactstore.Store, error)
+	DatabasesFactory func(ctx context.Context) (qldbstore.Store, error)
+
+	// QueueFactory returns a queue passing every result it receives to
+	// handle.
+	QueueFactory func(ctx context.Context, handle agentproto.ResultHandler) (Queue, error)
+)
+
+type registry[F any] struct {
+	kind      string
+	mutex     sync.Mutex
+	factories map[string]F
+}
+
+func (r *registry[F]) register(name string, f F) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if r.factories == nil {
+		r.factories = make(map[string]F)
+	}
+	if _, ok := r.factories[name]; ok {
+		panic(fmt.Sprintf("backend: %s backend %q registered twice", r.kind, name))
+	}
+	r.factories[name] = f
+}
+
+func (r *registry[F]) lookup(name string) (F, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	f, ok := r.factories[name]
+	if !ok {
+		return f, fmt.Errorf("unknown %s backend %q", r.kind, name)
+	}
+	return f, nil
+}
+
+func (r *registry[F]) names() []string {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	names := make([]string, 0, len(r.factories))
+	for name := range r.factories {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+var (
+	states    = &registry[StateFactory]{kind: "state"}
+	queues    = &registry[QueueFactory]{kind: "queue"}
+	artifacts = &registry[ArtifactsFactory]{kind: "artifact store"}
+	databases = &registry[DatabasesFactory]{kind: "database store"}
+)
+
+// RegisterState makes a state backend available by name.  It panics if
+// the name is taken.
+func RegisterState(name string, f StateFactory) { states.register(name, f) }
+
+func RegisterQueue(name string, f QueueFactory) { queues.register(name, f) }
+
+func RegisterArtifacts(name string, f ArtifactsFactory) { artifacts.register(name, f) }
+
+func RegisterDatabases(name string, f DatabasesFactory) { databases.register(name, f) }
+
+// OpenState opens the registered state backend name.
+func OpenState(ctx context.Context, name string) (state.ServerState, error) {
+	f, err := states.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return f(ctx)
+}
+
+func OpenQueue(ctx context.Context, name string, handle agentproto.ResultHandler) (Queue, error) {
+	f, err := queues.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return f(ctx, handle)
+}
+
+func OpenArtifacts(ctx context.Context, name string) (artifactstore.Store, error) {
+	f, err := artifacts.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return f(ctx)
+}
+
+func OpenDatabases(ctx context.Context, name string) (qldbstore.Store, error) {
+	f, err := databases.lookup(name)
+	if err != nil {
+		return nil, err
+	}
+	return f(ctx)
+}
+
+// States, Queues, ArtifactStores and DatabaseStores list the registered
+// backends of each kind.
+func States() []string         { return states.names() }
+func Queues() []string         { return queues.names() }
+func ArtifactStores() []string { return artifacts.names() }
+func DatabaseStores() []string { return databases.names() }
@@ -0,0 +1,136 @@
+package background
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/metrics"
+)
+
+var (
+	loopWorkers = metrics.NewGaugeVec("mrvaserver_loop_workers",
+		"Items a background task works on at once.", "loop")
+	loopBatchSize = metrics.NewGaugeVec("mrvaserver_loop_batch_size",
+		"Items a background task takes on per pass, 0 for all of them.", "loop")
+	loopBacklog = metrics.NewGaugeVec("mrvaserver_loop_backlog",
+		"Items a background task's last pass left for the next.", "loop")
+	loopPassSeconds = metrics.NewGaugeVec("mrvaserver_loop_pass_seconds",
+		"How long a background task's last pass over its items took.", "loop")
+	loopItems = metrics.NewCounterVec("mrvaserver_loop_items_total",
+		"Items worked on by background tasks, by whether that failed.", "loop", "result")
+)
+
+// pool is how a task works through the items of a pass.
+type pool struct {
+	name    string
+	workers int
+	batch   int
+
+	mu   sync.Mutex
+	next int // where the next batch starts
+}
+
+type poolKey struct{}
+
+func newPool(name string, cfg config.Loop) *pool {
+	p := &pool{name: name, workers: max(1, cfg.Workers), batch: cfg.BatchSize}
+	loopWorkers.With(name).Set(float64(p.workers))
+	loopBatchSize.With(name).Set(float64(p.batch))
+	return p
+}
+
+// SetLoops sets how the tasks that reconcile items one by one work through
+// them.  It must be called before Start.
+func (r *Runner) SetLoops(loops config.Loops) {
+	r.loops = loops
+}
+
+// withPool gives the runs of t the pool Each uses.
+func (r *Runner) withPool(ctx context.Context, t Task) context.Context {
+	return context.WithValue(ctx, poolKey{}, newPool(t.Name, r.loops[t.Name]))
+}
+
+// take returns where this pass's batch of n items starts and how long it
+// is, and moves the cursor past it.
+func (p *pool) take(n int) (int, int) {
+	if p.batch == 0 || p.batch >= n {
+		return 0, n
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	start := p.next % n
+	p.next = start + p.batch
+	return start, p.batch
+}
+
+// Each calls f on the items of one pass of a task, as many at once and as
+// many in all as the task is configured for under loops; outside a task,
+// on all of them in order.  After an error no more calls are started, and
+// Each returns it once those already started have finished.
+func Each[T any](ctx context.Context, items []T, f func(ctx context.Context, item T) error) error {
+	p, _ := ctx.Value(poolKey{}).(*pool)
+	if p == nil {
+		p = &pool{workers: 1}
+	}
+	start, n := p.take(len(items))
+	began := time.Now()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		mu    sync.Mutex
+		first error
+		wg    sync.WaitGroup
+	)
+	work := make(chan T)
+	for i := 0; i < min(p.workers, n); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for item := range work {
+				if ctx.Err() != nil {
+					// Handed over as the pass was stopped.
+					continue
+				}
+				err := f(ctx, item)
+				if p.name != "" {
+					result := "ok"
+					if err != nil {
+						result = "failed"
+					}
+					loopItems.With(p.name, result).Inc()
+				}
+				if err != nil {
+					mu.Lock()
+					if first == nil {
+						first = err
+					}
+					mu.Unlock()
+					cancel()
+				}
+			}
+		}()
+	}
+feed:
+	for i := 0; i < n; i++ {
+		select {
+		case work <- items[(start+i)%len(items)]:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(work)
+	wg.Wait()
+
+	if p.name != "" {
+		loopBacklog.With(p.name).Set(float64(len(items) - n))
+		loopPassSeconds.With(p.name).Set(time.Since(began).Seconds())
+	}
+	if first != nil {
+		return first
+	}
+	// Stopped with the task rather than by f.
+	return ctx.Err()
+}
@@ -0,0 +1,160 @@
+// Package background runs periodic tasks -- reapers, schedulers, cron-like
+// jobs -- on exactly one replica.  Each task is guarded by a named lock; the
+// replica that holds it runs the task at its interval until it shuts down
+// or loses the lock, and the others keep trying to take over.  Tasks marked
+// LeaderOnly instead run together on the elected leader.  Tasks that
+// reconcile many items work through them with Each, as many at once and per
+// pass as SetLoops configures.
+package background
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/leader"
+	"mrvaserver/pkg/lock"
+)
+
+// Task is one periodic job.
+type Task struct {
+	Name     string
+	Interval time.Duration
+	Run      func(ctx context.Context) error
+
+	// LeaderOnly tasks run on the leader replica, for subsystems whose
+	// parts must all run on the same replica.  They require SetElector.
+	LeaderOnly bool
+}
+
+type Runner struct {
+	locker  lock.Locker
+	elector leader.Elector
+	loops   config.Loops
+	tasks   []Task
+	wg      sync.WaitGroup
+}
+
+func NewRunner(locker lock.Locker) *Runner {
+	return &Runner{locker: locker}
+}
+
+// Add registers t.  Tasks must be added before Start.
+func (r *Runner) Add(t Task) {
+	r.tasks = append(r.tasks, t)
+}
+
+// SetElector sets the elector used for LeaderOnly tasks.
+func (r *Runner) SetElector(e leader.Elector) {
+	r.elector = e
+}
+
+// Start launches every task.  They stop when ctx is cancelled; Wait blocks
+// until they have.
+func (r *Runner) Start(ctx context.Context) {
+	var leaderTasks []Task
+	for _, t := range r.tasks {
+		if t.LeaderOnly {
+			leaderTasks = append(leaderTasks, t)
+			continue
+		}
+		r.wg.Add(1)
+		go func(t Task) {
+			defer r.wg.Done()
+			r.loop(r.withPool(ctx, t), t)
+		}(t)
+	}
+
+	if len(leaderTasks) == 0 {
+		return
+	}
+	if r.elector == nil {
+		slog.Error("Leader-only background tasks without an elector are not run", "count", len(leaderTasks))
+		return
+	}
+	r.wg.Add(1)
+	go func() {
+		defer r.wg.Done()
+		leader.Run(ctx, r.elector, func(leaderCtx context.Context) {
+			var wg sync.WaitGroup
+			for _, t := range leaderTasks {
+				wg.Add(1)
+				go func(t Task) {
+					defer wg.Done()
+					every(r.withPool(leaderCtx, t), t)
+				}(t)
+			}
+			wg.Wait()
+		})
+	}()
+}
+
+// every runs t now and at each interval until ctx is done.
+func every(ctx context.Context, t Task) {
+	ticker := time.NewTicker(t.Interval)
+	defer ticker.Stop()
+	for {
+		if err := t.Run(ctx); err != nil {
+			slog.Error("Background task failed", "task", t.Name, "error", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (r *Runner) Wait() {
+	r.wg.Wait()
+}
+
+func (r *Runner) loop(ctx context.Context, t Task) {
+	ticker := time.NewTicker(t.Interval)
+	defer ticker.Stop()
+
+	for {
+		l, err := r.locker.TryLock(ctx, "task/"+t.Name)
+		if err != nil {
+			slog.Warn("Failed to acquire task lock", "task", t.Name, "error", err)
+		}
+		if l != nil {
+			slog.Info("Running background task on this replica", "task", t.Name)
+			r.hold(ctx, t, l, ticker)
+			l.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// hold runs t at every tick for as long as l is held.
+func (r *Runner) hold(ctx context.Context, t Task, l lock.Lock, ticker *time.Ticker) {
+	for {
+		runCtx, cancel := context.WithCancel(ctx)
+		go func() {
+			select {
+			case <-l.Lost():
+				cancel()
+			case <-runCtx.Done():
+			}
+		}()
+		if err := t.Run(runCtx); err != nil {
+			slog.Error("Background task failed", "task", t.Name, "error", err)
+		}
+		cancel()
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-l.Lost():
+			return
+		case <-ticker.C:
+		}
+	}
+}
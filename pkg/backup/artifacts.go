@@ -0,0 +1,28 @@
+package backup
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"mrvaserver/pkg/cas"
+)
+
+// Buckets are the artifact store buckets a backup covers.  The
+// content-addressed store's only exists where it is enabled.
+var Buckets = []string{artifactstore.AF_BUCKETNAME_RESULTS, artifactstore.AF_BUCKETNAME_PACKS, cas.Bucket}
+
+// ArtifactClient connects to the artifact store with the ARTIFACT_MINIO_*
+// environment variables, the same ones deploy.InitMinIOArtifactStore reads.
+func ArtifactClient() (*minio.Client, error) {
+	for _, key := range []string{"ARTIFACT_MINIO_ENDPOINT", "ARTIFACT_MINIO_ID", "ARTIFACT_MINIO_SECRET"} {
+		if _, ok := os.LookupEnv(key); !ok {
+			return nil, fmt.Errorf("missing required environment variable %s", key)
+		}
+	}
+	return minio.New(os.Getenv("ARTIFACT_MINIO_ENDPOINT"), &minio.Options{
+		Creds: credentials.NewStaticV4(os.Getenv("ARTIFACT_MINIO_ID"), os.Getenv("ARTIFACT_MINIO_SECRET"), ""),
+	})
+}
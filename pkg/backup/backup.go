@@ -0,0 +1,173 @@
+// Package backup takes and restores snapshots of a deployment: the Postgres
+// databases holding commander state and mrvaserver metadata, and the query
+// packs and results in the artifact store.
+//
+// A backup is a directory holding one pg_dump archive per database, the
+// copied artifacts (unless they are only referenced) and manifest.json,
+// which is written last; a directory without a manifest is an incomplete
+// backup.  Databases are dumped before artifacts are listed.  Artifacts are
+// written before the state that refers to them, so every artifact a dump
+// refers to is in the backup; artifacts newer than the dumps are harmless.
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"mrvaserver/pkg/instance"
+)
+
+const (
+	manifestFile    = "manifest.json"
+	manifestVersion = 1
+)
+
+// Database names a Postgres database to back up.  An empty DSN means the
+// PG* environment variables.
+type Database struct {
+	Name string
+	DSN  string
+}
+
+type Options struct {
+	Dir       string
+	Databases []Database
+
+	// Copy stores the artifacts in the backup.  Otherwise the manifest
+	// only records them, for deployments whose object store has its own
+	// replication or versioning.
+	Copy bool
+}
+
+type Manifest struct {
+	Version   int              `json:"version"`
+	CreatedAt time.Time        `json:"created_at"`
+	Instance  string           `json:"instance"`
+	Databases []DatabaseDump   `json:"databases"`
+	Artifacts []ArtifactRecord `json:"artifacts"`
+}
+
+type DatabaseDump struct {
+	Name string `json:"name"`
+	File string `json:"file"`
+}
+
+// ArtifactRecord is one object.  File is empty for referenced artifacts.
+type ArtifactRecord struct {
+	Bucket string `json:"bucket"`
+	Key    string `json:"key"`
+	Size   int64  `json:"size"`
+	ETag   string `json:"etag"`
+	SHA256 string `json:"sha256,omitempty"`
+	File   string `json:"file,omitempty"`
+}
+
+// Backup writes a snapshot to opts.Dir, which must not exist or be empty.
+func Backup(ctx context.Context, opts Options, artifacts *minio.Client) (*Manifest, error) {
+	if entries, err := os.ReadDir(opts.Dir); err == nil && len(entries) > 0 {
+		return nil, fmt.Errorf("backup directory %s is not empty", opts.Dir)
+	}
+	if err := os.MkdirAll(opts.Dir, 0o750); err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{
+		Version:   manifestVersion,
+		CreatedAt: time.Now().UTC(),
+		Instance:  instance.ID(),
+	}
+
+	for _, db := range opts.Databases {
+		file := db.Name + ".dump"
+		slog.Info("Dumping database", "name", db.Name)
+		cmd := exec.CommandContext(ctx, "pg_dump", "--format=custom", "--no-owner",
+			"--file="+filepath.Join(opts.Dir, file), "--dbname="+conninfo(db.DSN))
+		if err := run(cmd); err != nil {
+			return nil, fmt.Errorf("failed to dump database %s: %w", db.Name, err)
+		}
+		m.Databases = append(m.Databases, DatabaseDump{Name: db.Name, File: file})
+	}
+
+	for _, bucket := range Buckets {
+		exists, err := artifacts.BucketExists(ctx, bucket)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reach artifact store: %w", err)
+		}
+		if !exists {
+			continue
+		}
+		for obj := range artifacts.ListObjects(ctx, bucket, minio.ListObjectsOptions{Recursive: true}) {
+			if obj.Err != nil {
+				return nil, fmt.Errorf("failed to list bucket %s: %w", bucket, obj.Err)
+			}
+			rec := ArtifactRecord{Bucket: bucket, Key: obj.Key, Size: obj.Size, ETag: obj.ETag}
+			if opts.Copy {
+				if err := copyOut(ctx, artifacts, opts.Dir, &rec); err != nil {
+					return nil, err
+				}
+			}
+			m.Artifacts = append(m.Artifacts, rec)
+		}
+	}
+	slog.Info("Artifacts recorded", "count", len(m.Artifacts), "copied", opts.Copy)
+
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(filepath.Join(opts.Dir, manifestFile), data, 0o640); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func copyOut(ctx context.Context, client *minio.Client, dir string, rec *ArtifactRecord) error {
+	obj, err := client.GetObject(ctx, rec.Bucket, rec.Key, minio.GetObjectOptions{})
+	if err != nil {
+		return fmt.Errorf("failed to read artifact %s/%s: %w", rec.Bucket, rec.Key, err)
+	}
+	defer obj.Close()
+
+	rec.File = filepath.Join("artifacts", rec.Bucket, filepath.FromSlash(rec.Key))
+	path := filepath.Join(dir, rec.File)
+	if err := os.MkdirAll(filepath.Dir(path), 0o750); err != nil {
+		return err
+	}
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(f, h), obj); err != nil {
+		return fmt.Errorf("failed to copy artifact %s/%s: %w", rec.Bucket, rec.Key, err)
+	}
+	rec.SHA256 = hex.EncodeToString(h.Sum(nil))
+	return f.Close()
+}
+
+// conninfo turns an empty DSN into a URI that libpq fills in from the PG*
+// environment variables, as pgx does for an empty DSN.
+func conninfo(dsn string) string {
+	if dsn == "" {
+		return "postgresql://"
+	}
+	return dsn
+}
+
+func run(cmd *exec.Cmd) error {
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
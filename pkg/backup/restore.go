@@ -0,0 +1,126 @@
+package backup
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// ReadManifest loads the manifest of the backup in dir.
+func ReadManifest(dir string) (*Manifest, error) {
+	data, err := os.ReadFile(filepath.Join(dir, manifestFile))
+	if err != nil {
+		return nil, fmt.Errorf("no complete backup in %s: %w", dir, err)
+	}
+	var m Manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("invalid manifest: %w", err)
+	}
+	if m.Version != manifestVersion {
+		return nil, fmt.Errorf("unsupported manifest version %d", m.Version)
+	}
+	return &m, nil
+}
+
+// Restore loads the backup in opts.Dir: each dumped database into the one
+// of the same name in opts.Databases, replacing its objects, then the
+// copied artifacts.  Referenced artifacts are checked and reported if
+// missing.  The server should be stopped while restoring.
+func Restore(ctx context.Context, opts Options, artifacts *minio.Client) error {
+	m, err := ReadManifest(opts.Dir)
+	if err != nil {
+		return err
+	}
+
+	targets := make(map[string]string)
+	for _, db := range opts.Databases {
+		targets[db.Name] = db.DSN
+	}
+	for _, dump := range m.Databases {
+		dsn, ok := targets[dump.Name]
+		if !ok {
+			return fmt.Errorf("no target for database %s", dump.Name)
+		}
+		slog.Info("Restoring database", "name", dump.Name)
+		cmd := exec.CommandContext(ctx, "pg_restore", "--clean", "--if-exists", "--no-owner",
+			"--single-transaction", "--dbname="+conninfo(dsn), filepath.Join(opts.Dir, dump.File))
+		if err := run(cmd); err != nil {
+			return fmt.Errorf("failed to restore database %s: %w", dump.Name, err)
+		}
+	}
+
+	for _, bucket := range Buckets {
+		exists, err := artifacts.BucketExists(ctx, bucket)
+		if err != nil {
+			return err
+		}
+		if !exists {
+			if err := artifacts.MakeBucket(ctx, bucket, minio.MakeBucketOptions{}); err != nil {
+				return fmt.Errorf("failed to create bucket %s: %w", bucket, err)
+			}
+		}
+	}
+
+	missing := 0
+	for _, rec := range m.Artifacts {
+		if rec.File == "" {
+			if _, err := artifacts.StatObject(ctx, rec.Bucket, rec.Key, minio.StatObjectOptions{}); err != nil {
+				slog.Warn("Referenced artifact is missing", "bucket", rec.Bucket, "key", rec.Key)
+				missing++
+			}
+			continue
+		}
+		if err := copyIn(ctx, artifacts, opts.Dir, rec); err != nil {
+			return err
+		}
+	}
+	slog.Info("Artifacts restored", "count", len(m.Artifacts), "missing", missing)
+	if missing > 0 {
+		return fmt.Errorf("%d referenced artifacts are missing from the artifact store", missing)
+	}
+	return nil
+}
+
+func copyIn(ctx context.Context, client *minio.Client, dir string, rec ArtifactRecord) error {
+	path := filepath.Join(dir, rec.File)
+	if err := verify(path, rec.SHA256); err != nil {
+		return fmt.Errorf("artifact %s/%s: %w", rec.Bucket, rec.Key, err)
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = client.PutObject(ctx, rec.Bucket, rec.Key, f, rec.Size, minio.PutObjectOptions{
+		ContentType: "application/octet-stream",
+	})
+	if err != nil {
+		return fmt.Errorf("failed to restore artifact %s/%s: %w", rec.Bucket, rec.Key, err)
+	}
+	return nil
+}
+
+func verify(path, sum string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return err
+	}
+	if got := hex.EncodeToString(h.Sum(nil)); got != sum {
+		return fmt.Errorf("checksum mismatch: manifest has %s, file has %s", sum, got)
+	}
+	return nil
+}
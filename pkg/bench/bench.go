@@ -0,0 +1,270 @@
+// Package bench measures a running server with synthetic sessions.  It
+// submits them, polls their status until every job has finished and then
+// downloads each result, timing every request.  Run with fake agents
+// (`mrvaserver fakeagent`) it measures the server and queue alone.
+//
+// The hot paths -- submission parsing, result ingestion, status rendering
+// and SARIF merging -- have go test benchmarks next to their code instead.
+// Compare checks their `go test -bench` output against a baseline's, as
+// benchstat does, so a change can be held to it.
+package bench
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/e2e"
+)
+
+type Options struct {
+	BaseURL        string
+	ControllerRepo string
+	Repositories   []string // per session
+	Language       string
+	QueryPack      []byte // nil submits a minimal one
+
+	Sessions    int
+	Concurrency int // requests in flight at once
+
+	// Timeout bounds the wait for the queue to drain.
+	Timeout time.Duration
+	Poll    time.Duration
+}
+
+// Stats summarizes the latencies of one kind of request.
+type Stats struct {
+	Count      int     `json:"count"`
+	Errors     int     `json:"errors"`
+	PerSecond  float64 `json:"per_second"`
+	P50Millis  float64 `json:"p50_ms"`
+	P95Millis  float64 `json:"p95_ms"`
+	MaxMillis  float64 `json:"max_ms"`
+	FirstError string  `json:"first_error,omitempty"`
+}
+
+type Report struct {
+	Sessions int `json:"sessions"`
+	Jobs     int `json:"jobs"`
+	Failed   int `json:"failed_jobs"`
+
+	Submit   Stats `json:"submit"`
+	Status   Stats `json:"status"`
+	Download Stats `json:"download"`
+
+	// Drain is the time from the last submission to the last job
+	// finishing; Total is from the first submission.
+	Drain    time.Duration `json:"-"`
+	Total    time.Duration `json:"-"`
+	Drained  bool          `json:"drained"`
+	DrainSec float64       `json:"drain_seconds"`
+	TotalSec float64       `json:"total_seconds"`
+
+	// JobsPerSecond is the end-to-end throughput.
+	JobsPerSecond float64 `json:"jobs_per_second"`
+}
+
+// timings collects the latencies of one kind of request.
+type timings struct {
+	mu       sync.Mutex
+	took     []time.Duration
+	errors   int
+	firstErr error
+	start    time.Time
+	end      time.Time
+}
+
+func (t *timings) record(start time.Time, err error) {
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.start.IsZero() || start.Before(t.start) {
+		t.start = start
+	}
+	if now.After(t.end) {
+		t.end = now
+	}
+	if err != nil {
+		t.errors++
+		if t.firstErr == nil {
+			t.firstErr = err
+		}
+		return
+	}
+	t.took = append(t.took, now.Sub(start))
+}
+
+func (t *timings) stats() Stats {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	s := Stats{Count: len(t.took) + t.errors, Errors: t.errors}
+	if t.firstErr != nil {
+		s.FirstError = t.firstErr.Error()
+	}
+	if len(t.took) == 0 {
+		return s
+	}
+	slices.Sort(t.took)
+	if wall := t.end.Sub(t.start).Seconds(); wall > 0 {
+		s.PerSecond = float64(s.Count) / wall
+	}
+	s.P50Millis = millis(quantile(t.took, 0.50))
+	s.P95Millis = millis(quantile(t.took, 0.95))
+	s.MaxMillis = millis(t.took[len(t.took)-1])
+	return s
+}
+
+// quantile is the nearest-rank quantile q of the sorted sample.
+func quantile(sorted []time.Duration, q float64) time.Duration {
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	return sorted[max(i, 0)]
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// parallel runs f on 0..n-1 with at most c running at once.
+func parallel(n, c int, f func(i int)) {
+	sem := make(chan struct{}, c)
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			f(i)
+		}()
+	}
+	wg.Wait()
+}
+
+// Run submits the sessions, waits for them and downloads their results.
+func Run(opts Options) (Report, error) {
+	report := Report{Sessions: opts.Sessions}
+	pack := opts.QueryPack
+	if pack == nil {
+		var err error
+		if pack, err = e2e.MinimalPack(opts.Language); err != nil {
+			return report, err
+		}
+	}
+	c := e2e.NewClient(opts.BaseURL, opts.ControllerRepo)
+	c.HTTP.Transport = transport(opts.Concurrency)
+
+	// Submissions
+	var submit, status, download timings
+	ids := make([]int, opts.Sessions)
+	parallel(opts.Sessions, opts.Concurrency, func(i int) {
+		start := time.Now()
+		id, err := c.Submit(opts.Language, opts.Repositories, pack)
+		submit.record(start, err)
+		ids[i] = id
+	})
+	report.Submit = submit.stats()
+	ids = slices.DeleteFunc(ids, func(id int) bool { return id == 0 })
+	if len(ids) == 0 {
+		return report, fmt.Errorf("every submission failed: %v", submit.firstErr)
+	}
+
+	// Drain: poll every unfinished session each round
+	finished := make(map[int]api.VariantAnalysis)
+	deadline := submit.end.Add(opts.Timeout)
+	for len(finished) < len(ids) && time.Now().Before(deadline) {
+		var mu sync.Mutex
+		pending := slices.DeleteFunc(slices.Clone(ids), func(id int) bool { _, ok := finished[id]; return ok })
+		parallel(len(pending), opts.Concurrency, func(i int) {
+			start := time.Now()
+			va, err := c.Status(pending[i])
+			status.record(start, err)
+			if err == nil && va.Status != api.StatusInProgress {
+				mu.Lock()
+				finished[pending[i]] = va
+				mu.Unlock()
+			}
+		})
+		if len(finished) < len(ids) {
+			time.Sleep(opts.Poll)
+		}
+	}
+	drained := time.Now()
+	report.Status = status.stats()
+	report.Drained = len(finished) == len(ids)
+	report.Drain = drained.Sub(submit.end)
+	report.Total = drained.Sub(submit.start)
+
+	// Downloads
+	type task struct {
+		id   int
+		repo string
+	}
+	var tasks []task
+	for id, va := range finished {
+		for _, sr := range va.ScannedRepositories {
+			report.Jobs++
+			if sr.AnalysisStatus != api.RepoStatusSucceeded {
+				report.Failed++
+				continue
+			}
+			tasks = append(tasks, task{id, sr.Repository.FullName})
+		}
+	}
+	parallel(len(tasks), opts.Concurrency, func(i int) {
+		start := time.Now()
+		_, err := c.Download(tasks[i].id, tasks[i].repo)
+		download.record(start, err)
+	})
+	report.Download = download.stats()
+
+	report.DrainSec = report.Drain.Seconds()
+	report.TotalSec = report.Total.Seconds()
+	if report.Total > 0 {
+		report.JobsPerSecond = float64(report.Jobs) / report.Total.Seconds()
+	}
+	return report, nil
+}
+
+// Print writes the report as a table, or as JSON for comparing runs.
+func (r Report) Print(w io.Writer, asJSON bool) error {
+	if asJSON {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(r)
+	}
+	fmt.Fprintf(w, "%d sessions, %d jobs (%d failed) in %s: %.1f jobs/s\n",
+		r.Sessions, r.Jobs, r.Failed, r.Total.Round(time.Millisecond), r.JobsPerSecond)
+	drain := r.Drain.Round(time.Millisecond).String()
+	if !r.Drained {
+		drain += " (timed out, not drained)"
+	}
+	fmt.Fprintf(w, "queue drain: %s\n\n", drain)
+	rows := []struct {
+		name string
+		s    Stats
+	}{{"submit", r.Submit}, {"status", r.Status}, {"download", r.Download}}
+	fmt.Fprintf(w, "%-9s %7s %7s %9s %9s %9s %9s\n", "request", "count", "errors", "req/s", "p50 ms", "p95 ms", "max ms")
+	for _, row := range rows {
+		fmt.Fprintf(w, "%-9s %7d %7d %9.1f %9.1f %9.1f %9.1f\n",
+			row.name, row.s.Count, row.s.Errors, row.s.PerSecond, row.s.P50Millis, row.s.P95Millis, row.s.MaxMillis)
+	}
+	for _, row := range rows {
+		if row.s.FirstError != "" {
+			fmt.Fprintf(w, "first %s error: %s\n", row.name, row.s.FirstError)
+		}
+	}
+	return nil
+}
+
+// transport keeps a connection open per request in flight, rather than
+// http.DefaultTransport's two per host.
+func transport(concurrency int) *http.Transport {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.MaxIdleConnsPerHost = concurrency
+	return t
+}
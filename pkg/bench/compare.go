@@ -0,0 +1,153 @@
+package bench
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"text/tabwriter"
+
+	"golang.org/x/perf/benchfmt"
+	"golang.org/x/perf/benchmath"
+	"golang.org/x/perf/benchunit"
+)
+
+// Delta compares a benchmark's measurements in one unit -- sec/op, B/op,
+// allocs/op, B/s and so on -- with its baseline.  Base and Head are
+// medians; Change is the percentage from Base to Head, positive for worse:
+// slower or more allocation, or less throughput.
+type Delta struct {
+	Name      string
+	Unit      string
+	Base      benchmath.Summary
+	Head      benchmath.Summary
+	Change    float64
+	Compared  benchmath.Comparison
+	Regressed bool
+}
+
+// Significant reports whether the samples differ by more than chance.
+func (d Delta) Significant() bool {
+	return d.Compared.P <= d.Compared.Alpha
+}
+
+type sampleKey struct {
+	name, unit string
+}
+
+// samples reads `go test -bench` output, with the values of each
+// benchmark and unit in the order they were first seen.
+func samples(name string) (map[sampleKey][]float64, []sampleKey, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer f.Close()
+
+	values := make(map[sampleKey][]float64)
+	var order []sampleKey
+	r := benchfmt.NewReader(f, name)
+	for r.Scan() {
+		switch rec := r.Result(); rec := rec.(type) {
+		case *benchfmt.SyntaxError:
+			return nil, nil, rec
+		case *benchfmt.Result:
+			bench := string(rec.Name.Full())
+			if pkg := rec.GetConfig("pkg"); pkg != "" {
+				bench = path.Base(pkg) + "." + bench
+			}
+			for _, v := range rec.Values {
+				k := sampleKey{bench, v.Unit}
+				if _, ok := values[k]; !ok {
+					order = append(order, k)
+				}
+				values[k] = append(values[k], v.Value)
+			}
+		}
+	}
+	if err := r.Err(); err != nil {
+		return nil, nil, err
+	}
+	if len(order) == 0 {
+		return nil, nil, fmt.Errorf("no benchmark results in %s", name)
+	}
+	return values, order, nil
+}
+
+// Compare compares two files of `go test -bench` output, benchmark by
+// benchmark and unit by unit, and reports whether any regressed: is
+// significantly slower, or allocates significantly more, by more than
+// threshold percent over its baseline.  Each benchmark should be run
+// several times (-count) for the comparison to be significant; benchmarks
+// missing from either side are left out.
+func Compare(base, head string, threshold float64) ([]Delta, bool, error) {
+	baseValues, _, err := samples(base)
+	if err != nil {
+		return nil, false, err
+	}
+	headValues, order, err := samples(head)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var deltas []Delta
+	regressed := false
+	for _, k := range order {
+		b, ok := baseValues[k]
+		if !ok {
+			continue
+		}
+		bs := benchmath.NewSample(b, &benchmath.DefaultThresholds)
+		hs := benchmath.NewSample(headValues[k], &benchmath.DefaultThresholds)
+		d := Delta{
+			Name:     k.name,
+			Unit:     k.unit,
+			Base:     benchmath.AssumeNothing.Summary(bs, 0.95),
+			Head:     benchmath.AssumeNothing.Summary(hs, 0.95),
+			Compared: benchmath.AssumeNothing.Compare(bs, hs),
+		}
+		d.Change = change(d.Base.Center, d.Head.Center)
+		if higherIsBetter(k.unit) {
+			d.Change = -d.Change
+		}
+		d.Regressed = d.Significant() && d.Change > threshold
+		regressed = regressed || d.Regressed
+		deltas = append(deltas, d)
+	}
+	return deltas, regressed, nil
+}
+
+func change(base, head float64) float64 {
+	if base == 0 {
+		if head == 0 {
+			return 0
+		}
+		return 100
+	}
+	return (head - base) / base * 100
+}
+
+// higherIsBetter reports whether more of unit is an improvement, as it is
+// of throughput.
+func higherIsBetter(unit string) bool {
+	return strings.HasSuffix(unit, "/s")
+}
+
+// PrintDeltas writes a comparison as a table, in the manner of benchstat:
+// a difference that is not significant is shown as "~".
+func PrintDeltas(w io.Writer, deltas []Delta) {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "benchmark\tunit\tbase\thead\tdelta\t\t")
+	for _, d := range deltas {
+		mark := ""
+		if d.Regressed {
+			mark = "REGRESSED"
+		}
+		class := benchunit.ClassOf(d.Unit)
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\t%s\t%s\n", d.Name, d.Unit,
+			benchunit.Scale(d.Base.Center, class), benchunit.Scale(d.Head.Center, class),
+			d.Compared.FormatDelta(d.Base.Center, d.Head.Center), d.Compared, mark)
+	}
+	tw.Flush()
+}
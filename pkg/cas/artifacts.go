@@ -0,0 +1,83 @@
+package cas
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/artifactstream"
+)
+
+// PackOwner and ResultOwner name the owners of query packs and results.
+func PackOwner(session int) string {
+	return fmt.Sprintf("pack/%d", session)
+}
+
+func ResultOwner(js common.JobSpec) string {
+	return fmt.Sprintf("result/%d/%s/%s", js.SessionID, js.Owner, js.Repo)
+}
+
+// Artifacts is an artifactstore.Store writing to the content-addressed
+// store.  Reads go to base, which can read any location, including those
+// of artifacts stored before the content-addressed store was enabled.
+type Artifacts struct {
+	cas  *Store
+	base artifactstore.Store
+}
+
+func NewArtifacts(s *Store, base artifactstore.Store) *Artifacts {
+	return &Artifacts{cas: s, base: base}
+}
+
+func (a *Artifacts) GetQueryPack(loc artifactstore.ArtifactLocation) ([]byte, error) {
+	return a.base.GetQueryPack(loc)
+}
+
+func (a *Artifacts) SaveQueryPack(session int, data []byte) (artifactstore.ArtifactLocation, error) {
+	return a.cas.Put(context.Background(), PackOwner(session), data, "application/gzip")
+}
+
+func (a *Artifacts) GetResult(loc artifactstore.ArtifactLocation) ([]byte, error) {
+	return a.base.GetResult(loc)
+}
+
+func (a *Artifacts) OpenResult(loc artifactstore.ArtifactLocation) (io.ReadCloser, int64, error) {
+	return artifactstream.Open(a.base, loc)
+}
+
+func (a *Artifacts) GetResultSize(loc artifactstore.ArtifactLocation) (int, error) {
+	return a.base.GetResultSize(loc)
+}
+
+func (a *Artifacts) SaveResult(js common.JobSpec, data []byte) (artifactstore.ArtifactLocation, error) {
+	return a.cas.Put(context.Background(), ResultOwner(js), data, "application/zip")
+}
+
+// HandleResult moves the results agents upload into the store before they
+// are recorded, so the state points at the shared copy.  The upload is
+// removed only once next has recorded the copy; until then a redelivered
+// result can still be adopted.  A result that cannot be moved is recorded
+// where the agent left it.
+func (s *Store) HandleResult(next agentproto.ResultHandler) agentproto.ResultHandler {
+	return func(r agentproto.Result) error {
+		if r.ResultLocation.Key == "" || r.ResultLocation.Bucket == Bucket {
+			return next(r)
+		}
+		src := r.ResultLocation
+		loc, err := s.Adopt(context.Background(), ResultOwner(r.Spec), src)
+		if err != nil {
+			slog.Warn("Failed to move result into the content-addressed store", "job", r.Spec, "error", err)
+			return next(r)
+		}
+		r.ResultLocation = loc
+		if err := next(r); err != nil {
+			return err
+		}
+		s.Remove(context.Background(), src)
+		return nil
+	}
+}
@@ -0,0 +1,270 @@
+// Package cas stores artifacts by content hash, so identical query packs
+// and results -- such as the many empty results of a broad query -- are
+// stored once.  Each artifact is referenced by its owners, the session of
+// a query pack or the job of a result; the reference table lives in the
+// metadata store, one row per owner, so an object's reference count is
+// the number of its rows.  Garbage collection is a sweep deleting objects
+// that have had no references for a grace period.
+package cas
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/minio/minio-go/v7"
+	"mrvaserver/pkg/background"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/store"
+)
+
+// Bucket holds the content-addressed artifacts.
+const Bucket = "cas"
+
+const (
+	nsObjects = "cas-objects"
+	nsRefs    = "cas-refs"
+	nsOwners  = "cas-owners"
+)
+
+var (
+	storedTotal = metrics.NewCounter("mrvaserver_cas_stored_total",
+		"Artifacts written to the content-addressed store.")
+	dedupedTotal = metrics.NewCounter("mrvaserver_cas_deduplicated_total",
+		"Artifacts found already stored under their hash.")
+	sweptTotal = metrics.NewCounter("mrvaserver_cas_swept_total",
+		"Unreferenced artifacts deleted.")
+	objectsGauge = metrics.NewGauge("mrvaserver_cas_objects",
+		"Artifacts in the content-addressed store, as of the last sweep.")
+	bytesGauge = metrics.NewGauge("mrvaserver_cas_bytes",
+		"Bytes in the content-addressed store, as of the last sweep.")
+)
+
+// Object is an artifact's row in the object table.
+type Object struct {
+	Hash    string    `json:"hash"`
+	Size    int64     `json:"size"`
+	Created time.Time `json:"created"`
+
+	// Orphaned is when a sweep first found the object unreferenced.
+	Orphaned *time.Time `json:"orphaned,omitempty"`
+}
+
+type ref struct {
+	Owner string    `json:"owner"`
+	Added time.Time `json:"added"`
+}
+
+type owner struct {
+	Hash string `json:"hash"`
+}
+
+type Store struct {
+	cfg  config.CAS
+	mc   *minio.Client
+	meta store.Store
+}
+
+// New returns a content-addressed store in Bucket of mc, creating the
+// bucket if needed.
+func New(cfg config.CAS, mc *minio.Client, meta store.Store) (*Store, error) {
+	if err := common.CreateMinIOBucketIfNotExists(mc, Bucket); err != nil {
+		return nil, fmt.Errorf("failed to create %s bucket: %w", Bucket, err)
+	}
+	return &Store{cfg: cfg, mc: mc, meta: meta}, nil
+}
+
+func objectKey(hash string) string {
+	return "sha256/" + hash[:2] + "/" + hash
+}
+
+// Location returns where the artifact with the given hash is stored.
+func Location(hash string) artifactstore.ArtifactLocation {
+	return artifactstore.ArtifactLocation{Bucket: Bucket, Key: objectKey(hash)}
+}
+
+// Put stores data for owner, replacing what owner referenced before.
+func (s *Store) Put(ctx context.Context, owner string, data []byte, contentType string) (artifactstore.ArtifactLocation, error) {
+	sum := sha256.Sum256(data)
+	hash := hex.EncodeToString(sum[:])
+	if err := s.ref(ctx, owner, hash, int64(len(data))); err != nil {
+		return artifactstore.ArtifactLocation{}, err
+	}
+	if _, err := s.mc.StatObject(ctx, Bucket, objectKey(hash), minio.StatObjectOptions{}); err == nil {
+		dedupedTotal.Inc()
+		return Location(hash), nil
+	}
+	_, err := s.mc.PutObject(ctx, Bucket, objectKey(hash), bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: contentType})
+	if err != nil {
+		return artifactstore.ArtifactLocation{}, fmt.Errorf("failed to store artifact: %w", err)
+	}
+	storedTotal.Inc()
+	return Location(hash), nil
+}
+
+// Adopt copies the artifact at loc, outside the store, into it for owner
+// and returns its new location.  The original is left in place; Remove it
+// once the new location is recorded.
+func (s *Store) Adopt(ctx context.Context, owner string, loc artifactstore.ArtifactLocation) (artifactstore.ArtifactLocation, error) {
+	obj, err := s.mc.GetObject(ctx, loc.Bucket, loc.Key, minio.GetObjectOptions{})
+	if err != nil {
+		return loc, err
+	}
+	h := sha256.New()
+	size, err := io.Copy(h, obj)
+	obj.Close()
+	if err != nil {
+		return loc, fmt.Errorf("failed to read artifact: %w", err)
+	}
+	hash := hex.EncodeToString(h.Sum(nil))
+	if err := s.ref(ctx, owner, hash, size); err != nil {
+		return loc, err
+	}
+
+	if _, err := s.mc.StatObject(ctx, Bucket, objectKey(hash), minio.StatObjectOptions{}); err == nil {
+		dedupedTotal.Inc()
+	} else {
+		_, err := s.mc.CopyObject(ctx,
+			minio.CopyDestOptions{Bucket: Bucket, Object: objectKey(hash)},
+			minio.CopySrcOptions{Bucket: loc.Bucket, Object: loc.Key})
+		if err != nil {
+			return loc, fmt.Errorf("failed to copy artifact: %w", err)
+		}
+		storedTotal.Inc()
+	}
+	return Location(hash), nil
+}
+
+// Remove deletes the original of an adopted artifact.
+func (s *Store) Remove(ctx context.Context, loc artifactstore.ArtifactLocation) {
+	if err := s.mc.RemoveObject(ctx, loc.Bucket, loc.Key, minio.RemoveObjectOptions{}); err != nil {
+		slog.Warn("Failed to remove adopted artifact", "bucket", loc.Bucket, "key", loc.Key, "error", err)
+	}
+}
+
+// ref records that owner references hash, dropping its previous reference.
+// The reference goes in before the object: a sweep never deletes an
+// object with references, and one just orphaned only after the grace
+// period.
+func (s *Store) ref(ctx context.Context, name, hash string, size int64) error {
+	err := store.UpdateJSON(ctx, s.meta, nsObjects, hash, func(o *Object, found bool) error {
+		if !found {
+			*o = Object{Hash: hash, Size: size, Created: time.Now().UTC()}
+		}
+		o.Orphaned = nil
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record artifact: %w", err)
+	}
+	if err := store.PutJSON(ctx, s.meta, nsRefs, hash+"/"+name, ref{Owner: name, Added: time.Now().UTC()}); err != nil {
+		return fmt.Errorf("failed to record artifact reference: %w", err)
+	}
+
+	var prev string
+	err = store.UpdateJSON(ctx, s.meta, nsOwners, name, func(o *owner, found bool) error {
+		prev = o.Hash
+		o.Hash = hash
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to record artifact owner: %w", err)
+	}
+	if prev != "" && prev != hash {
+		if err := s.meta.Delete(ctx, nsRefs, prev+"/"+name); err != nil {
+			slog.Warn("Failed to drop previous artifact reference", "owner", name, "hash", prev, "error", err)
+		}
+	}
+	return nil
+}
+
+// Release drops owner's reference.
+func (s *Store) Release(ctx context.Context, name string) error {
+	var o owner
+	err := store.GetJSON(ctx, s.meta, nsOwners, name, &o)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if err := s.meta.Delete(ctx, nsRefs, o.Hash+"/"+name); err != nil {
+		return err
+	}
+	return s.meta.Delete(ctx, nsOwners, name)
+}
+
+// Sweep deletes artifacts that have been unreferenced for cfg.Grace.  It
+// is a background task.
+func (s *Store) Sweep(ctx context.Context) error {
+	objects, err := store.ListJSON[Object](ctx, s.meta, nsObjects, "")
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	// Objects not swept are counted, whether or not this pass got to them.
+	var count, size atomic.Int64
+	for _, o := range objects {
+		count.Add(1)
+		size.Add(o.Size)
+	}
+	err = background.Each(ctx, objects, func(ctx context.Context, o Object) error {
+		refs, err := s.meta.List(ctx, nsRefs, o.Hash+"/")
+		if err != nil {
+			return err
+		}
+		switch {
+		case len(refs) > 0 && o.Orphaned != nil:
+			o.Orphaned = nil
+		case len(refs) > 0:
+			return nil
+		case o.Orphaned == nil:
+			o.Orphaned = &now
+		case now.Sub(*o.Orphaned) >= s.cfg.Grace:
+			// The row goes first and the references are checked again:
+			// an artifact being stored again meanwhile is either seen
+			// here or uploaded anew when its stat misses.
+			if err := s.meta.Delete(ctx, nsObjects, o.Hash); err != nil {
+				return err
+			}
+			refs, err := s.meta.List(ctx, nsRefs, o.Hash+"/")
+			if err != nil {
+				return err
+			}
+			if len(refs) > 0 {
+				o.Orphaned = nil
+				return store.UpdateJSON(ctx, s.meta, nsObjects, o.Hash, func(v *Object, found bool) error {
+					if !found {
+						*v = o
+					}
+					return nil
+				})
+			}
+			if err := s.mc.RemoveObject(ctx, Bucket, objectKey(o.Hash), minio.RemoveObjectOptions{}); err != nil {
+				return fmt.Errorf("failed to delete artifact %s: %w", o.Hash, err)
+			}
+			sweptTotal.Inc()
+			count.Add(-1)
+			size.Add(-o.Size)
+			return nil
+		}
+		return store.PutJSON(ctx, s.meta, nsObjects, o.Hash, o)
+	})
+	if err != nil {
+		return err
+	}
+	objectsGauge.Set(float64(count.Load()))
+	bytesGauge.Set(float64(size.Load()))
+	return nil
+}
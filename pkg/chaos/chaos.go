@@ -0,0 +1,207 @@
+// Package chaos injects faults into a running server to exercise its
+// recovery paths: dropped result acknowledgements (redelivery and dedup),
+// slow artifact puts (timeouts and retries) and killed Postgres
+// connections (pool reconnects and repair).  Faults are off until set
+// through /admin/chaos.
+//
+// The server links this package in only when built with the chaos tag:
+//
+//	go build -tags chaos
+package chaos
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/jackc/pgx/v5"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/artifactstream"
+	"mrvaserver/pkg/web"
+)
+
+// ErrAckDropped is returned for a result whose acknowledgement is
+// dropped.  The result has been applied; the queue redelivers it.
+var ErrAckDropped = errors.New("chaos: result acknowledgement dropped")
+
+// Faults are the faults in effect.
+type Faults struct {
+	// DropAckPercent is the share of results, 0 to 100, whose
+	// acknowledgement is dropped after they are applied.
+	DropAckPercent float64 `json:"drop_ack_percent"`
+
+	// PutDelay delays every artifact put.
+	PutDelay Duration `json:"put_delay"`
+}
+
+// Duration is a time.Duration written as a string such as "2s".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+type Injector struct {
+	mu     sync.Mutex
+	faults Faults
+
+	// dsns are the Postgres databases whose connections can be killed.
+	dsns []string
+}
+
+func New(dsns []string) *Injector {
+	return &Injector{dsns: dsns}
+}
+
+func (in *Injector) current() Faults {
+	in.mu.Lock()
+	defer in.mu.Unlock()
+	return in.faults
+}
+
+// Results wraps next so that results it applies are acknowledged, or
+// not, as the faults say.
+func (in *Injector) Results(next agentproto.ResultHandler) agentproto.ResultHandler {
+	return func(r agentproto.Result) error {
+		if err := next(r); err != nil {
+			return err
+		}
+		if p := in.current().DropAckPercent; p > 0 && rand.Float64()*100 < p {
+			slog.Warn("Chaos: dropping result acknowledgement", "job", r.Spec)
+			return ErrAckDropped
+		}
+		return nil
+	}
+}
+
+// Artifacts wraps store so that puts are delayed as the faults say.
+func (in *Injector) Artifacts(store artifactstore.Store) artifactstore.Store {
+	return &artifacts{Store: store, in: in}
+}
+
+type artifacts struct {
+	artifactstore.Store
+	in *Injector
+}
+
+func (a *artifacts) delay() {
+	if d := time.Duration(a.in.current().PutDelay); d > 0 {
+		time.Sleep(d)
+	}
+}
+
+func (a *artifacts) SaveQueryPack(sessionID int, data []byte) (artifactstore.ArtifactLocation, error) {
+	a.delay()
+	return a.Store.SaveQueryPack(sessionID, data)
+}
+
+func (a *artifacts) OpenResult(loc artifactstore.ArtifactLocation) (io.ReadCloser, int64, error) {
+	return artifactstream.Open(a.Store, loc)
+}
+
+func (a *artifacts) SaveResult(js common.JobSpec, data []byte) (artifactstore.ArtifactLocation, error) {
+	a.delay()
+	return a.Store.SaveResult(js, data)
+}
+
+// KillConnections terminates every other connection its databases' users
+// hold, all replicas' included, and returns how many it terminated.
+func (in *Injector) KillConnections(ctx context.Context) (int, error) {
+	killed := 0
+	for _, dsn := range in.dsns {
+		conn, err := pgx.Connect(ctx, dsn)
+		if err != nil {
+			return killed, fmt.Errorf("failed to connect: %w", err)
+		}
+		var n int
+		err = conn.QueryRow(ctx, `SELECT count(pg_terminate_backend(pid)) FROM pg_stat_activity
+			WHERE datname = current_database() AND usename = current_user AND pid <> pg_backend_pid()`).Scan(&n)
+		conn.Close(ctx)
+		if err != nil {
+			return killed, fmt.Errorf("failed to terminate connections: %w", err)
+		}
+		killed += n
+	}
+	slog.Warn("Chaos: killed Postgres connections", "count", killed)
+	return killed, nil
+}
+
+// RegisterAdmin adds the fault controls:
+//
+//	GET    /admin/chaos          the faults in effect
+//	PUT    /admin/chaos          replace them
+//	DELETE /admin/chaos          clear them
+//	POST   /admin/chaos/pg-kill  kill Postgres connections now
+func (in *Injector) RegisterAdmin(r *mux.Router) {
+	r.HandleFunc("/admin/chaos", in.get).Methods(http.MethodGet)
+	r.HandleFunc("/admin/chaos", in.put).Methods(http.MethodPut)
+	r.HandleFunc("/admin/chaos", in.clear).Methods(http.MethodDelete)
+	r.HandleFunc("/admin/chaos/pg-kill", in.pgKill).Methods(http.MethodPost)
+}
+
+func (in *Injector) get(w http.ResponseWriter, r *http.Request) {
+	web.WriteJSON(w, http.StatusOK, in.current())
+}
+
+func (in *Injector) put(w http.ResponseWriter, r *http.Request) {
+	var f Faults
+	dec := json.NewDecoder(r.Body)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&f); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if f.DropAckPercent < 0 || f.DropAckPercent > 100 || f.PutDelay < 0 {
+		http.Error(w, "drop_ack_percent must be 0-100 and put_delay not negative", http.StatusBadRequest)
+		return
+	}
+	in.mu.Lock()
+	in.faults = f
+	in.mu.Unlock()
+	slog.Warn("Chaos: faults set", "drop_ack_percent", f.DropAckPercent, "put_delay", time.Duration(f.PutDelay))
+	web.WriteJSON(w, http.StatusOK, f)
+}
+
+func (in *Injector) clear(w http.ResponseWriter, r *http.Request) {
+	in.mu.Lock()
+	in.faults = Faults{}
+	in.mu.Unlock()
+	slog.Info("Chaos: faults cleared")
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (in *Injector) pgKill(w http.ResponseWriter, r *http.Request) {
+	if len(in.dsns) == 0 {
+		http.Error(w, "no Postgres databases configured", http.StatusConflict)
+		return
+	}
+	n, err := in.KillConnections(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, map[string]int{"killed": n})
+}
@@ -0,0 +1,1312 @@
+// Package config loads mrvaserver's configuration file.  Backend endpoints
+// and credentials stay in the environment, as mrvacommander's deploy package
+// expects; the file holds tuning and feature settings.
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log/slog"
+	"net/netip"
+	"net/url"
+	"os"
+	"regexp"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+
+	"gopkg.in/yaml.v3"
+	"mrvaserver/pkg/backend"
+)
+
+type Config struct {
+	HTTP      HTTP      `yaml:"http"`
+	State     State     `yaml:"state"`
+	Cache     Cache     `yaml:"cache"`
+	Queue     Queue     `yaml:"queue"`
+	Artifacts Artifacts `yaml:"artifacts"`
+	Databases Databases `yaml:"databases"`
+	Egress    Egress    `yaml:"egress"`
+	Discovery Discovery `yaml:"discovery"`
+	Ingest    Ingest    `yaml:"ingest"`
+	Leader    Leader    `yaml:"leader"`
+	ReadOnly  ReadOnly  `yaml:"read_only"`
+	Loops     Loops     `yaml:"loops"`
+
+	Replication   Replication   `yaml:"replication"`
+	Leases        Leases        `yaml:"leases"`
+	Retries       Retries       `yaml:"retries"`
+	Routing       Routing       `yaml:"routing"`
+	Dispatch      Dispatch      `yaml:"dispatch"`
+	Prefetch      Prefetch      `yaml:"prefetch"`
+	Bandwidth     Bandwidth     `yaml:"bandwidth"`
+	CAS           CAS           `yaml:"cas"`
+	Tiering       Tiering       `yaml:"tiering"`
+	Usage         Usage         `yaml:"usage"`
+	Reports       Reports       `yaml:"usage_reports"`
+	Trash         Trash         `yaml:"trash"`
+	DropFolder    DropFolder    `yaml:"drop_folder"`
+	Encryption    Encryption    `yaml:"encryption"`
+	PackScan      PackScan      `yaml:"pack_scan"`
+	MalwareScan   MalwareScan   `yaml:"malware_scan"`
+	Sandbox       Sandbox       `yaml:"sandbox"`
+	Signing       Signing       `yaml:"signing"`
+	Issues        Issues        `yaml:"issues"`
+	Notifications Notifications `yaml:"notifications"`
+	Findings      Findings      `yaml:"findings"`
+	Sessions      Sessions      `yaml:"sessions"`
+	Toolchains    Toolchains    `yaml:"toolchains"`
+	RepoStats     RepoStats     `yaml:"repo_stats"`
+	Messages      Messages      `yaml:"messages"`
+	Logging       Logging       `yaml:"logging"`
+	Errors        Errors        `yaml:"error_reporting"`
+	Flags         Flags         `yaml:"feature_flags"`
+	Tenants       Tenants       `yaml:"tenants"`
+	UsageStats    UsageStats    `yaml:"usage_stats"`
+}
+
+// HTTP configures the public listener.  Listen is host:port or
+// unix:/path/to/socket, or several separated by commas; empty means port
+// SERVER_PORT (default 8080) on all interfaces, IPv4 and IPv6.  A zero timeout disables it.  WriteTimeout bounds whole
+// responses, including long-polls and artifact downloads, so it is off by
+// default.
+//
+// Behind a reverse proxy, BasePath is the path prefix the server is
+// published under, and TrustedProxies lists the addresses or CIDR ranges
+// whose X-Forwarded-* headers are believed.
+//
+// AdminAllow, if set, lists the addresses or CIDR ranges of the only
+// clients answered on /admin/ and /debug/, in addition to any API
+// authentication.
+//
+// MaxHeaderBytes bounds the request line and headers; with
+// ReadHeaderTimeout it keeps slow or oversized headers from holding
+// connections.
+//
+// ProbeListen, if set, is a listener opened at process start that serves
+// only /startupz and /livez, so a startup probe can wait out migrations
+// and backend warm-up before the public listener exists.
+type HTTP struct {
+	Listen            string        `yaml:"listen"`
+	ProbeListen       string        `yaml:"probe_listen"`
+	BasePath          string        `yaml:"base_path"`
+	TrustedProxies    []string      `yaml:"trusted_proxies"`
+	AdminAllow        []string      `yaml:"admin_allow"`
+	ReadHeaderTimeout time.Duration `yaml:"read_header_timeout"`
+	ReadTimeout       time.Duration `yaml:"read_timeout"`
+	WriteTimeout      time.Duration `yaml:"write_timeout"`
+	IdleTimeout       time.Duration `yaml:"idle_timeout"`
+	MaxHeaderBytes    int           `yaml:"max_header_bytes"`
+
+	// With TLSCertFile and TLSKeyFile the listener serves HTTPS, with
+	// HTTP/2 negotiated by ALPN.  H2C serves cleartext HTTP/2 as well as
+	// HTTP/1.1, for proxies that speak it.
+	TLSCertFile string `yaml:"tls_cert_file"`
+	TLSKeyFile  string `yaml:"tls_key_file"`
+	H2C         bool   `yaml:"h2c"`
+
+	Compression Compression `yaml:"compression"`
+	RateLimit   RateLimit   `yaml:"rate_limit"`
+	Hardening   Hardening   `yaml:"hardening"`
+	Caching     Caching     `yaml:"caching"`
+	Downloads   Downloads   `yaml:"downloads"`
+	AccessLog   AccessLog   `yaml:"access_log"`
+	Auth        Auth        `yaml:"auth"`
+}
+
+// Auth knows callers by their bearer tokens.  Each line of TokensFile is a
+// principal's name and one of its tokens, separated by white space; blank
+// lines and lines starting with # are skipped.  Callers with another
+// token, or none, are not authenticated and are known by their address.
+// Admins are the principals allowed on the admin control endpoints, such
+// as POST /admin/lame-duck, which answer no one else.
+type Auth struct {
+	TokensFile string   `yaml:"tokens_file"`
+	Admins     []string `yaml:"admins"`
+}
+
+// Hardening configures the security headers of responses and caps request
+// bodies by endpoint class, as for rate limits; a class without a cap is
+// not limited.  HSTSMaxAge, if positive, is sent as
+// Strict-Transport-Security on HTTPS responses.
+type Hardening struct {
+	Enabled    bool             `yaml:"enabled"`
+	HSTSMaxAge time.Duration    `yaml:"hsts_max_age"`
+	MaxBody    map[string]int64 `yaml:"max_body"`
+}
+
+// Caching lets clients and the server reuse responses about finished
+// sessions.  Status documents of terminal sessions are sent with
+// Cache-Control max-age MaxAge, and up to Entries of them are kept
+// rendered while their session is unchanged, for at most TTL so that
+// later annotations show.  Result downloads, whose content never changes,
+// are sent private and immutable, unless hardening makes them no-store or
+// their session is sealed or an authenticated tenant's.
+type Caching struct {
+	Enabled bool          `yaml:"enabled"`
+	Entries int           `yaml:"entries"`
+	TTL     time.Duration `yaml:"ttl"`
+	MaxAge  time.Duration `yaml:"max_age"`
+}
+
+// Downloads bounds the result downloads a replica serves at once, each
+// streamed from the artifact store.  A download beyond MaxConcurrent waits
+// up to Wait for its turn, then is refused with 503.  Zero MaxConcurrent
+// is no limit.
+type Downloads struct {
+	MaxConcurrent int           `yaml:"max_concurrent"`
+	Wait          time.Duration `yaml:"wait"`
+}
+
+// AccessLog logs a Sample fraction, from 0 to 1, of requests, or the
+// fraction under Classes for their endpoint class as for rate limits.
+// Requests slower than SlowThreshold and server errors are always logged.
+type AccessLog struct {
+	Enabled       bool               `yaml:"enabled"`
+	Sample        float64            `yaml:"sample"`
+	Classes       map[string]float64 `yaml:"classes"`
+	SlowThreshold time.Duration      `yaml:"slow_threshold"`
+}
+
+// Compression configures zstd/gzip compression of responses.  Responses of
+// known length below MinSize bytes are sent uncompressed.
+type Compression struct {
+	Enabled bool `yaml:"enabled"`
+	MinSize int  `yaml:"min_size"`
+}
+
+// RateLimit configures per-caller token buckets by endpoint class:
+// "submission", "polling", "download" and "other".
+type RateLimit struct {
+	Enabled bool            `yaml:"enabled"`
+	Classes map[string]Rate `yaml:"classes"`
+}
+
+// Rate refills PerMinute tokens a minute, up to Burst.
+type Rate struct {
+	PerMinute float64 `yaml:"per_minute"`
+	Burst     int     `yaml:"burst"`
+}
+
+type State struct {
+	// Backend selects the ServerState: "commander" for mrvacommander's
+	// PGState, "postgres" for mrvaserver's pgstate, which supports
+	// batched result writes, "mysql" for the same over MySQL or MariaDB,
+	// "etcd" for etcd, which then also holds the metadata and locks, or
+	// "journal" for an in-memory state journaled to JournalFile, for
+	// development.
+	Backend string `yaml:"backend"`
+
+	// EtcdPrefix is the key prefix of the "etcd" backend.
+	EtcdPrefix string `yaml:"etcd_prefix"`
+
+	// JournalFile and JournalSync configure the "journal" backend.
+	// JournalSync flushes every write to disk before acknowledging it.
+	JournalFile string `yaml:"journal_file"`
+	JournalSync bool   `yaml:"journal_sync"`
+}
+
+// Cache configures the Redis read-through cache in front of the state (see
+// the MRVA_REDIS_* environment variables).  TTL bounds how long an entry
+// can be stale if its invalidation is lost.
+type Cache struct {
+	Enabled bool          `yaml:"enabled"`
+	TTL     time.Duration `yaml:"ttl"`
+}
+
+type Queue struct {
+	// Backend is "rabbitmq" or a queue registered with package backend.
+	// The remaining settings are RabbitMQ's.
+	Backend string `yaml:"backend"`
+
+	// Results configures consumption of the results queue.
+	Results ConsumerPool `yaml:"results"`
+
+	// Priority declares the jobs queues as priority queues, so that jobs
+	// requeued after a preemption are dispatched ahead of queued ones.
+	// Everything that declares those queues, agents included, must
+	// declare them the same way, and existing queues must be deleted
+	// first.
+	Priority bool `yaml:"priority"`
+
+	// Quorum declares the server's queues as durable quorum queues,
+	// replicated across the broker's nodes, so that queued jobs and
+	// results survive the loss of a node, and publishes jobs persistent.
+	// As with Priority, agents must declare the queues the same way and
+	// existing queues must be deleted first.  Quorum queues take no
+	// x-max-priority: with Priority, preempted jobs rely on RabbitMQ 4's
+	// built-in priorities for quorum queues.
+	Quorum bool `yaml:"quorum"`
+
+	// ManagementURL is the broker's management API, from which
+	// GET /admin/queues reports the queues: port 15672 of
+	// MRVA_RABBITMQ_HOST by default, with the MRVA_RABBITMQ_* credentials
+	// unless the URL carries its own.
+	ManagementURL string `yaml:"management_url"`
+
+	// Quarantine configures the quarantine of poison messages.
+	Quarantine Quarantine `yaml:"quarantine"`
+}
+
+// Quarantine takes the results and lease messages that fail to decode or
+// validate off their queues, and those whose handler fails on
+// MaxDeliveries deliveries, keeping their bodies in Bucket of the artifact
+// store for inspection at /admin/quarantine.  Without it they are dropped
+// or requeued.
+type Quarantine struct {
+	Enabled       bool   `yaml:"enabled"`
+	Bucket        string `yaml:"bucket"`
+	MaxDeliveries int    `yaml:"max_deliveries"`
+}
+
+// Artifacts selects the artifact store: "minio", mrvacommander's MinIO
+// store, or one registered with package backend.  Features that manage
+// the artifacts' objects directly need "minio".
+type Artifacts struct {
+	Backend string `yaml:"backend"`
+}
+
+// Databases selects the CodeQL database store: "hepc", mrvacommander's
+// default, or one registered with package backend.
+type Databases struct {
+	Backend string `yaml:"backend"`
+}
+
+// Egress routes outbound HTTP calls, to HEPC, GitHub and issue trackers
+// among others, through Proxy, except to the hosts in NoProxy (a
+// comma-separated list as in NO_PROXY), and trusts the PEM certificates
+// in CABundle as well as the system's, for TLS-intercepting proxies.  An
+// empty Proxy leaves the HTTPS_PROXY, HTTP_PROXY and NO_PROXY environment
+// variables in charge.
+type Egress struct {
+	Proxy    string `yaml:"proxy"`
+	NoProxy  string `yaml:"no_proxy"`
+	CABundle string `yaml:"ca_bundle"`
+}
+
+// Discovery re-resolves the host names of the backing services every
+// Interval and resets their clients' pooled connections when the
+// addresses change; 0 turns it off.
+type Discovery struct {
+	Interval time.Duration `yaml:"interval"`
+}
+
+// ConsumerPool sizes the consumers of one queue.  Consumers is the number of
+// AMQP consumers (each on its own channel), Prefetch the unacknowledged
+// message limit per consumer, and Concurrency the number of goroutines
+// handling the deliveries of all consumers together.
+type ConsumerPool struct {
+	Consumers   int `yaml:"consumers"`
+	Prefetch    int `yaml:"prefetch"`
+	Concurrency int `yaml:"concurrency"`
+}
+
+// Ingest configures batching of result writes.  Results are buffered up to
+// Buffer entries and written BatchSize at a time, or whatever has arrived
+// after FlushInterval.  Batches can only be as large as the number of
+// results in flight, so Queue.Results.Concurrency should be at least
+// BatchSize.
+type Ingest struct {
+	BatchSize     int           `yaml:"batch_size"`
+	FlushInterval time.Duration `yaml:"flush_interval"`
+	Buffer        int           `yaml:"buffer"`
+}
+
+// Leader configures election of the replica that runs leader-only
+// background subsystems.  Backend is "postgres" (an advisory lock in the
+// metadata database, or a lease-bound key with the etcd state backend) or
+// "kubernetes" (a Lease object; Namespace defaults to the pod's own).
+type Leader struct {
+	Backend       string        `yaml:"backend"`
+	LeaseName     string        `yaml:"lease_name"`
+	Namespace     string        `yaml:"namespace"`
+	LeaseDuration time.Duration `yaml:"lease_duration"`
+}
+
+// ReadOnly runs the replica as a read-only one, answering session status,
+// listings and downloads and refusing everything else, so heavy polling
+// can be spread away from the writer.  Its MRVA_STATE_DSN and
+// MRVA_STORE_DSN may name Postgres read replicas: it creates no schema,
+// consumes no queue and runs no background tasks.
+type ReadOnly struct {
+	Enabled bool `yaml:"enabled"`
+}
+
+// Loops tunes the background tasks that reconcile items one by one, by
+// task name: see LoopTasks.  Tasks not listed work on one item at a time
+// and take on all of them every pass.
+type Loops map[string]Loop
+
+// Loop tunes one task.  Workers items are worked on at once; BatchSize, if
+// set, bounds the items taken on per pass, each pass resuming where the
+// last stopped.
+type Loop struct {
+	Workers   int `yaml:"workers"`
+	BatchSize int `yaml:"batch_size"`
+}
+
+// LoopTasks are the background tasks that can be tuned under loops.
+var LoopTasks = []string{"lease-reaper", "cas-sweep", "artifact-tiering", "findings-index", "trash-purge", "retention"}
+
+// Replication configures copying of artifacts to a disaster-recovery
+// secondary (see the DR_MINIO_* environment variables).  Interval is the
+// period of the reconciliation pass; Buffer bounds the artifacts queued for
+// immediate copying.
+type Replication struct {
+	Enabled      bool          `yaml:"enabled"`
+	BucketPrefix string        `yaml:"bucket_prefix"`
+	Interval     time.Duration `yaml:"interval"`
+	Buffer       int           `yaml:"buffer"`
+}
+
+// Leases configures job leases.  Agents that take leases must renew them
+// within TTL or their job is requeued, up to MaxAttempts dispatches in all.
+// ReapInterval is how often expired leases are looked for.
+type Leases struct {
+	Enabled      bool          `yaml:"enabled"`
+	TTL          time.Duration `yaml:"ttl"`
+	ReapInterval time.Duration `yaml:"reap_interval"`
+	MaxAttempts  int           `yaml:"max_attempts"`
+}
+
+// Retries configures how jobs that agents report as failed are retried,
+// keyed by the failure class the agent reports.  Failures of a class not
+// listed, or with no class, use the "unknown" policy.  Interval is how
+// often retries that have waited out their backoff are dispatched.
+type Retries struct {
+	Interval time.Duration          `yaml:"interval"`
+	Policies map[string]RetryPolicy `yaml:"policies"`
+}
+
+// RetryPolicy retries a failure up to Max times.  The first retry waits
+// Backoff, and each further one twice as long, up to MaxBackoff.  Pool, if
+// set, is the agent pool retries are dispatched to.
+type RetryPolicy struct {
+	Max        int           `yaml:"max"`
+	Backoff    time.Duration `yaml:"backoff"`
+	MaxBackoff time.Duration `yaml:"max_backoff"`
+	Pool       string        `yaml:"pool"`
+}
+
+// Routing configures agent pools.  Each pool has its own jobs queue,
+// tasks.<name>, except the pool named "default", which is the tasks queue
+// agents use out of the box.  Labels are what every agent of the pool
+// offers; jobs whose constraints they satisfy may be routed to the pool.
+// Rules add constraints to the jobs of every session in a language.
+// Agents that have not reported in for AgentTTL are not counted as live.
+type Routing struct {
+	Pools    []Pool        `yaml:"pools"`
+	Rules    []RoutingRule `yaml:"rules"`
+	AgentTTL time.Duration `yaml:"agent_ttl"`
+	Affinity Affinity      `yaml:"affinity"`
+}
+
+// Affinity sends a job to the queue of a live agent in its pool that has
+// the job's database cached, when there is one.  A job the agent has not
+// taken within Wait moves on to the pool's queue.
+type Affinity struct {
+	Enabled bool          `yaml:"enabled"`
+	Wait    time.Duration `yaml:"wait"`
+}
+
+type Pool struct {
+	Name   string            `yaml:"name"`
+	Labels map[string]string `yaml:"labels"`
+}
+
+type RoutingRule struct {
+	Language    string   `yaml:"language"`
+	Constraints []string `yaml:"constraints"`
+}
+
+// Dispatch configures how jobs are released to the agents' queues.  New
+// jobs wait in a backlog in the metadata store and are published while
+// fewer than Window jobs of their pool are outstanding, that is, published
+// and without a final result; 0 publishes them all at once.  Holding jobs
+// back is what lets a session be paused.  Interval is how often each
+// replica rereads the backlog and drops outstanding jobs that finished
+// without a result.  MaxPerSession caps the outstanding jobs of each
+// session, its shards together; submitters may set a lower cap with
+// max_concurrency.  0 leaves sessions uncapped.
+type Dispatch struct {
+	Window        int           `yaml:"window"`
+	Interval      time.Duration `yaml:"interval"`
+	MaxPerSession int           `yaml:"max_per_session"`
+}
+
+// Prefetch stages the databases of new jobs from the database store into
+// Bucket of the artifact store while the jobs wait in the dispatch
+// backlog, so agents fetch them nearby.  Concurrency databases are staged
+// at a time, each held in memory while it is copied.  Staged copies are
+// deleted after Retention.  Database downloads are served from staged
+// copies, with a manifest of ChunkSize-byte chunks for parallel fetching.
+type Prefetch struct {
+	Enabled     bool          `yaml:"enabled"`
+	Bucket      string        `yaml:"bucket"`
+	Concurrency int           `yaml:"concurrency"`
+	Retention   time.Duration `yaml:"retention"`
+	ChunkSize   int64         `yaml:"chunk_size"`
+}
+
+// Bandwidth limits the rate of artifact and database transfers, in bytes
+// per second; 0 is unlimited.  Ingress counts what the server receives:
+// query pack uploads, prefetched databases and artifacts read for
+// replication.  Egress counts what it sends: artifact and database
+// downloads, staged databases and replicated artifacts.
+type Bandwidth struct {
+	Enabled bool           `yaml:"enabled"`
+	Ingress BandwidthLimit `yaml:"ingress"`
+	Egress  BandwidthLimit `yaml:"egress"`
+}
+
+// BandwidthLimit is the limit of one direction for all transfers and for
+// those of each session.
+type BandwidthLimit struct {
+	Global     int64 `yaml:"global"`
+	PerSession int64 `yaml:"per_session"`
+}
+
+// CAS stores query packs and results by content hash, once however many
+// sessions and jobs reference them.  Every SweepInterval, artifacts that
+// have been unreferenced for Grace are deleted.
+type CAS struct {
+	Enabled       bool          `yaml:"enabled"`
+	SweepInterval time.Duration `yaml:"sweep_interval"`
+	Grace         time.Duration `yaml:"grace"`
+}
+
+// Tiering moves the artifacts of sessions untouched for After into Bucket,
+// with StorageClass if set, checking every Interval.  The storage class
+// must be one objects can be read from directly.
+type Tiering struct {
+	Enabled      bool          `yaml:"enabled"`
+	After        time.Duration `yaml:"after"`
+	Bucket       string        `yaml:"bucket"`
+	StorageClass string        `yaml:"storage_class"`
+	Interval     time.Duration `yaml:"interval"`
+}
+
+// Usage tracks the artifact bytes each session and user stores.  Results
+// that would take a session past SessionCap or a user past UserCap bytes
+// are rejected; 0 is no cap.
+type Usage struct {
+	Enabled    bool  `yaml:"enabled"`
+	SessionCap int64 `yaml:"session_cap"`
+	UserCap    int64 `yaml:"user_cap"`
+}
+
+// Reports exports a usage report of each week and month past Periods
+// names, "weekly" (ISO weeks) or "monthly" in UTC, to Bucket as CSV and
+// JSON, and mails it if Email names recipients.
+type Reports struct {
+	Enabled bool        `yaml:"enabled"`
+	Periods []string    `yaml:"periods"`
+	Bucket  string      `yaml:"bucket"`
+	Email   ReportEmail `yaml:"email"`
+}
+
+// ReportEmail sends reports from From to To through the SMTP server at
+// Addr, host:port, logging in as Username with the password in
+// PasswordFile if Username is set.
+type ReportEmail struct {
+	Addr         string   `yaml:"addr"`
+	From         string   `yaml:"from"`
+	To           []string `yaml:"to"`
+	Username     string   `yaml:"username"`
+	PasswordFile string   `yaml:"password_file"`
+}
+
+// Trash keeps deleted sessions restorable for Grace, checking every
+// PurgeInterval for sessions to purge for good.
+type Trash struct {
+	Grace         time.Duration `yaml:"grace"`
+	PurgeInterval time.Duration `yaml:"purge_interval"`
+}
+
+// DropFolder submits the session specs deposited in Dir, or under Prefix
+// of Bucket in the artifact store, checking every Interval; see package
+// dropfolder.
+type DropFolder struct {
+	Enabled  bool          `yaml:"enabled"`
+	Dir      string        `yaml:"dir"`
+	Bucket   string        `yaml:"bucket"`
+	Prefix   string        `yaml:"prefix"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Encryption lets submissions carry a key their results are sealed with.
+// KEKFile holds the base64 32-byte key the AES keys of sessions are
+// wrapped with in the metadata store.
+type Encryption struct {
+	Enabled bool   `yaml:"enabled"`
+	KEKFile string `yaml:"kek_file"`
+}
+
+// PackScan rejects submitted query packs whose QL sources match a Deny
+// rule, whose YAML files set a resource hint in MaxHints above its limit,
+// or that exceed the size limits; a zero limit is no limit.
+type PackScan struct {
+	Enabled          bool             `yaml:"enabled"`
+	Deny             []PackRule       `yaml:"deny"`
+	MaxHints         map[string]int64 `yaml:"max_hints"`
+	MaxCompiledBytes int64            `yaml:"max_compiled_bytes"`
+	MaxTotalBytes    int64            `yaml:"max_total_bytes"`
+	MaxFiles         int              `yaml:"max_files"`
+}
+
+// MalwareScan passes submitted query packs and, with Databases, staged
+// databases through a malware scanner before they are stored or
+// dispatched.  Kind "clamav" streams them to clamd at Addr, host:port or
+// unix:/path/to/socket; Kind "http" POSTs them to URL.  Databases are
+// only scanned as they are staged, so Databases needs prefetch, and jobs
+// then wait in the backlog until their database is scanned.  A scanner
+// that cannot be reached within Timeout fails the submission or holds the
+// job, unless FailOpen.
+type MalwareScan struct {
+	Enabled   bool          `yaml:"enabled"`
+	Kind      string        `yaml:"kind"`
+	Addr      string        `yaml:"addr"`
+	URL       string        `yaml:"url"`
+	Timeout   time.Duration `yaml:"timeout"`
+	Databases bool          `yaml:"databases"`
+	FailOpen  bool          `yaml:"fail_open"`
+}
+
+// PackRule is a regular expression QL sources must not match.
+type PackRule struct {
+	Name    string `yaml:"name"`
+	Pattern string `yaml:"pattern"`
+}
+
+// Sandbox is the execution envelope attached to every job: whether it may
+// reach the network, whether its database is mounted read-only, and its
+// memory limit in bytes (0: none).  With Require, successful results are
+// only recorded if their agent attests to an envelope at least as strict.
+type Sandbox struct {
+	Enabled          bool  `yaml:"enabled"`
+	Network          bool  `yaml:"network"`
+	ReadOnlyDatabase bool  `yaml:"read_only_database"`
+	MemoryLimit      int64 `yaml:"memory_limit"`
+	Require          bool  `yaml:"require"`
+}
+
+// Signing signs the jobs the server publishes with the Ed25519 private key
+// in KeyFile.  With AgentKeys, base64 public keys by agent name ("*" for
+// agents without their own), results not signed by their agent are
+// dropped.
+type Signing struct {
+	Enabled   bool              `yaml:"enabled"`
+	KeyFile   string            `yaml:"key_file"`
+	AgentKeys map[string]string `yaml:"agent_keys"`
+}
+
+// Toolchains names the agent image and CodeQL bundle the jobs of each
+// query language run with; language "*" covers the others.  A canary
+// toolchain takes CanaryPercent of a language's sessions, for staged
+// rollouts of a new CodeQL release.
+//
+// A canary is ready to promote once it has finished Rollout.MinJobs jobs,
+// its failure rate is at most Rollout.MaxFailureIncrease (a fraction)
+// above the stable release's, and its mean runtime at most
+// Rollout.MaxRuntimeRatio times the stable release's.
+type Toolchains struct {
+	Languages []LanguageToolchain `yaml:"languages"`
+	Rollout   Rollout             `yaml:"rollout"`
+}
+
+type Rollout struct {
+	MinJobs            int     `yaml:"min_jobs"`
+	MaxFailureIncrease float64 `yaml:"max_failure_increase"`
+	MaxRuntimeRatio    float64 `yaml:"max_runtime_ratio"`
+}
+
+type LanguageToolchain struct {
+	Language      string     `yaml:"language"`
+	Image         string     `yaml:"image"`
+	Bundle        string     `yaml:"bundle"`
+	Canary        *Toolchain `yaml:"canary"`
+	CanaryPercent int        `yaml:"canary_percent"`
+}
+
+type Toolchain struct {
+	Image  string `yaml:"image"`
+	Bundle string `yaml:"bundle"`
+}
+
+// RepoStats flags repositories that analyses keep struggling with, from
+// their outcomes across sessions.  Once a repository has MinJobs results,
+// it is flagged if more than MaxFailureRate (a fraction) of them failed,
+// if MaxOOMs of them ran out of memory, or if its mean runtime exceeds
+// MaxMeanRuntime.  Zero leaves a criterion out.  Flags stay until an admin
+// resets them.
+type RepoStats struct {
+	MinJobs        int           `yaml:"min_jobs"`
+	MaxFailureRate float64       `yaml:"max_failure_rate"`
+	MaxOOMs        int           `yaml:"max_ooms"`
+	MaxMeanRuntime time.Duration `yaml:"max_mean_runtime"`
+}
+
+// Messages localizes user-facing messages.  Dir holds a JSON file of
+// message templates per locale, named after it (pt-BR.json); English is
+// built in.  DefaultLocale is the locale of requests that ask for none
+// the server has, and must have messages.
+type Messages struct {
+	Dir           string `yaml:"dir"`
+	DefaultLocale string `yaml:"default_locale"`
+}
+
+// Logging sends the server's logs to every sink enabled: standard error,
+// File, Syslog and OTLP.  Format, "text" or "json", is that of standard
+// error and files; with only standard error in text, logs look as they do
+// without a configuration file.  The last Recent lines are also kept in
+// memory for diagnostics bundles.
+type Logging struct {
+	Stderr bool      `yaml:"stderr"`
+	Format string    `yaml:"format"`
+	Recent int       `yaml:"recent"`
+	File   LogFile   `yaml:"file"`
+	Syslog LogSyslog `yaml:"syslog"`
+	OTLP   LogOTLP   `yaml:"otlp"`
+}
+
+// LogFile appends logs to Path, starting a new file once it reaches
+// MaxSize bytes or MaxAge, and keeps MaxBackups of the old ones; zero is
+// no limit.
+type LogFile struct {
+	Enabled    bool          `yaml:"enabled"`
+	Path       string        `yaml:"path"`
+	MaxSize    int64         `yaml:"max_size"`
+	MaxAge     time.Duration `yaml:"max_age"`
+	MaxBackups int           `yaml:"max_backups"`
+}
+
+// LogSyslog sends logs to the syslog daemon at Address over Network, "udp"
+// or "tcp", or to the local one if both are empty, tagged Tag.
+type LogSyslog struct {
+	Enabled bool   `yaml:"enabled"`
+	Network string `yaml:"network"`
+	Address string `yaml:"address"`
+	Tag     string `yaml:"tag"`
+}
+
+// LogOTLP exports logs to Endpoint, an OTLP/HTTP logs URL such as
+// http://collector:4318/v1/logs, in batches of up to BatchSize at least
+// every Interval.  Headers go with every export, e.g. for authentication.
+type LogOTLP struct {
+	Enabled   bool              `yaml:"enabled"`
+	Endpoint  string            `yaml:"endpoint"`
+	Headers   map[string]string `yaml:"headers"`
+	BatchSize int               `yaml:"batch_size"`
+	Interval  time.Duration     `yaml:"interval"`
+}
+
+// Errors reports handler panics and error-level logs, with their stacks
+// and the request they happened in, to the Sentry-compatible project of
+// DSN (https://key@host/project), tagged Environment.  At most
+// MaxPerMinute events are sent.  ScrubTokens removes credentials from
+// headers, query strings and messages; ScrubRepos replaces repository
+// names in paths, messages and log attributes.
+type Errors struct {
+	Enabled      bool   `yaml:"enabled"`
+	DSN          string `yaml:"dsn"`
+	Environment  string `yaml:"environment"`
+	MaxPerMinute int    `yaml:"max_per_minute"`
+	ScrubTokens  bool   `yaml:"scrub_tokens"`
+	ScrubRepos   bool   `yaml:"scrub_repos"`
+}
+
+// UsageStats, if Enabled, sends anonymized, aggregate usage figures to
+// Endpoint every Interval: see package usagestats for what they are.  It
+// is off unless an operator opts in.
+type UsageStats struct {
+	Enabled  bool          `yaml:"enabled"`
+	Endpoint string        `yaml:"endpoint"`
+	Interval time.Duration `yaml:"interval"`
+}
+
+// Flags sets feature flags, overriding the server's defaults; flags set
+// through /admin/flags override these in turn.  A flag is on for the
+// tenants (identities, as web.Identity gives them) in Tenants, off for
+// those in Except, and otherwise on for everyone if Enabled, else for
+// Percent of tenants.
+type Flags struct {
+	Flags []Flag `yaml:"flags"`
+}
+
+type Flag struct {
+	Name    string   `yaml:"name"`
+	Enabled bool     `yaml:"enabled"`
+	Percent int      `yaml:"percent"`
+	Tenants []string `yaml:"tenants"`
+	Except  []string `yaml:"except"`
+}
+
+// Findings records, every IndexInterval, which sessions each finding's
+// fingerprint appeared in.
+type Findings struct {
+	IndexInterval time.Duration `yaml:"index_interval"`
+}
+
+// Sessions bounds submissions.  MaxRepositories, if set, rejects larger
+// ones.  Submissions of more than ShardSize repositories are split into
+// shards of at most ShardSize, each its own session dispatched on its own;
+// the first is the parent, whose status and repository tasks cover all of
+// them.  Zero means no limit and no sharding.
+type Sessions struct {
+	MaxRepositories int `yaml:"max_repositories"`
+	ShardSize       int `yaml:"shard_size"`
+}
+
+// Tenants holds the settings that have no other section and that tenant
+// settings (see package tenant) override.  Languages, if set, are the only
+// query languages submissions are accepted in.
+type Tenants struct {
+	Languages []string `yaml:"languages"`
+}
+
+// Notifications reports sessions as they complete by POSTing an event to
+// Webhook, signed with the key in SecretFile if set.  Notify is which
+// sessions are reported: all, failures (those with a failed repository)
+// or none.  Tenant settings (see package tenant) override the webhook and
+// the choice per tenant.
+type Notifications struct {
+	Webhook    string `yaml:"webhook"`
+	SecretFile string `yaml:"secret_file"`
+	Notify     string `yaml:"notify"`
+}
+
+// Issues files findings in issue trackers: GitHub repositories (kind
+// github, Project owner/repo) or Jira projects (kind jira, Project the
+// project key), reached at URL with the token in TokenFile -- for Jira,
+// "email:api-token".  Title and Body are text/template templates over the
+// finding.  Clients, if set, lists the identities that may file to the
+// tracker, so that each team files only to its own.
+type Issues struct {
+	Trackers []Tracker `yaml:"trackers"`
+}
+
+type Tracker struct {
+	Name      string   `yaml:"name"`
+	Kind      string   `yaml:"kind"`
+	URL       string   `yaml:"url"`
+	Project   string   `yaml:"project"`
+	TokenFile string   `yaml:"token_file"`
+	IssueType string   `yaml:"issue_type"`
+	Labels    []string `yaml:"labels"`
+	Title     string   `yaml:"title"`
+	Body      string   `yaml:"body"`
+	Clients   []string `yaml:"clients"`
+}
+
+// Default returns the configuration used when no file is present.
+func Default() *Config {
+	return &Config{
+		HTTP: HTTP{
+			ReadHeaderTimeout: 10 * time.Second,
+			ReadTimeout:       time.Minute,
+			IdleTimeout:       2 * time.Minute,
+			MaxHeaderBytes:    64 << 10,
+			Compression:       Compression{Enabled: true, MinSize: 1024},
+			Caching:           Caching{Entries: 1000, TTL: time.Minute, MaxAge: time.Minute},
+			Downloads:         Downloads{MaxConcurrent: 64, Wait: 30 * time.Second},
+			AccessLog:         AccessLog{Enabled: true, SlowThreshold: time.Second},
+			Hardening: Hardening{
+				Enabled:    true,
+				HSTSMaxAge: 180 * 24 * time.Hour,
+				MaxBody:    map[string]int64{"submission": 256 << 20, "other": 16 << 20},
+			},
+			RateLimit: RateLimit{Classes: map[string]Rate{
+				"submission": {PerMinute: 10, Burst: 5},
+				"polling":    {PerMinute: 600, Burst: 100},
+				"download":   {PerMinute: 120, Burst: 50},
+				"other":      {PerMinute: 600, Burst: 100},
+			}},
+		},
+		Logging: Logging{
+			Stderr: true,
+			Format: "text",
+			Recent: 1000,
+			File:   LogFile{MaxSize: 100 << 20, MaxAge: 24 * time.Hour, MaxBackups: 7},
+			Syslog: LogSyslog{Tag: "mrvaserver"},
+			OTLP:   LogOTLP{BatchSize: 512, Interval: 5 * time.Second},
+		},
+		Errors: Errors{Environment: "production", MaxPerMinute: 60, ScrubTokens: true},
+		State:  State{Backend: "commander", EtcdPrefix: "/mrvaserver/", JournalFile: "mrvaserver-state.journal"},
+		Cache:  Cache{TTL: 30 * time.Second},
+		Queue: Queue{
+			Backend:    "rabbitmq",
+			Results:    ConsumerPool{Consumers: 2, Prefetch: 64, Concurrency: 128},
+			Quarantine: Quarantine{Bucket: "quarantine", MaxDeliveries: 5},
+		},
+		Artifacts: Artifacts{Backend: "minio"},
+		Databases: Databases{Backend: "hepc"},
+		Ingest:    Ingest{BatchSize: 100, FlushInterval: 250 * time.Millisecond, Buffer: 1000},
+		Discovery: Discovery{Interval: 30 * time.Second},
+		Leader:    Leader{Backend: "postgres", LeaseName: "mrvaserver-leader", LeaseDuration: 15 * time.Second},
+
+		Replication: Replication{Interval: 5 * time.Minute, Buffer: 1000},
+		Leases:      Leases{Enabled: true, TTL: 5 * time.Minute, ReapInterval: 30 * time.Second, MaxAttempts: 3},
+		Retries: Retries{Interval: 10 * time.Second, Policies: map[string]RetryPolicy{
+			"oom":          {Max: 1, Backoff: time.Minute, MaxBackoff: 10 * time.Minute},
+			"db_corrupt":   {Max: 1},
+			"pack_compile": {Max: 0},
+			"cli_crash":    {Max: 2, Backoff: 30 * time.Second, MaxBackoff: 10 * time.Minute},
+			"timeout":      {Max: 1, Backoff: time.Minute, MaxBackoff: 10 * time.Minute},
+			"unknown":      {Max: 0},
+			"sandbox":      {Max: 1},
+		}},
+		Routing: Routing{
+			AgentTTL: 2 * time.Minute,
+			Affinity: Affinity{Enabled: true, Wait: 2 * time.Minute},
+		},
+		Dispatch:      Dispatch{Window: 200, Interval: 5 * time.Second},
+		Prefetch:      Prefetch{Bucket: "db-staging", Concurrency: 2, Retention: 24 * time.Hour, ChunkSize: 64 << 20},
+		CAS:           CAS{SweepInterval: time.Hour, Grace: 6 * time.Hour},
+		Tiering:       Tiering{After: 30 * 24 * time.Hour, Bucket: "artifacts-cold", Interval: time.Hour},
+		Reports:       Reports{Periods: []string{"monthly"}, Bucket: "usage-reports"},
+		Trash:         Trash{Grace: 7 * 24 * time.Hour, PurgeInterval: time.Hour},
+		Sandbox:       Sandbox{ReadOnlyDatabase: true},
+		Findings:      Findings{IndexInterval: time.Minute},
+		Notifications: Notifications{Notify: "all"},
+		Toolchains: Toolchains{
+			Rollout: Rollout{MinJobs: 200, MaxFailureIncrease: 0.02, MaxRuntimeRatio: 1.25},
+		},
+		RepoStats: RepoStats{MinJobs: 5, MaxFailureRate: 0.5, MaxOOMs: 3, MaxMeanRuntime: 2 * time.Hour},
+		PackScan: PackScan{
+			Deny: []PackRule{
+				{Name: "external-predicate", Pattern: `(?m)^\s*(?:(?:private|cached|deprecated|pragma\[[^\]]*\])\s+)*external\b`},
+			},
+			MaxHints:         map[string]int64{"ram": 64 << 10, "threads": 64, "timeout": 24 * 3600},
+			MaxCompiledBytes: 64 << 20,
+			MaxTotalBytes:    512 << 20,
+			MaxFiles:         10000,
+		},
+		MalwareScan: MalwareScan{Kind: "clamav", Addr: "localhost:3310", Timeout: 5 * time.Minute, Databases: true},
+		DropFolder:  DropFolder{Interval: 30 * time.Second},
+		UsageStats:  UsageStats{Interval: 24 * time.Hour},
+	}
+}
+
+// Load reads fname over the defaults.  A missing file is not an error.
+func Load(fname string) (*Config, error) {
+	cfg := Default()
+	data, err := os.ReadFile(fname)
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("Configuration file not found, using defaults", "name", fname)
+		return cfg, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return decode(fname, data, cfg, false)
+}
+
+// Check reads fname like Load, but the file must exist and keys the
+// configuration does not know, usually typos, are errors.
+func Check(fname string) (*Config, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, err
+	}
+	return decode(fname, data, Default(), true)
+}
+
+func decode(fname string, data []byte, cfg *Config, strict bool) (*Config, error) {
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(strict)
+	if err := dec.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("error decoding configuration file %s: %w", fname, err)
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration file %s: %w", fname, err)
+	}
+	return cfg, nil
+}
+
+func (c *Config) validate() error {
+	h := c.HTTP
+	if h.ReadHeaderTimeout < 0 || h.ReadTimeout < 0 || h.WriteTimeout < 0 || h.IdleTimeout < 0 {
+		return fmt.Errorf("http: timeouts must not be negative")
+	}
+	if ca := h.Caching; ca.Enabled && (ca.Entries < 0 || ca.TTL < 0 || ca.MaxAge < 0) {
+		return fmt.Errorf("http.caching: entries, ttl and max_age must not be negative")
+	}
+	if h.Downloads.MaxConcurrent < 0 || h.Downloads.Wait < 0 {
+		return fmt.Errorf("http.downloads: max_concurrent and wait must not be negative")
+	}
+	if a := h.AccessLog; a.Sample < 0 || a.Sample > 1 || a.SlowThreshold < 0 {
+		return fmt.Errorf("http.access_log: sample must be between 0 and 1 and slow_threshold not negative")
+	}
+	for name, rate := range h.AccessLog.Classes {
+		switch name {
+		case "submission", "polling", "download", "other":
+		default:
+			return fmt.Errorf("http.access_log.classes: unknown class %q", name)
+		}
+		if rate < 0 || rate > 1 {
+			return fmt.Errorf("http.access_log.classes.%s must be between 0 and 1", name)
+		}
+	}
+	if h.MaxHeaderBytes < 0 {
+		return fmt.Errorf("http.max_header_bytes must not be negative")
+	}
+	for name, limit := range h.Hardening.MaxBody {
+		switch name {
+		case "submission", "polling", "download", "other":
+		default:
+			return fmt.Errorf("http.hardening.max_body: unknown endpoint class %q", name)
+		}
+		if limit < 0 {
+			return fmt.Errorf("http.hardening.max_body.%s must not be negative", name)
+		}
+	}
+	for name, rate := range h.RateLimit.Classes {
+		switch name {
+		case "submission", "polling", "download", "other":
+		default:
+			return fmt.Errorf("http.rate_limit.classes: unknown class %q", name)
+		}
+		if rate.PerMinute > 0 && rate.Burst < 1 {
+			return fmt.Errorf("http.rate_limit.classes.%s: burst must be at least 1", name)
+		}
+	}
+	if (h.TLSCertFile == "") != (h.TLSKeyFile == "") {
+		return fmt.Errorf("http: tls_cert_file and tls_key_file must be set together")
+	}
+	if h.BasePath != "" && !strings.HasPrefix(h.BasePath, "/") {
+		return fmt.Errorf("http.base_path must start with /")
+	}
+	for _, p := range h.TrustedProxies {
+		if _, err := netip.ParsePrefix(p); err != nil {
+			if _, err := netip.ParseAddr(p); err != nil {
+				return fmt.Errorf("http.trusted_proxies: %q is not an address or CIDR range", p)
+			}
+		}
+	}
+	if len(h.Auth.Admins) > 0 && h.Auth.TokensFile == "" {
+		return fmt.Errorf("http.auth.admins needs http.auth.tokens_file")
+	}
+	for _, p := range h.AdminAllow {
+		if _, err := netip.ParsePrefix(p); err != nil {
+			if _, err := netip.ParseAddr(p); err != nil {
+				return fmt.Errorf("http.admin_allow: %q is not an address or CIDR range", p)
+			}
+		}
+	}
+	if c.Logging.Format != "text" && c.Logging.Format != "json" {
+		return fmt.Errorf("logging.format must be text or json")
+	}
+	if c.Logging.Recent < 0 {
+		return fmt.Errorf("logging.recent must not be negative")
+	}
+	if l := c.Logging; !l.Stderr && !l.File.Enabled && !l.Syslog.Enabled && !l.OTLP.Enabled {
+		return fmt.Errorf("logging: at least one sink must be enabled")
+	}
+	if f := c.Logging.File; f.Enabled && (f.Path == "" || f.MaxSize < 0 || f.MaxAge < 0 || f.MaxBackups < 0) {
+		return fmt.Errorf("logging.file: path is required and limits must not be negative")
+	}
+	if sl := c.Logging.Syslog; sl.Enabled {
+		switch sl.Network {
+		case "", "udp", "tcp":
+		default:
+			return fmt.Errorf("logging.syslog.network must be udp or tcp")
+		}
+		if (sl.Network == "") != (sl.Address == "") {
+			return fmt.Errorf("logging.syslog: network and address must be set together")
+		}
+	}
+	if o := c.Logging.OTLP; o.Enabled {
+		if u, err := url.Parse(o.Endpoint); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("logging.otlp.endpoint must be an http or https URL")
+		}
+		if o.BatchSize < 1 || o.Interval < 100*time.Millisecond {
+			return fmt.Errorf("logging.otlp: batch_size must be positive and interval at least 100ms")
+		}
+	}
+	if e := c.Errors; e.Enabled {
+		u, err := url.Parse(e.DSN)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.User.Username() == "" ||
+			strings.Trim(u.Path, "/") == "" {
+			return fmt.Errorf("error_reporting.dsn must be a URL of the form https://key@host/project")
+		}
+		if e.MaxPerMinute < 1 {
+			return fmt.Errorf("error_reporting.max_per_minute must be positive")
+		}
+	}
+	if u := c.UsageStats; u.Enabled {
+		e, err := url.Parse(u.Endpoint)
+		if err != nil || (e.Scheme != "http" && e.Scheme != "https") || e.Host == "" {
+			return fmt.Errorf("usage_stats.endpoint must be an http or https URL")
+		}
+		if u.Interval < time.Hour {
+			return fmt.Errorf("usage_stats.interval must be at least 1h")
+		}
+	}
+	p := c.Queue.Results
+	if p.Consumers < 1 || p.Prefetch < 1 || p.Concurrency < 1 {
+		return fmt.Errorf("queue.results: consumers, prefetch and concurrency must be at least 1")
+	}
+	switch c.State.Backend {
+	case "commander", "postgres", "mysql":
+	case "etcd":
+		if !strings.HasSuffix(c.State.EtcdPrefix, "/") {
+			return fmt.Errorf("state.etcd_prefix must end in /")
+		}
+	case "journal":
+		if c.State.JournalFile == "" {
+			return fmt.Errorf("state.journal_file is required by the journal backend")
+		}
+	default:
+		if !slices.Contains(backend.States(), c.State.Backend) {
+			return fmt.Errorf("state.backend: unknown backend %q", c.State.Backend)
+		}
+	}
+	if c.Queue.Backend != "rabbitmq" && !slices.Contains(backend.Queues(), c.Queue.Backend) {
+		return fmt.Errorf("queue.backend: unknown backend %q", c.Queue.Backend)
+	}
+	if qr := c.Queue.Quarantine; qr.Enabled {
+		if c.Queue.Backend != "rabbitmq" || c.Artifacts.Backend != "minio" {
+			return fmt.Errorf("queue.quarantine needs the rabbitmq queue and the minio artifact store")
+		}
+		if qr.Bucket == "" || qr.MaxDeliveries < 1 {
+			return fmt.Errorf("queue.quarantine: bucket is required and max_deliveries must be at least 1")
+		}
+	}
+	if m := c.Queue.ManagementURL; m != "" {
+		if u, err := url.Parse(m); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("queue.management_url: %q is not an http or https URL", m)
+		}
+	}
+	if c.Databases.Backend != "hepc" && !slices.Contains(backend.DatabaseStores(), c.Databases.Backend) {
+		return fmt.Errorf("databases.backend: unknown backend %q", c.Databases.Backend)
+	}
+	if c.Artifacts.Backend != "minio" {
+		if !slices.Contains(backend.ArtifactStores(), c.Artifacts.Backend) {
+			return fmt.Errorf("artifacts.backend: unknown backend %q", c.Artifacts.Backend)
+		}
+		if c.Replication.Enabled || c.Prefetch.Enabled || c.CAS.Enabled || c.Tiering.Enabled || c.Usage.Enabled || c.Reports.Enabled || c.Encryption.Enabled {
+			return fmt.Errorf("artifacts.backend: replication, prefetch, cas, tiering, usage, usage_reports and encryption need the minio backend")
+		}
+	}
+	if c.Cache.Enabled && c.Cache.TTL <= 0 {
+		return fmt.Errorf("cache.ttl must be positive")
+	}
+	i := c.Ingest
+	if i.BatchSize < 1 || i.Buffer < 1 || i.FlushInterval <= 0 {
+		return fmt.Errorf("ingest: batch_size, buffer and flush_interval must be positive")
+	}
+	if c.Discovery.Interval < 0 {
+		return fmt.Errorf("discovery.interval must not be negative")
+	}
+	if p := c.Egress.Proxy; p != "" {
+		u, err := url.Parse(p)
+		if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https" && u.Scheme != "socks5") {
+			return fmt.Errorf("egress.proxy must be an http, https or socks5 URL")
+		}
+	}
+	switch c.Leader.Backend {
+	case "postgres", "kubernetes":
+	default:
+		return fmt.Errorf("leader.backend: unknown backend %q", c.Leader.Backend)
+	}
+	if c.Leader.LeaseDuration < time.Second {
+		return fmt.Errorf("leader.lease_duration must be at least 1s")
+	}
+	if l := c.Leases; l.Enabled && (l.TTL < time.Second || l.ReapInterval < time.Second || l.MaxAttempts < 1) {
+		return fmt.Errorf("leases: ttl and reap_interval must be at least 1s and max_attempts at least 1")
+	}
+	if c.Retries.Interval < time.Second {
+		return fmt.Errorf("retries.interval must be at least 1s")
+	}
+	for class, p := range c.Retries.Policies {
+		switch class {
+		case "oom", "db_corrupt", "pack_compile", "cli_crash", "timeout", "unknown", "sandbox":
+		default:
+			return fmt.Errorf("retries.policies: unknown failure class %q", class)
+		}
+		if p.Max < 0 || p.Backoff < 0 || p.MaxBackoff < 0 {
+			return fmt.Errorf("retries.policies.%s: max and backoffs must not be negative", class)
+		}
+	}
+	pools := make(map[string]bool)
+	for _, p := range c.Routing.Pools {
+		if p.Name == "" || strings.ContainsAny(p.Name, " /.") {
+			return fmt.Errorf("routing.pools: invalid pool name %q", p.Name)
+		}
+		if pools[p.Name] {
+			return fmt.Errorf("routing.pools: duplicate pool %q", p.Name)
+		}
+		pools[p.Name] = true
+	}
+	for class, p := range c.Retries.Policies {
+		if p.Pool != "" && !pools[p.Pool] {
+			return fmt.Errorf("retries.policies.%s: unknown pool %q", class, p.Pool)
+		}
+	}
+	if c.Dispatch.Window < 0 || c.Dispatch.MaxPerSession < 0 || c.Dispatch.Interval < time.Second {
+		return fmt.Errorf("dispatch: window and max_per_session must not be negative and interval at least 1s")
+	}
+	if p := c.Prefetch; p.Enabled && (p.Bucket == "" || p.Concurrency < 1 || p.Retention < time.Minute) {
+		return fmt.Errorf("prefetch: bucket is required, concurrency must be positive and retention at least 1m")
+	}
+	if p := c.Prefetch; p.Enabled && p.ChunkSize < 1<<20 {
+		return fmt.Errorf("prefetch.chunk_size must be at least 1MiB")
+	}
+	for _, l := range []BandwidthLimit{c.Bandwidth.Ingress, c.Bandwidth.Egress} {
+		if l.Global < 0 || l.PerSession < 0 {
+			return fmt.Errorf("bandwidth: limits must not be negative")
+		}
+	}
+	if c.CAS.Enabled && (c.CAS.SweepInterval < time.Minute || c.CAS.Grace < 2*c.CAS.SweepInterval) {
+		return fmt.Errorf("cas: sweep_interval must be at least 1m and grace at least twice that")
+	}
+	if t := c.Tiering; t.Enabled {
+		switch {
+		case t.After < time.Hour || t.Interval < time.Minute:
+			return fmt.Errorf("tiering: after must be at least 1h and interval at least 1m")
+		case t.Bucket == "" || t.Bucket == "results" || t.Bucket == "packs" || t.Bucket == "cas":
+			return fmt.Errorf("tiering.bucket must name a bucket of its own")
+		}
+	}
+	if c.Usage.SessionCap < 0 || c.Usage.UserCap < 0 {
+		return fmt.Errorf("usage: caps must not be negative")
+	}
+	if r := c.Reports; r.Enabled {
+		if len(r.Periods) == 0 {
+			return fmt.Errorf("usage_reports.periods: name weekly, monthly or both")
+		}
+		for _, p := range r.Periods {
+			if p != "weekly" && p != "monthly" {
+				return fmt.Errorf("usage_reports.periods: unknown period %q", p)
+			}
+		}
+		switch {
+		case r.Bucket == "" || r.Bucket == "results" || r.Bucket == "packs" || r.Bucket == "cas":
+			return fmt.Errorf("usage_reports.bucket must name a bucket of its own")
+		case len(r.Email.To) > 0 && (r.Email.Addr == "" || r.Email.From == ""):
+			return fmt.Errorf("usage_reports.email: addr and from are required with recipients")
+		case r.Email.Username != "" && r.Email.PasswordFile == "":
+			return fmt.Errorf("usage_reports.email: password_file is required with a username")
+		}
+	}
+	for _, r := range c.PackScan.Deny {
+		if r.Name == "" {
+			return fmt.Errorf("pack_scan.deny: every rule needs a name")
+		}
+		if _, err := regexp.Compile(r.Pattern); err != nil {
+			return fmt.Errorf("pack_scan.deny.%s: %w", r.Name, err)
+		}
+	}
+	if p := c.PackScan; p.MaxCompiledBytes < 0 || p.MaxTotalBytes < 0 || p.MaxFiles < 0 {
+		return fmt.Errorf("pack_scan: limits must not be negative")
+	}
+	if m := c.MalwareScan; m.Enabled {
+		switch {
+		case m.Kind != "clamav" && m.Kind != "http":
+			return fmt.Errorf("malware_scan.kind must be clamav or http")
+		case m.Kind == "clamav" && m.Addr == "":
+			return fmt.Errorf("malware_scan.addr is required")
+		case m.Kind == "http" && m.URL == "":
+			return fmt.Errorf("malware_scan.url is required")
+		case m.Timeout <= 0:
+			return fmt.Errorf("malware_scan.timeout must be positive")
+		case m.Databases && !c.Prefetch.Enabled:
+			return fmt.Errorf("malware_scan.databases needs prefetch.enabled")
+		}
+	}
+	if s := c.Sandbox; s.Enabled && s.MemoryLimit < 0 {
+		return fmt.Errorf("sandbox.memory_limit must not be negative")
+	}
+	if c.Encryption.Enabled && c.Encryption.KEKFile == "" {
+		return fmt.Errorf("encryption.kek_file is required")
+	}
+	if c.Signing.Enabled && c.Signing.KeyFile == "" {
+		return fmt.Errorf("signing.key_file is required")
+	}
+	if c.Sessions.MaxRepositories < 0 || c.Sessions.ShardSize < 0 {
+		return fmt.Errorf("sessions.max_repositories and sessions.shard_size must not be negative")
+	}
+	if r := c.Toolchains.Rollout; r.MinJobs < 1 || r.MaxFailureIncrease < 0 || r.MaxRuntimeRatio < 1 {
+		return fmt.Errorf("toolchains.rollout: min_jobs must be positive, max_failure_increase not negative and max_runtime_ratio at least 1")
+	}
+	if r := c.RepoStats; r.MinJobs < 1 || r.MaxFailureRate < 0 || r.MaxFailureRate > 1 || r.MaxOOMs < 0 || r.MaxMeanRuntime < 0 {
+		return fmt.Errorf("repo_stats: min_jobs must be positive, max_failure_rate between 0 and 1, and max_ooms and max_mean_runtime not negative")
+	}
+	if c.Findings.IndexInterval < time.Second {
+		return fmt.Errorf("findings.index_interval must be at least 1s")
+	}
+	if n := c.Notifications; n.Webhook != "" {
+		if u, err := url.Parse(n.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("notifications.webhook must be an http or https URL")
+		}
+	}
+	if n := c.Notifications.Notify; n != "all" && n != "failures" && n != "none" {
+		return fmt.Errorf("notifications.notify must be all, failures or none")
+	}
+	seen := make(map[string]bool)
+	for _, t := range c.Issues.Trackers {
+		if t.Name == "" || seen[t.Name] {
+			return fmt.Errorf("issues.trackers: every tracker needs a unique name")
+		}
+		seen[t.Name] = true
+		if t.Kind != "github" && t.Kind != "jira" {
+			return fmt.Errorf("issues.trackers.%s: unknown kind %q", t.Name, t.Kind)
+		}
+		if t.Project == "" || t.TokenFile == "" {
+			return fmt.Errorf("issues.trackers.%s: project and token_file are required", t.Name)
+		}
+		if t.Kind == "github" && !strings.Contains(t.Project, "/") {
+			return fmt.Errorf("issues.trackers.%s: project must be owner/repo", t.Name)
+		}
+		if t.Kind == "jira" && t.URL == "" {
+			return fmt.Errorf("issues.trackers.%s: url is required", t.Name)
+		}
+		for _, tpl := range []string{t.Title, t.Body} {
+			if _, err := template.New("").Parse(tpl); err != nil {
+				return fmt.Errorf("issues.trackers.%s: %w", t.Name, err)
+			}
+		}
+	}
+	if d := c.DropFolder; d.Enabled {
+		if (d.Dir == "") == (d.Bucket == "") {
+			return fmt.Errorf("drop_folder: exactly one of dir and bucket is required")
+		}
+		if d.Bucket != "" && c.Artifacts.Backend != "minio" {
+			return fmt.Errorf("drop_folder.bucket needs the minio artifact store")
+		}
+		if d.Prefix != "" && !strings.HasSuffix(d.Prefix, "/") {
+			return fmt.Errorf("drop_folder.prefix must end in /")
+		}
+		if d.Interval < time.Second {
+			return fmt.Errorf("drop_folder.interval must be at least 1s")
+		}
+	}
+	if c.Trash.Grace < 0 || c.Trash.PurgeInterval < time.Minute {
+		return fmt.Errorf("trash: grace must not be negative and purge_interval must be at least 1m")
+	}
+	if c.ReadOnly.Enabled && c.State.Backend != "postgres" {
+		return fmt.Errorf("read_only needs the postgres state backend")
+	}
+	for name, l := range c.Loops {
+		if !slices.Contains(LoopTasks, name) {
+			return fmt.Errorf("loops: unknown task %q", name)
+		}
+		if l.Workers < 0 || l.BatchSize < 0 {
+			return fmt.Errorf("loops.%s: workers and batch_size must not be negative", name)
+		}
+	}
+	if c.Routing.AgentTTL < time.Second {
+		return fmt.Errorf("routing.agent_ttl must be at least 1s")
+	}
+	if a := c.Routing.Affinity; a.Enabled && a.Wait < time.Second {
+		return fmt.Errorf("routing.affinity.wait must be at least 1s")
+	}
+	if r := c.Replication; r.Enabled && (r.Interval < time.Second || r.Buffer < 1) {
+		return fmt.Errorf("replication: interval must be at least 1s and buffer positive")
+	}
+	return nil
+}
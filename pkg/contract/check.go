@@ -0,0 +1,115 @@
+package contract
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Target names a running server and an existing session to check.
+type Target struct {
+	BaseURL        string // e.g. http://localhost:8080
+	ControllerRepo string // owner/repo
+	SessionID      int
+
+	// SkipDownloads omits fetching artifact URLs.
+	SkipDownloads bool
+}
+
+// Result is the outcome of one request in a check run.
+type Result struct {
+	Name string
+	Errs []error
+}
+
+func (r Result) Passed() bool { return len(r.Errs) == 0 }
+
+// Check issues the extension's request sequence for one session against t
+// and validates every response.
+func Check(t Target) []Result {
+	client := &http.Client{Timeout: 30 * time.Second}
+	base := strings.TrimSuffix(t.BaseURL, "/")
+	var results []Result
+
+	get := func(name, path string, validator func([]byte) []error) ([]byte, bool) {
+		body, err := fetch(client, base+path)
+		if err != nil {
+			results = append(results, Result{Name: name, Errs: []error{err}})
+			return nil, false
+		}
+		errs := validator(body)
+		results = append(results, Result{Name: name, Errs: errs})
+		return body, len(errs) == 0
+	}
+
+	// 1. Controller repo lookup
+	body, ok := get("controller repo", "/repos/"+t.ControllerRepo, ValidateRepository)
+	if !ok {
+		return results
+	}
+	var controller struct {
+		ID int `json:"id"`
+	}
+	json.Unmarshal(body, &controller)
+
+	// 2. Session status, both URL forms
+	get("status (owner/repo)", fmt.Sprintf("/repos/%s/code-scanning/codeql/variant-analyses/%d",
+		t.ControllerRepo, t.SessionID), ValidateVariantAnalysis)
+	body, ok = get("status (id)", fmt.Sprintf("/repositories/%d/code-scanning/codeql/variant-analyses/%d",
+		controller.ID, t.SessionID), ValidateVariantAnalysis)
+	if !ok {
+		return results
+	}
+	var va struct {
+		ScannedRepositories []struct {
+			Repository struct {
+				ID       int    `json:"id"`
+				FullName string `json:"full_name"`
+			} `json:"repository"`
+		} `json:"scanned_repositories"`
+	}
+	json.Unmarshal(body, &va)
+
+	// 3. Every repo task, then its artifact
+	for _, sr := range va.ScannedRepositories {
+		name := "repo task " + sr.Repository.FullName
+		body, ok := get(name, fmt.Sprintf("/repositories/%d/code-scanning/codeql/variant-analyses/%d/repositories/%d",
+			controller.ID, t.SessionID, sr.Repository.ID), ValidateRepoTask)
+		if !ok || t.SkipDownloads {
+			continue
+		}
+		var task struct {
+			ArtifactURL string `json:"artifact_url"`
+		}
+		json.Unmarshal(body, &task)
+		if task.ArtifactURL == "" {
+			continue
+		}
+		_, err := fetch(client, task.ArtifactURL)
+		r := Result{Name: "artifact " + sr.Repository.FullName}
+		if err != nil {
+			r.Errs = []error{err}
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+func fetch(client *http.Client, url string) ([]byte, error) {
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %w", url, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: status %d: %s", url, resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
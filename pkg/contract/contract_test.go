@@ -0,0 +1,145 @@
+package contract
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/hohn/mrvacommander/pkg/server"
+	"github.com/hohn/mrvacommander/pkg/state"
+	"mrvaserver/pkg/gateway"
+)
+
+const suiteController = "mrva/controller"
+
+// newSuite starts an in-process gateway over seeded in-memory state.  The
+// sessions cover every repo status the commander produces as well as a
+// session without repositories.
+func newSuite(t *testing.T) (*httptest.Server, []int) {
+	t.Helper()
+	v := &server.Visibles{
+		State:     state.NewLocalState(0),
+		Artifacts: artifactstore.NewInMemoryArtifactStore(),
+	}
+	sessions := seed(t, v)
+	g, err := gateway.New(v, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(g)
+	t.Cleanup(srv.Close)
+	return srv, sessions
+}
+
+func seed(t *testing.T, v *server.Visibles) []int {
+	t.Helper()
+	now := time.Now().Format(time.RFC3339)
+	statuses := []common.Status{
+		common.StatusSuccess,
+		common.StatusQueued,
+		common.StatusInProgress,
+		common.StatusError,
+		common.StatusFailed,
+	}
+
+	full := v.State.NextID()
+	for i, status := range statuses {
+		js := common.JobSpec{
+			SessionID:     full,
+			NameWithOwner: common.NameWithOwner{Owner: "owner", Repo: "repo" + string(rune('a'+i))},
+		}
+		v.State.AddJob(queue.AnalyzeJob{Spec: js, QueryLanguage: "cpp"})
+		v.State.SetJobInfo(js, common.JobInfo{QueryLanguage: "cpp", CreatedAt: now, UpdatedAt: now})
+		v.State.SetStatus(js, status)
+		if status != common.StatusSuccess {
+			continue
+		}
+		loc, err := v.Artifacts.SaveResult(js, []byte("PK\x05\x06"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		v.State.SetResult(js, queue.AnalyzeResult{
+			Spec:           js,
+			Status:         status,
+			ResultCount:    3,
+			ResultLocation: loc,
+			DatabaseSHA:    "0000000000000000000000000000000000000000",
+		})
+	}
+
+	empty := v.State.NextID()
+	return []int{full, empty}
+}
+
+func report(t *testing.T, results []Result) {
+	t.Helper()
+	if len(results) == 0 {
+		t.Fatal("no checks ran")
+	}
+	for _, r := range results {
+		for _, err := range r.Errs {
+			t.Errorf("%s: %v", r.Name, err)
+		}
+	}
+}
+
+func TestSuite(t *testing.T) {
+	srv, sessions := newSuite(t)
+	for _, id := range sessions {
+		t.Run("session "+strconv.Itoa(id), func(t *testing.T) {
+			report(t, Check(Target{
+				BaseURL:        srv.URL,
+				ControllerRepo: suiteController,
+				SessionID:      id,
+				// Downloads are the commander's; there is none here.
+				SkipDownloads: true,
+			}))
+		})
+	}
+}
+
+func TestStatusIDRejectsNonNumericController(t *testing.T) {
+	srv, sessions := newSuite(t)
+	for _, controller := range []string{"abc", "1x", "-"} {
+		url := srv.URL + "/repositories/" + controller + "/code-scanning/codeql/variant-analyses/" + strconv.Itoa(sessions[0])
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("controller %q: got %d, want %d", controller, resp.StatusCode, http.StatusBadRequest)
+		}
+	}
+}
+
+// TestLive checks one session of a running server, named by
+// MRVA_CONTRACT_URL, MRVA_CONTRACT_SESSION and, if not mrva/controller,
+// MRVA_CONTRACT_CONTROLLER.  MRVA_CONTRACT_SKIP_DOWNLOADS=1 leaves out the
+// artifacts.
+func TestLive(t *testing.T) {
+	url := os.Getenv("MRVA_CONTRACT_URL")
+	if url == "" {
+		t.Skip("MRVA_CONTRACT_URL is not set")
+	}
+	session, err := strconv.Atoi(os.Getenv("MRVA_CONTRACT_SESSION"))
+	if err != nil {
+		t.Fatalf("MRVA_CONTRACT_SESSION: %v", err)
+	}
+	controller := os.Getenv("MRVA_CONTRACT_CONTROLLER")
+	if controller == "" {
+		controller = suiteController
+	}
+	report(t, Check(Target{
+		BaseURL:        url,
+		ControllerRepo: controller,
+		SessionID:      session,
+		SkipDownloads:  os.Getenv("MRVA_CONTRACT_SKIP_DOWNLOADS") == "1",
+	}))
+}
@@ -0,0 +1,200 @@
+// Package contract checks MRVA API responses against the shapes the CodeQL
+// VS Code extension parses.  The checks work on raw JSON, not on our own Go
+// types, so they catch drift in either json tags or handler logic.  go
+// test runs them against an in-process gateway over seeded state, and
+// against a running server with MRVA_CONTRACT_URL set; see TestLive.
+package contract
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+)
+
+type kind int
+
+const (
+	kString kind = iota
+	kNumber
+	kBool
+	kObject
+	kArray
+)
+
+func (k kind) String() string {
+	return [...]string{"string", "number", "bool", "object", "array"}[k]
+}
+
+// field describes one expected member of a JSON object.
+type field struct {
+	name     string
+	kind     kind
+	optional bool
+	enum     []string // permitted values for strings
+	object   []field  // members of an object, or of array elements
+}
+
+var repositoryFields = []field{
+	{name: "id", kind: kNumber},
+	{name: "name", kind: kString},
+	{name: "full_name", kind: kString},
+	{name: "private", kind: kBool},
+}
+
+var repoStatusEnum = []string{"pending", "in_progress", "succeeded", "failed", "canceled", "timed_out"}
+
+var skippedFields = []field{
+	{name: "access_mismatch_repos", kind: kObject, object: []field{
+		{name: "repository_count", kind: kNumber},
+		{name: "repositories", kind: kArray, object: repositoryFields},
+	}},
+	{name: "not_found_repos", kind: kObject, object: []field{
+		{name: "repository_count", kind: kNumber},
+		{name: "repository_full_names", kind: kArray},
+	}},
+	{name: "no_codeql_db_repos", kind: kObject, object: []field{
+		{name: "repository_count", kind: kNumber},
+		{name: "repositories", kind: kArray, object: repositoryFields},
+	}},
+	{name: "over_limit_repos", kind: kObject, object: []field{
+		{name: "repository_count", kind: kNumber},
+		{name: "repositories", kind: kArray, object: repositoryFields},
+	}},
+}
+
+// variantAnalysisFields describe the session status document.
+var variantAnalysisFields = []field{
+	{name: "id", kind: kNumber},
+	{name: "controller_repo", kind: kObject, object: repositoryFields},
+	{name: "actor", kind: kObject},
+	{name: "query_language", kind: kString},
+	{name: "query_pack_url", kind: kString},
+	{name: "created_at", kind: kString},
+	{name: "updated_at", kind: kString},
+	{name: "actions_workflow_run_id", kind: kNumber, optional: true},
+	{name: "status", kind: kString, enum: []string{"in_progress", "succeeded", "failed", "cancelled"}},
+	{name: "completed_at", kind: kString, optional: true},
+	{name: "failure_reason", kind: kString, optional: true,
+		enum: []string{"no_repos_queried", "actions_workflow_run_failed", "internal_error"}},
+	{name: "scanned_repositories", kind: kArray, optional: true, object: []field{
+		{name: "repository", kind: kObject, object: repositoryFields},
+		{name: "analysis_status", kind: kString, enum: repoStatusEnum},
+		{name: "result_count", kind: kNumber, optional: true},
+		{name: "artifact_size_in_bytes", kind: kNumber, optional: true},
+		{name: "failure_message", kind: kString, optional: true},
+	}},
+	{name: "skipped_repositories", kind: kObject, optional: true, object: skippedFields},
+}
+
+var repoTaskFields = []field{
+	{name: "repository", kind: kObject, object: repositoryFields},
+	{name: "analysis_status", kind: kString, enum: repoStatusEnum},
+	{name: "artifact_size_in_bytes", kind: kNumber, optional: true},
+	{name: "result_count", kind: kNumber, optional: true},
+	{name: "failure_message", kind: kString, optional: true},
+	{name: "database_commit_sha", kind: kString, optional: true},
+	{name: "source_location_prefix", kind: kString, optional: true},
+	{name: "artifact_url", kind: kString, optional: true},
+}
+
+// ValidateVariantAnalysis checks a session status response body.
+func ValidateVariantAnalysis(body []byte) []error {
+	return validate(body, variantAnalysisFields)
+}
+
+// ValidateRepoTask checks a repo task response body.  A succeeded task must
+// carry an artifact URL.
+func ValidateRepoTask(body []byte) []error {
+	errs := validate(body, repoTaskFields)
+	var task struct {
+		AnalysisStatus string `json:"analysis_status"`
+		ArtifactURL    string `json:"artifact_url"`
+	}
+	if json.Unmarshal(body, &task) == nil && task.AnalysisStatus == "succeeded" && task.ArtifactURL == "" {
+		errs = append(errs, fmt.Errorf("artifact_url: required for succeeded repo task"))
+	}
+	return errs
+}
+
+// ValidateRepository checks a GET /repos/{owner}/{repo} response body.
+func ValidateRepository(body []byte) []error {
+	return validate(body, repositoryFields)
+}
+
+func validate(body []byte, fields []field) []error {
+	var doc map[string]any
+	if err := json.Unmarshal(body, &doc); err != nil {
+		return []error{fmt.Errorf("not a JSON object: %w", err)}
+	}
+	return checkObject("", doc, fields)
+}
+
+func checkObject(path string, obj map[string]any, fields []field) []error {
+	var errs []error
+	for _, f := range fields {
+		p := f.name
+		if path != "" {
+			p = path + "." + f.name
+		}
+		v, ok := obj[f.name]
+		if !ok || v == nil {
+			if !f.optional {
+				errs = append(errs, fmt.Errorf("%s: missing", p))
+			}
+			continue
+		}
+		errs = append(errs, checkValue(p, v, f)...)
+	}
+	return errs
+}
+
+func checkValue(path string, v any, f field) []error {
+	switch f.kind {
+	case kString:
+		s, ok := v.(string)
+		if !ok {
+			return []error{typeError(path, f.kind, v)}
+		}
+		if f.enum != nil && !slices.Contains(f.enum, s) {
+			return []error{fmt.Errorf("%s: %q not one of %v", path, s, f.enum)}
+		}
+	case kNumber:
+		if _, ok := v.(float64); !ok {
+			return []error{typeError(path, f.kind, v)}
+		}
+	case kBool:
+		if _, ok := v.(bool); !ok {
+			return []error{typeError(path, f.kind, v)}
+		}
+	case kObject:
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return []error{typeError(path, f.kind, v)}
+		}
+		return checkObject(path, obj, f.object)
+	case kArray:
+		arr, ok := v.([]any)
+		if !ok {
+			return []error{typeError(path, f.kind, v)}
+		}
+		if f.object == nil {
+			return nil
+		}
+		var errs []error
+		for i, elt := range arr {
+			obj, ok := elt.(map[string]any)
+			p := fmt.Sprintf("%s[%d]", path, i)
+			if !ok {
+				errs = append(errs, typeError(p, kObject, elt))
+				continue
+			}
+			errs = append(errs, checkObject(p, obj, f.object)...)
+		}
+		return errs
+	}
+	return nil
+}
+
+func typeError(path string, want kind, got any) error {
+	return fmt.Errorf("%s: expected %s, got %T", path, want, got)
+}
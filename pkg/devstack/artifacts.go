@@ -0,0 +1,111 @@
+package devstack
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/common"
+)
+
+// Artifacts is an artifact store keeping each bucket as a directory and
+// each artifact as a file in it.
+type Artifacts struct {
+	dir string
+}
+
+func NewArtifacts(dir string) (*Artifacts, error) {
+	for _, bucket := range []string{artifactstore.AF_BUCKETNAME_PACKS, artifactstore.AF_BUCKETNAME_RESULTS} {
+		if err := os.MkdirAll(filepath.Join(dir, bucket), 0o755); err != nil {
+			return nil, fmt.Errorf("failed to create artifact directory: %w", err)
+		}
+	}
+	return &Artifacts{dir: dir}, nil
+}
+
+func (a *Artifacts) path(loc artifactstore.ArtifactLocation) (string, error) {
+	if loc.Bucket != artifactstore.AF_BUCKETNAME_PACKS && loc.Bucket != artifactstore.AF_BUCKETNAME_RESULTS {
+		return "", fmt.Errorf("unknown bucket %q", loc.Bucket)
+	}
+	if loc.Key == "" || filepath.Base(loc.Key) != loc.Key {
+		return "", fmt.Errorf("invalid artifact key %q", loc.Key)
+	}
+	return filepath.Join(a.dir, loc.Bucket, loc.Key), nil
+}
+
+func (a *Artifacts) save(loc artifactstore.ArtifactLocation, data []byte) (artifactstore.ArtifactLocation, error) {
+	p, err := a.path(loc)
+	if err != nil {
+		return loc, err
+	}
+	// Written under a temporary name so a reader never sees half a file.
+	tmp := p + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return loc, fmt.Errorf("failed to write artifact: %w", err)
+	}
+	if err := os.Rename(tmp, p); err != nil {
+		return loc, fmt.Errorf("failed to write artifact: %w", err)
+	}
+	return loc, nil
+}
+
+func (a *Artifacts) GetQueryPack(loc artifactstore.ArtifactLocation) ([]byte, error) {
+	p, err := a.path(loc)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
+
+func (a *Artifacts) SaveQueryPack(sessionID int, data []byte) (artifactstore.ArtifactLocation, error) {
+	return a.save(artifactstore.ArtifactLocation{
+		Bucket: artifactstore.AF_BUCKETNAME_PACKS,
+		Key:    fmt.Sprintf("%d.tgz", sessionID),
+	}, data)
+}
+
+func (a *Artifacts) GetResult(loc artifactstore.ArtifactLocation) ([]byte, error) {
+	p, err := a.path(loc)
+	if err != nil {
+		return nil, err
+	}
+	return os.ReadFile(p)
+}
+
+func (a *Artifacts) OpenResult(loc artifactstore.ArtifactLocation) (io.ReadCloser, int64, error) {
+	p, err := a.path(loc)
+	if err != nil {
+		return nil, 0, err
+	}
+	f, err := os.Open(p)
+	if err != nil {
+		return nil, 0, err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	return f, info.Size(), nil
+}
+
+func (a *Artifacts) GetResultSize(loc artifactstore.ArtifactLocation) (int, error) {
+	p, err := a.path(loc)
+	if err != nil {
+		return 0, err
+	}
+	info, err := os.Stat(p)
+	if err != nil {
+		return 0, err
+	}
+	return int(info.Size()), nil
+}
+
+func (a *Artifacts) SaveResult(js common.JobSpec, data []byte) (artifactstore.ArtifactLocation, error) {
+	return a.save(artifactstore.ArtifactLocation{
+		Bucket: artifactstore.AF_BUCKETNAME_RESULTS,
+		Key:    fmt.Sprintf("%d-%s-%s.zip", js.SessionID, js.Owner, js.Repo),
+	}, data)
+}
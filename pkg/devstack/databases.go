@@ -0,0 +1,43 @@
+package devstack
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/qldbstore"
+)
+
+// Databases is mrvacommander's filesystem database store, which also
+// tells the sizes of its databases and when they were updated.
+type Databases struct {
+	*qldbstore.FilesystemCodeQLDatabaseStore
+	dir string
+}
+
+func NewDatabases(dir string) *Databases {
+	return &Databases{qldbstore.NewLocalFilesystemCodeQLDatabaseStore(dir), dir}
+}
+
+func (d *Databases) stat(nwo common.NameWithOwner) (os.FileInfo, error) {
+	return os.Stat(filepath.Join(d.dir, nwo.Owner, nwo.Repo, nwo.Owner+"_"+nwo.Repo+"_db.zip"))
+}
+
+// DatabaseSize returns the size of a database's zip file.
+func (d *Databases) DatabaseSize(nwo common.NameWithOwner) (int64, bool) {
+	fi, err := d.stat(nwo)
+	if err != nil {
+		return 0, false
+	}
+	return fi.Size(), true
+}
+
+// DatabaseTime returns when a database's zip file was written.
+func (d *Databases) DatabaseTime(nwo common.NameWithOwner) (time.Time, bool) {
+	fi, err := d.stat(nwo)
+	if err != nil {
+		return time.Time{}, false
+	}
+	return fi.ModTime(), true
+}
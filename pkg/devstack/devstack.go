@@ -0,0 +1,77 @@
+// Package devstack runs the whole server in one process without Docker,
+// for development and end-to-end tests.  It stands in for the container
+// mode's backends with embedded substitutes under one directory:
+//
+//	state.journal      the journal state backend, in place of Postgres
+//	artifacts/         query packs and results, in place of MinIO
+//	dbs/OWNER/REPO/    CodeQL databases as OWNER_REPO_db.zip, in place of HEPC
+//
+// Jobs go through an in-process queue, in place of RabbitMQ, to in-process
+// agents running mrvacommander's agent, which needs the CodeQL CLI
+// (CODEQL_CLI_PATH).  The metadata store and locks are kept in memory.
+package devstack
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/qldbstore"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/backend"
+	"mrvaserver/pkg/config"
+)
+
+// Backend is the name the substitutes are registered under.
+const Backend = "devstack"
+
+// Setup creates dir, registers the substitutes with package backend and
+// points cfg at them.  Features that need MinIO or an external service
+// are turned off.
+func Setup(cfg *config.Config, dir string, agents int) error {
+	artifacts, err := NewArtifacts(filepath.Join(dir, "artifacts"))
+	if err != nil {
+		return err
+	}
+	dbs := filepath.Join(dir, "dbs")
+	if err := os.MkdirAll(dbs, 0o755); err != nil {
+		return fmt.Errorf("failed to create database directory: %w", err)
+	}
+	databases := NewDatabases(dbs)
+
+	backend.RegisterArtifacts(Backend, func(ctx context.Context) (artifactstore.Store, error) {
+		return artifacts, nil
+	})
+	backend.RegisterDatabases(Backend, func(ctx context.Context) (qldbstore.Store, error) {
+		return databases, nil
+	})
+	backend.RegisterQueue(Backend, func(ctx context.Context, handle agentproto.ResultHandler) (backend.Queue, error) {
+		return NewQueue(handle, artifacts, databases, agents), nil
+	})
+
+	cfg.State.Backend = "journal"
+	cfg.State.JournalFile = filepath.Join(dir, "state.journal")
+	cfg.Queue.Backend = Backend
+	cfg.Artifacts.Backend = Backend
+	cfg.Databases.Backend = Backend
+	cfg.Leader.Backend = "postgres"
+	for name, on := range map[string]*bool{
+		"cache":       &cfg.Cache.Enabled,
+		"leases":      &cfg.Leases.Enabled,
+		"replication": &cfg.Replication.Enabled,
+		"prefetch":    &cfg.Prefetch.Enabled,
+		"cas":         &cfg.CAS.Enabled,
+		"tiering":     &cfg.Tiering.Enabled,
+		"usage":       &cfg.Usage.Enabled,
+	} {
+		if *on {
+			slog.Warn("Feature not available in devstack mode, disabled", "feature", name)
+			*on = false
+		}
+	}
+	slog.Info("Devstack backends ready", "dir", dir, "agents", agents)
+	return nil
+}
@@ -0,0 +1,148 @@
+package devstack
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/agent"
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/qldbstore"
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"mrvaserver/pkg/agentproto"
+)
+
+// queueDepth bounds the jobs waiting for an agent; publishing blocks past
+// it.
+const queueDepth = 4096
+
+// Queue hands the commander's jobs to in-process agents and their results
+// to the server's result handler.
+type Queue struct {
+	jobs    chan queue.AnalyzeJob
+	results chan queue.AnalyzeResult
+	handle  agentproto.ResultHandler
+
+	// tasks and done are the agents' side of the queue.
+	tasks  chan queue.AnalyzeJob
+	done   chan agentproto.Result
+	cancel context.CancelFunc
+
+	agents int
+
+	stopOnce  sync.Once
+	stop      chan struct{}
+	consumers sync.WaitGroup
+}
+
+// NewQueue starts n agents working on the queue.
+func NewQueue(handle agentproto.ResultHandler, artifacts artifactstore.Store, databases qldbstore.Store, n int) *Queue {
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &Queue{
+		jobs:    make(chan queue.AnalyzeJob),
+		results: make(chan queue.AnalyzeResult),
+		handle:  handle,
+		tasks:   make(chan queue.AnalyzeJob, queueDepth),
+		done:    make(chan agentproto.Result),
+		cancel:  cancel,
+		agents:  n,
+		stop:    make(chan struct{}),
+	}
+	for i := 0; i < n; i++ {
+		go q.work(ctx, artifacts, databases)
+	}
+	go q.publishJobs()
+	q.consumers.Add(1)
+	go q.consumeResults()
+	return q
+}
+
+func (q *Queue) Jobs() chan queue.AnalyzeJob {
+	return q.jobs
+}
+
+// Results is unused: results go to the handler.
+func (q *Queue) Results() chan queue.AnalyzeResult {
+	return q.results
+}
+
+// Consumers is the number of agents.
+func (q *Queue) Consumers() int {
+	return q.agents
+}
+
+func (q *Queue) publishJobs() {
+	for job := range q.jobs {
+		if err := q.Publish(agentproto.Job{AnalyzeJob: job, Attempt: 1}); err != nil {
+			slog.Error("Failed to publish job", "job", job.Spec, "error", err)
+		}
+	}
+}
+
+// Publish queues job for the agents.  They know nothing of attempts or
+// pools, so only the analysis job is passed on.
+func (q *Queue) Publish(job agentproto.Job) error {
+	q.tasks <- job.AnalyzeJob
+	return nil
+}
+
+func (q *Queue) Requeue(job agentproto.Job) error {
+	return q.Publish(job)
+}
+
+// work is one agent.  A job that fails still produces a result, with the
+// error status, so that it does not stay in progress.
+func (q *Queue) work(ctx context.Context, artifacts artifactstore.Store, databases qldbstore.Store) {
+	for {
+		var job queue.AnalyzeJob
+		select {
+		case <-ctx.Done():
+			return
+		case job = <-q.tasks:
+		}
+		slog.Info("Running analysis job", "job", job.Spec)
+		start := time.Now()
+		result, err := agent.RunAnalysisJob(job, artifacts, databases)
+		if err != nil {
+			slog.Error("Failed to run analysis job", "job", job.Spec, "error", err)
+		}
+		// mrvacommander's agent keeps no evaluator log; the wall-clock
+		// time is all the telemetry there is.
+		r := agentproto.Result{AnalyzeResult: result,
+			Telemetry: &agentproto.Telemetry{WallSeconds: time.Since(start).Seconds()}}
+		select {
+		case <-ctx.Done():
+			return
+		case q.done <- r:
+		}
+	}
+}
+
+func (q *Queue) consumeResults() {
+	defer q.consumers.Done()
+	for {
+		select {
+		case <-q.stop:
+			return
+		case r := <-q.done:
+			if err := q.handle(r); err != nil {
+				slog.Error("Failed to handle result", "job", r.Spec, "error", err)
+			}
+		}
+	}
+}
+
+// StopConsuming stops taking results and returns once the one being
+// handled is done.
+func (q *Queue) StopConsuming() {
+	q.stopOnce.Do(func() { close(q.stop) })
+	q.consumers.Wait()
+}
+
+// Close stops the agents.  A job in progress is abandoned with the
+// process.
+func (q *Queue) Close() {
+	q.StopConsuming()
+	q.cancel()
+}
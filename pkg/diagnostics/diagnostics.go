@@ -0,0 +1,236 @@
+// Package diagnostics assembles support bundles at GET /admin/diagnostics:
+// a gzipped tarball of the recent logs, the configuration and environment
+// with secrets redacted, the components' health, the server's own status
+// endpoints, such as the queue figures, and a goroutine dump, so that a
+// bug report can carry what is needed to act on it.  A part that cannot
+// be made is replaced with a .error file saying why; the rest of the
+// bundle is still served.
+package diagnostics
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"runtime/pprof"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/instance"
+	"mrvaserver/pkg/logsink"
+	"mrvaserver/pkg/preflight"
+)
+
+type part struct {
+	name  string
+	write func(ctx context.Context, w io.Writer) error
+}
+
+// Bundle makes bundles for a server running cfg.
+type Bundle struct {
+	cfg     *config.Config
+	started time.Time
+	router  *mux.Router
+	parts   []part
+}
+
+// New returns a Bundle of the logs, configuration, environment, runtime
+// and goroutines of a server running cfg.
+func New(cfg *config.Config) *Bundle {
+	b := &Bundle{cfg: cfg, started: time.Now()}
+	b.Add("logs.txt", func(_ context.Context, w io.Writer) error { return logsink.WriteRecent(w) })
+	b.Add("config.yaml", b.writeConfig)
+	b.Add("environment.txt", writeEnvironment)
+	b.AddJSON("runtime.json", b.status)
+	b.Add("goroutines.txt", func(_ context.Context, w io.Writer) error {
+		return pprof.Lookup("goroutine").WriteTo(w, 2)
+	})
+	return b
+}
+
+// Add includes name, written by write, in every bundle.
+func (b *Bundle) Add(name string, write func(ctx context.Context, w io.Writer) error) {
+	b.parts = append(b.parts, part{name, write})
+}
+
+// AddJSON includes name, the indented JSON of what get returns.
+func (b *Bundle) AddJSON(name string, get func(ctx context.Context) (any, error)) {
+	b.Add(name, func(ctx context.Context, w io.Writer) error {
+		v, err := get(ctx)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(v)
+	})
+}
+
+// AddEndpoint includes name, the server's answer to GET path, as an
+// administrator asking from the server itself would get it.  An answer
+// other than 200, such as that of a failing probe, is the .error file.
+func (b *Bundle) AddEndpoint(name, path string) {
+	b.Add(name, func(ctx context.Context, w io.Writer) error {
+		if b.router == nil {
+			return fmt.Errorf("not mounted")
+		}
+		req := httptest.NewRequest(http.MethodGet, path, nil).WithContext(ctx)
+		rec := httptest.NewRecorder()
+		b.router.ServeHTTP(rec, req)
+		if rec.Code != http.StatusOK {
+			return fmt.Errorf("GET %s answered %d: %s", path, rec.Code, bytes.TrimSpace(rec.Body.Bytes()))
+		}
+		_, err := w.Write(rec.Body.Bytes())
+		return err
+	})
+}
+
+// Register adds no endpoints; the endpoints of the bundle are those of r,
+// admin ones included.
+func (b *Bundle) Register(r *mux.Router) {
+	b.router = r
+}
+
+// RegisterAdmin adds GET /admin/diagnostics.
+func (b *Bundle) RegisterAdmin(r *mux.Router) {
+	r.HandleFunc("/admin/diagnostics", b.serve).Methods(http.MethodGet)
+}
+
+func (b *Bundle) serve(w http.ResponseWriter, r *http.Request) {
+	now := time.Now().UTC()
+	name := fmt.Sprintf("mrvaserver-diagnostics-%s-%s", instance.ID(), now.Format("20060102T150405Z"))
+	w.Header().Set("Content-Type", "application/gzip")
+	w.Header().Set("Content-Disposition", fmt.Sprintf("attachment; filename=%q", name+".tar.gz"))
+	gz := gzip.NewWriter(w)
+	tw := tar.NewWriter(gz)
+	for _, p := range b.parts {
+		var buf bytes.Buffer
+		file := p.name
+		if err := p.write(r.Context(), &buf); err != nil {
+			file += ".error"
+			buf.Reset()
+			fmt.Fprintln(&buf, err)
+		}
+		hdr := &tar.Header{Name: name + "/" + file, Mode: 0o644, Size: int64(buf.Len()), ModTime: now.Truncate(time.Second)}
+		if err := tw.WriteHeader(hdr); err != nil {
+			slog.Warn("Failed to write diagnostics bundle", "error", err)
+			return
+		}
+		if _, err := tw.Write(buf.Bytes()); err != nil {
+			slog.Warn("Failed to write diagnostics bundle", "error", err)
+			return
+		}
+	}
+	tw.Close()
+	gz.Close()
+	slog.Info("Diagnostics bundle served", "name", name, "parts", len(b.parts))
+}
+
+type runtimeInfo struct {
+	Instance   string            `json:"instance"`
+	Started    time.Time         `json:"started"`
+	Uptime     string            `json:"uptime"`
+	GoVersion  string            `json:"go_version"`
+	Module     string            `json:"module,omitempty"`
+	Settings   map[string]string `json:"build_settings,omitempty"`
+	OS         string            `json:"os"`
+	Arch       string            `json:"arch"`
+	CPUs       int               `json:"cpus"`
+	GOMAXPROCS int               `json:"gomaxprocs"`
+	Goroutines int               `json:"goroutines"`
+	HeapAlloc  uint64            `json:"heap_alloc_bytes"`
+	HeapSys    uint64            `json:"heap_sys_bytes"`
+	NumGC      uint32            `json:"num_gc"`
+}
+
+func (b *Bundle) status(context.Context) (any, error) {
+	var ms runtime.MemStats
+	runtime.ReadMemStats(&ms)
+	info := runtimeInfo{
+		Instance:   instance.ID(),
+		Started:    b.started,
+		Uptime:     time.Since(b.started).Round(time.Second).String(),
+		GoVersion:  runtime.Version(),
+		OS:         runtime.GOOS,
+		Arch:       runtime.GOARCH,
+		CPUs:       runtime.NumCPU(),
+		GOMAXPROCS: runtime.GOMAXPROCS(0),
+		Goroutines: runtime.NumGoroutine(),
+		HeapAlloc:  ms.HeapAlloc,
+		HeapSys:    ms.HeapSys,
+		NumGC:      ms.NumGC,
+	}
+	if bi, ok := debug.ReadBuildInfo(); ok {
+		info.Module = bi.Main.Path + " " + bi.Main.Version
+		info.Settings = map[string]string{}
+		for _, s := range bi.Settings {
+			info.Settings[s.Key] = s.Value
+		}
+	}
+	return info, nil
+}
+
+type health struct {
+	Component string `json:"component"`
+	Status    string `json:"status"`
+	Detail    string `json:"detail,omitempty"`
+	Error     string `json:"error,omitempty"`
+}
+
+// Preflight checks every backend of cfg afresh, as "config check" does,
+// each check bounded by its own timeout.
+func Preflight(cfg *config.Config) func(context.Context) (any, error) {
+	return func(context.Context) (any, error) {
+		var out []health
+		for _, r := range preflight.Run(cfg) {
+			h := health{Component: r.Component, Detail: r.Detail, Status: "pass"}
+			switch {
+			case r.Skipped:
+				h.Status = "skip"
+			case !r.Passed():
+				h.Status, h.Error = "fail", r.Err.Error()
+			}
+			out = append(out, h)
+		}
+		return out, nil
+	}
+}
+
+// envPrefixes are those of the variables the server and its backends
+// read.
+var envPrefixes = []string{"MRVA_", "ARTIFACT_", "DR_", "PG", "SERVER_", "KUBERNETES_", "HTTP_PROXY", "HTTPS_PROXY", "NO_PROXY", "GO"}
+
+func writeEnvironment(_ context.Context, w io.Writer) error {
+	var lines []string
+	for _, kv := range os.Environ() {
+		k, v, _ := strings.Cut(kv, "=")
+		for _, p := range envPrefixes {
+			if strings.HasPrefix(strings.ToUpper(k), p) {
+				if secretName(k) {
+					v = redacted
+				}
+				lines = append(lines, k+"="+redactURL(v))
+				break
+			}
+		}
+	}
+	sort.Strings(lines)
+	for _, l := range lines {
+		if _, err := fmt.Fprintln(w, l); err != nil {
+			return err
+		}
+	}
+	return nil
+}
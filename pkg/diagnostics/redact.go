@@ -0,0 +1,79 @@
+package diagnostics
+
+import (
+	"context"
+	"io"
+	"net/url"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "[redacted]"
+
+// secretName reports whether a setting or variable named name holds a
+// secret rather than, as those ending in _file do, where to find one.
+func secretName(name string) bool {
+	n := strings.ToLower(name)
+	if strings.HasSuffix(n, "_file") {
+		return false
+	}
+	for _, s := range []string{"password", "secret", "token", "dsn", "credential", "minio_id"} {
+		if strings.Contains(n, s) {
+			return true
+		}
+	}
+	return strings.HasSuffix(n, "key")
+}
+
+// redactURL removes the password of a URL with one.
+func redactURL(v string) string {
+	u, err := url.Parse(v)
+	if err != nil || u.User == nil {
+		return v
+	}
+	if _, ok := u.User.Password(); !ok {
+		return v
+	}
+	return u.Redacted()
+}
+
+// writeConfig writes the configuration in effect, defaults included, as
+// YAML with secrets redacted.
+func (b *Bundle) writeConfig(_ context.Context, w io.Writer) error {
+	var doc yaml.Node
+	if err := doc.Encode(b.cfg); err != nil {
+		return err
+	}
+	redactNode(&doc, false)
+	enc := yaml.NewEncoder(w)
+	enc.SetIndent(2)
+	if err := enc.Encode(&doc); err != nil {
+		return err
+	}
+	return enc.Close()
+}
+
+// redactNode redacts the strings of secret settings under n, those of
+// headers, which usually carry credentials, and passwords in URLs.
+func redactNode(n *yaml.Node, secret bool) {
+	switch n.Kind {
+	case yaml.ScalarNode:
+		switch {
+		case n.Tag != "!!str":
+		case secret && n.Value != "":
+			n.SetString(redacted)
+		default:
+			n.Value = redactURL(n.Value)
+		}
+	case yaml.MappingNode:
+		for i := 0; i+1 < len(n.Content); i += 2 {
+			key := n.Content[i].Value
+			redactNode(n.Content[i+1], secret || secretName(key) || key == "headers")
+		}
+	default:
+		for _, c := range n.Content {
+			redactNode(c, secret)
+		}
+	}
+}
@@ -0,0 +1,151 @@
+// Package discovery re-resolves the host names of the backing services
+// and resets their clients' connections when the addresses change, as
+// when a Kubernetes service is recreated or a managed database or broker
+// fails over.  Pooled connections otherwise stay with the old address for
+// as long as it answers, though it may be a demoted primary; after a
+// reset, new connections dial the name again and reach the new one.
+package discovery
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgconn"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/netaddr"
+)
+
+// lookupTimeout bounds each resolution.
+const lookupTimeout = 5 * time.Second
+
+var changes = metrics.NewCounterVec("mrvaserver_discovery_changes_total",
+	"Backing service address changes that reset connections, by service.", "service")
+
+type target struct {
+	service string
+	host    string
+	addrs   []string
+	resets  []func()
+}
+
+type Watcher struct {
+	mu      sync.Mutex
+	targets map[string]*target // by service and host
+}
+
+func New() *Watcher {
+	return &Watcher{targets: make(map[string]*target)}
+}
+
+// Watch calls reset whenever the addresses of host change; service names
+// it in logs.  Host may carry a port.  IP literals, Unix sockets and empty
+// hosts are not watched.
+func (w *Watcher) Watch(service, host string, reset func()) {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	host = netaddr.Host(host)
+	if _, err := netip.ParseAddr(host); err == nil || host == "" || strings.HasPrefix(host, "/") {
+		return
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	k := service + "\x00" + host
+	t, ok := w.targets[k]
+	if !ok {
+		t = &target{service: service, host: host}
+		w.targets[k] = t
+	}
+	t.resets = append(t.resets, reset)
+}
+
+// WatchURL watches the host of a URL.
+func (w *Watcher) WatchURL(service, rawURL string, reset func()) {
+	if u, err := url.Parse(rawURL); err == nil {
+		w.Watch(service, u.Host, reset)
+	}
+}
+
+// WatchDSN watches the hosts of a Postgres connection string, including
+// fallback hosts.  An empty dsn is the PG* environment variables'.
+func (w *Watcher) WatchDSN(service, dsn string, reset func()) {
+	cfg, err := pgconn.ParseConfig(dsn)
+	if err != nil {
+		return
+	}
+	// Fallbacks repeat a host for each TLS setting to try.
+	hosts := []string{cfg.Host}
+	for _, fb := range cfg.Fallbacks {
+		if !slices.Contains(hosts, fb.Host) {
+			hosts = append(hosts, fb.Host)
+		}
+	}
+	for _, h := range hosts {
+		w.Watch(service, h, reset)
+	}
+}
+
+// Run re-resolves the watched hosts every interval until ctx ends.  The
+// first resolution only records the addresses.
+func (w *Watcher) Run(ctx context.Context, interval time.Duration) {
+	w.mu.Lock()
+	n := len(w.targets)
+	w.mu.Unlock()
+	if n == 0 {
+		return
+	}
+	slog.Info("Watching backing service addresses", "hosts", n, "interval", interval)
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		w.resolve(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+		}
+	}
+}
+
+func (w *Watcher) resolve(ctx context.Context) {
+	w.mu.Lock()
+	targets := make([]*target, 0, len(w.targets))
+	for _, t := range w.targets {
+		targets = append(targets, t)
+	}
+	w.mu.Unlock()
+
+	for _, t := range targets {
+		lctx, cancel := context.WithTimeout(ctx, lookupTimeout)
+		addrs, err := net.DefaultResolver.LookupHost(lctx, t.host)
+		cancel()
+		if err != nil {
+			// A name that stops resolving keeps its connections; they
+			// fail on their own if the service is gone.
+			slog.Debug("Failed to resolve backing service", "service", t.service, "host", t.host, "error", err)
+			continue
+		}
+		slices.Sort(addrs)
+		w.mu.Lock()
+		old := t.addrs
+		t.addrs = addrs
+		resets := slices.Clone(t.resets)
+		w.mu.Unlock()
+		if old == nil || slices.Equal(old, addrs) {
+			continue
+		}
+		changes.With(t.service).Inc()
+		slog.Info("Backing service address changed, resetting connections", "service", t.service,
+			"host", t.host, "old", old, "new", addrs)
+		for _, reset := range resets {
+			reset()
+		}
+	}
+}
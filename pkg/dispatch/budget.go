@@ -0,0 +1,173 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/store"
+)
+
+const (
+	nsConsumption = "session-consumption" // group -> Consumption
+	nsOverBudget  = "over-budget"         // job -> skip
+)
+
+// Budget bounds what a session may consume: Jobs published, retries
+// included, and CPUHours, the hours agents spent on its jobs.  Jobs
+// outstanding when the budget runs out still finish, so a session may
+// overshoot its CPU-hours by that much.
+type Budget struct {
+	Jobs     int     `json:"jobs,omitempty"`
+	CPUHours float64 `json:"cpu_hours,omitempty"`
+}
+
+func (b *Budget) empty() bool {
+	return b == nil || b.Jobs == 0 && b.CPUHours == 0
+}
+
+// Consumption is what a session and the shards sharing its limits have
+// consumed.
+type Consumption struct {
+	Group   int     `json:"group"`
+	Jobs    int     `json:"jobs"`
+	Seconds float64 `json:"seconds"`
+}
+
+// exhausted names the part of b that c used up, or returns "".
+func (c Consumption) exhausted(b *Budget) string {
+	switch {
+	case b.empty():
+		return ""
+	case b.Jobs > 0 && c.Jobs >= b.Jobs:
+		return fmt.Sprintf("%d jobs", b.Jobs)
+	case b.CPUHours > 0 && c.Seconds >= b.CPUHours*3600:
+		return fmt.Sprintf("%g CPU-hours", b.CPUHours)
+	}
+	return ""
+}
+
+// skip records a job dropped from the backlog because its session's budget
+// ran out.
+type skip struct {
+	Budget string    `json:"budget"`
+	At     time.Time `json:"at"`
+}
+
+// charge adds to a group's consumption.
+func (d *Dispatcher) charge(ctx context.Context, group, jobs int, seconds float64) (Consumption, error) {
+	var out Consumption
+	err := store.UpdateJSON(ctx, d.store, nsConsumption, strconv.Itoa(group), func(c *Consumption, found bool) error {
+		c.Group = group
+		c.Jobs += jobs
+		c.Seconds += seconds
+		out = *c
+		return nil
+	})
+	if err == nil {
+		d.versions.Touch(ctx, group)
+	}
+	return out, err
+}
+
+// overBudget names the part of a session's budget that is used up, or
+// returns "".  The caller holds d.mu.
+func (d *Dispatcher) overBudget(session int) string {
+	l, ok := d.limits[session]
+	if !ok {
+		return ""
+	}
+	return d.used[l.Group].exhausted(l.Budget)
+}
+
+// skipOverBudget claims a backlog entry whose session's budget is used up
+// and marks its job skipped.
+func (d *Dispatcher) skipOverBudget(ctx context.Context, it item, budget string) error {
+	claimed := false
+	err := d.store.Update(ctx, nsBacklog, it.key, func(old []byte) ([]byte, error) {
+		claimed = old != nil
+		return nil, nil
+	})
+	if err != nil || !claimed {
+		return err
+	}
+	js := it.e.Job.Spec
+	if err := store.PutJSON(ctx, d.store, nsOverBudget, jobKey(js), skip{Budget: budget, At: time.Now().UTC()}); err != nil {
+		d.restore(ctx, it)
+		return err
+	}
+	d.versions.Touch(ctx, js.SessionID)
+	slog.Info("Job skipped over budget", "job", js, "budget", budget)
+	return nil
+}
+
+// chargeRuntime adds a finished job's runtime to its session's
+// consumption, if the session has a CPU-hour budget.
+func (d *Dispatcher) chargeRuntime(js common.JobSpec) {
+	d.mu.Lock()
+	l, ok := d.limits[js.SessionID]
+	d.mu.Unlock()
+	if !ok || l.Budget.empty() || l.Budget.CPUHours == 0 {
+		return
+	}
+	ctx := context.Background()
+	t, err := d.Timing(ctx, js)
+	if err != nil {
+		return
+	}
+	c, err := d.charge(ctx, l.Group, 0, t.Duration().Seconds())
+	if err != nil {
+		slog.Warn("Failed to charge job runtime to session budget", "job", js, "error", err)
+		return
+	}
+	d.mu.Lock()
+	if d.used != nil {
+		d.used[l.Group] = c
+	}
+	d.mu.Unlock()
+}
+
+// budgetTask reports a job skipped over budget as canceled.
+func (d *Dispatcher) budgetTask(js common.JobSpec, task *api.RepoTask) {
+	var sk skip
+	if err := store.GetJSON(context.Background(), d.store, nsOverBudget, jobKey(js), &sk); err != nil {
+		return
+	}
+	task.AnalysisStatus = api.RepoStatusCanceled
+	task.FailureCode = apierr.SkippedOverBudget
+	task.FailureMessage = fmt.Sprintf("skipped: the session used up its budget of %s", sk.Budget)
+}
+
+// reportBudget adds the session's budget and consumption to its status
+// document.
+func (d *Dispatcher) reportBudget(va *api.VariantAnalysis) {
+	d.mu.Lock()
+	l, ok := d.limits[va.ID]
+	d.mu.Unlock()
+	if !ok || l.Budget.empty() {
+		return
+	}
+	var c Consumption
+	err := store.GetJSON(context.Background(), d.store, nsConsumption, strconv.Itoa(l.Group), &c)
+	if err != nil && !errors.Is(err, store.ErrNotFound) {
+		return
+	}
+	va.Budget = &api.Budget{
+		Jobs:         l.Budget.Jobs,
+		CPUHours:     l.Budget.CPUHours,
+		UsedJobs:     c.Jobs,
+		UsedCPUHours: c.Seconds / 3600,
+		Exhausted:    c.exhausted(l.Budget) != "",
+	}
+	for _, sr := range va.ScannedRepositories {
+		if sr.FailureCode == apierr.SkippedOverBudget {
+			va.Budget.Skipped++
+		}
+	}
+}
@@ -0,0 +1,572 @@
+// Package dispatch releases jobs to the agents' queues gradually.  Once a
+// job is on RabbitMQ it is out of the server's hands, so new jobs are kept
+// in a backlog in the metadata store and published only while their pool
+// has fewer than a window of jobs outstanding.  Jobs still in the backlog
+// can be held back: a paused session's jobs stay there until it resumes,
+// while its outstanding jobs run to completion, and in drain mode so do
+// those of every session.  A session with a concurrency cap, its
+// submitter's or the configured policy's, has at most that many jobs
+// outstanding, so that a large low-priority session trickles through
+// without taking over the agents, and a session with an execution window
+// is only published inside it, as if paused outside.  Once a session with
+// a budget has used it up, its remaining jobs are dropped from the backlog
+// and reported skipped.
+//
+// A tenant with the gradual-dispatch flag off has its sessions' jobs
+// published regardless of the window, though still subject to pauses,
+// drain mode and the session's own limits.
+//
+// A new job waits in the backlog until the submission that created it has
+// recorded its session's limits and routing, which is only once the
+// commander has answered with the session's ID; it is then routed to its
+// pool.
+//
+// Every replica pumps the backlog when jobs are added or finish and at a
+// regular interval.  Entries are claimed by deleting them, so a job is
+// published once even when replicas pump concurrently, though the window
+// may then be overshot slightly.
+//
+// The dispatcher also records when each job was published and finished,
+// for durations, and how many jobs finish a minute: with the queue ahead
+// of a session, that estimates when the session completes.
+package dispatch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/hohn/mrvacommander/pkg/state"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/flags"
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/shard"
+	"mrvaserver/pkg/store"
+)
+
+// settleWait is how long a new job waits for its submission to settle,
+// should the gateway never report on it.
+const settleWait = 30 * time.Second
+
+const (
+	nsBacklog    = "backlog"
+	nsDispatched = "dispatched"
+	nsPaused     = "paused-sessions"
+	nsUnwindowed = "unwindowed-sessions"
+	nsControl    = "dispatch-control"
+)
+
+var gradualDispatch = flags.Define("gradual-dispatch",
+	"Hold a session's jobs in the backlog while its pool has dispatch.window jobs outstanding.", true)
+
+var (
+	backlogJobs = metrics.NewGauge("mrvaserver_dispatch_backlog",
+		"Jobs waiting to be published, as of the last pump on this replica.")
+	outstandingJobs = metrics.NewGaugeVec("mrvaserver_dispatch_outstanding",
+		"Jobs published and without a final result, by pool.", "pool")
+)
+
+type entry struct {
+	Job    agentproto.Job `json:"job"`
+	Queued time.Time      `json:"queued"`
+
+	// Routed is set once the job's pool is picked.
+	Routed bool `json:"routed,omitempty"`
+
+	// Unsettled is set until the submission that created the job has
+	// recorded how its session's jobs are to be dispatched.
+	Unsettled bool `json:"unsettled,omitempty"`
+}
+
+type outstanding struct {
+	Spec      common.JobSpec `json:"spec"`
+	Pool      string         `json:"pool"`
+	Queued    time.Time      `json:"queued,omitempty"`
+	Published time.Time      `json:"published"`
+}
+
+type item struct {
+	key string
+	e   entry
+}
+
+// Pause records that a session is paused.
+type Pause struct {
+	Session int       `json:"session"`
+	Since   time.Time `json:"since"`
+}
+
+// unwindowedSession records that a session's jobs are not held to the
+// window.
+type unwindowedSession struct {
+	Session int       `json:"session"`
+	Since   time.Time `json:"since"`
+}
+
+// Stager prepares the inputs of jobs while they wait in the backlog.  It is
+// implemented by prefetch.Stager.
+type Stager interface {
+	// Stage starts preparing job's inputs.  It must not block.
+	Stage(job agentproto.Job)
+
+	// Annotate adds what has been prepared to job as it is published.
+	Annotate(job agentproto.Job) agentproto.Job
+}
+
+type Dispatcher struct {
+	cfg      config.Dispatch
+	store    store.Store
+	st       state.ServerState
+	publish  func(agentproto.Job) error
+	route    func(queue.AnalyzeJob) string
+	shards   *shard.Map
+	versions *gateway.MetadataVersions
+	stager   Stager
+	gate     Gate
+	flags    *flags.Set
+	kick     chan struct{}
+
+	// mu serializes pumps and guards the cached backlog, pauses and
+	// limits.
+	mu         sync.Mutex
+	backlog    []item
+	paused     map[int]bool
+	unwindowed map[int]bool
+	limits     map[int]Limits
+	used       map[int]Consumption
+	drain      *Drain
+
+	// settled are the sessions released recently, for jobs the commander
+	// hands over after answering their submission.
+	settled map[int]time.Time
+
+	eta eta
+}
+
+func New(cfg config.Dispatch, st state.ServerState, s store.Store, publish func(agentproto.Job) error) *Dispatcher {
+	return &Dispatcher{
+		cfg:     cfg,
+		store:   s,
+		st:      st,
+		publish: publish,
+		kick:    make(chan struct{}, 1),
+		settled: make(map[int]time.Time),
+		// Replicas count estimate changes from different starts, so that
+		// their counts do not meet.
+		eta: eta{version: time.Now().UnixNano()},
+	}
+}
+
+func jobKey(js common.JobSpec) string {
+	return fmt.Sprintf("%d/%s/%s", js.SessionID, js.Owner, js.Repo)
+}
+
+func poolName(pool string) string {
+	if pool == "" {
+		return agentproto.DefaultPool
+	}
+	return pool
+}
+
+// SetStager sets the stager for jobs enqueued from now on.  It must be
+// called before jobs are enqueued.  A stager that is a Gate holds jobs
+// until it clears them.
+func (d *Dispatcher) SetStager(s Stager) {
+	d.stager = s
+	d.gate, _ = s.(Gate)
+}
+
+// SetRoute sets how the pool new jobs are published to is picked, once
+// their submission settles.  Without it they go to the default pool.  It
+// must be called before jobs are enqueued.
+func (d *Dispatcher) SetRoute(f func(queue.AnalyzeJob) string) {
+	d.route = f
+}
+
+// SetShards makes pausing, resuming and limiting a sharded session apply
+// to all its shards.
+func (d *Dispatcher) SetShards(m *shard.Map) {
+	d.shards = m
+}
+
+// SetFlags consults f for the gradual-dispatch flag of submitters; without
+// it every session is held to the window.
+func (d *Dispatcher) SetFlags(f *flags.Set) {
+	d.flags = f
+}
+
+// SetVersions touches a session in v whenever its limits or budget
+// consumption change.
+func (d *Dispatcher) SetVersions(v *gateway.MetadataVersions) {
+	d.versions = v
+}
+
+// Enqueue adds a new job to the backlog.  It is not published until its
+// submission settles; see SubmitHook.
+func (d *Dispatcher) Enqueue(job agentproto.Job) error {
+	ctx := context.Background()
+	now := time.Now().UTC()
+	key := fmt.Sprintf("%019d/%s", now.UnixNano(), jobKey(job.Spec))
+	d.mu.Lock()
+	_, settled := d.settled[job.Spec.SessionID]
+	e := entry{Job: job, Queued: now, Unsettled: !settled}
+	if err := store.PutJSON(ctx, d.store, nsBacklog, key, e); err != nil {
+		d.mu.Unlock()
+		return fmt.Errorf("failed to add job to backlog: %w", err)
+	}
+	if d.backlog != nil {
+		d.backlog = append(d.backlog, item{key: key, e: e})
+	}
+	d.mu.Unlock()
+	if d.stager != nil {
+		d.stager.Stage(job)
+	}
+	d.Kick()
+	return nil
+}
+
+// settle releases the jobs of sessions whose submission has been
+// forwarded, including those enqueued from now on.  The caller holds d.mu.
+func (d *Dispatcher) settle(ctx context.Context, sessions []int) {
+	now := time.Now()
+	for id, t := range d.settled {
+		if now.Sub(t) > settleWait {
+			delete(d.settled, id)
+		}
+	}
+	ids := make(map[int]bool, len(sessions))
+	for _, id := range sessions {
+		d.settled[id] = now
+		ids[id] = true
+	}
+	if d.backlog == nil {
+		if err := d.load(ctx); err != nil {
+			slog.Warn("Failed to load dispatch state, jobs wait to settle", "session", sessions[0], "error", err)
+			return
+		}
+	}
+	for i, it := range d.backlog {
+		if !it.e.Unsettled || !ids[it.e.Job.Spec.SessionID] {
+			continue
+		}
+		it.e.Unsettled = false
+		err := d.store.Update(ctx, nsBacklog, it.key, func(old []byte) ([]byte, error) {
+			if old == nil {
+				return nil, nil
+			}
+			return json.Marshal(it.e)
+		})
+		if err != nil {
+			slog.Warn("Failed to settle backlog entry", "job", it.e.Job.Spec, "error", err)
+			continue
+		}
+		d.backlog[i] = it
+	}
+}
+
+// Kick asks for a pump soon.
+func (d *Dispatcher) Kick() {
+	select {
+	case d.kick <- struct{}{}:
+	default:
+	}
+}
+
+// Run pumps the backlog when kicked and every cfg.Interval until ctx is
+// cancelled.
+func (d *Dispatcher) Run(ctx context.Context) {
+	t := time.NewTicker(d.cfg.Interval)
+	defer t.Stop()
+	for {
+		reload := false
+		select {
+		case <-ctx.Done():
+			return
+		case <-d.kick:
+		case <-t.C:
+			reload = true
+		}
+		if err := d.pump(ctx, reload); err != nil {
+			slog.Error("Failed to dispatch jobs", "error", err)
+		}
+	}
+}
+
+// HandleResult marks a job no longer outstanding once its final result is
+// applied.  It must wrap the handler inside any that retry failures.
+func (d *Dispatcher) HandleResult(next agentproto.ResultHandler) agentproto.ResultHandler {
+	return func(r agentproto.Result) error {
+		if err := next(r); err != nil {
+			return err
+		}
+		d.recordTiming(r.Spec)
+		d.chargeRuntime(r.Spec)
+		if err := d.store.Delete(context.Background(), nsDispatched, jobKey(r.Spec)); err != nil {
+			slog.Warn("Failed to clear outstanding job", "job", r.Spec, "error", err)
+		}
+		d.Kick()
+		return nil
+	}
+}
+
+func (d *Dispatcher) load(ctx context.Context) error {
+	entries, err := d.store.List(ctx, nsBacklog, "")
+	if err != nil {
+		return err
+	}
+	backlog := make([]item, 0, len(entries))
+	for _, en := range entries {
+		var e entry
+		if err := json.Unmarshal(en.Value, &e); err != nil {
+			slog.Error("Dropping undecodable backlog entry", "key", en.Key, "error", err)
+			continue
+		}
+		backlog = append(backlog, item{key: en.Key, e: e})
+	}
+	pauses, err := store.ListJSON[Pause](ctx, d.store, nsPaused, "")
+	if err != nil {
+		return err
+	}
+	paused := make(map[int]bool, len(pauses))
+	for _, p := range pauses {
+		paused[p.Session] = true
+	}
+	unwindowedList, err := store.ListJSON[unwindowedSession](ctx, d.store, nsUnwindowed, "")
+	if err != nil {
+		return err
+	}
+	unwindowed := make(map[int]bool, len(unwindowedList))
+	for _, u := range unwindowedList {
+		unwindowed[u.Session] = true
+	}
+	limitList, err := store.ListJSON[Limits](ctx, d.store, nsLimits, "")
+	if err != nil {
+		return err
+	}
+	limits := make(map[int]Limits, len(limitList))
+	for _, l := range limitList {
+		limits[l.Session] = l
+	}
+	usedList, err := store.ListJSON[Consumption](ctx, d.store, nsConsumption, "")
+	if err != nil {
+		return err
+	}
+	used := make(map[int]Consumption, len(usedList))
+	for _, c := range usedList {
+		used[c.Group] = c
+	}
+	drain, err := d.loadDrain(ctx)
+	if err != nil {
+		return err
+	}
+	d.backlog, d.paused, d.unwindowed, d.limits, d.used, d.drain = backlog, paused, unwindowed, limits, used, drain
+	return nil
+}
+
+func (d *Dispatcher) pump(ctx context.Context, reload bool) error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if reload || d.backlog == nil {
+		if err := d.load(ctx); err != nil {
+			return err
+		}
+	}
+
+	out, err := store.ListJSON[outstanding](ctx, d.store, nsDispatched, "")
+	if err != nil {
+		return err
+	}
+	counts := make(map[string]int)
+	for _, o := range out {
+		counts[poolName(o.Pool)]++
+	}
+	perGroup := d.outstandingBy(out)
+
+	now := time.Now()
+	rest := d.backlog[:0]
+	for i, it := range d.backlog {
+		if it.e.Unsettled && now.Sub(it.e.Queued) < settleWait {
+			rest = append(rest, it)
+			continue
+		}
+		if !it.e.Routed && d.route != nil {
+			it.e.Job.Pool, it.e.Routed = d.route(it.e.Job.AnalyzeJob), true
+		}
+		pool := poolName(it.e.Job.Pool)
+		if budget := d.overBudget(it.e.Job.Spec.SessionID); budget != "" {
+			if err := d.skipOverBudget(ctx, it, budget); err != nil {
+				slog.Error("Failed to skip job over budget", "job", it.e.Job.Spec, "error", err)
+				rest = append(rest, it)
+			}
+			continue
+		}
+		if d.gate != nil {
+			ok, reason := d.gate.Clear(it.e.Job)
+			if reason != nil {
+				if err := d.reject(ctx, it, reason); err != nil {
+					slog.Error("Failed to reject job", "job", it.e.Job.Spec, "error", err)
+					rest = append(rest, it)
+				}
+				continue
+			}
+			if !ok {
+				rest = append(rest, it)
+				continue
+			}
+		}
+		group, max, _ := d.limitsOf(it.e.Job.Spec.SessionID)
+		windowed := d.cfg.Window > 0 && !d.unwindowed[it.e.Job.Spec.SessionID]
+		if d.held(it.e.Job.Spec.SessionID, now) || (windowed && counts[pool] >= d.cfg.Window) ||
+			(max > 0 && perGroup[group] >= max) {
+			rest = append(rest, it)
+			continue
+		}
+		published, err := d.dispatchOne(ctx, it)
+		if err != nil {
+			// Most likely the broker is unreachable; try again later.
+			slog.Error("Failed to publish job", "job", it.e.Job.Spec, "error", err)
+			rest = append(rest, d.backlog[i:]...)
+			break
+		}
+		if published {
+			counts[pool]++
+			perGroup[group]++
+		}
+	}
+	d.backlog = rest
+	d.recordQueue(out)
+
+	backlogJobs.Set(float64(len(rest)))
+	for pool, n := range counts {
+		outstandingJobs.With(pool).Set(float64(n))
+	}
+	return nil
+}
+
+// dispatchOne claims a backlog entry and publishes its job.  It reports
+// false if another replica claimed it first.
+func (d *Dispatcher) dispatchOne(ctx context.Context, it item) (bool, error) {
+	claimed := false
+	err := d.store.Update(ctx, nsBacklog, it.key, func(old []byte) ([]byte, error) {
+		claimed = old != nil
+		return nil, nil
+	})
+	if err != nil || !claimed {
+		return false, err
+	}
+
+	js := it.e.Job.Spec
+	o := outstanding{Spec: js, Pool: it.e.Job.Pool, Queued: it.e.Queued, Published: time.Now().UTC()}
+	if err := store.PutJSON(ctx, d.store, nsDispatched, jobKey(js), o); err != nil {
+		d.restore(ctx, it)
+		return false, err
+	}
+	job := it.e.Job
+	if d.stager != nil {
+		job = d.stager.Annotate(job)
+	}
+	if err := d.publish(job); err != nil {
+		d.store.Delete(ctx, nsDispatched, jobKey(js))
+		d.restore(ctx, it)
+		return false, err
+	}
+	if l, ok := d.limits[js.SessionID]; ok && !l.Budget.empty() {
+		c, err := d.charge(ctx, l.Group, 1, 0)
+		if err != nil {
+			slog.Warn("Failed to charge job to session budget", "job", js, "error", err)
+		} else {
+			d.used[l.Group] = c
+		}
+	}
+	return true, nil
+}
+
+func (d *Dispatcher) restore(ctx context.Context, it item) {
+	if err := store.PutJSON(ctx, d.store, nsBacklog, it.key, it.e); err != nil {
+		slog.Error("Failed to return job to backlog, job is lost", "job", it.e.Job.Spec, "error", err)
+	}
+}
+
+// Reconcile drops outstanding jobs that finished without a result passing
+// through HandleResult, such as jobs failed after their last lease ran
+// out.  It is a background task.
+func (d *Dispatcher) Reconcile(ctx context.Context) error {
+	out, err := store.ListJSON[outstanding](ctx, d.store, nsDispatched, "")
+	if err != nil {
+		return err
+	}
+	dropped := 0
+	for _, o := range out {
+		status, err := d.st.GetStatus(o.Spec)
+		if err != nil {
+			continue
+		}
+		switch status {
+		case common.StatusSuccess, common.StatusError, common.StatusFailed:
+			if err := d.store.Delete(ctx, nsDispatched, jobKey(o.Spec)); err != nil {
+				return err
+			}
+			dropped++
+		}
+	}
+	if dropped > 0 {
+		slog.Info("Dropped finished jobs from outstanding", "count", dropped)
+		d.Kick()
+	}
+	return nil
+}
+
+// Held reports whether new dispatches of the job are held back, because
+// its session is paused or outside its execution window, or the cluster
+// is draining.  Retries wait while it is true.
+func (d *Dispatcher) Held(js common.JobSpec) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.backlog == nil {
+		if err := d.load(context.Background()); err != nil {
+			slog.Warn("Failed to load dispatch state", "error", err)
+			return false
+		}
+	}
+	return d.held(js.SessionID, time.Now())
+}
+
+// Pause stops publishing the session's jobs, those of all its shards.
+func (d *Dispatcher) Pause(ctx context.Context, session int) error {
+	for _, id := range d.shards.Sessions(ctx, session) {
+		p := Pause{Session: id, Since: time.Now().UTC()}
+		if err := store.PutJSON(ctx, d.store, nsPaused, strconv.Itoa(id), p); err != nil {
+			return err
+		}
+		d.mu.Lock()
+		if d.paused != nil {
+			d.paused[id] = true
+		}
+		d.mu.Unlock()
+	}
+	return nil
+}
+
+// Resume publishes the session's jobs again, those of all its shards.
+func (d *Dispatcher) Resume(ctx context.Context, session int) error {
+	for _, id := range d.shards.Sessions(ctx, session) {
+		if err := d.store.Delete(ctx, nsPaused, strconv.Itoa(id)); err != nil {
+			return err
+		}
+		d.mu.Lock()
+		if d.paused != nil {
+			delete(d.paused, id)
+		}
+		d.mu.Unlock()
+	}
+	d.Kick()
+	return nil
+}
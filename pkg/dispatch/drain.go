@@ -0,0 +1,150 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const drainKey = "drain"
+
+var drainingGauge = metrics.NewGauge("mrvaserver_dispatch_draining",
+	"1 while the cluster is in drain mode.")
+
+// Drain records that the cluster is draining: no job is dispatched, and
+// every replica waits for the outstanding ones to finish, so that MinIO,
+// Postgres or RabbitMQ can be taken down for maintenance.
+type Drain struct {
+	Since  time.Time `json:"since"`
+	Reason string    `json:"reason,omitempty"`
+}
+
+type drainStatus struct {
+	Draining    bool       `json:"draining"`
+	Since       *time.Time `json:"since,omitempty"`
+	Reason      string     `json:"reason,omitempty"`
+	Outstanding int        `json:"outstanding"`
+	Backlog     int        `json:"backlog"`
+	Drained     bool       `json:"drained"`
+}
+
+func (d *Dispatcher) loadDrain(ctx context.Context) (*Drain, error) {
+	var dr Drain
+	err := store.GetJSON(ctx, d.store, nsControl, drainKey, &dr)
+	if errors.Is(err, store.ErrNotFound) {
+		drainingGauge.Set(0)
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	drainingGauge.Set(1)
+	return &dr, nil
+}
+
+// Draining reports whether the cluster is draining, as of the last load.
+func (d *Dispatcher) Draining() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.backlog == nil {
+		if err := d.load(context.Background()); err != nil {
+			slog.Warn("Failed to load dispatch state", "error", err)
+			return false
+		}
+	}
+	return d.drain != nil
+}
+
+// StartDrain stops dispatching on every replica.  Other replicas notice
+// within the dispatch interval.
+func (d *Dispatcher) StartDrain(ctx context.Context, reason string) error {
+	dr := &Drain{Since: time.Now().UTC(), Reason: reason}
+	err := store.UpdateJSON(ctx, d.store, nsControl, drainKey, func(old *Drain, found bool) error {
+		if found {
+			*dr = *old
+			return nil
+		}
+		*old = *dr
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.drain = dr
+	d.mu.Unlock()
+	drainingGauge.Set(1)
+	slog.Warn("Drain mode entered, dispatching stopped", "reason", dr.Reason)
+	return nil
+}
+
+// StopDrain resumes dispatching.
+func (d *Dispatcher) StopDrain(ctx context.Context) error {
+	if err := d.store.Delete(ctx, nsControl, drainKey); err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.drain = nil
+	d.mu.Unlock()
+	drainingGauge.Set(0)
+	slog.Info("Drain mode left, dispatching resumed")
+	d.Kick()
+	return nil
+}
+
+func (d *Dispatcher) drainStatus(ctx context.Context) (drainStatus, error) {
+	var s drainStatus
+	dr, err := d.loadDrain(ctx)
+	if err != nil {
+		return s, err
+	}
+	outs, err := d.store.List(ctx, nsDispatched, "")
+	if err != nil {
+		return s, err
+	}
+	backlog, err := d.store.List(ctx, nsBacklog, "")
+	if err != nil {
+		return s, err
+	}
+	s.Outstanding, s.Backlog = len(outs), len(backlog)
+	if dr != nil {
+		s.Draining, s.Since, s.Reason = true, &dr.Since, dr.Reason
+		s.Drained = s.Outstanding == 0
+	}
+	return s, nil
+}
+
+func (d *Dispatcher) getDrain(w http.ResponseWriter, r *http.Request) {
+	s, err := d.drainStatus(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, s)
+}
+
+func (d *Dispatcher) startDrain(w http.ResponseWriter, r *http.Request) {
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "requested via control endpoint"
+	}
+	if err := d.StartDrain(r.Context(), reason); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	d.getDrain(w, r)
+}
+
+func (d *Dispatcher) stopDrain(w http.ResponseWriter, r *http.Request) {
+	if err := d.StopDrain(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	d.getDrain(w, r)
+}
@@ -0,0 +1,169 @@
+package dispatch
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"maps"
+	"sync"
+	"time"
+
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/store"
+)
+
+const nsThroughput = "throughput"
+
+const (
+	// throughputWindow is how far back finished jobs count toward the
+	// throughput, in minute buckets shared by every replica.
+	throughputWindow = 15 * time.Minute
+	bucketRetention  = time.Hour
+
+	// rateRefresh bounds how often a replica reads the buckets.
+	rateRefresh = 10 * time.Second
+)
+
+// queueStats is where sessions stand in the queue, as of the last pump.
+type queueStats struct {
+	// ahead is how many backlog jobs of other sessions precede each
+	// session's first backlog job.
+	ahead map[int]int
+	// outstanding counts published jobs without a result, by session.
+	outstanding map[int]int
+	total       int
+}
+
+type eta struct {
+	mu      sync.Mutex
+	stats   queueStats
+	rate    float64 // jobs per minute
+	read    time.Time
+	version int64 // changes with stats and rate
+}
+
+func (a queueStats) equal(b queueStats) bool {
+	return a.total == b.total && maps.Equal(a.ahead, b.ahead) && maps.Equal(a.outstanding, b.outstanding)
+}
+
+// EstimatesVersion is a gateway.EstimatesVersioner: it changes whenever the
+// queue positions or the throughput that estimates are made from do.
+func (d *Dispatcher) EstimatesVersion() int64 {
+	d.eta.mu.Lock()
+	defer d.eta.mu.Unlock()
+	return d.eta.version
+}
+
+func bucketKey(t time.Time) string {
+	return t.UTC().Format("2006-01-02T15:04")
+}
+
+// countFinished adds a finished job to its minute's bucket.
+func (d *Dispatcher) countFinished(ctx context.Context, t time.Time) {
+	err := store.UpdateJSON(ctx, d.store, nsThroughput, bucketKey(t), func(n *int, _ bool) error {
+		*n++
+		return nil
+	})
+	if err != nil {
+		slog.Warn("Failed to count finished job", "error", err)
+	}
+}
+
+// recordQueue keeps the positions of the backlog's sessions and the
+// outstanding jobs, for estimates.  It is called with d.mu held.
+func (d *Dispatcher) recordQueue(out []outstanding) {
+	qs := queueStats{ahead: make(map[int]int), outstanding: make(map[int]int), total: len(out)}
+	for _, o := range out {
+		qs.outstanding[o.Spec.SessionID]++
+	}
+	for i, it := range d.backlog {
+		if _, ok := qs.ahead[it.e.Job.Spec.SessionID]; !ok {
+			qs.ahead[it.e.Job.Spec.SessionID] = i
+		}
+	}
+	d.eta.mu.Lock()
+	if !qs.equal(d.eta.stats) {
+		d.eta.version++
+	}
+	d.eta.stats = qs
+	d.eta.mu.Unlock()
+}
+
+// throughput returns the jobs finished per minute over the window,
+// rereading the buckets at most every rateRefresh.
+func (d *Dispatcher) throughput(ctx context.Context) float64 {
+	d.eta.mu.Lock()
+	defer d.eta.mu.Unlock()
+	now := time.Now()
+	if now.Sub(d.eta.read) < rateRefresh {
+		return d.eta.rate
+	}
+	entries, err := d.store.List(ctx, nsThroughput, "")
+	if err != nil {
+		slog.Warn("Failed to read throughput", "error", err)
+		return d.eta.rate
+	}
+	from, stale := bucketKey(now.Add(-throughputWindow)), bucketKey(now.Add(-bucketRetention))
+	var n int
+	for _, e := range entries {
+		switch {
+		case e.Key < stale:
+			d.store.Delete(ctx, nsThroughput, e.Key)
+		case e.Key > from:
+			var c int
+			if err := json.Unmarshal(e.Value, &c); err == nil {
+				n += c
+			}
+		}
+	}
+	if rate := float64(n) / throughputWindow.Minutes(); rate != d.eta.rate {
+		d.eta.rate = rate
+		d.eta.version++
+	}
+	d.eta.read = now
+	return d.eta.rate
+}
+
+// VariantAnalysisHook reports the session's budget and estimates when an
+// in-progress session completes, from its unfinished repositories, the
+// jobs ahead of it and the recent throughput.  Without a recent throughput
+// there is no estimate.
+func (d *Dispatcher) VariantAnalysisHook(va *api.VariantAnalysis) {
+	d.reportBudget(va)
+	if va.Status != api.StatusInProgress {
+		return
+	}
+	p := &api.Progress{}
+	for _, sr := range va.ScannedRepositories {
+		if !api.IsTerminalRepoStatus(sr.AnalysisStatus) {
+			p.Remaining++
+		}
+	}
+	sessions := va.Shards
+	if sessions == nil {
+		sessions = []int{va.ID}
+	}
+	d.eta.mu.Lock()
+	qs := d.eta.stats
+	d.eta.mu.Unlock()
+	ahead, own := -1, 0
+	for _, s := range sessions {
+		if a, ok := qs.ahead[s]; ok && (ahead < 0 || a < ahead) {
+			ahead = a
+		}
+		own += qs.outstanding[s]
+	}
+	// Jobs already published are ahead of every backlog job; those of a
+	// session without backlog jobs are all it waits for.
+	p.QueueDepth = qs.total - own
+	if ahead > 0 {
+		p.QueueDepth += ahead
+	}
+
+	p.ThroughputPerMinute = d.throughput(context.Background())
+	if p.ThroughputPerMinute > 0 {
+		minutes := float64(p.QueueDepth+p.Remaining) / p.ThroughputPerMinute
+		p.EstimatedCompletionAt = time.Now().UTC().Add(time.Duration(minutes * float64(time.Minute))).Format(time.RFC3339)
+	}
+	va.Progress = p
+}
@@ -0,0 +1,68 @@
+package dispatch
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const nsRejected = "rejected-jobs" // job -> rejection
+
+// Gate is a Stager that holds jobs in the backlog until their inputs are
+// cleared, such as databases scanned for malware.
+type Gate interface {
+	// Clear reports whether job may be published now.  It returns an
+	// error for a job whose inputs were rejected, which then fails.  A
+	// *web.Error's kind is its failure code.
+	Clear(job agentproto.Job) (bool, error)
+}
+
+// rejection records a job failed because its inputs were rejected.
+type rejection struct {
+	Code    string    `json:"code"`
+	Message string    `json:"message"`
+	At      time.Time `json:"at"`
+}
+
+// reject drops a job from the backlog and fails it.
+func (d *Dispatcher) reject(ctx context.Context, it item, reason error) error {
+	claimed := false
+	err := d.store.Update(ctx, nsBacklog, it.key, func(old []byte) ([]byte, error) {
+		claimed = old != nil
+		return nil, nil
+	})
+	if err != nil || !claimed {
+		return err
+	}
+	js := it.e.Job.Spec
+	rj := rejection{Code: apierr.InvalidRequest, Message: reason.Error(), At: time.Now().UTC()}
+	var we *web.Error
+	if errors.As(reason, &we) && we.Kind != "" {
+		rj.Code = we.Kind
+	}
+	if err := store.PutJSON(ctx, d.store, nsRejected, jobKey(js), rj); err != nil {
+		d.restore(ctx, it)
+		return err
+	}
+	d.st.SetStatus(js, common.StatusError)
+	slog.Warn("Job rejected before dispatch", "job", js, "code", rj.Code, "reason", rj.Message)
+	return nil
+}
+
+// rejectedTask reports why a rejected job failed.
+func (d *Dispatcher) rejectedTask(js common.JobSpec, task *api.RepoTask) {
+	var rj rejection
+	if err := store.GetJSON(context.Background(), d.store, nsRejected, jobKey(js), &rj); err != nil {
+		return
+	}
+	task.FailureCode = rj.Code
+	task.FailureMessage = rj.Message
+}
@@ -0,0 +1,128 @@
+package dispatch
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/web"
+)
+
+type sessionStatus struct {
+	Session         string     `json:"session"`
+	Paused          bool       `json:"paused"`
+	MaxConcurrency  int        `json:"max_concurrency,omitempty"`
+	ExecutionWindow string     `json:"execution_window,omitempty"`
+	WindowOpensAt   *time.Time `json:"window_opens_at,omitempty"`
+	Backlog         int        `json:"backlog"`
+	Outstanding     int        `json:"outstanding"`
+}
+
+// Register adds the session pause and resume endpoints and the session
+// concurrency cap.  Pausing stops publishing the session's remaining jobs;
+// jobs already with agents finish.  PUT /variant-analyses/{id}/concurrency
+// with {"max_concurrency": 5} changes a session's cap; 0 removes it,
+// leaving the configured one.  PUT /variant-analyses/{id}/window with
+// {"execution_window": "20:00-06:00"} changes when it runs; "" lets it
+// run at any time.
+func (d *Dispatcher) Register(r *mux.Router) {
+	r.HandleFunc("/variant-analyses/{id}/pause", d.pause).Methods(http.MethodPost)
+	r.HandleFunc("/variant-analyses/{id}/resume", d.resume).Methods(http.MethodPost)
+	r.HandleFunc("/variant-analyses/{id}/concurrency", d.putConcurrency).Methods(http.MethodPut)
+	r.HandleFunc("/variant-analyses/{id}/window", d.putWindow).Methods(http.MethodPut)
+}
+
+// RegisterAdmin adds the cluster's drain toggle, /admin/drain.  Draining
+// stops publishing the jobs of every session; GET reports drained once
+// none are left with agents.
+func (d *Dispatcher) RegisterAdmin(r *mux.Router) {
+	r.HandleFunc("/admin/drain", d.getDrain).Methods(http.MethodGet)
+	r.HandleFunc("/admin/drain", d.startDrain).Methods(http.MethodPost)
+	r.HandleFunc("/admin/drain", d.stopDrain).Methods(http.MethodDelete)
+}
+
+func (d *Dispatcher) pause(w http.ResponseWriter, r *http.Request) {
+	d.setPaused(w, r, d.Pause)
+}
+
+func (d *Dispatcher) resume(w http.ResponseWriter, r *http.Request) {
+	d.setPaused(w, r, d.Resume)
+}
+
+func (d *Dispatcher) setPaused(w http.ResponseWriter, r *http.Request, set func(context.Context, int) error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "variant analysis ID is not an integer", http.StatusBadRequest)
+		return
+	}
+	if err := d.exists(r.Context(), id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := set(r.Context(), id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	status, err := d.sessionStatus(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, status)
+}
+
+// exists fails if none of the session's shards has jobs.
+func (d *Dispatcher) exists(ctx context.Context, id int) error {
+	var err error
+	for _, sid := range d.shards.Sessions(ctx, id) {
+		if _, err = d.st.GetJobList(sid); err == nil {
+			return nil
+		}
+	}
+	return err
+}
+
+// sessionStatus reports on the session, counting the jobs of all its
+// shards.
+func (d *Dispatcher) sessionStatus(ctx context.Context, id int) (sessionStatus, error) {
+	name, err := web.SessionName(ctx, id)
+	if err != nil {
+		return sessionStatus{}, err
+	}
+	s := sessionStatus{Session: name}
+	shards := d.shards.Sessions(ctx, id)
+	for _, sid := range shards {
+		outs, err := d.store.List(ctx, nsDispatched, strconv.Itoa(sid)+"/")
+		if err != nil {
+			return s, err
+		}
+		s.Outstanding += len(outs)
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.backlog == nil {
+		if err := d.load(ctx); err != nil {
+			return s, err
+		}
+	}
+	s.Paused = d.paused[id]
+	var window *Window
+	_, s.MaxConcurrency, window = d.limitsOf(id)
+	if window != nil {
+		s.ExecutionWindow = window.String()
+		if now := time.Now(); !window.Open(now) {
+			opens := window.Opens(now)
+			s.WindowOpensAt = &opens
+		}
+	}
+	for _, it := range d.backlog {
+		if slices.Contains(shards, it.e.Job.Spec.SessionID) {
+			s.Backlog++
+		}
+	}
+	return s, nil
+}
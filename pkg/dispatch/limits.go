@@ -0,0 +1,350 @@
+package dispatch
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const nsLimits = "session-limits" // session -> Limits
+
+// Limits restrain when a session's jobs are published: at most
+// MaxConcurrency of them outstanding at once, only inside Window, and
+// while Budget lasts.  The shards of a split submission share their
+// limits; Group is the first of them.
+type Limits struct {
+	Session        int       `json:"session"`
+	Group          int       `json:"group"`
+	MaxConcurrency int       `json:"max_concurrency,omitempty"`
+	Window         *Window   `json:"window,omitempty"`
+	Budget         *Budget   `json:"budget,omitempty"`
+	Since          time.Time `json:"since"`
+}
+
+// Window is a daily execution window in UTC.  One that ends before it
+// starts, such as 20:00-06:00, spans midnight.
+type Window struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	from, to int // minutes after midnight
+}
+
+// ParseWindow parses a window written HH:MM-HH:MM.
+func ParseWindow(s string) (*Window, error) {
+	from, to, ok := strings.Cut(s, "-")
+	if !ok {
+		return nil, fmt.Errorf("missing '-'")
+	}
+	w := &Window{From: strings.TrimSpace(from), To: strings.TrimSpace(to)}
+	if err := w.parse(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *Window) parse() error {
+	var err error
+	if w.from, err = minuteOfDay(w.From); err != nil {
+		return err
+	}
+	if w.to, err = minuteOfDay(w.To); err != nil {
+		return err
+	}
+	if w.from == w.to {
+		return fmt.Errorf("the window is empty")
+	}
+	return nil
+}
+
+func minuteOfDay(s string) (int, error) {
+	t, err := time.Parse("15:04", s)
+	if err != nil {
+		return 0, fmt.Errorf("%q is not HH:MM", s)
+	}
+	return t.Hour()*60 + t.Minute(), nil
+}
+
+func (w *Window) String() string { return w.From + "-" + w.To }
+
+func (w *Window) UnmarshalJSON(data []byte) error {
+	type plain Window
+	if err := json.Unmarshal(data, (*plain)(w)); err != nil {
+		return err
+	}
+	return w.parse()
+}
+
+// Open reports whether t falls inside the window.
+func (w *Window) Open(t time.Time) bool {
+	t = t.UTC()
+	m := t.Hour()*60 + t.Minute()
+	if w.from < w.to {
+		return w.from <= m && m < w.to
+	}
+	return m >= w.from || m < w.to
+}
+
+// Opens returns when the window next opens after t, or t if it is open.
+func (w *Window) Opens(t time.Time) time.Time {
+	if w.Open(t) {
+		return t
+	}
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	next := day.Add(time.Duration(w.from) * time.Minute)
+	if !next.After(t) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// limitsOf returns the session whose outstanding jobs count against a
+// session's cap, the cap itself (the session's, or the policy's if lower)
+// and the session's window.
+func (d *Dispatcher) limitsOf(session int) (group, max int, window *Window) {
+	l, ok := d.limits[session]
+	if !ok {
+		return session, d.cfg.MaxPerSession, nil
+	}
+	max = l.MaxConcurrency
+	if policy := d.cfg.MaxPerSession; policy > 0 && (max == 0 || max > policy) {
+		max = policy
+	}
+	return l.Group, max, l.Window
+}
+
+// held reports whether the session's jobs are held back, whatever their
+// pool.  The caller holds d.mu.
+func (d *Dispatcher) held(session int, now time.Time) bool {
+	if d.drain != nil || d.paused[session] {
+		return true
+	}
+	_, _, window := d.limitsOf(session)
+	return window != nil && !window.Open(now)
+}
+
+// recordLimits records the limits a submission's sessions share.  The
+// caller holds d.mu.
+func (d *Dispatcher) recordLimits(ctx context.Context, sessions []int, l Limits) error {
+	l.Group, l.Since = sessions[0], time.Now().UTC()
+	for _, id := range sessions {
+		l.Session = id
+		if err := store.PutJSON(ctx, d.store, nsLimits, strconv.Itoa(id), l); err != nil {
+			return err
+		}
+		d.versions.Touch(ctx, id)
+		if d.limits != nil {
+			d.limits[id] = l
+		}
+	}
+	return nil
+}
+
+// SubmitHook takes the "max_concurrency" field, the most repositories of
+// the submission to analyze at once, the "execution_window" field, such as
+// "20:00-06:00", the time of day in UTC to analyze them in, and the
+// "budget" field, such as {"jobs": 500, "cpu_hours": 20}.  Once the
+// commander has created the sessions it records their limits, and whether
+// the submitter's gradual-dispatch flag exempts them from the window, and
+// releases their jobs.
+func (d *Dispatcher) SubmitHook(r *http.Request, sub *gateway.Submission) error {
+	var l Limits
+	if _, err := sub.TakeExtra("max_concurrency", &l.MaxConcurrency); err != nil {
+		return err
+	}
+	if l.MaxConcurrency < 0 {
+		return web.Msg(http.StatusBadRequest, "", "dispatch.invalid_concurrency", nil)
+	}
+	var window string
+	if _, err := sub.TakeExtra("execution_window", &window); err != nil {
+		return err
+	}
+	if window != "" {
+		w, err := ParseWindow(window)
+		if err != nil {
+			return web.Msg(http.StatusBadRequest, "", "dispatch.invalid_window",
+				messages.Params{"window": window, "error": err})
+		}
+		l.Window = w
+	}
+	if _, err := sub.TakeExtra("budget", &l.Budget); err != nil {
+		return err
+	}
+	if l.Budget != nil && (l.Budget.Jobs < 0 || l.Budget.CPUHours < 0) {
+		return web.Msg(http.StatusBadRequest, "", "dispatch.invalid_budget", nil)
+	}
+	if l.Budget.empty() {
+		l.Budget = nil
+	}
+	limited := l.MaxConcurrency > 0 || l.Window != nil || l.Budget != nil
+	unwindowed := d.cfg.Window > 0 && d.flags != nil && !d.flags.On(r, gradualDispatch)
+	sub.After(func() {
+		sessions := sub.Sessions()
+		if len(sessions) == 0 {
+			return
+		}
+		ctx := context.Background()
+		d.mu.Lock()
+		if limited {
+			if err := d.recordLimits(ctx, sessions, l); err != nil {
+				slog.Warn("Failed to record session limits", "session", sessions[0], "error", err)
+			}
+		}
+		if unwindowed {
+			if err := d.recordUnwindowed(ctx, sessions); err != nil {
+				slog.Warn("Failed to record unwindowed sessions", "session", sessions[0], "error", err)
+			}
+		}
+		d.settle(ctx, sessions)
+		d.mu.Unlock()
+		d.Kick()
+	})
+	return nil
+}
+
+// recordUnwindowed records that the jobs of sessions are published
+// regardless of the window.  The caller holds d.mu.
+func (d *Dispatcher) recordUnwindowed(ctx context.Context, sessions []int) error {
+	now := time.Now().UTC()
+	for _, id := range sessions {
+		if err := store.PutJSON(ctx, d.store, nsUnwindowed, strconv.Itoa(id), unwindowedSession{Session: id, Since: now}); err != nil {
+			return err
+		}
+		if d.unwindowed != nil {
+			d.unwindowed[id] = true
+		}
+	}
+	return nil
+}
+
+// updateLimits applies f to the limits of a session, its shards and the
+// sessions sharing them.
+func (d *Dispatcher) updateLimits(ctx context.Context, session int, f func(*Limits)) error {
+	ids := d.shards.Sessions(ctx, session)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.backlog == nil {
+		if err := d.load(ctx); err != nil {
+			return err
+		}
+	}
+	group := session
+	if l, ok := d.limits[session]; ok {
+		group = l.Group
+	}
+	for id, l := range d.limits {
+		if l.Group == group && !slices.Contains(ids, id) {
+			ids = append(ids, id)
+		}
+	}
+	now := time.Now().UTC()
+	for _, id := range ids {
+		l, ok := d.limits[id]
+		if !ok {
+			l = Limits{Session: id, Group: group}
+		}
+		f(&l)
+		l.Since = now
+		if err := store.PutJSON(ctx, d.store, nsLimits, strconv.Itoa(id), l); err != nil {
+			return err
+		}
+		d.versions.Touch(ctx, id)
+		d.limits[id] = l
+	}
+	d.Kick()
+	return nil
+}
+
+// SetConcurrency changes the cap of a session and the sessions sharing
+// it; 0 leaves only the policy's.
+func (d *Dispatcher) SetConcurrency(ctx context.Context, session, max int) error {
+	return d.updateLimits(ctx, session, func(l *Limits) { l.MaxConcurrency = max })
+}
+
+// SetWindow changes the execution window of a session and the sessions
+// sharing it; nil lets them run at any time.
+func (d *Dispatcher) SetWindow(ctx context.Context, session int, w *Window) error {
+	return d.updateLimits(ctx, session, func(l *Limits) { l.Window = w })
+}
+
+func (d *Dispatcher) putConcurrency(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		MaxConcurrency *int `json:"max_concurrency"`
+	}
+	err := json.NewDecoder(r.Body).Decode(&body)
+	if err != nil || body.MaxConcurrency == nil || *body.MaxConcurrency < 0 {
+		web.Fail(w, web.Msg(http.StatusBadRequest, "", "dispatch.invalid_concurrency", nil), http.StatusBadRequest)
+		return
+	}
+	d.setLimits(w, r, func(ctx context.Context, id int) error {
+		return d.SetConcurrency(ctx, id, *body.MaxConcurrency)
+	})
+}
+
+func (d *Dispatcher) putWindow(w http.ResponseWriter, r *http.Request) {
+	var body struct {
+		ExecutionWindow *string `json:"execution_window"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.ExecutionWindow == nil {
+		web.Fail(w, web.Msg(http.StatusBadRequest, "", "dispatch.missing_window", nil), http.StatusBadRequest)
+		return
+	}
+	var window *Window
+	if *body.ExecutionWindow != "" {
+		var err error
+		if window, err = ParseWindow(*body.ExecutionWindow); err != nil {
+			web.Fail(w, web.Msg(http.StatusBadRequest, "", "dispatch.invalid_window",
+				messages.Params{"window": *body.ExecutionWindow, "error": err}), http.StatusBadRequest)
+			return
+		}
+	}
+	d.setLimits(w, r, func(ctx context.Context, id int) error {
+		return d.SetWindow(ctx, id, window)
+	})
+}
+
+func (d *Dispatcher) setLimits(w http.ResponseWriter, r *http.Request, set func(context.Context, int) error) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "variant analysis ID is not an integer", http.StatusBadRequest)
+		return
+	}
+	if err := d.exists(r.Context(), id); err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err := set(r.Context(), id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	status, err := d.sessionStatus(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, status)
+}
+
+// outstandingBy counts outstanding jobs by the group their session's cap
+// counts them in.
+func (d *Dispatcher) outstandingBy(out []outstanding) map[int]int {
+	counts := make(map[int]int)
+	for _, o := range out {
+		g, _, _ := d.limitsOf(o.Spec.SessionID)
+		counts[g]++
+	}
+	return counts
+}
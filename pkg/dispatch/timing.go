@@ -0,0 +1,123 @@
+package dispatch
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/store"
+)
+
+const (
+	nsTimings   = "job-timings"
+	nsDurations = "job-durations" // language -> meanDuration
+)
+
+// durationWeight bounds the weight of old jobs in a language's mean
+// duration: it follows roughly the last durationWeight jobs.
+const durationWeight = 100
+
+const anyLanguage = "*"
+
+// meanDuration is the running mean time agents took over a language's
+// recent jobs.  The key anyLanguage is every language's.
+type meanDuration struct {
+	Jobs    int     `json:"jobs"`
+	Seconds float64 `json:"seconds"`
+}
+
+// Timing is when a job was added, published and finished.  Its duration is
+// from being published to its result.
+type Timing struct {
+	Queued    time.Time `json:"queued,omitempty"`
+	Published time.Time `json:"published"`
+	Finished  time.Time `json:"finished"`
+}
+
+func (t Timing) Duration() time.Duration {
+	return t.Finished.Sub(t.Published)
+}
+
+// recordTiming keeps the times of a job that has had its result, before
+// its outstanding entry goes.  Jobs the dispatcher did not publish, with
+// queues other than rabbitmq, were published as their session was
+// created.
+func (d *Dispatcher) recordTiming(js common.JobSpec) {
+	ctx := context.Background()
+	t := Timing{Finished: time.Now().UTC()}
+	var o outstanding
+	if err := store.GetJSON(ctx, d.store, nsDispatched, jobKey(js), &o); err == nil {
+		t.Queued, t.Published = o.Queued, o.Published
+	} else if ji, err := d.st.GetJobInfo(js); err == nil {
+		if t.Published, err = time.Parse(time.RFC3339, ji.CreatedAt); err != nil {
+			return
+		}
+		t.Queued = t.Published
+	} else {
+		return
+	}
+	if err := store.PutJSON(ctx, d.store, nsTimings, jobKey(js), t); err != nil {
+		slog.Warn("Failed to record job timing", "job", js, "error", err)
+	}
+	d.countFinished(ctx, t.Finished)
+	if ji, err := d.st.GetJobInfo(js); err == nil {
+		d.recordDuration(ctx, ji.QueryLanguage, t.Duration().Seconds())
+	}
+}
+
+// recordDuration adds a finished job to its language's mean duration and
+// to every language's.
+func (d *Dispatcher) recordDuration(ctx context.Context, language string, seconds float64) {
+	keys := []string{anyLanguage}
+	if language != "" && language != anyLanguage {
+		keys = append(keys, language)
+	}
+	for _, key := range keys {
+		err := store.UpdateJSON(ctx, d.store, nsDurations, key, func(m *meanDuration, _ bool) error {
+			m.Jobs = min(m.Jobs+1, durationWeight)
+			m.Seconds += (seconds - m.Seconds) / float64(m.Jobs)
+			return nil
+		})
+		if err != nil {
+			slog.Warn("Failed to record job duration", "language", key, "error", err)
+		}
+	}
+}
+
+// JobSeconds returns the mean time agents took over recent jobs in
+// language, or over recent jobs in any language if there were none, or 0.
+func (d *Dispatcher) JobSeconds(language string) float64 {
+	for _, key := range []string{language, anyLanguage} {
+		var m meanDuration
+		if err := store.GetJSON(context.Background(), d.store, nsDurations, key, &m); err == nil && m.Jobs > 0 {
+			return m.Seconds
+		}
+	}
+	return 0
+}
+
+// Timing returns the times of a finished job.
+func (d *Dispatcher) Timing(ctx context.Context, js common.JobSpec) (Timing, error) {
+	var t Timing
+	err := store.GetJSON(ctx, d.store, nsTimings, jobKey(js), &t)
+	return t, err
+}
+
+// RepoTaskHook reports how long a finished job took, jobs skipped over
+// their session's budget, and jobs rejected before dispatch.
+func (d *Dispatcher) RepoTaskHook(js common.JobSpec, task *api.RepoTask) {
+	switch task.AnalysisStatus {
+	case api.RepoStatusPending:
+		d.budgetTask(js, task)
+	case api.RepoStatusFailed:
+		d.rejectedTask(js, task)
+	}
+	if !api.IsTerminalRepoStatus(task.AnalysisStatus) {
+		return
+	}
+	if t, err := d.Timing(context.Background(), js); err == nil {
+		task.DurationSeconds = t.Duration().Seconds()
+	}
+}
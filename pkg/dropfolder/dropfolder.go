@@ -0,0 +1,243 @@
+// Package dropfolder submits variant analyses deposited as files, for
+// batch pipelines that cannot call the HTTP API.  A pipeline writes a
+// session spec, NAME.json, to the drop folder: a directory, or a prefix of
+// a bucket in the artifact store.  The spec is a submission body, as
+// POSTed to /repositories/0/code-scanning/codeql/variant-analyses, whose
+// query pack is either inline, base64 in query_pack, or a tarball next to
+// the spec named by query_pack_file, which must be written first and
+// serves that spec alone.
+//
+// Each pass submits the specs found through the gateway, so that quotas
+// and the submit hooks apply as to any submission, then moves each spec
+// and its pack to done/ or failed/ with NAME.result.json beside them,
+// holding the new session's ID or the error.  Specs refused for reasons
+// that may pass, such as the server draining, stay for the next pass.
+package dropfolder
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/store"
+)
+
+// nsSubmitted records the specs submitted but not yet moved to done/, so
+// that a spec is not submitted twice if the server stops in between.
+const nsSubmitted = "drop-folder" // name/spec sha256 -> Result
+
+const (
+	doneDir   = "done/"
+	failedDir = "failed/"
+
+	resultSuffix = ".result.json"
+
+	// client is the identity submissions are made under.
+	client = "drop-folder"
+)
+
+var submissions = metrics.NewCounterVec("mrvaserver_drop_folder_submissions_total",
+	"Session specs picked up from the drop folder, by result.", "result")
+
+// Result is a spec's outcome, written as NAME.result.json.
+type Result struct {
+	Spec    string    `json:"spec"`
+	Session int       `json:"session,omitempty"`
+	Status  int       `json:"status"`
+	Error   string    `json:"error,omitempty"`
+	At      time.Time `json:"at"`
+}
+
+type Folder struct {
+	src    source
+	meta   store.Store
+	submit http.Handler
+}
+
+// New watches cfg.Dir, or cfg.Prefix of cfg.Bucket through mc.
+func New(cfg config.DropFolder, mc *minio.Client, meta store.Store) *Folder {
+	var src source = dirSource{dir: cfg.Dir}
+	if cfg.Bucket != "" {
+		src = bucketSource{mc: mc, bucket: cfg.Bucket, prefix: cfg.Prefix}
+	}
+	return &Folder{src: src, meta: meta}
+}
+
+// SetSubmitter submits specs through h, the gateway.
+func (f *Folder) SetSubmitter(h http.Handler) {
+	f.submit = h
+}
+
+// Scan submits the specs in the drop folder.  It is a background task.
+func (f *Folder) Scan(ctx context.Context) error {
+	names, err := f.src.List(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to list drop folder %s: %w", f.src, err)
+	}
+	for _, name := range names {
+		if path.Ext(name) != ".json" || strings.HasSuffix(name, resultSuffix) {
+			continue
+		}
+		if err := f.process(ctx, name); err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			slog.Warn("Failed to process drop folder spec, will retry", "spec", name, "error", err)
+		}
+	}
+	return nil
+}
+
+// process submits spec name and moves it away, unless the error returned
+// may pass.
+func (f *Folder) process(ctx context.Context, name string) error {
+	data, err := f.src.Read(ctx, name)
+	if errors.Is(err, errMissing) {
+		return nil // taken by another pass
+	}
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	key := name + "/" + hex.EncodeToString(sum[:])
+
+	res := Result{Spec: name, At: time.Now().UTC()}
+	var pack string
+	if err := store.GetJSON(ctx, f.meta, nsSubmitted, key, &res); err == nil {
+		slog.Info("Drop folder spec already submitted", "spec", name, "session", res.Session)
+	} else if !errors.Is(err, store.ErrNotFound) {
+		return err
+	} else {
+		var body []byte
+		body, pack, err = f.body(ctx, data)
+		if err != nil {
+			res.Status, res.Error = http.StatusBadRequest, err.Error()
+		} else {
+			res.Status, res.Session, res.Error = f.post(ctx, body)
+			if res.Status >= 500 || res.Status == http.StatusTooManyRequests {
+				return fmt.Errorf("submission refused with %d: %s", res.Status, res.Error)
+			}
+		}
+		if res.Session != 0 {
+			if err := store.PutJSON(ctx, f.meta, nsSubmitted, key, res); err != nil {
+				return err
+			}
+		}
+	}
+	if pack == "" {
+		_, pack, _ = f.body(ctx, data)
+	}
+	return f.finish(ctx, key, name, pack, res)
+}
+
+// body is the submission body of spec data, with its query pack file, if
+// any, inlined.  pack names that file.
+func (f *Folder) body(ctx context.Context, data []byte) (body []byte, pack string, err error) {
+	var spec map[string]json.RawMessage
+	if err := json.Unmarshal(data, &spec); err != nil {
+		return nil, "", fmt.Errorf("invalid session spec: %w", err)
+	}
+	raw, ok := spec["query_pack_file"]
+	if !ok {
+		return data, "", nil
+	}
+	if err := json.Unmarshal(raw, &pack); err != nil || pack == "" || strings.Contains(pack, "/") {
+		return nil, "", fmt.Errorf("query_pack_file must name a file beside the spec")
+	}
+	delete(spec, "query_pack_file")
+	tgz, err := f.src.Read(ctx, pack)
+	if errors.Is(err, errMissing) {
+		return nil, pack, fmt.Errorf("query pack %s is not in the drop folder", pack)
+	}
+	if err != nil {
+		return nil, pack, err
+	}
+	spec["query_pack"], _ = json.Marshal(base64.StdEncoding.EncodeToString(tgz))
+	body, err = json.Marshal(spec)
+	return body, pack, err
+}
+
+// post submits body and returns the response's status and the new
+// session, or the error message.
+func (f *Folder) post(ctx context.Context, body []byte) (int, int, string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/repositories/0/code-scanning/codeql/variant-analyses",
+		bytes.NewReader(body))
+	if err != nil {
+		return http.StatusInternalServerError, 0, err.Error()
+	}
+	req.RequestURI = req.URL.RequestURI()
+	req.RemoteAddr = client
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	rec := httptest.NewRecorder()
+	f.submit.ServeHTTP(rec, req)
+	if rec.Code < 200 || rec.Code >= 300 {
+		return rec.Code, 0, submitError(rec.Body.Bytes())
+	}
+	var resp struct {
+		ID int `json:"id"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.ID == 0 {
+		return http.StatusBadGateway, 0, fmt.Sprintf("unexpected submission response: %s", rec.Body.Bytes())
+	}
+	return rec.Code, resp.ID, ""
+}
+
+// submitError is the message of the error response to a submission.
+func submitError(body []byte) string {
+	var b apierr.Body
+	if json.Unmarshal(body, &b) == nil && b.Message != "" {
+		return b.Message
+	}
+	return string(bytes.TrimSpace(body))
+}
+
+// finish writes res beside spec name and moves both, and pack, to done/
+// or failed/.
+func (f *Folder) finish(ctx context.Context, key, name, pack string, res Result) error {
+	dir, outcome := doneDir, "submitted"
+	if res.Session == 0 {
+		dir, outcome = failedDir, "failed"
+	}
+	data, err := json.MarshalIndent(res, "", "  ")
+	if err != nil {
+		return err
+	}
+	base := strings.TrimSuffix(name, ".json")
+	if err := f.src.Write(ctx, dir+base+resultSuffix, append(data, '\n')); err != nil {
+		return fmt.Errorf("failed to write result: %w", err)
+	}
+	if pack != "" {
+		if err := f.src.Move(ctx, pack, dir+pack); err != nil {
+			slog.Warn("Failed to move query pack out of the drop folder", "pack", pack, "error", err)
+		}
+	}
+	if err := f.src.Move(ctx, name, dir+name); err != nil {
+		return fmt.Errorf("failed to move spec: %w", err)
+	}
+	if res.Session != 0 {
+		if err := f.meta.Delete(ctx, nsSubmitted, key); err != nil {
+			slog.Warn("Failed to clear drop folder submission record", "spec", name, "error", err)
+		}
+	}
+	submissions.With(outcome).Inc()
+	slog.Info("Drop folder spec processed", "spec", name, "outcome", outcome, "session", res.Session,
+		"status", res.Status, "error", res.Error)
+	return nil
+}
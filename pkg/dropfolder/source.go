@@ -0,0 +1,134 @@
+package dropfolder
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// source is where specs are deposited: a directory or a bucket prefix.
+// Names are relative to it and use slashes.
+type source interface {
+	// List returns the names of the files deposited at the top level.
+	List(ctx context.Context) ([]string, error)
+	Read(ctx context.Context, name string) ([]byte, error)
+	Write(ctx context.Context, name string, data []byte) error
+	// Move renames a file, replacing any at to.
+	Move(ctx context.Context, from, to string) error
+	String() string
+}
+
+// errMissing is returned by Read for a file that is not there.
+var errMissing = errors.New("no such file in the drop folder")
+
+type dirSource struct {
+	dir string
+}
+
+func (s dirSource) String() string { return s.dir }
+
+func (s dirSource) List(ctx context.Context) ([]string, error) {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return nil, err
+	}
+	var names []string
+	for _, e := range entries {
+		if e.Type().IsRegular() {
+			names = append(names, e.Name())
+		}
+	}
+	return names, nil
+}
+
+func (s dirSource) Read(ctx context.Context, name string) ([]byte, error) {
+	data, err := os.ReadFile(filepath.Join(s.dir, filepath.FromSlash(name)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, errMissing
+	}
+	return data, err
+}
+
+func (s dirSource) Write(ctx context.Context, name string, data []byte) error {
+	p := filepath.Join(s.dir, filepath.FromSlash(name))
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(p, data, 0o644)
+}
+
+func (s dirSource) Move(ctx context.Context, from, to string) error {
+	dst := filepath.Join(s.dir, filepath.FromSlash(to))
+	if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+		return err
+	}
+	return os.Rename(filepath.Join(s.dir, filepath.FromSlash(from)), dst)
+}
+
+type bucketSource struct {
+	mc     *minio.Client
+	bucket string
+	prefix string
+}
+
+func (s bucketSource) String() string { return s.bucket + "/" + s.prefix }
+
+func (s bucketSource) List(ctx context.Context) ([]string, error) {
+	var names []string
+	for obj := range s.mc.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: s.prefix}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+		// Without Recursive, "directories" are listed with a trailing slash.
+		if name := strings.TrimPrefix(obj.Key, s.prefix); name != "" && !strings.HasSuffix(name, "/") {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names, nil
+}
+
+func (s bucketSource) Read(ctx context.Context, name string) ([]byte, error) {
+	obj, err := s.mc.GetObject(ctx, s.bucket, s.prefix+name, minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	data, err := io.ReadAll(obj)
+	if minio.ToErrorResponse(err).Code == "NoSuchKey" {
+		return nil, errMissing
+	}
+	return data, err
+}
+
+func (s bucketSource) Write(ctx context.Context, name string, data []byte) error {
+	_, err := s.mc.PutObject(ctx, s.bucket, s.prefix+name, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: contentType(name)})
+	return err
+}
+
+func (s bucketSource) Move(ctx context.Context, from, to string) error {
+	_, err := s.mc.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: s.bucket, Object: s.prefix + to},
+		minio.CopySrcOptions{Bucket: s.bucket, Object: s.prefix + from})
+	if err != nil {
+		return err
+	}
+	return s.mc.RemoveObject(ctx, s.bucket, s.prefix+from, minio.RemoveObjectOptions{})
+}
+
+func contentType(name string) string {
+	if path.Ext(name) == ".json" {
+		return "application/json"
+	}
+	return "application/octet-stream"
+}
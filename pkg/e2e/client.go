@@ -0,0 +1,153 @@
+// Package e2e makes the VS Code extension's requests of a server: it
+// submits variant analyses, follows their status and downloads their
+// results.  Its tests, built with the integration tag, run one analysis
+// end to end, from submission through dispatch and results to the
+// downloads, on a stack of Postgres, RabbitMQ and MinIO containers with a
+// fake agent:
+//
+//	go test -tags integration ./pkg/e2e
+//
+// They need Docker, or another container runtime testcontainers supports.
+package e2e
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/api"
+)
+
+// Client makes the extension's requests for one controller repository.
+type Client struct {
+	HTTP           *http.Client
+	BaseURL        string
+	ControllerRepo string
+}
+
+func NewClient(baseURL, controllerRepo string) *Client {
+	return &Client{
+		HTTP:           &http.Client{Timeout: 30 * time.Second},
+		BaseURL:        strings.TrimSuffix(baseURL, "/"),
+		ControllerRepo: controllerRepo,
+	}
+}
+
+func (c *Client) sessionURL(id int) string {
+	return fmt.Sprintf("%s/repos/%s/code-scanning/codeql/variant-analyses/%d", c.BaseURL, c.ControllerRepo, id)
+}
+
+// Submit submits a variant analysis of repos with the query pack, a
+// gzipped tar, and returns its session ID.
+func (c *Client) Submit(language string, repos []string, pack []byte) (int, error) {
+	body, err := json.Marshal(common.SubmitMsg{
+		ActionRepoRef: "main",
+		Language:      language,
+		QueryPack:     base64.StdEncoding.EncodeToString(pack),
+		Repositories:  repos,
+	})
+	if err != nil {
+		return 0, err
+	}
+	url := fmt.Sprintf("%s/repos/%s/code-scanning/codeql/variant-analyses", c.BaseURL, c.ControllerRepo)
+	resp, err := c.HTTP.Post(url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return 0, fmt.Errorf("POST %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, fmt.Errorf("POST %s: %w", url, err)
+	}
+	if resp.StatusCode != http.StatusOK && resp.StatusCode != http.StatusCreated {
+		return 0, fmt.Errorf("POST %s: status %d: %s", url, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	var va struct {
+		ID int `json:"id"`
+	}
+	if err := json.Unmarshal(data, &va); err != nil || va.ID == 0 {
+		return 0, fmt.Errorf("POST %s: no session ID in response: %s", url, strings.TrimSpace(string(data)))
+	}
+	return va.ID, nil
+}
+
+// Status fetches the session's status.
+func (c *Client) Status(id int) (api.VariantAnalysis, error) {
+	var va api.VariantAnalysis
+	return va, c.getJSON(c.sessionURL(id), &va)
+}
+
+// Download fetches a repository's task in the session, then its results
+// artifact.
+func (c *Client) Download(id int, repo string) ([]byte, error) {
+	var task api.RepoTask
+	if err := c.getJSON(c.sessionURL(id)+"/repos/"+repo, &task); err != nil {
+		return nil, err
+	}
+	if task.ArtifactURL == "" {
+		return nil, fmt.Errorf("%s has no artifact (%s)", repo, task.AnalysisStatus)
+	}
+	resp, err := c.HTTP.Get(task.ArtifactURL)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %w", task.ArtifactURL, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %w", task.ArtifactURL, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: status %d", task.ArtifactURL, resp.StatusCode)
+	}
+	return data, nil
+}
+
+func (c *Client) getJSON(url string, v any) error {
+	resp, err := c.HTTP.Get(url)
+	if err != nil {
+		return fmt.Errorf("GET %s: %w", url, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		data, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("GET %s: status %d: %s", url, resp.StatusCode, strings.TrimSpace(string(data)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(v); err != nil {
+		return fmt.Errorf("GET %s: %w", url, err)
+	}
+	return nil
+}
+
+// MinimalPack is a query pack with one trivial query.
+func MinimalPack(language string) ([]byte, error) {
+	files := []struct{ name, body string }{
+		{"qlpack.yml", fmt.Sprintf("name: mrva/e2e\nversion: 0.0.1\ndependencies:\n  codeql/%s-all: \"*\"\n", language)},
+		{"e2e.ql", "/**\n * @kind problem\n * @id mrva/e2e\n */\nselect \"e2e\", \"e2e\"\n"},
+	}
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	tw := tar.NewWriter(gz)
+	for _, f := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: f.name, Mode: 0o644, Size: int64(len(f.body))}); err != nil {
+			return nil, fmt.Errorf("failed to write query pack: %w", err)
+		}
+		if _, err := tw.Write([]byte(f.body)); err != nil {
+			return nil, fmt.Errorf("failed to write query pack: %w", err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write query pack: %w", err)
+	}
+	if err := gz.Close(); err != nil {
+		return nil, fmt.Errorf("failed to write query pack: %w", err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,142 @@
+//go:build integration
+
+package e2e
+
+import (
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/contract"
+)
+
+const (
+	testController = "mrva/controller"
+	testLanguage   = "cpp"
+	testTimeout    = 5 * time.Minute
+	testPoll       = time.Second
+)
+
+var testRepositories = []string{"mrva/alpha", "mrva/beta", "mrva/gamma"}
+
+// TestEndToEnd runs a variant analysis through a stack of Postgres,
+// RabbitMQ and MinIO containers with a fake agent.
+func TestEndToEnd(t *testing.T) {
+	s := startStack(t, testRepositories)
+	analyze(t, NewClient(s.URL, testController), testRepositories, testLanguage, nil, testTimeout)
+}
+
+// TestLive runs a variant analysis through a running stack instead: the
+// devstack mode, or a stack from `deploy generate` with its agents.  It is
+// named by MRVA_E2E_URL and MRVA_E2E_REPOS, a comma-separated list of
+// repositories it has databases for, with MRVA_E2E_CONTROLLER,
+// MRVA_E2E_LANGUAGE and MRVA_E2E_QUERY_PACK, a gzipped tar, if not
+// mrva/controller, cpp and a minimal pack.
+func TestLive(t *testing.T) {
+	url := os.Getenv("MRVA_E2E_URL")
+	if url == "" {
+		t.Skip("MRVA_E2E_URL is not set")
+	}
+	repos := os.Getenv("MRVA_E2E_REPOS")
+	if repos == "" {
+		t.Fatal("MRVA_E2E_REPOS is not set")
+	}
+	controller := os.Getenv("MRVA_E2E_CONTROLLER")
+	if controller == "" {
+		controller = testController
+	}
+	language := os.Getenv("MRVA_E2E_LANGUAGE")
+	if language == "" {
+		language = testLanguage
+	}
+	var pack []byte
+	if name := os.Getenv("MRVA_E2E_QUERY_PACK"); name != "" {
+		var err error
+		if pack, err = os.ReadFile(name); err != nil {
+			t.Fatal(err)
+		}
+	}
+	analyze(t, NewClient(url, controller), strings.Split(repos, ","), language, pack, 10*time.Minute)
+}
+
+// analyze submits an analysis of repos and follows it the way the
+// extension would, from submission through dispatch and results to the
+// downloads, checking every response with package contract.  It stops at
+// the first step that fails.
+func analyze(t *testing.T, c *Client, repos []string, language string, pack []byte, timeout time.Duration) {
+	t.Helper()
+	if pack == nil {
+		var err error
+		if pack, err = MinimalPack(language); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 1. Submission
+	id, err := c.Submit(language, repos, pack)
+	if err != nil {
+		t.Fatalf("submit: %v", err)
+	}
+	t.Logf("submitted session %d", id)
+
+	// 2. Dispatch: every repository has a job
+	va, err := c.Status(id)
+	if err != nil {
+		t.Fatalf("dispatch: %v", err)
+	}
+	scanned := make(map[string]bool)
+	for _, sr := range va.ScannedRepositories {
+		scanned[sr.Repository.FullName] = true
+	}
+	for _, repo := range repos {
+		if !scanned[repo] {
+			t.Errorf("dispatch: %s was not dispatched (no database?)", repo)
+		}
+	}
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	// 3. Results: wait for every repository to finish
+	deadline := time.Now().Add(timeout)
+	for va.Status == api.StatusInProgress {
+		if time.Now().After(deadline) {
+			t.Fatalf("results: session %d still in progress after %s", id, timeout)
+		}
+		time.Sleep(testPoll)
+		if va, err = c.Status(id); err != nil {
+			t.Fatalf("results: %v", err)
+		}
+	}
+	for _, sr := range va.ScannedRepositories {
+		if sr.AnalysisStatus != api.RepoStatusSucceeded {
+			msg := sr.Repository.FullName + ": " + sr.AnalysisStatus
+			if sr.FailureMessage != "" {
+				msg += ": " + sr.FailureMessage
+			}
+			t.Errorf("results: %s", msg)
+		}
+	}
+	if t.Failed() {
+		t.FailNow()
+	}
+
+	// 4. Downloads, with every response checked against the extension's
+	// schema
+	for _, repo := range repos {
+		if _, err := c.Download(id, repo); err != nil {
+			t.Errorf("download: %v", err)
+		}
+	}
+	for _, r := range contract.Check(contract.Target{
+		BaseURL:        c.BaseURL,
+		ControllerRepo: c.ControllerRepo,
+		SessionID:      id,
+	}) {
+		for _, err := range r.Errs {
+			t.Errorf("%s: %v", r.Name, err)
+		}
+	}
+}
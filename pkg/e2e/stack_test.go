@@ -0,0 +1,284 @@
+//go:build integration
+
+package e2e
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/docker/go-connections/nat"
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/qldbstore"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"github.com/testcontainers/testcontainers-go"
+	tcminio "github.com/testcontainers/testcontainers-go/modules/minio"
+	"github.com/testcontainers/testcontainers-go/modules/postgres"
+	"github.com/testcontainers/testcontainers-go/modules/rabbitmq"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/fakeagent"
+	"mrvaserver/pkg/netaddr"
+)
+
+// The images deploy generate runs.
+const (
+	postgresImage = "postgres:16"
+	rabbitmqImage = "rabbitmq:3-management"
+	minioImage    = "minio/minio:RELEASE.2024-06-11T03-13-30Z"
+)
+
+const (
+	stackUser    = "mrva"
+	startTimeout = 2 * time.Minute
+)
+
+// stack is a server in container mode over Postgres, RabbitMQ and MinIO
+// containers, with a fake agent.  MinIO holds both the artifacts and the
+// databases.
+type stack struct {
+	URL   string
+	minio *minio.Client
+}
+
+// startStack starts a stack with databases of repos, all stopped when the
+// test ends.
+func startStack(t *testing.T, repos []string) *stack {
+	t.Helper()
+	ctx := context.Background()
+	password := randomPassword(t)
+
+	pg, err := postgres.Run(ctx, postgresImage,
+		postgres.WithDatabase(stackUser),
+		postgres.WithUsername(stackUser),
+		postgres.WithPassword(password),
+		postgres.BasicWaitStrategies(),
+	)
+	if err != nil {
+		t.Fatalf("failed to start Postgres: %v", err)
+	}
+	terminateLater(t, pg)
+	dsn, err := pg.ConnectionString(ctx, "sslmode=disable")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	mq, err := rabbitmq.Run(ctx, rabbitmqImage,
+		rabbitmq.WithAdminUsername(stackUser),
+		rabbitmq.WithAdminPassword(password),
+	)
+	if err != nil {
+		t.Fatalf("failed to start RabbitMQ: %v", err)
+	}
+	terminateLater(t, mq)
+	mqHost, mqPort := endpoint(t, mq, rabbitmq.DefaultAMQPPort)
+	mgmtHost, mgmtPort := endpoint(t, mq, rabbitmq.DefaultHTTPPort)
+	management := url.URL{Scheme: "http", User: url.UserPassword(stackUser, password),
+		Host: netaddr.JoinHostPort(mgmtHost, mgmtPort)}
+
+	mc, err := tcminio.Run(ctx, minioImage,
+		tcminio.WithUsername(stackUser),
+		tcminio.WithPassword(password),
+	)
+	if err != nil {
+		t.Fatalf("failed to start MinIO: %v", err)
+	}
+	terminateLater(t, mc)
+	minioEndpoint, err := mc.ConnectionString(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &stack{}
+	s.minio, err = minio.New(minioEndpoint, &minio.Options{Creds: credentials.NewStaticV4(stackUser, password, "")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.addDatabases(t, repos)
+
+	port := freePort(t)
+	s.URL = "http://" + netaddr.JoinHostPort("127.0.0.1", port)
+	env := []string{
+		"MRVA_STATE_DSN=" + dsn,
+		"MRVA_STORE_DSN=" + dsn,
+		"MRVA_RABBITMQ_HOST=" + mqHost,
+		"MRVA_RABBITMQ_PORT=" + mqPort,
+		"MRVA_RABBITMQ_USER=" + stackUser,
+		"MRVA_RABBITMQ_PASSWORD=" + password,
+		"MRVA_COMMANDER_PORT=" + freePort(t),
+	}
+	for _, store := range []string{"ARTIFACT", "QLDB"} {
+		env = append(env,
+			store+"_MINIO_ENDPOINT="+minioEndpoint,
+			store+"_MINIO_ID="+stackUser,
+			store+"_MINIO_SECRET="+password,
+		)
+	}
+	config := fmt.Sprintf("state:\n  backend: postgres\nqueue:\n  management_url: %s\n", management.String())
+	startServer(t, config, env, "127.0.0.1:"+port)
+	s.waitReady(t)
+
+	artifacts, err := artifactstore.NewMinIOArtifactStore(minioEndpoint, stackUser, password)
+	if err != nil {
+		t.Fatal(err)
+	}
+	delay, err := fakeagent.ParseDelay("100ms-500ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	agentURL := fmt.Sprintf("amqp://%s:%s@%s/", stackUser, password, netaddr.JoinHostPort(mqHost, mqPort))
+	agentCtx, stop := context.WithCancel(ctx)
+	done := make(chan error, 1)
+	go func() {
+		done <- fakeagent.Run(agentCtx, fakeagent.Options{
+			URL:         agentURL,
+			Name:        "e2e",
+			Pool:        agentproto.DefaultPool,
+			Concurrency: 4,
+			Delay:       delay,
+			MaxResults:  5,
+		}, artifacts)
+	}()
+	t.Cleanup(func() {
+		stop()
+		if err := <-done; err != nil && !errors.Is(err, context.Canceled) {
+			t.Errorf("fake agent: %v", err)
+		}
+	})
+	return s
+}
+
+// addDatabases puts a database of each repository in the database store.
+// The fake agent does not read them, so an empty zip does.
+func (s *stack) addDatabases(t *testing.T, repos []string) {
+	t.Helper()
+	ctx := context.Background()
+	if err := s.minio.MakeBucket(ctx, qldbstore.QL_DB_BUCKETNAME, minio.MakeBucketOptions{}); err != nil {
+		t.Fatalf("failed to create the database bucket: %v", err)
+	}
+	empty := []byte("PK\x05\x06" + strings.Repeat("\x00", 18))
+	for _, repo := range repos {
+		owner, name, _ := strings.Cut(repo, "/")
+		key := fmt.Sprintf("%s$%s.zip", owner, name)
+		_, err := s.minio.PutObject(ctx, qldbstore.QL_DB_BUCKETNAME, key,
+			bytes.NewReader(empty), int64(len(empty)), minio.PutObjectOptions{ContentType: "application/zip"})
+		if err != nil {
+			t.Fatalf("failed to add the database of %s: %v", repo, err)
+		}
+	}
+}
+
+// startServer builds the server and runs it in container mode with the
+// configuration and environment, until the test ends.  Its log is shown
+// if the test fails.
+func startServer(t *testing.T, config string, env []string, listen string) {
+	t.Helper()
+	dir := t.TempDir()
+	bin := filepath.Join(dir, "mrvaserver")
+	build := exec.Command("go", "build", "-o", bin, ".")
+	build.Dir = filepath.Join("..", "..")
+	if out, err := build.CombinedOutput(); err != nil {
+		t.Fatalf("failed to build the server: %v\n%s", err, out)
+	}
+	configFile := filepath.Join(dir, "mrvaserver.yaml")
+	if err := os.WriteFile(configFile, []byte(config), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	logFile, err := os.Create(filepath.Join(dir, "server.log"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cmd := exec.Command(bin, "--mode=container", "--loglevel=info", "--config="+configFile, "--listen="+listen)
+	cmd.Dir = dir
+	cmd.Env = append(os.Environ(), env...)
+	cmd.Stdout = logFile
+	cmd.Stderr = logFile
+	if err := cmd.Start(); err != nil {
+		t.Fatalf("failed to start the server: %v", err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Signal(os.Interrupt)
+		cmd.Wait()
+		logFile.Close()
+		if t.Failed() {
+			data, _ := os.ReadFile(logFile.Name())
+			t.Logf("server log:\n%s", data)
+		}
+	})
+}
+
+// waitReady waits for the server to report itself ready.
+func (s *stack) waitReady(t *testing.T) {
+	t.Helper()
+	deadline := time.Now().Add(startTimeout)
+	for {
+		resp, err := http.Get(s.URL + "/readyz")
+		if err == nil {
+			resp.Body.Close()
+			if resp.StatusCode == http.StatusOK {
+				return
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("server not ready after %s (last: %v)", startTimeout, err)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func terminateLater(t *testing.T, c testcontainers.Container) {
+	t.Helper()
+	t.Cleanup(func() {
+		if err := c.Terminate(context.Background()); err != nil {
+			t.Errorf("failed to stop container: %v", err)
+		}
+	})
+}
+
+// endpoint is the host and mapped port of a container's port.
+func endpoint(t *testing.T, c testcontainers.Container, port nat.Port) (string, string) {
+	t.Helper()
+	ctx := context.Background()
+	host, err := c.Host(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := c.MappedPort(ctx, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return host, p.Port()
+}
+
+func freePort(t *testing.T) string {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port)
+}
+
+func randomPassword(t *testing.T) string {
+	t.Helper()
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatal(err)
+	}
+	return hex.EncodeToString(b)
+}
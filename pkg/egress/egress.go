@@ -0,0 +1,67 @@
+// Package egress routes the server's outbound HTTP calls as configured
+// (see config.Egress): through a proxy, and trusting a custom CA bundle,
+// as enterprise networks that force egress through TLS-intercepting
+// proxies require.  Install sets up http.DefaultTransport, which serves
+// every client without a transport of its own: the commander's HEPC
+// store, the issue trackers and the malware scanning service among them.
+package egress
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+
+	"golang.org/x/net/http/httpproxy"
+	"mrvaserver/pkg/config"
+)
+
+// Install configures http.DefaultTransport from cfg.  It must be called
+// before any client copies the default transport.
+func Install(cfg config.Egress) error {
+	t, ok := http.DefaultTransport.(*http.Transport)
+	if !ok {
+		return fmt.Errorf("default transport is a %T", http.DefaultTransport)
+	}
+	return Configure(t, cfg)
+}
+
+// Configure sets t's proxy and trusted CAs from cfg.
+func Configure(t *http.Transport, cfg config.Egress) error {
+	if cfg.Proxy != "" {
+		pc := httpproxy.Config{HTTPProxy: cfg.Proxy, HTTPSProxy: cfg.Proxy, NoProxy: cfg.NoProxy}
+		proxy := pc.ProxyFunc()
+		t.Proxy = func(r *http.Request) (*url.URL, error) { return proxy(r.URL) }
+		slog.Info("Routing outbound HTTP through proxy", "proxy", redact(cfg.Proxy), "no_proxy", cfg.NoProxy)
+	}
+	if cfg.CABundle != "" {
+		pem, err := os.ReadFile(cfg.CABundle)
+		if err != nil {
+			return fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in CA bundle %s", cfg.CABundle)
+		}
+		if t.TLSClientConfig == nil {
+			t.TLSClientConfig = &tls.Config{}
+		}
+		t.TLSClientConfig.RootCAs = pool
+	}
+	return nil
+}
+
+// redact leaves a proxy URL's password out of the logs.
+func redact(proxy string) string {
+	u, err := url.Parse(proxy)
+	if err != nil {
+		return "(invalid)"
+	}
+	return u.Redacted()
+}
@@ -0,0 +1,435 @@
+// Package encryption seals the results of sessions submitted with a key,
+// so that only the submitter can read them.  A submission's "encryption"
+// field holds either an X25519 public key, whose private key the client
+// keeps, or a 32-byte AES key, which the server keeps with the session:
+//
+//	"encryption": {"public_key": "<base64>"}
+//	"encryption": {"key": "<base64>"}
+//
+// Each result archive is sealed in place as it arrives, before anything
+// records it, and downloads return the sealed bytes; `mrvaserver decrypt`
+// opens them.  Query packs are not sealed, as the agents must read them.
+//
+// The AES keys the server keeps are stored wrapped with the key-encryption
+// key in encryption.kek_file, so the metadata store alone does not open
+// the results.
+//
+// A result can arrive before the gateway has recorded the new session's
+// key: the dispatcher releases a submission's jobs only after the key is
+// recorded, but without it, or should the commander run a job at once,
+// one may be early.  While an encrypted submission is in flight, results
+// for the repositories it names, of sessions without a key, wait for it
+// and are requeued if it takes long, so none is recorded in the clear.
+// Other results are not held back.  Should a session's key fail to be
+// recorded, its results are refused: their archives are deleted and the
+// jobs fail.
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/minio/minio-go/v7"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const (
+	nsKeys    = "session-keys"
+	nsPending = "encryption-pending"
+	nsSealed  = "sealed-results"
+
+	// pendingTTL bounds how long a crashed replica's in-flight
+	// submission holds results back.
+	pendingTTL = 5 * time.Minute
+
+	// pendingWait is how long a result waits for an in-flight submission
+	// before it is requeued.
+	pendingWait = 10 * time.Second
+
+	// sealingSuffix names the object a result archive is sealed into
+	// before it replaces the archive.
+	sealingSuffix = ".sealing"
+)
+
+// ErrPending is returned for a result that may belong to an encrypted
+// submission still in flight.  The queue redelivers it.
+var ErrPending = errors.New("encrypted submission in flight")
+
+// errUnsealable is returned for a result of a session whose key failed to
+// be recorded.
+var errUnsealable = errors.New("the session's encryption key could not be recorded, so its results are not stored")
+
+var sealedTotal = metrics.NewCounter("mrvaserver_results_sealed_total",
+	"Result archives sealed with their session's key.")
+
+type Keys struct {
+	mc       *minio.Client
+	store    store.Store
+	kek      cipher.AEAD
+	versions *gateway.MetadataVersions
+}
+
+// New returns the keys of sessions, kept in s with the AES keys wrapped
+// with the key in cfg.KEKFile, sealing archives in mc.
+func New(cfg config.Encryption, mc *minio.Client, s store.Store) (*Keys, error) {
+	data, err := os.ReadFile(cfg.KEKFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read key-encryption key: %w", err)
+	}
+	b, err := decodeKey(strings.TrimSpace(string(data)))
+	if err != nil || len(b) != 32 {
+		return nil, fmt.Errorf("%s: want a base64 32-byte key-encryption key", cfg.KEKFile)
+	}
+	kek, err := newAEAD(b)
+	if err != nil {
+		return nil, err
+	}
+	return &Keys{mc: mc, store: s, kek: kek}, nil
+}
+
+// SetVersions touches a session in v once its key is recorded.
+func (k *Keys) SetVersions(v *gateway.MetadataVersions) {
+	k.versions = v
+}
+
+// record is a session's key as stored: a public key as given, or an AES
+// key wrapped with the key-encryption key.
+type record struct {
+	PublicKey  string `json:"public_key,omitempty"`
+	WrappedKey string `json:"wrapped_key,omitempty"`
+}
+
+// pending marks an encrypted submission in flight.  Should the keys of
+// some of its sessions fail to be recorded, it is kept, naming them, and
+// no longer expires.
+type pending struct {
+	Started      time.Time `json:"started"`
+	Repositories []string  `json:"repositories"`
+	Unsealable   []int     `json:"unsealable,omitempty"`
+}
+
+// sealedHeader is the header of an archive sealed with a public key, which
+// the server cannot open to check.
+type sealedHeader struct {
+	Session int    `json:"session"`
+	Header  []byte `json:"header"`
+}
+
+// wrapAD binds a wrapped key to its session, so that it does not open as
+// another's.
+func wrapAD(session int) []byte {
+	return []byte("mrvaserver session key " + strconv.Itoa(session))
+}
+
+func (k *Keys) wrap(session int, key Key) (record, error) {
+	if key.PublicKey != "" {
+		return record{PublicKey: key.PublicKey}, nil
+	}
+	aesKey, err := parseAESKey(key.Key)
+	if err != nil {
+		return record{}, err
+	}
+	nonce := make([]byte, k.kek.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return record{}, err
+	}
+	wrapped := k.kek.Seal(nonce, nonce, aesKey, wrapAD(session))
+	return record{WrappedKey: base64.StdEncoding.EncodeToString(wrapped)}, nil
+}
+
+func (k *Keys) unwrap(session int, rec record) (Key, error) {
+	if rec.PublicKey != "" {
+		return Key{PublicKey: rec.PublicKey}, nil
+	}
+	wrapped, err := base64.StdEncoding.DecodeString(rec.WrappedKey)
+	if err != nil || len(wrapped) < k.kek.NonceSize() {
+		return Key{}, fmt.Errorf("session %d has an invalid wrapped key", session)
+	}
+	n := k.kek.NonceSize()
+	aesKey, err := k.kek.Open(nil, wrapped[:n], wrapped[n:], wrapAD(session))
+	if err != nil {
+		return Key{}, fmt.Errorf("failed to unwrap the key of session %d: %w", session, err)
+	}
+	return Key{Key: base64.StdEncoding.EncodeToString(aesKey)}, nil
+}
+
+// SessionKey returns the key session was submitted with, or
+// store.ErrNotFound.
+func (k *Keys) SessionKey(ctx context.Context, session int) (Key, error) {
+	var rec record
+	if err := store.GetJSON(ctx, k.store, nsKeys, strconv.Itoa(session), &rec); err != nil {
+		return Key{}, err
+	}
+	return k.unwrap(session, rec)
+}
+
+// SubmitHook takes the "encryption" field and records the key for the
+// new session.
+func (k *Keys) SubmitHook(r *http.Request, sub *gateway.Submission) error {
+	var key Key
+	found, err := sub.TakeExtra("encryption", &key)
+	if err != nil || !found {
+		return err
+	}
+	if _, err := key.Scheme(); err != nil {
+		return web.Msg(http.StatusBadRequest, "", "encryption.invalid", messages.Params{"error": err})
+	}
+
+	ctx := context.Background()
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return err
+	}
+	marker := hex.EncodeToString(b)
+	p := pending{Started: time.Now(), Repositories: sub.Msg.Repositories}
+	if err := store.PutJSON(ctx, k.store, nsPending, marker, p); err != nil {
+		return fmt.Errorf("failed to record encrypted submission: %w", err)
+	}
+	sub.After(func() {
+		for _, id := range sub.Sessions() {
+			rec, err := k.wrap(id, key)
+			if err == nil {
+				err = store.PutJSON(ctx, k.store, nsKeys, strconv.Itoa(id), rec)
+			}
+			if err != nil {
+				slog.Error("Failed to record session key; its results will be refused", "session", id, "error", err)
+				p.Unsealable = append(p.Unsealable, id)
+				continue
+			}
+			k.versions.Touch(ctx, id)
+			slog.Info("Session results will be sealed", "session", id)
+		}
+		if len(p.Unsealable) > 0 {
+			if err := store.PutJSON(ctx, k.store, nsPending, marker, p); err != nil {
+				slog.Error("Failed to record sessions whose results cannot be sealed", "sessions", p.Unsealable, "error", err)
+			}
+			return
+		}
+		if err := k.store.Delete(ctx, nsPending, marker); err != nil {
+			slog.Warn("Failed to clear encrypted submission marker", "error", err)
+		}
+	})
+	return nil
+}
+
+// Sealed reports whether session's results are sealed, or may be.
+func (k *Keys) Sealed(ctx context.Context, session int) bool {
+	var rec record
+	err := store.GetJSON(ctx, k.store, nsKeys, strconv.Itoa(session), &rec)
+	return !errors.Is(err, store.ErrNotFound)
+}
+
+// VariantAnalysisHook says in a status document whether its results are
+// sealed, and how.
+func (k *Keys) VariantAnalysisHook(va *api.VariantAnalysis) {
+	key, err := k.SessionKey(context.Background(), va.ID)
+	if err != nil {
+		return
+	}
+	va.Encryption = "key"
+	if key.PublicKey != "" {
+		va.Encryption = "public_key"
+	}
+}
+
+// HandleResult seals the results of sessions submitted with a key before
+// they are recorded.
+func (k *Keys) HandleResult(next agentproto.ResultHandler) agentproto.ResultHandler {
+	return func(r agentproto.Result) error {
+		if r.ResultLocation.Key == "" {
+			return next(r)
+		}
+		ctx := context.Background()
+		key, err := k.awaitKey(ctx, r.Spec)
+		if errors.Is(err, store.ErrNotFound) {
+			return next(r)
+		}
+		if errors.Is(err, errUnsealable) {
+			return k.refuse(ctx, r, next)
+		}
+		if err != nil {
+			return err
+		}
+		if err := k.seal(ctx, key, r); err != nil {
+			return fmt.Errorf("failed to seal result: %w", err)
+		}
+		return next(r)
+	}
+}
+
+// refuse fails a result of a session whose key was not recorded, deleting
+// its archive so that it is not kept in the clear.
+func (k *Keys) refuse(ctx context.Context, r agentproto.Result, next agentproto.ResultHandler) error {
+	loc := r.ResultLocation
+	if err := k.mc.RemoveObject(ctx, loc.Bucket, loc.Key, minio.RemoveObjectOptions{}); err != nil {
+		return fmt.Errorf("failed to delete unsealable result: %w", err)
+	}
+	slog.Warn("Refused result of session without a recorded key", "job", r.Spec)
+	r.Status = common.StatusError
+	r.ResultLocation = artifactstore.ArtifactLocation{}
+	r.ResultCount = 0
+	r.FailureMessage = errUnsealable.Error()
+	return next(r)
+}
+
+// awaitKey returns the key of the job's session, waiting while an
+// encrypted submission naming the job's repository is in flight, or
+// errUnsealable for a session whose key failed to be recorded.
+func (k *Keys) awaitKey(ctx context.Context, job common.JobSpec) (Key, error) {
+	deadline := time.Now().Add(pendingWait)
+	for {
+		key, err := k.SessionKey(ctx, job.SessionID)
+		if !errors.Is(err, store.ErrNotFound) {
+			return key, err
+		}
+		pending, err := k.pending(ctx, job)
+		if err != nil {
+			return key, err
+		}
+		if !pending {
+			return key, store.ErrNotFound
+		}
+		if time.Now().After(deadline) {
+			return key, ErrPending
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
+
+// pending reports whether an encrypted submission naming the job's
+// repository is in flight on any replica, or errUnsealable if the job's
+// session is one whose key failed to be recorded.
+func (k *Keys) pending(ctx context.Context, job common.JobSpec) (bool, error) {
+	markers, err := store.ListJSON[pending](ctx, k.store, nsPending, "")
+	if err != nil {
+		return false, err
+	}
+	repo := job.Owner + "/" + job.Repo
+	for _, p := range markers {
+		if slices.Contains(p.Unsealable, job.SessionID) {
+			return false, errUnsealable
+		}
+		if len(p.Unsealable) > 0 || time.Since(p.Started) >= pendingTTL {
+			continue
+		}
+		for _, name := range p.Repositories {
+			if strings.EqualFold(name, repo) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// seal replaces the result archive with its sealed form, streaming it
+// into a temporary object that is then copied over the archive
+// server-side, so neither is held in memory and the archive is not
+// overwritten while it is read.  A redelivered result's archive is sealed
+// already; an archive that only looks sealed is sealed over.
+func (k *Keys) seal(ctx context.Context, key Key, r agentproto.Result) error {
+	loc := r.ResultLocation
+	obj, err := k.mc.GetObject(ctx, loc.Bucket, loc.Key, minio.GetObjectOptions{})
+	if err != nil {
+		return err
+	}
+	defer obj.Close()
+	n := headerSize(SchemePublicKey) + segmentSize + 64
+	br := bufio.NewReaderSize(obj, n)
+	start, err := br.Peek(n)
+	if err != nil && len(start) == 0 {
+		return err
+	}
+	done, err := k.sealedFor(ctx, r.Spec.SessionID, key, loc, start)
+	if err != nil || done {
+		return err
+	}
+	if IsSealed(start) {
+		slog.Warn("Result looks sealed but not with its session's key; sealing it", "job", r.Spec)
+	}
+
+	tmp := loc.Key + sealingSuffix
+	pr, pw := io.Pipe()
+	header := make(chan []byte, 1)
+	go func() {
+		h, err := seal(pw, key, br)
+		header <- h
+		pw.CloseWithError(err)
+	}()
+	_, err = k.mc.PutObject(ctx, loc.Bucket, tmp, pr, -1,
+		minio.PutObjectOptions{ContentType: "application/octet-stream", PartSize: 16 << 20})
+	pr.CloseWithError(err)
+	if err != nil {
+		return err
+	}
+	defer k.mc.RemoveObject(ctx, loc.Bucket, tmp, minio.RemoveObjectOptions{})
+	if key.PublicKey != "" {
+		h := sealedHeader{Session: r.Spec.SessionID, Header: <-header}
+		if err := store.PutJSON(ctx, k.store, nsSealed, sealedKey(loc), h); err != nil {
+			return fmt.Errorf("failed to record sealed header: %w", err)
+		}
+	}
+	_, err = k.mc.ComposeObject(ctx,
+		minio.CopyDestOptions{Bucket: loc.Bucket, Object: loc.Key},
+		minio.CopySrcOptions{Bucket: loc.Bucket, Object: tmp})
+	if err != nil {
+		return err
+	}
+	sealedTotal.Inc()
+	slog.Debug("Result sealed", "job", r.Spec)
+	return nil
+}
+
+// sealedKey is where the header of the archive at loc is recorded.
+func sealedKey(loc artifactstore.ArtifactLocation) string {
+	return loc.Bucket + "/" + loc.Key
+}
+
+// sealedFor reports whether the archive beginning with start is sealed
+// for session with key, as a redelivered result's is.  One sealed with an
+// AES key must open with it; one sealed with a public key, which the
+// server cannot open, must have the header recorded when it was sealed.
+func (k *Keys) sealedFor(ctx context.Context, session int, key Key, loc artifactstore.ArtifactLocation, start []byte) (bool, error) {
+	if !IsSealed(start) {
+		return false, nil
+	}
+	if key.PublicKey == "" {
+		aesKey, err := parseAESKey(key.Key)
+		if err != nil {
+			return false, err
+		}
+		return opensWith(start, aesKey), nil
+	}
+	var h sealedHeader
+	err := store.GetJSON(ctx, k.store, nsSealed, sealedKey(loc), &h)
+	if errors.Is(err, store.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	return h.Session == session && len(h.Header) > 0 && bytes.HasPrefix(start, h.Header), nil
+}
@@ -0,0 +1,420 @@
+package encryption
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// A sealed artifact is
+//
+//	magic "MRVAENC2" | scheme (1 byte) | [ephemeral X25519 public key] | nonce prefix (7) | segments
+//
+// where each segment is up to segmentSize bytes of the artifact sealed
+// with AES-256-GCM, its nonce the prefix, the segment's number (4 bytes,
+// big-endian) and 1 for the last segment or 0 for the others, and
+// everything before the segments as additional data.  The last segment
+// may be empty; a sealed artifact cut short does not open.  For
+// SchemePublicKey the AES key is derived with HKDF-SHA256 from the X25519
+// shared secret, salted with the ephemeral and recipient public keys; for
+// SchemeKey it is the client's key.
+//
+// Artifacts sealed whole, under magicV1 with a 12-byte nonce and no
+// segments, still open.
+const (
+	magic   = "MRVAENC2"
+	magicV1 = "MRVAENC1"
+
+	segmentSize = 64 << 10
+	prefixSize  = 7
+)
+
+const (
+	SchemePublicKey byte = 1
+	SchemeKey       byte = 2
+)
+
+const hkdfInfo = "mrvaserver sealed result v1"
+
+// ErrNotSealed is returned by Open for data that was not sealed.
+var ErrNotSealed = errors.New("not a sealed artifact")
+
+// Key is what a client submits to have its session's results sealed:
+// either an X25519 public key, of which it holds the private key, or a
+// 32-byte AES key the server keeps with the session.  Both are base64.
+type Key struct {
+	PublicKey string `json:"public_key,omitempty"`
+	Key       string `json:"key,omitempty"`
+}
+
+// Scheme returns the key's scheme, checking it.
+func (k Key) Scheme() (byte, error) {
+	switch {
+	case k.PublicKey != "" && k.Key != "":
+		return 0, errors.New("give public_key or key, not both")
+	case k.PublicKey != "":
+		if _, err := parsePublicKey(k.PublicKey); err != nil {
+			return 0, err
+		}
+		return SchemePublicKey, nil
+	case k.Key != "":
+		if _, err := parseAESKey(k.Key); err != nil {
+			return 0, err
+		}
+		return SchemeKey, nil
+	default:
+		return 0, errors.New("public_key or key is required")
+	}
+}
+
+func decodeKey(s string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		b, err = base64.RawURLEncoding.DecodeString(s)
+	}
+	return b, err
+}
+
+func parsePublicKey(s string) (*ecdh.PublicKey, error) {
+	b, err := decodeKey(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public_key: %w", err)
+	}
+	pub, err := ecdh.X25519().NewPublicKey(b)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public_key: %w", err)
+	}
+	return pub, nil
+}
+
+func parseAESKey(s string) ([]byte, error) {
+	b, err := decodeKey(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %w", err)
+	}
+	if len(b) != 32 {
+		return nil, fmt.Errorf("invalid key: must be 32 bytes, not %d", len(b))
+	}
+	return b, nil
+}
+
+// IsSealed reports whether data, or the start of it, is a sealed
+// artifact.
+func IsSealed(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(magic)) || bytes.HasPrefix(data, []byte(magicV1))
+}
+
+// headerSize is the size of the header of an artifact sealed under
+// scheme, before its segments.
+func headerSize(scheme byte) int {
+	if scheme == SchemePublicKey {
+		return len(magic) + 1 + 32 + prefixSize
+	}
+	return len(magic) + 1 + prefixSize
+}
+
+// opensWith reports whether the artifact start begins, its header and
+// first segment, was sealed with the AES key aesKey: whether the segment
+// opens with it.
+func opensWith(start, aesKey []byte) bool {
+	n := headerSize(SchemeKey)
+	if len(start) < n || string(start[:len(magic)]) != magic || start[len(magic)] != SchemeKey {
+		return false
+	}
+	aead, err := newAEAD(aesKey)
+	if err != nil {
+		return false
+	}
+	header, segment := start[:n], start[n:]
+	segment = segment[:min(len(segment), segmentSize+aead.Overhead())]
+	for _, last := range []bool{false, true} {
+		s := &segments{aead: aead, header: header, prefix: header[len(magic)+1:]}
+		nonce, _ := s.nonce(last)
+		if _, err := aead.Open(nil, nonce, segment, header); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// segments seals or opens the segments of one artifact.
+type segments struct {
+	aead   cipher.AEAD
+	header []byte
+	prefix []byte
+	n      uint32
+	done   bool
+}
+
+func (s *segments) nonce(last bool) ([]byte, error) {
+	if s.done {
+		return nil, errors.New("sealed artifact has data past its last segment")
+	}
+	if s.n == math.MaxUint32 {
+		return nil, errors.New("artifact too large to seal")
+	}
+	nonce := make([]byte, s.aead.NonceSize())
+	copy(nonce, s.prefix)
+	binary.BigEndian.PutUint32(nonce[prefixSize:], s.n)
+	if last {
+		nonce[len(nonce)-1] = 1
+	}
+	s.n++
+	s.done = last
+	return nonce, nil
+}
+
+// readSegment reads up to len(buf) bytes of r, reporting whether they are
+// the last.
+func readSegment(r *bufio.Reader, buf []byte) (int, bool, error) {
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, true, nil
+	}
+	if err != nil {
+		return n, false, err
+	}
+	if _, err := r.Peek(1); err == io.EOF {
+		return n, true, nil
+	} else if err != nil {
+		return n, false, err
+	}
+	return n, false, nil
+}
+
+// Seal encrypts src for the holder of k, writing the sealed artifact to
+// dst a segment at a time.
+func Seal(dst io.Writer, k Key, src io.Reader) error {
+	_, err := seal(dst, k, src)
+	return err
+}
+
+// seal is Seal, returning the sealed artifact's header once written.
+func seal(dst io.Writer, k Key, src io.Reader) ([]byte, error) {
+	scheme, err := k.Scheme()
+	if err != nil {
+		return nil, err
+	}
+	header := append([]byte(magic), scheme)
+	var aesKey []byte
+	if scheme == SchemePublicKey {
+		pub, _ := parsePublicKey(k.PublicKey)
+		eph, err := ecdh.X25519().GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := eph.ECDH(pub)
+		if err != nil {
+			return nil, err
+		}
+		header = append(header, eph.PublicKey().Bytes()...)
+		aesKey = deriveKey(shared, eph.PublicKey().Bytes(), pub.Bytes())
+	} else {
+		aesKey, _ = parseAESKey(k.Key)
+	}
+	aead, err := newAEAD(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	prefix := make([]byte, prefixSize)
+	if _, err := rand.Read(prefix); err != nil {
+		return nil, err
+	}
+	header = append(header, prefix...)
+	if _, err := dst.Write(header); err != nil {
+		return nil, err
+	}
+
+	s := &segments{aead: aead, header: header, prefix: prefix}
+	r := bufio.NewReaderSize(src, segmentSize)
+	buf := make([]byte, segmentSize)
+	out := make([]byte, 0, segmentSize+aead.Overhead())
+	for {
+		n, last, err := readSegment(r, buf)
+		if err != nil {
+			return nil, err
+		}
+		nonce, err := s.nonce(last)
+		if err != nil {
+			return nil, err
+		}
+		out = aead.Seal(out[:0], nonce, buf[:n], header)
+		if _, err := dst.Write(out); err != nil {
+			return nil, err
+		}
+		if last {
+			return header, nil
+		}
+	}
+}
+
+// Open decrypts the sealed artifact in src to dst, a segment at a time.
+// secret is the base64 X25519 private key for SchemePublicKey, or the AES
+// key for SchemeKey.  Should the artifact not open, part of it may have
+// been written already.
+func Open(dst io.Writer, secret string, src io.Reader) error {
+	r := bufio.NewReaderSize(src, segmentSize+64)
+	start, _ := r.Peek(len(magic) + 1)
+	if len(start) < len(magic)+1 || !IsSealed(start) {
+		return ErrNotSealed
+	}
+	if string(start[:len(magic)]) == magicV1 {
+		sealed, err := io.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		data, err := openV1(secret, sealed)
+		if err != nil {
+			return err
+		}
+		_, err = dst.Write(data)
+		return err
+	}
+
+	header := make([]byte, len(magic)+1)
+	io.ReadFull(r, header)
+	scheme := header[len(magic)]
+	var eph []byte
+	if scheme == SchemePublicKey {
+		eph = make([]byte, 32)
+		if _, err := io.ReadFull(r, eph); err != nil {
+			return errors.New("sealed artifact is truncated")
+		}
+		header = append(header, eph...)
+	}
+	aesKey, err := openKey(secret, scheme, eph)
+	if err != nil {
+		return err
+	}
+	aead, err := newAEAD(aesKey)
+	if err != nil {
+		return err
+	}
+	prefix := make([]byte, prefixSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return errors.New("sealed artifact is truncated")
+	}
+	header = append(header, prefix...)
+
+	s := &segments{aead: aead, header: header, prefix: prefix}
+	buf := make([]byte, segmentSize+aead.Overhead())
+	out := make([]byte, 0, segmentSize)
+	for {
+		n, last, err := readSegment(r, buf)
+		if err != nil {
+			return err
+		}
+		nonce, err := s.nonce(last)
+		if err != nil {
+			return err
+		}
+		out, err = aead.Open(out[:0], nonce, buf[:n], header)
+		if err != nil {
+			return fmt.Errorf("failed to decrypt: %w", err)
+		}
+		if _, err := dst.Write(out); err != nil {
+			return err
+		}
+		if last {
+			return nil
+		}
+	}
+}
+
+// openKey returns the AES key of an artifact sealed under scheme.
+func openKey(secret string, scheme byte, eph []byte) ([]byte, error) {
+	switch scheme {
+	case SchemePublicKey:
+		b, err := decodeKey(secret)
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key: %w", err)
+		}
+		priv, err := ecdh.X25519().NewPrivateKey(b)
+		if err != nil {
+			return nil, fmt.Errorf("invalid private key: %w", err)
+		}
+		pub, err := ecdh.X25519().NewPublicKey(eph)
+		if err != nil {
+			return nil, err
+		}
+		shared, err := priv.ECDH(pub)
+		if err != nil {
+			return nil, err
+		}
+		return deriveKey(shared, eph, priv.PublicKey().Bytes()), nil
+	case SchemeKey:
+		return parseAESKey(secret)
+	}
+	return nil, fmt.Errorf("unknown sealing scheme %d", scheme)
+}
+
+// openV1 decrypts an artifact sealed whole.
+func openV1(secret string, sealed []byte) ([]byte, error) {
+	rest := sealed[len(magicV1)+1:]
+	scheme := sealed[len(magicV1)]
+	var eph []byte
+	if scheme == SchemePublicKey {
+		if len(rest) < 32 {
+			return nil, errors.New("sealed artifact is truncated")
+		}
+		eph, rest = rest[:32], rest[32:]
+	}
+	aesKey, err := openKey(secret, scheme, eph)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(aesKey)
+	if err != nil {
+		return nil, err
+	}
+	if len(rest) < aead.NonceSize() {
+		return nil, errors.New("sealed artifact is truncated")
+	}
+	headerLen := len(sealed) - len(rest) + aead.NonceSize()
+	nonce := rest[:aead.NonceSize()]
+	data, err := aead.Open(nil, nonce, rest[aead.NonceSize():], sealed[:headerLen])
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt: %w", err)
+	}
+	return data, nil
+}
+
+// GenerateKey returns a new X25519 key pair, base64.
+func GenerateKey() (private, public string, err error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(priv.Bytes()),
+		base64.StdEncoding.EncodeToString(priv.PublicKey().Bytes()), nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// deriveKey is HKDF-SHA256 for a single 32-byte output block.
+func deriveKey(secret, ephPub, recipientPub []byte) []byte {
+	extract := hmac.New(sha256.New, append(append([]byte(nil), ephPub...), recipientPub...))
+	extract.Write(secret)
+	prk := extract.Sum(nil)
+	expand := hmac.New(sha256.New, prk)
+	expand.Write([]byte(hkdfInfo))
+	expand.Write([]byte{1})
+	return expand.Sum(nil)
+}
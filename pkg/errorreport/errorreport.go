@@ -0,0 +1,163 @@
+// Package errorreport sends handler panics and error-level logs, with
+// stack traces and the request they happened in, to a Sentry-compatible
+// project: Sentry itself, GlitchTip or anything else that takes events on
+// the store endpoint.  Events are sent in the background, at most so many
+// a minute; those there is no room or allowance for are counted and
+// dropped.
+package errorreport
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/metrics"
+)
+
+var reportsTotal = metrics.NewCounterVec("mrvaserver_error_reports_total",
+	"Error events by outcome: sent, failed, or dropped for want of room or allowance.", "result")
+
+// Reporter ships events to one project.
+type Reporter struct {
+	cfg      config.Errors
+	endpoint string
+	auth     string
+	scrub    scrubber
+	client   *http.Client
+
+	events chan *event
+	stop   chan struct{}
+	done   chan struct{}
+	once   sync.Once
+
+	mu     sync.Mutex
+	window time.Time
+	sent   int
+}
+
+// New returns a Reporter for the project of cfg's DSN and starts sending.
+func New(cfg config.Errors) (*Reporter, error) {
+	u, err := url.Parse(cfg.DSN)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse error reporting DSN: %w", err)
+	}
+	// https://key@host/prefix/project posts to https://host/prefix/api/project/store/.
+	prefix, project := "", strings.Trim(u.Path, "/")
+	if i := strings.LastIndex(project, "/"); i >= 0 {
+		prefix, project = "/"+project[:i], project[i+1:]
+	}
+	if project == "" || u.User.Username() == "" {
+		return nil, fmt.Errorf("error reporting DSN %q has no key or project", u.Redacted())
+	}
+	r := &Reporter{
+		cfg:      cfg,
+		endpoint: fmt.Sprintf("%s://%s%s/api/%s/store/", u.Scheme, u.Host, prefix, project),
+		auth: fmt.Sprintf("Sentry sentry_version=7, sentry_client=%s, sentry_key=%s",
+			clientName, u.User.Username()),
+		scrub:  scrubber{tokens: cfg.ScrubTokens, repos: cfg.ScrubRepos},
+		client: &http.Client{Timeout: 10 * time.Second},
+		events: make(chan *event, 64),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	if secret, ok := u.User.Password(); ok {
+		r.auth += ", sentry_secret=" + secret
+	}
+	go r.run()
+	return r, nil
+}
+
+const clientName = "mrvaserver/1.0"
+
+// report queues e if this minute's allowance is not spent.
+func (r *Reporter) report(e *event) {
+	r.mu.Lock()
+	now := time.Now()
+	if now.Sub(r.window) >= time.Minute {
+		r.window, r.sent = now, 0
+	}
+	allowed := r.sent < r.cfg.MaxPerMinute
+	if allowed {
+		r.sent++
+	}
+	r.mu.Unlock()
+	if !allowed {
+		reportsTotal.With("dropped").Inc()
+		return
+	}
+	select {
+	case r.events <- e:
+	default:
+		reportsTotal.With("dropped").Inc()
+	}
+}
+
+func (r *Reporter) run() {
+	defer close(r.done)
+	for {
+		select {
+		case e := <-r.events:
+			r.send(e)
+		case <-r.stop:
+			for len(r.events) > 0 {
+				r.send(<-r.events)
+			}
+			return
+		}
+	}
+}
+
+func (r *Reporter) send(e *event) {
+	e.Environment = r.cfg.Environment
+	body, err := json.Marshal(e)
+	if err == nil {
+		err = r.post(body)
+	}
+	if err != nil {
+		// Logging it would be reported in turn.
+		reportsTotal.With("failed").Inc()
+		return
+	}
+	reportsTotal.With("sent").Inc()
+}
+
+func (r *Reporter) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, r.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Sentry-Auth", r.auth)
+	resp, err := r.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("error reporting endpoint answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Close sends the queued events, waiting up to the client timeout for
+// each.  Events reported after it are dropped.
+func (r *Reporter) Close() error {
+	r.once.Do(func() { close(r.stop) })
+	<-r.done
+	return nil
+}
+
+type reportedKey struct{}
+
+// reported marks a context whose error-level logs describe something
+// already reported, so that the log handler does not report it again.
+func reported(ctx context.Context) context.Context {
+	return context.WithValue(ctx, reportedKey{}, true)
+}
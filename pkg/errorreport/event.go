@@ -0,0 +1,134 @@
+package errorreport
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"runtime"
+	"slices"
+	"strings"
+	"time"
+
+	"mrvaserver/pkg/instance"
+)
+
+// event is a Sentry event, as far as the server fills it in.
+type event struct {
+	EventID     string            `json:"event_id"`
+	Timestamp   string            `json:"timestamp"`
+	Platform    string            `json:"platform"`
+	Level       string            `json:"level"`
+	Logger      string            `json:"logger,omitempty"`
+	ServerName  string            `json:"server_name"`
+	Environment string            `json:"environment,omitempty"`
+	Message     *message          `json:"message,omitempty"`
+	Exception   *exceptions       `json:"exception,omitempty"`
+	Request     *request          `json:"request,omitempty"`
+	Tags        map[string]string `json:"tags,omitempty"`
+	Extra       map[string]any    `json:"extra,omitempty"`
+}
+
+type message struct {
+	Formatted string `json:"formatted"`
+}
+
+type exceptions struct {
+	Values []exception `json:"values"`
+}
+
+type exception struct {
+	Type       string      `json:"type"`
+	Value      string      `json:"value"`
+	Stacktrace *stacktrace `json:"stacktrace,omitempty"`
+}
+
+type stacktrace struct {
+	Frames []frame `json:"frames"`
+}
+
+type frame struct {
+	Function string `json:"function"`
+	Module   string `json:"module,omitempty"`
+	Filename string `json:"filename"`
+	AbsPath  string `json:"abs_path"`
+	Lineno   int    `json:"lineno"`
+	InApp    bool   `json:"in_app"`
+}
+
+type request struct {
+	Method      string            `json:"method"`
+	URL         string            `json:"url"`
+	QueryString string            `json:"query_string,omitempty"`
+	Headers     map[string]string `json:"headers,omitempty"`
+	Env         map[string]string `json:"env,omitempty"`
+}
+
+func newEvent(level string, at time.Time) *event {
+	var id [16]byte
+	rand.Read(id[:])
+	return &event{
+		EventID:    hex.EncodeToString(id[:]),
+		Timestamp:  at.UTC().Format(time.RFC3339Nano),
+		Platform:   "go",
+		Level:      level,
+		ServerName: instance.ID(),
+		Tags:       map[string]string{},
+	}
+}
+
+// callers is the stack above skip frames of the caller, outermost first as
+// Sentry expects, leaving out the runtime's and those of the packages that
+// only carry the error to us.
+func callers(skip int) *stacktrace {
+	pcs := make([]uintptr, 64)
+	pcs = pcs[:runtime.Callers(skip+2, pcs)]
+	var st stacktrace
+	frames := runtime.CallersFrames(pcs)
+	for {
+		f, more := frames.Next()
+		if f.Function != "" && !carrier(f.Function) {
+			module, function := splitFunction(f.Function)
+			st.Frames = append(st.Frames, frame{
+				Function: function,
+				Module:   module,
+				Filename: shortFile(f.File),
+				AbsPath:  f.File,
+				Lineno:   f.Line,
+				InApp:    strings.HasPrefix(module, "mrvaserver"),
+			})
+		}
+		if !more {
+			break
+		}
+	}
+	slices.Reverse(st.Frames)
+	return &st
+}
+
+func carrier(function string) bool {
+	for _, p := range []string{"runtime.", "log/slog.", "mrvaserver/pkg/errorreport.", "mrvaserver/pkg/logsink."} {
+		if strings.HasPrefix(function, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// splitFunction splits mrvaserver/pkg/x.(*T).F into its package and the
+// rest.
+func splitFunction(name string) (module, function string) {
+	slash := strings.LastIndex(name, "/")
+	if dot := strings.Index(name[slash+1:], "."); dot >= 0 {
+		return name[:slash+1+dot], name[slash+1+dot+1:]
+	}
+	return "", name
+}
+
+// shortFile keeps the last directory and file name of path.
+func shortFile(path string) string {
+	if i := strings.LastIndex(path, "/"); i > 0 {
+		if j := strings.LastIndex(path[:i], "/"); j >= 0 {
+			return path[j+1:]
+		}
+	}
+	return path
+}
@@ -0,0 +1,159 @@
+package errorreport
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"reflect"
+	"time"
+
+	"mrvaserver/pkg/web"
+)
+
+// Middleware reports panics in the handlers behind it with the request
+// and answers 500 in their place.  http.ErrAbortHandler passes through,
+// as the server expects.
+func (r *Reporter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		req, route := web.WithRouteSlot(req)
+		defer func() {
+			v := recover()
+			if v == nil {
+				return
+			}
+			if v == http.ErrAbortHandler {
+				panic(v)
+			}
+			e := newEvent("fatal", time.Now())
+			e.Exception = &exceptions{Values: []exception{{
+				Type:       panicType(v),
+				Value:      r.scrub.text(fmt.Sprint(v)),
+				Stacktrace: callers(1),
+			}}}
+			e.Request = r.request(req, *route)
+			if *route != "" {
+				e.Tags["route"] = *route
+			}
+			e.Tags["method"] = req.Method
+			r.report(e)
+			slog.ErrorContext(reported(req.Context()), "Handler panicked",
+				"method", req.Method, "path", r.scrub.path(req.URL.Path, *route),
+				"panic", r.scrub.text(fmt.Sprint(v)), "event", e.EventID)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		}()
+		next.ServeHTTP(w, req)
+	})
+}
+
+func panicType(v any) string {
+	if err, ok := v.(error); ok {
+		return reflect.TypeOf(err).String()
+	}
+	return "panic"
+}
+
+// request describes req to the event, scrubbed.
+func (r *Reporter) request(req *http.Request, route string) *request {
+	base := web.ExternalBase(req)
+	out := &request{
+		Method:      req.Method,
+		URL:         base + r.scrub.path(req.URL.Path, route),
+		QueryString: r.scrub.query(req.URL.Query()),
+		Headers:     map[string]string{},
+		Env: map[string]string{
+			"REMOTE_ADDR": web.OriginOf(req).ClientIP,
+			"IDENTITY":    web.Identity(req),
+		},
+	}
+	for k, vs := range req.Header {
+		if v, ok := r.scrub.header(k, vs[0]); ok {
+			out.Headers[k] = v
+		}
+	}
+	return out
+}
+
+// Handler returns a log handler that reports error-level records, with
+// the stack they were logged from and their attributes, scrubbed.  An
+// "error" attribute is the event's exception.
+func (r *Reporter) Handler() slog.Handler {
+	return &logHandler{r: r}
+}
+
+type logHandler struct {
+	r      *Reporter
+	attrs  []slog.Attr
+	prefix string
+}
+
+func (h *logHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= slog.LevelError
+}
+
+func (h *logHandler) Handle(ctx context.Context, rec slog.Record) error {
+	if ctx != nil && ctx.Value(reportedKey{}) != nil {
+		return nil
+	}
+	e := newEvent("error", rec.Time)
+	e.Logger = "slog"
+	e.Message = &message{Formatted: h.r.scrub.text(rec.Message)}
+	e.Extra = map[string]any{}
+	var cause error
+	var add func(string, slog.Attr)
+	add = func(prefix string, a slog.Attr) {
+		v := a.Value.Resolve()
+		if v.Kind() == slog.KindGroup {
+			p := prefix
+			if a.Key != "" {
+				p += a.Key + "."
+			}
+			for _, ga := range v.Group() {
+				add(p, ga)
+			}
+			return
+		}
+		if a.Key == "" {
+			return
+		}
+		if err, ok := v.Any().(error); ok && a.Key == "error" && cause == nil {
+			cause = err
+		}
+		e.Extra[prefix+a.Key] = h.r.scrub.attr(prefix+a.Key, v.String())
+	}
+	for _, a := range h.attrs {
+		add("", a)
+	}
+	rec.Attrs(func(a slog.Attr) bool {
+		add(h.prefix, a)
+		return true
+	})
+	ex := exception{Type: "error", Value: e.Message.Formatted, Stacktrace: callers(1)}
+	if cause != nil {
+		ex.Type, ex.Value = reflect.TypeOf(cause).String(), h.r.scrub.text(cause.Error())
+	}
+	e.Exception = &exceptions{Values: []exception{ex}}
+	h.r.report(e)
+	return nil
+}
+
+func (h *logHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := *h
+	out.attrs = append([]slog.Attr(nil), h.attrs...)
+	for _, a := range attrs {
+		if h.prefix != "" {
+			a = slog.Group(h.prefix[:len(h.prefix)-1], a)
+		}
+		out.attrs = append(out.attrs, a)
+	}
+	return &out
+}
+
+func (h *logHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	out := *h
+	out.prefix = h.prefix + name + "."
+	return &out
+}
@@ -0,0 +1,119 @@
+package errorreport
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const scrubbed = "[scrubbed]"
+
+var (
+	// Credentials as they appear in messages: header values, GitHub
+	// tokens and passwords in URLs.
+	tokenPatterns = []*regexp.Regexp{
+		regexp.MustCompile(`(?i)\b(bearer|token|basic)\s+[A-Za-z0-9._~+/=-]{8,}`),
+		regexp.MustCompile(`\b(gh[opsur]_[A-Za-z0-9]{20,}|github_pat_[A-Za-z0-9_]{20,})\b`),
+		regexp.MustCompile(`(://[^/:@\s]*:)[^@/\s]+@`),
+		regexp.MustCompile(`(?i)\b((?:access_)?token|password|secret|signature|x-amz-signature|x-amz-credential)=[^&\s]+`),
+	}
+	tokenReplacements = []string{"$1 " + scrubbed, scrubbed, "${1}" + scrubbed + "@", "$1=" + scrubbed}
+
+	// Anything shaped like owner/repo that is not part of a longer path.
+	nwoPattern = regexp.MustCompile(`(^|[\s"'(=:,])[A-Za-z0-9][A-Za-z0-9-]*/[A-Za-z0-9._-]+($|[\s"'),.;:])`)
+
+	// /repos/{owner}/{repo} and the like in request paths.
+	repoPathPattern = regexp.MustCompile(`/(repos|repository-stats|telemetry|findings)/[^/]+/[^/]+`)
+)
+
+// Query parameters and headers whose values are always credentials.
+var (
+	secretParams  = []string{"token", "access_token", "password", "secret", "signature", "x-amz-signature", "x-amz-credential"}
+	secretHeaders = []string{"Authorization", "Cookie", "Set-Cookie", "Proxy-Authorization", "X-Api-Key"}
+)
+
+// repoKeys are log attributes that name repositories, or are built from
+// their names; their values are replaced whole.
+var repoKeys = []string{"job", "spec", "repository", "repositories", "repo", "nwo", "owner", "controller", "key", "path", "uri", "artifact", "location"}
+
+type scrubber struct {
+	tokens, repos bool
+}
+
+// text scrubs a message or attribute value.
+func (s scrubber) text(v string) string {
+	if s.tokens {
+		for i, p := range tokenPatterns {
+			v = p.ReplaceAllString(v, tokenReplacements[i])
+		}
+	}
+	if s.repos {
+		v = repoPathPattern.ReplaceAllString(v, "/$1/"+scrubbed)
+		v = nwoPattern.ReplaceAllString(v, "${1}"+scrubbed+"${2}")
+	}
+	return v
+}
+
+// attr scrubs the value of the attribute named key.
+func (s scrubber) attr(key, v string) string {
+	if s.repos && matchKey(repoKeys, key) {
+		return scrubbed
+	}
+	if s.tokens && matchKey(secretParams, key) {
+		return scrubbed
+	}
+	return s.text(v)
+}
+
+// path scrubs a request path; route, the template the request matched,
+// stands for it if known and repositories are scrubbed.
+func (s scrubber) path(path, route string) string {
+	if !s.repos {
+		return path
+	}
+	if route != "" {
+		return route
+	}
+	return repoPathPattern.ReplaceAllString(path, "/$1/"+scrubbed)
+}
+
+// query scrubs a query string.  Values do not survive scrubbing
+// repositories, since any of them could name one.
+func (s scrubber) query(q url.Values) string {
+	if len(q) == 0 {
+		return ""
+	}
+	out := url.Values{}
+	for k, vs := range q {
+		for _, v := range vs {
+			if s.repos || (s.tokens && matchKey(secretParams, k)) {
+				v = scrubbed
+			}
+			out.Add(k, v)
+		}
+	}
+	return out.Encode()
+}
+
+// header reports whether the header named key can be sent and, if so,
+// its scrubbed value.
+func (s scrubber) header(key, v string) (string, bool) {
+	if s.tokens && matchKey(secretHeaders, key) {
+		return "", false
+	}
+	return s.text(v), true
+}
+
+// matchKey reports whether key, the last element of a dotted name, is one
+// of keys.
+func matchKey(keys []string, key string) bool {
+	if i := strings.LastIndex(key, "."); i >= 0 {
+		key = key[i+1:]
+	}
+	for _, k := range keys {
+		if strings.EqualFold(k, key) {
+			return true
+		}
+	}
+	return false
+}
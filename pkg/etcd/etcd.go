@@ -0,0 +1,495 @@
+// Package etcd is a minimal etcd v3 client: the key/value, transaction,
+// lease and watch calls the etcd state, store and locks need, spoken to
+// etcd's JSON gateway over HTTP.  Requests go to the first endpoint that
+// answers, so any member of the cluster can serve them.
+package etcd
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const requestTimeout = 10 * time.Second
+
+// KV is one key with its value and revisions.
+type KV struct {
+	Key            string
+	Value          []byte
+	CreateRevision int64
+	ModRevision    int64
+	Version        int64
+}
+
+type Client struct {
+	endpoints []string
+	http      *http.Client
+	watchHTTP *http.Client
+	username  string
+	password  string
+
+	mutex   sync.Mutex
+	current int
+	token   string
+}
+
+// FromEnv returns a client for MRVA_ETCD_ENDPOINTS, a comma-separated list
+// of member URLs, authenticating as MRVA_ETCD_USERNAME with
+// MRVA_ETCD_PASSWORD if set.  MRVA_ETCD_CA names a PEM file of CAs to trust
+// for https endpoints.
+func FromEnv() (*Client, error) {
+	var endpoints []string
+	for _, e := range strings.Split(os.Getenv("MRVA_ETCD_ENDPOINTS"), ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			endpoints = append(endpoints, strings.TrimSuffix(e, "/"))
+		}
+	}
+	if len(endpoints) == 0 {
+		return nil, fmt.Errorf("missing required environment variable MRVA_ETCD_ENDPOINTS")
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if path := os.Getenv("MRVA_ETCD_CA"); path != "" {
+		ca, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read MRVA_ETCD_CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(ca) {
+			return nil, fmt.Errorf("no certificates in MRVA_ETCD_CA")
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: pool}
+	}
+	c := &Client{
+		endpoints: endpoints,
+		http:      &http.Client{Timeout: requestTimeout, Transport: transport},
+		watchHTTP: &http.Client{Transport: transport},
+		username:  os.Getenv("MRVA_ETCD_USERNAME"),
+		password:  os.Getenv("MRVA_ETCD_PASSWORD"),
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	if _, err := c.Get(ctx, "\x00"); err != nil {
+		return nil, fmt.Errorf("failed to connect to etcd: %w", err)
+	}
+	return c, nil
+}
+
+// int64s decodes the int64 fields of the gateway's responses, which are
+// JSON strings.
+type int64s int64
+
+func (n *int64s) UnmarshalJSON(data []byte) error {
+	s := strings.Trim(string(data), `"`)
+	if s == "" || s == "null" {
+		*n = 0
+		return nil
+	}
+	v, err := strconv.ParseInt(s, 10, 64)
+	*n = int64s(v)
+	return err
+}
+
+type header struct {
+	Revision int64s `json:"revision"`
+}
+
+type kv struct {
+	Key            []byte `json:"key"`
+	Value          []byte `json:"value"`
+	CreateRevision int64s `json:"create_revision"`
+	ModRevision    int64s `json:"mod_revision"`
+	Version        int64s `json:"version"`
+}
+
+func (k kv) kv() KV {
+	return KV{
+		Key:            string(k.Key),
+		Value:          k.Value,
+		CreateRevision: int64(k.CreateRevision),
+		ModRevision:    int64(k.ModRevision),
+		Version:        int64(k.Version),
+	}
+}
+
+type rangeRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+	KeysOnly bool   `json:"keys_only,omitempty"`
+}
+
+type rangeResponse struct {
+	Header header `json:"header"`
+	Kvs    []kv   `json:"kvs"`
+}
+
+type putRequest struct {
+	Key   []byte `json:"key"`
+	Value []byte `json:"value"`
+	Lease int64  `json:"lease,omitempty,string"`
+}
+
+type deleteRequest struct {
+	Key      []byte `json:"key"`
+	RangeEnd []byte `json:"range_end,omitempty"`
+}
+
+// PrefixEnd returns the end of the range of keys starting with prefix.
+func PrefixEnd(prefix string) []byte {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	// All 0xff: the range runs to the end of the keyspace.
+	return []byte{0}
+}
+
+// Get returns key, or nil if it does not exist.
+// Endpoints returns the member URLs.
+func (c *Client) Endpoints() []string {
+	return c.endpoints
+}
+
+// ResetConnections closes the idle connections to the members, so that
+// new ones dial them again.  Open watches keep theirs.
+func (c *Client) ResetConnections() {
+	c.http.CloseIdleConnections()
+	c.watchHTTP.CloseIdleConnections()
+}
+
+func (c *Client) Get(ctx context.Context, key string) (*KV, error) {
+	var resp rangeResponse
+	if err := c.call(ctx, "/v3/kv/range", rangeRequest{Key: []byte(key)}, &resp); err != nil {
+		return nil, err
+	}
+	if len(resp.Kvs) == 0 {
+		return nil, nil
+	}
+	kv := resp.Kvs[0].kv()
+	return &kv, nil
+}
+
+// List returns the keys starting with prefix, ordered by key.  With
+// keysOnly the values are left out.
+func (c *Client) List(ctx context.Context, prefix string, keysOnly bool) ([]KV, error) {
+	var resp rangeResponse
+	req := rangeRequest{Key: []byte(prefix), RangeEnd: PrefixEnd(prefix), KeysOnly: keysOnly}
+	if err := c.call(ctx, "/v3/kv/range", req, &resp); err != nil {
+		return nil, err
+	}
+	kvs := make([]KV, len(resp.Kvs))
+	for i, k := range resp.Kvs {
+		kvs[i] = k.kv()
+	}
+	return kvs, nil
+}
+
+// Put stores value under key, attached to lease if it is not zero.
+func (c *Client) Put(ctx context.Context, key string, value []byte, lease int64) error {
+	return c.call(ctx, "/v3/kv/put", putRequest{Key: []byte(key), Value: value, Lease: lease}, nil)
+}
+
+func (c *Client) Delete(ctx context.Context, key string) error {
+	return c.call(ctx, "/v3/kv/deleterange", deleteRequest{Key: []byte(key)}, nil)
+}
+
+// Compare is a condition of a transaction.
+type Compare struct {
+	Result      string `json:"result"`
+	Target      string `json:"target"`
+	Key         []byte `json:"key"`
+	ModRevision int64  `json:"mod_revision,string"`
+}
+
+// ModRevisionIs holds if key was last written at rev; rev 0 means key does
+// not exist.
+func ModRevisionIs(key string, rev int64) Compare {
+	return Compare{Result: "EQUAL", Target: "MOD", Key: []byte(key), ModRevision: rev}
+}
+
+// Op is a write in a transaction.
+type Op struct {
+	Put    *putRequest    `json:"request_put,omitempty"`
+	Delete *deleteRequest `json:"request_delete_range,omitempty"`
+}
+
+func OpPut(key string, value []byte, lease int64) Op {
+	return Op{Put: &putRequest{Key: []byte(key), Value: value, Lease: lease}}
+}
+
+func OpDelete(key string) Op {
+	return Op{Delete: &deleteRequest{Key: []byte(key)}}
+}
+
+// Txn applies ops atomically if every comparison holds and reports whether
+// they did.
+func (c *Client) Txn(ctx context.Context, cmps []Compare, ops []Op) (bool, error) {
+	req := struct {
+		Compare []Compare `json:"compare"`
+		Success []Op      `json:"success"`
+	}{cmps, ops}
+	var resp struct {
+		Succeeded bool `json:"succeeded"`
+	}
+	if err := c.call(ctx, "/v3/kv/txn", req, &resp); err != nil {
+		return false, err
+	}
+	return resp.Succeeded, nil
+}
+
+// Grant creates a lease expiring after ttl unless kept alive.
+func (c *Client) Grant(ctx context.Context, ttl time.Duration) (int64, error) {
+	req := struct {
+		TTL int64 `json:"TTL,string"`
+	}{int64(ttl.Seconds())}
+	var resp struct {
+		ID int64s `json:"ID"`
+	}
+	if err := c.call(ctx, "/v3/lease/grant", req, &resp); err != nil {
+		return 0, err
+	}
+	return int64(resp.ID), nil
+}
+
+// ErrLeaseExpired is returned by KeepAlive for a lease that has expired.
+var ErrLeaseExpired = errors.New("etcd: lease expired")
+
+// KeepAlive renews a lease.
+func (c *Client) KeepAlive(ctx context.Context, id int64) error {
+	req := struct {
+		ID int64 `json:"ID,string"`
+	}{id}
+	var resp struct {
+		Result struct {
+			TTL int64s `json:"TTL"`
+		} `json:"result"`
+	}
+	if err := c.call(ctx, "/v3/lease/keepalive", req, &resp); err != nil {
+		return err
+	}
+	if resp.Result.TTL <= 0 {
+		return ErrLeaseExpired
+	}
+	return nil
+}
+
+// Revoke ends a lease, deleting the keys attached to it.
+func (c *Client) Revoke(ctx context.Context, id int64) error {
+	req := struct {
+		ID int64 `json:"ID,string"`
+	}{id}
+	return c.call(ctx, "/v3/lease/revoke", req, nil)
+}
+
+// Event is a change seen by Watch.
+type Event struct {
+	Deleted bool
+	KV      KV
+}
+
+// Watch calls fn with the changes to keys starting with prefix after
+// revision rev (0: from now), until ctx ends or the stream fails.  It
+// returns the last revision seen, from which a new watch can resume.
+func (c *Client) Watch(ctx context.Context, prefix string, rev int64, fn func([]Event)) (int64, error) {
+	create := struct {
+		Key           []byte `json:"key"`
+		RangeEnd      []byte `json:"range_end"`
+		StartRevision int64  `json:"start_revision,omitempty,string"`
+	}{Key: []byte(prefix), RangeEnd: PrefixEnd(prefix)}
+	if rev > 0 {
+		create.StartRevision = rev + 1
+	}
+	body, err := json.Marshal(map[string]any{"create_request": create})
+	if err != nil {
+		return rev, err
+	}
+	resp, err := c.post(ctx, c.watchHTTP, "/v3/watch", body)
+	if err != nil {
+		return rev, err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var msg struct {
+			Result struct {
+				Header   header `json:"header"`
+				Canceled bool   `json:"canceled"`
+				Reason   string `json:"cancel_reason"`
+				Events   []struct {
+					Type string `json:"type"`
+					KV   kv     `json:"kv"`
+				} `json:"events"`
+			} `json:"result"`
+			Error *gatewayError `json:"error"`
+		}
+		if err := dec.Decode(&msg); err != nil {
+			if ctx.Err() != nil {
+				return rev, ctx.Err()
+			}
+			return rev, fmt.Errorf("etcd watch stream ended: %w", err)
+		}
+		if msg.Error != nil {
+			return rev, msg.Error
+		}
+		if msg.Result.Canceled {
+			return rev, fmt.Errorf("etcd watch canceled: %s", msg.Result.Reason)
+		}
+		if rev == 0 {
+			// The watch starts at the revision of its creation.
+			rev = int64(msg.Result.Header.Revision)
+		}
+		if len(msg.Result.Events) == 0 {
+			continue
+		}
+		events := make([]Event, len(msg.Result.Events))
+		for i, e := range msg.Result.Events {
+			events[i] = Event{Deleted: e.Type == "DELETE", KV: e.KV.kv()}
+			rev = max(rev, events[i].KV.ModRevision)
+		}
+		fn(events)
+	}
+}
+
+type gatewayError struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+func (e *gatewayError) Error() string {
+	return "etcd: " + e.Message
+}
+
+// call posts req to path and decodes the response into resp, which may be
+// nil.  It re-authenticates once if the token has expired.
+func (c *Client) call(ctx context.Context, path string, req, resp any) error {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return err
+	}
+	for attempt := 0; ; attempt++ {
+		r, err := c.post(ctx, c.http, path, body)
+		if err != nil {
+			return err
+		}
+		data, err := io.ReadAll(r.Body)
+		r.Body.Close()
+		if err != nil {
+			return err
+		}
+		if r.StatusCode != http.StatusOK {
+			var gerr gatewayError
+			if json.Unmarshal(data, &gerr) != nil || gerr.Message == "" {
+				gerr.Message = fmt.Sprintf("%s: %s", r.Status, bytes.TrimSpace(data))
+			}
+			if attempt == 0 && c.username != "" && strings.Contains(gerr.Message, "token") {
+				c.setToken("")
+				continue
+			}
+			return &gerr
+		}
+		if resp == nil {
+			return nil
+		}
+		return json.Unmarshal(data, resp)
+	}
+}
+
+// post sends body to path on the current endpoint, moving on to the next
+// one if it cannot be reached.
+func (c *Client) post(ctx context.Context, client *http.Client, path string, body []byte) (*http.Response, error) {
+	token, err := c.authToken(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for range c.endpoints {
+		c.mutex.Lock()
+		endpoint := c.endpoints[c.current]
+		c.mutex.Unlock()
+
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+path, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if token != "" {
+			req.Header.Set("Authorization", token)
+		}
+		resp, err := client.Do(req)
+		if err == nil {
+			return resp, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		lastErr = err
+		c.mutex.Lock()
+		if c.endpoints[c.current] == endpoint {
+			c.current = (c.current + 1) % len(c.endpoints)
+		}
+		c.mutex.Unlock()
+	}
+	return nil, fmt.Errorf("no etcd endpoint reachable: %w", lastErr)
+}
+
+func (c *Client) setToken(token string) {
+	c.mutex.Lock()
+	c.token = token
+	c.mutex.Unlock()
+}
+
+// authToken returns the token to send, authenticating first if needed.
+func (c *Client) authToken(ctx context.Context) (string, error) {
+	if c.username == "" {
+		return "", nil
+	}
+	c.mutex.Lock()
+	token := c.token
+	c.mutex.Unlock()
+	if token != "" {
+		return token, nil
+	}
+
+	body, err := json.Marshal(map[string]string{"name": c.username, "password": c.password})
+	if err != nil {
+		return "", err
+	}
+	c.mutex.Lock()
+	endpoint := c.endpoints[c.current]
+	c.mutex.Unlock()
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint+"/v3/auth/authenticate", bytes.NewReader(body))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to authenticate to etcd: %w", err)
+	}
+	defer resp.Body.Close()
+	var auth struct {
+		Token string `json:"token"`
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("failed to authenticate to etcd: %s", resp.Status)
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&auth); err != nil {
+		return "", fmt.Errorf("failed to authenticate to etcd: %w", err)
+	}
+	c.setToken(auth.Token)
+	return auth.Token, nil
+}
@@ -0,0 +1,430 @@
+// Package etcdstate implements the commander's state.ServerState in etcd,
+// for Kubernetes-native deployments that want highly available state
+// without running Postgres.  Every session has a version key that each
+// write to the session's jobs touches in the same transaction; its
+// revision is the session version, and a watch on the version keys wakes
+// long-polling status requests when their session changes.
+//
+// Keys, under the configured prefix:
+//
+//	state/next-id                   last allocated session ID
+//	state/sessions/<id>             {"jobs": n}, the number of indexed jobs
+//	state/versions/<id>             touched by every write to the session
+//	state/list/<id>/<index>         the job with that index
+//	state/job/<id>/<owner>/<repo>/  index, info, status and result
+//
+// Session IDs and indexes are zero-padded so keys sort numerically.
+package etcdstate
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"mrvaserver/pkg/etcd"
+)
+
+// maxTxnOps stays under etcd's default --max-txn-ops of 128.
+const maxTxnOps = 120
+
+type session struct {
+	Jobs int `json:"jobs"`
+}
+
+type EtcdState struct {
+	c      *etcd.Client
+	prefix string
+
+	watchOnce sync.Once
+	mutex     sync.Mutex
+	watchers  map[int][]chan struct{}
+}
+
+// New keeps state in etcd under prefix.
+func New(c *etcd.Client, prefix string) *EtcdState {
+	return &EtcdState{c: c, prefix: prefix + "state/", watchers: make(map[int][]chan struct{})}
+}
+
+func (s *EtcdState) nextIDKey() string {
+	return s.prefix + "next-id"
+}
+
+func (s *EtcdState) sessionKey(id int) string {
+	return fmt.Sprintf("%ssessions/%010d", s.prefix, id)
+}
+
+func (s *EtcdState) versionKey(id int) string {
+	return fmt.Sprintf("%sversions/%010d", s.prefix, id)
+}
+
+func (s *EtcdState) listKey(id, index int) string {
+	return fmt.Sprintf("%slist/%010d/%08d", s.prefix, id, index)
+}
+
+func (s *EtcdState) jobKey(js common.JobSpec, field string) string {
+	return fmt.Sprintf("%sjob/%010d/%s/%s/%s", s.prefix, js.SessionID, js.Owner, js.Repo, field)
+}
+
+func (s *EtcdState) touch(id int) etcd.Op {
+	return etcd.OpPut(s.versionKey(id), []byte{}, 0)
+}
+
+func opContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), 10*time.Second)
+}
+
+func (s *EtcdState) NextID() int {
+	c, cancel := opContext()
+	defer cancel()
+	for {
+		kv, err := s.c.Get(c, s.nextIDKey())
+		if err != nil {
+			// The interface has no error return; a zero ID cannot collide
+			// with a real session.
+			slog.Error("Failed to allocate session ID", "error", err)
+			return 0
+		}
+		var last int
+		var rev int64
+		if kv != nil {
+			last, _ = strconv.Atoi(string(kv.Value))
+			rev = kv.ModRevision
+		}
+		id := last + 1
+		ok, err := s.c.Txn(c, []etcd.Compare{etcd.ModRevisionIs(s.nextIDKey(), rev)}, []etcd.Op{
+			etcd.OpPut(s.nextIDKey(), []byte(strconv.Itoa(id)), 0),
+			etcd.OpPut(s.sessionKey(id), []byte(`{"jobs":0}`), 0),
+			s.touch(id),
+		})
+		if err != nil {
+			slog.Error("Failed to allocate session ID", "error", err)
+			return 0
+		}
+		if ok {
+			return id
+		}
+	}
+}
+
+// get decodes the JSON value of key into v and reports whether it exists.
+func (s *EtcdState) get(key string, v any) (bool, error) {
+	c, cancel := opContext()
+	defer cancel()
+	kv, err := s.c.Get(c, key)
+	if err != nil || kv == nil {
+		return false, err
+	}
+	return true, json.Unmarshal(kv.Value, v)
+}
+
+// set stores v as field of js, touching the session.
+func (s *EtcdState) set(js common.JobSpec, field string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("Failed to encode state", "field", field, "job", js, "error", err)
+		return
+	}
+	c, cancel := opContext()
+	defer cancel()
+	_, err = s.c.Txn(c, nil, []etcd.Op{etcd.OpPut(s.jobKey(js, field), data, 0), s.touch(js.SessionID)})
+	if err != nil {
+		slog.Error("Failed to store state", "field", field, "job", js, "error", err)
+	}
+}
+
+func (s *EtcdState) GetResult(js common.JobSpec) (queue.AnalyzeResult, error) {
+	var r queue.AnalyzeResult
+	found, err := s.get(s.jobKey(js, "result"), &r)
+	if err == nil && !found {
+		err = fmt.Errorf("result not found for job spec %v", js)
+	}
+	return r, err
+}
+
+func (s *EtcdState) GetJobSpecByRepoId(sessionId int, jobRepoId int) (common.JobSpec, error) {
+	var job queue.AnalyzeJob
+	found, err := s.get(s.listKey(sessionId, jobRepoId), &job)
+	if err != nil {
+		return common.JobSpec{}, err
+	}
+	if !found {
+		return common.JobSpec{}, fmt.Errorf("job spec not found for job repo id %v", jobRepoId)
+	}
+	return job.Spec, nil
+}
+
+func (s *EtcdState) SetResult(js common.JobSpec, ar queue.AnalyzeResult) {
+	s.set(js, "result", ar)
+}
+
+func (s *EtcdState) GetJobList(sessionId int) ([]queue.AnalyzeJob, error) {
+	var sess session
+	found, err := s.get(s.sessionKey(sessionId), &sess)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("job list not found for session %v", sessionId)
+	}
+
+	c, cancel := opContext()
+	defer cancel()
+	kvs, err := s.c.List(c, fmt.Sprintf("%slist/%010d/", s.prefix, sessionId), false)
+	if err != nil {
+		return nil, err
+	}
+	jobs := make([]queue.AnalyzeJob, 0, len(kvs))
+	for _, kv := range kvs {
+		var job queue.AnalyzeJob
+		if err := json.Unmarshal(kv.Value, &job); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+func (s *EtcdState) GetJobInfo(js common.JobSpec) (common.JobInfo, error) {
+	var ji common.JobInfo
+	found, err := s.get(s.jobKey(js, "info"), &ji)
+	if err == nil && !found {
+		err = fmt.Errorf("info not found for job spec %v", js)
+	}
+	return ji, err
+}
+
+func (s *EtcdState) SetJobInfo(js common.JobSpec, ji common.JobInfo) {
+	s.set(js, "info", ji)
+}
+
+func (s *EtcdState) GetStatus(js common.JobSpec) (common.Status, error) {
+	var status common.Status
+	found, err := s.get(s.jobKey(js, "status"), &status)
+	if err != nil {
+		return common.StatusError, err
+	}
+	if !found {
+		return common.StatusError, fmt.Errorf("status not found for job spec %v", js)
+	}
+	return status, nil
+}
+
+func (s *EtcdState) SetStatus(js common.JobSpec, status common.Status) {
+	s.set(js, "status", status)
+}
+
+// AddJob appends job to its session's list, assigning the next index
+// unless the job already has one.  Concurrent additions to a session
+// conflict on the session key and are retried.
+func (s *EtcdState) AddJob(job queue.AnalyzeJob) {
+	data, err := json.Marshal(job)
+	if err != nil {
+		slog.Error("Failed to encode job", "job", job.Spec, "error", err)
+		return
+	}
+	js := job.Spec
+	c, cancel := opContext()
+	defer cancel()
+	for {
+		ok, err := s.addJob(c, js, data)
+		if err != nil {
+			slog.Error("Failed to add job", "job", js, "error", err)
+			return
+		}
+		if ok {
+			return
+		}
+	}
+}
+
+func (s *EtcdState) addJob(c context.Context, js common.JobSpec, data []byte) (bool, error) {
+	indexKey := s.jobKey(js, "index")
+	if kv, err := s.c.Get(c, indexKey); err != nil {
+		return false, err
+	} else if kv != nil {
+		index, _ := strconv.Atoi(string(kv.Value))
+		return s.c.Txn(c, []etcd.Compare{etcd.ModRevisionIs(indexKey, kv.ModRevision)}, []etcd.Op{
+			etcd.OpPut(s.listKey(js.SessionID, index), data, 0),
+			s.touch(js.SessionID),
+		})
+	}
+
+	var sess session
+	var rev int64
+	kv, err := s.c.Get(c, s.sessionKey(js.SessionID))
+	if err != nil {
+		return false, err
+	}
+	if kv != nil {
+		if err := json.Unmarshal(kv.Value, &sess); err != nil {
+			return false, err
+		}
+		rev = kv.ModRevision
+	}
+	index := sess.Jobs
+	sess.Jobs++
+	sessData, err := json.Marshal(sess)
+	if err != nil {
+		return false, err
+	}
+	return s.c.Txn(c, []etcd.Compare{
+		etcd.ModRevisionIs(s.sessionKey(js.SessionID), rev),
+		etcd.ModRevisionIs(indexKey, 0),
+	}, []etcd.Op{
+		etcd.OpPut(s.sessionKey(js.SessionID), sessData, 0),
+		etcd.OpPut(indexKey, []byte(strconv.Itoa(index)), 0),
+		etcd.OpPut(s.listKey(js.SessionID, index), data, 0),
+		s.touch(js.SessionID),
+	})
+}
+
+// ApplyResults stores the results and their statuses.  A batch is written
+// in as few transactions as etcd's limit on operations allows, each of
+// which is atomic.
+func (s *EtcdState) ApplyResults(results []queue.AnalyzeResult) error {
+	c, cancel := opContext()
+	defer cancel()
+	// etcd refuses a transaction that writes a key twice.
+	var ops []etcd.Op
+	written := make(map[common.JobSpec]bool)
+	touched := make(map[int]bool)
+	flush := func() error {
+		if len(ops) == 0 {
+			return nil
+		}
+		_, err := s.c.Txn(c, nil, ops)
+		ops = nil
+		clear(written)
+		clear(touched)
+		return err
+	}
+	for _, r := range results {
+		data, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		status, err := json.Marshal(r.Status)
+		if err != nil {
+			return err
+		}
+		if len(ops)+3 > maxTxnOps || written[r.Spec] {
+			if err := flush(); err != nil {
+				return err
+			}
+		}
+		ops = append(ops, etcd.OpPut(s.jobKey(r.Spec, "result"), data, 0), etcd.OpPut(s.jobKey(r.Spec, "status"), status, 0))
+		written[r.Spec] = true
+		if !touched[r.Spec.SessionID] {
+			touched[r.Spec.SessionID] = true
+			ops = append(ops, s.touch(r.Spec.SessionID))
+		}
+	}
+	return flush()
+}
+
+// SessionVersion returns a counter that changes with every write to the
+// session's jobs: the revision of its last write.
+func (s *EtcdState) SessionVersion(sessionID int) (int64, error) {
+	c, cancel := opContext()
+	defer cancel()
+	kv, err := s.c.Get(c, s.versionKey(sessionID))
+	if err != nil {
+		return 0, err
+	}
+	if kv == nil {
+		return 0, fmt.Errorf("session %d not found", sessionID)
+	}
+	return kv.ModRevision, nil
+}
+
+// SessionIDs returns the IDs of all sessions, in order.
+func (s *EtcdState) SessionIDs() ([]int, error) {
+	c, cancel := opContext()
+	defer cancel()
+	kvs, err := s.c.List(c, s.prefix+"sessions/", true)
+	if err != nil {
+		return nil, err
+	}
+	ids := make([]int, 0, len(kvs))
+	for _, kv := range kvs {
+		id, err := strconv.Atoi(strings.TrimPrefix(kv.Key, s.prefix+"sessions/"))
+		if err != nil {
+			return nil, fmt.Errorf("unexpected session key %q", kv.Key)
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// WatchSession returns a channel that receives when the session is written
+// to, until ctx ends.  Notifications may be spurious, e.g. after the watch
+// reconnects.
+func (s *EtcdState) WatchSession(ctx context.Context, sessionID int) <-chan struct{} {
+	s.watchOnce.Do(func() { go s.watch() })
+
+	ch := make(chan struct{}, 1)
+	s.mutex.Lock()
+	s.watchers[sessionID] = append(s.watchers[sessionID], ch)
+	s.mutex.Unlock()
+	go func() {
+		<-ctx.Done()
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		chans := s.watchers[sessionID]
+		for i, c := range chans {
+			if c == ch {
+				chans = append(chans[:i], chans[i+1:]...)
+				break
+			}
+		}
+		if len(chans) == 0 {
+			delete(s.watchers, sessionID)
+		} else {
+			s.watchers[sessionID] = chans
+		}
+	}()
+	return ch
+}
+
+// watch follows the version keys for the life of the process.  Every
+// watcher is woken when the watch reconnects, so it need not resume where
+// it left off.
+func (s *EtcdState) watch() {
+	prefix := s.prefix + "versions/"
+	for {
+		_, err := s.c.Watch(context.Background(), prefix, 0, func(events []etcd.Event) {
+			for _, e := range events {
+				if id, err := strconv.Atoi(strings.TrimPrefix(e.KV.Key, prefix)); err == nil {
+					s.notify(id)
+				}
+			}
+		})
+		slog.Warn("State watch interrupted; reconnecting", "error", err)
+		s.notify(-1)
+		time.Sleep(time.Second)
+	}
+}
+
+// notify wakes the watchers of a session, or of every session for -1.
+func (s *EtcdState) notify(sessionID int) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	for id, chans := range s.watchers {
+		if sessionID != -1 && id != sessionID {
+			continue
+		}
+		for _, ch := range chans {
+			select {
+			case ch <- struct{}{}:
+			default:
+			}
+		}
+	}
+}
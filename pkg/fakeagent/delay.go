@@ -0,0 +1,88 @@
+package fakeagent
+
+import (
+	"fmt"
+	"math"
+	"math/rand/v2"
+	"strings"
+	"time"
+)
+
+// Delay is the distribution of the time a fake analysis takes.
+type Delay struct {
+	kind string
+	a, b time.Duration
+}
+
+// ParseDelay reads a delay distribution:
+//
+//	2s           always 2s
+//	1s-5s        uniform between 1s and 5s
+//	exp:2s       exponential with a mean of 2s
+//	normal:2s,1s normal with a mean of 2s and a deviation of 1s, at least 0
+func ParseDelay(s string) (Delay, error) {
+	kind, spec, ok := strings.Cut(s, ":")
+	if !ok {
+		kind, spec = "", s
+	}
+	var err error
+	d := Delay{kind: kind}
+	switch kind {
+	case "":
+		if lo, hi, ok := strings.Cut(spec, "-"); ok {
+			d.kind = "uniform"
+			if d.a, err = time.ParseDuration(lo); err == nil {
+				d.b, err = time.ParseDuration(hi)
+			}
+			if err == nil && d.b < d.a {
+				err = fmt.Errorf("upper bound below lower bound")
+			}
+		} else {
+			d.kind = "constant"
+			d.a, err = time.ParseDuration(spec)
+		}
+	case "exp":
+		d.a, err = time.ParseDuration(spec)
+	case "normal":
+		mean, dev, ok := strings.Cut(spec, ",")
+		if !ok {
+			return d, fmt.Errorf("invalid delay %q: normal needs MEAN,DEVIATION", s)
+		}
+		if d.a, err = time.ParseDuration(mean); err == nil {
+			d.b, err = time.ParseDuration(dev)
+		}
+	default:
+		return d, fmt.Errorf("invalid delay %q: unknown distribution %s", s, kind)
+	}
+	if err != nil {
+		return d, fmt.Errorf("invalid delay %q: %w", s, err)
+	}
+	return d, nil
+}
+
+// Sample draws one delay.
+func (d Delay) Sample() time.Duration {
+	switch d.kind {
+	case "uniform":
+		return d.a + time.Duration(rand.Int64N(int64(d.b-d.a)+1))
+	case "exp":
+		return time.Duration(rand.ExpFloat64() * float64(d.a))
+	case "normal":
+		return time.Duration(math.Max(0, float64(d.a)+rand.NormFloat64()*float64(d.b)))
+	default:
+		return d.a
+	}
+}
+
+func (d Delay) String() string {
+	switch d.kind {
+	case "uniform":
+		return fmt.Sprintf("%s-%s", d.a, d.b)
+	case "exp":
+		return fmt.Sprintf("exp:%s", d.a)
+	case "normal":
+		return fmt.Sprintf("normal:%s,%s", d.a, d.b)
+	default:
+		return d.a.String()
+	}
+}
@@ -0,0 +1,100 @@
+package fakeagent
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"fmt"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+)
+
+// sarifLog is the subset of SARIF 2.1.0 the extension reads from an
+// analysis' results.sarif.
+type sarifLog struct {
+	Schema  string     `json:"$schema"`
+	Version string     `json:"version"`
+	Runs    []sarifRun `json:"runs"`
+}
+
+type sarifRun struct {
+	Tool    sarifTool     `json:"tool"`
+	Results []sarifResult `json:"results"`
+}
+
+type sarifTool struct {
+	Driver struct {
+		Name  string      `json:"name"`
+		Rules []sarifRule `json:"rules"`
+	} `json:"driver"`
+}
+
+type sarifRule struct {
+	ID string `json:"id"`
+}
+
+type sarifResult struct {
+	RuleID    string          `json:"ruleId"`
+	Message   sarifText       `json:"message"`
+	Locations []sarifLocation `json:"locations"`
+}
+
+type sarifText struct {
+	Text string `json:"text"`
+}
+
+type sarifLocation struct {
+	PhysicalLocation struct {
+		ArtifactLocation struct {
+			URI string `json:"uri"`
+		} `json:"artifactLocation"`
+		Region struct {
+			StartLine   int `json:"startLine"`
+			StartColumn int `json:"startColumn"`
+		} `json:"region"`
+	} `json:"physicalLocation"`
+}
+
+const fakeRule = "mrva/fake-result"
+
+// ResultsArchive is a results zip, as the commander's agent uploads it,
+// holding a results.sarif with n results in the job's repository.
+func ResultsArchive(js common.JobSpec, n int) ([]byte, error) {
+	run := sarifRun{Results: make([]sarifResult, 0, n)}
+	run.Tool.Driver.Name = "CodeQL"
+	run.Tool.Driver.Rules = []sarifRule{{ID: fakeRule}}
+	for i := 0; i < n; i++ {
+		r := sarifResult{
+			RuleID:    fakeRule,
+			Message:   sarifText{Text: fmt.Sprintf("Synthetic result %d in %s/%s", i+1, js.Owner, js.Repo)},
+			Locations: make([]sarifLocation, 1),
+		}
+		loc := &r.Locations[0].PhysicalLocation
+		loc.ArtifactLocation.URI = fmt.Sprintf("src/file%d.c", i%10)
+		loc.Region.StartLine = i + 1
+		loc.Region.StartColumn = 1
+		run.Results = append(run.Results, r)
+	}
+	sarif, err := json.Marshal(sarifLog{
+		Schema:  "https://json.schemastore.org/sarif-2.1.0.json",
+		Version: "2.1.0",
+		Runs:    []sarifRun{run},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.Create("results.sarif")
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(sarif); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,275 @@
+package findings
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const (
+	nsBaselines        = "baselines"
+	nsSessionBaselines = "session-baselines"
+	nsBaselineCounts   = "baseline-counts"
+)
+
+var baselineName = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Baseline is a set of known findings, by fingerprint.  The findings of a
+// session that uses a baseline and are in it are suppressed, in the
+// session's listings, its SARIF export and its status counts, leaving the
+// regressions.
+type Baseline struct {
+	Name         string    `json:"name"`
+	Fingerprints []string  `json:"fingerprints"`
+	FromSession  int       `json:"from_session,omitempty"`
+	UpdatedBy    string    `json:"updated_by,omitempty"`
+	UpdatedAt    time.Time `json:"updated_at"`
+}
+
+// baselineCount caches how many of a repository's findings a baseline
+// suppresses, for status documents.
+type baselineCount struct {
+	Baseline   string    `json:"baseline"`
+	Version    time.Time `json:"version"`
+	Suppressed int       `json:"suppressed"`
+}
+
+// PutBaseline creates or replaces a baseline: the given fingerprints or,
+// with fromSession, those of every finding of that session.
+func (s *Service) PutBaseline(ctx context.Context, name string, fingerprints []string, fromSession int, by string) (Baseline, error) {
+	if !baselineName.MatchString(name) {
+		return Baseline{}, web.Msg(http.StatusBadRequest, "", "baseline.invalid_name", nil)
+	}
+	b := Baseline{Name: name, FromSession: fromSession, UpdatedBy: by, UpdatedAt: time.Now().UTC()}
+	switch {
+	case fromSession != 0 && len(fingerprints) > 0:
+		return Baseline{}, web.Msg(http.StatusBadRequest, "", "baseline.exclusive", nil)
+	case fromSession != 0:
+		found, unreadable, err := s.Findings(ctx, fromSession)
+		if err != nil {
+			return Baseline{}, err
+		}
+		if len(unreadable) > 0 {
+			return Baseline{}, web.Msg(http.StatusConflict, "", "baseline.unreadable",
+				messages.Params{"repository": unreadable[0].Repository, "session": web.SessionLabel(ctx, fromSession)})
+		}
+		seen := make(map[string]bool)
+		for _, f := range found {
+			if !seen[f.Fingerprint] {
+				seen[f.Fingerprint] = true
+				b.Fingerprints = append(b.Fingerprints, f.Fingerprint)
+			}
+		}
+	default:
+		for _, fp := range fingerprints {
+			if !validFingerprint(fp) {
+				return Baseline{}, web.Msg(http.StatusBadRequest, "", "baseline.invalid_fingerprint", messages.Params{"fingerprint": fp})
+			}
+		}
+		b.Fingerprints = fingerprints
+	}
+	if b.Fingerprints == nil {
+		b.Fingerprints = []string{}
+	}
+	if err := store.PutJSON(ctx, s.store, nsBaselines, name, b); err != nil {
+		return b, fmt.Errorf("failed to save baseline: %w", err)
+	}
+	s.touchBaseline(ctx, name)
+	slog.Info("Baseline saved", "baseline", name, "fingerprints", len(b.Fingerprints), "client", by)
+	return b, nil
+}
+
+// GetBaseline returns a baseline, or store.ErrNotFound.
+func (s *Service) GetBaseline(ctx context.Context, name string) (Baseline, error) {
+	var b Baseline
+	err := store.GetJSON(ctx, s.store, nsBaselines, name, &b)
+	return b, err
+}
+
+func (s *Service) Baselines(ctx context.Context) ([]Baseline, error) {
+	return store.ListJSON[Baseline](ctx, s.store, nsBaselines, "")
+}
+
+func (s *Service) DeleteBaseline(ctx context.Context, name string) error {
+	if _, err := s.store.Get(ctx, nsBaselines, name); err != nil {
+		return err
+	}
+	if err := s.store.Delete(ctx, nsBaselines, name); err != nil {
+		return err
+	}
+	s.touchBaseline(ctx, name)
+	return nil
+}
+
+// touchBaseline touches the sessions using the named baseline.
+func (s *Service) touchBaseline(ctx context.Context, name string) {
+	if s.versions == nil {
+		return
+	}
+	entries, err := s.store.List(ctx, nsSessionBaselines, "")
+	if err != nil {
+		slog.Warn("Failed to list the sessions of a baseline", "baseline", name, "error", err)
+		return
+	}
+	for _, e := range entries {
+		if string(e.Value) != name {
+			continue
+		}
+		if id, err := strconv.Atoi(e.Key); err == nil {
+			s.versions.Touch(ctx, id)
+		}
+	}
+}
+
+// SetSessionBaseline makes session, and its shards, use the named
+// baseline; "" stops them using one.
+func (s *Service) SetSessionBaseline(ctx context.Context, session int, name string) error {
+	if _, err := s.state.GetJobList(session); err != nil {
+		return web.Msg(http.StatusNotFound, "", "session.not_found", nil)
+	}
+	if name != "" {
+		if _, err := s.GetBaseline(ctx, name); err != nil {
+			return web.Msg(http.StatusNotFound, "", "baseline.unknown", messages.Params{"name": name})
+		}
+	}
+	for _, id := range s.shards.Sessions(ctx, session) {
+		var err error
+		if name == "" {
+			err = s.store.Delete(ctx, nsSessionBaselines, strconv.Itoa(id))
+		} else {
+			err = s.store.Put(ctx, nsSessionBaselines, strconv.Itoa(id), []byte(name))
+		}
+		if err != nil && !errors.Is(err, store.ErrNotFound) {
+			return err
+		}
+		s.versions.Touch(ctx, id)
+	}
+	return nil
+}
+
+// sessionBaseline returns the baseline session uses, if any.
+func (s *Service) sessionBaseline(ctx context.Context, session int) (*Baseline, error) {
+	name, err := s.store.Get(ctx, nsSessionBaselines, strconv.Itoa(session))
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.GetBaseline(ctx, string(name))
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	return &b, err
+}
+
+// sessionSuppressions returns what suppresses findings in session, by
+// fingerprint: suppressions of their own and the session's baseline.
+func (s *Service) sessionSuppressions(ctx context.Context, session int) (map[string]Suppression, error) {
+	out, err := s.suppressions(ctx)
+	if err != nil {
+		return nil, err
+	}
+	b, err := s.sessionBaseline(ctx, session)
+	if err != nil || b == nil {
+		return out, err
+	}
+	for _, fp := range b.Fingerprints {
+		if _, ok := out[fp]; !ok {
+			out[fp] = Suppression{Reason: "in baseline " + b.Name, Baseline: b.Name, SuppressedAt: b.UpdatedAt}
+		}
+	}
+	return out, nil
+}
+
+// SubmitHook takes the "baseline" field, the name of the baseline the new
+// session uses.
+func (s *Service) SubmitHook(r *http.Request, sub *gateway.Submission) error {
+	var name string
+	if _, err := sub.TakeExtra("baseline", &name); err != nil || name == "" {
+		return err
+	}
+	if _, err := s.GetBaseline(r.Context(), name); err != nil {
+		return web.Msg(http.StatusBadRequest, "", "baseline.unknown", messages.Params{"name": name})
+	}
+	sub.After(func() {
+		for _, id := range sub.Sessions() {
+			if err := s.store.Put(context.Background(), nsSessionBaselines, strconv.Itoa(id), []byte(name)); err != nil {
+				slog.Error("Failed to record session baseline", "session", id, "error", err)
+				continue
+			}
+			s.versions.Touch(context.Background(), id)
+		}
+	})
+	return nil
+}
+
+// RepoTaskHook leaves the findings the session's baseline suppresses out
+// of a repository's result count, reporting them as suppressed instead.
+func (s *Service) RepoTaskHook(js common.JobSpec, task *api.RepoTask) {
+	if task.ResultCount == 0 {
+		return
+	}
+	ctx := context.Background()
+	b, err := s.sessionBaseline(ctx, js.SessionID)
+	if err != nil {
+		slog.Warn("Failed to look up session baseline", "session", js.SessionID, "error", err)
+		return
+	}
+	if b == nil {
+		return
+	}
+	n, err := s.baselined(ctx, js, b)
+	if err != nil {
+		slog.Warn("Failed to count baselined findings", "job", js, "error", err)
+		return
+	}
+	task.SuppressedCount = min(n, task.ResultCount)
+	task.ResultCount -= task.SuppressedCount
+}
+
+// baselined counts the job's findings in b, caching the count for the
+// baseline's version.
+func (s *Service) baselined(ctx context.Context, js common.JobSpec, b *Baseline) (int, error) {
+	nwo := js.Owner + "/" + js.Repo
+	key := indexedKey(js.SessionID, nwo)
+	var c baselineCount
+	err := store.GetJSON(ctx, s.store, nsBaselineCounts, key, &c)
+	if err == nil && c.Baseline == b.Name && c.Version.Equal(b.UpdatedAt) {
+		return c.Suppressed, nil
+	}
+	sarif, err := s.sarif(js)
+	if err != nil {
+		return 0, err
+	}
+	found, err := parse(nwo, sarif)
+	if err != nil {
+		return 0, err
+	}
+	in := make(map[string]bool, len(b.Fingerprints))
+	for _, fp := range b.Fingerprints {
+		in[fp] = true
+	}
+	c = baselineCount{Baseline: b.Name, Version: b.UpdatedAt}
+	for _, f := range found {
+		if in[f.Fingerprint] {
+			c.Suppressed++
+		}
+	}
+	if err := store.PutJSON(ctx, s.store, nsBaselineCounts, key, c); err != nil {
+		slog.Warn("Failed to cache baselined count", "job", js, "error", err)
+	}
+	return c.Suppressed, nil
+}
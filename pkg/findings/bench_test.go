@@ -0,0 +1,45 @@
+package findings
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/hohn/mrvacommander/pkg/state"
+	"mrvaserver/pkg/fakeagent"
+	"mrvaserver/pkg/store"
+)
+
+// BenchmarkMergeSARIF builds the SARIF export of a session of 100
+// repositories with 100 results each: every log is read, fingerprinted,
+// annotated and merged into one.
+func BenchmarkMergeSARIF(b *testing.B) {
+	st := state.NewLocalState(0)
+	artifacts := artifactstore.NewInMemoryArtifactStore()
+	session := st.NextID()
+	for i := 0; i < 100; i++ {
+		js := common.JobSpec{SessionID: session, NameWithOwner: common.NameWithOwner{Owner: "owner", Repo: fmt.Sprintf("repo%d", i)}}
+		archive, err := fakeagent.ResultsArchive(js, 100)
+		if err != nil {
+			b.Fatal(err)
+		}
+		loc, err := artifacts.SaveResult(js, archive)
+		if err != nil {
+			b.Fatal(err)
+		}
+		st.AddJob(queue.AnalyzeJob{Spec: js, QueryLanguage: "cpp"})
+		st.SetStatus(js, common.StatusSuccess)
+		st.SetResult(js, queue.AnalyzeResult{Spec: js, Status: common.StatusSuccess, ResultCount: 100, ResultLocation: loc})
+	}
+	s := New(store.NewMemoryStore(), st, artifacts)
+	ctx := context.Background()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, unreadable, err := s.SARIF(ctx, session); err != nil || len(unreadable) > 0 {
+			b.Fatal(err, unreadable)
+		}
+	}
+}
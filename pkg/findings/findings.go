@@ -0,0 +1,375 @@
+// Package findings reads the alerts in a session's SARIF results and lets
+// teams triage them where the results are: each finding can be marked
+// open, false-positive, fixed or won't-fix, assigned and commented on.
+// Triage is kept in the metadata store and merged into the session's SARIF
+// export as the result property "mrva/triage".
+//
+// A finding is named by its repository and its index among the results of
+// that repository's SARIF log.  Its fingerprint -- rule, normalized
+// location and a hash of the line's content -- names it across sessions:
+// every session a fingerprint appears in is recorded, so listings can show
+// only findings new in a session, and a suppression by fingerprint holds
+// in every later run.  A session can also use a baseline, a named set of
+// fingerprints uploaded or taken from an earlier session: the findings in
+// it are suppressed in the session's listings and export, and left out of
+// its result counts, so what remains are the regressions.  Results without
+// a SARIF log, such as those of table queries, and sealed results have no
+// findings.
+package findings
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/state"
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/shard"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const nsTriage = "triage"
+
+const TriageProperty = "mrva/triage"
+
+// Triage states.
+const (
+	StateOpen          = "open"
+	StateFalsePositive = "false-positive"
+	StateFixed         = "fixed"
+	StateWontFix       = "wont-fix"
+)
+
+const maxCommentLen = 16 << 10
+
+type Finding struct {
+	Repository  string  `json:"repository"`
+	Index       int     `json:"index"`
+	Fingerprint string  `json:"fingerprint"`
+	RuleID      string  `json:"rule_id"`
+	Message     string  `json:"message"`
+	Path        string  `json:"path,omitempty"`
+	StartLine   int     `json:"start_line,omitempty"`
+	StartColumn int     `json:"start_column,omitempty"`
+	Triage      *Triage `json:"triage,omitempty"`
+
+	// FirstSession is the first session the finding appeared in; New is
+	// set if that is this one.
+	FirstSession int          `json:"first_session"`
+	New          bool         `json:"new"`
+	Suppression  *Suppression `json:"suppression,omitempty"`
+}
+
+type Triage struct {
+	State     string    `json:"state"`
+	Assignee  string    `json:"assignee,omitempty"`
+	Comment   string    `json:"comment,omitempty"`
+	UpdatedBy string    `json:"updated_by,omitempty"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// TriagePatch changes a finding's triage; fields left out are kept.
+type TriagePatch struct {
+	State    *string `json:"state"`
+	Assignee *string `json:"assignee"`
+	Comment  *string `json:"comment"`
+}
+
+// Unreadable is a repository whose findings could not be read.
+type Unreadable struct {
+	Repository string `json:"repository"`
+	Reason     string `json:"reason"`
+}
+
+type Service struct {
+	store     store.Store
+	state     state.ServerState
+	artifacts artifactstore.Store
+	shards    *shard.Map
+	versions  *gateway.MetadataVersions
+}
+
+func New(s store.Store, st state.ServerState, artifacts artifactstore.Store) *Service {
+	return &Service{store: s, state: st, artifacts: artifacts}
+}
+
+// SetShards has the findings of a split submission listed, triaged and
+// exported under its parent session.  Each finding stays the finding of
+// its repository's shard: sightings and triage are recorded there.
+func (s *Service) SetShards(m *shard.Map) {
+	s.shards = m
+}
+
+// SetVersions touches a session in v whenever its baseline, and with it
+// the suppressed counts of its status, changes.
+func (s *Service) SetVersions(v *gateway.MetadataVersions) {
+	s.versions = v
+}
+
+func triageKey(session int, repository string, index int) string {
+	return fmt.Sprintf("%d/%s/%d", session, repository, index)
+}
+
+func checkState(s string) error {
+	switch s {
+	case StateOpen, StateFalsePositive, StateFixed, StateWontFix:
+		return nil
+	}
+	return web.Msg(http.StatusBadRequest, "", "findings.invalid_state", messages.Params{
+		"state": s, "states": []string{StateOpen, StateFalsePositive, StateFixed, StateWontFix}})
+}
+
+// repoSARIF is one repository's SARIF log, and the session, or shard, the
+// repository was analyzed in.
+type repoSARIF struct {
+	session    int
+	repository string
+	sarif      []byte
+}
+
+// sarifLogs reads the SARIF log of each of the repositories with a result
+// of the session and its shards.
+func (s *Service) sarifLogs(ctx context.Context, session int) ([]repoSARIF, []Unreadable, error) {
+	var logs []repoSARIF
+	var unreadable []Unreadable
+	found := false
+	for _, id := range s.shards.Sessions(ctx, session) {
+		jobs, err := s.state.GetJobList(id)
+		if err != nil {
+			continue
+		}
+		found = true
+		for _, job := range jobs {
+			nwo := job.Spec.Owner + "/" + job.Spec.Repo
+			sarif, err := s.sarif(job.Spec)
+			if errors.Is(err, store.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				unreadable = append(unreadable, Unreadable{Repository: nwo, Reason: err.Error()})
+				continue
+			}
+			logs = append(logs, repoSARIF{id, nwo, sarif})
+		}
+	}
+	if !found {
+		return nil, nil, web.Msg(http.StatusNotFound, "", "session.not_found", nil)
+	}
+	return logs, unreadable, nil
+}
+
+// jobOf returns the job of the session, or of one of its shards, that
+// analyzed repository.
+func (s *Service) jobOf(ctx context.Context, session int, repository string) (common.JobSpec, bool) {
+	for _, id := range s.shards.Sessions(ctx, session) {
+		jobs, err := s.state.GetJobList(id)
+		if err != nil {
+			continue
+		}
+		for _, job := range jobs {
+			if job.Spec.Owner+"/"+job.Spec.Repo == repository {
+				return job.Spec, true
+			}
+		}
+	}
+	return common.JobSpec{}, false
+}
+
+// sarif returns the job's SARIF log, or store.ErrNotFound for a job
+// without a result.
+func (s *Service) sarif(js common.JobSpec) ([]byte, error) {
+	r, err := s.state.GetResult(js)
+	if err != nil || r.ResultLocation.Key == "" {
+		return nil, store.ErrNotFound
+	}
+	archive, err := s.artifacts.GetResult(r.ResultLocation)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read result: %w", err)
+	}
+	return readSARIF(archive)
+}
+
+// triage returns the triage of the findings of the session and its
+// shards, by key.
+func (s *Service) triage(ctx context.Context, session int) (map[string]Triage, error) {
+	out := make(map[string]Triage)
+	for _, id := range s.shards.Sessions(ctx, session) {
+		entries, err := s.store.List(ctx, nsTriage, fmt.Sprintf("%d/", id))
+		if err != nil {
+			return nil, err
+		}
+		for _, e := range entries {
+			var t Triage
+			if err := json.Unmarshal(e.Value, &t); err != nil {
+				return nil, err
+			}
+			out[e.Key] = t
+		}
+	}
+	return out, nil
+}
+
+// Findings returns the session's findings with their triage.
+func (s *Service) Findings(ctx context.Context, session int) ([]Finding, []Unreadable, error) {
+	logs, unreadable, err := s.sarifLogs(ctx, session)
+	if err != nil {
+		return nil, nil, err
+	}
+	triage, err := s.triage(ctx, session)
+	if err != nil {
+		return nil, nil, err
+	}
+	suppressed, err := s.sessionSuppressions(ctx, session)
+	if err != nil {
+		return nil, nil, err
+	}
+	out := []Finding{}
+	for _, l := range logs {
+		found, err := parse(l.repository, l.sarif)
+		if err != nil {
+			unreadable = append(unreadable, Unreadable{Repository: l.repository, Reason: "invalid SARIF: " + err.Error()})
+			continue
+		}
+		if err := s.index(ctx, l.session, l.repository, found); err != nil {
+			slog.Warn("Failed to index findings", "session", l.session, "repository", l.repository, "error", err)
+		}
+		for _, f := range found {
+			if t, ok := triage[triageKey(l.session, f.Repository, f.Index)]; ok {
+				f.Triage = &t
+			}
+			if sp, ok := suppressed[f.Fingerprint]; ok {
+				f.Suppression = &sp
+			}
+			if f.FirstSession, err = s.firstSession(ctx, f.Fingerprint, l.session); err != nil {
+				return nil, nil, err
+			}
+			f.New = f.FirstSession == l.session
+			out = append(out, f)
+		}
+	}
+	return out, unreadable, nil
+}
+
+// SetTriage applies p to a finding's triage.
+func (s *Service) SetTriage(ctx context.Context, session int, repository string, index int, p TriagePatch, by string) (Triage, error) {
+	js, ok := s.jobOf(ctx, session, repository)
+	if !ok {
+		return Triage{}, web.Msg(http.StatusNotFound, "", "findings.no_results",
+			messages.Params{"repository": repository, "session": web.SessionLabel(ctx, session)})
+	}
+	sarif, err := s.sarif(js)
+	if errors.Is(err, store.ErrNotFound) {
+		return Triage{}, web.Msg(http.StatusNotFound, "", "findings.no_results",
+			messages.Params{"repository": repository, "session": web.SessionLabel(ctx, session)})
+	}
+	if err != nil {
+		return Triage{}, web.Msg(http.StatusConflict, "", "findings.unreadable",
+			messages.Params{"repository": repository, "error": err})
+	}
+	found, err := parse(repository, sarif)
+	if err != nil {
+		return Triage{}, web.Msg(http.StatusConflict, "", "findings.unreadable",
+			messages.Params{"repository": repository, "error": err})
+	}
+	if index < 0 || index >= len(found) {
+		return Triage{}, web.Msg(http.StatusNotFound, "", "findings.no_finding",
+			messages.Params{"repository": repository, "index": index})
+	}
+
+	var out Triage
+	err = store.UpdateJSON(ctx, s.store, nsTriage, triageKey(js.SessionID, repository, index), func(t *Triage, found bool) error {
+		if !found {
+			t.State = StateOpen
+		}
+		if p.State != nil {
+			if err := checkState(*p.State); err != nil {
+				return err
+			}
+			t.State = *p.State
+		}
+		if p.Assignee != nil {
+			t.Assignee = *p.Assignee
+		}
+		if p.Comment != nil {
+			if len(*p.Comment) > maxCommentLen {
+				return web.Msg(http.StatusBadRequest, "", "findings.comment_length", messages.Params{"max": maxCommentLen})
+			}
+			t.Comment = *p.Comment
+		}
+		t.UpdatedBy, t.UpdatedAt = by, time.Now().UTC()
+		out = *t
+		return nil
+	})
+	if err == nil {
+		slog.Info("Finding triaged", "session", session, "repository", repository, "index", index,
+			"state", out.State, "client", by)
+	}
+	return out, err
+}
+
+// SARIF returns the session's results as one SARIF log, a run per
+// repository run.  Each result carries its finding's fingerprint, its
+// triage in its properties and its suppression, if any, as an external
+// suppression.
+func (s *Service) SARIF(ctx context.Context, session int) (map[string]any, []Unreadable, error) {
+	logs, unreadable, err := s.sarifLogs(ctx, session)
+	if err != nil {
+		return nil, nil, err
+	}
+	triage, err := s.triage(ctx, session)
+	if err != nil {
+		return nil, nil, err
+	}
+	suppressed, err := s.sessionSuppressions(ctx, session)
+	if err != nil {
+		return nil, nil, err
+	}
+	runs := []any{}
+	for _, l := range logs {
+		found, err := parse(l.repository, l.sarif)
+		if err != nil {
+			unreadable = append(unreadable, Unreadable{Repository: l.repository, Reason: "invalid SARIF: " + err.Error()})
+			continue
+		}
+		rr, err := annotate(l.repository, l.sarif, func(index int, result map[string]any) {
+			if index >= len(found) {
+				return
+			}
+			fp := found[index].Fingerprint
+			set(result, "fingerprints", FingerprintKey, fp)
+			if t, ok := triage[triageKey(l.session, l.repository, index)]; ok {
+				set(result, "properties", TriageProperty, t)
+			}
+			if sp, ok := suppressed[fp]; ok {
+				result["suppressions"] = append(asSlice(result["suppressions"]), map[string]any{
+					"kind":          "external",
+					"status":        "accepted",
+					"justification": sp.Reason,
+				})
+			}
+		})
+		if err != nil {
+			unreadable = append(unreadable, Unreadable{Repository: l.repository, Reason: "invalid SARIF: " + err.Error()})
+			continue
+		}
+		runs = append(runs, rr...)
+	}
+	return map[string]any{
+		"$schema": "https://json.schemastore.org/sarif-2.1.0.json",
+		"version": "2.1.0",
+		"runs":    runs,
+	}, unreadable, nil
+}
+
+func asSlice(v any) []any {
+	s, _ := v.([]any)
+	return s
+}
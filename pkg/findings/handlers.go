@@ -0,0 +1,312 @@
+package findings
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+// Register adds the findings, their history and the SARIF export:
+//
+//	GET    /variant-analyses/{id}/findings?repository=o/r&state=open&new=true&suppressed=false
+//	PATCH  /variant-analyses/{id}/findings/{owner}/{repo}/{index}  {"state": "false-positive", "comment": "..."}
+//	GET    /variant-analyses/{id}/sarif
+//	GET    /findings/{fingerprint}              the sessions it appeared in
+//	PUT    /findings/{fingerprint}/suppression  {"reason": "..."}
+//	DELETE /findings/{fingerprint}/suppression
+//	GET    /baselines
+//	GET    /baselines/{name}
+//	PUT    /baselines/{name}                    {"fingerprints": [...]} or {"from_session": "<ULID>"}
+//	DELETE /baselines/{name}
+//	PUT    /variant-analyses/{id}/baseline      {"baseline": "name"}
+//	DELETE /variant-analyses/{id}/baseline
+func (s *Service) Register(r *mux.Router) {
+	r.HandleFunc("/variant-analyses/{id:[0-9]+}/findings", s.list).Methods(http.MethodGet)
+	r.HandleFunc("/variant-analyses/{id:[0-9]+}/findings/{owner}/{repo}/{index:[0-9]+}", s.patch).Methods(http.MethodPatch)
+	r.HandleFunc("/variant-analyses/{id:[0-9]+}/sarif", s.export).Methods(http.MethodGet)
+	r.HandleFunc("/findings/{fingerprint:[0-9a-f]{32}}", s.history).Methods(http.MethodGet)
+	r.HandleFunc("/findings/{fingerprint:[0-9a-f]{32}}/suppression", s.suppress).Methods(http.MethodPut)
+	r.HandleFunc("/findings/{fingerprint:[0-9a-f]{32}}/suppression", s.unsuppress).Methods(http.MethodDelete)
+	r.HandleFunc("/baselines", s.listBaselines).Methods(http.MethodGet)
+	r.HandleFunc("/baselines/{name}", s.getBaseline).Methods(http.MethodGet)
+	r.HandleFunc("/baselines/{name}", s.putBaseline).Methods(http.MethodPut)
+	r.HandleFunc("/baselines/{name}", s.deleteBaseline).Methods(http.MethodDelete)
+	r.HandleFunc("/variant-analyses/{id:[0-9]+}/baseline", s.useBaseline).Methods(http.MethodPut)
+	r.HandleFunc("/variant-analyses/{id:[0-9]+}/baseline", s.useBaseline).Methods(http.MethodDelete)
+}
+
+type findingList struct {
+	Findings   []Finding    `json:"findings"`
+	Unreadable []Unreadable `json:"unreadable,omitempty"`
+}
+
+func (s *Service) list(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	found, unreadable, err := s.Findings(r.Context(), id)
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	q := r.URL.Query()
+	repo, state := q.Get("repository"), q.Get("state")
+	onlyNew := q.Get("new") == "true"
+	suppressed, bySuppression := q.Get("suppressed") == "true", q.Has("suppressed")
+	head := findingList{Findings: []Finding{}, Unreadable: unreadable}
+	web.WriteJSONStream(w, http.StatusOK, web.Rows{Head: head, Key: "findings", Each: func(a *web.ArrayWriter) error {
+		for _, f := range found {
+			if repo != "" && f.Repository != repo || onlyNew && !f.New {
+				continue
+			}
+			if bySuppression && (f.Suppression != nil) != suppressed {
+				continue
+			}
+			if state != "" {
+				got := StateOpen
+				if f.Triage != nil {
+					got = f.Triage.State
+				}
+				if got != state {
+					continue
+				}
+			}
+			first, err := web.SessionName(r.Context(), f.FirstSession)
+			if err != nil {
+				return err
+			}
+			if err := a.Write(findingView{Finding: f, FirstSession: first}); err != nil {
+				return err
+			}
+		}
+		return nil
+	}})
+}
+
+// findingView is a Finding as clients see it, its first session named.
+type findingView struct {
+	Finding
+	FirstSession string `json:"first_session"`
+}
+
+func (s *Service) patch(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+	index, _ := strconv.Atoi(vars["index"])
+	var p TriagePatch
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, "invalid triage: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, err := s.SetTriage(r.Context(), id, vars["owner"]+"/"+vars["repo"], index, p, web.Identity(r))
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, t)
+}
+
+func (s *Service) export(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	log, unreadable, err := s.SARIF(r.Context(), id)
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	if len(unreadable) > 0 {
+		repos := make([]string, len(unreadable))
+		for i, u := range unreadable {
+			repos[i] = u.Repository
+		}
+		slog.Warn("SARIF export leaves out unreadable results", "session", id, "repositories", repos)
+		w.Header().Set("X-Mrva-Unreadable-Repositories", strings.Join(repos, ", "))
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=variant-analysis-"+web.SessionLabel(r.Context(), id)+".sarif")
+	web.WriteJSON(w, http.StatusOK, log)
+}
+
+type history struct {
+	Fingerprint string         `json:"fingerprint"`
+	Sightings   []sightingView `json:"sightings"`
+	Suppression *Suppression   `json:"suppression,omitempty"`
+}
+
+// sightingView is a Sighting as clients see it, the session named.
+type sightingView struct {
+	Sighting
+	Session string `json:"session"`
+}
+
+func (s *Service) history(w http.ResponseWriter, r *http.Request) {
+	fp := mux.Vars(r)["fingerprint"]
+	ss, err := s.Sightings(r.Context(), fp)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	h := history{Fingerprint: fp, Sightings: make([]sightingView, len(ss))}
+	for i, sg := range ss {
+		session, err := web.SessionName(r.Context(), sg.Session)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		h.Sightings[i] = sightingView{Sighting: sg, Session: session}
+	}
+	var sp Suppression
+	if err := store.GetJSON(r.Context(), s.store, nsSuppressions, fp, &sp); err == nil {
+		h.Suppression = &sp
+	}
+	if len(ss) == 0 && h.Suppression == nil {
+		http.Error(w, "finding not seen", http.StatusNotFound)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, h)
+}
+
+func (s *Service) suppress(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Reason string `json:"reason"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, "invalid suppression: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	sp, err := s.Suppress(r.Context(), mux.Vars(r)["fingerprint"], req.Reason, web.Identity(r))
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, sp)
+}
+
+func (s *Service) unsuppress(w http.ResponseWriter, r *http.Request) {
+	err := s.Unsuppress(r.Context(), mux.Vars(r)["fingerprint"])
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "finding is not suppressed", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) listBaselines(w http.ResponseWriter, r *http.Request) {
+	bs, err := s.Baselines(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	views := make([]baselineView, len(bs))
+	for i, b := range bs {
+		if views[i], err = nameBaseline(r, b); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	web.WriteJSON(w, http.StatusOK, map[string]any{"baselines": views})
+}
+
+// baselineView is a Baseline as clients see it, the session it was taken
+// from named.
+type baselineView struct {
+	Baseline
+	FromSession string `json:"from_session,omitempty"`
+}
+
+func nameBaseline(r *http.Request, b Baseline) (baselineView, error) {
+	v := baselineView{Baseline: b}
+	if b.FromSession == 0 {
+		return v, nil
+	}
+	var err error
+	v.FromSession, err = web.SessionName(r.Context(), b.FromSession)
+	return v, err
+}
+
+func (s *Service) writeBaseline(w http.ResponseWriter, r *http.Request, b Baseline) {
+	v, err := nameBaseline(r, b)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, v)
+}
+
+func (s *Service) getBaseline(w http.ResponseWriter, r *http.Request) {
+	b, err := s.GetBaseline(r.Context(), mux.Vars(r)["name"])
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "no such baseline", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.writeBaseline(w, r, b)
+}
+
+func (s *Service) putBaseline(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Fingerprints []string `json:"fingerprints"`
+		FromSession  string   `json:"from_session"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, "invalid baseline: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	var from int
+	if req.FromSession != "" {
+		var err error
+		if from, err = web.ResolveSession(r.Context(), req.FromSession); err != nil {
+			web.Fail(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	b, err := s.PutBaseline(r.Context(), mux.Vars(r)["name"], req.Fingerprints, from, web.Identity(r))
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	s.writeBaseline(w, r, b)
+}
+
+func (s *Service) deleteBaseline(w http.ResponseWriter, r *http.Request) {
+	err := s.DeleteBaseline(r.Context(), mux.Vars(r)["name"])
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "no such baseline", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (s *Service) useBaseline(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	var req struct {
+		Baseline string `json:"baseline"`
+	}
+	if r.Method == http.MethodPut {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil || req.Baseline == "" {
+			http.Error(w, "give a baseline", http.StatusBadRequest)
+			return
+		}
+	}
+	if err := s.SetSessionBaseline(r.Context(), id, req.Baseline); err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,206 @@
+package findings
+
+import (
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/background"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/snapshot"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const (
+	nsSightings    = "sightings"
+	nsIndexed      = "findings-indexed"
+	nsSuppressions = "suppressions"
+)
+
+// maxGap bounds the probe for sessions of a state that cannot list them.
+const maxGap = 100
+
+// Sighting is a finding's appearance in a session.
+type Sighting struct {
+	Session    int       `json:"session"`
+	Repository string    `json:"repository"`
+	Index      int       `json:"index"`
+	SeenAt     time.Time `json:"seen_at"`
+}
+
+// Suppression hides a finding, by fingerprint, in every session it
+// appears in, or in the sessions using Baseline.
+type Suppression struct {
+	Reason       string    `json:"reason,omitempty"`
+	Baseline     string    `json:"baseline,omitempty"`
+	SuppressedBy string    `json:"suppressed_by,omitempty"`
+	SuppressedAt time.Time `json:"suppressed_at"`
+}
+
+func sightingKey(fingerprint string, session int) string {
+	return fmt.Sprintf("%s/%d", fingerprint, session)
+}
+
+func indexedKey(session int, repository string) string {
+	return fmt.Sprintf("%d/%s", session, repository)
+}
+
+// index records the sightings of a repository's findings in session, once.
+func (s *Service) index(ctx context.Context, session int, repository string, found []Finding) error {
+	key := indexedKey(session, repository)
+	if _, err := s.store.Get(ctx, nsIndexed, key); err == nil {
+		return nil
+	}
+	now := time.Now().UTC()
+	for _, f := range found {
+		sg := Sighting{Session: session, Repository: repository, Index: f.Index, SeenAt: now}
+		if err := store.PutJSON(ctx, s.store, nsSightings, sightingKey(f.Fingerprint, session), sg); err != nil {
+			return fmt.Errorf("failed to record sighting: %w", err)
+		}
+	}
+	return store.PutJSON(ctx, s.store, nsIndexed, key, now)
+}
+
+// Index records the sightings of every finding of a session that has not
+// been indexed yet.  It is the findings-index background task; sessions
+// are also indexed as their findings are read.
+func (s *Service) Index(ctx context.Context) error {
+	ids, err := snapshot.SessionIDs(s.state, maxGap)
+	if err != nil {
+		return fmt.Errorf("failed to list sessions: %w", err)
+	}
+	indexed, err := s.store.List(ctx, nsIndexed, "")
+	if err != nil {
+		return err
+	}
+	done := make(map[string]bool, len(indexed))
+	for _, e := range indexed {
+		done[e.Key] = true
+	}
+
+	var n atomic.Int64
+	err = background.Each(ctx, ids, func(ctx context.Context, id int) error {
+		jobs, err := s.state.GetJobList(id)
+		if err != nil {
+			return nil
+		}
+		for _, job := range jobs {
+			nwo := job.Spec.Owner + "/" + job.Spec.Repo
+			if done[indexedKey(id, nwo)] {
+				continue
+			}
+			if status, err := s.state.GetStatus(job.Spec); err != nil || status != common.StatusSuccess {
+				continue
+			}
+			sarif, err := s.sarif(job.Spec)
+			if err != nil {
+				// Without a readable log there is nothing to index, now
+				// or later.
+				if errors.Is(err, ErrNoSARIF) {
+					store.PutJSON(ctx, s.store, nsIndexed, indexedKey(id, nwo), time.Now().UTC())
+				}
+				continue
+			}
+			found, err := parse(nwo, sarif)
+			if err != nil {
+				continue
+			}
+			if err := s.index(ctx, id, nwo, found); err != nil {
+				return err
+			}
+			n.Add(1)
+		}
+		return nil
+	})
+	if n := n.Load(); n > 0 {
+		slog.Info("Indexed findings", "results", n)
+	}
+	return err
+}
+
+// Sightings returns the sessions a finding appeared in, oldest first.
+func (s *Service) Sightings(ctx context.Context, fingerprint string) ([]Sighting, error) {
+	entries, err := s.store.List(ctx, nsSightings, fingerprint+"/")
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Sighting, 0, len(entries))
+	for _, e := range entries {
+		var sg Sighting
+		if err := json.Unmarshal(e.Value, &sg); err != nil {
+			return nil, err
+		}
+		out = append(out, sg)
+	}
+	slices.SortFunc(out, func(a, b Sighting) int { return a.Session - b.Session })
+	return out, nil
+}
+
+// firstSession returns the first session a finding appeared in, counting
+// session itself.
+func (s *Service) firstSession(ctx context.Context, fingerprint string, session int) (int, error) {
+	ss, err := s.Sightings(ctx, fingerprint)
+	if err != nil {
+		return 0, err
+	}
+	if len(ss) > 0 && ss[0].Session < session {
+		return ss[0].Session, nil
+	}
+	return session, nil
+}
+
+// Suppress suppresses a finding in every session.
+func (s *Service) Suppress(ctx context.Context, fingerprint, reason, by string) (Suppression, error) {
+	if !validFingerprint(fingerprint) {
+		return Suppression{}, web.Msg(http.StatusBadRequest, "", "findings.invalid_fingerprint", nil)
+	}
+	if len(reason) > maxCommentLen {
+		return Suppression{}, web.Msg(http.StatusBadRequest, "", "findings.reason_length", messages.Params{"max": maxCommentLen})
+	}
+	sp := Suppression{Reason: reason, SuppressedBy: by, SuppressedAt: time.Now().UTC()}
+	if err := store.PutJSON(ctx, s.store, nsSuppressions, fingerprint, sp); err != nil {
+		return sp, fmt.Errorf("failed to record suppression: %w", err)
+	}
+	slog.Info("Finding suppressed", "fingerprint", fingerprint, "client", by)
+	return sp, nil
+}
+
+// Unsuppress lifts a finding's suppression.
+func (s *Service) Unsuppress(ctx context.Context, fingerprint string) error {
+	if _, err := s.store.Get(ctx, nsSuppressions, fingerprint); err != nil {
+		return err
+	}
+	return s.store.Delete(ctx, nsSuppressions, fingerprint)
+}
+
+// suppressions returns every suppression, by fingerprint.
+func (s *Service) suppressions(ctx context.Context) (map[string]Suppression, error) {
+	entries, err := s.store.List(ctx, nsSuppressions, "")
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]Suppression, len(entries))
+	for _, e := range entries {
+		var sp Suppression
+		if err := json.Unmarshal(e.Value, &sp); err != nil {
+			return nil, err
+		}
+		out[e.Key] = sp
+	}
+	return out, nil
+}
+
+func validFingerprint(fp string) bool {
+	b, err := hex.DecodeString(fp)
+	return err == nil && len(b) == 16 && strings.ToLower(fp) == fp
+}
@@ -0,0 +1,169 @@
+package findings
+
+import (
+	"archive/zip"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// ErrNoSARIF is returned for a results archive without a SARIF log, such
+// as the results of a table query or a sealed archive.
+var ErrNoSARIF = errors.New("results archive has no SARIF log")
+
+// readSARIF returns the SARIF log in a results archive.
+func readSARIF(archive []byte) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return nil, ErrNoSARIF
+	}
+	for _, f := range zr.File {
+		if path.Ext(f.Name) != ".sarif" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+		defer rc.Close()
+		return io.ReadAll(rc)
+	}
+	return nil, ErrNoSARIF
+}
+
+// sarifLog is the part of a SARIF 2.1.0 log findings are made from.
+type sarifLog struct {
+	Runs []struct {
+		Results []sarifResult `json:"results"`
+	} `json:"runs"`
+}
+
+type sarifResult struct {
+	RuleID string `json:"ruleId"`
+	Rule   struct {
+		ID string `json:"id"`
+	} `json:"rule"`
+	Message struct {
+		Text string `json:"text"`
+	} `json:"message"`
+	Locations []struct {
+		PhysicalLocation struct {
+			ArtifactLocation struct {
+				URI string `json:"uri"`
+			} `json:"artifactLocation"`
+			Region struct {
+				StartLine   int `json:"startLine"`
+				StartColumn int `json:"startColumn"`
+			} `json:"region"`
+		} `json:"physicalLocation"`
+	} `json:"locations"`
+	PartialFingerprints map[string]string `json:"partialFingerprints"`
+}
+
+func (r sarifResult) rule() string {
+	if r.RuleID != "" {
+		return r.RuleID
+	}
+	return r.Rule.ID
+}
+
+// parse returns the findings of a repository's SARIF log, numbered in the
+// order of the log's runs and results.
+func parse(repository string, sarif []byte) ([]Finding, error) {
+	var log sarifLog
+	if err := json.Unmarshal(sarif, &log); err != nil {
+		return nil, err
+	}
+	var out []Finding
+	for _, run := range log.Runs {
+		for _, r := range run.Results {
+			f := Finding{Repository: repository, Index: len(out), RuleID: r.rule(), Message: r.Message.Text}
+			if len(r.Locations) > 0 {
+				loc := r.Locations[0].PhysicalLocation
+				f.Path = loc.ArtifactLocation.URI
+				f.StartLine, f.StartColumn = loc.Region.StartLine, loc.Region.StartColumn
+			}
+			f.Fingerprint = fingerprint(f, r.PartialFingerprints)
+			out = append(out, f)
+		}
+	}
+	return out, nil
+}
+
+// FingerprintKey is the key of mrvaserver's fingerprint in the
+// fingerprints of an exported SARIF result.
+const FingerprintKey = "mrva/v1"
+
+// fingerprint names a finding independently of its index and its session:
+// its repository, rule and normalized path, and the hash of its line's
+// content that CodeQL reports as primaryLocationLineHash -- or, without
+// one, its line number.  The line hash survives edits elsewhere in the
+// file that move the finding.
+func fingerprint(f Finding, partial map[string]string) string {
+	context := partial["primaryLocationLineHash"]
+	if context == "" {
+		context = fmt.Sprintf("line:%d", f.StartLine)
+	}
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s", f.Repository, f.RuleID, normalizePath(f.Path), context)
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// normalizePath makes the forms a checkout-relative path is reported in
+// alike: file:// URIs, ./ prefixes, redundant separators.
+func normalizePath(p string) string {
+	p = strings.TrimPrefix(p, "file://")
+	p = strings.ReplaceAll(p, "\\", "/")
+	p = path.Clean("/" + p)
+	return strings.TrimPrefix(p, "/")
+}
+
+// annotate lets edit change each result of a SARIF log, by finding index,
+// and returns the log's runs.  Everything else in the log is kept as it
+// is.
+func annotate(repository string, sarif []byte, edit func(index int, result map[string]any)) ([]any, error) {
+	var log map[string]any
+	if err := json.Unmarshal(sarif, &log); err != nil {
+		return nil, err
+	}
+	runs, _ := log["runs"].([]any)
+	index := 0
+	for _, run := range runs {
+		run, ok := run.(map[string]any)
+		if !ok {
+			continue
+		}
+		if _, ok := run["versionControlProvenance"]; !ok {
+			run["versionControlProvenance"] = []any{
+				map[string]any{"repositoryUri": "https://github.com/" + repository},
+			}
+		}
+		results, _ := run["results"].([]any)
+		for _, r := range results {
+			r, ok := r.(map[string]any)
+			if !ok {
+				index++
+				continue
+			}
+			edit(index, r)
+			index++
+		}
+	}
+	return runs, nil
+}
+
+// set sets result[field][key], making the object if need be.
+func set(result map[string]any, field, key string, v any) {
+	m, _ := result[field].(map[string]any)
+	if m == nil {
+		m = make(map[string]any)
+	}
+	m[key] = v
+	result[field] = m
+}
@@ -0,0 +1,257 @@
+// Package flags gates new subsystems behind feature flags, so that they
+// can be rolled out to a few tenants, then a share of them, then everyone,
+// and turned off again without a redeploy.  A tenant is an identity as
+// web.Identity gives it.  Packages define the flags they consult, each
+// with its default; the configuration overrides the defaults and
+// /admin/flags overrides both at run time, for every replica within
+// seconds.
+//
+// A flag is on for the tenants it names, off for those it excepts, and
+// otherwise on for everyone if enabled, else for its percentage of
+// tenants.  Which tenants make up the percentage is fixed by hashing, so
+// that raising it only adds tenants.
+//
+// Flags gate what is decided per request: streamed-downloads, whether
+// result downloads bypass the commander; session-sharding, whether large
+// submissions are split; and gradual-dispatch, whether a submission's jobs
+// wait for the dispatch window.  Choices made once per process, such as the
+// queue, state or artifact backend, cannot differ between tenants served
+// by the same replica and are left to configuration.
+package flags
+
+import (
+	"context"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const ns = "feature-flags" // name -> Flag set at run time
+
+// refresh is how often flags set on other replicas are picked up.
+const refresh = 10 * time.Second
+
+var evaluationsTotal = metrics.NewCounterVec("mrvaserver_feature_flag_evaluations_total",
+	"Feature flag evaluations by flag and result.", "flag", "result")
+
+// Flag is a flag's setting.
+type Flag struct {
+	Name        string   `json:"name"`
+	Description string   `json:"description,omitempty"`
+	Enabled     bool     `json:"enabled"`
+	Percent     int      `json:"percent,omitempty"`
+	Tenants     []string `json:"tenants,omitempty"`
+	Except      []string `json:"except,omitempty"`
+
+	// Source is "default", "config", or "admin" for a flag set at run
+	// time.
+	Source    string     `json:"source"`
+	UpdatedBy string     `json:"updated_by,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+func (f Flag) validate() error {
+	if f.Percent < 0 || f.Percent > 100 {
+		return fmt.Errorf("%s: percent must be between 0 and 100", f.Name)
+	}
+	return nil
+}
+
+// on reports whether f is on for tenant.
+func (f Flag) on(tenant string) bool {
+	switch {
+	case slices.Contains(f.Tenants, tenant):
+		return true
+	case slices.Contains(f.Except, tenant):
+		return false
+	case f.Enabled:
+		return true
+	}
+	return f.Percent > 0 && bucket(f.Name, tenant) < f.Percent
+}
+
+// bucket places a tenant in one of 100 buckets of a flag.
+func bucket(flag, tenant string) int {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s/%s", flag, tenant)
+	return int(h.Sum32() % 100)
+}
+
+var (
+	definedMu sync.Mutex
+	defined   = map[string]Flag{}
+)
+
+// Define defines a flag, on or off by default, and returns its name.
+// Flags are defined when packages are initialized.
+func Define(name, description string, enabled bool) string {
+	definedMu.Lock()
+	defer definedMu.Unlock()
+	if _, ok := defined[name]; ok {
+		panic("flags: " + name + " defined twice")
+	}
+	defined[name] = Flag{Name: name, Description: description, Enabled: enabled, Source: "default"}
+	return name
+}
+
+// Set evaluates the flags.
+type Set struct {
+	config map[string]Flag
+	store  store.Store
+
+	mu        sync.Mutex
+	overrides map[string]Flag
+	loaded    time.Time
+}
+
+// New returns the flags defined, as cfg sets them, with the overrides in s.
+func New(cfg config.Flags, s store.Store) (*Set, error) {
+	definedMu.Lock()
+	defer definedMu.Unlock()
+	set := &Set{config: make(map[string]Flag, len(defined)), store: s}
+	for name, f := range defined {
+		set.config[name] = f
+	}
+	seen := map[string]bool{}
+	for i, c := range cfg.Flags {
+		def, ok := defined[c.Name]
+		if !ok {
+			return nil, fmt.Errorf("feature_flags.flags[%d]: unknown flag %q", i, c.Name)
+		}
+		if seen[c.Name] {
+			return nil, fmt.Errorf("feature_flags.flags[%d]: duplicate flag %q", i, c.Name)
+		}
+		seen[c.Name] = true
+		f := Flag{
+			Name:        c.Name,
+			Description: def.Description,
+			Enabled:     c.Enabled,
+			Percent:     c.Percent,
+			Tenants:     c.Tenants,
+			Except:      c.Except,
+			Source:      "config",
+		}
+		if err := f.validate(); err != nil {
+			return nil, fmt.Errorf("feature_flags.flags[%d]: %w", i, err)
+		}
+		set.config[c.Name] = f
+	}
+	return set, nil
+}
+
+// flags returns the flags in effect by name, reading the ones set at run
+// time at most every refresh.
+func (s *Set) flags(ctx context.Context) (map[string]Flag, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.overrides == nil || time.Since(s.loaded) > refresh {
+		list, err := store.ListJSON[Flag](ctx, s.store, ns, "")
+		if err != nil && s.overrides == nil {
+			return nil, err
+		}
+		if err == nil {
+			s.overrides = make(map[string]Flag, len(list))
+			for _, f := range list {
+				if _, ok := s.config[f.Name]; ok {
+					s.overrides[f.Name] = f
+				}
+			}
+			s.loaded = time.Now()
+		} else {
+			slog.Warn("Failed to refresh feature flags", "error", err)
+		}
+	}
+	out := make(map[string]Flag, len(s.config))
+	for name, f := range s.config {
+		if o, ok := s.overrides[name]; ok {
+			o.Description = f.Description
+			f = o
+		}
+		out[name] = f
+	}
+	return out, nil
+}
+
+// For reports whether flag is on for tenant.  A flag that cannot be read
+// is as configured.
+func (s *Set) For(ctx context.Context, flag, tenant string) bool {
+	f, ok := s.config[flag]
+	if flags, err := s.flags(ctx); err == nil {
+		f, ok = flags[flag]
+	}
+	on := ok && f.on(tenant)
+	result := "off"
+	if on {
+		result = "on"
+	}
+	evaluationsTotal.With(flag, result).Inc()
+	return on
+}
+
+// On reports whether flag is on for the tenant making r.
+func (s *Set) On(r *http.Request, flag string) bool {
+	return s.For(r.Context(), flag, web.Identity(r))
+}
+
+// List returns the flags in effect, by name.
+func (s *Set) List(ctx context.Context) ([]Flag, error) {
+	flags, err := s.flags(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]Flag, 0, len(flags))
+	for _, f := range flags {
+		out = append(out, f)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out, nil
+}
+
+// Put overrides a flag at run time.
+func (s *Set) Put(ctx context.Context, f Flag, by string) (Flag, error) {
+	def, ok := s.config[f.Name]
+	if !ok {
+		return f, web.Errorf(http.StatusNotFound, "no such feature flag")
+	}
+	now := time.Now().UTC()
+	f.Description, f.Source, f.UpdatedBy, f.UpdatedAt = "", "admin", by, &now
+	if err := f.validate(); err != nil {
+		return f, web.Errorf(http.StatusBadRequest, "%v", err)
+	}
+	if err := store.PutJSON(ctx, s.store, ns, f.Name, f); err != nil {
+		return f, fmt.Errorf("failed to save feature flag: %w", err)
+	}
+	s.mu.Lock()
+	s.overrides = nil
+	s.mu.Unlock()
+	slog.Info("Feature flag set", "flag", f.Name, "enabled", f.Enabled, "percent", f.Percent,
+		"tenants", len(f.Tenants), "except", len(f.Except), "client", by)
+	f.Description = def.Description
+	return f, nil
+}
+
+// Reset drops a flag's run-time override, going back to its configured or
+// default setting.
+func (s *Set) Reset(ctx context.Context, name string) error {
+	if _, err := s.store.Get(ctx, ns, name); err != nil {
+		return err
+	}
+	if err := s.store.Delete(ctx, ns, name); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	s.overrides = nil
+	s.mu.Unlock()
+	slog.Info("Feature flag reset", "flag", name)
+	return nil
+}
@@ -0,0 +1,96 @@
+package flags
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+// RegisterAdmin adds the feature flags:
+//
+//	GET    /admin/flags                 the flags in effect
+//	GET    /admin/flags/{name}          one flag
+//	PUT    /admin/flags/{name}          override it
+//	DELETE /admin/flags/{name}          go back to the configured setting
+//	GET    /admin/flags/{name}/for      whether it is on for ?tenant=, or the caller
+func (s *Set) RegisterAdmin(r *mux.Router) {
+	r.HandleFunc("/admin/flags", s.list).Methods(http.MethodGet)
+	r.HandleFunc("/admin/flags/{name}", s.get).Methods(http.MethodGet)
+	r.HandleFunc("/admin/flags/{name}", s.put).Methods(http.MethodPut)
+	r.HandleFunc("/admin/flags/{name}", s.reset).Methods(http.MethodDelete)
+	r.HandleFunc("/admin/flags/{name}/for", s.evaluate).Methods(http.MethodGet)
+}
+
+func (s *Set) list(w http.ResponseWriter, r *http.Request) {
+	flags, err := s.List(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, flags)
+}
+
+func (s *Set) get(w http.ResponseWriter, r *http.Request) {
+	flags, err := s.flags(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	f, ok := flags[mux.Vars(r)["name"]]
+	if !ok {
+		http.Error(w, "no such feature flag", http.StatusNotFound)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, f)
+}
+
+func (s *Set) put(w http.ResponseWriter, r *http.Request) {
+	var f Flag
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		http.Error(w, "invalid feature flag: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.Name = mux.Vars(r)["name"]
+	f, err := s.Put(r.Context(), f, web.Identity(r))
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, f)
+}
+
+func (s *Set) reset(w http.ResponseWriter, r *http.Request) {
+	err := s.Reset(r.Context(), mux.Vars(r)["name"])
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "no feature flag was set with this name", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+type evaluation struct {
+	Flag   string `json:"flag"`
+	Tenant string `json:"tenant"`
+	On     bool   `json:"on"`
+}
+
+func (s *Set) evaluate(w http.ResponseWriter, r *http.Request) {
+	name := mux.Vars(r)["name"]
+	if _, ok := s.config[name]; !ok {
+		http.Error(w, "no such feature flag", http.StatusNotFound)
+		return
+	}
+	tenant := r.URL.Query().Get("tenant")
+	if tenant == "" {
+		tenant = web.Identity(r)
+	}
+	web.WriteJSON(w, http.StatusOK, evaluation{Flag: name, Tenant: tenant, On: s.For(r.Context(), name, tenant)})
+}
@@ -0,0 +1,131 @@
+package gateway_test
+
+import (
+	"net/http"
+	"slices"
+	"testing"
+
+	"github.com/gorilla/mux"
+	"github.com/hohn/mrvacommander/pkg/server"
+	"mrvaserver/pkg/actions"
+	"mrvaserver/pkg/annotations"
+	"mrvaserver/pkg/chaos"
+	"mrvaserver/pkg/diagnostics"
+	"mrvaserver/pkg/dispatch"
+	"mrvaserver/pkg/findings"
+	"mrvaserver/pkg/flags"
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/issues"
+	"mrvaserver/pkg/lameduck"
+	"mrvaserver/pkg/lease"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/pool"
+	"mrvaserver/pkg/prefetch"
+	"mrvaserver/pkg/provenance"
+	"mrvaserver/pkg/quarantine"
+	"mrvaserver/pkg/queuestats"
+	"mrvaserver/pkg/quickquery"
+	"mrvaserver/pkg/repostats"
+	"mrvaserver/pkg/resources"
+	"mrvaserver/pkg/sample"
+	"mrvaserver/pkg/shard"
+	"mrvaserver/pkg/startup"
+	"mrvaserver/pkg/telemetry"
+	"mrvaserver/pkg/templates"
+	"mrvaserver/pkg/tenant"
+	"mrvaserver/pkg/toolchain"
+	"mrvaserver/pkg/trash"
+	"mrvaserver/pkg/usage"
+	"mrvaserver/pkg/usagereport"
+	"mrvaserver/pkg/usagestats"
+)
+
+func newGateway(t *testing.T) *gateway.Gateway {
+	t.Helper()
+	g, err := gateway.New(&server.Visibles{}, "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return g
+}
+
+// routes mounts its routes either way.
+type routes func(r *mux.Router)
+
+func (f routes) Register(r *mux.Router)      { f(r) }
+func (f routes) RegisterAdmin(r *mux.Router) { f(r) }
+
+func TestUnguardedAdminRoutes(t *testing.T) {
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	g := newGateway(t)
+	g.MountAdmin(routes(func(r *mux.Router) {
+		r.HandleFunc("/admin/guarded", ok).Methods(http.MethodGet)
+	}))
+	g.Mount(routes(func(r *mux.Router) {
+		r.HandleFunc("/admin/open", ok).Methods(http.MethodGet, http.MethodPost)
+		r.HandleFunc("/administrators", ok).Methods(http.MethodGet)
+	}))
+	got := g.UnguardedAdminRoutes()
+	want := []string{"GET /admin/open", "POST /admin/open"}
+	if !slices.Equal(got, want) {
+		t.Errorf("UnguardedAdminRoutes() = %q, want %q", got, want)
+	}
+}
+
+// TestAdminRoutesGuarded mounts every package the server mounts, the way
+// it mounts them, and fails on any /admin/ route outside the admin router.
+// The endpoints are only registered, never served, so zero values do.
+func TestAdminRoutesGuarded(t *testing.T) {
+	g := newGateway(t)
+	for _, m := range []gateway.Mounter{
+		new(shard.Map),
+		metrics.Default,
+		new(templates.Templates),
+		new(repostats.Tracker),
+		new(sample.Sampler),
+		new(usage.Accountant),
+		new(toolchain.Map),
+		new(dispatch.Dispatcher),
+		new(trash.Trash),
+		new(provenance.Exporter),
+		new(provenance.Replayer),
+		new(actions.Submitter),
+		new(telemetry.Reports),
+		new(findings.Service),
+		new(issues.Filer),
+		new(prefetch.Stager),
+		new(annotations.Store),
+		new(quickquery.Broker),
+		new(lameduck.Controller),
+		new(startup.Tracker),
+		new(diagnostics.Bundle),
+		new(messages.Catalog),
+	} {
+		g.Mount(m)
+	}
+	for _, m := range []gateway.AdminMounter{
+		new(repostats.Tracker),
+		new(tenant.Tenants),
+		new(usagereport.Reporter),
+		new(usagestats.Reporter),
+		new(pool.Router),
+		new(toolchain.Map),
+		new(flags.Set),
+		new(lease.Manager),
+		new(dispatch.Dispatcher),
+		new(queuestats.Handler),
+		new(quarantine.Quarantine),
+		new(trash.Trash),
+		new(resources.Registry),
+		new(usage.Accountant),
+		new(lameduck.Controller),
+		new(chaos.Injector),
+		new(diagnostics.Bundle),
+	} {
+		g.MountAdmin(m)
+	}
+	if unguarded := g.UnguardedAdminRoutes(); len(unguarded) > 0 {
+		t.Errorf("admin routes outside the admin router: %q", unguarded)
+	}
+}
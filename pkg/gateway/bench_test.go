@@ -0,0 +1,91 @@
+package gateway
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/hohn/mrvacommander/pkg/server"
+	"github.com/hohn/mrvacommander/pkg/state"
+)
+
+// benchRepositories is the size of the sessions the benchmarks work on.
+const benchRepositories = 1000
+
+// BenchmarkParseSubmission decodes a submission of benchRepositories
+// repositories with a 64 KiB query pack and an extension field.
+func BenchmarkParseSubmission(b *testing.B) {
+	repos := make([]string, benchRepositories)
+	for i := range repos {
+		repos[i] = fmt.Sprintf("owner%d/repo%d", i%50, i)
+	}
+	body, err := json.Marshal(map[string]any{
+		"action_repo_ref": "main",
+		"language":        "cpp",
+		"query_pack":      base64.StdEncoding.EncodeToString(make([]byte, 64<<10)),
+		"repositories":    repos,
+		"mrva_priority":   "high",
+	})
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := parseSubmission(body); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkStatusRender answers a status request for a finished session
+// of benchRepositories repositories, most with a result.
+func BenchmarkStatusRender(b *testing.B) {
+	v := &server.Visibles{
+		State:     state.NewLocalState(0),
+		Artifacts: artifactstore.NewInMemoryArtifactStore(),
+	}
+	session := v.State.NextID()
+	now := time.Now().Format(time.RFC3339)
+	for i := 0; i < benchRepositories; i++ {
+		js := common.JobSpec{
+			SessionID:     session,
+			NameWithOwner: common.NameWithOwner{Owner: fmt.Sprintf("owner%d", i%50), Repo: fmt.Sprintf("repo%d", i)},
+		}
+		var status common.Status = common.StatusSuccess
+		if i%10 == 0 {
+			status = common.StatusFailed
+		}
+		v.State.AddJob(queue.AnalyzeJob{Spec: js, QueryLanguage: "cpp"})
+		v.State.SetJobInfo(js, common.JobInfo{QueryLanguage: "cpp", CreatedAt: now, UpdatedAt: now})
+		v.State.SetStatus(js, status)
+		if status != common.StatusSuccess {
+			continue
+		}
+		loc, err := v.Artifacts.SaveResult(js, []byte("PK\x05\x06"))
+		if err != nil {
+			b.Fatal(err)
+		}
+		v.State.SetResult(js, queue.AnalyzeResult{Spec: js, Status: status, ResultCount: i % 7, ResultLocation: loc})
+	}
+	g, err := New(v, "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	path := fmt.Sprintf("/repos/mrva/controller/code-scanning/codeql/variant-analyses/%d", session)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		w := httptest.NewRecorder()
+		g.ServeHTTP(w, httptest.NewRequest(http.MethodGet, path, nil))
+		if w.Code != http.StatusOK {
+			b.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+	}
+}
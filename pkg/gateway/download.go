@@ -0,0 +1,52 @@
+package gateway
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/artifactstream"
+	"mrvaserver/pkg/flags"
+)
+
+var streamedDownloads = flags.Define("streamed-downloads",
+	"Stream result downloads from the artifact store rather than through the commander.", true)
+
+// SetDownloads serves result downloads through s, streamed, rather than
+// through the commander, which reads each archive whole.
+func (g *Gateway) SetDownloads(s *artifactstream.Server) {
+	g.downloads = s
+}
+
+// SetFlags consults f for the gateway's feature flags; without it they
+// are all on.
+func (g *Gateway) SetFlags(f *flags.Set) {
+	g.flags = f
+}
+
+// on reports whether flag is on for the client of r.
+func (g *Gateway) on(r *http.Request, flag string) bool {
+	return g.flags == nil || g.flags.On(r, flag)
+}
+
+// Download serves /download/{encoded_job_spec}, the artifact URL of repo
+// tasks.
+func (g *Gateway) Download(w http.ResponseWriter, r *http.Request) {
+	if g.downloads == nil || !g.on(r, streamedDownloads) {
+		g.proxy.ServeHTTP(w, r)
+		return
+	}
+	js, err := common.DecodeJobSpec(mux.Vars(r)["encoded_job_spec"])
+	if err != nil {
+		http.Error(w, "Invalid job spec", http.StatusBadRequest)
+		return
+	}
+	result, err := g.v.State.GetResult(js)
+	if err != nil {
+		slog.Error("Failed to get result", "job", js, "error", err)
+		http.Error(w, "Failed to get result", http.StatusInternalServerError)
+		return
+	}
+	g.downloads.ServeResult(w, r, result.ResultLocation)
+}
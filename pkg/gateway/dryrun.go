@@ -0,0 +1,87 @@
+package gateway
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/utils"
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/web"
+)
+
+// DatabaseSizes knows the sizes of databases without fetching them.
+type DatabaseSizes interface {
+	DatabaseSize(nwo common.NameWithOwner) (int64, bool)
+}
+
+// Estimator projects how long analyses take.
+type Estimator interface {
+	// JobSeconds returns the mean time agents took over recent jobs in
+	// language, or 0 if it does not know.
+	JobSeconds(language string) float64
+}
+
+// SetEstimates makes dry-run submissions take database sizes from sizes
+// and compute time from est.  Either may be nil; the estimate then leaves
+// that part out.
+func (g *Gateway) SetEstimates(sizes DatabaseSizes, est Estimator) {
+	g.dbSizes, g.estimator = sizes, est
+}
+
+// dryRun answers a submission marked "dry_run" with what it would analyze
+// and roughly what it would cost.  The submit hooks have run, so the
+// submission is as it would be forwarded; nothing is enqueued.
+func (g *Gateway) dryRun(w http.ResponseWriter, r *http.Request, sub *Submission) {
+	msg := sub.Msg
+	if msg.Language == "" {
+		web.Fail(w, web.Msg(http.StatusBadRequest, "", "submit.missing_language", nil), http.StatusBadRequest)
+		return
+	}
+	if !utils.IsBase64Gzip([]byte(msg.QueryPack)) {
+		web.Fail(w, web.Msg(http.StatusBadRequest, "", "pack.bad_format", nil), http.StatusBadRequest)
+		return
+	}
+	nwos := make([]common.NameWithOwner, 0, len(msg.Repositories))
+	for _, repo := range msg.Repositories {
+		owner, name, ok := strings.Cut(repo, "/")
+		if !ok || owner == "" || name == "" || strings.Contains(name, "/") {
+			web.Fail(w, web.Msg(http.StatusBadRequest, "", "submit.invalid_repository", nil), http.StatusBadRequest)
+			return
+		}
+		nwos = append(nwos, common.NameWithOwner{Owner: owner, Repo: name})
+	}
+
+	notFound, found := g.v.CodeQLDBStore.FindAvailableDBs(nwos)
+	est := api.Estimate{
+		DryRun:          true,
+		Language:        msg.Language,
+		RepositoryCount: len(found),
+		Sessions:        1,
+		NoCodeqlDBRepos: make([]string, 0, len(notFound)),
+	}
+	if g.splits(r, len(nwos)) {
+		size := g.sessions.ShardSize
+		est.Sessions = (len(nwos) + size - 1) / size
+	}
+	for _, nwo := range notFound {
+		est.NoCodeqlDBRepos = append(est.NoCodeqlDBRepos, nwo.Owner+"/"+nwo.Repo)
+	}
+	for _, nwo := range found {
+		if g.dbSizes == nil {
+			est.UnsizedDatabases++
+			continue
+		}
+		n, ok := g.dbSizes.DatabaseSize(nwo)
+		if !ok {
+			est.UnsizedDatabases++
+			continue
+		}
+		est.DatabaseBytes += n
+	}
+	if g.estimator != nil {
+		est.SecondsPerRepository = g.estimator.JobSeconds(msg.Language)
+		est.EstimatedComputeSeconds = est.SecondsPerRepository * float64(len(found))
+	}
+	web.WriteJSON(w, http.StatusOK, est)
+}
@@ -0,0 +1,232 @@
+// Package gateway is the public HTTP front of mrvaserver.  It serves the
+// parts of the GitHub MRVA API that the commander does not implement (or
+// implements with shapes the VS Code extension rejects) and reverse-proxies
+// everything else to the commander's own listener.
+package gateway
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/hohn/mrvacommander/pkg/server"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"mrvaserver/pkg/artifactstream"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/flags"
+	"mrvaserver/pkg/web"
+)
+
+type Gateway struct {
+	v         *server.Visibles
+	commander *url.URL
+	proxy     *httputil.ReverseProxy
+	router    *mux.Router
+	handler   http.Handler
+	admin     *mux.Router
+	adminAuth func(http.Handler) http.Handler
+
+	serverMu sync.Mutex
+	server   *http.Server
+
+	submitHooks          []SubmitHook
+	repoTaskHooks        []RepoTaskHook
+	variantAnalysisHooks []VariantAnalysisHook
+	sizes                ResultSizes
+	sessions             config.Sessions
+	shardMap             ShardMap
+	dbSizes              DatabaseSizes
+	estimator            Estimator
+	caching              config.Caching
+	statuses             *statusCache
+	metaVersions         *MetadataVersions
+	downloads            *artifactstream.Server
+	flags                *flags.Set
+}
+
+// New creates a gateway in front of the commander listening on commanderAddr
+// (host:port).  The Visibles must be the same ones handed to the commander.
+func New(v *server.Visibles, commanderAddr string) (*Gateway, error) {
+	target, err := url.Parse("http://" + commanderAddr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid commander address %q: %w", commanderAddr, err)
+	}
+
+	g := &Gateway{
+		v:         v,
+		commander: target,
+		proxy:     httputil.NewSingleHostReverseProxy(target),
+		router:    mux.NewRouter(),
+	}
+	g.handler = g.router
+	g.proxy.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		slog.Error("Commander request failed", "uri", r.RequestURI, "client", web.OriginOf(r).ClientIP, "error", err)
+		http.Error(w, "Bad Gateway", http.StatusBadGateway)
+	}
+	g.setupEndpoints()
+	return g, nil
+}
+
+func (g *Gateway) setupEndpoints() {
+	r := g.router
+
+	// Controller repository lookup, used by the extension to resolve the
+	// controller repo's ID before submitting.
+	r.HandleFunc("/repos/{owner}/{repo}", g.ControllerRepo).Methods(http.MethodGet)
+
+	// Submissions are rewritten by the submit hooks, then forwarded.
+	r.HandleFunc("/repos/{owner}/{repo}/code-scanning/codeql/variant-analyses", g.Submit).Methods(http.MethodPost)
+	r.HandleFunc("/repositories/{controller_repo_id}/code-scanning/codeql/variant-analyses", g.Submit).Methods(http.MethodPost)
+
+	// Status requests
+	r.HandleFunc("/repos/{owner}/{repo}/code-scanning/codeql/variant-analyses/{codeql_variant_analysis_id}", g.StatusNWO).Methods(http.MethodGet)
+	r.HandleFunc("/repositories/{controller_repo_id}/code-scanning/codeql/variant-analyses/{codeql_variant_analysis_id}", g.StatusID).Methods(http.MethodGet)
+
+	// Repo task requests
+	r.HandleFunc("/repos/{controller_owner}/{controller_repo}/code-scanning/codeql/variant-analyses/{codeql_variant_analysis_id}/repos/{repo_owner}/{repo_name}", g.RepoTaskNWO).Methods(http.MethodGet)
+	r.HandleFunc("/repositories/{controller_repo_id}/code-scanning/codeql/variant-analyses/{codeql_variant_analysis_id}/repositories/{repository_id}", g.RepoTaskID).Methods(http.MethodGet)
+
+	// Paged repo task listing
+	r.HandleFunc("/variant-analyses/{id:[0-9]+}/repos", g.RepoTasks).Methods(http.MethodGet)
+
+	// Result downloads, streamed from the artifact store
+	r.HandleFunc("/download/{encoded_job_spec}", g.Download).Methods(http.MethodGet, http.MethodHead)
+
+	// Admin control endpoints, behind SetAdminAuth.
+	g.admin = r.NewRoute().Subrouter()
+	g.admin.Use(g.requireAdmin)
+
+	// Everything else is the commander's.  A path match with the wrong
+	// method (e.g. POST to a status URL) must reach the commander as well.
+	r.NotFoundHandler = g.proxy
+	r.MethodNotAllowedHandler = g.proxy
+	r.Use(recordRoute)
+}
+
+// recordRoute notes the route each request matched for the access log.
+func recordRoute(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil {
+			if tpl, err := route.GetPathTemplate(); err == nil {
+				web.SetRoute(r, tpl)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// ServeHTTP makes the gateway usable as a plain http.Handler.
+func (g *Gateway) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	g.handler.ServeHTTP(w, r)
+}
+
+// Use wraps every request in mw, before routing.  Middleware added later
+// runs first.
+func (g *Gateway) Use(mw func(http.Handler) http.Handler) {
+	g.handler = mw(g.handler)
+}
+
+// ListenAndServe serves the gateway on cfg.Listen until the listener fails
+// or Shutdown is called, in which case it returns http.ErrServerClosed.
+func (g *Gateway) ListenAndServe(cfg config.HTTP) error {
+	l, err := Listen(cfg.Listen)
+	if err != nil {
+		return err
+	}
+	slog.Info("Gateway listening", "addr", l.Addr().String(), "commander", g.commander.Host)
+	srv := &http.Server{
+		Handler:           g,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout,
+		ReadTimeout:       cfg.ReadTimeout,
+		WriteTimeout:      cfg.WriteTimeout,
+		IdleTimeout:       cfg.IdleTimeout,
+		MaxHeaderBytes:    cfg.MaxHeaderBytes,
+	}
+	if cfg.H2C && cfg.TLSCertFile == "" {
+		srv.Handler = h2c.NewHandler(g, &http2.Server{IdleTimeout: cfg.IdleTimeout})
+	}
+	g.serverMu.Lock()
+	g.server = srv
+	g.serverMu.Unlock()
+	if cfg.TLSCertFile != "" {
+		return srv.ServeTLS(l, cfg.TLSCertFile, cfg.TLSKeyFile)
+	}
+	return srv.Serve(l)
+}
+
+// Shutdown stops accepting connections and waits for in-flight requests.
+func (g *Gateway) Shutdown(ctx context.Context) error {
+	g.serverMu.Lock()
+	srv := g.server
+	g.serverMu.Unlock()
+	if srv == nil {
+		return nil
+	}
+	return srv.Shutdown(ctx)
+}
+
+// Mounter is implemented by packages that add their own endpoints to the
+// gateway.
+type Mounter interface {
+	Register(r *mux.Router)
+}
+
+// Mount adds m's endpoints.  Routes added this way take precedence over the
+// proxy but not over the gateway's own routes.
+func (g *Gateway) Mount(m Mounter) {
+	m.Register(g.router)
+}
+
+// AdminMounter is implemented by packages with admin control endpoints.
+type AdminMounter interface {
+	RegisterAdmin(r *mux.Router)
+}
+
+// MountAdmin adds m's admin endpoints, which answer only the requests
+// the SetAdminAuth middleware lets through, and none without it.
+func (g *Gateway) MountAdmin(m AdminMounter) {
+	m.RegisterAdmin(g.admin)
+}
+
+// UnguardedAdminRoutes lists the routes under /admin/, as "METHOD path",
+// that were mounted with Mount rather than MountAdmin and so answer
+// without SetAdminAuth.
+func (g *Gateway) UnguardedAdminRoutes() []string {
+	var out []string
+	g.router.Walk(func(route *mux.Route, router *mux.Router, _ []*mux.Route) error {
+		tpl, err := route.GetPathTemplate()
+		if err != nil || router == g.admin || tpl != "/admin" && !strings.HasPrefix(tpl, "/admin/") {
+			return nil
+		}
+		methods, _ := route.GetMethods()
+		if len(methods) == 0 {
+			methods = []string{"*"}
+		}
+		for _, m := range methods {
+			out = append(out, m+" "+tpl)
+		}
+		return nil
+	})
+	return out
+}
+
+// SetAdminAuth sets the middleware that authorizes admin requests.
+func (g *Gateway) SetAdminAuth(mw func(http.Handler) http.Handler) {
+	g.adminAuth = mw
+}
+
+func (g *Gateway) requireAdmin(next http.Handler) http.Handler {
+	if g.adminAuth != nil {
+		return g.adminAuth(next)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "forbidden", http.StatusForbidden)
+	})
+}
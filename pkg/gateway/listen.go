@@ -0,0 +1,107 @@
+package gateway
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"sync"
+)
+
+// Listen opens addr, which is host:port or unix:/path, or several of them
+// separated by commas, accepting on all: "0.0.0.0:8080,[::]:8080" serves
+// both stacks where IPv6 sockets are IPv6-only.  Elsewhere ":8080" is
+// dual-stack already.  A socket file left behind by a previous run is
+// replaced.
+func Listen(addr string) (net.Listener, error) {
+	addrs := strings.Split(addr, ",")
+	if len(addrs) == 1 {
+		return listen(addr)
+	}
+	ls := make([]net.Listener, 0, len(addrs))
+	for _, a := range addrs {
+		l, err := listen(strings.TrimSpace(a))
+		if err != nil {
+			for _, l := range ls {
+				l.Close()
+			}
+			return nil, err
+		}
+		ls = append(ls, l)
+	}
+	return newMultiListener(ls), nil
+}
+
+func listen(addr string) (net.Listener, error) {
+	path, ok := strings.CutPrefix(addr, "unix:")
+	if !ok {
+		return net.Listen("tcp", addr)
+	}
+	if fi, err := os.Stat(path); err == nil && fi.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	return net.Listen("unix", path)
+}
+
+type accepted struct {
+	conn net.Conn
+	err  error
+}
+
+// multiListener accepts on several listeners.  Its address is the first
+// one's.
+type multiListener struct {
+	ls     []net.Listener
+	conns  chan accepted
+	closed chan struct{}
+	once   sync.Once
+}
+
+func newMultiListener(ls []net.Listener) *multiListener {
+	m := &multiListener{ls: ls, conns: make(chan accepted), closed: make(chan struct{})}
+	for _, l := range ls {
+		go m.accept(l)
+	}
+	return m
+}
+
+func (m *multiListener) accept(l net.Listener) {
+	for {
+		c, err := l.Accept()
+		select {
+		case m.conns <- accepted{c, err}:
+		case <-m.closed:
+			if c != nil {
+				c.Close()
+			}
+			return
+		}
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
+	}
+}
+
+func (m *multiListener) Accept() (net.Conn, error) {
+	select {
+	case a := <-m.conns:
+		return a.conn, a.err
+	case <-m.closed:
+		return nil, net.ErrClosed
+	}
+}
+
+func (m *multiListener) Close() error {
+	var err error
+	m.once.Do(func() {
+		close(m.closed)
+		for _, l := range m.ls {
+			err = errors.Join(err, l.Close())
+		}
+	})
+	return err
+}
+
+func (m *multiListener) Addr() net.Addr {
+	return m.ls[0].Addr()
+}
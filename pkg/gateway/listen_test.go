@@ -0,0 +1,135 @@
+package gateway
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+)
+
+// serve answers every request on l with "ok" until the test ends.
+func serve(t *testing.T, l net.Listener) {
+	t.Helper()
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "ok")
+	})}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+}
+
+func get(t *testing.T, c *http.Client, url string) {
+	t.Helper()
+	resp, err := c.Get(url)
+	if err != nil {
+		t.Fatalf("GET %s: %v", url, err)
+	}
+	defer resp.Body.Close()
+	body, _ := io.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusOK || string(body) != "ok" {
+		t.Fatalf("GET %s: %d %q", url, resp.StatusCode, body)
+	}
+}
+
+func skipWithoutIPv6(t *testing.T) {
+	t.Helper()
+	l, err := net.Listen("tcp6", "[::1]:0")
+	if err != nil {
+		t.Skipf("no IPv6 loopback: %v", err)
+	}
+	l.Close()
+}
+
+func TestListen(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		addr string
+		ipv6 bool
+	}{
+		{"IPv4 loopback", "127.0.0.1:0", false},
+		{"IPv6 loopback", "[::1]:0", true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if tc.ipv6 {
+				skipWithoutIPv6(t)
+			}
+			l, err := Listen(tc.addr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			serve(t, l)
+			get(t, http.DefaultClient, "http://"+l.Addr().String()+"/")
+		})
+	}
+}
+
+func TestListenSeveral(t *testing.T) {
+	skipWithoutIPv6(t)
+	l, err := Listen("127.0.0.1:0, [::1]:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	m, ok := l.(*multiListener)
+	if !ok {
+		t.Fatalf("Listen returned a %T", l)
+	}
+	serve(t, l)
+	if len(m.ls) != 2 {
+		t.Fatalf("listening on %d addresses, want 2", len(m.ls))
+	}
+	if got := l.Addr().String(); got != m.ls[0].Addr().String() {
+		t.Errorf("Addr() = %s, want the first address %s", got, m.ls[0].Addr())
+	}
+	for _, sub := range m.ls {
+		get(t, http.DefaultClient, "http://"+sub.Addr().String()+"/")
+	}
+}
+
+func TestListenSeveralFailsWhole(t *testing.T) {
+	taken, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer taken.Close()
+	free, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	freeAddr := free.Addr().String()
+	free.Close()
+
+	if l, err := Listen(freeAddr + "," + taken.Addr().String()); err == nil {
+		l.Close()
+		t.Fatal("Listen succeeded on an address in use")
+	}
+	// The address opened before the failure was released.
+	l, err := net.Listen("tcp", freeAddr)
+	if err != nil {
+		t.Fatalf("%s still in use: %v", freeAddr, err)
+	}
+	l.Close()
+}
+
+func TestListenUnixReplacesStaleSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "mrvaserver.sock")
+	stale, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.SetUnlinkOnClose(false)
+	stale.Close()
+
+	l, err := Listen("unix:" + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serve(t, l)
+	c := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	defer c.CloseIdleConnections()
+	get(t, c, "http://mrvaserver/")
+}
@@ -0,0 +1,65 @@
+package gateway
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"strconv"
+
+	"mrvaserver/pkg/store"
+)
+
+const nsMetadataVersions = "session-metadata-versions" // session -> counter
+
+// MetadataVersions counts, per session, the writes to what status
+// documents take from the metadata store rather than the server state:
+// tags and notes, baselines, limits and budgets, encryption, samples and
+// ULIDs.  The packages keeping them touch a session whenever they change
+// it, and the session ETag covers the count, so conditional requests and
+// cached documents see the change.
+type MetadataVersions struct {
+	store store.Store
+}
+
+func NewMetadataVersions(s store.Store) *MetadataVersions {
+	return &MetadataVersions{store: s}
+}
+
+// Touch records that the metadata of sessions changed.  A failure is
+// logged.  A nil MetadataVersions does nothing.
+func (m *MetadataVersions) Touch(ctx context.Context, sessions ...int) {
+	if m == nil {
+		return
+	}
+	for _, id := range sessions {
+		err := store.UpdateJSON(ctx, m.store, nsMetadataVersions, strconv.Itoa(id), func(n *int64, _ bool) error {
+			*n++
+			return nil
+		})
+		if err != nil {
+			slog.Warn("Failed to record session metadata change", "session", id, "error", err)
+		}
+	}
+}
+
+// version returns how often the session's metadata changed.
+func (m *MetadataVersions) version(ctx context.Context, session int) (int64, error) {
+	var n int64
+	err := store.GetJSON(ctx, m.store, nsMetadataVersions, strconv.Itoa(session), &n)
+	if errors.Is(err, store.ErrNotFound) {
+		return 0, nil
+	}
+	return n, err
+}
+
+// SetMetadataVersions makes session ETags cover the metadata counted in m.
+func (g *Gateway) SetMetadataVersions(m *MetadataVersions) {
+	g.metaVersions = m
+}
+
+// EstimatesVersioner is implemented by estimators whose progress
+// estimates, such as dispatch.Dispatcher's, change as the queue moves.
+// The ETags of in-progress sessions then change with them.
+type EstimatesVersioner interface {
+	EstimatesVersion() int64
+}
@@ -0,0 +1,33 @@
+package gateway
+
+import (
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/web"
+)
+
+// controllerRepoID derives a stable positive ID from a controller repo's full
+// name.  The commander ignores the controller repo entirely, but the
+// extension needs an ID to build /repositories/{id}/... URLs.
+func controllerRepoID(fullName string) int {
+	h := fnv.New32a()
+	h.Write([]byte(fullName))
+	return int(h.Sum32() & 0x7fffffff)
+}
+
+func (g *Gateway) ControllerRepo(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	fullName := fmt.Sprintf("%s/%s", vars["owner"], vars["repo"])
+	web.WriteJSON(w, http.StatusOK, api.Repository{
+		ID:        controllerRepoID(fullName),
+		Name:      vars["repo"],
+		FullName:  fullName,
+		Private:   false,
+		UpdatedAt: time.Now().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,107 @@
+package gateway
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/web"
+)
+
+func (g *Gateway) RepoTaskID(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionID, err := strconv.Atoi(vars["codeql_variant_analysis_id"])
+	if err != nil {
+		slog.Error("Variant analysis ID is not an integer", "id", vars["codeql_variant_analysis_id"])
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	repoID, err := strconv.Atoi(vars["repository_id"])
+	if err != nil {
+		slog.Error("Repository ID is not an integer", "id", vars["repository_id"])
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	js, err := g.shardJob(sessionID, repoID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	g.repoTaskCommon(w, r, repoID, js)
+}
+
+// RepoTaskNWO serves the owner/repo form.  Unlike the commander, which
+// reports repo ID -1 here, the job list is searched so that the ID agrees
+// with the status response.
+func (g *Gateway) RepoTaskNWO(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	sessionID, err := strconv.Atoi(vars["codeql_variant_analysis_id"])
+	if err != nil {
+		slog.Error("Variant analysis ID is not an integer", "id", vars["codeql_variant_analysis_id"])
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	nwo := common.NameWithOwner{Owner: vars["repo_owner"], Repo: vars["repo_name"]}
+
+	// Shards without jobs have no job list; other sessions must.
+	shards := g.shardsOf(sessionID)
+	offset := 0
+	for _, id := range shards {
+		jobs, err := g.v.State.GetJobList(id)
+		if err != nil && len(shards) == 1 {
+			http.Error(w, errNoSession.Error(), http.StatusNotFound)
+			return
+		}
+		for repoID, job := range jobs {
+			if job.Spec.NameWithOwner == nwo {
+				g.repoTaskCommon(w, r, offset+repoID, job.Spec)
+				return
+			}
+		}
+		offset += len(jobs)
+	}
+	http.Error(w, fmt.Sprintf("repository %s/%s not part of session %d", nwo.Owner, nwo.Repo, sessionID),
+		http.StatusNotFound)
+}
+
+func (g *Gateway) repoTaskCommon(w http.ResponseWriter, r *http.Request, repoID int, js common.JobSpec) {
+	if etag, ok := g.sessionETag(js.SessionID); ok && web.NotModified(w, r, etag) {
+		return
+	}
+
+	var updatedAt string
+	if ji, err := g.v.State.GetJobInfo(js); err == nil {
+		updatedAt = ji.UpdatedAt
+	}
+
+	task, err := g.repoTask(repoID, js, updatedAt, true)
+	if err != nil {
+		slog.Error("Error building repo task response", "job", js, "error", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+
+	if err := setArtifactURL(r, js, &task); err != nil {
+		http.Error(w, "Failed to encode job spec", http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSONTagged(w, r, http.StatusOK, task)
+}
+
+// setArtifactURL points a succeeded task at its result's download.
+func setArtifactURL(r *http.Request, js common.JobSpec, task *api.RepoTask) error {
+	if task.AnalysisStatus != api.RepoStatusSucceeded {
+		return nil
+	}
+	encoded, err := common.EncodeJobSpec(js)
+	if err != nil {
+		return err
+	}
+	task.ArtifactURL = fmt.Sprintf("%s/download/%s", web.ExternalBase(r), encoded)
+	return nil
+}
@@ -0,0 +1,288 @@
+package gateway
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/gorilla/mux"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/flags"
+	"mrvaserver/pkg/web"
+)
+
+// ShardsHeader lists the sessions a sharded submission was split into,
+// parent first.
+const ShardsHeader = "X-MRVA-Shards"
+
+// shardWorkers bounds how many shards of a session are read at once for
+// its status.
+const shardWorkers = 8
+
+var sessionSharding = flags.Define("session-sharding",
+	"Split submissions of more than sessions.shard_size repositories into shards.", true)
+
+// ShardMap records the sessions sharded submissions are split into.
+type ShardMap interface {
+	// RecordShards records shards, parent first, as one submission's.
+	RecordShards(ctx context.Context, shards []int) error
+	// Shards returns the shards of a parent session, itself first, or nil
+	// for a session that was not split.
+	Shards(ctx context.Context, session int) ([]int, error)
+	// RecordSkipped records the repositories skipped by a shard left with
+	// no jobs, whose status cannot report them.
+	RecordSkipped(ctx context.Context, shard int, skipped common.SkippedRepositories) error
+	// Skipped returns what RecordSkipped recorded for a shard, if anything.
+	Skipped(ctx context.Context, shard int) (common.SkippedRepositories, error)
+}
+
+// SetSessions applies cfg's limits to submissions.  Shards are recorded in
+// m, which may be nil without a shard size.
+func (g *Gateway) SetSessions(cfg config.Sessions, m ShardMap) {
+	g.sessions, g.shardMap = cfg, m
+}
+
+// Sessions returns every session the submission created: its shards if it
+// was split, its one session otherwise.  After functions that record
+// per-session state, such as keys, record it for each.
+func (sub *Submission) Sessions() []int {
+	if sub.Shards != nil {
+		return sub.Shards
+	}
+	if sub.Session == 0 {
+		return nil
+	}
+	return []int{sub.Session}
+}
+
+// splits reports whether a submission of n repositories by the client
+// of r is split into shards.
+func (g *Gateway) splits(r *http.Request, n int) bool {
+	size := g.sessions.ShardSize
+	return size > 0 && n > size && g.shardMap != nil && g.on(r, sessionSharding)
+}
+
+// shardsOf returns the shards of session, or just session.
+func (g *Gateway) shardsOf(session int) []int {
+	if g.shardMap == nil {
+		return []int{session}
+	}
+	shards, err := g.shardMap.Shards(context.Background(), session)
+	if err != nil {
+		slog.Warn("Failed to look up session shards", "session", session, "error", err)
+	}
+	if len(shards) == 0 {
+		return []int{session}
+	}
+	return shards
+}
+
+// forward sends msg to the commander and returns the new session's ID, or
+// 0 if the commander refused it.
+func (g *Gateway) forward(w http.ResponseWriter, r *http.Request, msg common.SubmitMsg) (int, error) {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return 0, err
+	}
+	r = r.Clone(r.Context())
+	r.Body = io.NopCloser(bytes.NewReader(body))
+	r.ContentLength = int64(len(body))
+	r.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	rec := &submitRecorder{ResponseWriter: w, status: http.StatusOK}
+	g.proxy.ServeHTTP(rec, r)
+	return rec.session(), nil
+}
+
+// submitShards submits sub as sessions of at most ShardSize repositories
+// each and answers with the parent's status.  Should a shard fail, the
+// ones submitted are kept, and recorded, and the failure is answered.
+func (g *Gateway) submitShards(w http.ResponseWriter, r *http.Request, sub *Submission) {
+	repos, size := sub.Msg.Repositories, g.sessions.ShardSize
+	var shards []int
+	for start := 0; start < len(repos); start += size {
+		msg := sub.Msg
+		msg.Repositories = repos[start:min(start+size, len(repos))]
+		rec := httptest.NewRecorder()
+		id, err := g.forward(rec, r, msg)
+		if err == nil && id == 0 {
+			err = fmt.Errorf("commander answered %d: %s", rec.Code, strings.TrimSpace(rec.Body.String()))
+		}
+		if err != nil {
+			slog.Error("Failed to submit shard", "shard", len(shards), "submitted", shards, "error", err)
+			g.recordShards(shards)
+			sub.Shards = shards
+			if len(shards) > 0 {
+				sub.Session = shards[0]
+			}
+			w.Header().Set(ShardsHeader, shardList(shards))
+			http.Error(w, fmt.Sprintf("submitted %d of %d shards: %v", len(shards),
+				(len(repos)+size-1)/size, err), http.StatusBadGateway)
+			return
+		}
+		shards = append(shards, id)
+		if jobs, err := g.v.State.GetJobList(id); err != nil || len(jobs) == 0 {
+			g.recordSkipped(id, rec.Body.Bytes())
+		}
+	}
+	g.recordShards(shards)
+	sub.Session, sub.Shards = shards[0], shards
+	slog.Info("Submission split into shards", "session", shards[0], "shards", len(shards),
+		"repositories", len(repos))
+
+	va, err := g.variantAnalysis(shards[0], controllerOf(r))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set(ShardsHeader, shardList(shards))
+	web.WriteJSONStream(w, http.StatusOK, statusRows(va))
+}
+
+func (g *Gateway) recordShards(shards []int) {
+	if len(shards) < 2 {
+		return
+	}
+	if err := g.shardMap.RecordShards(context.Background(), shards); err != nil {
+		slog.Error("Failed to record session shards", "shards", shards, "error", err)
+	}
+}
+
+// recordSkipped records the repositories a shard's submit response
+// reports skipped.
+func (g *Gateway) recordSkipped(shard int, body []byte) {
+	var resp struct {
+		SkippedRepositories common.SkippedRepositories `json:"skipped_repositories"`
+	}
+	if err := json.Unmarshal(body, &resp); err != nil {
+		slog.Warn("Failed to read the skipped repositories of a shard", "shard", shard, "error", err)
+		return
+	}
+	if err := g.shardMap.RecordSkipped(context.Background(), shard, resp.SkippedRepositories); err != nil {
+		slog.Error("Failed to record the skipped repositories of a shard", "shard", shard, "error", err)
+	}
+}
+
+func shardList(shards []int) string {
+	ss := make([]string, len(shards))
+	for i, id := range shards {
+		ss[i] = strconv.Itoa(id)
+	}
+	return strings.Join(ss, ",")
+}
+
+// controllerOf returns the controller repository a request names.
+func controllerOf(r *http.Request) api.Repository {
+	vars := mux.Vars(r)
+	if id, err := strconv.Atoi(vars["controller_repo_id"]); err == nil {
+		return api.Repository{ID: id}
+	}
+	fullName := vars["owner"] + "/" + vars["repo"]
+	return api.Repository{ID: controllerRepoID(fullName), Name: vars["repo"], FullName: fullName}
+}
+
+// shardDoc is one shard's part of a session document.
+type shardDoc struct {
+	va       api.VariantAnalysis
+	statuses []string
+	err      error
+}
+
+// shardedDoc assembles the document of a session split into shards, a few
+// shards at a time.  Repo IDs run on from one shard to the next.
+func (g *Gateway) shardedDoc(shards []int, controller api.Repository) (api.VariantAnalysis, []string, error) {
+	docs := make([]shardDoc, len(shards))
+	sem := make(chan struct{}, shardWorkers)
+	var wg sync.WaitGroup
+	for i, id := range shards {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			d := &docs[i]
+			d.va, d.statuses, d.err = g.sessionDoc(id, controller)
+		}()
+	}
+	wg.Wait()
+
+	// A shard none of whose repositories has a database has no jobs, and
+	// so no session in the state; its skipped repositories were recorded
+	// when it was submitted.
+	var va api.VariantAnalysis
+	var statuses []string
+	var offset int
+	var skipped common.SkippedRepositories
+	for i, d := range docs {
+		if errors.Is(d.err, errNoSession) {
+			s, err := g.shardMap.Skipped(context.Background(), shards[i])
+			if err != nil {
+				return api.VariantAnalysis{}, nil, fmt.Errorf("shard %d (session %d): %w", i, shards[i], err)
+			}
+			addSkipped(&skipped, s)
+			continue
+		}
+		if d.err != nil {
+			return api.VariantAnalysis{}, nil, fmt.Errorf("shard %d (session %d): %w", i, shards[i], d.err)
+		}
+		addSkipped(&skipped, d.va.SkippedRepositories)
+		if va.ID == 0 {
+			va = d.va
+			va.ID, va.Shards = shards[0], shards
+			statuses, offset = d.statuses, len(d.va.ScannedRepositories)
+			continue
+		}
+		for _, sr := range d.va.ScannedRepositories {
+			sr.Repository.ID += offset
+			va.ScannedRepositories = append(va.ScannedRepositories, sr)
+		}
+		offset += len(d.va.ScannedRepositories)
+		statuses = append(statuses, d.statuses...)
+		if d.va.UpdatedAt > va.UpdatedAt {
+			va.UpdatedAt = d.va.UpdatedAt
+		}
+	}
+	if va.ID == 0 {
+		return va, nil, errNoSession
+	}
+	va.SkippedRepositories = normalizeSkipped(skipped)
+	return va, statuses, nil
+}
+
+// addSkipped adds a shard's skipped repositories to those of its session.
+func addSkipped(skipped *common.SkippedRepositories, s common.SkippedRepositories) {
+	skipped.AccessMismatchRepos.Repositories = append(skipped.AccessMismatchRepos.Repositories, s.AccessMismatchRepos.Repositories...)
+	skipped.AccessMismatchRepos.RepositoryCount += s.AccessMismatchRepos.RepositoryCount
+	skipped.NotFoundRepos.RepositoryFullNames = append(skipped.NotFoundRepos.RepositoryFullNames, s.NotFoundRepos.RepositoryFullNames...)
+	skipped.NotFoundRepos.RepositoryCount += s.NotFoundRepos.RepositoryCount
+	skipped.NoCodeqlDBRepos.Repositories = append(skipped.NoCodeqlDBRepos.Repositories, s.NoCodeqlDBRepos.Repositories...)
+	skipped.NoCodeqlDBRepos.RepositoryCount += s.NoCodeqlDBRepos.RepositoryCount
+	skipped.OverLimitRepos.Repositories = append(skipped.OverLimitRepos.Repositories, s.OverLimitRepos.Repositories...)
+	skipped.OverLimitRepos.RepositoryCount += s.OverLimitRepos.RepositoryCount
+}
+
+// shardJob finds a parent session's repo ID among its shards.
+func (g *Gateway) shardJob(session, repoID int) (common.JobSpec, error) {
+	shards := g.shardsOf(session)
+	if len(shards) == 1 {
+		return g.v.State.GetJobSpecByRepoId(session, repoID)
+	}
+	local := repoID
+	for _, id := range shards {
+		jobs, _ := g.v.State.GetJobList(id)
+		if local < len(jobs) {
+			return jobs[local].Spec, nil
+		}
+		local -= len(jobs)
+	}
+	return common.JobSpec{}, fmt.Errorf("no repository with ID %d in session %d", repoID, session)
+}
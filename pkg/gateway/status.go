@@ -0,0 +1,435 @@
+package gateway
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/web"
+)
+
+var errNoSession = errors.New("no jobs found for given session id")
+
+const (
+	// maxStatusWait bounds the ?wait= parameter of status requests.
+	maxStatusWait = time.Minute
+
+	versionedPollInterval   = 500 * time.Millisecond
+	unversionedPollInterval = 2 * time.Second
+	watchedPollInterval     = 10 * time.Second
+)
+
+// SessionVersioner is implemented by states that keep a per-session counter
+// changing with every write to the session, such as pgstate.PGState.  The
+// status endpoints then answer conditional requests without reading the
+// session.  States without it get ETags computed from the response body.
+type SessionVersioner interface {
+	SessionVersion(sessionID int) (int64, error)
+}
+
+// SessionWatcher is implemented by states that can notify of writes to a
+// session, such as etcdstate.EtcdState.  Long-poll status requests then
+// wake on changes rather than polling for them.  A nil channel means the
+// state cannot, as when a cache wraps a state without watches.
+type SessionWatcher interface {
+	WatchSession(ctx context.Context, sessionID int) <-chan struct{}
+}
+
+// sessionETag returns the ETag of responses built from the session's state
+// and metadata, if the state keeps session versions.
+func (g *Gateway) sessionETag(sessionID int) (string, bool) {
+	sv, ok := g.v.State.(SessionVersioner)
+	if !ok {
+		return "", false
+	}
+	shards := g.shardsOf(sessionID)
+	var tag strings.Builder
+	for i, id := range shards {
+		version, err := sv.SessionVersion(id)
+		if err != nil {
+			return "", false
+		}
+		if i == 0 {
+			fmt.Fprintf(&tag, `"s%d-v%d`, id, version)
+		} else {
+			fmt.Fprintf(&tag, ".%d", version)
+		}
+	}
+	if g.metaVersions != nil {
+		for i, id := range shards {
+			version, err := g.metaVersions.version(context.Background(), id)
+			if err != nil {
+				return "", false
+			}
+			if i == 0 {
+				fmt.Fprintf(&tag, "-m%d", version)
+			} else {
+				fmt.Fprintf(&tag, ".%d", version)
+			}
+		}
+	}
+	return tag.String() + `"`, true
+}
+
+// progressETag returns the ETag of an in-progress session's status, whose
+// estimates change as the queue moves, given its session ETag.  Terminal
+// sessions have no estimates and keep the session ETag.
+func (g *Gateway) progressETag(etag string) string {
+	ev, ok := g.estimator.(EstimatesVersioner)
+	if !ok {
+		return etag
+	}
+	return fmt.Sprintf(`%s-e%d"`, strings.TrimSuffix(etag, `"`), ev.EstimatesVersion())
+}
+
+func (g *Gateway) StatusNWO(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	fullName := fmt.Sprintf("%s/%s", vars["owner"], vars["repo"])
+	controller := api.Repository{
+		ID:       controllerRepoID(fullName),
+		Name:     vars["repo"],
+		FullName: fullName,
+	}
+	g.statusCommon(w, r, controller, vars["codeql_variant_analysis_id"])
+}
+
+func (g *Gateway) StatusID(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, err := strconv.Atoi(vars["controller_repo_id"])
+	if err != nil {
+		slog.Error("Controller repository ID is not an integer", "id", vars["controller_repo_id"])
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	g.statusCommon(w, r, api.Repository{ID: id}, vars["codeql_variant_analysis_id"])
+}
+
+func (g *Gateway) statusCommon(w http.ResponseWriter, r *http.Request, controller api.Repository, variantAnalysisID string) {
+	sessionID, err := strconv.Atoi(variantAnalysisID)
+	if err != nil {
+		slog.Error("Variant analysis ID is not integer", "id", variantAnalysisID)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	if s := r.URL.Query().Get("wait"); s != "" {
+		wait, err := time.ParseDuration(s)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid wait: %v", err), http.StatusBadRequest)
+			return
+		}
+		if !g.awaitChange(r, sessionID, controller, min(wait, maxStatusWait)) {
+			return
+		}
+	}
+
+	// Only terminal sessions are cached, so a cached document is one to
+	// mark cacheable.  A client holding the session ETag was sent a
+	// terminal document.
+	key := statusKey(sessionID, controller)
+	etag, versioned := g.sessionETag(sessionID)
+	if versioned {
+		if body, ok := g.statuses.get(key, etag); ok {
+			statusCacheTotal.With("hit").Inc()
+			g.cacheable(w)
+			if !web.NotModified(w, r, etag) {
+				writeStatus(w, body)
+			}
+			return
+		}
+		if web.NotModified(w, r, etag) {
+			return
+		}
+		if progress := g.progressETag(etag); progress != etag && web.NotModified(w, r, progress) {
+			return
+		}
+	}
+
+	va, err := g.variantAnalysis(sessionID, controller)
+	if errors.Is(err, errNoSession) {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		slog.Error("Error building status response", "id", sessionID, "error", err)
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if va.Status == api.StatusInProgress {
+		web.WriteJSONTagged(w, r, http.StatusOK, statusRows(va))
+		return
+	}
+	if versioned {
+		w.Header().Set("ETag", etag)
+	}
+	g.cacheable(w)
+	if g.statuses == nil || !versioned {
+		web.WriteJSONTagged(w, r, http.StatusOK, statusRows(va))
+		return
+	}
+	body, err := json.Marshal(va)
+	if err != nil {
+		slog.Error("Error encoding response as JSON", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	statusCacheTotal.With("miss").Inc()
+	g.statuses.put(key, etag, body)
+	writeStatus(w, body)
+}
+
+// awaitChange holds a long-poll request until the session's ETag differs
+// from the client's If-None-Match (or, without one, from the ETag when the
+// request arrived) or wait elapses.  It returns false if the client went
+// away.
+func (g *Gateway) awaitChange(r *http.Request, sessionID int, controller api.Repository, wait time.Duration) bool {
+	// current returns the ETags the session's status may carry now: the
+	// session ETag and, while in progress, the one covering estimates.
+	current := func() []string {
+		if etag, ok := g.sessionETag(sessionID); ok {
+			return []string{g.progressETag(etag), etag}
+		}
+		va, err := g.variantAnalysis(sessionID, controller)
+		if err != nil {
+			return nil
+		}
+		etag, _ := web.BodyETag(statusRows(va))
+		return []string{etag}
+	}
+	// Without session versions every check rebuilds the session, so check
+	// less often.
+	interval := versionedPollInterval
+	if _, ok := g.v.State.(SessionVersioner); !ok {
+		interval = unversionedPollInterval
+	}
+	// With a watch, polling only covers notifications that went missing.
+	// The watch covers one session, not the shards of one.
+	var changed <-chan struct{}
+	if sw, ok := g.v.State.(SessionWatcher); ok && len(g.shardsOf(sessionID)) == 1 {
+		if changed = sw.WatchSession(r.Context(), sessionID); changed != nil {
+			interval = watchedPollInterval
+		}
+	}
+
+	seen := r.Header.Get("If-None-Match")
+	if seen == "" {
+		if tags := current(); len(tags) > 0 {
+			seen = tags[0]
+		}
+	}
+	deadline := time.Now().Add(wait)
+	for {
+		if !slices.Contains(current(), seen) || time.Now().After(deadline) {
+			return true
+		}
+		select {
+		case <-r.Context().Done():
+			return false
+		case <-changed:
+		case <-time.After(min(interval, time.Until(deadline))):
+		}
+	}
+}
+
+// statusRows streams a status document a repository at a time.
+func statusRows(va api.VariantAnalysis) web.Rows {
+	repos := va.ScannedRepositories
+	va.ScannedRepositories = []api.ScannedRepository{}
+	return web.Rows{Head: va, Key: "scanned_repositories", Each: func(a *web.ArrayWriter) error {
+		for _, sr := range repos {
+			if err := a.Write(sr); err != nil {
+				return err
+			}
+		}
+		return nil
+	}}
+}
+
+// variantAnalysis assembles the session document from server state.  Repo IDs
+// are job list indices, matching the commander's GetJobSpecByRepoId; a
+// session split into shards lists the repositories of all of them.
+func (g *Gateway) variantAnalysis(sessionID int, controller api.Repository) (api.VariantAnalysis, error) {
+	var va api.VariantAnalysis
+	var statuses []string
+	var err error
+	if shards := g.shardsOf(sessionID); len(shards) > 1 {
+		va, statuses, err = g.shardedDoc(shards, controller)
+	} else {
+		va, statuses, err = g.sessionDoc(sessionID, controller)
+	}
+	if err != nil {
+		return api.VariantAnalysis{}, err
+	}
+
+	va.Status, va.FailureReason = api.SessionStatus(statuses)
+	if va.Status != api.StatusInProgress {
+		va.CompletedAt = va.UpdatedAt
+		va.Outcome = api.SessionOutcome(va.ScannedRepositories)
+	}
+	for _, h := range g.variantAnalysisHooks {
+		h(&va)
+	}
+	return va, nil
+}
+
+// sessionDoc assembles one session's repositories and their statuses.
+func (g *Gateway) sessionDoc(sessionID int, controller api.Repository) (api.VariantAnalysis, []string, error) {
+	jobs, err := g.v.State.GetJobList(sessionID)
+	if err != nil {
+		return api.VariantAnalysis{}, nil, errNoSession
+	}
+
+	va := api.VariantAnalysis{
+		ID:                   sessionID,
+		ControllerRepo:       controller,
+		ActionsWorkflowRunID: -1,
+		ScannedRepositories:  []api.ScannedRepository{},
+		SkippedRepositories:  normalizeSkipped(common.SkippedRepositories{}),
+	}
+
+	var statuses []string
+	for jobRepoID, job := range jobs {
+		if jobRepoID == 0 {
+			ji, err := g.v.State.GetJobInfo(job.Spec)
+			if err != nil {
+				return api.VariantAnalysis{}, nil, fmt.Errorf("no job info for session %d: %w", sessionID, err)
+			}
+			va.QueryLanguage = ji.QueryLanguage
+			va.CreatedAt = ji.CreatedAt
+			va.UpdatedAt = ji.UpdatedAt
+			va.SkippedRepositories = normalizeSkipped(ji.SkippedRepositories)
+		}
+
+		task, err := g.repoTask(jobRepoID, job.Spec, va.UpdatedAt, false)
+		if err != nil {
+			return api.VariantAnalysis{}, nil, err
+		}
+		statuses = append(statuses, task.AnalysisStatus)
+		va.ScannedRepositories = append(va.ScannedRepositories, api.ScannedRepository{
+			Repository:          task.Repository,
+			AnalysisStatus:      task.AnalysisStatus,
+			ResultCount:         task.ResultCount,
+			SuppressedCount:     task.SuppressedCount,
+			ArtifactSizeInBytes: task.ArtifactSizeInBytes,
+			FailureMessage:      task.FailureMessage,
+			FailureCode:         task.FailureCode,
+		})
+	}
+	return va, statuses, nil
+}
+
+// VariantAnalysisHook completes a session's status document.
+type VariantAnalysisHook func(va *api.VariantAnalysis)
+
+// OnVariantAnalysis registers a hook run on every status document.
+func (g *Gateway) OnVariantAnalysis(h VariantAnalysisHook) {
+	g.variantAnalysisHooks = append(g.variantAnalysisHooks, h)
+}
+
+// RepoTaskHook completes a repo task as it is reported, for instance with
+// the failure message of a job the server itself failed.
+type RepoTaskHook func(js common.JobSpec, task *api.RepoTask)
+
+// OnRepoTask registers a hook run on every repo task, in status and repo
+// task responses alike.
+func (g *Gateway) OnRepoTask(h RepoTaskHook) {
+	g.repoTaskHooks = append(g.repoTaskHooks, h)
+}
+
+// ResultSizes knows the sizes of stored results, sparing the artifact
+// store a lookup per repository on every status request.
+type ResultSizes interface {
+	ResultSize(js common.JobSpec) (int, bool)
+}
+
+// SetResultSizes makes repo tasks take their artifact sizes from rs where
+// it knows them.
+func (g *Gateway) SetResultSizes(rs ResultSizes) {
+	g.sizes = rs
+}
+
+// repoTask assembles one repo task.  With withResult the stored result is
+// consulted for the database SHA and source prefix as well.
+func (g *Gateway) repoTask(jobRepoID int, js common.JobSpec, updatedAt string, withResult bool) (api.RepoTask, error) {
+	task, err := g.buildRepoTask(jobRepoID, js, updatedAt, withResult)
+	if err != nil {
+		return task, err
+	}
+	for _, h := range g.repoTaskHooks {
+		h(js, &task)
+	}
+	return task, nil
+}
+
+func (g *Gateway) buildRepoTask(jobRepoID int, js common.JobSpec, updatedAt string, withResult bool) (api.RepoTask, error) {
+	task := api.RepoTask{
+		Repository: api.Repository{
+			ID:        jobRepoID,
+			Name:      js.Repo,
+			FullName:  fmt.Sprintf("%s/%s", js.Owner, js.Repo),
+			UpdatedAt: updatedAt,
+		},
+	}
+
+	status, err := g.v.State.GetStatus(js)
+	if err != nil {
+		return api.RepoTask{}, fmt.Errorf("error getting status: %w", err)
+	}
+	task.AnalysisStatus = api.RepoStatus(status)
+	if task.AnalysisStatus == api.RepoStatusFailed {
+		// Hooks that know more name the failure.
+		task.FailureCode = apierr.AnalysisError
+	}
+	if status != common.StatusSuccess {
+		return task, nil
+	}
+
+	result, err := g.v.State.GetResult(js)
+	if err != nil {
+		return api.RepoTask{}, fmt.Errorf("error getting result: %w", err)
+	}
+	size, ok := 0, false
+	if g.sizes != nil {
+		size, ok = g.sizes.ResultSize(js)
+	}
+	if !ok {
+		if size, err = g.v.Artifacts.GetResultSize(result.ResultLocation); err != nil {
+			return api.RepoTask{}, fmt.Errorf("error getting artifact size: %w", err)
+		}
+	}
+	task.ResultCount = result.ResultCount
+	task.ArtifactSizeInBytes = size
+	if withResult {
+		task.DatabaseCommitSha = result.DatabaseSHA
+		task.SourceLocationPrefix = result.SourceLocationPrefix
+	}
+	return task, nil
+}
+
+// normalizeSkipped replaces nil lists, which encode as null, with empty ones.
+func normalizeSkipped(s common.SkippedRepositories) common.SkippedRepositories {
+	if s.AccessMismatchRepos.Repositories == nil {
+		s.AccessMismatchRepos.Repositories = []common.Repository{}
+	}
+	if s.NotFoundRepos.RepositoryFullNames == nil {
+		s.NotFoundRepos.RepositoryFullNames = []string{}
+	}
+	if s.NoCodeqlDBRepos.Repositories == nil {
+		s.NoCodeqlDBRepos.Repositories = []common.Repository{}
+	}
+	if s.OverLimitRepos.Repositories == nil {
+		s.OverLimitRepos.Repositories = []common.Repository{}
+	}
+	return s
+}
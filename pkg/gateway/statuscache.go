@@ -0,0 +1,107 @@
+package gateway
+
+import (
+	"container/list"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/metrics"
+)
+
+var statusCacheTotal = metrics.NewCounterVec("mrvaserver_status_cache_total",
+	"Status requests for terminal sessions, by whether a rendered document was reused.", "result")
+
+// statusCache keeps the rendered status documents of terminal sessions, most
+// recently used first, each under the session ETag it was rendered at.
+type statusCache struct {
+	mu      sync.Mutex
+	max     int
+	ttl     time.Duration
+	order   *list.List
+	entries map[string]*list.Element
+}
+
+type statusEntry struct {
+	key  string
+	etag string
+	body []byte
+	at   time.Time
+}
+
+// SetCaching makes status responses of terminal sessions cacheable by
+// clients and, with session versions, reuses their rendered documents.
+func (g *Gateway) SetCaching(cfg config.Caching) {
+	if !cfg.Enabled {
+		return
+	}
+	g.caching = cfg
+	if _, ok := g.v.State.(SessionVersioner); ok && cfg.Entries > 0 {
+		g.statuses = &statusCache{max: cfg.Entries, ttl: cfg.TTL, order: list.New(),
+			entries: make(map[string]*list.Element)}
+	}
+}
+
+// statusKey tells documents apart by what they are rendered from: the
+// session and the controller repository named in the request.
+func statusKey(sessionID int, controller api.Repository) string {
+	return fmt.Sprintf("%d/%d/%s", sessionID, controller.ID, controller.FullName)
+}
+
+// get returns the document rendered at etag, if it is still fresh.
+func (c *statusCache) get(key, etag string) ([]byte, bool) {
+	if c == nil {
+		return nil, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	e := el.Value.(*statusEntry)
+	if e.etag != etag || time.Since(e.at) > c.ttl {
+		c.order.Remove(el)
+		delete(c.entries, key)
+		return nil, false
+	}
+	c.order.MoveToFront(el)
+	return e.body, true
+}
+
+func (c *statusCache) put(key, etag string, body []byte) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.entries[key]; ok {
+		c.order.Remove(el)
+	}
+	c.entries[key] = c.order.PushFront(&statusEntry{key: key, etag: etag, body: body, at: time.Now()})
+	for c.order.Len() > c.max {
+		oldest := c.order.Back()
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*statusEntry).key)
+	}
+}
+
+// cacheable marks a terminal session's status response as reusable by the
+// client for the configured max-age.
+func (g *Gateway) cacheable(w http.ResponseWriter) {
+	if g.caching.Enabled && g.caching.MaxAge > 0 {
+		w.Header().Set("Cache-Control", "private, max-age="+strconv.Itoa(int(g.caching.MaxAge.Seconds())))
+	}
+}
+
+// writeStatus sends a rendered status document.
+func writeStatus(w http.ResponseWriter, body []byte) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+}
@@ -0,0 +1,217 @@
+package gateway
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/web"
+)
+
+// Submission is a variant analysis submission on its way to the commander.
+// Msg holds the fields the commander understands; Extra holds any other
+// top-level fields of the request body.  Submit hooks consume Extra entries
+// (deleting them) and adjust Msg.  Whatever remains in Extra when all hooks
+// have run is rejected, as the commander would.
+type Submission struct {
+	Msg   common.SubmitMsg
+	Extra map[string]json.RawMessage
+
+	// Session is the ID the commander assigned, for After functions; 0 if
+	// the submission failed.  A submission split into shards has them all
+	// in Shards, Session being the first; see Sessions.
+	Session int
+	Shards  []int
+
+	// Header holds the response's headers; hooks may add to it.
+	Header http.Header
+
+	// MaxRepositories, if a hook sets it, replaces sessions.max_repositories
+	// for this submission.
+	MaxRepositories int
+
+	after []func()
+}
+
+// SubmitHook inspects or rewrites a submission before it is forwarded.  An
+// error aborts the submission; return a *web.Error to pick the status code.
+type SubmitHook func(r *http.Request, sub *Submission) error
+
+// OnSubmit registers a hook run, in registration order, on every submission.
+func (g *Gateway) OnSubmit(h SubmitHook) {
+	g.submitHooks = append(g.submitHooks, h)
+}
+
+// After registers f to run once the submission has been forwarded and the
+// commander has responded, or once it has been rejected.
+func (sub *Submission) After(f func()) {
+	sub.after = append(sub.after, f)
+}
+
+func (sub *Submission) done() {
+	for i := len(sub.after) - 1; i >= 0; i-- {
+		sub.after[i]()
+	}
+}
+
+// TakeExtra decodes and removes the extension field name from sub.Extra.
+// It reports whether the field was present.
+func (sub *Submission) TakeExtra(name string, v any) (bool, error) {
+	raw, ok := sub.Extra[name]
+	if !ok {
+		return false, nil
+	}
+	delete(sub.Extra, name)
+	if err := json.Unmarshal(raw, v); err != nil {
+		return true, web.Msg(http.StatusBadRequest, "", "submit.invalid_field", messages.Params{"field": name, "error": err})
+	}
+	return true, nil
+}
+
+func parseSubmission(body []byte) (*Submission, error) {
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(body, &fields); err != nil {
+		return nil, err
+	}
+	sub := &Submission{Extra: make(map[string]json.RawMessage)}
+	for name, raw := range fields {
+		var err error
+		switch name {
+		case "action_repo_ref":
+			err = json.Unmarshal(raw, &sub.Msg.ActionRepoRef)
+		case "language":
+			err = json.Unmarshal(raw, &sub.Msg.Language)
+		case "query_pack":
+			err = json.Unmarshal(raw, &sub.Msg.QueryPack)
+		case "repositories":
+			err = json.Unmarshal(raw, &sub.Msg.Repositories)
+		default:
+			sub.Extra[name] = raw
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s: %w", name, err)
+		}
+	}
+	return sub, nil
+}
+
+// Submit runs the submit hooks and forwards the rewritten submission to the
+// commander, or, for a dry run, answers with an estimate instead.
+func (g *Gateway) Submit(w http.ResponseWriter, r *http.Request) {
+	if len(g.submitHooks) == 0 && g.sessions == (config.Sessions{}) {
+		g.proxy.ServeHTTP(w, r)
+		return
+	}
+
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sub, err := parseSubmission(body)
+	if err != nil {
+		slog.Error("Unknown MRVA submission body format", "err", err)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sub.Header = w.Header()
+	defer sub.done()
+	var dryRun bool
+	if _, err := sub.TakeExtra("dry_run", &dryRun); err != nil {
+		web.Fail(w, err, http.StatusBadRequest)
+		return
+	}
+
+	for _, h := range g.submitHooks {
+		if err := h(r, sub); err != nil {
+			slog.Warn("Submission rejected", "error", err)
+			web.Fail(w, err, http.StatusBadRequest)
+			return
+		}
+	}
+	if len(sub.Extra) > 0 {
+		var names []string
+		for name := range sub.Extra {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		web.Fail(w, web.Msg(http.StatusBadRequest, "", "submit.unknown_fields",
+			messages.Params{"fields": strings.Join(names, ", ")}), http.StatusBadRequest)
+		return
+	}
+
+	n := len(sub.Msg.Repositories)
+	max := g.sessions.MaxRepositories
+	if sub.MaxRepositories > 0 {
+		max = sub.MaxRepositories
+	}
+	if max > 0 && n > max {
+		web.Fail(w, web.Msg(http.StatusBadRequest, apierr.QuotaExceeded,
+			"submit.too_many_repositories", messages.Params{"n": n, "max": max}), http.StatusBadRequest)
+		return
+	}
+	if dryRun {
+		g.dryRun(w, r, sub)
+		return
+	}
+	if g.splits(r, n) {
+		g.submitShards(w, r, sub)
+		return
+	}
+
+	sub.Session, err = g.forward(w, r, sub.Msg)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// submitRecorder keeps a copy of the commander's response, to learn the
+// new session's ID.
+type submitRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+// maxSubmitResponse bounds the copy; the response is a short JSON
+// document.
+const maxSubmitResponse = 1 << 20
+
+func (sr *submitRecorder) WriteHeader(code int) {
+	sr.status = code
+	sr.ResponseWriter.WriteHeader(code)
+}
+
+func (sr *submitRecorder) Write(p []byte) (int, error) {
+	if sr.body.Len()+len(p) <= maxSubmitResponse {
+		sr.body.Write(p)
+	}
+	return sr.ResponseWriter.Write(p)
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sr *submitRecorder) Unwrap() http.ResponseWriter {
+	return sr.ResponseWriter
+}
+
+func (sr *submitRecorder) session() int {
+	if sr.status < 200 || sr.status >= 300 {
+		return 0
+	}
+	var resp struct {
+		ID int `json:"id"`
+	}
+	if err := json.Unmarshal(sr.body.Bytes(), &resp); err != nil {
+		return 0
+	}
+	return resp.ID
+}
@@ -0,0 +1,202 @@
+package gateway
+
+import (
+	"cmp"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/web"
+)
+
+const (
+	defaultPerPage = 100
+	maxPerPage     = 1000
+)
+
+// RepoTaskPage is a page of a session's repo tasks.
+type RepoTaskPage struct {
+	TotalCount   int            `json:"total_count"`
+	Repositories []api.RepoTask `json:"repositories"`
+}
+
+// taskSorts orders repo tasks by the sort parameter's keys; a leading "-"
+// reverses one.
+var taskSorts = map[string]func(a, b api.RepoTask) int{
+	"id":           func(a, b api.RepoTask) int { return a.Repository.ID - b.Repository.ID },
+	"name":         func(a, b api.RepoTask) int { return strings.Compare(a.Repository.FullName, b.Repository.FullName) },
+	"status":       func(a, b api.RepoTask) int { return strings.Compare(a.AnalysisStatus, b.AnalysisStatus) },
+	"result_count": func(a, b api.RepoTask) int { return a.ResultCount - b.ResultCount },
+	"duration":     func(a, b api.RepoTask) int { return cmp.Compare(a.DurationSeconds, b.DurationSeconds) },
+	"size":         func(a, b api.RepoTask) int { return a.ArtifactSizeInBytes - b.ArtifactSizeInBytes },
+}
+
+// RepoTasks serves a page of a session's repo tasks:
+//
+//	GET /variant-analyses/{id}/repos?status=failed,timed_out&sort=-result_count&page=2&per_page=100
+//
+// failure_code=AGENT_OOM,DB_CORRUPT keeps the failed tasks with those codes,
+// the categories of the session's outcome.
+//
+// Pages are numbered from 1, as on GitHub, and the Link header points at
+// the others.  Unfiltered and unsorted, only the page's tasks are read;
+// otherwise every task of the session is.
+func (g *Gateway) RepoTasks(w http.ResponseWriter, r *http.Request) {
+	sessionID, _ := strconv.Atoi(mux.Vars(r)["id"])
+	q := r.URL.Query()
+	page, perPage, err := pageParams(q)
+	if err != nil {
+		web.Fail(w, err, http.StatusBadRequest)
+		return
+	}
+	var statuses, codes []string
+	if s := q.Get("status"); s != "" {
+		statuses = strings.Split(s, ",")
+	}
+	if s := q.Get("failure_code"); s != "" {
+		codes = strings.Split(s, ",")
+	}
+	var order []func(a, b api.RepoTask) int
+	if s := q.Get("sort"); s != "" {
+		for _, key := range strings.Split(s, ",") {
+			desc := strings.HasPrefix(key, "-")
+			f, ok := taskSorts[strings.TrimPrefix(key, "-")]
+			if !ok {
+				http.Error(w, fmt.Sprintf("cannot sort by %q", key), http.StatusBadRequest)
+				return
+			}
+			if desc {
+				asc := f
+				f = func(a, b api.RepoTask) int { return asc(b, a) }
+			}
+			order = append(order, f)
+		}
+	}
+
+	jobs, err := g.sessionJobs(sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	var updatedAt string
+	if len(jobs) > 0 {
+		if ji, err := g.v.State.GetJobInfo(jobs[0]); err == nil {
+			updatedAt = ji.UpdatedAt
+		}
+	}
+	build := func(repoID int) (api.RepoTask, error) {
+		task, err := g.repoTask(repoID, jobs[repoID], updatedAt, false)
+		if err == nil {
+			err = setArtifactURL(r, jobs[repoID], &task)
+		}
+		return task, err
+	}
+
+	out := RepoTaskPage{Repositories: []api.RepoTask{}}
+	start := (page - 1) * perPage
+	if statuses == nil && codes == nil && order == nil {
+		out.TotalCount = len(jobs)
+		for id := start; id < min(start+perPage, len(jobs)); id++ {
+			task, err := build(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			out.Repositories = append(out.Repositories, task)
+		}
+	} else {
+		var all []api.RepoTask
+		for id := range jobs {
+			task, err := build(id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			if (statuses == nil || slices.Contains(statuses, task.AnalysisStatus)) &&
+				(codes == nil || slices.Contains(codes, task.FailureCode)) {
+				all = append(all, task)
+			}
+		}
+		slices.SortStableFunc(all, func(a, b api.RepoTask) int {
+			for _, f := range order {
+				if c := f(a, b); c != 0 {
+					return c
+				}
+			}
+			return 0
+		})
+		out.TotalCount = len(all)
+		if start < len(all) {
+			out.Repositories = all[start:min(start+perPage, len(all))]
+		}
+	}
+
+	name, err := web.SessionName(r.Context(), sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if links := pageLinks(r, "/variant-analyses/"+name+"/repos", page, perPage, out.TotalCount); links != "" {
+		w.Header().Set("Link", links)
+	}
+	web.WriteJSONTagged(w, r, http.StatusOK, out)
+}
+
+// sessionJobs returns the job specs of a session, of all its shards if it
+// was split, in repo ID order.
+func (g *Gateway) sessionJobs(sessionID int) ([]common.JobSpec, error) {
+	shards := g.shardsOf(sessionID)
+	var specs []common.JobSpec
+	for _, id := range shards {
+		jobs, err := g.v.State.GetJobList(id)
+		if err != nil && len(shards) == 1 {
+			return nil, errNoSession
+		}
+		for _, job := range jobs {
+			specs = append(specs, job.Spec)
+		}
+	}
+	return specs, nil
+}
+
+func pageParams(q url.Values) (page, perPage int, err error) {
+	page, perPage = 1, defaultPerPage
+	if s := q.Get("page"); s != "" {
+		if page, err = strconv.Atoi(s); err != nil || page < 1 {
+			return 0, 0, web.Msg(http.StatusBadRequest, "", "page.invalid", nil)
+		}
+	}
+	if s := q.Get("per_page"); s != "" {
+		if perPage, err = strconv.Atoi(s); err != nil || perPage < 1 || perPage > maxPerPage {
+			return 0, 0, web.Msg(http.StatusBadRequest, "", "page.per_page_invalid", messages.Params{"max": maxPerPage})
+		}
+	}
+	return page, perPage, nil
+}
+
+// pageLinks makes a GitHub-style Link header for the pages around page of
+// the listing at path.
+func pageLinks(r *http.Request, path string, page, perPage, total int) string {
+	last := max(1, (total+perPage-1)/perPage)
+	link := func(p int, rel string) string {
+		q := r.URL.Query()
+		q.Set("page", strconv.Itoa(p))
+		q.Set("per_page", strconv.Itoa(perPage))
+		return fmt.Sprintf(`<%s%s?%s>; rel="%s"`, web.ExternalBase(r), path, q.Encode(), rel)
+	}
+	var links []string
+	if page > 1 {
+		links = append(links, link(1, "first"), link(min(page-1, last), "prev"))
+	}
+	if page < last {
+		links = append(links, link(page+1, "next"), link(last, "last"))
+	}
+	return strings.Join(links, ", ")
+}
@@ -0,0 +1,103 @@
+// Package ingest applies agent results to server state in batches, and
+// summarizes their archives, or their failures, on the way.
+package ingest
+
+import (
+	"log/slog"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/hohn/mrvacommander/pkg/state"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/config"
+)
+
+// BatchApplier is implemented by states that can apply many results in one
+// transaction, such as pgstate.PGState.
+type BatchApplier interface {
+	ApplyResults(results []queue.AnalyzeResult) error
+}
+
+type pending struct {
+	result queue.AnalyzeResult
+	done   chan error
+}
+
+// Batcher groups results into batches of up to BatchSize, flushing at least
+// every FlushInterval.  Handle blocks until the result's batch is applied,
+// so queue messages are only acknowledged once their result is stored.
+type Batcher struct {
+	st       state.ServerState
+	in       chan pending
+	size     int
+	interval time.Duration
+}
+
+func NewBatcher(cfg config.Ingest, st state.ServerState) *Batcher {
+	b := &Batcher{
+		st:       st,
+		in:       make(chan pending, cfg.Buffer),
+		size:     cfg.BatchSize,
+		interval: cfg.FlushInterval,
+	}
+	if _, ok := st.(BatchApplier); !ok {
+		slog.Warn("State does not support batched writes, applying results one by one")
+	}
+	go b.run()
+	return b
+}
+
+// Handle is an agentproto.ResultHandler.
+func (b *Batcher) Handle(r agentproto.Result) error {
+	done := make(chan error, 1)
+	b.in <- pending{result: r.AnalyzeResult, done: done}
+	return <-done
+}
+
+func (b *Batcher) run() {
+	ticker := time.NewTicker(b.interval)
+	defer ticker.Stop()
+
+	var batch []pending
+	for {
+		select {
+		case p := <-b.in:
+			batch = append(batch, p)
+			if len(batch) < b.size {
+				continue
+			}
+		case <-ticker.C:
+			if len(batch) == 0 {
+				continue
+			}
+		}
+		b.flush(batch)
+		batch = nil
+	}
+}
+
+func (b *Batcher) flush(batch []pending) {
+	results := make([]queue.AnalyzeResult, len(batch))
+	for i, p := range batch {
+		results[i] = p.result
+	}
+
+	start := time.Now()
+	err := b.apply(results)
+	slog.Debug("Flushed result batch", "count", len(batch), "duration", time.Since(start), "error", err)
+
+	for _, p := range batch {
+		p.done <- err
+	}
+}
+
+func (b *Batcher) apply(results []queue.AnalyzeResult) error {
+	if ba, ok := b.st.(BatchApplier); ok {
+		return ba.ApplyResults(results)
+	}
+	for _, r := range results {
+		b.st.SetResult(r.Spec, r)
+		b.st.SetStatus(r.Spec, r.Status)
+	}
+	return nil
+}
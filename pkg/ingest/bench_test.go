@@ -0,0 +1,40 @@
+package ingest
+
+import (
+	"testing"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/fakeagent"
+	"mrvaserver/pkg/store"
+)
+
+// BenchmarkIngestResult summarizes a result of 1000 SARIF results as it
+// is ingested: the archive is read, its results counted and the summary
+// recorded.
+func BenchmarkIngestResult(b *testing.B) {
+	js := common.JobSpec{SessionID: 1, NameWithOwner: common.NameWithOwner{Owner: "owner", Repo: "repo"}}
+	archive, err := fakeagent.ResultsArchive(js, 1000)
+	if err != nil {
+		b.Fatal(err)
+	}
+	artifacts := artifactstore.NewInMemoryArtifactStore()
+	loc, err := artifacts.SaveResult(js, archive)
+	if err != nil {
+		b.Fatal(err)
+	}
+	m := NewSummarizer(store.NewMemoryStore())
+	m.SetArtifacts(artifacts)
+	handle := m.HandleResult(func(agentproto.Result) error { return nil })
+	r := agentproto.Result{AnalyzeResult: queue.AnalyzeResult{
+		Spec: js, Status: common.StatusSuccess, ResultCount: 1000, ResultLocation: loc}}
+	b.SetBytes(int64(len(archive)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := handle(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,98 @@
+package ingest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/store"
+)
+
+const nsApplied = "applied-results"
+
+var duplicateResults = metrics.NewCounterVec("mrvaserver_results_dropped_total",
+	"Results not applied because they repeat or predate one already applied.", "reason")
+
+// applied records which attempts of a job have had a result applied.
+type applied struct {
+	Attempts []int `json:"attempts"`
+
+	// Latest is the highest attempt applied and Status its status.
+	Latest int           `json:"latest"`
+	Status common.Status `json:"status"`
+}
+
+// AttemptFunc returns a job's current dispatch attempt, for results from
+// agents that do not report one.
+type AttemptFunc func(ctx context.Context, js common.JobSpec) (int, error)
+
+type skip string
+
+func (s skip) Error() string { return string(s) }
+
+// Dedup makes result application idempotent.  Each result is keyed by
+// session, repository and attempt; the key is claimed in the metadata
+// store before next runs, and released again if next fails, so a
+// redelivered message is applied at most once.  A result is also dropped if
+// it comes from an earlier attempt than one already applied, or if the job
+// already succeeded, so late deliveries never move a status backwards.
+func Dedup(s store.Store, attempt AttemptFunc, next agentproto.ResultHandler) agentproto.ResultHandler {
+	return func(r agentproto.Result) error {
+		ctx := context.Background()
+		n := r.Attempt
+		if n == 0 {
+			var err error
+			if n, err = attempt(ctx, r.Spec); err != nil {
+				return err
+			}
+		}
+		key := fmt.Sprintf("%d/%s/%s", r.Spec.SessionID, r.Spec.Owner, r.Spec.Repo)
+
+		var prev applied
+		var prevFound bool
+		err := store.UpdateJSON(ctx, s, nsApplied, key, func(a *applied, found bool) error {
+			prev, prevFound = *a, found
+			for _, seen := range a.Attempts {
+				if seen == n {
+					return skip("duplicate")
+				}
+			}
+			if found && n < a.Latest {
+				return skip("stale")
+			}
+			if found && a.Status == common.StatusSuccess {
+				return skip("already_succeeded")
+			}
+			a.Attempts = append(a.Attempts, n)
+			a.Latest = n
+			a.Status = r.Status
+			return nil
+		})
+		var reason skip
+		if errors.As(err, &reason) {
+			duplicateResults.With(string(reason)).Inc()
+			slog.Info("Dropping result", "job", r.Spec, "attempt", n, "reason", string(reason))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := next(r); err != nil {
+			// Release the claim so the redelivery is applied.
+			rerr := s.Delete(ctx, nsApplied, key)
+			if prevFound {
+				rerr = store.PutJSON(ctx, s, nsApplied, key, prev)
+			}
+			if rerr != nil {
+				slog.Error("Failed to release result claim", "job", r.Spec, "error", rerr)
+			}
+			return err
+		}
+		return nil
+	}
+}
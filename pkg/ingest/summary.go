@@ -0,0 +1,169 @@
+package ingest
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"path"
+	"sync/atomic"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/store"
+)
+
+const nsSummaries = "result-summaries"
+
+// Summary is what ingestion learned of a result archive.
+type Summary struct {
+	ResultCount  int `json:"result_count"`
+	ArtifactSize int `json:"artifact_size_in_bytes"`
+
+	// Counted is set if ResultCount was counted in the archive's SARIF log
+	// rather than taken from the agent.
+	Counted bool `json:"counted"`
+
+	// FailureClass and FailureMessage are the agent's account of a
+	// failure.
+	FailureClass   string `json:"failure_class,omitempty"`
+	FailureMessage string `json:"failure_message,omitempty"`
+}
+
+// Summarizer reads result archives as they are ingested, counts the
+// results of their SARIF logs and records their sizes, so status requests
+// need not consult the artifact store.  An archive without a SARIF log,
+// such as a table query's or a sealed one, keeps the count its agent
+// reported.
+type Summarizer struct {
+	store     store.Store
+	artifacts atomic.Pointer[artifactstore.Store]
+}
+
+func NewSummarizer(s store.Store) *Summarizer {
+	return &Summarizer{store: s}
+}
+
+// failed records why a failed job failed.
+func (m *Summarizer) failed(r agentproto.Result) {
+	sum := Summary{FailureClass: r.FailureClass, FailureMessage: r.FailureMessage}
+	if err := store.PutJSON(context.Background(), m.store, nsSummaries, summaryKey(r.Spec), sum); err != nil {
+		slog.Warn("Failed to record failure summary", "job", r.Spec, "error", err)
+	}
+}
+
+// SetArtifacts sets the store results are read from.  Until it is set,
+// results are passed on unsummarized.
+func (m *Summarizer) SetArtifacts(a artifactstore.Store) {
+	m.artifacts.Store(&a)
+}
+
+func summaryKey(js common.JobSpec) string {
+	return fmt.Sprintf("%d/%s/%s", js.SessionID, js.Owner, js.Repo)
+}
+
+// HandleResult summarizes a result's archive before next applies it, or
+// records a failed result's failure once next has.
+func (m *Summarizer) HandleResult(next agentproto.ResultHandler) agentproto.ResultHandler {
+	return func(r agentproto.Result) error {
+		if r.Failed() {
+			if err := next(r); err != nil {
+				return err
+			}
+			m.failed(r)
+			return nil
+		}
+		artifacts := m.artifacts.Load()
+		if artifacts == nil || r.ResultLocation.Key == "" {
+			return next(r)
+		}
+		archive, err := (*artifacts).GetResult(r.ResultLocation)
+		if err != nil {
+			// The result is applied as reported; its size is looked up
+			// when it is asked for.
+			slog.Warn("Failed to read result for its summary", "job", r.Spec, "error", err)
+			return next(r)
+		}
+		sum := Summary{ResultCount: r.ResultCount, ArtifactSize: len(archive)}
+		if n, ok := countSARIF(archive); ok {
+			if n != r.ResultCount {
+				slog.Debug("Agent misreported result count", "job", r.Spec, "reported", r.ResultCount, "counted", n)
+			}
+			sum.ResultCount, sum.Counted = n, true
+			r.ResultCount = n
+		}
+		if err := next(r); err != nil {
+			return err
+		}
+		if err := store.PutJSON(context.Background(), m.store, nsSummaries, summaryKey(r.Spec), sum); err != nil {
+			slog.Warn("Failed to record result summary", "job", r.Spec, "error", err)
+		}
+		return nil
+	}
+}
+
+// Summary returns the recorded summary of a job's result.
+func (m *Summarizer) Summary(js common.JobSpec) (Summary, bool) {
+	var sum Summary
+	err := store.GetJSON(context.Background(), m.store, nsSummaries, summaryKey(js), &sum)
+	return sum, err == nil
+}
+
+// ResultSize is a gateway.ResultSizes.
+func (m *Summarizer) ResultSize(js common.JobSpec) (int, bool) {
+	sum, ok := m.Summary(js)
+	return sum.ArtifactSize, ok
+}
+
+// RepoTaskHook reports the code and message of a failed job's failure.
+func (m *Summarizer) RepoTaskHook(js common.JobSpec, task *api.RepoTask) {
+	if task.AnalysisStatus != api.RepoStatusFailed {
+		return
+	}
+	sum, ok := m.Summary(js)
+	if !ok {
+		return
+	}
+	task.FailureCode = apierr.ForFailure(sum.FailureClass)
+	if task.FailureMessage == "" {
+		task.FailureMessage = sum.FailureMessage
+	}
+}
+
+// countSARIF counts the results of every run of the SARIF log in a results
+// archive.
+func countSARIF(archive []byte) (int, bool) {
+	zr, err := zip.NewReader(bytes.NewReader(archive), int64(len(archive)))
+	if err != nil {
+		return 0, false
+	}
+	for _, f := range zr.File {
+		if path.Ext(f.Name) != ".sarif" {
+			continue
+		}
+		rc, err := f.Open()
+		if err != nil {
+			return 0, false
+		}
+		defer rc.Close()
+		var log struct {
+			Runs []struct {
+				Results []json.RawMessage `json:"results"`
+			} `json:"runs"`
+		}
+		if err := json.NewDecoder(rc).Decode(&log); err != nil {
+			return 0, false
+		}
+		n := 0
+		for _, run := range log.Runs {
+			n += len(run.Results)
+		}
+		return n, true
+	}
+	return 0, false
+}
@@ -0,0 +1,31 @@
+// Package instance identifies this mrvaserver replica.
+package instance
+
+import (
+	"fmt"
+	"os"
+	"sync"
+)
+
+var (
+	id   string
+	once sync.Once
+)
+
+// ID is a name for this process that is unique among replicas: the host
+// name (the pod name under Kubernetes) and the process ID.  MRVA_INSTANCE_ID
+// overrides it.
+func ID() string {
+	once.Do(func() {
+		if v := os.Getenv("MRVA_INSTANCE_ID"); v != "" {
+			id = v
+			return
+		}
+		host, err := os.Hostname()
+		if err != nil {
+			host = "unknown"
+		}
+		id = fmt.Sprintf("%s-%d", host, os.Getpid())
+	})
+	return id
+}
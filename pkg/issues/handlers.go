@@ -0,0 +1,68 @@
+package issues
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/web"
+)
+
+// Register adds issue filing:
+//
+//	GET  /issue-trackers                 the trackers the caller may use
+//	POST /variant-analyses/{id}/issues   {"tracker": "security", "findings": [{"repository": "o/r", "index": 0}]}
+//	                                     or {"tracker": "security", "state": "open"}
+func (x *Filer) Register(r *mux.Router) {
+	r.HandleFunc("/issue-trackers", x.list).Methods(http.MethodGet)
+	r.HandleFunc("/variant-analyses/{id:[0-9]+}/issues", x.post).Methods(http.MethodPost)
+}
+
+func (x *Filer) list(w http.ResponseWriter, r *http.Request) {
+	names := x.Trackers(r.Context(), web.Identity(r))
+	if names == nil {
+		names = []string{}
+	}
+	web.WriteJSON(w, http.StatusOK, names)
+}
+
+func (x *Filer) post(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	var sel Selection
+	if err := json.NewDecoder(r.Body).Decode(&sel); err != nil {
+		http.Error(w, "invalid selection: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	out, err := x.File(r.Context(), id, sel, web.Identity(r))
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	views := make([]outcomeView, len(out))
+	for i, o := range out {
+		views[i].Outcome = o
+		if o.Issue == nil {
+			continue
+		}
+		session, err := web.SessionName(r.Context(), o.Issue.Session)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		views[i].Issue = &issueView{Issue: *o.Issue, Session: session}
+	}
+	web.WriteJSON(w, http.StatusOK, views)
+}
+
+// outcomeView and issueView are an Outcome and its Issue as clients see
+// them, the session named.
+type outcomeView struct {
+	Outcome
+	Issue *issueView `json:"issue,omitempty"`
+}
+
+type issueView struct {
+	Issue
+	Session string `json:"session"`
+}
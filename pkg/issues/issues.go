@@ -0,0 +1,285 @@
+// Package issues files selected findings in the issue trackers teams
+// already work from, GitHub Issues or Jira.  Each configured tracker has
+// its own title and body templates and, optionally, the clients allowed to
+// use it.  A finding is filed at most once per tracker: the issue is
+// recorded by the finding's fingerprint, and filing it again returns the
+// existing issue.
+package issues
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/findings"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const nsIssues = "issues"
+
+const (
+	defaultTitle = "{{.RuleID}}: {{.Message}} ({{.Repository}})"
+	defaultBody  = `Variant analysis {{.Session}} found this in {{.Repository}}:
+
+> {{.Message}}
+
+Rule: {{.RuleID}}
+{{- if .Path}}
+Location: {{.Path}}{{if .StartLine}}:{{.StartLine}}{{end}}
+{{- end}}
+{{- if .Triage}}
+Triage: {{.Triage.State}}{{if .Triage.Comment}} -- {{.Triage.Comment}}{{end}}
+{{- end}}
+
+Fingerprint: {{.Fingerprint}}
+`
+)
+
+var filedTotal = metrics.NewCounterVec("mrvaserver_issues_filed_total",
+	"Issues filed for findings, by tracker.", "tracker")
+
+// Issue is an issue filed for a finding.
+type Issue struct {
+	Tracker     string    `json:"tracker"`
+	Key         string    `json:"key"`
+	URL         string    `json:"url"`
+	Fingerprint string    `json:"fingerprint"`
+	Session     int       `json:"session"`
+	Repository  string    `json:"repository"`
+	FiledBy     string    `json:"filed_by,omitempty"`
+	FiledAt     time.Time `json:"filed_at"`
+}
+
+// fields is what a tracker needs to create an issue.
+type fields struct {
+	Title  string
+	Body   string
+	Labels []string
+}
+
+// client creates issues in one tracker and returns the new issue's key
+// and URL.
+type client interface {
+	create(ctx context.Context, f fields) (key, url string, err error)
+}
+
+type tracker struct {
+	cfg    config.Tracker
+	title  *template.Template
+	body   *template.Template
+	client client
+}
+
+// data is what the templates see.
+type data struct {
+	findings.Finding
+	Session int
+}
+
+type Filer struct {
+	store    store.Store
+	findings *findings.Service
+	trackers map[string]*tracker
+
+	// clientTrackers names the trackers a client may file to in place of
+	// the trackers' clients lists, for clients it returns a list for.
+	clientTrackers func(ctx context.Context, client string) ([]string, bool)
+
+	// mu serializes filing, so a finding is not filed twice at once.
+	mu sync.Mutex
+}
+
+func New(cfg config.Issues, s store.Store, f *findings.Service) (*Filer, error) {
+	x := &Filer{store: s, findings: f, trackers: make(map[string]*tracker)}
+	for _, tc := range cfg.Trackers {
+		t := &tracker{cfg: tc}
+		var err error
+		if t.title, err = template.New("title").Parse(or(tc.Title, defaultTitle)); err != nil {
+			return nil, fmt.Errorf("invalid title template of tracker %s: %w", tc.Name, err)
+		}
+		if t.body, err = template.New("body").Parse(or(tc.Body, defaultBody)); err != nil {
+			return nil, fmt.Errorf("invalid body template of tracker %s: %w", tc.Name, err)
+		}
+		token, err := os.ReadFile(tc.TokenFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read token of tracker %s: %w", tc.Name, err)
+		}
+		switch tc.Kind {
+		case "github":
+			t.client = newGitHub(tc, strings.TrimSpace(string(token)))
+		case "jira":
+			t.client = newJira(tc, strings.TrimSpace(string(token)))
+		}
+		x.trackers[tc.Name] = t
+	}
+	return x, nil
+}
+
+// SetTrackers makes f decide which trackers a client may file to, for the
+// clients it returns a list for.
+func (x *Filer) SetTrackers(f func(ctx context.Context, client string) ([]string, bool)) {
+	x.clientTrackers = f
+}
+
+// allowed reports whether client may file to t.
+func (x *Filer) allowed(ctx context.Context, t *tracker, client string) bool {
+	if x.clientTrackers != nil {
+		if names, ok := x.clientTrackers(ctx, client); ok {
+			return slices.Contains(names, t.cfg.Name)
+		}
+	}
+	return len(t.cfg.Clients) == 0 || slices.Contains(t.cfg.Clients, client)
+}
+
+func or(s, def string) string {
+	if s == "" {
+		return def
+	}
+	return s
+}
+
+// Selection names the findings to file: by repository and index, or every
+// finding in a triage state.
+type Selection struct {
+	Tracker  string `json:"tracker"`
+	Findings []struct {
+		Repository string `json:"repository"`
+		Index      int    `json:"index"`
+	} `json:"findings"`
+	State string `json:"state"`
+}
+
+// Outcome is what filing one finding came to.
+type Outcome struct {
+	Repository string `json:"repository"`
+	Index      int    `json:"index"`
+	Issue      *Issue `json:"issue,omitempty"`
+	Created    bool   `json:"created"`
+	Error      string `json:"error,omitempty"`
+}
+
+func issueKey(tracker, fingerprint string) string {
+	return tracker + "/" + fingerprint
+}
+
+// File files the selected findings of session in sel.Tracker on behalf of
+// client.
+func (x *Filer) File(ctx context.Context, session int, sel Selection, client string) ([]Outcome, error) {
+	t, ok := x.trackers[sel.Tracker]
+	if !ok {
+		return nil, web.Msg(http.StatusNotFound, "", "issues.unknown_tracker", messages.Params{"tracker": sel.Tracker})
+	}
+	if !x.allowed(ctx, t, client) {
+		return nil, web.Msg(http.StatusForbidden, "", "issues.forbidden", messages.Params{"client": client, "tracker": sel.Tracker})
+	}
+	if len(sel.Findings) == 0 && sel.State == "" {
+		return nil, web.Msg(http.StatusBadRequest, "", "issues.empty_selection", nil)
+	}
+	all, _, err := x.findings.Findings(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+
+	var chosen []findings.Finding
+	var out []Outcome
+	for _, want := range sel.Findings {
+		i := slices.IndexFunc(all, func(f findings.Finding) bool {
+			return f.Repository == want.Repository && f.Index == want.Index
+		})
+		if i < 0 {
+			out = append(out, Outcome{Repository: want.Repository, Index: want.Index, Error: "no such finding"})
+			continue
+		}
+		chosen = append(chosen, all[i])
+	}
+	if sel.State != "" {
+		for _, f := range all {
+			state := findings.StateOpen
+			if f.Triage != nil {
+				state = f.Triage.State
+			}
+			if state == sel.State {
+				chosen = append(chosen, f)
+			}
+		}
+	}
+
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	for _, f := range chosen {
+		o := Outcome{Repository: f.Repository, Index: f.Index}
+		issue, created, err := x.file(ctx, t, session, f, client)
+		if err != nil {
+			slog.Warn("Failed to file issue", "tracker", t.cfg.Name, "session", session,
+				"repository", f.Repository, "index", f.Index, "error", err)
+			o.Error = err.Error()
+		} else {
+			o.Issue, o.Created = &issue, created
+		}
+		out = append(out, o)
+	}
+	return out, nil
+}
+
+// file files one finding unless it has been filed in t already.
+func (x *Filer) file(ctx context.Context, t *tracker, session int, f findings.Finding, client string) (Issue, bool, error) {
+	var issue Issue
+	err := store.GetJSON(ctx, x.store, nsIssues, issueKey(t.cfg.Name, f.Fingerprint), &issue)
+	if err == nil {
+		return issue, false, nil
+	}
+	if !errors.Is(err, store.ErrNotFound) {
+		return issue, false, err
+	}
+
+	d := data{Finding: f, Session: session}
+	var title, body bytes.Buffer
+	if err := t.title.Execute(&title, d); err != nil {
+		return issue, false, fmt.Errorf("failed to render title: %w", err)
+	}
+	if err := t.body.Execute(&body, d); err != nil {
+		return issue, false, fmt.Errorf("failed to render body: %w", err)
+	}
+	key, url, err := t.client.create(ctx, fields{
+		Title:  strings.TrimSpace(title.String()),
+		Body:   body.String(),
+		Labels: t.cfg.Labels,
+	})
+	if err != nil {
+		return issue, false, err
+	}
+	issue = Issue{Tracker: t.cfg.Name, Key: key, URL: url, Fingerprint: f.Fingerprint, Session: session,
+		Repository: f.Repository, FiledBy: client, FiledAt: time.Now().UTC()}
+	if err := store.PutJSON(ctx, x.store, nsIssues, issueKey(t.cfg.Name, f.Fingerprint), issue); err != nil {
+		return issue, true, fmt.Errorf("issue %s was filed but not recorded: %w", key, err)
+	}
+	filedTotal.With(t.cfg.Name).Inc()
+	slog.Info("Issue filed", "tracker", t.cfg.Name, "issue", key, "session", session,
+		"repository", f.Repository, "client", client)
+	return issue, true, nil
+}
+
+// Trackers returns the names of the trackers client may file to.
+func (x *Filer) Trackers(ctx context.Context, client string) []string {
+	var names []string
+	for name, t := range x.trackers {
+		if x.allowed(ctx, t, client) {
+			names = append(names, name)
+		}
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,110 @@
+package issues
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"mrvaserver/pkg/config"
+)
+
+const requestTimeout = 30 * time.Second
+
+// post sends body as JSON and decodes a 2xx response into out.
+func post(ctx context.Context, c *http.Client, url, auth string, body, out any) error {
+	data, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	req.Header.Set("Authorization", auth)
+	resp, err := c.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("tracker answered %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+type github struct {
+	http    *http.Client
+	url     string
+	project string
+	token   string
+}
+
+func newGitHub(cfg config.Tracker, token string) *github {
+	return &github{
+		http:    &http.Client{Timeout: requestTimeout},
+		url:     strings.TrimSuffix(or(cfg.URL, "https://api.github.com"), "/"),
+		project: cfg.Project,
+		token:   token,
+	}
+}
+
+func (g *github) create(ctx context.Context, f fields) (string, string, error) {
+	req := map[string]any{"title": f.Title, "body": f.Body}
+	if len(f.Labels) > 0 {
+		req["labels"] = f.Labels
+	}
+	var resp struct {
+		Number  int    `json:"number"`
+		HTMLURL string `json:"html_url"`
+	}
+	if err := post(ctx, g.http, g.url+"/repos/"+g.project+"/issues", "Bearer "+g.token, req, &resp); err != nil {
+		return "", "", err
+	}
+	return fmt.Sprintf("%s#%d", g.project, resp.Number), resp.HTMLURL, nil
+}
+
+type jira struct {
+	http      *http.Client
+	url       string
+	project   string
+	issueType string
+	auth      string
+}
+
+func newJira(cfg config.Tracker, token string) *jira {
+	return &jira{
+		http:      &http.Client{Timeout: requestTimeout},
+		url:       strings.TrimSuffix(cfg.URL, "/"),
+		project:   cfg.Project,
+		issueType: or(cfg.IssueType, "Bug"),
+		auth:      "Basic " + base64.StdEncoding.EncodeToString([]byte(token)),
+	}
+}
+
+func (j *jira) create(ctx context.Context, f fields) (string, string, error) {
+	issue := map[string]any{
+		"project":     map[string]string{"key": j.project},
+		"summary":     f.Title,
+		"description": f.Body,
+		"issuetype":   map[string]string{"name": j.issueType},
+	}
+	if len(f.Labels) > 0 {
+		issue["labels"] = f.Labels
+	}
+	var resp struct {
+		Key string `json:"key"`
+	}
+	if err := post(ctx, j.http, j.url+"/rest/api/2/issue", j.auth, map[string]any{"fields": issue}, &resp); err != nil {
+		return "", "", err
+	}
+	return resp.Key, j.url + "/browse/" + resp.Key, nil
+}
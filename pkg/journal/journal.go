@@ -0,0 +1,219 @@
+// Package journal makes the commander's in-memory state.LocalState survive
+// restarts.  Every write is appended to a journal file, one JSON record per
+// line, and the journal is replayed into a fresh LocalState on start.  It
+// is meant for development and single-node runs that should not need a
+// database.
+package journal
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"sync"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/hohn/mrvacommander/pkg/state"
+)
+
+const (
+	opNextID    = "next_id"
+	opAddJob    = "add_job"
+	opSetInfo   = "set_info"
+	opSetStatus = "set_status"
+	opSetResult = "set_result"
+)
+
+type record struct {
+	Op     string               `json:"op"`
+	Spec   *common.JobSpec      `json:"spec,omitempty"`
+	Job    *queue.AnalyzeJob    `json:"job,omitempty"`
+	Info   *common.JobInfo      `json:"info,omitempty"`
+	Status *common.Status       `json:"status,omitempty"`
+	Result *queue.AnalyzeResult `json:"result,omitempty"`
+}
+
+// JournaledState is a state.LocalState whose writes are journaled.  Reads
+// go straight to the embedded LocalState.
+type JournaledState struct {
+	*state.LocalState
+
+	mu       sync.Mutex
+	f        *os.File
+	w        *bufio.Writer
+	sync     bool
+	versions map[int]int64
+	lastID   int
+}
+
+// Open replays the journal at path, creating it if needed, and appends to
+// it from then on.  With sync set each write is flushed to disk before the
+// call returns; otherwise a crash can lose the last few writes.
+func Open(path string, sync bool) (*JournaledState, error) {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open state journal: %w", err)
+	}
+	s := &JournaledState{
+		LocalState: state.NewLocalState(0),
+		f:          f,
+		sync:       sync,
+		versions:   make(map[int]int64),
+	}
+
+	n, good, err := s.replay(f)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	// A crash can leave a partial last record; drop it so appends start
+	// on a record boundary.
+	if err := f.Truncate(good); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("failed to truncate state journal: %w", err)
+	}
+	if _, err := f.Seek(good, io.SeekStart); err != nil {
+		f.Close()
+		return nil, err
+	}
+	s.w = bufio.NewWriter(f)
+	slog.Info("Replayed state journal", "path", path, "records", n)
+	return s, nil
+}
+
+// replay applies every complete record and returns how many there were and
+// the offset just past the last one.
+func (s *JournaledState) replay(r io.Reader) (int, int64, error) {
+	br := bufio.NewReader(r)
+	var n int
+	var good int64
+	for {
+		line, err := br.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				slog.Warn("Dropping incomplete record at end of state journal", "offset", good)
+			}
+			return n, good, nil
+		}
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to read state journal: %w", err)
+		}
+		var rec record
+		if err := json.Unmarshal(bytes.TrimSpace(line), &rec); err != nil {
+			return 0, 0, fmt.Errorf("corrupt state journal record at offset %d: %w", good, err)
+		}
+		s.apply(rec)
+		n++
+		good += int64(len(line))
+	}
+}
+
+// apply performs rec on the LocalState.  It returns the allocated ID for
+// next_id records.
+func (s *JournaledState) apply(rec record) int {
+	if rec.Spec != nil {
+		s.versions[rec.Spec.SessionID]++
+	} else if rec.Job != nil {
+		s.versions[rec.Job.Spec.SessionID]++
+	}
+	switch rec.Op {
+	case opNextID:
+		s.lastID = s.LocalState.NextID()
+		return s.lastID
+	case opAddJob:
+		s.LocalState.AddJob(*rec.Job)
+	case opSetInfo:
+		s.LocalState.SetJobInfo(*rec.Spec, *rec.Info)
+	case opSetStatus:
+		s.LocalState.SetStatus(*rec.Spec, *rec.Status)
+	case opSetResult:
+		s.LocalState.SetResult(*rec.Spec, *rec.Result)
+	default:
+		slog.Warn("Unknown state journal record", "op", rec.Op)
+	}
+	return 0
+}
+
+// write applies rec and appends it to the journal, under one lock so that
+// the journal order is the order the writes took effect.  The interface's
+// setters cannot fail, so journal errors are logged.
+func (s *JournaledState) write(rec record) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	id := s.apply(rec)
+
+	data, err := json.Marshal(rec)
+	if err != nil {
+		slog.Error("Failed to encode state journal record", "op", rec.Op, "error", err)
+		return id
+	}
+	s.w.Write(append(data, '\n'))
+	if err := s.w.Flush(); err != nil {
+		slog.Error("Failed to write state journal", "error", err)
+		return id
+	}
+	if s.sync {
+		if err := s.f.Sync(); err != nil {
+			slog.Error("Failed to sync state journal", "error", err)
+		}
+	}
+	return id
+}
+
+func (s *JournaledState) NextID() int {
+	return s.write(record{Op: opNextID})
+}
+
+func (s *JournaledState) AddJob(job queue.AnalyzeJob) {
+	s.write(record{Op: opAddJob, Job: &job})
+}
+
+func (s *JournaledState) SetJobInfo(js common.JobSpec, ji common.JobInfo) {
+	s.write(record{Op: opSetInfo, Spec: &js, Info: &ji})
+}
+
+func (s *JournaledState) SetStatus(js common.JobSpec, status common.Status) {
+	s.write(record{Op: opSetStatus, Spec: &js, Status: &status})
+}
+
+func (s *JournaledState) SetResult(js common.JobSpec, r queue.AnalyzeResult) {
+	s.write(record{Op: opSetResult, Spec: &js, Result: &r})
+}
+
+// SessionVersion returns a counter that changes with every write to the
+// session's jobs.
+func (s *JournaledState) SessionVersion(sessionID int) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.versions[sessionID], nil
+}
+
+// SessionIDs returns the IDs of all sessions, in order.  IDs handed out
+// to submissions that failed before adding a job are left out.
+func (s *JournaledState) SessionIDs() ([]int, error) {
+	s.mu.Lock()
+	last := s.lastID
+	s.mu.Unlock()
+	var ids []int
+	for id := 1; id <= last; id++ {
+		if _, err := s.GetJobList(id); err == nil {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// Close flushes and closes the journal.
+func (s *JournaledState) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.w.Flush(); err != nil {
+		s.f.Close()
+		return err
+	}
+	return s.f.Close()
+}
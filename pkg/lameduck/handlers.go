@@ -0,0 +1,67 @@
+package lameduck
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/web"
+)
+
+type status struct {
+	Instance string     `json:"instance"`
+	LameDuck bool       `json:"lame_duck"`
+	Since    *time.Time `json:"since,omitempty"`
+	Reason   string     `json:"reason,omitempty"`
+	Drained  bool       `json:"drained"`
+}
+
+// Register adds a readiness probe that fails once the replica is in
+// lame-duck mode, so load balancers stop routing to it.
+func (c *Controller) Register(r *mux.Router) {
+	r.HandleFunc("/readyz", c.ready).Methods(http.MethodGet)
+}
+
+// RegisterAdmin adds the status and control endpoints, GET and POST
+// /admin/lame-duck.
+func (c *Controller) RegisterAdmin(r *mux.Router) {
+	r.HandleFunc("/admin/lame-duck", c.getStatus).Methods(http.MethodGet)
+	r.HandleFunc("/admin/lame-duck", c.enter).Methods(http.MethodPost)
+}
+
+func (c *Controller) status() status {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	s := status{Instance: c.id, LameDuck: !c.since.IsZero(), Reason: c.reason}
+	if s.LameDuck {
+		since := c.since
+		s.Since = &since
+	}
+	select {
+	case <-c.done:
+		s.Drained = true
+	default:
+	}
+	return s
+}
+
+func (c *Controller) getStatus(w http.ResponseWriter, r *http.Request) {
+	web.WriteJSON(w, http.StatusOK, c.status())
+}
+
+func (c *Controller) enter(w http.ResponseWriter, r *http.Request) {
+	reason := "requested via control endpoint"
+	if by := r.URL.Query().Get("by"); by != "" {
+		reason = "replaced by " + by
+	}
+	c.Enter(reason)
+	web.WriteJSON(w, http.StatusAccepted, c.status())
+}
+
+func (c *Controller) ready(w http.ResponseWriter, r *http.Request) {
+	if c.Active() {
+		http.Error(w, "lame duck", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,140 @@
+// Package lameduck retires a replica without dropping work.  A replica in
+// lame-duck mode reports itself unready, stops taking messages off the
+// queue, finishes what it already took, hands over its background tasks and
+// then exits.  During a rolling upgrade the new replica puts the old one in
+// lame-duck mode once it is serving, either through the old replica's
+// control endpoint or through a request left in the metadata store.
+package lameduck
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"mrvaserver/pkg/store"
+)
+
+const namespace = "lame-duck"
+
+// Request is the record a replica leaves for the one it replaces.
+type Request struct {
+	By          string    `json:"by"`
+	RequestedAt time.Time `json:"requested_at"`
+}
+
+type Controller struct {
+	id     string
+	store  store.Store
+	drains []func()
+
+	mu     sync.Mutex
+	since  time.Time
+	reason string
+	once   sync.Once
+	done   chan struct{}
+}
+
+// New returns the controller for replica id.  On entering lame-duck mode
+// each drain func runs in order and must return only once its subsystem has
+// finished its in-flight work.
+func New(id string, st store.Store, drains ...func()) *Controller {
+	return &Controller{
+		id:     id,
+		store:  st,
+		drains: drains,
+		done:   make(chan struct{}),
+	}
+}
+
+// Enter puts the replica in lame-duck mode.  It returns at once; Done is
+// closed when draining has finished.  Entering again has no effect.
+func (c *Controller) Enter(reason string) {
+	c.once.Do(func() {
+		c.mu.Lock()
+		c.since = time.Now()
+		c.reason = reason
+		c.mu.Unlock()
+
+		slog.Info("Entering lame-duck mode", "instance", c.id, "reason", reason)
+		go func() {
+			for _, drain := range c.drains {
+				drain()
+			}
+			slog.Info("Lame-duck drain complete", "instance", c.id, "took", time.Since(c.since))
+			close(c.done)
+		}()
+	})
+}
+
+// Active reports whether the replica is in lame-duck mode.
+func (c *Controller) Active() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.since.IsZero()
+}
+
+// Done is closed once the replica has drained and may exit.
+func (c *Controller) Done() <-chan struct{} {
+	return c.done
+}
+
+// Watch polls the metadata store for a request addressed to this replica
+// until ctx is done or a request arrives.
+func (c *Controller) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		var req Request
+		err := store.GetJSON(ctx, c.store, namespace, c.id, &req)
+		switch {
+		case err == nil:
+			if err := c.store.Delete(ctx, namespace, c.id); err != nil {
+				slog.Warn("Failed to clear lame-duck request", "error", err)
+			}
+			c.Enter("replaced by " + req.By)
+			return
+		case !errors.Is(err, store.ErrNotFound) && ctx.Err() == nil:
+			slog.Warn("Failed to check for lame-duck request", "error", err)
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Signal asks the replica target to enter lame-duck mode on behalf of
+// replica by.  A target starting with http:// or https:// is the base URL
+// of the replica's gateway, called with the admin bearer token; anything
+// else is its instance ID.
+func Signal(ctx context.Context, st store.Store, target, by, token string) error {
+	if !strings.HasPrefix(target, "http://") && !strings.HasPrefix(target, "https://") {
+		return store.PutJSON(ctx, st, namespace, target, Request{By: by, RequestedAt: time.Now().UTC()})
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost,
+		strings.TrimSuffix(target, "/")+"/admin/lame-duck?by="+url.QueryEscape(by), nil)
+	if err != nil {
+		return err
+	}
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to signal %s: %w", target, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("failed to signal %s: %s", target, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,45 @@
+// Package leader elects one replica to run the background subsystems that
+// must not run twice (garbage collection, dead-letter processing, scheduled
+// analyses), while every replica keeps serving HTTP.
+package leader
+
+import (
+	"context"
+	"log/slog"
+	"time"
+)
+
+type Elector interface {
+	// Campaign blocks until this replica is leader or ctx is done.  The
+	// returned context is cancelled when leadership is lost.
+	Campaign(ctx context.Context) (context.Context, error)
+
+	// Resign gives up leadership, if held.
+	Resign()
+}
+
+// retryDelay is the pause after a failed campaign.
+const retryDelay = 5 * time.Second
+
+// Run calls lead each time this replica becomes leader, with a context that
+// ends with its leadership, and campaigns again afterwards.  It returns when
+// ctx is done.
+func Run(ctx context.Context, e Elector, lead func(ctx context.Context)) {
+	for ctx.Err() == nil {
+		leaderCtx, err := e.Campaign(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				slog.Warn("Leader campaign failed", "error", err)
+				select {
+				case <-ctx.Done():
+				case <-time.After(retryDelay):
+				}
+			}
+			continue
+		}
+		slog.Info("This replica is now leader")
+		lead(leaderCtx)
+		e.Resign()
+		slog.Info("This replica is no longer leader")
+	}
+}
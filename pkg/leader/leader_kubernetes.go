@@ -0,0 +1,248 @@
+package leader
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+const serviceAccountDir = "/var/run/secrets/kubernetes.io/serviceaccount"
+
+// KubernetesElector elects through a coordination.k8s.io/v1 Lease, using
+// the pod's service account.  The account needs get, create and update on
+// leases in the namespace.
+type KubernetesElector struct {
+	client    *http.Client
+	apiServer string
+	token     string
+	namespace string
+	name      string
+	identity  string
+	duration  time.Duration
+
+	mutex  sync.Mutex
+	cancel context.CancelFunc
+}
+
+type lease struct {
+	APIVersion string        `json:"apiVersion"`
+	Kind       string        `json:"kind"`
+	Metadata   leaseMetadata `json:"metadata"`
+	Spec       leaseSpec     `json:"spec"`
+}
+
+type leaseMetadata struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+}
+
+type leaseSpec struct {
+	HolderIdentity       *string `json:"holderIdentity,omitempty"`
+	LeaseDurationSeconds int     `json:"leaseDurationSeconds"`
+	AcquireTime          string  `json:"acquireTime,omitempty"`
+	RenewTime            string  `json:"renewTime,omitempty"`
+}
+
+// k8sTime is the MicroTime format of Lease timestamps.
+const k8sTime = "2006-01-02T15:04:05.000000Z07:00"
+
+// NewKubernetesElector uses the in-cluster API server configuration.  An
+// empty namespace means the pod's own.
+func NewKubernetesElector(namespace, name, identity string, duration time.Duration) (*KubernetesElector, error) {
+	host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+	if host == "" || port == "" {
+		return nil, fmt.Errorf("not running in a Kubernetes cluster")
+	}
+	token, err := os.ReadFile(serviceAccountDir + "/token")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read service account token: %w", err)
+	}
+	ca, err := os.ReadFile(serviceAccountDir + "/ca.crt")
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cluster CA: %w", err)
+	}
+	pool := x509.NewCertPool()
+	pool.AppendCertsFromPEM(ca)
+	if namespace == "" {
+		ns, err := os.ReadFile(serviceAccountDir + "/namespace")
+		if err != nil {
+			return nil, fmt.Errorf("failed to read pod namespace: %w", err)
+		}
+		namespace = string(bytes.TrimSpace(ns))
+	}
+
+	return &KubernetesElector{
+		client: &http.Client{
+			Timeout:   10 * time.Second,
+			Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: pool}},
+		},
+		apiServer: "https://" + net.JoinHostPort(host, port),
+		token:     string(bytes.TrimSpace(token)),
+		namespace: namespace,
+		name:      name,
+		identity:  identity,
+		duration:  duration,
+	}, nil
+}
+
+func (e *KubernetesElector) Campaign(ctx context.Context) (context.Context, error) {
+	retry := e.duration / 3
+	for {
+		ok, err := e.tryAcquireOrRenew(ctx)
+		if err != nil {
+			slog.Warn("Failed to acquire lease", "lease", e.name, "error", err)
+		}
+		if ok {
+			break
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(retry):
+		}
+	}
+
+	leaderCtx, cancel := context.WithCancel(ctx)
+	e.mutex.Lock()
+	e.cancel = cancel
+	e.mutex.Unlock()
+
+	// Renew at a third of the lease duration; give up once a renewal has
+	// not succeeded for a whole duration, since another replica may then
+	// take the lease.
+	go func() {
+		defer cancel()
+		lastRenew := time.Now()
+		for {
+			select {
+			case <-leaderCtx.Done():
+				return
+			case <-time.After(retry):
+			}
+			ok, err := e.tryAcquireOrRenew(leaderCtx)
+			if ok {
+				lastRenew = time.Now()
+				continue
+			}
+			if err == nil || time.Since(lastRenew) > e.duration {
+				slog.Warn("Lost lease", "lease", e.name, "error", err)
+				return
+			}
+		}
+	}()
+	return leaderCtx, nil
+}
+
+func (e *KubernetesElector) Resign() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.cancel != nil {
+		e.cancel()
+		e.cancel = nil
+	}
+}
+
+// Check reads the lease, which need not exist yet, to verify the API
+// server is reachable and the service account may get leases.
+func (e *KubernetesElector) Check(ctx context.Context) error {
+	url := fmt.Sprintf("%s/apis/coordination.k8s.io/v1/namespaces/%s/leases/%s", e.apiServer, e.namespace, e.name)
+	_, err := e.do(ctx, http.MethodGet, url, nil, nil)
+	return err
+}
+
+// tryAcquireOrRenew takes the lease if it is ours, free or expired.
+func (e *KubernetesElector) tryAcquireOrRenew(ctx context.Context) (bool, error) {
+	now := time.Now().UTC()
+	url := fmt.Sprintf("%s/apis/coordination.k8s.io/v1/namespaces/%s/leases", e.apiServer, e.namespace)
+
+	var current lease
+	code, err := e.do(ctx, http.MethodGet, url+"/"+e.name, nil, &current)
+	if err != nil {
+		return false, err
+	}
+	identity := e.identity
+	desired := lease{
+		APIVersion: "coordination.k8s.io/v1",
+		Kind:       "Lease",
+		Metadata:   leaseMetadata{Name: e.name, Namespace: e.namespace},
+		Spec: leaseSpec{
+			HolderIdentity:       &identity,
+			LeaseDurationSeconds: int(e.duration.Seconds()),
+			AcquireTime:          now.Format(k8sTime),
+			RenewTime:            now.Format(k8sTime),
+		},
+	}
+
+	if code == http.StatusNotFound {
+		code, err = e.do(ctx, http.MethodPost, url, desired, nil)
+		return code == http.StatusCreated, err
+	}
+
+	holder := ""
+	if current.Spec.HolderIdentity != nil {
+		holder = *current.Spec.HolderIdentity
+	}
+	if holder != "" && holder != e.identity {
+		renewed, err := time.Parse(k8sTime, current.Spec.RenewTime)
+		expired := err != nil ||
+			now.After(renewed.Add(time.Duration(current.Spec.LeaseDurationSeconds)*time.Second))
+		if !expired {
+			return false, nil
+		}
+	}
+	if holder == e.identity {
+		desired.Spec.AcquireTime = current.Spec.AcquireTime
+	}
+	// The resource version makes the update fail if someone else wrote the
+	// lease since we read it.
+	desired.Metadata.ResourceVersion = current.Metadata.ResourceVersion
+	code, err = e.do(ctx, http.MethodPut, url+"/"+e.name, desired, nil)
+	return code == http.StatusOK, err
+}
+
+func (e *KubernetesElector) do(ctx context.Context, method, url string, in, out any) (int, error) {
+	var body io.Reader
+	if in != nil {
+		data, err := json.Marshal(in)
+		if err != nil {
+			return 0, err
+		}
+		body = bytes.NewReader(data)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Authorization", "Bearer "+e.token)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusConflict:
+		return resp.StatusCode, nil
+	case resp.StatusCode >= 300:
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, fmt.Errorf("%s %s: %s: %s", method, url, resp.Status, msg)
+	}
+	if out != nil {
+		if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+			return resp.StatusCode, err
+		}
+	}
+	return resp.StatusCode, nil
+}
@@ -0,0 +1,63 @@
+package leader
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"mrvaserver/pkg/lock"
+)
+
+const leaderLockName = "leader"
+
+// LockElector elects through a lock.Locker, e.g. Postgres advisory locks.
+type LockElector struct {
+	locker lock.Locker
+	poll   time.Duration
+
+	mutex sync.Mutex
+	held  lock.Lock
+}
+
+// NewLockElector campaigns by trying the leader lock every poll interval.
+func NewLockElector(locker lock.Locker, poll time.Duration) *LockElector {
+	return &LockElector{locker: locker, poll: poll}
+}
+
+func (e *LockElector) Campaign(ctx context.Context) (context.Context, error) {
+	for {
+		l, err := e.locker.TryLock(ctx, leaderLockName)
+		if err != nil {
+			return nil, err
+		}
+		if l != nil {
+			e.mutex.Lock()
+			e.held = l
+			e.mutex.Unlock()
+
+			leaderCtx, cancel := context.WithCancel(ctx)
+			go func() {
+				select {
+				case <-l.Lost():
+				case <-leaderCtx.Done():
+				}
+				cancel()
+			}()
+			return leaderCtx, nil
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(e.poll):
+		}
+	}
+}
+
+func (e *LockElector) Resign() {
+	e.mutex.Lock()
+	defer e.mutex.Unlock()
+	if e.held != nil {
+		e.held.Unlock()
+		e.held = nil
+	}
+}
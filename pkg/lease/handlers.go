@@ -0,0 +1,30 @@
+package lease
+
+import (
+	"net/http"
+	"sort"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/web"
+)
+
+// RegisterAdmin adds an endpoint listing repositories by how often their jobs
+// were preempted, most often first.
+func (m *Manager) RegisterAdmin(r *mux.Router) {
+	r.HandleFunc("/admin/preemptions", m.listPreemptions).Methods(http.MethodGet)
+}
+
+func (m *Manager) listPreemptions(w http.ResponseWriter, r *http.Request) {
+	counts, err := m.RepoPreemptions(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(counts, func(i, j int) bool {
+		if counts[i].Count != counts[j].Count {
+			return counts[i].Count > counts[j].Count
+		}
+		return counts[i].Repository < counts[j].Repository
+	})
+	web.WriteJSON(w, http.StatusOK, counts)
+}
@@ -0,0 +1,350 @@
+// Package lease tracks which agent is working on which job.  An agent
+// acquires a lease when it starts a job and renews it while it works; the
+// lease ends with the job's result.  A periodic reaper requeues the jobs of
+// leases that ran out -- the agent crashed or was cut off -- and fails jobs
+// that have used up their attempts.  Agents on spot instances announce
+// their preemption, and have their jobs requeued without waiting for the
+// leases to run out.
+//
+// Leases and attempt counts are kept in the metadata store, so every
+// replica sees them.  Jobs taken by agents that do not send lease messages
+// are never requeued, as before.
+package lease
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync/atomic"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/hohn/mrvacommander/pkg/state"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/background"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/store"
+)
+
+const (
+	nsLeases          = "leases"
+	nsAttempts        = "attempts"
+	nsPreemptions     = "preemptions"
+	nsRepoPreemptions = "repo-preemptions"
+	nsExpired         = "lease-expired" // jobs failed for their expired leases
+	nsHeld            = "lease-held"    // jobs to requeue once the drain ends
+
+	// maxTTL bounds the lease an agent may ask for.
+	maxTTL = time.Hour
+)
+
+var (
+	expiredTotal = metrics.NewCounter("mrvaserver_leases_expired_total",
+		"Leases that ran out, requeueing or failing their job.")
+	activeLeases = metrics.NewGauge("mrvaserver_leases_active",
+		"Leases held by agents, as of the last reaper pass.")
+	preemptionsTotal = metrics.NewCounter("mrvaserver_preemptions_total",
+		"Jobs requeued because their agent was preempted.")
+)
+
+type Lease struct {
+	Spec       common.JobSpec `json:"spec"`
+	Agent      string         `json:"agent"`
+	Attempt    int            `json:"attempt"`
+	AcquiredAt time.Time      `json:"acquired_at"`
+	ExpiresAt  time.Time      `json:"expires_at"`
+}
+
+// Requeuer publishes a job again.
+type Requeuer func(job agentproto.Job) error
+
+type Manager struct {
+	store    store.Store
+	st       state.ServerState
+	requeue  Requeuer
+	cfg      config.Leases
+	draining func() bool
+}
+
+// held is a job whose requeue waits for the drain to end.
+type held struct {
+	Spec common.JobSpec `json:"spec"`
+	Job  agentproto.Job `json:"job"`
+}
+
+func New(cfg config.Leases, st state.ServerState, s store.Store, requeue Requeuer) *Manager {
+	return &Manager{store: s, st: st, requeue: requeue, cfg: cfg}
+}
+
+// SetDrain holds back the requeues of expired and preempted jobs while
+// draining reports true.  The reaper requeues them once it is over.
+func (m *Manager) SetDrain(draining func() bool) {
+	m.draining = draining
+}
+
+func key(js common.JobSpec) string {
+	return fmt.Sprintf("%d/%s/%s", js.SessionID, js.Owner, js.Repo)
+}
+
+// Attempt returns the job's current dispatch attempt, 1 for a job that was
+// never requeued.
+func (m *Manager) Attempt(ctx context.Context, js common.JobSpec) (int, error) {
+	var attempt int
+	err := store.GetJSON(ctx, m.store, nsAttempts, key(js), &attempt)
+	if errors.Is(err, store.ErrNotFound) {
+		return 1, nil
+	}
+	return attempt, err
+}
+
+// TTL is the lease duration advertised to agents.
+func (m *Manager) TTL() time.Duration {
+	return m.cfg.TTL
+}
+
+// Handle applies a lease message from an agent.  Messages for an earlier
+// attempt than the current one are from an agent whose lease was already
+// given up on, and are dropped.
+func (m *Manager) Handle(msg agentproto.LeaseMessage) error {
+	ctx := context.Background()
+	if msg.Type == agentproto.LeasePreempt {
+		return m.Preempt(ctx, msg)
+	}
+	current, err := m.Attempt(ctx, msg.Spec)
+	if err != nil {
+		return err
+	}
+	if msg.Attempt != 0 && msg.Attempt < current {
+		slog.Info("Dropping lease message for a superseded attempt", "job", msg.Spec,
+			"agent", msg.Agent, "attempt", msg.Attempt, "current", current)
+		return nil
+	}
+
+	if msg.Type == agentproto.LeaseRelease {
+		return m.Release(msg.Spec)
+	}
+	if msg.Type != agentproto.LeaseAcquire && msg.Type != agentproto.LeaseRenew {
+		slog.Warn("Unknown lease message type", "type", msg.Type, "agent", msg.Agent)
+		return nil
+	}
+
+	ttl := m.cfg.TTL
+	if msg.TTLSeconds > 0 {
+		ttl = min(time.Duration(msg.TTLSeconds)*time.Second, maxTTL)
+	}
+	now := time.Now().UTC()
+	return store.UpdateJSON(ctx, m.store, nsLeases, key(msg.Spec), func(l *Lease, found bool) error {
+		if found && l.Agent != msg.Agent && l.ExpiresAt.After(now) {
+			slog.Warn("Job leased by another agent", "job", msg.Spec, "holder", l.Agent, "agent", msg.Agent)
+			return nil
+		}
+		if !found || l.Agent != msg.Agent {
+			*l = Lease{Spec: msg.Spec, Agent: msg.Agent, Attempt: current, AcquiredAt: now}
+		}
+		l.ExpiresAt = now.Add(ttl)
+		return nil
+	})
+}
+
+// Release ends the job's lease, if it has one.
+func (m *Manager) Release(js common.JobSpec) error {
+	return m.store.Delete(context.Background(), nsLeases, key(js))
+}
+
+// HandleResult ends the lease of the result's job.  It wraps the next
+// result handler.
+func (m *Manager) HandleResult(next agentproto.ResultHandler) agentproto.ResultHandler {
+	return func(r agentproto.Result) error {
+		if err := next(r); err != nil {
+			return err
+		}
+		if err := m.Release(r.Spec); err != nil {
+			slog.Warn("Failed to release lease", "job", r.Spec, "error", err)
+		}
+		return nil
+	}
+}
+
+// Reap requeues the jobs of expired leases, and those held back by a
+// drain that has ended.  It is a background task.
+func (m *Manager) Reap(ctx context.Context) error {
+	if err := m.requeueHeld(ctx); err != nil {
+		slog.Error("Failed to requeue jobs held during drain", "error", err)
+	}
+	leases, err := store.ListJSON[Lease](ctx, m.store, nsLeases, "")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var expired []Lease
+	for _, l := range leases {
+		if !l.ExpiresAt.After(now) {
+			expired = append(expired, l)
+		}
+	}
+	var reaped atomic.Int64
+	err = background.Each(ctx, expired, func(ctx context.Context, l Lease) error {
+		ok, err := m.take(ctx, l.Spec, now)
+		if err != nil {
+			slog.Error("Failed to reap lease", "job", l.Spec, "error", err)
+			return nil
+		}
+		if !ok {
+			return nil
+		}
+		reaped.Add(1)
+		expiredTotal.Inc()
+		if err := m.retry(ctx, l); err != nil {
+			slog.Error("Failed to requeue job with expired lease", "job", l.Spec, "error", err)
+		}
+		return nil
+	})
+	activeLeases.Set(float64(len(leases) - int(reaped.Load())))
+	return err
+}
+
+// take deletes the job's lease if it is still expired, so that a renewal
+// racing with the reaper wins.
+func (m *Manager) take(ctx context.Context, js common.JobSpec, now time.Time) (bool, error) {
+	expired := false
+	err := m.store.Update(ctx, nsLeases, key(js), func(old []byte) ([]byte, error) {
+		if old == nil {
+			return nil, nil
+		}
+		var l Lease
+		if err := json.Unmarshal(old, &l); err != nil {
+			return nil, err
+		}
+		if l.ExpiresAt.After(now) {
+			return old, nil
+		}
+		expired = true
+		return nil, nil
+	})
+	return expired, err
+}
+
+// retry requeues the job for its next attempt, or fails it once it has
+// had cfg.MaxAttempts.
+func (m *Manager) retry(ctx context.Context, l Lease) error {
+	preempted, err := m.preemptions(ctx, l.Spec)
+	if err != nil {
+		return err
+	}
+	if l.Attempt-preempted >= m.cfg.MaxAttempts {
+		slog.Warn("Job lease expired on final attempt, failing job", "job", l.Spec,
+			"agent", l.Agent, "attempts", l.Attempt)
+		m.st.SetStatus(l.Spec, common.StatusError)
+		if err := store.PutJSON(ctx, m.store, nsExpired, key(l.Spec), l.Attempt); err != nil {
+			slog.Warn("Failed to record job failed for its lease", "job", l.Spec, "error", err)
+		}
+		return nil
+	}
+
+	if ok, err := m.hold(ctx, l.Spec, agentproto.Job{}); ok || err != nil {
+		slog.Info("Job lease expired while draining, holding it back", "job", l.Spec, "agent", l.Agent)
+		return err
+	}
+	slog.Info("Job lease expired, requeueing", "job", l.Spec, "agent", l.Agent, "attempt", l.Attempt+1)
+	_, err = m.Redispatch(ctx, l.Spec, "")
+	return err
+}
+
+// hold records j, which need only carry its extensions, to be requeued
+// once the drain ends, if the cluster is draining.
+func (m *Manager) hold(ctx context.Context, js common.JobSpec, j agentproto.Job) (bool, error) {
+	if m.draining == nil || !m.draining() {
+		return false, nil
+	}
+	if err := store.PutJSON(ctx, m.store, nsHeld, key(js), held{Spec: js, Job: j}); err != nil {
+		return true, err
+	}
+	m.st.SetStatus(js, common.StatusQueued)
+	return true, nil
+}
+
+// requeueHeld requeues the jobs held back by a drain that has ended.
+func (m *Manager) requeueHeld(ctx context.Context) error {
+	if m.draining != nil && m.draining() {
+		return nil
+	}
+	jobs, err := store.ListJSON[held](ctx, m.store, nsHeld, "")
+	if err != nil {
+		return err
+	}
+	var errs []error
+	for _, h := range jobs {
+		if err := m.store.Delete(ctx, nsHeld, key(h.Spec)); err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		attempt, err := m.dispatch(ctx, h.Spec, h.Job)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		slog.Info("Requeued job held during drain", "job", h.Spec, "attempt", attempt)
+	}
+	return errors.Join(errs...)
+}
+
+// RepoTaskHook reports jobs failed because their agents stopped renewing
+// their leases as timed out.
+func (m *Manager) RepoTaskHook(js common.JobSpec, task *api.RepoTask) {
+	if task.AnalysisStatus != api.RepoStatusFailed {
+		return
+	}
+	var attempts int
+	if err := store.GetJSON(context.Background(), m.store, nsExpired, key(js), &attempts); err == nil {
+		task.FailureCode = apierr.AgentTimeout
+		task.FailureMessage = fmt.Sprintf("agents stopped renewing the job's lease on %d attempts", attempts)
+	}
+}
+
+// Redispatch publishes the job again as its next attempt, on pool's queue,
+// and marks it queued.  It returns the new attempt.
+func (m *Manager) Redispatch(ctx context.Context, js common.JobSpec, pool string) (int, error) {
+	return m.dispatch(ctx, js, agentproto.Job{Pool: pool})
+}
+
+// dispatch publishes j, which need only carry its extensions, as the job's
+// next attempt.
+func (m *Manager) dispatch(ctx context.Context, js common.JobSpec, j agentproto.Job) (int, error) {
+	job, err := m.job(js)
+	if err != nil {
+		return 0, err
+	}
+	attempt, err := m.Attempt(ctx, js)
+	if err != nil {
+		return 0, err
+	}
+	next := attempt + 1
+	if err := store.PutJSON(ctx, m.store, nsAttempts, key(js), next); err != nil {
+		return 0, err
+	}
+	m.st.SetStatus(js, common.StatusQueued)
+	j.AnalyzeJob, j.Attempt = job, next
+	if m.cfg.Enabled {
+		j.LeaseTTLSeconds = int(m.cfg.TTL.Seconds())
+	}
+	return next, m.requeue(j)
+}
+
+func (m *Manager) job(js common.JobSpec) (queue.AnalyzeJob, error) {
+	jobs, err := m.st.GetJobList(js.SessionID)
+	if err != nil {
+		return queue.AnalyzeJob{}, err
+	}
+	for _, job := range jobs {
+		if job.Spec == js {
+			return job, nil
+		}
+	}
+	return queue.AnalyzeJob{}, fmt.Errorf("job %v not in session %d", js, js.SessionID)
+}
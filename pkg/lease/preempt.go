@@ -0,0 +1,128 @@
+package lease
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/store"
+)
+
+// RepoPreemptions counts the preemptions of a repository's jobs across
+// sessions.  Repositories that are preempted often are candidates for
+// on-demand agents.
+type RepoPreemptions struct {
+	Repository string    `json:"repository"`
+	Count      int       `json:"count"`
+	Last       time.Time `json:"last"`
+}
+
+// Preempt requeues the jobs msg.Agent holds leases on, or only msg.Spec if
+// it is set, ahead of queued jobs.  Preemption is not the job's fault, so
+// it does not count against MaxAttempts.  While the cluster drains the
+// jobs are held back instead.
+func (m *Manager) Preempt(ctx context.Context, msg agentproto.LeaseMessage) error {
+	specs := []common.JobSpec{msg.Spec}
+	if msg.Spec == (common.JobSpec{}) {
+		leases, err := store.ListJSON[Lease](ctx, m.store, nsLeases, "")
+		if err != nil {
+			return err
+		}
+		specs = specs[:0]
+		for _, l := range leases {
+			if l.Agent == msg.Agent {
+				specs = append(specs, l.Spec)
+			}
+		}
+	}
+
+	var errs []error
+	for _, js := range specs {
+		held, err := m.release(ctx, js, msg.Agent)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		if !held {
+			slog.Info("Ignoring preemption of a job the agent does not hold", "job", js, "agent", msg.Agent)
+			continue
+		}
+		if err := m.countPreemption(ctx, js); err != nil {
+			slog.Warn("Failed to count preemption", "job", js, "error", err)
+		}
+		preemptionsTotal.Inc()
+		j := agentproto.Job{Preempted: true, Checkpoint: msg.Checkpoint}
+		if ok, err := m.hold(ctx, js, j); ok || err != nil {
+			if err != nil {
+				errs = append(errs, err)
+			} else {
+				slog.Info("Agent preempted while draining, holding job back", "job", js, "agent", msg.Agent)
+			}
+			continue
+		}
+		attempt, err := m.dispatch(ctx, js, j)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		slog.Info("Agent preempted, requeued job", "job", js, "agent", msg.Agent, "attempt", attempt,
+			"checkpoint", msg.Checkpoint != "")
+	}
+	return errors.Join(errs...)
+}
+
+// release deletes the job's lease if agent holds it.
+func (m *Manager) release(ctx context.Context, js common.JobSpec, agent string) (bool, error) {
+	held := false
+	err := m.store.Update(ctx, nsLeases, key(js), func(old []byte) ([]byte, error) {
+		if old == nil {
+			return nil, nil
+		}
+		var l Lease
+		if err := json.Unmarshal(old, &l); err != nil {
+			return nil, err
+		}
+		if l.Agent != agent {
+			return old, nil
+		}
+		held = true
+		return nil, nil
+	})
+	return held, err
+}
+
+func (m *Manager) countPreemption(ctx context.Context, js common.JobSpec) error {
+	err := store.UpdateJSON(ctx, m.store, nsPreemptions, key(js), func(n *int, found bool) error {
+		*n++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	repo := js.Owner + "/" + js.Repo
+	return store.UpdateJSON(ctx, m.store, nsRepoPreemptions, repo, func(p *RepoPreemptions, found bool) error {
+		p.Repository = repo
+		p.Count++
+		p.Last = time.Now().UTC()
+		return nil
+	})
+}
+
+// preemptions returns the number of times the job was preempted.
+func (m *Manager) preemptions(ctx context.Context, js common.JobSpec) (int, error) {
+	var n int
+	err := store.GetJSON(ctx, m.store, nsPreemptions, key(js), &n)
+	if errors.Is(err, store.ErrNotFound) {
+		return 0, nil
+	}
+	return n, err
+}
+
+// RepoPreemptions returns the preemption counts of all repositories.
+func (m *Manager) RepoPreemptions(ctx context.Context) ([]RepoPreemptions, error) {
+	return store.ListJSON[RepoPreemptions](ctx, m.store, nsRepoPreemptions, "")
+}
@@ -0,0 +1,65 @@
+// Package lock provides named locks shared by all mrvaserver replicas, so
+// that background work runs on one replica at a time.
+package lock
+
+import (
+	"context"
+	"sync"
+)
+
+// Lock is a held lock.
+type Lock interface {
+	// Unlock releases the lock.
+	Unlock()
+
+	// Lost is closed if the lock is lost without Unlock, e.g. because the
+	// database connection holding it dropped.  The holder must stop the
+	// guarded work.
+	Lost() <-chan struct{}
+}
+
+type Locker interface {
+	// TryLock acquires the named lock if it is free.  It returns a nil Lock
+	// and no error if another holder has it.
+	TryLock(ctx context.Context, name string) (Lock, error)
+}
+
+// LocalLocker coordinates within one process only.  It is meant for single
+// replica deployments and development.
+type LocalLocker struct {
+	held  map[string]bool
+	mutex sync.Mutex
+}
+
+func NewLocalLocker() *LocalLocker {
+	return &LocalLocker{held: make(map[string]bool)}
+}
+
+func (l *LocalLocker) TryLock(ctx context.Context, name string) (Lock, error) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	if l.held[name] {
+		return nil, nil
+	}
+	l.held[name] = true
+	return &localLock{locker: l, name: name, lost: make(chan struct{})}, nil
+}
+
+type localLock struct {
+	locker *LocalLocker
+	name   string
+	lost   chan struct{}
+	once   sync.Once
+}
+
+func (l *localLock) Unlock() {
+	l.once.Do(func() {
+		l.locker.mutex.Lock()
+		delete(l.locker.held, l.name)
+		l.locker.mutex.Unlock()
+	})
+}
+
+func (l *localLock) Lost() <-chan struct{} {
+	return l.lost
+}
@@ -0,0 +1,101 @@
+package lock
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"mrvaserver/pkg/etcd"
+	"mrvaserver/pkg/instance"
+)
+
+// etcdLockTTL is how long a lock outlives a replica that stopped renewing
+// it; it is renewed at a third of that.
+const etcdLockTTL = 15 * time.Second
+
+// EtcdLocker holds each lock as a key attached to a lease, so etcd
+// releases it if the replica stops renewing the lease.
+type EtcdLocker struct {
+	c      *etcd.Client
+	prefix string
+}
+
+func NewEtcdLocker(c *etcd.Client, prefix string) *EtcdLocker {
+	return &EtcdLocker{c: c, prefix: prefix + "locks/"}
+}
+
+func (l *EtcdLocker) Close() {}
+
+func (l *EtcdLocker) TryLock(ctx context.Context, name string) (Lock, error) {
+	lease, err := l.c.Grant(ctx, etcdLockTTL)
+	if err != nil {
+		return nil, err
+	}
+	key := l.prefix + name
+	ok, err := l.c.Txn(ctx, []etcd.Compare{etcd.ModRevisionIs(key, 0)},
+		[]etcd.Op{etcd.OpPut(key, []byte(instance.ID()), lease)})
+	if err != nil || !ok {
+		l.c.Revoke(context.Background(), lease)
+		return nil, err
+	}
+
+	el := &etcdLock{c: l.c, name: name, lease: lease, lost: make(chan struct{}), done: make(chan struct{})}
+	go el.keepAlive()
+	return el, nil
+}
+
+type etcdLock struct {
+	c     *etcd.Client
+	name  string
+	lease int64
+	lost  chan struct{}
+	done  chan struct{}
+	once  sync.Once
+}
+
+// keepAlive renews the lease until Unlock, closing lost once a renewal
+// has not succeeded for a whole TTL, since another replica may then hold
+// the lock.
+func (l *etcdLock) keepAlive() {
+	ticker := time.NewTicker(etcdLockTTL / 3)
+	defer ticker.Stop()
+	renewed := time.Now()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), etcdLockTTL/3)
+		err := l.c.KeepAlive(ctx, l.lease)
+		cancel()
+		if err == nil {
+			renewed = time.Now()
+			continue
+		}
+		if err == etcd.ErrLeaseExpired || time.Since(renewed) > etcdLockTTL {
+			slog.Error("Lost etcd lock", "name", l.name, "error", err)
+			close(l.lost)
+			l.once.Do(func() { close(l.done) })
+			return
+		}
+		slog.Warn("Failed to renew etcd lock", "name", l.name, "error", err)
+	}
+}
+
+func (l *etcdLock) Unlock() {
+	l.once.Do(func() {
+		close(l.done)
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		// Revoking the lease deletes the key; otherwise it expires.
+		if err := l.c.Revoke(ctx, l.lease); err != nil {
+			slog.Warn("Failed to release etcd lock", "name", l.name, "error", err)
+		}
+	})
+}
+
+func (l *etcdLock) Lost() <-chan struct{} {
+	return l.lost
+}
@@ -0,0 +1,123 @@
+package lock
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+// lockClass is the first key of every advisory lock taken here ("mrva"), so
+// that mrvaserver's locks cannot collide with other users of the database.
+const lockClass = 0x6d727661
+
+// pingInterval is how often a held lock's connection is checked.
+const pingInterval = 10 * time.Second
+
+// PostgresLocker uses session-level advisory locks.  Each held lock pins
+// one pooled connection; Postgres releases the lock if that connection or
+// the replica dies.
+type PostgresLocker struct {
+	pool *pgxpool.Pool
+}
+
+// NewPostgresLocker connects using dsn (empty: the PG* environment variables).
+func NewPostgresLocker(ctx context.Context, dsn string) (*PostgresLocker, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	return &PostgresLocker{pool: pool}, nil
+}
+
+func (l *PostgresLocker) Close() {
+	l.pool.Close()
+}
+
+// ResetConnections closes the idle pooled connections.  Held locks keep
+// theirs until they are released or the connection fails.
+func (l *PostgresLocker) ResetConnections() {
+	l.pool.Reset()
+}
+
+func (l *PostgresLocker) TryLock(ctx context.Context, name string) (Lock, error) {
+	conn, err := l.pool.Acquire(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var ok bool
+	err = conn.QueryRow(ctx, `SELECT pg_try_advisory_lock($1, hashtext($2))`, lockClass, name).Scan(&ok)
+	if err != nil || !ok {
+		conn.Release()
+		return nil, err
+	}
+
+	pl := &pgLock{conn: conn, name: name, lost: make(chan struct{}), done: make(chan struct{}),
+		stopped: make(chan struct{})}
+	go pl.watch()
+	return pl, nil
+}
+
+// pgLock's connection is used by the watcher until Unlock stops it, and by
+// Unlock after, never by both at once.
+type pgLock struct {
+	conn     *pgxpool.Conn
+	name     string
+	lost     chan struct{}
+	done     chan struct{}
+	stopped  chan struct{} // closed when the watcher returns
+	gone     bool          // set by the watcher once it closed the connection
+	lostOnce sync.Once
+	once     sync.Once
+}
+
+// watch pings the lock's connection until Unlock, closing lost on failure.
+func (l *pgLock) watch() {
+	defer close(l.stopped)
+	ticker := time.NewTicker(pingInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-l.done:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), pingInterval)
+			err := l.conn.Ping(ctx)
+			cancel()
+			if err != nil {
+				slog.Error("Lost advisory lock", "name", l.name, "error", err)
+				l.lostOnce.Do(func() { close(l.lost) })
+				// The session is gone, and the lock with it.
+				l.conn.Hijack().Close(context.Background())
+				l.gone = true
+				return
+			}
+		}
+	}
+}
+
+func (l *pgLock) Unlock() {
+	l.once.Do(func() {
+		close(l.done)
+		<-l.stopped
+		if l.gone {
+			return
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if _, err := l.conn.Exec(ctx, `SELECT pg_advisory_unlock($1, hashtext($2))`, lockClass, l.name); err != nil {
+			// Don't return a connection that may still hold the lock.
+			slog.Error("Failed to release advisory lock", "name", l.name, "error", err)
+			l.conn.Hijack().Close(context.Background())
+			return
+		}
+		l.conn.Release()
+	})
+}
+
+func (l *pgLock) Lost() <-chan struct{} {
+	return l.lost
+}
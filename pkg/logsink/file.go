@@ -0,0 +1,100 @@
+package logsink
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"mrvaserver/pkg/config"
+)
+
+// rotating is a log file that is renamed aside, with the time, and started
+// anew once it is too big or too old.
+type rotating struct {
+	cfg config.LogFile
+
+	mu     sync.Mutex
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotating(cfg config.LogFile) (*rotating, error) {
+	if err := os.MkdirAll(filepath.Dir(cfg.Path), 0o755); err != nil {
+		return nil, fmt.Errorf("failed to create log directory: %w", err)
+	}
+	r := &rotating{cfg: cfg}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotating) open() error {
+	f, err := os.OpenFile(r.cfg.Path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0o644)
+	if err != nil {
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return fmt.Errorf("failed to open log file: %w", err)
+	}
+	r.f, r.size, r.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+func (r *rotating) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	full := r.cfg.MaxSize > 0 && r.size > 0 && r.size+int64(len(p)) > r.cfg.MaxSize
+	old := r.cfg.MaxAge > 0 && time.Since(r.opened) >= r.cfg.MaxAge
+	if full || old {
+		if err := r.rotate(); err != nil {
+			droppedTotal.With("file").Inc()
+			return 0, err
+		}
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	if err != nil {
+		droppedTotal.With("file").Inc()
+	}
+	return n, err
+}
+
+// rotate moves the current file aside, opens a new one and removes the
+// oldest backups beyond MaxBackups.
+func (r *rotating) rotate() error {
+	r.f.Close()
+	backup := r.cfg.Path + "." + time.Now().UTC().Format("20060102T150405.000")
+	if err := os.Rename(r.cfg.Path, backup); err != nil && !os.IsNotExist(err) {
+		// Carry on in the same file rather than lose lines.
+		return r.open()
+	}
+	if err := r.open(); err != nil {
+		return err
+	}
+	if r.cfg.MaxBackups <= 0 {
+		return nil
+	}
+	backups, err := filepath.Glob(r.cfg.Path + ".*")
+	if err != nil || len(backups) <= r.cfg.MaxBackups {
+		return nil
+	}
+	// The timestamps sort as the files were made.
+	slices.Sort(backups)
+	for _, b := range backups[:len(backups)-r.cfg.MaxBackups] {
+		os.Remove(b)
+	}
+	return nil
+}
+
+func (r *rotating) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
@@ -0,0 +1,174 @@
+// Package logsink sends the server's slog output to the sinks the
+// configuration enables, all at once: standard error, rotating files,
+// syslog and an OTLP collector.  Output of the log package goes along,
+// at info level.  The last lines are kept in memory too, for WriteRecent.  A sink's failures are counted rather than logged, which
+// could only feed them back to it.
+package logsink
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log"
+	"log/slog"
+	"os"
+	"sync"
+
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/metrics"
+)
+
+var droppedTotal = metrics.NewCounterVec("mrvaserver_log_records_dropped_total",
+	"Log records a sink failed to write or had no room for.", "sink")
+
+// Setup makes the sinks of cfg, and extra, the default logger's, at level
+// but for extra, which choose their own.  With only standard error in
+// text the default logger is kept as it is, only copied to memory.  The
+// returned function flushes and closes the sinks.
+func Setup(cfg config.Logging, level slog.Leveler, extra ...slog.Handler) (func(), error) {
+	var mem *ring
+	if cfg.Recent > 0 {
+		mem = newRing(cfg.Recent)
+		recentMu.Lock()
+		recent = mem
+		recentMu.Unlock()
+	}
+	onlyStderr := cfg.Stderr && !cfg.File.Enabled && !cfg.Syslog.Enabled && !cfg.OTLP.Enabled
+	if onlyStderr && cfg.Format == "text" && len(extra) == 0 {
+		// The default logger writes through the log package.
+		if mem != nil {
+			log.SetOutput(io.MultiWriter(os.Stderr, mem))
+		}
+		return func() {}, nil
+	}
+
+	handlers := fanout(extra)
+	var closers []io.Closer
+	cleanup := func() {
+		for _, c := range closers {
+			c.Close()
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	if cfg.Stderr {
+		handlers = append(handlers, newHandler(os.Stderr, cfg.Format, opts))
+	}
+	if cfg.File.Enabled {
+		f, err := openRotating(cfg.File)
+		if err != nil {
+			return nil, err
+		}
+		closers = append(closers, f)
+		handlers = append(handlers, newHandler(f, cfg.Format, opts))
+	}
+	if cfg.Syslog.Enabled {
+		h, c, err := newSyslog(cfg.Syslog, opts)
+		if err != nil {
+			cleanup()
+			return nil, err
+		}
+		closers = append(closers, c)
+		handlers = append(handlers, h)
+	}
+	if mem != nil {
+		handlers = append(handlers, slog.NewTextHandler(mem, opts))
+	}
+	if cfg.OTLP.Enabled {
+		e := newExporter(cfg.OTLP)
+		closers = append(closers, e)
+		handlers = append(handlers, &otlpHandler{exp: e, level: level})
+	}
+	slog.SetDefault(slog.New(handlers))
+	return cleanup, nil
+}
+
+func newHandler(w io.Writer, format string, opts *slog.HandlerOptions) slog.Handler {
+	if format == "json" {
+		return slog.NewJSONHandler(w, opts)
+	}
+	return slog.NewTextHandler(w, opts)
+}
+
+// fanout hands each record to every handler that takes its level.
+type fanout []slog.Handler
+
+func (f fanout) Enabled(ctx context.Context, level slog.Level) bool {
+	for _, h := range f {
+		if h.Enabled(ctx, level) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f fanout) Handle(ctx context.Context, r slog.Record) error {
+	var errs []error
+	for _, h := range f {
+		if h.Enabled(ctx, r.Level) {
+			errs = append(errs, h.Handle(ctx, r.Clone()))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (f fanout) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := make(fanout, len(f))
+	for i, h := range f {
+		out[i] = h.WithAttrs(attrs)
+	}
+	return out
+}
+
+func (f fanout) WithGroup(name string) slog.Handler {
+	out := make(fanout, len(f))
+	for i, h := range f {
+		out[i] = h.WithGroup(name)
+	}
+	return out
+}
+
+// lineHandler renders records as text lines, without time or level, for
+// sinks that take lines and a severity.
+type lineHandler struct {
+	mu   *sync.Mutex
+	buf  *bytes.Buffer
+	text slog.Handler // writes to buf
+	emit func(level slog.Level, line string) error
+}
+
+func newLineHandler(opts *slog.HandlerOptions, emit func(slog.Level, string) error) *lineHandler {
+	buf := new(bytes.Buffer)
+	text := slog.NewTextHandler(buf, &slog.HandlerOptions{
+		Level: opts.Level,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			if len(groups) == 0 && (a.Key == slog.TimeKey || a.Key == slog.LevelKey) {
+				return slog.Attr{}
+			}
+			return a
+		},
+	})
+	return &lineHandler{mu: new(sync.Mutex), buf: buf, text: text, emit: emit}
+}
+
+func (h *lineHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.text.Enabled(ctx, level)
+}
+
+func (h *lineHandler) Handle(ctx context.Context, r slog.Record) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.buf.Reset()
+	if err := h.text.Handle(ctx, r); err != nil {
+		return err
+	}
+	return h.emit(r.Level, string(bytes.TrimSuffix(h.buf.Bytes(), []byte("\n"))))
+}
+
+func (h *lineHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &lineHandler{mu: h.mu, buf: h.buf, text: h.text.WithAttrs(attrs), emit: h.emit}
+}
+
+func (h *lineHandler) WithGroup(name string) slog.Handler {
+	return &lineHandler{mu: h.mu, buf: h.buf, text: h.text.WithGroup(name), emit: h.emit}
+}
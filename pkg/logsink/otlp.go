@@ -0,0 +1,235 @@
+package logsink
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/instance"
+)
+
+// otlpRecord is a LogRecord of the OTLP/HTTP JSON encoding.
+type otlpRecord struct {
+	TimeUnixNano   string         `json:"timeUnixNano"`
+	SeverityNumber int            `json:"severityNumber"`
+	SeverityText   string         `json:"severityText"`
+	Body           otlpValue      `json:"body"`
+	Attributes     []otlpKeyValue `json:"attributes,omitempty"`
+}
+
+type otlpKeyValue struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+// otlpValue is an AnyValue; 64-bit integers are strings in JSON.
+type otlpValue struct {
+	StringValue *string  `json:"stringValue,omitempty"`
+	BoolValue   *bool    `json:"boolValue,omitempty"`
+	IntValue    *string  `json:"intValue,omitempty"`
+	DoubleValue *float64 `json:"doubleValue,omitempty"`
+}
+
+func stringValue(s string) otlpValue { return otlpValue{StringValue: &s} }
+
+func toValue(v slog.Value) otlpValue {
+	switch v.Kind() {
+	case slog.KindBool:
+		b := v.Bool()
+		return otlpValue{BoolValue: &b}
+	case slog.KindInt64:
+		i := strconv.FormatInt(v.Int64(), 10)
+		return otlpValue{IntValue: &i}
+	case slog.KindUint64:
+		i := strconv.FormatUint(v.Uint64(), 10)
+		return otlpValue{IntValue: &i}
+	case slog.KindFloat64:
+		f := v.Float64()
+		return otlpValue{DoubleValue: &f}
+	}
+	return stringValue(v.String())
+}
+
+// severity maps slog levels onto the OTLP severity numbers of the same
+// name: DEBUG 5, INFO 9, WARN 13, ERROR 17.
+func severity(l slog.Level) int {
+	return min(max(9+int(l), 1), 24)
+}
+
+// exporter batches records and posts them to the collector.
+type exporter struct {
+	cfg     config.LogOTLP
+	client  *http.Client
+	records chan otlpRecord
+	stop    chan struct{}
+	done    chan struct{}
+	once    sync.Once
+}
+
+func newExporter(cfg config.LogOTLP) *exporter {
+	e := &exporter{
+		cfg:     cfg,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		records: make(chan otlpRecord, 4*cfg.BatchSize),
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	go e.run()
+	return e
+}
+
+func (e *exporter) add(r otlpRecord) {
+	select {
+	case e.records <- r:
+	default:
+		droppedTotal.With("otlp").Inc()
+	}
+}
+
+func (e *exporter) run() {
+	defer close(e.done)
+	ticker := time.NewTicker(e.cfg.Interval)
+	defer ticker.Stop()
+	batch := make([]otlpRecord, 0, e.cfg.BatchSize)
+	for {
+		select {
+		case r := <-e.records:
+			if batch = append(batch, r); len(batch) < e.cfg.BatchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-e.stop:
+			for len(e.records) > 0 && len(batch) < cap(batch) {
+				batch = append(batch, <-e.records)
+			}
+			e.send(batch)
+			return
+		}
+		e.send(batch)
+		batch = batch[:0]
+	}
+}
+
+func (e *exporter) send(batch []otlpRecord) {
+	if len(batch) == 0 {
+		return
+	}
+	body, err := json.Marshal(map[string]any{
+		"resourceLogs": []any{map[string]any{
+			"resource": map[string]any{"attributes": []otlpKeyValue{
+				{Key: "service.name", Value: stringValue("mrvaserver")},
+				{Key: "service.instance.id", Value: stringValue(instance.ID())},
+			}},
+			"scopeLogs": []any{map[string]any{
+				"scope":      map[string]any{"name": "mrvaserver"},
+				"logRecords": batch,
+			}},
+		}},
+	})
+	if err == nil {
+		err = e.post(body)
+	}
+	if err != nil {
+		droppedTotal.With("otlp").Add(float64(len(batch)))
+	}
+}
+
+func (e *exporter) post(body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, e.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+// Close sends what is left, up to a batch, waiting up to the client
+// timeout.  Records logged after it are dropped.
+func (e *exporter) Close() error {
+	e.once.Do(func() { close(e.stop) })
+	<-e.done
+	return nil
+}
+
+// otlpHandler turns records into OTLP log records, attributes flattened
+// under their groups' names joined with dots.
+type otlpHandler struct {
+	exp    *exporter
+	level  slog.Leveler
+	attrs  []otlpKeyValue
+	prefix string
+}
+
+func (h *otlpHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= h.level.Level()
+}
+
+func (h *otlpHandler) Handle(_ context.Context, r slog.Record) error {
+	rec := otlpRecord{
+		TimeUnixNano:   strconv.FormatInt(r.Time.UnixNano(), 10),
+		SeverityNumber: severity(r.Level),
+		SeverityText:   r.Level.String(),
+		Body:           stringValue(r.Message),
+		Attributes:     append([]otlpKeyValue(nil), h.attrs...),
+	}
+	r.Attrs(func(a slog.Attr) bool {
+		rec.Attributes = appendAttr(rec.Attributes, h.prefix, a)
+		return true
+	})
+	h.exp.add(rec)
+	return nil
+}
+
+func appendAttr(kvs []otlpKeyValue, prefix string, a slog.Attr) []otlpKeyValue {
+	v := a.Value.Resolve()
+	if v.Kind() == slog.KindGroup {
+		p := prefix
+		if a.Key != "" {
+			p += a.Key + "."
+		}
+		for _, ga := range v.Group() {
+			kvs = appendAttr(kvs, p, ga)
+		}
+		return kvs
+	}
+	if a.Key == "" {
+		return kvs
+	}
+	return append(kvs, otlpKeyValue{Key: prefix + a.Key, Value: toValue(v)})
+}
+
+func (h *otlpHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	out := *h
+	out.attrs = append([]otlpKeyValue(nil), h.attrs...)
+	for _, a := range attrs {
+		out.attrs = appendAttr(out.attrs, h.prefix, a)
+	}
+	return &out
+}
+
+func (h *otlpHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return h
+	}
+	out := *h
+	out.prefix = h.prefix + name + "."
+	return &out
+}
@@ -0,0 +1,74 @@
+package logsink
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// ring keeps the last lines written to it.
+type ring struct {
+	mu    sync.Mutex
+	lines [][]byte
+	next  int
+	full  bool
+}
+
+func newRing(n int) *ring {
+	return &ring{lines: make([][]byte, n)}
+}
+
+func (r *ring) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, line := range bytes.SplitAfter(p, []byte("\n")) {
+		if len(line) == 0 {
+			continue
+		}
+		r.lines[r.next] = append(r.lines[r.next][:0], line...)
+		if r.next++; r.next == len(r.lines) {
+			r.next, r.full = 0, true
+		}
+	}
+	return len(p), nil
+}
+
+func (r *ring) WriteTo(w io.Writer) (int64, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	var n int64
+	write := func(lines [][]byte) error {
+		for _, l := range lines {
+			m, err := w.Write(l)
+			n += int64(m)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if r.full {
+		if err := write(r.lines[r.next:]); err != nil {
+			return n, err
+		}
+	}
+	return n, write(r.lines[:r.next])
+}
+
+var (
+	recentMu sync.Mutex
+	recent   *ring
+)
+
+// WriteRecent writes the last lines logged, oldest first, as many as the
+// configuration keeps.
+func WriteRecent(w io.Writer) error {
+	recentMu.Lock()
+	r := recent
+	recentMu.Unlock()
+	if r == nil {
+		return nil
+	}
+	_, err := r.WriteTo(w)
+	return err
+}
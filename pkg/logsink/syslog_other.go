@@ -0,0 +1,15 @@
+//go:build windows || plan9
+
+package logsink
+
+import (
+	"errors"
+	"io"
+	"log/slog"
+
+	"mrvaserver/pkg/config"
+)
+
+func newSyslog(config.LogSyslog, *slog.HandlerOptions) (slog.Handler, io.Closer, error) {
+	return nil, nil, errors.New("syslog is not available on this platform")
+}
@@ -0,0 +1,37 @@
+//go:build !windows && !plan9
+
+package logsink
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"log/syslog"
+
+	"mrvaserver/pkg/config"
+)
+
+func newSyslog(cfg config.LogSyslog, opts *slog.HandlerOptions) (slog.Handler, io.Closer, error) {
+	w, err := syslog.Dial(cfg.Network, cfg.Address, syslog.LOG_DAEMON|syslog.LOG_INFO, cfg.Tag)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to syslog: %w", err)
+	}
+	h := newLineHandler(opts, func(level slog.Level, line string) error {
+		var err error
+		switch {
+		case level >= slog.LevelError:
+			err = w.Err(line)
+		case level >= slog.LevelWarn:
+			err = w.Warning(line)
+		case level >= slog.LevelInfo:
+			err = w.Info(line)
+		default:
+			err = w.Debug(line)
+		}
+		if err != nil {
+			droppedTotal.With("syslog").Inc()
+		}
+		return err
+	})
+	return h, w, nil
+}
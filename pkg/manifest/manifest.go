@@ -0,0 +1,346 @@
+// Package manifest generates a docker-compose file or Kubernetes manifests
+// for a complete deployment: the server, its agents, RabbitMQ, the MinIO
+// artifact and database stores, and whatever else the configuration's
+// backends need (Postgres, MySQL, etcd, Redis, a replication secondary).
+// Credentials are generated and written into the output, which should be
+// kept private.
+package manifest
+
+import (
+	"crypto/rand"
+	_ "embed"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"mrvaserver/pkg/config"
+)
+
+// Options parameterizes the generated stack.
+type Options struct {
+	// Format is "compose" or "kubernetes".
+	Format string
+
+	ServerImage string
+	AgentImage  string
+	Agents      int
+	// Replicas is the number of server replicas; compose runs one.
+	Replicas int
+	// Namespace of the Kubernetes objects; empty uses the current one.
+	Namespace string
+	// StorageSize is the size of each Kubernetes volume claim.
+	StorageSize string
+
+	// Config is the configuration file the server runs with, shipped with
+	// the stack as is.  Empty runs it with the defaults.
+	Config []byte
+}
+
+const (
+	minioImage    = "minio/minio:RELEASE.2024-06-11T03-13-30Z"
+	rabbitmqImage = "rabbitmq:3-management"
+	postgresImage = "postgres:16"
+	mysqlImage    = "mysql:8.4"
+	etcdImage     = "quay.io/coreos/etcd:v3.5.15"
+	redisImage    = "redis:7"
+
+	// configPath is where the server's configuration is mounted.
+	configPath = "/etc/mrvaserver/mrvaserver.yaml"
+	user       = "mrva"
+)
+
+// env is a container environment variable.  A Secret variable is kept in
+// the Kubernetes Secret under that key.
+type env struct {
+	Name   string
+	Value  string
+	Secret string
+}
+
+type service struct {
+	Name      string
+	Image     string
+	Args      []string
+	Env       []env
+	Port      int
+	Publish   bool
+	Volume    string
+	WorkDir   string
+	DependsOn []string
+	Replicas  int
+	// Config mounts the server configuration.
+	Config bool
+	// ServiceAccount is the Kubernetes account the pods run as.
+	ServiceAccount string
+	// Migrate runs the server's migrations in a Kubernetes init container,
+	// and ProbePort (if not zero) serves its probes.
+	Migrate   bool
+	ProbePort int
+}
+
+type stack struct {
+	Options
+	Services []service
+	Secrets  map[string]string
+	// LeaseRBAC grants the server's account access to leases, for
+	// Kubernetes leader election.
+	LeaseRBAC bool
+}
+
+// Generate writes the stack for cfg to w.
+func Generate(w io.Writer, cfg *config.Config, opts Options) error {
+	s, err := build(cfg, opts)
+	if err != nil {
+		return err
+	}
+	var tmpl *template.Template
+	switch opts.Format {
+	case "compose":
+		tmpl = composeTemplate
+	case "kubernetes":
+		tmpl = kubernetesTemplate
+	default:
+		return fmt.Errorf("unknown format %q", opts.Format)
+	}
+	return tmpl.Execute(w, s)
+}
+
+func build(cfg *config.Config, opts Options) (*stack, error) {
+	if cfg.Queue.Backend != "rabbitmq" || cfg.Artifacts.Backend != "minio" || cfg.Databases.Backend != "hepc" {
+		return nil, fmt.Errorf("only the built-in queue, artifact and database backends can be generated")
+	}
+	port := 8080
+	if cfg.HTTP.Listen != "" {
+		var err error
+		if port, err = tcpPort("http.listen", cfg.HTTP.Listen); err != nil {
+			return nil, err
+		}
+	}
+	probePort := port
+	if cfg.HTTP.ProbeListen != "" {
+		var err error
+		if probePort, err = tcpPort("http.probe_listen", cfg.HTTP.ProbeListen); err != nil {
+			return nil, err
+		}
+	}
+	if opts.Format == "compose" {
+		opts.Replicas = 1
+	}
+	if cfg.State.Backend == "journal" && opts.Replicas > 1 {
+		return nil, fmt.Errorf("the journal state backend runs a single replica")
+	}
+
+	if len(opts.Config) == 0 {
+		opts.Config = []byte("# Defaults.\n")
+	}
+	s := &stack{Options: opts, Secrets: map[string]string{}}
+	secret := func(key string) string {
+		if s.Secrets[key] == "" {
+			b := make([]byte, 16)
+			rand.Read(b)
+			s.Secrets[key] = hex.EncodeToString(b)
+		}
+		return s.Secrets[key]
+	}
+	minio := func(name, key string) service {
+		secret(key)
+		return service{
+			Name:   name,
+			Image:  minioImage,
+			Args:   []string{"server", "/data", "--console-address", ":9001"},
+			Env:    []env{{Name: "MINIO_ROOT_USER", Value: user}, {Name: "MINIO_ROOT_PASSWORD", Secret: key}},
+			Port:   9000,
+			Volume: "/data",
+		}
+	}
+
+	// The agents and the server share the queue and stores.
+	common := []env{
+		{Name: "MRVA_RABBITMQ_HOST", Value: "rabbitmq"},
+		{Name: "MRVA_RABBITMQ_PORT", Value: "5672"},
+		{Name: "MRVA_RABBITMQ_USER", Value: user},
+		{Name: "MRVA_RABBITMQ_PASSWORD", Secret: "rabbitmq-password"},
+		{Name: "ARTIFACT_MINIO_ENDPOINT", Value: "artifactstore:9000"},
+		{Name: "ARTIFACT_MINIO_ID", Value: user},
+		{Name: "ARTIFACT_MINIO_SECRET", Secret: "artifactstore-password"},
+		{Name: "QLDB_MINIO_ENDPOINT", Value: "dbstore:9000"},
+		{Name: "QLDB_MINIO_ID", Value: user},
+		{Name: "QLDB_MINIO_SECRET", Secret: "dbstore-password"},
+	}
+	secret("rabbitmq-password")
+	s.Services = append(s.Services,
+		service{
+			Name:  "rabbitmq",
+			Image: rabbitmqImage,
+			Env: []env{
+				{Name: "RABBITMQ_DEFAULT_USER", Value: user},
+				{Name: "RABBITMQ_DEFAULT_PASS", Secret: "rabbitmq-password"},
+			},
+			Port:   5672,
+			Volume: "/var/lib/rabbitmq",
+		},
+		minio("artifactstore", "artifactstore-password"),
+		minio("dbstore", "dbstore-password"),
+	)
+
+	server := service{
+		Name:      "server",
+		Image:     opts.ServerImage,
+		Args:      []string{"--mode=container", "--loglevel=info", "--config=" + configPath},
+		Env:       append([]env{{Name: "SERVER_PORT", Value: strconv.Itoa(port)}}, common...),
+		Port:      port,
+		Publish:   true,
+		DependsOn: []string{"rabbitmq", "artifactstore", "dbstore"},
+		Replicas:  opts.Replicas,
+		Config:    true,
+		Migrate:   true,
+		ProbePort: probePort,
+	}
+
+	// Everything but the etcd backend keeps the metadata in Postgres.
+	if cfg.State.Backend != "etcd" {
+		secret("postgres-password")
+		s.Services = append(s.Services, service{
+			Name:  "postgres",
+			Image: postgresImage,
+			Env: []env{
+				{Name: "POSTGRES_USER", Value: user},
+				{Name: "POSTGRES_PASSWORD", Secret: "postgres-password"},
+				{Name: "POSTGRES_DB", Value: user},
+				{Name: "PGDATA", Value: "/var/lib/postgresql/data/pgdata"},
+			},
+			Port:   5432,
+			Volume: "/var/lib/postgresql/data",
+		})
+		server.Env = append(server.Env,
+			env{Name: "PGHOST", Value: "postgres"},
+			env{Name: "PGUSER", Value: user},
+			env{Name: "PGPASSWORD", Secret: "postgres-password"},
+			env{Name: "PGDATABASE", Value: user},
+			env{Name: "PGSSLMODE", Value: "disable"},
+		)
+		server.DependsOn = append(server.DependsOn, "postgres")
+	}
+	switch cfg.State.Backend {
+	case "mysql":
+		password := secret("mysql-password")
+		secret("mysql-root-password")
+		s.Secrets["state-dsn"] = fmt.Sprintf("%s:%s@tcp(mysql:3306)/%s", user, password, user)
+		s.Services = append(s.Services, service{
+			Name:  "mysql",
+			Image: mysqlImage,
+			Env: []env{
+				{Name: "MYSQL_DATABASE", Value: user},
+				{Name: "MYSQL_USER", Value: user},
+				{Name: "MYSQL_PASSWORD", Secret: "mysql-password"},
+				{Name: "MYSQL_ROOT_PASSWORD", Secret: "mysql-root-password"},
+			},
+			Port:   3306,
+			Volume: "/var/lib/mysql",
+		})
+		server.Env = append(server.Env, env{Name: "MRVA_STATE_DSN", Secret: "state-dsn"})
+		server.DependsOn = append(server.DependsOn, "mysql")
+	case "etcd":
+		s.Services = append(s.Services, service{
+			Name:  "etcd",
+			Image: etcdImage,
+			Args: []string{"etcd", "--data-dir=/etcd-data",
+				"--listen-client-urls=http://0.0.0.0:2379", "--advertise-client-urls=http://etcd:2379"},
+			Port:   2379,
+			Volume: "/etcd-data",
+		})
+		server.Env = append(server.Env, env{Name: "MRVA_ETCD_ENDPOINTS", Value: "http://etcd:2379"})
+		server.DependsOn = append(server.DependsOn, "etcd")
+	case "journal":
+		// A relative journal file is kept in the working directory.
+		dir := path.Dir(cfg.State.JournalFile)
+		if !path.IsAbs(dir) {
+			server.WorkDir = "/var/lib/mrvaserver"
+			dir = path.Join(server.WorkDir, dir)
+		}
+		server.Volume = dir
+	}
+
+	if cfg.Cache.Enabled {
+		s.Services = append(s.Services, service{Name: "redis", Image: redisImage, Port: 6379})
+		server.Env = append(server.Env, env{Name: "MRVA_REDIS_ADDR", Value: "redis:6379"})
+		server.DependsOn = append(server.DependsOn, "redis")
+	}
+	if cfg.Replication.Enabled {
+		s.Services = append(s.Services, minio("artifactstore-dr", "artifactstore-dr-password"))
+		server.Env = append(server.Env,
+			env{Name: "DR_MINIO_ENDPOINT", Value: "artifactstore-dr:9000"},
+			env{Name: "DR_MINIO_ID", Value: user},
+			env{Name: "DR_MINIO_SECRET", Secret: "artifactstore-dr-password"},
+		)
+		server.DependsOn = append(server.DependsOn, "artifactstore-dr")
+	}
+	if cfg.Leader.Backend == "kubernetes" {
+		if opts.Format == "compose" {
+			return nil, fmt.Errorf("leader.backend kubernetes cannot run under compose")
+		}
+		s.LeaseRBAC = true
+		server.ServiceAccount = "mrvaserver"
+	}
+
+	s.Services = append(s.Services, server, service{
+		Name:      "agent",
+		Image:     opts.AgentImage,
+		Args:      []string{"--loglevel=info"},
+		Env:       common,
+		DependsOn: []string{"rabbitmq", "artifactstore", "dbstore"},
+		Replicas:  opts.Agents,
+	})
+	return s, nil
+}
+
+// tcpPort is the port of the listen address addr of setting name.
+func tcpPort(name, addr string) (int, error) {
+	if strings.HasPrefix(addr, "unix:") {
+		return 0, fmt.Errorf("%s must be a TCP address to be published", name)
+	}
+	_, p, err := net.SplitHostPort(addr)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s: %w", name, err)
+	}
+	port, err := strconv.Atoi(p)
+	if err != nil {
+		return 0, fmt.Errorf("invalid %s port: %w", name, err)
+	}
+	return port, nil
+}
+
+func (s *stack) ConfigPath() string { return configPath }
+
+// EnvValue is the literal value of e.
+func (s *stack) EnvValue(e env) string {
+	if e.Secret != "" {
+		return s.Secrets[e.Secret]
+	}
+	return e.Value
+}
+
+var funcs = template.FuncMap{
+	// quote makes a YAML double-quoted scalar.
+	"quote":      strconv.Quote,
+	"configPath": func() string { return configPath },
+	"indent": func(n int, text string) string {
+		pad := strings.Repeat(" ", n)
+		return pad + strings.ReplaceAll(strings.TrimRight(text, "\n"), "\n", "\n"+pad)
+	},
+}
+
+var (
+	//go:embed compose.tmpl
+	composeText string
+	//go:embed kubernetes.tmpl
+	kubernetesText string
+
+	composeTemplate    = template.Must(template.New("compose").Funcs(funcs).Parse(composeText))
+	kubernetesTemplate = template.Must(template.New("kubernetes").Funcs(funcs).Parse(kubernetesText))
+)
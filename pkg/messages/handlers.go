@@ -0,0 +1,46 @@
+package messages
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+
+	"github.com/gorilla/mux"
+)
+
+// Register adds the catalog, for clients that render messages themselves:
+//
+//	GET /messages          the locales with messages
+//	GET /messages/{locale} every message's template in a locale, falling
+//	                       back as Render does
+func (c *Catalog) Register(r *mux.Router) {
+	r.HandleFunc("/messages", c.listLocales).Methods(http.MethodGet)
+	r.HandleFunc("/messages/{locale}", c.getLocale).Methods(http.MethodGet)
+}
+
+func (c *Catalog) listLocales(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, map[string]any{"locales": c.Locales(), "default": c.fallback})
+}
+
+func (c *Catalog) getLocale(w http.ResponseWriter, r *http.Request) {
+	locale := c.match(mux.Vars(r)["locale"])
+	if locale == "" {
+		http.Error(w, "no messages for this locale", http.StatusNotFound)
+		return
+	}
+	out := make(map[string]string)
+	chain := c.chain(locale)
+	slices.Reverse(chain)
+	for _, l := range chain {
+		for id, src := range c.sources[l] {
+			out[id] = src
+		}
+	}
+	w.Header().Set("Content-Language", locale)
+	writeJSON(w, map[string]any{"locale": locale, "messages": out})
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
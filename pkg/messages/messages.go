@@ -0,0 +1,239 @@
+// Package messages is the catalog of user-facing messages.  Each message
+// has an ID, such as "session.not_found", and per locale a text/template
+// over named parameters:
+//
+//	"submit.too_many_repositories": "{{.n}} repositories exceed the limit of {{.max}} per session"
+//
+// English is built in.  Other locales, or different English wording, are
+// JSON files of the same form named after their locale, such as
+// pt-BR.json, in the configured directory.  A request picks its locale
+// with the locale query parameter or Accept-Language; a message missing
+// from its locale falls back to the locale's base language, then to the
+// default locale, then to English.
+package messages
+
+import (
+	"bytes"
+	"embed"
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"net/http"
+	"os"
+	"path"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"mrvaserver/pkg/config"
+)
+
+// English is the built-in locale.
+const English = "en"
+
+//go:embed catalog/*.json
+var builtin embed.FS
+
+// Params are a message's template parameters.
+type Params map[string]any
+
+// Catalog holds the messages of every locale.
+type Catalog struct {
+	locales  map[string]map[string]*template.Template
+	sources  map[string]map[string]string
+	fallback string
+
+	// static maps the English text of messages without parameters to
+	// their IDs, so that plain-text messages can be localized too.
+	static map[string]string
+}
+
+// Builtin is the catalog of the built-in messages.
+var Builtin = mustBuiltin()
+
+func mustBuiltin() *Catalog {
+	c, err := New(config.Messages{})
+	if err != nil {
+		panic(err)
+	}
+	return c
+}
+
+// New loads the built-in messages and those in cfg.Dir.
+func New(cfg config.Messages) (*Catalog, error) {
+	c := &Catalog{
+		locales:  make(map[string]map[string]*template.Template),
+		sources:  make(map[string]map[string]string),
+		fallback: English,
+		static:   make(map[string]string),
+	}
+	if err := c.loadDir(builtin, "catalog"); err != nil {
+		return nil, err
+	}
+	for id, src := range c.sources[English] {
+		if !strings.Contains(src, "{{") {
+			c.static[src] = id
+		}
+	}
+	if cfg.Dir != "" {
+		if err := c.loadDir(os.DirFS(cfg.Dir), "."); err != nil {
+			return nil, err
+		}
+	}
+	if cfg.DefaultLocale != "" {
+		if _, ok := c.locales[cfg.DefaultLocale]; !ok {
+			return nil, fmt.Errorf("messages.default_locale: no messages for %q", cfg.DefaultLocale)
+		}
+		c.fallback = cfg.DefaultLocale
+	}
+	return c, nil
+}
+
+func (c *Catalog) loadDir(fsys fs.FS, dir string) error {
+	files, err := fs.Glob(fsys, path.Join(dir, "*.json"))
+	if err != nil {
+		return err
+	}
+	for _, name := range files {
+		data, err := fs.ReadFile(fsys, name)
+		if err != nil {
+			return fmt.Errorf("failed to read messages: %w", err)
+		}
+		var msgs map[string]string
+		if err := json.Unmarshal(data, &msgs); err != nil {
+			return fmt.Errorf("failed to parse messages %s: %w", name, err)
+		}
+		locale := strings.TrimSuffix(path.Base(name), ".json")
+		if c.locales[locale] == nil {
+			c.locales[locale] = make(map[string]*template.Template)
+			c.sources[locale] = make(map[string]string)
+		}
+		for id, src := range msgs {
+			t, err := template.New(id).Option("missingkey=error").Parse(src)
+			if err != nil {
+				return fmt.Errorf("messages %s: %w", name, err)
+			}
+			c.locales[locale][id] = t
+			c.sources[locale][id] = src
+		}
+	}
+	return nil
+}
+
+// Locales returns the locales with messages.
+func (c *Catalog) Locales() []string {
+	out := make([]string, 0, len(c.locales))
+	for l := range c.locales {
+		out = append(out, l)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// chain is the locales a message is looked up in for locale, in order.
+func (c *Catalog) chain(locale string) []string {
+	var out []string
+	add := func(l string) {
+		if l != "" && !slices.Contains(out, l) {
+			out = append(out, l)
+		}
+	}
+	add(locale)
+	if base, _, ok := strings.Cut(locale, "-"); ok {
+		add(base)
+	}
+	add(c.fallback)
+	add(English)
+	return out
+}
+
+// Render renders a message in locale, or the first locale it falls back
+// to that has the message, and returns the locale it rendered in.  It
+// reports false if no locale has the message or it does not render with p.
+func (c *Catalog) Render(locale, id string, p Params) (string, string, bool) {
+	for _, l := range c.chain(locale) {
+		t, ok := c.locales[l][id]
+		if !ok {
+			continue
+		}
+		var buf bytes.Buffer
+		if err := t.Execute(&buf, p); err == nil {
+			return buf.String(), l, true
+		}
+	}
+	return "", "", false
+}
+
+// Text renders a message in the default locale, or returns its ID if
+// there is no such message.
+func (c *Catalog) Text(id string, p Params) string {
+	if s, _, ok := c.Render(c.fallback, id, p); ok {
+		return s
+	}
+	return id
+}
+
+// Lookup returns the ID of the message without parameters whose English
+// text is s.
+func (c *Catalog) Lookup(s string) (string, bool) {
+	id, ok := c.static[s]
+	return id, ok
+}
+
+// Negotiate picks a request's locale: its locale query parameter if there
+// are messages for it, else the best of its Accept-Language, else the
+// default locale.
+func (c *Catalog) Negotiate(r *http.Request) string {
+	if l := r.URL.Query().Get("locale"); l != "" {
+		if best := c.match(l); best != "" {
+			return best
+		}
+	}
+	type pref struct {
+		tag string
+		q   float64
+	}
+	var prefs []pref
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if tag == "" || tag == "*" {
+			continue
+		}
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if q > 0 {
+			prefs = append(prefs, pref{tag, q})
+		}
+	}
+	sort.SliceStable(prefs, func(i, j int) bool { return prefs[i].q > prefs[j].q })
+	for _, p := range prefs {
+		if best := c.match(p.tag); best != "" {
+			return best
+		}
+	}
+	return c.fallback
+}
+
+// match returns the locale with messages that best serves tag, ignoring
+// case: itself, else its base language, else another locale of that
+// language.
+func (c *Catalog) match(tag string) string {
+	base, _, _ := strings.Cut(tag, "-")
+	var sibling string
+	for _, l := range c.Locales() {
+		if strings.EqualFold(l, tag) {
+			return l
+		}
+		lbase, _, _ := strings.Cut(l, "-")
+		if strings.EqualFold(lbase, base) && (sibling == "" || !strings.Contains(l, "-")) {
+			sibling = l
+		}
+	}
+	return sibling
+}
@@ -0,0 +1,168 @@
+// Package metrics keeps the server's counters and gauges and serves them
+// in the Prometheus text exposition format on /metrics.  Feature packages
+// create their metrics at init time with NewCounter and NewGauge.
+package metrics
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/gorilla/mux"
+)
+
+type kind string
+
+const (
+	counter kind = "counter"
+	gauge   kind = "gauge"
+)
+
+type Registry struct {
+	mu       sync.Mutex
+	families map[string]*family
+}
+
+// Default is the registry the New* functions register with.
+var Default = &Registry{families: make(map[string]*family)}
+
+type family struct {
+	name, help string
+	kind       kind
+	labels     []string
+
+	mu     sync.Mutex
+	values map[string]*value
+}
+
+type value struct {
+	labels string
+	bits   atomic.Uint64
+}
+
+func (v *value) get() float64  { return math.Float64frombits(v.bits.Load()) }
+func (v *value) set(f float64) { v.bits.Store(math.Float64bits(f)) }
+
+func (v *value) add(f float64) {
+	for {
+		old := v.bits.Load()
+		if v.bits.CompareAndSwap(old, math.Float64bits(math.Float64frombits(old)+f)) {
+			return
+		}
+	}
+}
+
+func (r *Registry) family(name, help string, k kind, labels []string) *family {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if f, ok := r.families[name]; ok {
+		return f
+	}
+	f := &family{name: name, help: help, kind: k, labels: labels, values: make(map[string]*value)}
+	r.families[name] = f
+	return f
+}
+
+func (f *family) with(labelValues []string) *value {
+	if len(labelValues) != len(f.labels) {
+		panic(fmt.Sprintf("metrics: %s takes %d label values, got %d", f.name, len(f.labels), len(labelValues)))
+	}
+	var b strings.Builder
+	for i, l := range f.labels {
+		if i > 0 {
+			b.WriteByte(',')
+		}
+		fmt.Fprintf(&b, "%s=%q", l, labelValues[i])
+	}
+	key := b.String()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	v, ok := f.values[key]
+	if !ok {
+		v = &value{labels: key}
+		f.values[key] = v
+	}
+	return v
+}
+
+// Counter only goes up.
+type Counter struct{ v *value }
+
+func (c Counter) Inc()          { c.v.add(1) }
+func (c Counter) Add(f float64) { c.v.add(f) }
+
+// Gauge is a value that is set.
+type Gauge struct{ v *value }
+
+func (g Gauge) Set(f float64) { g.v.set(f) }
+func (g Gauge) Add(f float64) { g.v.add(f) }
+func (g Gauge) Value() float64 {
+	return g.v.get()
+}
+
+// CounterVec and GaugeVec are families with labels.
+type CounterVec struct{ f *family }
+type GaugeVec struct{ f *family }
+
+func (c CounterVec) With(labelValues ...string) Counter { return Counter{c.f.with(labelValues)} }
+func (g GaugeVec) With(labelValues ...string) Gauge     { return Gauge{g.f.with(labelValues)} }
+
+func NewCounter(name, help string) Counter {
+	return Counter{Default.family(name, help, counter, nil).with(nil)}
+}
+
+func NewGauge(name, help string) Gauge {
+	return Gauge{Default.family(name, help, gauge, nil).with(nil)}
+}
+
+func NewCounterVec(name, help string, labels ...string) CounterVec {
+	return CounterVec{Default.family(name, help, counter, labels)}
+}
+
+func NewGaugeVec(name, help string, labels ...string) GaugeVec {
+	return GaugeVec{Default.family(name, help, gauge, labels)}
+}
+
+// Register adds GET /metrics.
+func (r *Registry) Register(router *mux.Router) {
+	router.Handle("/metrics", r).Methods(http.MethodGet)
+}
+
+func (r *Registry) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	names := make([]string, 0, len(r.families))
+	for name := range r.families {
+		names = append(names, name)
+	}
+	r.mu.Unlock()
+	sort.Strings(names)
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	for _, name := range names {
+		r.mu.Lock()
+		f := r.families[name]
+		r.mu.Unlock()
+
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", f.name, f.help, f.name, f.kind)
+		f.mu.Lock()
+		keys := make([]string, 0, len(f.values))
+		for k := range f.values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			v := f.values[k]
+			if v.labels == "" {
+				fmt.Fprintf(w, "%s %g\n", f.name, v.get())
+			} else {
+				fmt.Fprintf(w, "%s{%s} %g\n", f.name, v.labels, v.get())
+			}
+		}
+		f.mu.Unlock()
+	}
+}
@@ -0,0 +1,100 @@
+package middleware
+
+import (
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/web"
+)
+
+var slowRequests = metrics.NewCounterVec("mrvaserver_http_slow_requests_total",
+	"Requests that took longer than the access log's slow threshold.", "class")
+
+// AccessLog logs requests, as cfg samples them, once they are answered.
+// The route is the path template the gateway matched, or "" for requests
+// passed to the commander.  It must run inside Forwarded, for the client
+// address, and outside the rest to see the response as sent.  Probes and
+// metrics scrapes are only logged when slow or failing.
+func AccessLog(cfg config.AccessLog) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			r, route := web.WithRouteSlot(r)
+			sw := &statusWriter{ResponseWriter: w}
+			next.ServeHTTP(sw, r)
+			took := time.Since(start)
+
+			class := Classify(r)
+			slow := cfg.SlowThreshold > 0 && took >= cfg.SlowThreshold
+			if slow {
+				slowRequests.With(class).Inc()
+			}
+			if sw.status == 0 {
+				sw.status = http.StatusOK
+			}
+			level := slog.LevelInfo
+			switch {
+			case slow, sw.status >= 500:
+				level = slog.LevelWarn
+			case r.URL.Path == "/readyz", r.URL.Path == "/startupz", r.URL.Path == "/livez", r.URL.Path == "/metrics":
+				return
+			default:
+				rate, ok := cfg.Classes[class]
+				if !ok {
+					rate = cfg.Sample
+				}
+				if rate <= 0 || rand.Float64() >= rate {
+					return
+				}
+			}
+			slog.Log(r.Context(), level, "HTTP request",
+				"method", r.Method,
+				"path", r.URL.Path,
+				"route", *route,
+				"status", sw.status,
+				"bytes", sw.bytes,
+				"duration", took,
+				"identity", web.Identity(r),
+				"client", web.OriginOf(r).ClientIP,
+				"slow", slow)
+		})
+	}
+}
+
+// statusWriter records the status and size of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 && code >= 200 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	n, err := sw.ResponseWriter.Write(p)
+	sw.bytes += int64(n)
+	return n, err
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (sw *statusWriter) Unwrap() http.ResponseWriter {
+	return sw.ResponseWriter
+}
@@ -0,0 +1,55 @@
+package middleware
+
+import (
+	"log/slog"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/web"
+)
+
+// adminPrefixes are the paths cfg.AdminAllow guards.
+var adminPrefixes = []string{"/admin/", "/debug/"}
+
+// AdminAllow restricts the admin and debug endpoints to clients in
+// cfg.AdminAllow, whatever credentials they present.  The client address
+// is the one Forwarded determined, so AdminAllow must run after it.  An
+// empty list allows every client.
+func AdminAllow(cfg config.HTTP) func(http.Handler) http.Handler {
+	allowed := parsePrefixes(cfg.AdminAllow)
+	return func(next http.Handler) http.Handler {
+		if len(allowed) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if !isAdminPath(r.URL.Path) {
+				next.ServeHTTP(w, r)
+				return
+			}
+			client := web.OriginOf(r).ClientIP
+			ip, err := netip.ParseAddr(client)
+			if err == nil {
+				ip = ip.Unmap()
+				for _, p := range allowed {
+					if p.Contains(ip) {
+						next.ServeHTTP(w, r)
+						return
+					}
+				}
+			}
+			slog.Warn("Admin request from a client not allowed", "client", client, "path", r.URL.Path)
+			http.Error(w, "forbidden", http.StatusForbidden)
+		})
+	}
+}
+
+func isAdminPath(path string) bool {
+	for _, p := range adminPrefixes {
+		if strings.HasPrefix(path, p) || path == strings.TrimSuffix(p, "/") {
+			return true
+		}
+	}
+	return false
+}
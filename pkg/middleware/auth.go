@@ -0,0 +1,101 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/web"
+)
+
+// Tokens are the bearer tokens callers are authenticated by.  They are
+// kept hashed, so that looking one up takes no longer for a near miss.
+type Tokens struct {
+	names  map[[sha256.Size]byte]string
+	tokens map[string]string // principal -> its first token
+}
+
+// LoadTokens reads cfg.TokensFile.  Without one nobody is authenticated.
+func LoadTokens(cfg config.Auth) (*Tokens, error) {
+	t := &Tokens{names: make(map[[sha256.Size]byte]string), tokens: make(map[string]string)}
+	if cfg.TokensFile == "" {
+		return t, nil
+	}
+	data, err := os.ReadFile(cfg.TokensFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read tokens file: %w", err)
+	}
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; sc.Scan(); n++ {
+		line := strings.TrimSpace(sc.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("%s:%d: want a name and a token", cfg.TokensFile, n)
+		}
+		t.names[sha256.Sum256([]byte(fields[1]))] = fields[0]
+		if _, ok := t.tokens[fields[0]]; !ok {
+			t.tokens[fields[0]] = fields[1]
+		}
+	}
+	return t, sc.Err()
+}
+
+// TokenOf returns a token of principal name.
+func (t *Tokens) TokenOf(name string) (string, bool) {
+	token, ok := t.tokens[name]
+	return token, ok
+}
+
+// Authenticate records the principal of requests carrying one of the
+// tokens (see web.Principal).  Other requests go on unauthenticated.
+func Authenticate(t *Tokens) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		if len(t.names) == 0 {
+			return next
+		}
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			auth := r.Header.Get("Authorization")
+			token, ok := strings.CutPrefix(auth, "Bearer ")
+			if !ok {
+				token, ok = strings.CutPrefix(auth, "token ")
+			}
+			if ok && token != "" {
+				if name, found := t.names[sha256.Sum256([]byte(token))]; found {
+					r = web.WithPrincipal(r, name)
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// RequireAdmin answers only requests authenticated as one of cfg.Admins:
+// others get 401 if they are not authenticated, 403 if they are.
+// Authenticate must run before it.
+func RequireAdmin(cfg config.Auth) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			name := web.Principal(r)
+			switch {
+			case name == "":
+				w.Header().Set("WWW-Authenticate", `Bearer realm="mrvaserver"`)
+				http.Error(w, "unauthorized", http.StatusUnauthorized)
+			case !slices.Contains(cfg.Admins, name):
+				slog.Warn("Admin request from a principal not allowed", "principal", name, "path", r.URL.Path)
+				http.Error(w, "forbidden", http.StatusForbidden)
+			default:
+				next.ServeHTTP(w, r)
+			}
+		})
+	}
+}
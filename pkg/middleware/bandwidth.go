@@ -0,0 +1,64 @@
+package middleware
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/throttle"
+)
+
+// Bandwidth limits the transfer rate of query pack uploads (ingress) and of
+// artifact and database downloads (egress).  Artifact downloads are charged
+// to the session named by their URL; uploads precede their session and
+// database downloads belong to none, so only the global limits apply to
+// them.  It must run inside Compress, to count the bytes actually sent.
+func Bandwidth(t *throttle.Throttle) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p := r.URL.Path
+			switch {
+			case Classify(r) == ClassSubmission:
+				r.Body = &throttledBody{
+					Reader: t.Reader(r.Context(), throttle.Ingress, 0, r.Body),
+					Closer: r.Body,
+				}
+			case strings.HasPrefix(p, "/download/"):
+				session := 0
+				if js, err := common.DecodeJobSpec(strings.TrimPrefix(p, "/download/")); err == nil {
+					session = js.SessionID
+				}
+				w = &throttledWriter{ResponseWriter: w, w: t.Writer(r.Context(), throttle.Egress, session, w)}
+			case strings.Contains(p, "/code-scanning/codeql/databases/"):
+				w = &throttledWriter{ResponseWriter: w, w: t.Writer(r.Context(), throttle.Egress, 0, w)}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+type throttledBody struct {
+	io.Reader
+	io.Closer
+}
+
+type throttledWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (tw *throttledWriter) Write(p []byte) (int, error) {
+	return tw.w.Write(p)
+}
+
+func (tw *throttledWriter) Flush() {
+	if f, ok := tw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (tw *throttledWriter) Unwrap() http.ResponseWriter {
+	return tw.ResponseWriter
+}
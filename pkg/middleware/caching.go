@@ -0,0 +1,68 @@
+package middleware
+
+import (
+	"context"
+	"net/http"
+	"strings"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+)
+
+// immutable is the Cache-Control of result downloads that may be kept:
+// the archive of a job's result never changes, but it is the submitter's,
+// so only private caches may keep it.
+const immutable = "private, max-age=31536000, immutable"
+
+// CacheDownloads marks successful result downloads as immutable where
+// nothing forbids caching them.  A download already no-store keeps it, so
+// with Harden, inside or outside, none is marked; nor is one of a session
+// private reports as private -- sealed, say, or an authenticated tenant's
+// -- nor one whose session the URL does not name, which are no-store.
+// Error responses keep their headers: a download may succeed later.
+func CacheDownloads(private func(ctx context.Context, session int) bool) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if Classify(r) != ClassDownload {
+				next.ServeHTTP(w, r)
+				return
+			}
+			js, err := common.DecodeJobSpec(strings.TrimPrefix(r.URL.Path, "/download/"))
+			if !strings.HasPrefix(r.URL.Path, "/download/") || err != nil || private(r.Context(), js.SessionID) {
+				w.Header().Set("Cache-Control", "no-store")
+				next.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(&downloadWriter{ResponseWriter: w}, r)
+		})
+	}
+}
+
+type downloadWriter struct {
+	http.ResponseWriter
+	wroteHeader bool
+}
+
+func (dw *downloadWriter) WriteHeader(code int) {
+	if !dw.wroteHeader && code >= 200 {
+		dw.wroteHeader = true
+		ok := code == http.StatusOK || code == http.StatusPartialContent || code == http.StatusNotModified
+		if ok && dw.Header().Get("Cache-Control") != "no-store" {
+			dw.Header().Set("Cache-Control", immutable)
+		}
+	}
+	dw.ResponseWriter.WriteHeader(code)
+}
+
+func (dw *downloadWriter) Write(p []byte) (int, error) {
+	if !dw.wroteHeader {
+		dw.WriteHeader(http.StatusOK)
+	}
+	return dw.ResponseWriter.Write(p)
+}
+
+// Flush passes streamed downloads on as they are written.
+func (dw *downloadWriter) Flush() {
+	if f, ok := dw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,196 @@
+package middleware
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+	"mrvaserver/pkg/config"
+)
+
+var (
+	gzipPool = sync.Pool{New: func() any {
+		w, _ := gzip.NewWriterLevel(nil, gzip.DefaultCompression)
+		return w
+	}}
+	zstdPool = sync.Pool{New: func() any {
+		w, _ := zstd.NewWriter(nil, zstd.WithEncoderLevel(zstd.SpeedDefault), zstd.WithEncoderConcurrency(1))
+		return w
+	}}
+)
+
+// Already-compressed bodies, recognised by their first bytes.
+var compressedMagic = [][]byte{
+	{0x1f, 0x8b},             // gzip
+	{'P', 'K', 0x03, 0x04},   // zip
+	{0x28, 0xb5, 0x2f, 0xfd}, // zstd
+}
+
+// Compress compresses responses with zstd or gzip, whichever the client
+// prefers among those it accepts.  Bodies shorter than cfg.MinSize, partial
+// content and bodies that are already compressed, such as zipped result
+// archives, are sent as they are.
+func Compress(cfg config.Compression) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Encoding")
+			encoding := negotiate(r.Header.Get("Accept-Encoding"))
+			if encoding == "" || r.Method == http.MethodHead || r.Header.Get("Range") != "" {
+				next.ServeHTTP(w, r)
+				return
+			}
+			cw := &compressWriter{ResponseWriter: w, encoding: encoding, minSize: cfg.MinSize, status: http.StatusOK}
+			defer cw.Close()
+			next.ServeHTTP(cw, r)
+		})
+	}
+}
+
+// negotiate picks zstd or gzip from an Accept-Encoding header, by q-value
+// and preferring zstd on ties.
+func negotiate(accept string) string {
+	best, bestQ := "", 0.0
+	for _, part := range strings.Split(accept, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if f, err := strconv.ParseFloat(v, 64); err == nil {
+				q = f
+			}
+		}
+		if (name != "zstd" && name != "gzip") || q <= 0 {
+			continue
+		}
+		if q > bestQ || (q == bestQ && name == "zstd") {
+			best, bestQ = name, q
+		}
+	}
+	return best
+}
+
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	minSize  int
+	status   int
+
+	wroteHeader bool
+	enc         io.WriteCloser
+}
+
+func (cw *compressWriter) WriteHeader(code int) {
+	if !cw.wroteHeader {
+		cw.status = code
+	}
+	// 1xx responses are not the final header.
+	if code >= 100 && code < 200 {
+		cw.ResponseWriter.WriteHeader(code)
+	}
+}
+
+func (cw *compressWriter) Write(p []byte) (int, error) {
+	if !cw.wroteHeader {
+		cw.start(p)
+	}
+	if cw.enc != nil {
+		return cw.enc.Write(p)
+	}
+	return cw.ResponseWriter.Write(p)
+}
+
+// start decides, from the headers and the first bytes of the body, whether
+// to compress, and sends the header.
+func (cw *compressWriter) start(first []byte) {
+	cw.wroteHeader = true
+	h := cw.Header()
+	if cw.shouldCompress(h, first) {
+		h.Del("Content-Length")
+		h.Set("Content-Encoding", cw.encoding)
+		if etag := h.Get("ETag"); etag != "" && !strings.HasPrefix(etag, "W/") {
+			h.Set("ETag", "W/"+etag)
+		}
+		switch cw.encoding {
+		case "zstd":
+			z := zstdPool.Get().(*zstd.Encoder)
+			z.Reset(cw.ResponseWriter)
+			cw.enc = z
+		default:
+			g := gzipPool.Get().(*gzip.Writer)
+			g.Reset(cw.ResponseWriter)
+			cw.enc = g
+		}
+	}
+	cw.ResponseWriter.WriteHeader(cw.status)
+}
+
+func (cw *compressWriter) shouldCompress(h http.Header, first []byte) bool {
+	switch {
+	case cw.status < 200 || cw.status == http.StatusNoContent || cw.status == http.StatusNotModified,
+		cw.status == http.StatusPartialContent,
+		h.Get("Content-Encoding") != "",
+		len(first) == 0:
+		return false
+	}
+	if n, err := strconv.Atoi(h.Get("Content-Length")); err == nil && n < cw.minSize {
+		return false
+	}
+	ct := h.Get("Content-Type")
+	for _, prefix := range []string{"image/", "video/", "audio/", "application/zip", "application/gzip",
+		"application/x-gzip", "application/zstd"} {
+		if strings.HasPrefix(ct, prefix) {
+			return false
+		}
+	}
+	for _, magic := range compressedMagic {
+		if bytes.HasPrefix(first, magic) {
+			return false
+		}
+	}
+	return true
+}
+
+// Flush sends what has been compressed so far, for streamed responses.
+func (cw *compressWriter) Flush() {
+	if !cw.wroteHeader {
+		cw.start(nil)
+	}
+	switch enc := cw.enc.(type) {
+	case *gzip.Writer:
+		enc.Flush()
+	case *zstd.Encoder:
+		enc.Flush()
+	}
+	if f, ok := cw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying writer.
+func (cw *compressWriter) Unwrap() http.ResponseWriter {
+	return cw.ResponseWriter
+}
+
+func (cw *compressWriter) Close() {
+	if !cw.wroteHeader {
+		cw.wroteHeader = true
+		cw.ResponseWriter.WriteHeader(cw.status)
+		return
+	}
+	if cw.enc == nil {
+		return
+	}
+	cw.enc.Close()
+	switch enc := cw.enc.(type) {
+	case *gzip.Writer:
+		gzipPool.Put(enc)
+	case *zstd.Encoder:
+		zstdPool.Put(enc)
+	}
+	cw.enc = nil
+}
@@ -0,0 +1,114 @@
+// Package middleware holds the http.Handler wrappers the gateway applies to
+// every request before routing.
+package middleware
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/web"
+)
+
+// Forwarded makes the gateway usable behind a reverse proxy.  For requests
+// from a trusted proxy -- an address in cfg.TrustedProxies, or any peer on
+// a Unix socket -- X-Forwarded-Proto, -Host, -Prefix and -For describe the
+// client's view; the client address then replaces r.RemoteAddr.  A request
+// path under cfg.BasePath has it stripped before routing, and generated
+// URLs (see web.ExternalBase) include it again.
+func Forwarded(cfg config.HTTP) func(http.Handler) http.Handler {
+	trusted := parsePrefixes(cfg.TrustedProxies)
+	base := strings.TrimSuffix(cfg.BasePath, "/")
+
+	isTrusted := func(addr string) bool {
+		ip, err := netip.ParseAddr(host(addr))
+		if err != nil {
+			// Unix socket peers have no IP address.
+			return addr == "" || addr == "@"
+		}
+		ip = ip.Unmap()
+		for _, p := range trusted {
+			if p.Contains(ip) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			o := web.Origin{Scheme: "http", Host: r.Host, Prefix: base, ClientIP: host(r.RemoteAddr)}
+			if r.TLS != nil {
+				o.Scheme = "https"
+			}
+
+			if isTrusted(r.RemoteAddr) {
+				if v := first(r.Header.Get("X-Forwarded-Proto")); v == "http" || v == "https" {
+					o.Scheme = v
+				}
+				if v := first(r.Header.Get("X-Forwarded-Host")); v != "" {
+					o.Host = v
+				}
+				if v := r.Header.Get("X-Forwarded-Prefix"); v != "" {
+					o.Prefix = strings.TrimSuffix(first(v), "/")
+				}
+				if v := r.Header.Get("X-Forwarded-For"); v != "" {
+					o.ClientIP = clientIP(v, isTrusted)
+					r.RemoteAddr = net.JoinHostPort(o.ClientIP, "0")
+				}
+			}
+
+			if base != "" {
+				if p, ok := strings.CutPrefix(r.URL.Path, base); ok && (p == "" || p[0] == '/') {
+					r.URL.Path = "/" + strings.TrimPrefix(p, "/")
+					r.URL.RawPath = ""
+				}
+			}
+			next.ServeHTTP(w, web.WithOrigin(r, o))
+		})
+	}
+}
+
+// clientIP is the rightmost X-Forwarded-For entry not added by a trusted
+// proxy; entries further left are client-supplied and can be forged.
+func clientIP(xff string, isTrusted func(string) bool) string {
+	hops := strings.Split(xff, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := strings.TrimSpace(hops[i])
+		if hop == "" {
+			continue
+		}
+		if i == 0 || !isTrusted(hop) {
+			return hop
+		}
+	}
+	return ""
+}
+
+func parsePrefixes(list []string) []netip.Prefix {
+	var prefixes []netip.Prefix
+	for _, s := range list {
+		if p, err := netip.ParsePrefix(s); err == nil {
+			prefixes = append(prefixes, p.Masked())
+		} else if ip, err := netip.ParseAddr(s); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(ip, ip.BitLen()))
+		}
+	}
+	return prefixes
+}
+
+// host strips the port from addr, if it has one.
+func host(addr string) string {
+	if h, _, err := net.SplitHostPort(addr); err == nil {
+		return h
+	}
+	return addr
+}
+
+// first is the first value of a comma-separated header.
+func first(v string) string {
+	v, _, _ = strings.Cut(v, ",")
+	return strings.TrimSpace(v)
+}
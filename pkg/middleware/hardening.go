@@ -0,0 +1,48 @@
+package middleware
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/web"
+)
+
+// Harden sets the security headers every response carries, forbids caching
+// of result downloads, and caps request bodies by endpoint class (see
+// Classify).  Downloads stay no-store with CacheDownloads as well: it
+// marks immutable only downloads that nothing made no-store.
+// Strict-Transport-Security is only sent on requests that reached the
+// server, or its trusted proxy, over HTTPS, so Harden must run after
+// Forwarded.
+func Harden(cfg config.Hardening) func(http.Handler) http.Handler {
+	hsts := ""
+	if cfg.HSTSMaxAge > 0 {
+		hsts = "max-age=" + strconv.Itoa(int(cfg.HSTSMaxAge.Seconds())) + "; includeSubDomains"
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h := w.Header()
+			h.Set("X-Content-Type-Options", "nosniff")
+			h.Set("X-Frame-Options", "DENY")
+			h.Set("Referrer-Policy", "no-referrer")
+			if hsts != "" && web.OriginOf(r).Scheme == "https" {
+				h.Set("Strict-Transport-Security", hsts)
+			}
+
+			class := Classify(r)
+			if class == ClassDownload {
+				h.Set("Cache-Control", "no-store")
+			}
+			if limit, ok := cfg.MaxBody[class]; ok && limit > 0 && r.Body != nil {
+				if r.ContentLength > limit {
+					http.Error(w, fmt.Sprintf("request body exceeds %d bytes", limit), http.StatusRequestEntityTooLarge)
+					return
+				}
+				r.Body = http.MaxBytesReader(w, r.Body, limit)
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
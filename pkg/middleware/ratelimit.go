@@ -0,0 +1,142 @@
+package middleware
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/web"
+)
+
+// Endpoint classes for rate limiting.
+const (
+	ClassSubmission = "submission"
+	ClassPolling    = "polling"
+	ClassDownload   = "download"
+	ClassOther      = "other"
+)
+
+var rateLimited = metrics.NewCounterVec("mrvaserver_rate_limited_total",
+	"Requests rejected by the rate limiter.", "class")
+
+// sweepInterval is how often buckets that have refilled are dropped.
+const sweepInterval = time.Minute
+
+// Classify assigns a request to an endpoint class.
+func Classify(r *http.Request) string {
+	p := r.URL.Path
+	switch {
+	case r.Method == http.MethodPost && strings.HasSuffix(p, "/code-scanning/codeql/variant-analyses"),
+		r.Method == http.MethodPost && p == "/quick-queries":
+		return ClassSubmission
+	case strings.HasPrefix(p, "/download/"), strings.HasSuffix(p, "/result"):
+		return ClassDownload
+	case r.Method == http.MethodGet && strings.Contains(p, "/code-scanning/codeql/variant-analyses/"),
+		r.Method == http.MethodGet && strings.HasPrefix(p, "/quick-queries/"):
+		return ClassPolling
+	default:
+		return ClassOther
+	}
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+	full   time.Time // when it will have refilled, if not used
+}
+
+type limiter struct {
+	mu      sync.Mutex
+	classes map[string]config.Rate
+	buckets map[string]*bucket
+	swept   time.Time
+}
+
+// RateLimit applies a token bucket per caller (see web.Identity: the
+// authenticated principal, else the client address) and endpoint class.
+// A bucket is dropped once it has refilled, being as good as a new one.  Responses carry RateLimit-Limit, RateLimit-Remaining,
+// RateLimit-Reset and RateLimit-Policy headers; rejected requests get 429
+// with Retry-After.  Classes without a configured rate are not limited, nor
+// are the probe and metrics endpoints.  Buckets are per replica.
+func RateLimit(cfg config.RateLimit) func(http.Handler) http.Handler {
+	l := &limiter{classes: cfg.Classes, buckets: make(map[string]*bucket), swept: time.Now()}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/readyz", "/startupz", "/livez", "/metrics":
+				next.ServeHTTP(w, r)
+				return
+			}
+			class := Classify(r)
+			rate, ok := l.classes[class]
+			if !ok || rate.PerMinute <= 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			allowed, remaining, reset := l.take(web.Identity(r)+"|"+class, rate)
+			h := w.Header()
+			h.Set("RateLimit-Limit", strconv.Itoa(rate.Burst))
+			h.Set("RateLimit-Remaining", strconv.Itoa(remaining))
+			h.Set("RateLimit-Reset", strconv.Itoa(reset))
+			h.Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", rate.Burst,
+				int(math.Ceil(float64(rate.Burst)*60/rate.PerMinute))))
+			if !allowed {
+				rateLimited.With(class).Inc()
+				h.Set("Retry-After", strconv.Itoa(reset))
+				http.Error(w, "rate limit exceeded", http.StatusTooManyRequests)
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// take removes a token from the bucket under key.  It returns whether one
+// was available, how many remain, and the seconds until the next one.
+func (l *limiter) take(key string, rate config.Rate) (bool, int, int) {
+	now := time.Now()
+	perSecond := rate.PerMinute / 60
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.sweep(now)
+
+	b, ok := l.buckets[key]
+	if !ok {
+		b = &bucket{tokens: float64(rate.Burst), last: now}
+		l.buckets[key] = b
+	}
+	b.tokens = math.Min(float64(rate.Burst), b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+
+	allowed := b.tokens >= 1
+	if allowed {
+		b.tokens--
+	}
+	b.full = now.Add(time.Duration((float64(rate.Burst) - b.tokens) / perSecond * float64(time.Second)))
+	reset := 0
+	if b.tokens < 1 {
+		reset = int(math.Ceil((1 - b.tokens) / perSecond))
+	}
+	return allowed, int(b.tokens), reset
+}
+
+// sweep drops buckets that have been idle long enough to have refilled.
+func (l *limiter) sweep(now time.Time) {
+	if now.Sub(l.swept) < sweepInterval {
+		return
+	}
+	l.swept = now
+	for key, b := range l.buckets {
+		if !now.Before(b.full) {
+			delete(l.buckets, key)
+		}
+	}
+}
@@ -0,0 +1,185 @@
+// Package mrvaclient submits variant analyses to a server and waits for
+// them, for automation such as CI workflows: a query pack built by the
+// pipeline, run on a repository list kept in a file.  `mrvaserver
+// actions` wraps it for GitHub Actions:
+//
+//	steps:
+//	- run: codeql pack create queries --output=pack && tar -C pack -czf pack.tgz .
+//	- run: >
+//	    mrvaserver actions --url=$MRVA_URL --language=cpp
+//	    --query-pack=pack.tgz --repos-file=.github/mrva-repos.txt --wait
+//	  env:
+//	    MRVA_TOKEN: ${{ secrets.MRVA_TOKEN }}
+//
+// It talks to the same API as the VS Code extension, so it works with any
+// server; workflows with nothing but curl can use the form endpoint of
+// package actions instead.
+package mrvaclient
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"mrvaserver/pkg/api"
+)
+
+// Client submits to one server.  Token, if set, is sent as a bearer token.
+type Client struct {
+	HTTP    *http.Client
+	BaseURL string
+	Token   string
+}
+
+func New(baseURL, token string) *Client {
+	return &Client{
+		HTTP:    &http.Client{Timeout: 5 * time.Minute},
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Token:   token,
+	}
+}
+
+// Submission is a variant analysis to submit.  Options are further fields
+// of the submission body, such as "tags" or "sample".
+type Submission struct {
+	Language     string
+	Repositories []string
+	// QueryPack is a gzipped tar of the query pack.
+	QueryPack []byte
+	Options   map[string]any
+}
+
+func (c *Client) sessionsURL() string {
+	return c.BaseURL + "/repositories/0/code-scanning/codeql/variant-analyses"
+}
+
+// StatusURL is where session id's status is read.
+func (c *Client) StatusURL(id int) string {
+	return fmt.Sprintf("%s/%d", c.sessionsURL(), id)
+}
+
+// Submit submits s and returns the new session.
+func (c *Client) Submit(ctx context.Context, s Submission) (api.VariantAnalysis, error) {
+	sub := map[string]any{}
+	for k, v := range s.Options {
+		sub[k] = v
+	}
+	sub["action_repo_ref"] = "main"
+	sub["language"] = s.Language
+	sub["query_pack"] = base64.StdEncoding.EncodeToString(s.QueryPack)
+	sub["repositories"] = s.Repositories
+	body, err := json.Marshal(sub)
+	if err != nil {
+		return api.VariantAnalysis{}, err
+	}
+	var va api.VariantAnalysis
+	if err := c.do(ctx, http.MethodPost, c.sessionsURL(), body, &va); err != nil {
+		return va, err
+	}
+	if va.ID == 0 {
+		return va, fmt.Errorf("POST %s: no session ID in response", c.sessionsURL())
+	}
+	return va, nil
+}
+
+// Status reads session id's status.
+func (c *Client) Status(ctx context.Context, id int) (api.VariantAnalysis, error) {
+	var va api.VariantAnalysis
+	return va, c.do(ctx, http.MethodGet, c.StatusURL(id), nil, &va)
+}
+
+// Wait polls session id every poll until it is no longer in progress, or
+// ctx ends.  progress, if not nil, is called with each status read.
+// Failed reads are retried until ctx ends.
+func (c *Client) Wait(ctx context.Context, id int, poll time.Duration, progress func(api.VariantAnalysis)) (api.VariantAnalysis, error) {
+	t := time.NewTicker(poll)
+	defer t.Stop()
+	var lastErr error
+	for {
+		va, err := c.Status(ctx, id)
+		if err == nil {
+			if progress != nil {
+				progress(va)
+			}
+			if va.Status != api.StatusInProgress {
+				return va, nil
+			}
+		}
+		lastErr = err
+		select {
+		case <-ctx.Done():
+			if lastErr != nil {
+				return va, fmt.Errorf("%w; last error: %v", ctx.Err(), lastErr)
+			}
+			return va, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+func (c *Client) do(ctx context.Context, method, url string, body []byte, v any) error {
+	var r io.Reader
+	if body != nil {
+		r = bytes.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, method, url, r)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if c.Token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.Token)
+	}
+	resp, err := c.HTTP.Do(req)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, url, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return fmt.Errorf("%s %s: %w", method, url, err)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%s %s: status %d: %s", method, url, resp.StatusCode, errorMessage(data))
+	}
+	if err := json.Unmarshal(data, v); err != nil {
+		return fmt.Errorf("%s %s: %w", method, url, err)
+	}
+	return nil
+}
+
+// errorMessage is the message of an error response.
+func errorMessage(body []byte) string {
+	var b struct {
+		Message string `json:"message"`
+	}
+	if json.Unmarshal(body, &b) == nil && b.Message != "" {
+		return b.Message
+	}
+	return string(bytes.TrimSpace(body))
+}
+
+// ParseRepoList reads a repository list: owner/repo names separated by
+// newlines or commas, with # starting a comment.
+func ParseRepoList(data []byte) []string {
+	var repos []string
+	sc := bufio.NewScanner(bytes.NewReader(data))
+	for sc.Scan() {
+		line, _, _ := strings.Cut(sc.Text(), "#")
+		for _, f := range strings.Split(line, ",") {
+			if f = strings.TrimSpace(f); f != "" {
+				repos = append(repos, f)
+			}
+		}
+	}
+	return repos
+}
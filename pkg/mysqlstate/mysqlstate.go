@@ -0,0 +1,366 @@
+// Package mysqlstate implements the commander's state.ServerState over
+// MySQL 8 or MariaDB 10.5+, for deployments whose only managed database is
+// MySQL.  It keeps the same tables as pgstate and gives the same
+// guarantees: job indexes are assigned under a per-session row lock, every
+// write to a session's jobs bumps its version in the same transaction, and
+// ApplyResults stores a batch of results atomically.
+package mysqlstate
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+)
+
+// migrations are applied in order, each once; the schema version is the
+// number applied.  MySQL commits DDL implicitly, so each is one statement.
+var migrations = []string{
+	`CREATE TABLE IF NOT EXISTS mrvaserver_sessions (
+		id         int          NOT NULL AUTO_INCREMENT PRIMARY KEY,
+		created_at timestamp(6) NOT NULL DEFAULT CURRENT_TIMESTAMP(6)
+	)`,
+	`CREATE TABLE IF NOT EXISTS mrvaserver_jobs (
+		session_id int          NOT NULL,
+		owner      varchar(255) NOT NULL,
+		repo       varchar(255) NOT NULL,
+		repo_index int,
+		job        json,
+		info       json,
+		status     int,
+		result     json,
+		PRIMARY KEY (session_id, owner, repo),
+		UNIQUE KEY (session_id, repo_index)
+	)`,
+	`ALTER TABLE mrvaserver_sessions ADD COLUMN version bigint NOT NULL DEFAULT 0`,
+}
+
+const schemaLock = "mrvaserver_state_schema"
+
+type MySQLState struct {
+	db *sql.DB
+}
+
+// New connects using dsn, in the driver's user:password@tcp(host)/db form,
+// and brings the schema up to date.
+func New(ctx context.Context, dsn string) (*MySQLState, error) {
+	if dsn == "" {
+		return nil, fmt.Errorf("a MySQL DSN is required")
+	}
+	if _, err := mysql.ParseDSN(dsn); err != nil {
+		return nil, fmt.Errorf("invalid MySQL DSN: %w", err)
+	}
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to mysql: %w", err)
+	}
+	if err := migrate(ctx, db); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate state schema: %w", err)
+	}
+	return &MySQLState{db: db}, nil
+}
+
+// migrate applies the pending migrations, holding a named lock so that
+// replicas starting together do not race.
+func migrate(ctx context.Context, db *sql.DB) error {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	var got sql.NullInt64
+	if err := conn.QueryRowContext(ctx, `SELECT GET_LOCK(?, 60)`, schemaLock).Scan(&got); err != nil {
+		return err
+	}
+	if got.Int64 != 1 {
+		return fmt.Errorf("timed out waiting for the schema lock")
+	}
+	defer conn.ExecContext(context.Background(), `SELECT RELEASE_LOCK(?)`, schemaLock)
+
+	if _, err := conn.ExecContext(ctx,
+		`CREATE TABLE IF NOT EXISTS mrvaserver_state_schema (version int NOT NULL)`); err != nil {
+		return err
+	}
+	var version int
+	err = conn.QueryRowContext(ctx, `SELECT version FROM mrvaserver_state_schema`).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		_, err = conn.ExecContext(ctx, `INSERT INTO mrvaserver_state_schema (version) VALUES (0)`)
+	}
+	if err != nil {
+		return err
+	}
+	for ; version < len(migrations); version++ {
+		if _, err := conn.ExecContext(ctx, migrations[version]); err != nil {
+			return fmt.Errorf("migration %d: %w", version+1, err)
+		}
+		if _, err := conn.ExecContext(ctx, `UPDATE mrvaserver_state_schema SET version = ?`, version+1); err != nil {
+			return err
+		}
+		slog.Info("Applied state schema migration", "version", version+1)
+	}
+	return nil
+}
+
+func (s *MySQLState) Close() {
+	s.db.Close()
+}
+
+func (s *MySQLState) NextID() int {
+	res, err := s.db.Exec(`INSERT INTO mrvaserver_sessions () VALUES ()`)
+	var id int64
+	if err == nil {
+		id, err = res.LastInsertId()
+	}
+	if err != nil {
+		// The interface has no error return; a zero ID cannot collide with
+		// a real session.
+		slog.Error("Failed to allocate session ID", "error", err)
+	}
+	return int(id)
+}
+
+func (s *MySQLState) GetResult(js common.JobSpec) (queue.AnalyzeResult, error) {
+	var r queue.AnalyzeResult
+	err := s.getColumn(js, "result", &r)
+	return r, err
+}
+
+func (s *MySQLState) GetJobSpecByRepoId(sessionId int, jobRepoId int) (common.JobSpec, error) {
+	js := common.JobSpec{SessionID: sessionId}
+	err := s.db.QueryRow(`
+		SELECT owner, repo FROM mrvaserver_jobs WHERE session_id = ? AND repo_index = ?`,
+		sessionId, jobRepoId).Scan(&js.Owner, &js.Repo)
+	if errors.Is(err, sql.ErrNoRows) {
+		return common.JobSpec{}, fmt.Errorf("job spec not found for job repo id %v", jobRepoId)
+	}
+	return js, err
+}
+
+func (s *MySQLState) SetResult(js common.JobSpec, ar queue.AnalyzeResult) {
+	s.setColumn(js, "result", ar)
+}
+
+func (s *MySQLState) GetJobList(sessionId int) ([]queue.AnalyzeJob, error) {
+	var exists bool
+	err := s.db.QueryRow(
+		`SELECT EXISTS (SELECT 1 FROM mrvaserver_sessions WHERE id = ?)`, sessionId).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("job list not found for session %v", sessionId)
+	}
+
+	rows, err := s.db.Query(`
+		SELECT job FROM mrvaserver_jobs
+		WHERE session_id = ? AND repo_index IS NOT NULL
+		ORDER BY repo_index`, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []queue.AnalyzeJob{}
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var job queue.AnalyzeJob
+		if err := json.Unmarshal(data, &job); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func (s *MySQLState) GetJobInfo(js common.JobSpec) (common.JobInfo, error) {
+	var ji common.JobInfo
+	err := s.getColumn(js, "info", &ji)
+	return ji, err
+}
+
+func (s *MySQLState) SetJobInfo(js common.JobSpec, ji common.JobInfo) {
+	s.setColumn(js, "info", ji)
+}
+
+func (s *MySQLState) GetStatus(js common.JobSpec) (common.Status, error) {
+	var status sql.NullInt64
+	err := s.db.QueryRow(`
+		SELECT status FROM mrvaserver_jobs WHERE session_id = ? AND owner = ? AND repo = ?`,
+		js.SessionID, js.Owner, js.Repo).Scan(&status)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !status.Valid) {
+		return common.StatusError, fmt.Errorf("status not found for job spec %v", js)
+	}
+	if err != nil {
+		return common.StatusError, err
+	}
+	return common.Status(status.Int64), nil
+}
+
+func (s *MySQLState) SetStatus(js common.JobSpec, status common.Status) {
+	err := s.inTx(func(tx *sql.Tx) error {
+		return upsert(tx, js, "status", int(status))
+	})
+	if err != nil {
+		slog.Error("Failed to set status", "job", js, "error", err)
+	}
+}
+
+// AddJob appends job to its session's list.  The commander may set a job's
+// status before adding it, so the row may already exist.
+func (s *MySQLState) AddJob(job queue.AnalyzeJob) {
+	data, err := json.Marshal(job)
+	if err != nil {
+		slog.Error("Failed to encode job", "job", job.Spec, "error", err)
+		return
+	}
+	js := job.Spec
+	err = s.inTx(func(tx *sql.Tx) error {
+		// Serialize index assignment per session.
+		var locked int
+		err := tx.QueryRow(`SELECT id FROM mrvaserver_sessions WHERE id = ? FOR UPDATE`, js.SessionID).Scan(&locked)
+		if err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		// MySQL cannot read the table an INSERT writes in a subquery, so
+		// the next index is read first, under the session lock.
+		var next int
+		if err := tx.QueryRow(`
+			SELECT COALESCE(MAX(repo_index) + 1, 0) FROM mrvaserver_jobs WHERE session_id = ?`,
+			js.SessionID).Scan(&next); err != nil {
+			return err
+		}
+		if err := bumpVersion(tx, js.SessionID); err != nil {
+			return err
+		}
+		_, err = tx.Exec(`
+			INSERT INTO mrvaserver_jobs (session_id, owner, repo, job, repo_index) VALUES (?, ?, ?, ?, ?)
+			ON DUPLICATE KEY UPDATE
+				job = VALUES(job),
+				repo_index = COALESCE(repo_index, VALUES(repo_index))`,
+			js.SessionID, js.Owner, js.Repo, string(data), next)
+		return err
+	})
+	if err != nil {
+		slog.Error("Failed to add job", "job", js, "error", err)
+	}
+}
+
+// ApplyResults stores the results and their statuses in one transaction.
+func (s *MySQLState) ApplyResults(results []queue.AnalyzeResult) error {
+	return s.inTx(func(tx *sql.Tx) error {
+		for _, r := range results {
+			data, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			if err := upsert(tx, r.Spec, "result", string(data)); err != nil {
+				return err
+			}
+			if err := upsert(tx, r.Spec, "status", int(r.Status)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// SessionVersion returns a counter that changes with every write to the
+// session's jobs.
+func (s *MySQLState) SessionVersion(sessionID int) (int64, error) {
+	var version int64
+	err := s.db.QueryRow(
+		`SELECT version FROM mrvaserver_sessions WHERE id = ?`, sessionID).Scan(&version)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, fmt.Errorf("session %d not found", sessionID)
+	}
+	return version, err
+}
+
+// SessionIDs returns the IDs of all sessions, in order.
+func (s *MySQLState) SessionIDs() ([]int, error) {
+	rows, err := s.db.Query(`SELECT id FROM mrvaserver_sessions ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var ids []int
+	for rows.Next() {
+		var id int
+		if err := rows.Scan(&id); err != nil {
+			return nil, err
+		}
+		ids = append(ids, id)
+	}
+	return ids, rows.Err()
+}
+
+func (s *MySQLState) inTx(fn func(tx *sql.Tx) error) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if err := fn(tx); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+// bumpVersion changes the session's version as part of a write to its
+// jobs.
+func bumpVersion(tx *sql.Tx, sessionID int) error {
+	_, err := tx.Exec(`UPDATE mrvaserver_sessions SET version = version + 1 WHERE id = ?`, sessionID)
+	return err
+}
+
+// upsert sets one column of js's row, creating the row if needed.
+func upsert(tx *sql.Tx, js common.JobSpec, column string, value any) error {
+	if err := bumpVersion(tx, js.SessionID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(fmt.Sprintf(`
+		INSERT INTO mrvaserver_jobs (session_id, owner, repo, %[1]s) VALUES (?, ?, ?, ?)
+		ON DUPLICATE KEY UPDATE %[1]s = VALUES(%[1]s)`, column),
+		js.SessionID, js.Owner, js.Repo, value)
+	return err
+}
+
+// getColumn decodes the JSON column of js into v.
+func (s *MySQLState) getColumn(js common.JobSpec, column string, v any) error {
+	var data []byte
+	err := s.db.QueryRow(
+		fmt.Sprintf(`SELECT %s FROM mrvaserver_jobs WHERE session_id = ? AND owner = ? AND repo = ?`, column),
+		js.SessionID, js.Owner, js.Repo).Scan(&data)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && data == nil) {
+		return fmt.Errorf("%s not found for job spec %v", column, js)
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *MySQLState) setColumn(js common.JobSpec, column string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("Failed to encode state", "column", column, "job", js, "error", err)
+		return
+	}
+	err = s.inTx(func(tx *sql.Tx) error {
+		return upsert(tx, js, column, string(data))
+	})
+	if err != nil {
+		slog.Error("Failed to store state", "column", column, "job", js, "error", err)
+	}
+}
@@ -0,0 +1,50 @@
+// Package netaddr handles the backing services' addresses given in the
+// environment, so that IPv6 literals work wherever host names do, for
+// IPv6-only clusters.  Host names resolving to AAAA records need nothing:
+// Go's dialer tries every address a name has.
+package netaddr
+
+import (
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+)
+
+// EndpointVars are the environment variables holding host[:port]
+// endpoints, read by the commander's deploy.Init* as well as the server.
+var EndpointVars = []string{"ARTIFACT_MINIO_ENDPOINT", "QLDB_MINIO_ENDPOINT", "DR_MINIO_ENDPOINT"}
+
+// Host strips the brackets from an IPv6 literal.
+func Host(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+// JoinHostPort is net.JoinHostPort for a host that may be bracketed
+// already.
+func JoinHostPort(host, port string) string {
+	return net.JoinHostPort(Host(host), port)
+}
+
+// Endpoint brackets a bare IPv6 literal, which is otherwise taken for a
+// host and port: "fd00::1" becomes "[fd00::1]".  Other endpoints are
+// returned as they are.
+func Endpoint(s string) string {
+	if ip, err := netip.ParseAddr(s); err == nil && ip.Is6() {
+		return "[" + s + "]"
+	}
+	return s
+}
+
+// NormalizeEnv rewrites EndpointVars with Endpoint.  It must be called
+// before the clients reading them are created.
+func NormalizeEnv() {
+	for _, key := range EndpointVars {
+		if v, ok := os.LookupEnv(key); ok {
+			os.Setenv(key, Endpoint(strings.TrimSpace(v)))
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package netaddr
+
+import (
+	"os"
+	"testing"
+)
+
+func TestHost(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"minio", "minio"},
+		{"10.0.0.1", "10.0.0.1"},
+		{"::1", "::1"},
+		{"[::1]", "::1"},
+		{"[fd00::1]", "fd00::1"},
+		{"[fe80::1%eth0]", "fe80::1%eth0"},
+		{"fe80::1%eth0", "fe80::1%eth0"},
+		{"[::1", "[::1"},
+		{"", ""},
+	} {
+		if got := Host(tc.in); got != tc.want {
+			t.Errorf("Host(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestJoinHostPort(t *testing.T) {
+	for _, tc := range []struct{ host, port, want string }{
+		{"rabbitmq", "5672", "rabbitmq:5672"},
+		{"10.0.0.1", "5672", "10.0.0.1:5672"},
+		{"::1", "5672", "[::1]:5672"},
+		{"[::1]", "5672", "[::1]:5672"},
+		{"fd00::1", "15672", "[fd00::1]:15672"},
+		{"[fd00::1]", "15672", "[fd00::1]:15672"},
+		{"fe80::1%eth0", "5672", "[fe80::1%eth0]:5672"},
+		{"[fe80::1%eth0]", "5672", "[fe80::1%eth0]:5672"},
+	} {
+		if got := JoinHostPort(tc.host, tc.port); got != tc.want {
+			t.Errorf("JoinHostPort(%q, %q) = %q, want %q", tc.host, tc.port, got, tc.want)
+		}
+	}
+}
+
+func TestEndpoint(t *testing.T) {
+	for _, tc := range []struct{ in, want string }{
+		{"minio:9000", "minio:9000"},
+		{"minio", "minio"},
+		{"10.0.0.1:9000", "10.0.0.1:9000"},
+		{"10.0.0.1", "10.0.0.1"},
+		{"fd00::1", "[fd00::1]"},
+		{"::1", "[::1]"},
+		{"fe80::1%eth0", "[fe80::1%eth0]"},
+		// An IPv4-mapped address is still written as IPv6.
+		{"::ffff:10.0.0.1", "[::ffff:10.0.0.1]"},
+		{"[fd00::1]", "[fd00::1]"},
+		{"[fd00::1]:9000", "[fd00::1]:9000"},
+		{"[fe80::1%eth0]:9000", "[fe80::1%eth0]:9000"},
+		{"", ""},
+	} {
+		if got := Endpoint(tc.in); got != tc.want {
+			t.Errorf("Endpoint(%q) = %q, want %q", tc.in, got, tc.want)
+		}
+	}
+}
+
+func TestNormalizeEnv(t *testing.T) {
+	t.Setenv("ARTIFACT_MINIO_ENDPOINT", " fd00::1 ")
+	t.Setenv("QLDB_MINIO_ENDPOINT", "minio:9000")
+	t.Setenv("DR_MINIO_ENDPOINT", "[fd00::2]:9000")
+	NormalizeEnv()
+	for key, want := range map[string]string{
+		"ARTIFACT_MINIO_ENDPOINT": "[fd00::1]",
+		"QLDB_MINIO_ENDPOINT":     "minio:9000",
+		"DR_MINIO_ENDPOINT":       "[fd00::2]:9000",
+	} {
+		if got := os.Getenv(key); got != want {
+			t.Errorf("%s = %q, want %q", key, got, want)
+		}
+	}
+}
+
+func TestNormalizeEnvLeavesUnsetVariables(t *testing.T) {
+	for _, key := range EndpointVars {
+		t.Setenv(key, "")
+		os.Unsetenv(key)
+	}
+	NormalizeEnv()
+	for _, key := range EndpointVars {
+		if _, ok := os.LookupEnv(key); ok {
+			t.Errorf("%s was set", key)
+		}
+	}
+}
@@ -0,0 +1,283 @@
+// Package notify reports sessions to their tenants as they complete, by
+// POSTing an event to a webhook.  Which webhook, and which sessions are
+// reported -- all, only those with a failed repository, or none -- is the
+// notifications section of the configuration, overridden per tenant by
+// tenant settings (see package tenant).  A sharded session is reported
+// once, when its last shard completes.
+//
+// Sessions are recorded as they are submitted, if their tenant is notified
+// at all, and checked at an interval.  An event the webhook does not
+// accept is sent again at the next check, up to maxAttempts times.  With a
+// secret configured, events carry the HMAC-SHA256 of their body in
+// X-MRVA-Signature, as "sha256=<hex>".
+package notify
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/state"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const nsPending = "pending-notifications" // session -> pending
+
+// Interval is how often Run checks the sessions it waits on.
+const Interval = 30 * time.Second
+
+const (
+	// emptyWait is how long a session without jobs is given for the
+	// commander to add them before it counts as complete.
+	emptyWait = 2 * time.Minute
+
+	// maxAge is how long a session is waited on before it is given up,
+	// such as one deleted before it completed.
+	maxAge = 30 * 24 * time.Hour
+
+	maxAttempts    = 5
+	requestTimeout = 30 * time.Second
+)
+
+// SignatureHeader carries an event's signature.
+const SignatureHeader = "X-MRVA-Signature"
+
+// Which sessions a tenant is notified of.
+const (
+	All      = "all"
+	Failures = "failures"
+	None     = "none"
+)
+
+var notificationsTotal = metrics.NewCounterVec("mrvaserver_notifications_total",
+	"Session notifications, by result: sent, skipped or failed.", "result")
+
+// Target is where a tenant's sessions are reported, and which of them.
+type Target struct {
+	Webhook string
+	Notify  string
+}
+
+func (t Target) wants(ev Event) bool {
+	switch {
+	case t.Webhook == "" || t.Notify == None:
+		return false
+	case t.Notify == Failures:
+		return ev.Failed > 0
+	}
+	return true
+}
+
+// Event is what a webhook is sent as a session completes.
+type Event struct {
+	Event        string    `json:"event"`
+	Session      string    `json:"session"`
+	Tenant       string    `json:"tenant,omitempty"`
+	Repositories int       `json:"repositories"`
+	Succeeded    int       `json:"succeeded"`
+	Failed       int       `json:"failed"`
+	CompletedAt  time.Time `json:"completed_at"`
+}
+
+// pending is a session waited on, with its shards, parent first, or
+// itself in Sessions.
+type pending struct {
+	Session   int       `json:"session"`
+	Sessions  []int     `json:"sessions"`
+	Tenant    string    `json:"tenant"`
+	Submitted time.Time `json:"submitted"`
+	Attempts  int       `json:"attempts,omitempty"`
+}
+
+type Notifier struct {
+	cfg     config.Notifications
+	secret  []byte
+	st      state.ServerState
+	store   store.Store
+	http    *http.Client
+	targets func(ctx context.Context, tenant string) (Target, error)
+	names   web.SessionNames
+}
+
+// New returns a notifier of the sessions of st, waiting on them in s.
+func New(cfg config.Notifications, st state.ServerState, s store.Store) (*Notifier, error) {
+	n := &Notifier{cfg: cfg, st: st, store: s, http: &http.Client{Timeout: requestTimeout}}
+	if cfg.SecretFile != "" {
+		secret, err := os.ReadFile(cfg.SecretFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read notification secret: %w", err)
+		}
+		n.secret = bytes.TrimSpace(secret)
+	}
+	return n, nil
+}
+
+// SetTargets sets how a tenant's target is found.  Without it every tenant
+// has the configured one.
+func (n *Notifier) SetTargets(f func(ctx context.Context, tenant string) (Target, error)) {
+	n.targets = f
+}
+
+// SetNames names sessions in events as sn does; without it they are
+// named by their numeric IDs.
+func (n *Notifier) SetNames(sn web.SessionNames) {
+	n.names = sn
+}
+
+func (n *Notifier) target(ctx context.Context, tenant string) (Target, error) {
+	if n.targets == nil {
+		return Target{Webhook: n.cfg.Webhook, Notify: n.cfg.Notify}, nil
+	}
+	return n.targets(ctx, tenant)
+}
+
+// SubmitHook waits on the sessions of submissions whose tenant is
+// notified.
+func (n *Notifier) SubmitHook(r *http.Request, sub *gateway.Submission) error {
+	tenant := web.Identity(r)
+	t, err := n.target(r.Context(), tenant)
+	if err != nil {
+		slog.Warn("Failed to read notification settings", "tenant", tenant, "error", err)
+	}
+	if t.Webhook == "" || t.Notify == None {
+		return nil
+	}
+	sub.After(func() {
+		sessions := sub.Sessions()
+		if len(sessions) == 0 {
+			return
+		}
+		p := pending{Session: sessions[0], Sessions: sessions, Tenant: tenant, Submitted: time.Now().UTC()}
+		if err := store.PutJSON(context.Background(), n.store, nsPending, strconv.Itoa(p.Session), p); err != nil {
+			slog.Warn("Failed to record session for notification", "session", p.Session, "error", err)
+		}
+	})
+	return nil
+}
+
+// Run reports the sessions waited on that have completed.  It is a
+// background task.
+func (n *Notifier) Run(ctx context.Context) error {
+	list, err := store.ListJSON[pending](ctx, n.store, nsPending, "")
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for _, p := range list {
+		ev, done := n.check(p, now)
+		if !done {
+			if now.Sub(p.Submitted) > maxAge {
+				slog.Warn("Giving up on session notification", "session", p.Session, "submitted", p.Submitted)
+				n.store.Delete(ctx, nsPending, strconv.Itoa(p.Session))
+			}
+			continue
+		}
+		result, err := n.send(ctx, p, ev)
+		if err != nil {
+			p.Attempts++
+			if p.Attempts < maxAttempts {
+				slog.Warn("Failed to send session notification", "session", p.Session, "attempt", p.Attempts, "error", err)
+				if err := store.PutJSON(ctx, n.store, nsPending, strconv.Itoa(p.Session), p); err != nil {
+					return err
+				}
+				continue
+			}
+			slog.Error("Giving up on session notification", "session", p.Session, "attempts", p.Attempts, "error", err)
+		}
+		notificationsTotal.With(result).Inc()
+		if err := n.store.Delete(ctx, nsPending, strconv.Itoa(p.Session)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// check returns the event of a session, if it has completed: if every job
+// of its shards has a final status.
+func (n *Notifier) check(p pending, now time.Time) (Event, bool) {
+	ev := Event{Event: "session.completed", Tenant: p.Tenant, CompletedAt: now}
+	for _, id := range p.Sessions {
+		jobs, err := n.st.GetJobList(id)
+		if err != nil {
+			return ev, false
+		}
+		for _, job := range jobs {
+			status, err := n.st.GetStatus(job.Spec)
+			if err != nil {
+				return ev, false
+			}
+			switch status {
+			case common.StatusSuccess:
+				ev.Succeeded++
+			case common.StatusFailed, common.StatusError:
+				ev.Failed++
+			default:
+				return ev, false
+			}
+			ev.Repositories++
+		}
+	}
+	if ev.Repositories == 0 && now.Sub(p.Submitted) < emptyWait {
+		return ev, false
+	}
+	return ev, true
+}
+
+// send reports ev to the target of the session's tenant, unless it is not
+// to be, returning "sent", "skipped" or, with the error, "failed".
+func (n *Notifier) send(ctx context.Context, p pending, ev Event) (string, error) {
+	t, err := n.target(ctx, p.Tenant)
+	if err != nil {
+		return "failed", err
+	}
+	if !t.wants(ev) {
+		return "skipped", nil
+	}
+	ev.Session = strconv.Itoa(p.Session)
+	if n.names != nil {
+		if ev.Session, err = n.names.Name(ctx, p.Session); err != nil {
+			return "failed", err
+		}
+	}
+	body, err := json.Marshal(ev)
+	if err != nil {
+		return "failed", err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, t.Webhook, bytes.NewReader(body))
+	if err != nil {
+		return "failed", err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if n.secret != nil {
+		mac := hmac.New(sha256.New, n.secret)
+		mac.Write(body)
+		req.Header.Set(SignatureHeader, "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+	resp, err := n.http.Do(req)
+	if err != nil {
+		return "failed", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return "failed", fmt.Errorf("webhook answered %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	slog.Info("Sent session notification", "session", p.Session, "tenant", p.Tenant, "failed", ev.Failed)
+	return "sent", nil
+}
@@ -0,0 +1,194 @@
+// Package packscan inspects submitted query packs before the commander
+// stores them and the agents run them, rejecting packs that untrusted
+// submitters should not push onto shared agents: QL sources matching a
+// deny rule (by default, external predicates, which reach outside the
+// database), resource hints above their limits, oversized compiled
+// queries, and archives that are too large or try to write outside the
+// pack directory.
+package packscan
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/web"
+)
+
+var rejected = metrics.NewCounterVec("mrvaserver_pack_scan_rejected_total",
+	"Query packs rejected by the pack scan, by rule.", "rule")
+
+// hintLine matches a numeric setting in a pack's YAML files, such as
+// "ram: 128000".
+var hintLine = regexp.MustCompile(`^\s*([A-Za-z_-]+)\s*:\s*"?(\d+)"?\s*(#.*)?$`)
+
+// Violation is the reason a pack was rejected.
+type Violation struct {
+	Rule string
+	File string
+	Msg  string
+}
+
+func (v *Violation) Error() string {
+	if v.File == "" {
+		return fmt.Sprintf("query pack rejected (%s): %s", v.Rule, v.Msg)
+	}
+	return fmt.Sprintf("query pack rejected (%s): %s: %s", v.Rule, v.File, v.Msg)
+}
+
+type rule struct {
+	name string
+	re   *regexp.Regexp
+}
+
+type Scanner struct {
+	cfg  config.PackScan
+	deny []rule
+}
+
+// New compiles the deny rules.
+func New(cfg config.PackScan) (*Scanner, error) {
+	s := &Scanner{cfg: cfg}
+	for _, r := range cfg.Deny {
+		re, err := regexp.Compile(r.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("failed to compile pack scan rule %s: %w", r.Name, err)
+		}
+		s.deny = append(s.deny, rule{r.Name, re})
+	}
+	return s, nil
+}
+
+// Scan inspects a query pack, a gzipped tar.  It returns a *Violation for
+// a pack it rejects.
+func (s *Scanner) Scan(tgz []byte) error {
+	zr, err := gzip.NewReader(bytes.NewReader(tgz))
+	if err != nil {
+		return &Violation{Rule: "archive", Msg: "not a gzipped tar: " + err.Error()}
+	}
+	tr := tar.NewReader(zr)
+	var files int
+	var total int64
+	for {
+		hdr, err := tr.Next()
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return &Violation{Rule: "archive", Msg: err.Error()}
+		}
+		name := hdr.Name
+		clean := path.Clean(name)
+		if path.IsAbs(name) || clean == ".." || strings.HasPrefix(clean, "../") {
+			return &Violation{Rule: "archive", File: name, Msg: "path leaves the pack directory"}
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			continue
+		case tar.TypeReg:
+		default:
+			return &Violation{Rule: "archive", File: name, Msg: "only regular files and directories are allowed"}
+		}
+
+		files++
+		total += hdr.Size
+		if s.cfg.MaxFiles > 0 && files > s.cfg.MaxFiles {
+			return &Violation{Rule: "size", Msg: fmt.Sprintf("more than %d files", s.cfg.MaxFiles)}
+		}
+		if s.cfg.MaxTotalBytes > 0 && total > s.cfg.MaxTotalBytes {
+			return &Violation{Rule: "size", Msg: fmt.Sprintf("unpacks to more than %d bytes", s.cfg.MaxTotalBytes)}
+		}
+		if strings.HasSuffix(name, ".qlx") {
+			if s.cfg.MaxCompiledBytes > 0 && hdr.Size > s.cfg.MaxCompiledBytes {
+				return &Violation{Rule: "compiled-size", File: name,
+					Msg: fmt.Sprintf("%d bytes, more than %d", hdr.Size, s.cfg.MaxCompiledBytes)}
+			}
+			continue
+		}
+
+		switch path.Ext(name) {
+		case ".ql", ".qll":
+			if err := s.scanSource(name, tr); err != nil {
+				return err
+			}
+		case ".yml", ".yaml":
+			if err := s.scanHints(name, tr); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *Scanner) scanSource(name string, r io.Reader) error {
+	src, err := io.ReadAll(r)
+	if err != nil {
+		return &Violation{Rule: "archive", File: name, Msg: err.Error()}
+	}
+	for _, d := range s.deny {
+		if loc := d.re.FindIndex(src); loc != nil {
+			line := bytes.Count(src[:loc[0]], []byte("\n")) + 1
+			return &Violation{Rule: d.name, File: name, Msg: fmt.Sprintf("line %d matches a denied construct", line)}
+		}
+	}
+	return nil
+}
+
+func (s *Scanner) scanHints(name string, r io.Reader) error {
+	if len(s.cfg.MaxHints) == 0 {
+		return nil
+	}
+	sc := bufio.NewScanner(r)
+	for n := 1; sc.Scan(); n++ {
+		m := hintLine.FindStringSubmatch(sc.Text())
+		if m == nil {
+			continue
+		}
+		limit, ok := s.cfg.MaxHints[m[1]]
+		if !ok {
+			continue
+		}
+		v, err := strconv.ParseInt(m[2], 10, 64)
+		if err != nil || v > limit {
+			return &Violation{Rule: "resource-hint", File: name,
+				Msg: fmt.Sprintf("line %d: %s %s exceeds %d", n, m[1], m[2], limit)}
+		}
+	}
+	if err := sc.Err(); err != nil {
+		return &Violation{Rule: "archive", File: name, Msg: err.Error()}
+	}
+	return nil
+}
+
+// SubmitHook rejects submissions whose query pack fails the scan.  It must
+// run after hooks that supply the query pack, such as templates'.
+func (s *Scanner) SubmitHook(r *http.Request, sub *gateway.Submission) error {
+	tgz, err := base64.StdEncoding.DecodeString(sub.Msg.QueryPack)
+	if err != nil {
+		return web.Msg(http.StatusBadRequest, apierr.PackInvalid, "pack.invalid", messages.Params{"error": err})
+	}
+	if err := s.Scan(tgz); err != nil {
+		var v *Violation
+		if errors.As(err, &v) {
+			rejected.With(v.Rule).Inc()
+		}
+		slog.Warn("Query pack rejected", "client", web.Identity(r), "error", err)
+		return web.Msg(http.StatusUnprocessableEntity, apierr.PackInvalid, "pack.rejected", messages.Params{"error": err})
+	}
+	return nil
+}
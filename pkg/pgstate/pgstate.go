@@ -0,0 +1,304 @@
+// Package pgstate is mrvaserver's Postgres implementation of the commander's
+// state.ServerState.  Unlike mrvacommander's PGState it can apply many
+// results in a single transaction (ApplyResults), which the ingestion
+// batcher uses when large sessions complete.
+package pgstate
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const schema = `
+CREATE TABLE IF NOT EXISTS mrvaserver_sessions (
+	id         serial      PRIMARY KEY,
+	created_at timestamptz NOT NULL DEFAULT now()
+);
+ALTER TABLE mrvaserver_sessions ADD COLUMN IF NOT EXISTS version bigint NOT NULL DEFAULT 0;
+CREATE TABLE IF NOT EXISTS mrvaserver_jobs (
+	session_id int   NOT NULL,
+	owner      text  NOT NULL,
+	repo       text  NOT NULL,
+	repo_index int,
+	job        jsonb,
+	info       jsonb,
+	status     int,
+	result     jsonb,
+	PRIMARY KEY (session_id, owner, repo),
+	UNIQUE (session_id, repo_index)
+)`
+
+type PGState struct {
+	pool *pgxpool.Pool
+}
+
+// New connects using dsn (empty: the PG* environment variables) and creates
+// the tables if needed.
+func New(ctx context.Context, dsn string) (*PGState, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	if _, err := pool.Exec(ctx, schema); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to create state schema: %w", err)
+	}
+	return &PGState{pool: pool}, nil
+}
+
+// NewReadOnly connects using dsn, which may be a hot standby, without
+// creating the tables: each session is read-only, so that any write fails
+// rather than reaching the primary through a misconfigured DSN.
+func NewReadOnly(ctx context.Context, dsn string) (*PGState, error) {
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse postgres DSN: %w", err)
+	}
+	cfg.ConnConfig.RuntimeParams["default_transaction_read_only"] = "on"
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	return &PGState{pool: pool}, nil
+}
+
+func (s *PGState) Close() {
+	s.pool.Close()
+}
+
+// ResetConnections closes the pooled connections, so that new ones dial
+// the database again.  Those in use close when they are released.
+func (s *PGState) ResetConnections() {
+	s.pool.Reset()
+}
+
+func (s *PGState) NextID() int {
+	var id int
+	err := s.pool.QueryRow(context.Background(),
+		`INSERT INTO mrvaserver_sessions DEFAULT VALUES RETURNING id`).Scan(&id)
+	if err != nil {
+		// The interface has no error return; a zero ID cannot collide with
+		// a real session.
+		slog.Error("Failed to allocate session ID", "error", err)
+	}
+	return id
+}
+
+func (s *PGState) GetResult(js common.JobSpec) (queue.AnalyzeResult, error) {
+	var r queue.AnalyzeResult
+	err := s.getColumn(js, "result", &r)
+	return r, err
+}
+
+func (s *PGState) GetJobSpecByRepoId(sessionId int, jobRepoId int) (common.JobSpec, error) {
+	js := common.JobSpec{SessionID: sessionId}
+	err := s.pool.QueryRow(context.Background(), `
+		SELECT owner, repo FROM mrvaserver_jobs WHERE session_id = $1 AND repo_index = $2`,
+		sessionId, jobRepoId).Scan(&js.Owner, &js.Repo)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return common.JobSpec{}, fmt.Errorf("job spec not found for job repo id %v", jobRepoId)
+	}
+	return js, err
+}
+
+func (s *PGState) SetResult(js common.JobSpec, ar queue.AnalyzeResult) {
+	s.setColumn(js, "result", ar)
+}
+
+func (s *PGState) GetJobList(sessionId int) ([]queue.AnalyzeJob, error) {
+	ctx := context.Background()
+	var exists bool
+	err := s.pool.QueryRow(ctx,
+		`SELECT EXISTS (SELECT 1 FROM mrvaserver_sessions WHERE id = $1)`, sessionId).Scan(&exists)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, fmt.Errorf("job list not found for session %v", sessionId)
+	}
+
+	rows, err := s.pool.Query(ctx, `
+		SELECT job FROM mrvaserver_jobs
+		WHERE session_id = $1 AND repo_index IS NOT NULL
+		ORDER BY repo_index`, sessionId)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	jobs := []queue.AnalyzeJob{}
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var job queue.AnalyzeJob
+		if err := json.Unmarshal(data, &job); err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, rows.Err()
+}
+
+func (s *PGState) GetJobInfo(js common.JobSpec) (common.JobInfo, error) {
+	var ji common.JobInfo
+	err := s.getColumn(js, "info", &ji)
+	return ji, err
+}
+
+func (s *PGState) SetJobInfo(js common.JobSpec, ji common.JobInfo) {
+	s.setColumn(js, "info", ji)
+}
+
+func (s *PGState) GetStatus(js common.JobSpec) (common.Status, error) {
+	var status *int
+	err := s.pool.QueryRow(context.Background(), `
+		SELECT status FROM mrvaserver_jobs WHERE session_id = $1 AND owner = $2 AND repo = $3`,
+		js.SessionID, js.Owner, js.Repo).Scan(&status)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && status == nil) {
+		return common.StatusError, fmt.Errorf("status not found for job spec %v", js)
+	}
+	if err != nil {
+		return common.StatusError, err
+	}
+	return common.Status(*status), nil
+}
+
+func (s *PGState) SetStatus(js common.JobSpec, status common.Status) {
+	_, err := s.pool.Exec(context.Background(), upsertStatus, js.SessionID, js.Owner, js.Repo, int(status))
+	if err != nil {
+		slog.Error("Failed to set status", "job", js, "error", err)
+	}
+}
+
+// AddJob appends job to its session's list.  The commander may set a job's
+// status before adding it, so the row may already exist.
+func (s *PGState) AddJob(job queue.AnalyzeJob) {
+	data, err := json.Marshal(job)
+	if err != nil {
+		slog.Error("Failed to encode job", "job", job.Spec, "error", err)
+		return
+	}
+	js := job.Spec
+	err = pgx.BeginFunc(context.Background(), s.pool, func(tx pgx.Tx) error {
+		// Serialize index assignment per session.
+		if _, err := tx.Exec(context.Background(),
+			`SELECT id FROM mrvaserver_sessions WHERE id = $1 FOR UPDATE`, js.SessionID); err != nil {
+			return err
+		}
+		_, err := tx.Exec(context.Background(), bumpVersion+`
+			INSERT INTO mrvaserver_jobs (session_id, owner, repo, job, repo_index)
+			VALUES ($1, $2, $3, $4, (SELECT COALESCE(MAX(repo_index) + 1, 0) FROM mrvaserver_jobs WHERE session_id = $1))
+			ON CONFLICT (session_id, owner, repo) DO UPDATE SET
+				job = EXCLUDED.job,
+				repo_index = COALESCE(mrvaserver_jobs.repo_index, EXCLUDED.repo_index)`,
+			js.SessionID, js.Owner, js.Repo, data)
+		return err
+	})
+	if err != nil {
+		slog.Error("Failed to add job", "job", js, "error", err)
+	}
+}
+
+// bumpVersion prefixes each write to a session's jobs ($1 is the session
+// ID) so that the session's version changes in the same statement.
+const bumpVersion = `WITH bump AS (UPDATE mrvaserver_sessions SET version = version + 1 WHERE id = $1)
+	`
+
+const upsertStatus = bumpVersion + `
+	INSERT INTO mrvaserver_jobs (session_id, owner, repo, status) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (session_id, owner, repo) DO UPDATE SET status = EXCLUDED.status`
+
+const upsertResult = bumpVersion + `
+	INSERT INTO mrvaserver_jobs (session_id, owner, repo, result) VALUES ($1, $2, $3, $4)
+	ON CONFLICT (session_id, owner, repo) DO UPDATE SET result = EXCLUDED.result`
+
+// ApplyResults stores the results and their statuses in one transaction.
+func (s *PGState) ApplyResults(results []queue.AnalyzeResult) error {
+	ctx := context.Background()
+	return pgx.BeginFunc(ctx, s.pool, func(tx pgx.Tx) error {
+		batch := &pgx.Batch{}
+		for _, r := range results {
+			data, err := json.Marshal(r)
+			if err != nil {
+				return err
+			}
+			js := r.Spec
+			batch.Queue(upsertResult, js.SessionID, js.Owner, js.Repo, data)
+			batch.Queue(upsertStatus, js.SessionID, js.Owner, js.Repo, int(r.Status))
+		}
+		return tx.SendBatch(ctx, batch).Close()
+	})
+}
+
+// SessionVersion returns a counter that changes with every write to the
+// session's jobs.
+func (s *PGState) SessionVersion(sessionID int) (int64, error) {
+	var version int64
+	err := s.pool.QueryRow(context.Background(),
+		`SELECT version FROM mrvaserver_sessions WHERE id = $1`, sessionID).Scan(&version)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return 0, fmt.Errorf("session %d not found", sessionID)
+	}
+	return version, err
+}
+
+// DeleteSession deletes the session's jobs.  The session's row stays, so
+// its ID is not reused.
+func (s *PGState) DeleteSession(sessionID int) error {
+	_, err := s.pool.Exec(context.Background(), bumpVersion+`
+		DELETE FROM mrvaserver_jobs WHERE session_id = $1`, sessionID)
+	if err != nil {
+		return fmt.Errorf("failed to delete session %d: %w", sessionID, err)
+	}
+	return nil
+}
+
+// SessionIDs returns the IDs of all sessions, in order.
+func (s *PGState) SessionIDs() ([]int, error) {
+	rows, err := s.pool.Query(context.Background(), `SELECT id FROM mrvaserver_sessions ORDER BY id`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	return pgx.CollectRows(rows, pgx.RowTo[int])
+}
+
+// getColumn decodes the JSON column of js into v.
+func (s *PGState) getColumn(js common.JobSpec, column string, v any) error {
+	var data []byte
+	err := s.pool.QueryRow(context.Background(),
+		fmt.Sprintf(`SELECT %s FROM mrvaserver_jobs WHERE session_id = $1 AND owner = $2 AND repo = $3`, column),
+		js.SessionID, js.Owner, js.Repo).Scan(&data)
+	if errors.Is(err, pgx.ErrNoRows) || (err == nil && data == nil) {
+		return fmt.Errorf("%s not found for job spec %v", column, js)
+	}
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+func (s *PGState) setColumn(js common.JobSpec, column string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("Failed to encode state", "column", column, "job", js, "error", err)
+		return
+	}
+	_, err = s.pool.Exec(context.Background(), bumpVersion+fmt.Sprintf(`
+		INSERT INTO mrvaserver_jobs (session_id, owner, repo, %[1]s) VALUES ($1, $2, $3, $4)
+		ON CONFLICT (session_id, owner, repo) DO UPDATE SET %[1]s = EXCLUDED.%[1]s`, column),
+		js.SessionID, js.Owner, js.Repo, data)
+	if err != nil {
+		slog.Error("Failed to store state", "column", column, "job", js, "error", err)
+	}
+}
@@ -0,0 +1,55 @@
+package pool
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/metrics"
+)
+
+var affinityRouted = metrics.NewCounter("mrvaserver_affinity_routed_total",
+	"Jobs published to an agent that has their database cached.")
+
+// Affinity implements the rabbitmq affinity hook.  It picks a live agent of
+// pool holding the job's database, spreading jobs over the agents that
+// hold it, and returns how long the job may wait for that agent.
+func (r *Router) Affinity(job queue.AnalyzeJob, pool string) (string, time.Duration) {
+	if !r.affinity.Enabled {
+		return "", 0
+	}
+	pool = poolName(pool)
+	repo := job.Spec.Owner + "/" + job.Spec.Repo
+	agents, err := r.registry.Caching(context.Background(), repo)
+	if err != nil {
+		slog.Warn("Failed to read agent registry", "error", err)
+		return "", 0
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	best := ""
+	for _, a := range agents {
+		if a.Pool != pool {
+			continue
+		}
+		if best == "" || r.assigned[a.Name] < r.assigned[best] {
+			best = a.Name
+		}
+	}
+	if best == "" {
+		return "", 0
+	}
+	r.assigned[best]++
+	affinityRouted.Inc()
+	return best, r.affinity.Wait
+}
+
+func poolName(pool string) string {
+	if pool == "" {
+		return agentproto.DefaultPool
+	}
+	return pool
+}
@@ -0,0 +1,101 @@
+package pool
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// Labels describe an agent or pool: arch=arm64, memory=64 (GiB),
+// codeql=2.17.0, gpu=true and so on.
+type Labels map[string]string
+
+// Constraint is a requirement on one label, written key=value, key!=value,
+// key>=n, key<=n, key>n, key<n or a bare key, which requires the label to
+// be present and not "false".  Ordered comparisons are numeric.
+type Constraint struct {
+	Key   string
+	Op    string
+	Value string
+}
+
+var ops = []string{">=", "<=", "!=", "=", ">", "<"}
+
+func ParseConstraint(s string) (Constraint, error) {
+	s = strings.TrimSpace(s)
+	for _, op := range ops {
+		if i := strings.Index(s, op); i >= 0 {
+			c := Constraint{Key: strings.TrimSpace(s[:i]), Op: op, Value: strings.TrimSpace(s[i+len(op):])}
+			if c.Key == "" {
+				return c, fmt.Errorf("constraint %q has no label", s)
+			}
+			if op != "=" && op != "!=" {
+				if _, err := strconv.ParseFloat(c.Value, 64); err != nil {
+					return c, fmt.Errorf("constraint %q compares with a non-number", s)
+				}
+			}
+			return c, nil
+		}
+	}
+	if s == "" {
+		return Constraint{}, fmt.Errorf("empty constraint")
+	}
+	return Constraint{Key: s}, nil
+}
+
+func ParseConstraints(ss []string) ([]Constraint, error) {
+	cs := make([]Constraint, 0, len(ss))
+	for _, s := range ss {
+		c, err := ParseConstraint(s)
+		if err != nil {
+			return nil, err
+		}
+		cs = append(cs, c)
+	}
+	return cs, nil
+}
+
+func (c Constraint) String() string {
+	return c.Key + c.Op + c.Value
+}
+
+// Match reports whether l satisfies c.
+func (c Constraint) Match(l Labels) bool {
+	v, ok := l[c.Key]
+	switch c.Op {
+	case "":
+		return ok && v != "false"
+	case "=":
+		return ok && v == c.Value
+	case "!=":
+		return v != c.Value
+	}
+	if !ok {
+		return false
+	}
+	have, err := strconv.ParseFloat(v, 64)
+	if err != nil {
+		return false
+	}
+	want, _ := strconv.ParseFloat(c.Value, 64)
+	switch c.Op {
+	case ">=":
+		return have >= want
+	case "<=":
+		return have <= want
+	case ">":
+		return have > want
+	default:
+		return have < want
+	}
+}
+
+// MatchAll reports whether l satisfies every constraint in cs.
+func MatchAll(cs []Constraint, l Labels) bool {
+	for _, c := range cs {
+		if !c.Match(l) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+package pool
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/web"
+)
+
+type agentStatus struct {
+	Agent
+	Live bool `json:"live"`
+}
+
+type poolStatus struct {
+	Name       string `json:"name"`
+	Queue      string `json:"queue"`
+	Labels     Labels `json:"labels"`
+	LiveAgents int    `json:"live_agents"`
+
+	// Source is "config", or "resource" for a declared pool.
+	Source string `json:"source"`
+}
+
+// RegisterAdmin adds read-only endpoints listing the registered agents and the
+// pools, configured and declared.
+func (r *Router) RegisterAdmin(mr *mux.Router) {
+	mr.HandleFunc("/admin/agents", r.listAgents).Methods(http.MethodGet)
+	mr.HandleFunc("/admin/pools", r.listPools).Methods(http.MethodGet)
+}
+
+func (r *Router) listAgents(w http.ResponseWriter, req *http.Request) {
+	agents, err := r.registry.Agents(req.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out := make([]agentStatus, len(agents))
+	for i, a := range agents {
+		out[i] = agentStatus{Agent: a, Live: r.registry.Live(a)}
+	}
+	web.WriteJSON(w, http.StatusOK, out)
+}
+
+func (r *Router) listPools(w http.ResponseWriter, req *http.Request) {
+	live, err := r.registry.LiveCounts(req.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pools := r.current(req.Context())
+	out := make([]poolStatus, len(pools))
+	for i, p := range pools {
+		out[i] = poolStatus{Name: p.name, Queue: agentproto.PoolQueueName(p.name), Labels: p.labels,
+			LiveAgents: live[p.name], Source: "config"}
+		if p.declared {
+			out[i].Source = "resource"
+		}
+	}
+	web.WriteJSON(w, http.StatusOK, out)
+}
@@ -0,0 +1,116 @@
+package pool
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/store"
+)
+
+const nsAgents = "agents"
+
+// liveRefresh is how long the live agent counts used for routing are
+// reused before the registry is read again.
+const liveRefresh = 10 * time.Second
+
+type Agent struct {
+	Name            string    `json:"name"`
+	Pool            string    `json:"pool"`
+	Labels          Labels    `json:"labels"`
+	CachedDatabases []string  `json:"cached_databases,omitempty"`
+	LastSeen        time.Time `json:"last_seen"`
+}
+
+// snapshot is the live part of the fleet.
+type snapshot struct {
+	// live counts live agents by pool.
+	live map[string]int
+
+	// cached lists, by repository, the live agents holding its database.
+	cached map[string][]Agent
+}
+
+// Registry records the agents that have reported in, in the metadata
+// store, so every replica sees the whole fleet.
+type Registry struct {
+	store store.Store
+	ttl   time.Duration
+
+	mu     sync.Mutex
+	snap   *snapshot
+	loaded time.Time
+}
+
+func NewRegistry(s store.Store, ttl time.Duration) *Registry {
+	return &Registry{store: s, ttl: ttl}
+}
+
+// Record stores an agent's registration.
+func (r *Registry) Record(ctx context.Context, info agentproto.AgentInfo) error {
+	pool := info.Pool
+	if pool == "" {
+		pool = agentproto.DefaultPool
+	}
+	return store.PutJSON(ctx, r.store, nsAgents, info.Agent, Agent{
+		Name:            info.Agent,
+		Pool:            pool,
+		Labels:          info.Labels,
+		CachedDatabases: info.CachedDatabases,
+		LastSeen:        time.Now().UTC(),
+	})
+}
+
+func (r *Registry) Agents(ctx context.Context) ([]Agent, error) {
+	return store.ListJSON[Agent](ctx, r.store, nsAgents, "")
+}
+
+// Live reports whether a has reported in within the TTL.
+func (r *Registry) Live(a Agent) bool {
+	return time.Since(a.LastSeen) < r.ttl
+}
+
+// LiveCounts returns the number of live agents in each pool, as of at most
+// liveRefresh ago.
+func (r *Registry) LiveCounts(ctx context.Context) (map[string]int, error) {
+	snap, err := r.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return snap.live, nil
+}
+
+// Caching returns the live agents that have repo's database cached, as of
+// at most liveRefresh ago.
+func (r *Registry) Caching(ctx context.Context, repo string) ([]Agent, error) {
+	snap, err := r.snapshot(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return snap.cached[repo], nil
+}
+
+func (r *Registry) snapshot(ctx context.Context) (*snapshot, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.snap != nil && time.Since(r.loaded) < liveRefresh {
+		return r.snap, nil
+	}
+	agents, err := r.Agents(ctx)
+	if err != nil {
+		return nil, err
+	}
+	snap := &snapshot{live: make(map[string]int), cached: make(map[string][]Agent)}
+	for _, a := range agents {
+		if !r.Live(a) {
+			continue
+		}
+		snap.live[a.Pool]++
+		for _, repo := range a.CachedDatabases {
+			snap.cached[repo] = append(snap.cached[repo], a)
+		}
+	}
+	r.snap, r.loaded = snap, time.Now()
+	return snap, nil
+}
@@ -0,0 +1,65 @@
+package pool
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+
+	"mrvaserver/pkg/resources"
+)
+
+// PoolKind is the kind of the agent pools declared as resources, which
+// jobs are routed to as to the configured ones.  Their IDs are the pools'
+// names.
+const PoolKind = "agent-pools"
+
+// PoolSpec is a declared agent pool.
+type PoolSpec struct {
+	Labels Labels `json:"labels"`
+}
+
+// SetResources defines the agent pool kind in reg and routes jobs to the
+// pools declared there after the configured ones.
+func (r *Router) SetResources(reg *resources.Registry) {
+	reg.Define(resources.NewKind(PoolKind, "Agent pools jobs are routed to, beside the configured ones.", r.checkPool))
+	r.resources = reg
+}
+
+func (r *Router) checkPool(name string, spec *PoolSpec) error {
+	for _, p := range r.pools {
+		if p.name == name {
+			return fmt.Errorf("pool %s is configured and cannot be declared", name)
+		}
+	}
+	for k := range spec.Labels {
+		if k == "" {
+			return fmt.Errorf("labels must have keys")
+		}
+	}
+	if spec.Labels == nil {
+		spec.Labels = Labels{}
+	}
+	return nil
+}
+
+// current returns the configured pools, then the declared ones by name.
+func (r *Router) current(ctx context.Context) []pool {
+	specs, err := resources.Specs[PoolSpec](ctx, r.resources, PoolKind)
+	if err != nil {
+		slog.Warn("Failed to read declared agent pools", "error", err)
+	}
+	if len(specs) == 0 {
+		return r.pools
+	}
+	names := make([]string, 0, len(specs))
+	for name := range specs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := append([]pool(nil), r.pools...)
+	for _, name := range names {
+		out = append(out, pool{name: name, labels: specs[name].Labels, declared: true})
+	}
+	return out
+}
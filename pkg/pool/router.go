@@ -0,0 +1,255 @@
+// Package pool routes jobs to agent pools.  A heterogeneous fleet is split
+// into pools -- arm64 agents, large-memory agents, agents with a newer
+// CodeQL -- each consuming its own jobs queue.  Agents register the pool
+// they serve and the labels they offer; sessions state constraints on
+// those labels in their submission's "agent_constraints" field, and
+// configured rules add constraints by language.  Each job is published to
+// a pool whose labels satisfy all of them, preferring pools with live
+// agents, unless the submission names a pool in "agent_pool".  Jobs
+// without constraints go to the default tasks queue.  Pools
+// are configured, or declared at run time as agent-pools resources (see
+// package resources).
+//
+// Within its pool, a job is preferably published to the queue of an agent
+// that reports having the job's database cached, saving a download of
+// what may be several gigabytes.
+package pool
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/resources"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const nsSessionRouting = "session-routing" // session -> routing
+
+type pool struct {
+	name   string
+	labels Labels
+
+	// declared is set for pools declared as resources.
+	declared bool
+}
+
+// routing is how a session's jobs are routed: to the pool it names, if
+// any, else to one satisfying its constraints.
+type routing struct {
+	Pool        string   `json:"pool,omitempty"`
+	Constraints []string `json:"constraints,omitempty"`
+
+	constraints []Constraint
+}
+
+type Router struct {
+	pools    []pool
+	rules    map[string][]Constraint
+	registry *Registry
+	store    store.Store
+	affinity config.Affinity
+
+	// resources are where agent pools are declared, if anywhere.
+	resources *resources.Registry
+
+	mu       sync.Mutex
+	sessions map[int]routing
+
+	// assigned counts the jobs sent to each agent's own queue.
+	assigned map[string]int
+}
+
+func NewRouter(cfg config.Routing, s store.Store) (*Router, error) {
+	r := &Router{
+		rules:    make(map[string][]Constraint),
+		registry: NewRegistry(s, cfg.AgentTTL),
+		store:    s,
+		affinity: cfg.Affinity,
+		sessions: make(map[int]routing),
+		assigned: make(map[string]int),
+	}
+	for _, p := range cfg.Pools {
+		r.pools = append(r.pools, pool{name: p.Name, labels: p.Labels})
+	}
+	for i, rule := range cfg.Rules {
+		cs, err := ParseConstraints(rule.Constraints)
+		if err != nil {
+			return nil, fmt.Errorf("routing.rules[%d]: %w", i, err)
+		}
+		if len(match(r.pools, cs)) == 0 {
+			return nil, fmt.Errorf("routing.rules[%d]: no pool satisfies %v", i, rule.Constraints)
+		}
+		r.rules[rule.Language] = append(r.rules[rule.Language], cs...)
+	}
+	return r, nil
+}
+
+// HandleAgent records an agent's registration.
+func (r *Router) HandleAgent(info agentproto.AgentInfo) error {
+	if info.Agent == "" {
+		return fmt.Errorf("registration without agent name")
+	}
+	for _, p := range r.current(context.Background()) {
+		if p.name != info.Pool && !(info.Pool == "" && p.name == agentproto.DefaultPool) {
+			continue
+		}
+		for k, v := range p.labels {
+			if info.Labels[k] != v {
+				slog.Warn("Agent lacks a label of its pool", "agent", info.Agent, "pool", p.name,
+					"label", k, "want", v, "have", info.Labels[k])
+			}
+		}
+	}
+	return r.registry.Record(context.Background(), info)
+}
+
+// match returns the pools whose labels satisfy cs.
+func match(pools []pool, cs []Constraint) []pool {
+	var out []pool
+	for _, p := range pools {
+		if MatchAll(cs, p.labels) {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// Route implements rabbitmq.Router.  A job is routed once its session's
+// submission has been forwarded, so that how it was submitted is known.
+func (r *Router) Route(job queue.AnalyzeJob) string {
+	ctx := context.Background()
+	rt := r.sessionRouting(job.Spec.SessionID)
+	if rt.Pool != "" {
+		known := rt.Pool == agentproto.DefaultPool ||
+			slices.ContainsFunc(r.current(ctx), func(p pool) bool { return p.name == rt.Pool })
+		if !known {
+			slog.Warn("The pool the session named is gone, publishing to its queue regardless",
+				"job", job.Spec, "pool", rt.Pool)
+		}
+		return rt.Pool
+	}
+
+	cs := append([]Constraint(nil), r.rules[string(job.QueryLanguage)]...)
+	cs = append(cs, rt.constraints...)
+	if len(cs) == 0 {
+		return ""
+	}
+
+	candidates := match(r.current(ctx), cs)
+	if len(candidates) == 0 {
+		slog.Warn("No pool satisfies job constraints, using the default pool", "job", job.Spec,
+			"constraints", cs)
+		return ""
+	}
+	live, err := r.registry.LiveCounts(ctx)
+	if err != nil {
+		slog.Warn("Failed to read agent registry", "error", err)
+	}
+	for _, p := range candidates {
+		if live[p.name] > 0 {
+			return p.name
+		}
+	}
+	slog.Warn("No live agents in the pools matching job constraints", "job", job.Spec,
+		"pool", candidates[0].name)
+	return candidates[0].name
+}
+
+// sessionRouting returns how the session was submitted to be routed.
+func (r *Router) sessionRouting(id int) routing {
+	r.mu.Lock()
+	rt, ok := r.sessions[id]
+	r.mu.Unlock()
+	if ok {
+		return rt
+	}
+
+	err := store.GetJSON(context.Background(), r.store, nsSessionRouting, strconv.Itoa(id), &rt)
+	if err != nil {
+		if !errors.Is(err, store.ErrNotFound) {
+			slog.Error("Failed to read session routing", "session", id, "error", err)
+		}
+		return routing{}
+	}
+	if rt.constraints, err = ParseConstraints(rt.Constraints); err != nil {
+		slog.Error("Invalid stored session constraints", "session", id, "error", err)
+		return routing{}
+	}
+	r.mu.Lock()
+	r.sessions[id] = rt
+	r.mu.Unlock()
+	return rt
+}
+
+// SubmitHook takes the "agent_pool" field, the name of the pool to run the
+// session's jobs in, and the "agent_constraints" field, a list of
+// constraints such as "arch=arm64" or "memory>=32".  It rejects
+// submissions naming an unknown pool or that no pool can run, and records
+// the others' routing once the commander has created their sessions.
+func (r *Router) SubmitHook(req *http.Request, sub *gateway.Submission) error {
+	var rt routing
+	if _, err := sub.TakeExtra("agent_pool", &rt.Pool); err != nil {
+		return err
+	}
+	if _, err := sub.TakeExtra("agent_constraints", &rt.Constraints); err != nil {
+		return err
+	}
+	cs, err := ParseConstraints(rt.Constraints)
+	if err != nil {
+		return web.Msg(http.StatusBadRequest, "", "pool.invalid_constraints", messages.Params{"error": err})
+	}
+	rt.constraints = cs
+	pools := r.current(req.Context())
+	if rt.Pool != "" {
+		i := slices.IndexFunc(pools, func(p pool) bool { return p.name == rt.Pool })
+		switch {
+		case i >= 0:
+			pools = pools[i : i+1]
+		case rt.Pool == agentproto.DefaultPool:
+			pools = []pool{{name: agentproto.DefaultPool}}
+		default:
+			return web.Msg(http.StatusBadRequest, "", "pool.unknown", messages.Params{"pool": rt.Pool})
+		}
+	}
+	all := append(append([]Constraint(nil), r.rules[sub.Msg.Language]...), cs...)
+	if len(all) > 0 && len(match(pools, all)) == 0 {
+		return web.Msg(http.StatusBadRequest, "", "pool.unsatisfiable", messages.Params{"constraints": constraintList(all)})
+	}
+	if rt.Pool == "" && len(cs) == 0 {
+		return nil
+	}
+
+	sub.After(func() {
+		for _, id := range sub.Sessions() {
+			if err := store.PutJSON(context.Background(), r.store, nsSessionRouting, strconv.Itoa(id), rt); err != nil {
+				slog.Error("Failed to save session routing", "session", id, "error", err)
+				continue
+			}
+			r.mu.Lock()
+			r.sessions[id] = rt
+			r.mu.Unlock()
+		}
+	})
+	return nil
+}
+
+func constraintList(cs []Constraint) string {
+	ss := make([]string, len(cs))
+	for i, c := range cs {
+		ss[i] = c.String()
+	}
+	return strings.Join(ss, ", ")
+}
@@ -0,0 +1,89 @@
+package prefetch
+
+import (
+	"errors"
+	"log/slog"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/minio/minio-go/v7"
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/web"
+)
+
+// Register takes over the commander's database download, serving staged
+// copies with Range support, and adds the manifest of their chunks.  The
+// language is ignored, as the commander ignores it.
+func (s *Stager) Register(r *mux.Router) {
+	const path = "/repos/{repo_owner}/{repo_name}/code-scanning/codeql/databases/{repo_language}"
+	r.HandleFunc(path+"/manifest", s.serveManifest).Methods(http.MethodGet)
+	r.HandleFunc(path, s.serveDatabase).Methods(http.MethodGet, http.MethodHead)
+}
+
+func repoOf(r *http.Request) common.NameWithOwner {
+	vars := mux.Vars(r)
+	return common.NameWithOwner{Owner: vars["repo_owner"], Repo: vars["repo_name"]}
+}
+
+// stageFailed answers a download whose database could not be staged,
+// telling a missing database from a failure to copy it.
+func (s *Stager) stageFailed(w http.ResponseWriter, nwo common.NameWithOwner, err error) {
+	var we *web.Error
+	if errors.As(err, &we) {
+		web.Fail(w, we, we.Code)
+		return
+	}
+	if notFound, _ := s.dbs.FindAvailableDBs([]common.NameWithOwner{nwo}); len(notFound) > 0 {
+		web.Fail(w, web.Msg(http.StatusNotFound, apierr.DBNotFound, "database.not_found",
+			messages.Params{"repository": nwo.Owner + "/" + nwo.Repo}), http.StatusNotFound)
+		return
+	}
+	slog.Error("Failed to stage database for download", "repo", nwo, "error", err)
+	http.Error(w, "Failed to retrieve ql database", http.StatusInternalServerError)
+}
+
+func (s *Stager) serveManifest(w http.ResponseWriter, r *http.Request) {
+	nwo := repoOf(r)
+	if err := s.Ensure(r.Context(), nwo); err != nil {
+		s.stageFailed(w, nwo, err)
+		return
+	}
+	m, err := s.Manifest(r.Context(), nwo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, m)
+}
+
+func (s *Stager) serveDatabase(w http.ResponseWriter, r *http.Request) {
+	nwo := repoOf(r)
+	if err := s.Ensure(r.Context(), nwo); err != nil {
+		s.stageFailed(w, nwo, err)
+		return
+	}
+	m, err := s.Manifest(r.Context(), nwo)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	obj, err := s.mc.GetObject(r.Context(), s.cfg.Bucket, objectName(nwo), minio.GetObjectOptions{})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer obj.Close()
+	info, err := obj.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// The database's hash is its ETag, so If-Range keeps the chunks of a
+	// parallel download from mixing two versions.
+	w.Header().Set("ETag", `"`+m.SHA256+`"`)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	http.ServeContent(w, r, objectName(nwo), info.LastModified, obj)
+}
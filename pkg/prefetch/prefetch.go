@@ -0,0 +1,440 @@
+// Package prefetch stages CodeQL databases ahead of dispatch.  Databases
+// come from HEPC or GitHub and can take minutes each to download; a large
+// session's jobs spend that time waiting in the dispatch backlog anyway.
+// As soon as a job is queued its database is copied from the database
+// store into a staging bucket of the artifact store, and the job is
+// published pointing at the staged copy if it is ready by then.
+//
+// Staged copies are also what the server's database downloads are served
+// from, in ranged chunks listed with their hashes in a manifest, so agents
+// on high-latency links can fetch large databases in parallel.
+//
+// With a malware scanner, databases are scanned as they are staged, and
+// the stager holds jobs in the backlog until their database is staged and
+// clean; jobs on infected databases fail.
+package prefetch
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/qldbstore"
+	"github.com/minio/minio-go/v7"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/avscan"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/throttle"
+	"mrvaserver/pkg/web"
+)
+
+// queueSize bounds the databases waiting to be staged; jobs beyond it are
+// dispatched without a staged copy.
+const queueSize = 10000
+
+const manifestSuffix = ".manifest.json"
+
+var (
+	stagedTotal = metrics.NewCounter("mrvaserver_prefetch_staged_total",
+		"Databases copied into the staging bucket.")
+	stageErrors = metrics.NewCounter("mrvaserver_prefetch_errors_total",
+		"Databases that could not be staged.")
+	stagedBytes = metrics.NewCounter("mrvaserver_prefetch_bytes_total",
+		"Bytes copied into the staging bucket.")
+)
+
+type state int
+
+const (
+	pending state = iota
+	staged
+	failed
+	infected
+)
+
+type entry struct {
+	state state
+
+	// threat is why an infected database was rejected.
+	threat *web.Error
+
+	// started is set once a worker or a download has begun staging.
+	started bool
+
+	// done is closed when the entry stops being pending.
+	done chan struct{}
+}
+
+type Stager struct {
+	cfg   config.Prefetch
+	dbs   qldbstore.Store
+	mc    *minio.Client
+	queue chan common.JobSpec
+	limit *throttle.Throttle
+	scan  *avscan.Scanner
+
+	mu      sync.Mutex
+	entries map[common.NameWithOwner]*entry
+}
+
+// New returns a stager copying from dbs into cfg.Bucket of the artifact
+// store mc, creating the bucket if needed.
+func New(cfg config.Prefetch, dbs qldbstore.Store, mc *minio.Client) (*Stager, error) {
+	if err := common.CreateMinIOBucketIfNotExists(mc, cfg.Bucket); err != nil {
+		return nil, fmt.Errorf("failed to create staging bucket: %w", err)
+	}
+	return &Stager{
+		cfg:     cfg,
+		dbs:     dbs,
+		mc:      mc,
+		queue:   make(chan common.JobSpec, queueSize),
+		entries: make(map[common.NameWithOwner]*entry),
+	}, nil
+}
+
+// SetThrottle limits the bandwidth of staging.  It must be called before
+// Run.
+func (s *Stager) SetThrottle(t *throttle.Throttle) {
+	s.limit = t
+}
+
+// SetScanner makes staging scan databases with sc, and the stager a
+// dispatch.Gate holding jobs until their database is staged and clean.
+// It must be called before Run.  Databases staged before are not scanned
+// again.
+func (s *Stager) SetScanner(sc *avscan.Scanner) {
+	s.scan = sc
+}
+
+func baseName(nwo common.NameWithOwner) string {
+	return fmt.Sprintf("%s$%s", nwo.Owner, nwo.Repo)
+}
+
+func objectName(nwo common.NameWithOwner) string {
+	return baseName(nwo) + ".zip"
+}
+
+func manifestName(nwo common.NameWithOwner) string {
+	return baseName(nwo) + manifestSuffix
+}
+
+// Run stages databases with cfg.Concurrency workers until ctx is
+// cancelled.
+func (s *Stager) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for i := 0; i < s.cfg.Concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case js := <-s.queue:
+					if s.claim(js.NameWithOwner) {
+						s.stage(ctx, js)
+					}
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Stage queues the job's database for staging unless it is staged or
+// queued already.
+func (s *Stager) Stage(job agentproto.Job) {
+	nwo := job.Spec.NameWithOwner
+	s.mu.Lock()
+	if e, ok := s.entries[nwo]; ok && e.state != failed {
+		s.mu.Unlock()
+		return
+	}
+	e := &entry{done: make(chan struct{})}
+	s.entries[nwo] = e
+	s.mu.Unlock()
+
+	select {
+	case s.queue <- job.Spec:
+	default:
+		s.mu.Lock()
+		if !e.started {
+			delete(s.entries, nwo)
+			close(e.done)
+		}
+		s.mu.Unlock()
+		slog.Debug("Prefetch queue full, not staging database", "repo", nwo)
+	}
+}
+
+// claim marks a queued database as being staged.  It reports false if
+// staging has begun already or the entry is gone.
+func (s *Stager) claim(nwo common.NameWithOwner) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[nwo]
+	if !ok || e.started || e.state != pending {
+		return false
+	}
+	e.started = true
+	return true
+}
+
+// Annotate points the job at the staged copy of its database, if there is
+// one.
+func (s *Stager) Annotate(job agentproto.Job) agentproto.Job {
+	s.mu.Lock()
+	e, ok := s.entries[job.Spec.NameWithOwner]
+	s.mu.Unlock()
+	if ok && e.state == staged {
+		job.Database = &artifactstore.ArtifactLocation{
+			Bucket: s.cfg.Bucket,
+			Key:    objectName(job.Spec.NameWithOwner),
+		}
+	}
+	return job
+}
+
+// Clear clears a job once its database is staged, queueing it for staging
+// again if it could not be, and rejects it if its database is infected.
+// Without a scanner every job is clear.
+func (s *Stager) Clear(job agentproto.Job) (bool, error) {
+	if s.scan == nil {
+		return true, nil
+	}
+	s.mu.Lock()
+	e, ok := s.entries[job.Spec.NameWithOwner]
+	s.mu.Unlock()
+	switch {
+	case !ok || e.state == failed:
+		s.Stage(job)
+		return false, nil
+	case e.state == infected:
+		return false, e.threat
+	}
+	return e.state == staged, nil
+}
+
+// Ensure stages a database now, unless it is staged already, and waits
+// until it is.  A database queued for staging is taken out of turn.
+func (s *Stager) Ensure(ctx context.Context, nwo common.NameWithOwner) error {
+	for {
+		s.mu.Lock()
+		e, ok := s.entries[nwo]
+		switch {
+		case ok && e.state == staged:
+			s.mu.Unlock()
+			return nil
+		case ok && e.state == infected:
+			s.mu.Unlock()
+			return e.threat
+		case ok && e.state == pending && e.started:
+			s.mu.Unlock()
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-e.done:
+			}
+			continue
+		case !ok || e.state == failed:
+			e = &entry{done: make(chan struct{})}
+			s.entries[nwo] = e
+		}
+		e.started = true
+		s.mu.Unlock()
+
+		s.stage(ctx, common.JobSpec{NameWithOwner: nwo})
+		s.mu.Lock()
+		st, threat := e.state, e.threat
+		s.mu.Unlock()
+		if st == infected {
+			return threat
+		}
+		if st != staged {
+			return fmt.Errorf("failed to stage database of %s/%s", nwo.Owner, nwo.Repo)
+		}
+		return nil
+	}
+}
+
+// reject marks a database infected.
+func (s *Stager) reject(nwo common.NameWithOwner, inf *avscan.Infected) {
+	threat := web.Msg(http.StatusUnprocessableEntity, apierr.MalwareDetected, "malware.database_infected",
+		messages.Params{"repository": nwo.Owner + "/" + nwo.Repo, "signature": inf.Signature})
+	s.mu.Lock()
+	if e, ok := s.entries[nwo]; ok {
+		e.threat = threat
+	}
+	s.mu.Unlock()
+	stageErrors.Inc()
+	s.set(nwo, infected)
+}
+
+func (s *Stager) set(nwo common.NameWithOwner, st state) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e, ok := s.entries[nwo]
+	if !ok {
+		return
+	}
+	if e.state == pending && st != pending {
+		close(e.done)
+	}
+	e.state = st
+}
+
+// stage copies a database and its manifest, charging the transfer to the
+// session that first needed it.
+func (s *Stager) stage(ctx context.Context, js common.JobSpec) {
+	nwo := js.NameWithOwner
+	if _, err := s.mc.StatObject(ctx, s.cfg.Bucket, manifestName(nwo), minio.StatObjectOptions{}); err == nil {
+		s.set(nwo, staged)
+		return
+	}
+
+	start := time.Now()
+	data, err := s.dbs.GetDatabase(nwo)
+	if err == nil {
+		// The database store hands over whole databases, so the download
+		// is paid for after the fact, delaying the next one.
+		err = s.limit.Wait(ctx, throttle.Ingress, js.SessionID, len(data))
+	}
+	if err == nil && s.scan != nil {
+		err = s.scan.Scan(ctx, avscan.KindDatabase, baseName(nwo)+".zip", data)
+		var inf *avscan.Infected
+		if errors.As(err, &inf) {
+			s.reject(nwo, inf)
+			return
+		}
+	}
+	if err == nil {
+		body := s.limit.Reader(ctx, throttle.Egress, js.SessionID, bytes.NewReader(data))
+		_, err = s.mc.PutObject(ctx, s.cfg.Bucket, objectName(nwo), body, int64(len(data)),
+			minio.PutObjectOptions{ContentType: "application/zip"})
+	}
+	if err == nil {
+		// The manifest goes last: its presence marks a complete copy.
+		var m []byte
+		m, err = json.Marshal(buildManifest(nwo, data, s.cfg.ChunkSize))
+		if err == nil {
+			_, err = s.mc.PutObject(ctx, s.cfg.Bucket, manifestName(nwo), bytes.NewReader(m), int64(len(m)),
+				minio.PutObjectOptions{ContentType: "application/json"})
+		}
+	}
+	if err != nil {
+		stageErrors.Inc()
+		s.set(nwo, failed)
+		slog.Warn("Failed to stage database", "repo", nwo, "error", err)
+		return
+	}
+	stagedTotal.Inc()
+	stagedBytes.Add(float64(len(data)))
+	s.set(nwo, staged)
+	slog.Debug("Staged database", "repo", nwo, "bytes", len(data), "duration", time.Since(start))
+}
+
+func buildManifest(nwo common.NameWithOwner, data []byte, chunkSize int64) agentproto.DatabaseManifest {
+	sum := sha256.Sum256(data)
+	m := agentproto.DatabaseManifest{
+		Repository: nwo.Owner + "/" + nwo.Repo,
+		Size:       int64(len(data)),
+		ChunkSize:  chunkSize,
+		SHA256:     hex.EncodeToString(sum[:]),
+	}
+	for off := int64(0); off < m.Size; off += chunkSize {
+		chunk := data[off:min(off+chunkSize, m.Size)]
+		sum := sha256.Sum256(chunk)
+		m.Chunks = append(m.Chunks, agentproto.DatabaseChunk{
+			Offset: off,
+			Size:   int64(len(chunk)),
+			SHA256: hex.EncodeToString(sum[:]),
+		})
+	}
+	return m
+}
+
+// Manifest returns the manifest of a staged database.
+func (s *Stager) Manifest(ctx context.Context, nwo common.NameWithOwner) (*agentproto.DatabaseManifest, error) {
+	obj, err := s.mc.GetObject(ctx, s.cfg.Bucket, manifestName(nwo), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	var m agentproto.DatabaseManifest
+	if err := json.NewDecoder(obj).Decode(&m); err != nil {
+		return nil, fmt.Errorf("failed to read manifest of %s/%s: %w", nwo.Owner, nwo.Repo, err)
+	}
+	return &m, nil
+}
+
+// DatabaseSize returns the size of a staged database.
+func (s *Stager) DatabaseSize(nwo common.NameWithOwner) (int64, bool) {
+	m, err := s.Manifest(context.Background(), nwo)
+	if err != nil {
+		return 0, false
+	}
+	return m.Size, true
+}
+
+// Prune deletes staged copies older than cfg.Retention, and databases
+// whose staging never completed.  It is a background task.
+func (s *Stager) Prune(ctx context.Context) error {
+	cutoff := time.Now().Add(-s.cfg.Retention)
+	manifests := make(map[string]time.Time)
+	databases := make(map[string]time.Time)
+	for obj := range s.mc.ListObjects(ctx, s.cfg.Bucket, minio.ListObjectsOptions{Recursive: true}) {
+		if obj.Err != nil {
+			return obj.Err
+		}
+		if base, ok := strings.CutSuffix(obj.Key, manifestSuffix); ok {
+			manifests[base] = obj.LastModified
+		} else if base, ok := strings.CutSuffix(obj.Key, ".zip"); ok {
+			databases[base] = obj.LastModified
+		}
+	}
+
+	removed := make(map[string]bool)
+	for base, modified := range databases {
+		m, complete := manifests[base]
+		if complete {
+			modified = m
+		}
+		if modified.After(cutoff) {
+			continue
+		}
+		// The manifest goes first, so the copy is not taken as complete
+		// while it is being removed.
+		for _, key := range []string{base + manifestSuffix, base + ".zip"} {
+			if err := s.mc.RemoveObject(ctx, s.cfg.Bucket, key, minio.RemoveObjectOptions{}); err != nil {
+				return err
+			}
+		}
+		removed[base] = true
+	}
+	if len(removed) == 0 {
+		return nil
+	}
+	s.mu.Lock()
+	for nwo, e := range s.entries {
+		if e.state == staged && removed[baseName(nwo)] {
+			delete(s.entries, nwo)
+		}
+	}
+	s.mu.Unlock()
+	slog.Info("Pruned staged databases", "count", len(removed))
+	return nil
+}
@@ -0,0 +1,272 @@
+// Package preflight checks that the backends a configuration names can be
+// reached with the endpoints and credentials in the environment, before a
+// server is started with them.  Every check is read-only: it connects,
+// authenticates and reads, but creates no schema, bucket or queue.
+package preflight
+
+import (
+	"context"
+	"crypto/tls"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"time"
+
+	_ "github.com/go-sql-driver/mysql"
+	"github.com/jackc/pgx/v5"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"mrvaserver/pkg/backup"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/etcd"
+	"mrvaserver/pkg/instance"
+	"mrvaserver/pkg/leader"
+	"mrvaserver/pkg/netaddr"
+	"mrvaserver/pkg/rabbitmq"
+	"mrvaserver/pkg/redis"
+	"mrvaserver/pkg/replication"
+)
+
+// checkTimeout bounds each check, so an unreachable endpoint fails rather
+// than hangs.
+const checkTimeout = 10 * time.Second
+
+// Result is the outcome of one component's check.  A component that
+// cannot be checked, such as a backend registered by a fork, is Skipped.
+type Result struct {
+	Component string
+	Detail    string
+	Err       error
+	Skipped   bool
+}
+
+func (r Result) Passed() bool { return r.Err == nil }
+
+type check struct {
+	component string
+	run       func(ctx context.Context) (string, error)
+}
+
+// Run checks every component cfg uses, in the order the server starts
+// them.
+func Run(cfg *config.Config) []Result {
+	var checks []check
+	add := func(component string, run func(ctx context.Context) (string, error)) {
+		checks = append(checks, check{component, run})
+	}
+
+	if cfg.HTTP.TLSCertFile != "" {
+		add("http.tls", func(ctx context.Context) (string, error) {
+			if _, err := tls.LoadX509KeyPair(cfg.HTTP.TLSCertFile, cfg.HTTP.TLSKeyFile); err != nil {
+				return "", fmt.Errorf("failed to load certificate: %w", err)
+			}
+			return cfg.HTTP.TLSCertFile, nil
+		})
+	}
+
+	switch cfg.State.Backend {
+	case "postgres":
+		add("state", dsnPostgres("MRVA_STATE_DSN"))
+	case "commander":
+		add("state", func(ctx context.Context) (string, error) { return pingPostgres(ctx, "") })
+	case "mysql":
+		add("state", func(ctx context.Context) (string, error) {
+			return pingMySQL(ctx, os.Getenv("MRVA_STATE_DSN"))
+		})
+	case "etcd":
+		add("state", func(ctx context.Context) (string, error) {
+			c, err := etcd.FromEnv()
+			if err != nil {
+				return "", err
+			}
+			if _, err := c.Get(ctx, cfg.State.EtcdPrefix+"state/next-id"); err != nil {
+				return "", fmt.Errorf("failed to read state: %w", err)
+			}
+			return "etcd under " + cfg.State.EtcdPrefix, nil
+		})
+	case "journal":
+		add("state", func(ctx context.Context) (string, error) { return checkJournal(cfg.State.JournalFile) })
+	default:
+		add("state", nil)
+	}
+
+	if cfg.State.Backend != "etcd" {
+		add("metadata", dsnPostgres("MRVA_STORE_DSN"))
+	}
+
+	if cfg.Cache.Enabled {
+		add("cache", func(ctx context.Context) (string, error) {
+			c, err := redis.FromEnv()
+			if err != nil {
+				return "", err
+			}
+			c.Close()
+			return os.Getenv("MRVA_REDIS_ADDR"), nil
+		})
+	}
+
+	if cfg.Queue.Backend == "rabbitmq" {
+		add("queue", checkRabbitMQ)
+	} else {
+		add("queue", nil)
+	}
+
+	if cfg.Artifacts.Backend == "minio" {
+		add("artifacts", checkArtifacts)
+	} else {
+		add("artifacts", nil)
+	}
+	if cfg.Tiering.Enabled {
+		add("tiering", func(ctx context.Context) (string, error) { return checkColdBucket(ctx, cfg.Tiering.Bucket) })
+	}
+	if cfg.Replication.Enabled {
+		add("replication", checkSecondary)
+	}
+
+	// mrvacommander's database store exits the process on a missing
+	// setting rather than returning an error, so it is left to the server.
+	add("databases", nil)
+
+	if cfg.Leader.Backend == "kubernetes" {
+		add("leader", func(ctx context.Context) (string, error) {
+			e, err := leader.NewKubernetesElector(cfg.Leader.Namespace, cfg.Leader.LeaseName,
+				instance.ID(), cfg.Leader.LeaseDuration)
+			if err != nil {
+				return "", err
+			}
+			if err := e.Check(ctx); err != nil {
+				return "", err
+			}
+			return "lease " + cfg.Leader.LeaseName, nil
+		})
+	}
+
+	results := make([]Result, 0, len(checks))
+	for _, c := range checks {
+		if c.run == nil {
+			results = append(results, Result{Component: c.component, Detail: "not checked", Skipped: true})
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), checkTimeout)
+		detail, err := c.run(ctx)
+		cancel()
+		results = append(results, Result{Component: c.component, Detail: detail, Err: err})
+	}
+	return results
+}
+
+// dsnPostgres checks the Postgres database named by the environment
+// variable env, or by the PG* variables if it is empty.
+func dsnPostgres(env string) func(ctx context.Context) (string, error) {
+	return func(ctx context.Context) (string, error) {
+		detail, err := pingPostgres(ctx, os.Getenv(env))
+		if os.Getenv(env) == "" && err == nil {
+			detail += " (PG* environment)"
+		}
+		return detail, err
+	}
+}
+
+func pingPostgres(ctx context.Context, dsn string) (string, error) {
+	conn, err := pgx.Connect(ctx, dsn)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	defer conn.Close(context.Background())
+	var version string
+	if err := conn.QueryRow(ctx, `SHOW server_version`).Scan(&version); err != nil {
+		return "", fmt.Errorf("failed to query postgres: %w", err)
+	}
+	cc := conn.Config()
+	return fmt.Sprintf("postgres %s at %s:%d/%s", version, cc.Host, cc.Port, cc.Database), nil
+}
+
+func pingMySQL(ctx context.Context, dsn string) (string, error) {
+	db, err := sql.Open("mysql", dsn)
+	if err != nil {
+		return "", fmt.Errorf("failed to connect to mysql: %w", err)
+	}
+	defer db.Close()
+	var version string
+	if err := db.QueryRowContext(ctx, `SELECT VERSION()`).Scan(&version); err != nil {
+		return "", fmt.Errorf("failed to connect to mysql: %w", err)
+	}
+	return "mysql " + version, nil
+}
+
+// checkJournal checks that an existing journal can be read, or that the
+// directory a new one will be created in exists.
+func checkJournal(name string) (string, error) {
+	f, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		dir := filepath.Dir(name)
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() {
+			return "", fmt.Errorf("journal directory %s does not exist", dir)
+		}
+		return name + " (will be created)", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("failed to open journal: %w", err)
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("failed to read journal: %w", err)
+	}
+	return fmt.Sprintf("%s (%d bytes)", name, info.Size()), nil
+}
+
+func checkRabbitMQ(ctx context.Context) (string, error) {
+	url, err := rabbitmq.URLFromEnv()
+	if err != nil {
+		return "", err
+	}
+	conn, err := amqp.DialConfig(url, amqp.Config{Dial: amqp.DefaultDial(checkTimeout)})
+	if err != nil {
+		return "", fmt.Errorf("failed to connect: %w", err)
+	}
+	defer conn.Close()
+	return "rabbitmq at " + netaddr.JoinHostPort(os.Getenv("MRVA_RABBITMQ_HOST"), os.Getenv("MRVA_RABBITMQ_PORT")), nil
+}
+
+func checkArtifacts(ctx context.Context) (string, error) {
+	client, err := backup.ArtifactClient()
+	if err != nil {
+		return "", err
+	}
+	buckets, err := client.ListBuckets(ctx)
+	if err != nil {
+		return "", fmt.Errorf("failed to list buckets: %w", err)
+	}
+	return fmt.Sprintf("minio at %s, %d buckets", os.Getenv("ARTIFACT_MINIO_ENDPOINT"), len(buckets)), nil
+}
+
+// checkColdBucket checks the tiering bucket, which the server expects to
+// exist.
+func checkColdBucket(ctx context.Context, bucket string) (string, error) {
+	client, err := backup.ArtifactClient()
+	if err != nil {
+		return "", err
+	}
+	exists, err := client.BucketExists(ctx, bucket)
+	if err != nil {
+		return "", fmt.Errorf("failed to look up bucket %s: %w", bucket, err)
+	}
+	if !exists {
+		return "", fmt.Errorf("bucket %s does not exist", bucket)
+	}
+	return "bucket " + bucket, nil
+}
+
+func checkSecondary(ctx context.Context) (string, error) {
+	client, err := replication.SecondaryClient()
+	if err != nil {
+		return "", err
+	}
+	if _, err := client.ListBuckets(ctx); err != nil {
+		return "", fmt.Errorf("failed to list buckets: %w", err)
+	}
+	return "minio at " + os.Getenv("DR_MINIO_ENDPOINT"), nil
+}
@@ -0,0 +1,107 @@
+package provenance
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/web"
+)
+
+// Register adds the provenance download:
+//
+//	GET /repos/{owner}/{repo}/code-scanning/codeql/variant-analyses/{id}/provenance
+//	GET /variant-analyses/{id}/provenance
+func (x *Exporter) Register(r *mux.Router) {
+	r.HandleFunc("/repos/{owner}/{repo}/code-scanning/codeql/variant-analyses/{id:[0-9]+}/provenance", x.get).Methods(http.MethodGet)
+	r.HandleFunc("/variant-analyses/{id:[0-9]+}/provenance", x.get).Methods(http.MethodGet)
+}
+
+func (x *Exporter) get(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	st, err := x.Statement(r.Context(), id)
+	if err != nil {
+		http.Error(w, "variant analysis not found", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Disposition", "attachment; filename=provenance-"+st.Predicate.Session+".intoto.json")
+	web.WriteJSON(w, http.StatusOK, st)
+}
+
+// Register adds replays:
+//
+//	POST /repos/{owner}/{repo}/code-scanning/codeql/variant-analyses/{id}/replay
+//	POST /variant-analyses/{id}/replay   {"pin_codeql": false} to relax the CodeQL pin
+//	GET  /variant-analyses/{id}/replays  divergence reports of its replays
+func (p *Replayer) Register(r *mux.Router) {
+	r.HandleFunc("/repos/{owner}/{repo}/code-scanning/codeql/variant-analyses/{id:[0-9]+}/replay", p.start).Methods(http.MethodPost)
+	r.HandleFunc("/variant-analyses/{id:[0-9]+}/replay", p.start).Methods(http.MethodPost)
+	r.HandleFunc("/variant-analyses/{id:[0-9]+}/replays", p.list).Methods(http.MethodGet)
+}
+
+func (p *Replayer) start(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	var opts replayOptions
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&opts); err != nil && !errors.Is(err, io.EOF) {
+			http.Error(w, "invalid replay options: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	rep, err := p.Start(r, id, opts.PinCodeQL == nil || *opts.PinCodeQL)
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	v, err := nameReplay(r, rep)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusCreated, v)
+}
+
+func (p *Replayer) list(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	reports, err := p.Reports(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	views := make([]reportView, len(reports))
+	for i, rep := range reports {
+		v, err := nameReplay(r, rep.Replay)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		views[i] = reportView{Report: rep, Original: v.Original, Session: v.Session}
+	}
+	web.WriteJSON(w, http.StatusOK, views)
+}
+
+// replayView and reportView are a Replay and a Report as clients see
+// them, their sessions named.
+type replayView struct {
+	Replay
+	Original string `json:"original"`
+	Session  string `json:"session"`
+}
+
+type reportView struct {
+	Report
+	Original string `json:"original"`
+	Session  string `json:"session"`
+}
+
+func nameReplay(r *http.Request, rep Replay) (replayView, error) {
+	v := replayView{Replay: rep}
+	var err error
+	if v.Original, err = web.SessionName(r.Context(), rep.Original); err == nil {
+		v.Session, err = web.SessionName(r.Context(), rep.Session)
+	}
+	return v, err
+}
@@ -0,0 +1,231 @@
+// Package provenance records what produced each session's results and
+// exports it as an in-toto statement, for audits and reproduction.  The
+// statement's subjects are the result archives, by SHA-256; its predicate
+// names the query pack by hash and, for every repository, the database
+// analyzed, the CodeQL version and agent image that analyzed it, and the
+// sandbox the agent attested to.
+//
+// Agents report their CodeQL version and image digest with each result
+// (see agentproto.Result); older agents leave them out.
+package provenance
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"runtime/debug"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/hohn/mrvacommander/pkg/state"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/instance"
+	"mrvaserver/pkg/shard"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const nsExecutions = "provenance"
+
+const (
+	StatementType = "https://in-toto.io/Statement/v1"
+	PredicateType = "https://github.com/hohn/mrvaserver/provenance/v1"
+)
+
+// execution is what a result says about how it was produced.
+type execution struct {
+	Attempt       int                            `json:"attempt,omitempty"`
+	Agent         string                         `json:"agent,omitempty"`
+	AgentImage    string                         `json:"agent_image,omitempty"`
+	CodeQLVersion string                         `json:"codeql_version,omitempty"`
+	Sandbox       *agentproto.SandboxAttestation `json:"sandbox,omitempty"`
+}
+
+func key(js common.JobSpec) string {
+	return fmt.Sprintf("%d/%s/%s", js.SessionID, js.Owner, js.Repo)
+}
+
+// Record saves what each result says about its production before next
+// applies it.  A later attempt's result replaces an earlier one's.
+func Record(s store.Store, next agentproto.ResultHandler) agentproto.ResultHandler {
+	return func(r agentproto.Result) error {
+		e := execution{
+			Attempt:       r.Attempt,
+			Agent:         r.Agent,
+			AgentImage:    r.AgentImage,
+			CodeQLVersion: r.CodeQLVersion,
+			Sandbox:       r.Sandbox,
+		}
+		if err := store.PutJSON(context.Background(), s, nsExecutions, key(r.Spec), e); err != nil {
+			return fmt.Errorf("failed to record provenance: %w", err)
+		}
+		return next(r)
+	}
+}
+
+type Statement struct {
+	Type          string    `json:"_type"`
+	Subject       []Subject `json:"subject"`
+	PredicateType string    `json:"predicateType"`
+	Predicate     Predicate `json:"predicate"`
+}
+
+type Subject struct {
+	Name   string            `json:"name"`
+	Digest map[string]string `json:"digest"`
+}
+
+type Predicate struct {
+	Session     string    `json:"session"`
+	Language    string    `json:"language"`
+	CreatedAt   string    `json:"created_at,omitempty"`
+	QueryPack   Material  `json:"query_pack"`
+	Server      Server    `json:"server"`
+	Jobs        []Job     `json:"jobs"`
+	GeneratedAt time.Time `json:"generated_at"`
+}
+
+// Material is an input, by location and digest.
+type Material struct {
+	URI    string            `json:"uri"`
+	Digest map[string]string `json:"digest,omitempty"`
+}
+
+// Server identifies the build of the server writing the statement.
+type Server struct {
+	Version  string `json:"version,omitempty"`
+	Revision string `json:"revision,omitempty"`
+	Instance string `json:"instance"`
+}
+
+type Job struct {
+	Repository    string                         `json:"repository"`
+	Status        string                         `json:"status"`
+	DatabaseSHA   string                         `json:"database_sha,omitempty"`
+	ResultCount   int                            `json:"result_count"`
+	Result        *Material                      `json:"result,omitempty"`
+	Attempt       int                            `json:"attempt,omitempty"`
+	Agent         string                         `json:"agent,omitempty"`
+	AgentImage    string                         `json:"agent_image,omitempty"`
+	CodeQLVersion string                         `json:"codeql_version,omitempty"`
+	Sandbox       *agentproto.SandboxAttestation `json:"sandbox,omitempty"`
+}
+
+type Exporter struct {
+	store     store.Store
+	state     state.ServerState
+	artifacts artifactstore.Store
+	shards    *shard.Map
+}
+
+func NewExporter(s store.Store, st state.ServerState, artifacts artifactstore.Store) *Exporter {
+	return &Exporter{store: s, state: st, artifacts: artifacts}
+}
+
+// SetShards makes a sharded session's statement cover the jobs of all
+// its shards.
+func (x *Exporter) SetShards(m *shard.Map) {
+	x.shards = m
+}
+
+// jobs returns the jobs of the session's shards, failing only if none has
+// any.
+func (x *Exporter) jobs(ctx context.Context, session int) ([]queue.AnalyzeJob, error) {
+	var all []queue.AnalyzeJob
+	var err error
+	found := false
+	for _, id := range x.shards.Sessions(ctx, session) {
+		js, e := x.state.GetJobList(id)
+		if e != nil {
+			err = e
+			continue
+		}
+		found = true
+		all = append(all, js...)
+	}
+	if !found {
+		return nil, err
+	}
+	return all, nil
+}
+
+func uri(loc artifactstore.ArtifactLocation) string {
+	return fmt.Sprintf("artifact://%s/%s", loc.Bucket, loc.Key)
+}
+
+func digest(data []byte) map[string]string {
+	sum := sha256.Sum256(data)
+	return map[string]string{"sha256": hex.EncodeToString(sum[:])}
+}
+
+// Statement builds the session's statement, hashing its query pack and
+// results.
+func (x *Exporter) Statement(ctx context.Context, session int) (*Statement, error) {
+	jobs, err := x.jobs(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	name, err := web.SessionName(ctx, session)
+	if err != nil {
+		return nil, err
+	}
+	p := Predicate{Session: name, Server: server(), Jobs: []Job{}, GeneratedAt: time.Now().UTC()}
+	st := &Statement{Type: StatementType, Subject: []Subject{}, PredicateType: PredicateType}
+	for i, job := range jobs {
+		if i == 0 {
+			p.Language = string(job.QueryLanguage)
+			p.QueryPack = Material{URI: uri(job.QueryPackLocation)}
+			if pack, err := x.artifacts.GetQueryPack(job.QueryPackLocation); err == nil {
+				p.QueryPack.Digest = digest(pack)
+			} else {
+				slog.Warn("Failed to hash query pack for provenance", "session", session, "error", err)
+			}
+			if info, err := x.state.GetJobInfo(job.Spec); err == nil {
+				p.CreatedAt = info.CreatedAt
+			}
+		}
+
+		nwo := job.Spec.Owner + "/" + job.Spec.Repo
+		j := Job{Repository: nwo}
+		if status, err := x.state.GetStatus(job.Spec); err == nil {
+			j.Status = status.ToExternalString()
+		}
+		var e execution
+		if err := store.GetJSON(ctx, x.store, nsExecutions, key(job.Spec), &e); err == nil {
+			j.Attempt, j.Agent, j.AgentImage, j.CodeQLVersion, j.Sandbox =
+				e.Attempt, e.Agent, e.AgentImage, e.CodeQLVersion, e.Sandbox
+		}
+		if r, err := x.state.GetResult(job.Spec); err == nil {
+			j.DatabaseSHA, j.ResultCount = r.DatabaseSHA, r.ResultCount
+			if r.ResultLocation.Key != "" {
+				j.Result = &Material{URI: uri(r.ResultLocation)}
+				if data, err := x.artifacts.GetResult(r.ResultLocation); err == nil {
+					j.Result.Digest = digest(data)
+					st.Subject = append(st.Subject, Subject{Name: nwo, Digest: j.Result.Digest})
+				} else {
+					slog.Warn("Failed to hash result for provenance", "job", job.Spec, "error", err)
+				}
+			}
+		}
+		p.Jobs = append(p.Jobs, j)
+	}
+	st.Predicate = p
+	return st, nil
+}
+
+func server() Server {
+	s := Server{Instance: instance.ID()}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		s.Version = info.Main.Version
+		for _, setting := range info.Settings {
+			if setting.Key == "vcs.revision" {
+				s.Revision = setting.Value
+			}
+		}
+	}
+	return s
+}
@@ -0,0 +1,246 @@
+package provenance
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strconv"
+	"time"
+
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const nsReplays = "replays"
+
+// Replay is a session re-run from another's provenance.  The replay runs
+// the recorded query pack, byte for byte, on the recorded repositories,
+// and on agents offering the recorded CodeQL version (the pool label
+// codeql=VERSION) unless the request relaxes that.  Databases cannot be
+// pinned, as agents fetch a repository's current one; a database that
+// changed since shows as a divergence.
+type Replay struct {
+	Original      int       `json:"original"`
+	Session       int       `json:"session"`
+	RequestedBy   string    `json:"requested_by,omitempty"`
+	RequestedAt   time.Time `json:"requested_at"`
+	QueryPack     string    `json:"query_pack_sha256,omitempty"`
+	CodeQLVersion string    `json:"codeql_version,omitempty"`
+}
+
+// Divergences between a job and its replay.
+const (
+	DivergedMissing   = "missing"
+	DivergedStatus    = "status"
+	DivergedFindings  = "findings"
+	DivergedDatabase  = "database"
+	DivergedCodeQL    = "codeql"
+	DivergedQueryPack = "query_pack"
+)
+
+type Report struct {
+	Replay
+	Complete     bool         `json:"complete"`
+	Diverged     bool         `json:"diverged"`
+	QueryPack    []string     `json:"query_pack_divergence,omitempty"`
+	Repositories []Comparison `json:"repositories"`
+}
+
+// Comparison is one repository's job in the original and the replay.
+// Divergence is filled in once the replay's job has finished.
+type Comparison struct {
+	Repository string   `json:"repository"`
+	Original   Job      `json:"original"`
+	Replay     *Job     `json:"replay,omitempty"`
+	Divergence []string `json:"divergence,omitempty"`
+}
+
+type Replayer struct {
+	store    store.Store
+	exporter *Exporter
+	submit   http.Handler
+}
+
+// NewReplayer submits replays through submit, the gateway, so that the
+// requester's credentials, quotas and the submit hooks apply to them as to
+// any submission.
+func NewReplayer(s store.Store, x *Exporter, submit http.Handler) *Replayer {
+	return &Replayer{store: s, exporter: x, submit: submit}
+}
+
+type replayOptions struct {
+	PinCodeQL *bool `json:"pin_codeql"`
+}
+
+func finished(status string) bool {
+	return status == "succeeded" || status == "failed" || status == "error"
+}
+
+// Start submits a replay of original on behalf of r.
+func (p *Replayer) Start(r *http.Request, original int, pinCodeQL bool) (Replay, error) {
+	ctx := r.Context()
+	st, err := p.exporter.Statement(ctx, original)
+	if err != nil {
+		return Replay{}, web.Msg(http.StatusNotFound, "", "session.not_found", nil)
+	}
+	if len(st.Predicate.Jobs) == 0 {
+		return Replay{}, web.Msg(http.StatusConflict, "", "replay.no_repositories", messages.Params{"session": st.Predicate.Session})
+	}
+	jobs, err := p.exporter.jobs(ctx, original)
+	if err != nil {
+		return Replay{}, err
+	}
+	pack, err := p.exporter.artifacts.GetQueryPack(jobs[0].QueryPackLocation)
+	if err != nil {
+		return Replay{}, fmt.Errorf("failed to read query pack: %w", err)
+	}
+
+	rep := Replay{Original: original, RequestedBy: web.Identity(r), RequestedAt: time.Now().UTC(),
+		QueryPack: st.Predicate.QueryPack.Digest["sha256"]}
+	repos := make([]string, 0, len(st.Predicate.Jobs))
+	for _, j := range st.Predicate.Jobs {
+		repos = append(repos, j.Repository)
+		if !pinCodeQL || j.CodeQLVersion == "" {
+			continue
+		}
+		if rep.CodeQLVersion != "" && rep.CodeQLVersion != j.CodeQLVersion {
+			return Replay{}, web.Msg(http.StatusConflict, "", "replay.codeql_mismatch", messages.Params{
+				"session": original, "first": rep.CodeQLVersion, "second": j.CodeQLVersion})
+		}
+		rep.CodeQLVersion = j.CodeQLVersion
+	}
+
+	sub := map[string]any{
+		"action_repo_ref": "main",
+		"language":        st.Predicate.Language,
+		"query_pack":      base64.StdEncoding.EncodeToString(pack),
+		"repositories":    repos,
+	}
+	if rep.CodeQLVersion != "" {
+		sub["agent_constraints"] = []string{"codeql=" + rep.CodeQLVersion}
+	}
+	body, err := json.Marshal(sub)
+	if err != nil {
+		return Replay{}, err
+	}
+	req := r.Clone(ctx)
+	req.Method = http.MethodPost
+	req.URL.Path = "/repositories/0/code-scanning/codeql/variant-analyses"
+	req.URL.RawPath = ""
+	req.URL.RawQuery = ""
+	req.RequestURI = req.URL.RequestURI()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	rec := httptest.NewRecorder()
+	p.submit.ServeHTTP(rec, req)
+	if rec.Code < 200 || rec.Code >= 300 {
+		return Replay{}, web.Msg(rec.Code, "", "replay.failed", messages.Params{"error": submitError(rec.Body.Bytes())})
+	}
+	var resp struct {
+		ID int `json:"id"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.ID == 0 {
+		return Replay{}, fmt.Errorf("unexpected replay submission response: %s", rec.Body.Bytes())
+	}
+	rep.Session = resp.ID
+
+	key := fmt.Sprintf("%d/%d", original, rep.Session)
+	if err := store.PutJSON(context.Background(), p.store, nsReplays, key, rep); err != nil {
+		return rep, fmt.Errorf("failed to record replay: %w", err)
+	}
+	slog.Info("Variant analysis replayed", "session", original, "replay", rep.Session,
+		"codeql", rep.CodeQLVersion, "client", rep.RequestedBy)
+	return rep, nil
+}
+
+// submitError is the message of the error response to a replay's submission.
+func submitError(body []byte) string {
+	var b apierr.Body
+	if json.Unmarshal(body, &b) == nil && b.Message != "" {
+		return b.Message
+	}
+	return string(bytes.TrimSpace(body))
+}
+
+// Reports compares every replay of original with it.
+func (p *Replayer) Reports(ctx context.Context, original int) ([]Report, error) {
+	replays, err := store.ListJSON[Replay](ctx, p.store, nsReplays, strconv.Itoa(original)+"/")
+	if err != nil {
+		return nil, err
+	}
+	if len(replays) == 0 {
+		return []Report{}, nil
+	}
+	orig, err := p.exporter.Statement(ctx, original)
+	if err != nil {
+		return nil, err
+	}
+	reports := make([]Report, 0, len(replays))
+	for _, rep := range replays {
+		st, err := p.exporter.Statement(ctx, rep.Session)
+		if err != nil {
+			if errors.Is(err, ctx.Err()) {
+				return nil, err
+			}
+			slog.Warn("Replay session is gone", "session", original, "replay", rep.Session, "error", err)
+			continue
+		}
+		reports = append(reports, compare(rep, orig, st))
+	}
+	slices.SortFunc(reports, func(a, b Report) int { return a.Session - b.Session })
+	return reports, nil
+}
+
+func compare(rep Replay, orig, replay *Statement) Report {
+	out := Report{Replay: rep, Complete: true, Repositories: []Comparison{}}
+	if a, b := orig.Predicate.QueryPack.Digest["sha256"], replay.Predicate.QueryPack.Digest["sha256"]; a != b {
+		out.QueryPack = []string{DivergedQueryPack}
+		out.Diverged = true
+	}
+	replayed := make(map[string]Job, len(replay.Predicate.Jobs))
+	for _, j := range replay.Predicate.Jobs {
+		replayed[j.Repository] = j
+	}
+	for _, o := range orig.Predicate.Jobs {
+		c := Comparison{Repository: o.Repository, Original: o}
+		j, ok := replayed[o.Repository]
+		switch {
+		case !ok:
+			c.Divergence = []string{DivergedMissing}
+		case !finished(j.Status):
+			c.Replay = &j
+			out.Complete = false
+		default:
+			c.Replay = &j
+			if j.Status != o.Status {
+				c.Divergence = append(c.Divergence, DivergedStatus)
+			}
+			if j.ResultCount != o.ResultCount {
+				c.Divergence = append(c.Divergence, DivergedFindings)
+			}
+			if j.DatabaseSHA != o.DatabaseSHA {
+				c.Divergence = append(c.Divergence, DivergedDatabase)
+			}
+			if j.CodeQLVersion != o.CodeQLVersion {
+				c.Divergence = append(c.Divergence, DivergedCodeQL)
+			}
+		}
+		if len(c.Divergence) > 0 {
+			out.Diverged = true
+		}
+		out.Repositories = append(out.Repositories, c)
+	}
+	return out
+}
@@ -0,0 +1,68 @@
+package quarantine
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/web"
+)
+
+// RegisterAdmin adds the quarantine's endpoints:
+//
+//	GET    /admin/quarantine               quarantined messages
+//	GET    /admin/quarantine/{id}          one's record
+//	GET    /admin/quarantine/{id}/body     its body, as it was received
+//	POST   /admin/quarantine/{id}/redrive  publish it back onto its queue
+//	DELETE /admin/quarantine/{id}          discard it
+func (q *Quarantine) RegisterAdmin(r *mux.Router) {
+	r.HandleFunc("/admin/quarantine", q.list).Methods(http.MethodGet)
+	r.HandleFunc("/admin/quarantine/{id}", q.get).Methods(http.MethodGet)
+	r.HandleFunc("/admin/quarantine/{id}/body", q.getBody).Methods(http.MethodGet)
+	r.HandleFunc("/admin/quarantine/{id}/redrive", q.redriveOne).Methods(http.MethodPost)
+	r.HandleFunc("/admin/quarantine/{id}", q.discard).Methods(http.MethodDelete)
+}
+
+func (q *Quarantine) list(w http.ResponseWriter, r *http.Request) {
+	entries, err := q.List(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, entries)
+}
+
+func (q *Quarantine) get(w http.ResponseWriter, r *http.Request) {
+	e, err := q.Entry(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, e)
+}
+
+func (q *Quarantine) getBody(w http.ResponseWriter, r *http.Request) {
+	body, err := q.Body(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Write(body)
+}
+
+func (q *Quarantine) redriveOne(w http.ResponseWriter, r *http.Request) {
+	e, err := q.Redrive(r.Context(), mux.Vars(r)["id"])
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, e)
+}
+
+func (q *Quarantine) discard(w http.ResponseWriter, r *http.Request) {
+	if err := q.Discard(r.Context(), mux.Vars(r)["id"]); err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,196 @@
+// Package quarantine keeps the queue messages the server cannot process,
+// poison messages, out of their queues.  A message that fails to decode
+// or validate, or that its handler keeps failing on, would otherwise be
+// dropped, or requeued and redelivered forever.  Instead its body is put
+// in a bucket of the artifact store and a record of where it came from
+// and why it was taken out kept in the metadata store, so an operator can
+// inspect it, drive it back onto its queue once the cause is fixed, or
+// discard it.
+package quarantine
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/minio/minio-go/v7"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const nsQuarantine = "quarantine" // id -> Entry
+
+// Reasons a message is quarantined.
+const (
+	ReasonDecode  = "decode"  // the body is not a valid message
+	ReasonInvalid = "invalid" // the message fails validation, say its signature
+	ReasonHandler = "handler" // handling it failed on every redelivery
+)
+
+var quarantined = metrics.NewCounterVec("mrvaserver_quarantined_messages_total",
+	"Queue messages quarantined, by queue and reason.", "queue", "reason")
+
+// Entry records a quarantined message.
+type Entry struct {
+	ID          string         `json:"id"`
+	Queue       string         `json:"queue"`
+	Reason      string         `json:"reason"`
+	Error       string         `json:"error"`
+	Headers     map[string]any `json:"headers,omitempty"`
+	ContentType string         `json:"content_type,omitempty"`
+	Size        int            `json:"size"`
+	Deliveries  int            `json:"deliveries,omitempty"`
+	At          time.Time      `json:"at"`
+}
+
+// Redriver publishes a message back onto its queue.
+type Redriver interface {
+	Redrive(ctx context.Context, queue string, body []byte, contentType string, headers map[string]any) error
+}
+
+type Quarantine struct {
+	cfg     config.Quarantine
+	mc      *minio.Client
+	meta    store.Store
+	redrive Redriver
+}
+
+// New keeps the quarantined messages' bodies in cfg.Bucket.
+func New(cfg config.Quarantine, mc *minio.Client, meta store.Store) (*Quarantine, error) {
+	if err := common.CreateMinIOBucketIfNotExists(mc, cfg.Bucket); err != nil {
+		return nil, fmt.Errorf("failed to create quarantine bucket: %w", err)
+	}
+	return &Quarantine{cfg: cfg, mc: mc, meta: meta}, nil
+}
+
+// SetRedriver sets where re-driven messages are published.
+func (q *Quarantine) SetRedriver(r Redriver) {
+	q.redrive = r
+}
+
+// MaxDeliveries is how many times a message is delivered, its handler
+// failing each time, before it is quarantined.
+func (q *Quarantine) MaxDeliveries() int {
+	return q.cfg.MaxDeliveries
+}
+
+func newID() string {
+	b := make([]byte, 6)
+	rand.Read(b)
+	return time.Now().UTC().Format("20060102T150405Z") + "-" + hex.EncodeToString(b)
+}
+
+func objectName(id string) string {
+	return id + ".msg"
+}
+
+// Put quarantines a message taken off queue, which the caller then
+// acknowledges.
+func (q *Quarantine) Put(ctx context.Context, queue string, body []byte, contentType string, headers map[string]any,
+	deliveries int, reason string, cause error) (Entry, error) {
+	e := Entry{
+		ID:          newID(),
+		Queue:       queue,
+		Reason:      reason,
+		Error:       cause.Error(),
+		Headers:     headers,
+		ContentType: contentType,
+		Size:        len(body),
+		Deliveries:  deliveries,
+		At:          time.Now().UTC(),
+	}
+	_, err := q.mc.PutObject(ctx, q.cfg.Bucket, objectName(e.ID), bytes.NewReader(body), int64(len(body)),
+		minio.PutObjectOptions{
+			ContentType:  "application/octet-stream",
+			UserMetadata: map[string]string{"queue": queue, "reason": reason},
+		})
+	if err != nil {
+		return e, fmt.Errorf("failed to store quarantined message: %w", err)
+	}
+	if err := store.PutJSON(ctx, q.meta, nsQuarantine, e.ID, e); err != nil {
+		q.mc.RemoveObject(ctx, q.cfg.Bucket, objectName(e.ID), minio.RemoveObjectOptions{})
+		return e, fmt.Errorf("failed to record quarantined message: %w", err)
+	}
+	quarantined.With(queue, reason).Inc()
+	slog.Warn("Message quarantined", "id", e.ID, "queue", queue, "reason", reason, "error", e.Error)
+	return e, nil
+}
+
+// List returns the quarantined messages, oldest first.
+func (q *Quarantine) List(ctx context.Context) ([]Entry, error) {
+	return store.ListJSON[Entry](ctx, q.meta, nsQuarantine, "")
+}
+
+// Entry returns the record of message id.
+func (q *Quarantine) Entry(ctx context.Context, id string) (Entry, error) {
+	var e Entry
+	err := store.GetJSON(ctx, q.meta, nsQuarantine, id, &e)
+	if errors.Is(err, store.ErrNotFound) {
+		return e, web.Msg(http.StatusNotFound, "", "quarantine.unknown", messages.Params{"id": id})
+	}
+	return e, err
+}
+
+// Body returns the body of message id.
+func (q *Quarantine) Body(ctx context.Context, id string) ([]byte, error) {
+	if _, err := q.Entry(ctx, id); err != nil {
+		return nil, err
+	}
+	obj, err := q.mc.GetObject(ctx, q.cfg.Bucket, objectName(id), minio.GetObjectOptions{})
+	if err != nil {
+		return nil, err
+	}
+	defer obj.Close()
+	return io.ReadAll(obj)
+}
+
+// Redrive publishes message id back onto its queue and removes it from
+// the quarantine.
+func (q *Quarantine) Redrive(ctx context.Context, id string) (Entry, error) {
+	e, err := q.Entry(ctx, id)
+	if err != nil {
+		return e, err
+	}
+	if q.redrive == nil {
+		return e, web.Msg(http.StatusServiceUnavailable, "", "quarantine.no_redrive", nil)
+	}
+	body, err := q.Body(ctx, id)
+	if err != nil {
+		return e, err
+	}
+	if err := q.redrive.Redrive(ctx, e.Queue, body, e.ContentType, e.Headers); err != nil {
+		return e, fmt.Errorf("failed to re-drive message: %w", err)
+	}
+	slog.Info("Quarantined message re-driven", "id", id, "queue", e.Queue)
+	return e, q.remove(ctx, id)
+}
+
+// Discard removes message id for good.
+func (q *Quarantine) Discard(ctx context.Context, id string) error {
+	if _, err := q.Entry(ctx, id); err != nil {
+		return err
+	}
+	slog.Info("Quarantined message discarded", "id", id)
+	return q.remove(ctx, id)
+}
+
+func (q *Quarantine) remove(ctx context.Context, id string) error {
+	if err := q.meta.Delete(ctx, nsQuarantine, id); err != nil {
+		return err
+	}
+	if err := q.mc.RemoveObject(ctx, q.cfg.Bucket, objectName(id), minio.RemoveObjectOptions{}); err != nil {
+		slog.Warn("Failed to remove quarantined message body", "id", id, "error", err)
+	}
+	return nil
+}
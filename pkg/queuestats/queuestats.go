@@ -0,0 +1,207 @@
+// Package queuestats reports the job queues at GET /admin/queues: how many
+// messages each holds, ready and unacknowledged, how many consumers take
+// them and at what rates messages are published and acknowledged, so that
+// a stuck pipeline shows without the broker's own UI.  RabbitMQ's figures
+// come from its management API; other queue backends' are tracked by the
+// server as it publishes jobs and handles results.
+package queuestats
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/backend"
+	"mrvaserver/pkg/web"
+)
+
+// Queue is one queue's figures.  Rates are per second.  Tracked backends
+// know nothing of deliveries, so they leave the ready and unacknowledged
+// messages and the delivery rate out.
+type Queue struct {
+	Name        string  `json:"name"`
+	Type        string  `json:"type,omitempty"`
+	State       string  `json:"state,omitempty"`
+	Messages    int     `json:"messages"`
+	Ready       int     `json:"ready,omitempty"`
+	Unacked     int     `json:"unacked,omitempty"`
+	Consumers   int     `json:"consumers"`
+	PublishRate float64 `json:"publish_rate"`
+	DeliverRate float64 `json:"deliver_rate,omitempty"`
+	AckRate     float64 `json:"ack_rate"`
+}
+
+// Source reports the queues.
+type Source interface {
+	Queues(ctx context.Context) ([]Queue, error)
+}
+
+// Handler serves a Source's figures.
+type Handler struct {
+	name string
+	src  Source
+}
+
+// New serves src's figures, naming it name in responses.
+func New(name string, src Source) *Handler {
+	return &Handler{name: name, src: src}
+}
+
+type queuesResponse struct {
+	Source string  `json:"source"`
+	Queues []Queue `json:"queues"`
+}
+
+// RegisterAdmin adds GET /admin/queues.
+func (h *Handler) RegisterAdmin(r *mux.Router) {
+	r.HandleFunc("/admin/queues", h.list).Methods(http.MethodGet)
+}
+
+func (h *Handler) list(w http.ResponseWriter, r *http.Request) {
+	qs, err := h.src.Queues(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if qs == nil {
+		qs = []Queue{}
+	}
+	web.WriteJSON(w, http.StatusOK, queuesResponse{Source: h.name, Queues: qs})
+}
+
+// Rates are averaged over rateWindow, sampled every sampleInterval.
+const (
+	sampleInterval = 5 * time.Second
+	rateWindow     = time.Minute
+)
+
+type sample struct {
+	at               time.Time
+	published, acked int64
+}
+
+// Tracker counts the jobs published on a queue backend and the results
+// handled, acknowledging them, and reports the jobs outstanding between
+// the two as the queue's messages.  Counts start with the process, so
+// jobs published before it are not outstanding.  The backend's consumers
+// are counted if it has a Consumers method.
+type Tracker struct {
+	name      string
+	consumers func() int
+
+	published atomic.Int64
+	acked     atomic.Int64
+
+	mu      sync.Mutex
+	samples []sample
+}
+
+func NewTracker(name string) *Tracker {
+	t := &Tracker{name: name}
+	t.samples = []sample{t.sample()}
+	return t
+}
+
+func (t *Tracker) sample() sample {
+	return sample{at: time.Now(), published: t.published.Load(), acked: t.acked.Load()}
+}
+
+// Run samples the counts for the rates until ctx ends.
+func (t *Tracker) Run(ctx context.Context) {
+	tick := time.NewTicker(sampleInterval)
+	defer tick.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-tick.C:
+		}
+		s := t.sample()
+		t.mu.Lock()
+		t.samples = append(t.samples, s)
+		for len(t.samples) > 2 && s.at.Sub(t.samples[1].at) >= rateWindow {
+			t.samples = t.samples[1:]
+		}
+		t.mu.Unlock()
+	}
+}
+
+func (t *Tracker) Queues(ctx context.Context) ([]Queue, error) {
+	now := t.sample()
+	t.mu.Lock()
+	first := t.samples[0]
+	t.mu.Unlock()
+	rate := func(n, m int64) float64 {
+		if d := now.at.Sub(first.at).Seconds(); d > 0 {
+			return float64(n-m) / d
+		}
+		return 0
+	}
+	q := Queue{
+		Name:        t.name,
+		Messages:    int(max(now.published-now.acked, 0)),
+		PublishRate: rate(now.published, first.published),
+		AckRate:     rate(now.acked, first.acked),
+	}
+	if t.consumers != nil {
+		q.Consumers = t.consumers()
+	}
+	return []Queue{q}, nil
+}
+
+// HandleResult counts each result before passing it to next.
+func (t *Tracker) HandleResult(next agentproto.ResultHandler) agentproto.ResultHandler {
+	return func(r agentproto.Result) error {
+		t.acked.Add(1)
+		return next(r)
+	}
+}
+
+// Wrap counts the jobs published on q: those the server publishes and
+// those the commander sends on Jobs.
+func (t *Tracker) Wrap(q backend.Queue) backend.Queue {
+	if c, ok := q.(interface{ Consumers() int }); ok {
+		t.consumers = c.Consumers
+	}
+	tq := &trackedQueue{Queue: q, t: t, jobs: make(chan queue.AnalyzeJob)}
+	go tq.forward()
+	return tq
+}
+
+type trackedQueue struct {
+	backend.Queue
+	t    *Tracker
+	jobs chan queue.AnalyzeJob
+}
+
+func (q *trackedQueue) Jobs() chan queue.AnalyzeJob {
+	return q.jobs
+}
+
+func (q *trackedQueue) forward() {
+	for job := range q.jobs {
+		q.t.published.Add(1)
+		q.Queue.Jobs() <- job
+	}
+}
+
+func (q *trackedQueue) Publish(job agentproto.Job) error {
+	if err := q.Queue.Publish(job); err != nil {
+		return err
+	}
+	q.t.published.Add(1)
+	return nil
+}
+
+func (q *trackedQueue) Requeue(job agentproto.Job) error {
+	if err := q.Queue.Requeue(job); err != nil {
+		return err
+	}
+	q.t.published.Add(1)
+	return nil
+}
@@ -0,0 +1,238 @@
+// Package quickquery brokers single-repository "quick query" runs.  A quick
+// query is an ordinary commander session with exactly one job, so it reuses
+// the agents, the query pack store and the database store, but skips the
+// controller repo and status-polling ceremony of a variant analysis.
+package quickquery
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/hohn/mrvacommander/pkg/server"
+	"github.com/hohn/mrvacommander/utils"
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/artifactstream"
+	"mrvaserver/pkg/web"
+)
+
+// maxWait bounds the ?wait= parameter of status requests.
+const maxWait = 5 * time.Minute
+
+// Request is the body of POST /quick-queries.
+type Request struct {
+	Repository string `json:"repository"` // owner/repo
+	Language   string `json:"language"`
+	QueryPack  string `json:"query_pack"` // base64-encoded gzipped tar, as in MRVA submissions
+}
+
+// Status is the response of POST /quick-queries and GET /quick-queries/{id}.
+type Status struct {
+	ID             string `json:"id"`
+	Repository     string `json:"repository"`
+	Language       string `json:"language"`
+	AnalysisStatus string `json:"analysis_status"`
+	ResultCount    int    `json:"result_count"`
+	ResultURL      string `json:"result_url,omitempty"`
+}
+
+type Broker struct {
+	v         *server.Visibles
+	downloads *artifactstream.Server
+}
+
+// NewBroker serves quick queries, their results through downloads.
+func NewBroker(v *server.Visibles, downloads *artifactstream.Server) *Broker {
+	return &Broker{v: v, downloads: downloads}
+}
+
+// Register adds the quick query endpoints to r.
+func (b *Broker) Register(r *mux.Router) {
+	r.HandleFunc("/quick-queries", b.Submit).Methods(http.MethodPost)
+	r.HandleFunc("/quick-queries/{id}", b.Status).Methods(http.MethodGet)
+	r.HandleFunc("/quick-queries/{id}/result", b.Result).Methods(http.MethodGet)
+}
+
+func (b *Broker) Submit(w http.ResponseWriter, r *http.Request) {
+	var req Request
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, fmt.Sprintf("invalid quick query body: %v", err), http.StatusBadRequest)
+		return
+	}
+	owner, repo, ok := strings.Cut(req.Repository, "/")
+	if !ok || owner == "" || repo == "" || strings.Contains(repo, "/") {
+		http.Error(w, "Invalid owner / repository entry", http.StatusBadRequest)
+		return
+	}
+	if req.Language == "" {
+		http.Error(w, "missing language", http.StatusBadRequest)
+		return
+	}
+	if !utils.IsBase64Gzip([]byte(req.QueryPack)) {
+		http.Error(w, "query pack has invalid format", http.StatusBadRequest)
+		return
+	}
+	nwo := common.NameWithOwner{Owner: owner, Repo: repo}
+
+	if _, found := b.v.CodeQLDBStore.FindAvailableDBs([]common.NameWithOwner{nwo}); len(found) == 0 {
+		http.Error(w, fmt.Sprintf("no CodeQL database for %s", req.Repository), http.StatusNotFound)
+		return
+	}
+
+	tgz, err := base64.StdEncoding.DecodeString(req.QueryPack)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	sessionID := b.v.State.NextID()
+	location, err := b.v.Artifacts.SaveQueryPack(sessionID, tgz)
+	if err != nil {
+		slog.Error("Failed to save query pack", "id", sessionID, "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	now := time.Now().Format(time.RFC3339)
+	js := common.JobSpec{SessionID: sessionID, NameWithOwner: nwo}
+	job := queue.AnalyzeJob{
+		Spec:              js,
+		QueryPackLocation: location,
+		QueryLanguage:     queue.QueryLanguage(req.Language),
+	}
+	b.v.State.AddJob(job)
+	b.v.State.SetJobInfo(js, common.JobInfo{QueryLanguage: req.Language, CreatedAt: now, UpdatedAt: now})
+	b.v.State.SetStatus(js, common.StatusQueued)
+	b.v.Queue.Jobs() <- job
+
+	slog.Info("New quick query", "id", sessionID, "repository", req.Repository)
+	st, err := b.status(r, sessionID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusCreated, st)
+}
+
+// Status reports a quick query.  With ?wait=<duration> the request is held
+// until the analysis finishes or the duration elapses.
+func (b *Broker) Status(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseID(w, r)
+	if !ok {
+		return
+	}
+
+	var wait time.Duration
+	if s := r.URL.Query().Get("wait"); s != "" {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid wait: %v", err), http.StatusBadRequest)
+			return
+		}
+		wait = min(d, maxWait)
+	}
+	deadline := time.Now().Add(wait)
+
+	for {
+		st, err := b.status(r, id)
+		if errors.Is(err, errNotQuick) {
+			http.Error(w, err.Error(), http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if api.IsTerminalRepoStatus(st.AnalysisStatus) || time.Now().After(deadline) {
+			web.WriteJSON(w, http.StatusOK, st)
+			return
+		}
+		select {
+		case <-r.Context().Done():
+			return
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Result streams the result archive of a succeeded quick query.
+func (b *Broker) Result(w http.ResponseWriter, r *http.Request) {
+	id, ok := parseID(w, r)
+	if !ok {
+		return
+	}
+	js, err := b.jobSpec(id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusNotFound)
+		return
+	}
+	result, err := b.v.State.GetResult(js)
+	if err != nil {
+		http.Error(w, "result not available", http.StatusNotFound)
+		return
+	}
+	b.downloads.ServeResult(w, r, result.ResultLocation)
+}
+
+var errNotQuick = errors.New("no quick query with that id")
+
+// jobSpec returns the single job of a quick query session.
+func (b *Broker) jobSpec(id int) (common.JobSpec, error) {
+	jobs, err := b.v.State.GetJobList(id)
+	if err != nil || len(jobs) != 1 {
+		return common.JobSpec{}, errNotQuick
+	}
+	return jobs[0].Spec, nil
+}
+
+func (b *Broker) status(r *http.Request, id int) (Status, error) {
+	js, err := b.jobSpec(id)
+	if err != nil {
+		return Status{}, err
+	}
+	name, err := web.SessionName(r.Context(), id)
+	if err != nil {
+		return Status{}, err
+	}
+	st := Status{
+		ID:         name,
+		Repository: fmt.Sprintf("%s/%s", js.Owner, js.Repo),
+	}
+	if ji, err := b.v.State.GetJobInfo(js); err == nil {
+		st.Language = ji.QueryLanguage
+	}
+
+	status, err := b.v.State.GetStatus(js)
+	if err != nil {
+		return Status{}, err
+	}
+	st.AnalysisStatus = api.RepoStatus(status)
+	if status == common.StatusSuccess {
+		result, err := b.v.State.GetResult(js)
+		if err != nil {
+			return Status{}, err
+		}
+		st.ResultCount = result.ResultCount
+		st.ResultURL = fmt.Sprintf("%s/quick-queries/%s/result", web.ExternalBase(r), name)
+	}
+	return st, nil
+}
+
+func parseID(w http.ResponseWriter, r *http.Request) (int, bool) {
+	raw := mux.Vars(r)["id"]
+	id, err := strconv.Atoi(raw)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("quick query ID %q is not an integer", raw), http.StatusBadRequest)
+		return 0, false
+	}
+	return id, true
+}
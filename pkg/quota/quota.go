@@ -0,0 +1,111 @@
+// Package quota limits users by the quotas declared for them as
+// resources (see package resources).  A quota names a user, an identity
+// as web.Identity gives it and /admin/usage lists it, and bounds the
+// repositories of each of the user's submissions and the artifact storage
+// the user's sessions take.  Where several quotas name a user, the lowest
+// of each limit applies; a limit left out or zero does not apply.
+//
+// The repository limit bounds submissions further than
+// sessions.max_repositories, which still applies to everyone.  The
+// storage limit replaces usage.user_cap for the user, and like it needs
+// usage accounting.
+package quota
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/resources"
+	"mrvaserver/pkg/web"
+)
+
+// Kind is the kind of quotas.
+const Kind = "quotas"
+
+// Spec is a declared quota.
+type Spec struct {
+	User            string `json:"user"`
+	MaxRepositories int    `json:"max_repositories,omitempty"`
+	StorageBytes    int64  `json:"storage_bytes,omitempty"`
+}
+
+func check(id string, spec *Spec) error {
+	switch {
+	case spec.User == "" || strings.TrimSpace(spec.User) != spec.User:
+		return fmt.Errorf("user is required, without surrounding spaces")
+	case spec.MaxRepositories < 0 || spec.StorageBytes < 0:
+		return fmt.Errorf("limits must not be negative")
+	}
+	return nil
+}
+
+type Quotas struct {
+	resources *resources.Registry
+}
+
+// New defines the quota kind in reg.
+func New(reg *resources.Registry) *Quotas {
+	reg.Define(resources.NewKind(Kind, "Per-user limits on submissions and artifact storage.", check))
+	return &Quotas{resources: reg}
+}
+
+// For returns the limits that apply to user, and whether any quota names
+// the user.
+func (q *Quotas) For(ctx context.Context, user string) (Spec, bool, error) {
+	specs, err := resources.Specs[Spec](ctx, q.resources, Kind)
+	if err != nil {
+		return Spec{}, false, err
+	}
+	out, found := Spec{User: user}, false
+	for _, s := range specs {
+		if s.User != user {
+			continue
+		}
+		found = true
+		out.MaxRepositories = lowest(out.MaxRepositories, s.MaxRepositories)
+		out.StorageBytes = lowest(out.StorageBytes, s.StorageBytes)
+	}
+	return out, found, nil
+}
+
+// lowest is the lower of two limits, zero being none.
+func lowest[T int | int64](a, b T) T {
+	if a == 0 || b != 0 && b < a {
+		return b
+	}
+	return a
+}
+
+// StorageCap is the storage limit of user, if a quota sets one.  Quotas
+// that cannot be read set none.
+func (q *Quotas) StorageCap(ctx context.Context, user string) (int64, bool) {
+	s, _, err := q.For(ctx, user)
+	if err != nil || s.StorageBytes == 0 {
+		return 0, false
+	}
+	return s.StorageBytes, true
+}
+
+// SubmitHook rejects submissions of more repositories than the
+// submitter's quota allows.  It must run after the hooks that add or drop
+// repositories.
+func (q *Quotas) SubmitHook(r *http.Request, sub *gateway.Submission) error {
+	user := web.Identity(r)
+	s, found, err := q.For(r.Context(), user)
+	if err != nil {
+		return web.Errorf(http.StatusServiceUnavailable, "failed to read quotas: %v", err)
+	}
+	if !found || s.MaxRepositories == 0 {
+		return nil
+	}
+	if n := len(sub.Msg.Repositories); n > s.MaxRepositories {
+		return web.Msg(http.StatusBadRequest, apierr.QuotaExceeded, "quota.too_many_repositories",
+			messages.Params{"n": n, "max": s.MaxRepositories, "user": user})
+	}
+	return nil
+}
@@ -0,0 +1,30 @@
+package rabbitmq
+
+import (
+	"encoding/json"
+	"log/slog"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"mrvaserver/pkg/agentproto"
+)
+
+// ConsumeAgents starts consuming the registrations agents send.  They are
+// status reports, so failures to apply one are logged and the message
+// dropped; the agent sends another soon.
+func (q *Queue) ConsumeAgents(handler func(agentproto.AgentInfo) error) error {
+	return q.subscribe(consumer{
+		tag:     "mrvaserver-agents",
+		queue:   agentproto.AgentsQueueName,
+		autoAck: true,
+		handle: func(msg amqp.Delivery) {
+			var info agentproto.AgentInfo
+			if err := json.Unmarshal(msg.Body, &info); err != nil {
+				slog.Error("Failed to unmarshal agent info", slog.Any("error", err))
+				return
+			}
+			if err := handler(info); err != nil {
+				slog.Warn("Failed to record agent info", "agent", info.Agent, "error", err)
+			}
+		},
+	})
+}
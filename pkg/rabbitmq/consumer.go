@@ -0,0 +1,94 @@
+package rabbitmq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/quarantine"
+)
+
+var forgedResults = metrics.NewCounter("mrvaserver_results_unverified_total",
+	"Results dropped for a missing or invalid signature.")
+
+// consumeResults starts pool.Consumers consumers, each on its own channel
+// with a prefetch of pool.Prefetch, feeding pool.Concurrency workers.
+func (q *Queue) consumeResults(ctx context.Context) error {
+	deliveries := make(chan amqp.Delivery)
+
+	for i := 0; i < q.pool.Consumers; i++ {
+		err := q.subscribe(consumer{
+			tag:      fmt.Sprintf("mrvaserver-results-%d", i),
+			queue:    resultsQueueName,
+			prefetch: q.pool.Prefetch,
+			handle: func(msg amqp.Delivery) {
+				select {
+				case deliveries <- msg:
+				case <-ctx.Done():
+					msg.Nack(false, true)
+				}
+			},
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	for i := 0; i < q.pool.Concurrency; i++ {
+		q.wg.Add(1)
+		go func() {
+			defer q.wg.Done()
+			for {
+				select {
+				case msg := <-deliveries:
+					q.handleResult(msg)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	return nil
+}
+
+func (q *Queue) handleResult(msg amqp.Delivery) {
+	var result agentproto.Result
+	if err := json.Unmarshal(msg.Body, &result); err != nil {
+		slog.Error("Failed to unmarshal result", slog.Any("error", err))
+		q.poison(resultsQueueName, msg, 0, quarantine.ReasonDecode, err)
+		return
+	}
+	slog.Debug("Result consumed", "spec", result.Spec, "status", result.Status.ToExternalString())
+	if v := q.verifier.Load(); v != nil {
+		signer, err := v.Verify(msg.Body, msg.Headers)
+		if err == nil && signer != result.Agent {
+			err = fmt.Errorf("result of agent %q is signed by %q", result.Agent, signer)
+		}
+		if err != nil {
+			forgedResults.Inc()
+			slog.Error("Dropping result that fails signature verification", "spec", result.Spec,
+				"agent", result.Agent, "error", err)
+			q.poison(resultsQueueName, msg, 0, quarantine.ReasonInvalid, err)
+			return
+		}
+	}
+
+	if q.handler == nil {
+		q.results <- result.AnalyzeResult
+		msg.Ack(false)
+		return
+	}
+	if err := q.handler(result); err != nil {
+		slog.Error("Failed to apply result", "spec", result.Spec, "error", err)
+		q.failed(resultsQueueName, msg, err)
+		return
+	}
+	q.forget(msg)
+	if err := msg.Ack(false); err != nil {
+		slog.Error("Failed to acknowledge result consumption message", slog.Any("error", err))
+	}
+}
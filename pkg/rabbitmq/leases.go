@@ -0,0 +1,41 @@
+package rabbitmq
+
+import (
+	"encoding/json"
+	"log/slog"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/quarantine"
+)
+
+// ConsumeLeases starts consuming agents' lease messages and advertises ttl
+// as the lease duration on jobs published from now on.
+func (q *Queue) ConsumeLeases(ttl time.Duration, handler func(agentproto.LeaseMessage) error) error {
+	err := q.subscribe(consumer{
+		tag:      "mrvaserver-leases",
+		queue:    agentproto.LeasesQueueName,
+		prefetch: q.pool.Prefetch,
+		handle: func(msg amqp.Delivery) {
+			var lm agentproto.LeaseMessage
+			if err := json.Unmarshal(msg.Body, &lm); err != nil {
+				slog.Error("Failed to unmarshal lease message", slog.Any("error", err))
+				q.poison(agentproto.LeasesQueueName, msg, 0, quarantine.ReasonDecode, err)
+				return
+			}
+			if err := handler(lm); err != nil {
+				slog.Error("Failed to apply lease message", "job", lm.Spec, "error", err)
+				q.failed(agentproto.LeasesQueueName, msg, err)
+				return
+			}
+			q.forget(msg)
+			msg.Ack(false)
+		},
+	})
+	if err != nil {
+		return err
+	}
+	q.leaseTTL.Store(int64(ttl.Seconds()))
+	return nil
+}
@@ -0,0 +1,117 @@
+package rabbitmq
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"mrvaserver/pkg/netaddr"
+	"mrvaserver/pkg/queuestats"
+)
+
+const (
+	managementPort    = "15672"
+	managementTimeout = 10 * time.Second
+)
+
+// managementColumns are the fields of GET /api/queues the figures need.
+var managementColumns = strings.Join([]string{
+	"name", "type", "state", "messages", "messages_ready", "messages_unacknowledged", "consumers",
+	"message_stats.publish_details.rate", "message_stats.deliver_get_details.rate",
+	"message_stats.ack_details.rate",
+}, ",")
+
+// Management reads the queues' figures from the broker's management API.
+type Management struct {
+	base           *url.URL
+	user, password string
+	client         *http.Client
+}
+
+// NewManagement reads the figures from the management API at rawURL, or
+// from port 15672 of MRVA_RABBITMQ_HOST if it is empty.  Unless the URL
+// carries credentials, the MRVA_RABBITMQ_* ones are used.
+func NewManagement(rawURL string) (*Management, error) {
+	if rawURL == "" {
+		rawURL = "http://" + netaddr.JoinHostPort(os.Getenv("MRVA_RABBITMQ_HOST"), managementPort)
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse management URL: %w", err)
+	}
+	m := &Management{base: u, client: &http.Client{Timeout: managementTimeout}}
+	if u.User != nil {
+		m.user = u.User.Username()
+		m.password, _ = u.User.Password()
+		u.User = nil
+	} else {
+		m.user, m.password = os.Getenv("MRVA_RABBITMQ_USER"), os.Getenv("MRVA_RABBITMQ_PASSWORD")
+	}
+	return m, nil
+}
+
+type managementQueue struct {
+	Name         string `json:"name"`
+	Type         string `json:"type"`
+	State        string `json:"state"`
+	Messages     int    `json:"messages"`
+	Ready        int    `json:"messages_ready"`
+	Unacked      int    `json:"messages_unacknowledged"`
+	Consumers    int    `json:"consumers"`
+	MessageStats struct {
+		Publish    managementRate `json:"publish_details"`
+		DeliverGet managementRate `json:"deliver_get_details"`
+		Ack        managementRate `json:"ack_details"`
+	} `json:"message_stats"`
+}
+
+type managementRate struct {
+	Rate float64 `json:"rate"`
+}
+
+// Queues lists the queues of the default virtual host, by name.
+func (m *Management) Queues(ctx context.Context) ([]queuestats.Queue, error) {
+	// The default virtual host is "/", escaped.
+	u := strings.TrimSuffix(m.base.String(), "/") + "/api/queues/%2F?" +
+		url.Values{"columns": {managementColumns}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.SetBasicAuth(m.user, m.password)
+	resp, err := m.client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to query RabbitMQ management API: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("RabbitMQ management API returned %s", resp.Status)
+	}
+	var mqs []managementQueue
+	if err := json.NewDecoder(resp.Body).Decode(&mqs); err != nil {
+		return nil, fmt.Errorf("failed to decode RabbitMQ management API response: %w", err)
+	}
+	qs := make([]queuestats.Queue, len(mqs))
+	for i, mq := range mqs {
+		qs[i] = queuestats.Queue{
+			Name:        mq.Name,
+			Type:        mq.Type,
+			State:       mq.State,
+			Messages:    mq.Messages,
+			Ready:       mq.Ready,
+			Unacked:     mq.Unacked,
+			Consumers:   mq.Consumers,
+			PublishRate: mq.MessageStats.Publish.Rate,
+			DeliverRate: mq.MessageStats.DeliverGet.Rate,
+			AckRate:     mq.MessageStats.Ack.Rate,
+		}
+	}
+	sort.Slice(qs, func(i, j int) bool { return qs[i].Name < qs[j].Name })
+	return qs, nil
+}
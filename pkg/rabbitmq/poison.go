@@ -0,0 +1,139 @@
+package rabbitmq
+
+import (
+	"context"
+	"crypto/sha256"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"mrvaserver/pkg/quarantine"
+)
+
+// Requeues of messages whose handler failed are delayed, doubling from
+// requeueDelay up to maxRequeueDelay, so that a store outage or a result
+// waiting on its session's key does not use up the deliveries at once.
+const (
+	requeueDelay    = 2 * time.Second
+	maxRequeueDelay = 5 * time.Minute
+)
+
+// SetQuarantine quarantines the results and lease messages that fail to
+// decode or validate, and those whose handler fails on qr.MaxDeliveries
+// deliveries, instead of dropping them or requeueing them for ever.
+func (q *Queue) SetQuarantine(qr *quarantine.Quarantine) {
+	q.quarantine.Store(qr)
+}
+
+// deliveries is how many times msg has been delivered, its handler
+// failing each time before this one.  Quorum queues count deliveries in
+// x-delivery-count; on classic queues the server counts the failures of
+// each body itself.
+func (q *Queue) deliveries(msg amqp.Delivery) int {
+	switch n := msg.Headers["x-delivery-count"].(type) {
+	case int64:
+		return int(n) + 1
+	case int32:
+		return int(n) + 1
+	case int:
+		return n + 1
+	}
+	k := sha256.Sum256(msg.Body)
+	q.failuresMu.Lock()
+	defer q.failuresMu.Unlock()
+	q.failures[k]++
+	return q.failures[k]
+}
+
+// forget drops the failure count of msg, once handled or quarantined.
+func (q *Queue) forget(msg amqp.Delivery) {
+	q.failuresMu.Lock()
+	defer q.failuresMu.Unlock()
+	if len(q.failures) > 0 {
+		delete(q.failures, sha256.Sum256(msg.Body))
+	}
+}
+
+// poison quarantines msg, taken off queue, and acknowledges it.  Without
+// a quarantine msg is dropped; if quarantining it fails, it is requeued.
+func (q *Queue) poison(queue string, msg amqp.Delivery, deliveries int, reason string, cause error) {
+	qr := q.quarantine.Load()
+	if qr == nil {
+		msg.Nack(false, false)
+		return
+	}
+	_, err := qr.Put(context.Background(), queue, msg.Body, msg.ContentType, msg.Headers, deliveries, reason, cause)
+	if err != nil {
+		slog.Error("Failed to quarantine message, requeueing it", "queue", queue, "error", err)
+		msg.Nack(false, true)
+		return
+	}
+	q.forget(msg)
+	msg.Ack(false)
+}
+
+// failed requeues msg, taken off queue, whose handler failed, unless
+// it has failed on as many deliveries as the quarantine allows.  The
+// message is held, unacknowledged, for the backoff before it is requeued.
+func (q *Queue) failed(queue string, msg amqp.Delivery, cause error) {
+	qr := q.quarantine.Load()
+	if qr == nil {
+		requeue(msg, 1)
+		return
+	}
+	n := q.deliveries(msg)
+	if n >= qr.MaxDeliveries() {
+		q.poison(queue, msg, n, quarantine.ReasonHandler, cause)
+		return
+	}
+	requeue(msg, n)
+}
+
+// requeue requeues msg, on its nth failed delivery, after the backoff.
+func requeue(msg amqp.Delivery, n int) {
+	d := requeueDelay
+	for i := 1; i < n && d < maxRequeueDelay; i++ {
+		d *= 2
+	}
+	time.AfterFunc(min(d, maxRequeueDelay), func() {
+		msg.Nack(false, true)
+	})
+}
+
+// brokerHeaders are the headers the broker sets, dropped on redrive.
+// Other x- headers, such as the x-mrva-* signature headers, stay.
+var brokerHeaders = []string{"x-death", "x-delivery-count"}
+
+// Redrive publishes a quarantined message back onto queue, without the
+// headers the broker set.
+func (q *Queue) Redrive(ctx context.Context, queue string, body []byte, contentType string, headers map[string]any) error {
+	publish, err := q.publishChannel()
+	if err != nil {
+		return err
+	}
+	var h amqp.Table
+	for k, v := range headers {
+		if slices.Contains(brokerHeaders, k) || strings.HasPrefix(k, "x-first-death-") ||
+			strings.HasPrefix(k, "x-last-death-") {
+			continue
+		}
+		if h == nil {
+			h = amqp.Table{}
+		}
+		h[k] = v
+	}
+	var mode uint8
+	if q.quorum {
+		mode = amqp.Persistent
+	}
+	ctx, cancel := context.WithTimeout(ctx, publishTimeout)
+	defer cancel()
+	return q.publishConfirmed(ctx, publish, queue, amqp.Publishing{
+		ContentType:  contentType,
+		Headers:      h,
+		DeliveryMode: mode,
+		Body:         body,
+	})
+}
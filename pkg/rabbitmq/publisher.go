@@ -0,0 +1,65 @@
+package rabbitmq
+
+import (
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+// returnBuffer bounds the returned messages waiting for their publishers.
+// The broker's connection blocks while it is full.
+const returnBuffer = 256
+
+// publisher is the publishing channel, in confirm mode.  Jobs are
+// published mandatory, so that the broker returns those no queue takes,
+// say because their queue was deleted, instead of dropping them.  It
+// still confirms them, after returning them.
+type publisher struct {
+	*amqp.Channel
+	returns chan amqp.Return
+
+	mu       sync.Mutex
+	returned map[string]amqp.Return // by message id
+}
+
+var messageIDs atomic.Uint64
+
+func newPublisher(ch *amqp.Channel) *publisher {
+	return &publisher{
+		Channel:  ch,
+		returns:  ch.NotifyReturn(make(chan amqp.Return, returnBuffer)),
+		returned: make(map[string]amqp.Return),
+	}
+}
+
+// nextMessageID is a message id unique to the process, by which returned
+// messages are told apart.
+func nextMessageID() string {
+	return "mrvaserver-" + strconv.FormatUint(messageIDs.Add(1), 10)
+}
+
+// wasReturned reports whether the message with id was returned.  It must
+// be called once the message is confirmed: the broker returns a message
+// before confirming it, so its return is then either buffered or taken
+// by another publisher already.
+func (p *publisher) wasReturned(id string) (amqp.Return, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for drained := false; !drained; {
+		select {
+		case r, ok := <-p.returns:
+			if ok {
+				p.returned[r.MessageId] = r
+			} else {
+				drained = true
+			}
+		default:
+			drained = true
+		}
+	}
+	r, ok := p.returned[id]
+	delete(p.returned, id)
+	return r, ok
+}
@@ -0,0 +1,423 @@
+// Package rabbitmq is the commander-side RabbitMQ queue.  It speaks the same
+// wire format and queue names as mrvacommander's queue.RabbitMQQueue, but
+// consumes results with a pool of consumers and workers instead of a single
+// consumer with a prefetch of one.
+package rabbitmq
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/url"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/hohn/mrvacommander/pkg/state"
+	amqp "github.com/rabbitmq/amqp091-go"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/netaddr"
+	"mrvaserver/pkg/quarantine"
+	"mrvaserver/pkg/signing"
+)
+
+const (
+	resultsQueueName = "results"
+
+	tryCount       = 5
+	retryDelaySec  = 3
+	publishTimeout = 5 * time.Second
+
+	// maxPriority is the priority of preempted jobs on priority queues;
+	// other jobs have priority 0.
+	maxPriority = 9
+)
+
+// StateHandler applies results to st exactly as the commander's own
+// ConsumeResults loop does.
+func StateHandler(st state.ServerState) agentproto.ResultHandler {
+	return func(r agentproto.Result) error {
+		st.SetResult(r.Spec, r.AnalyzeResult)
+		st.SetStatus(r.Spec, r.Status)
+		return nil
+	}
+}
+
+type Queue struct {
+	url string
+
+	// mu guards the connection and publishing channel, which the
+	// supervisor replaces after reconnecting, and the consumers it
+	// restores.
+	mu        sync.Mutex
+	conn      *amqp.Connection
+	publish   *publisher
+	consumers []consumer
+	closing   chan struct{}
+	closeOnce sync.Once
+
+	jobs    chan queue.AnalyzeJob
+	results chan queue.AnalyzeResult
+
+	pool     config.ConsumerPool
+	priority bool
+	quorum   bool
+	handler  agentproto.ResultHandler
+	ctx      context.Context
+	cancel   context.CancelFunc
+	wg       sync.WaitGroup
+
+	// leaseTTL is advertised on published jobs once leases are consumed.
+	leaseTTL atomic.Int64
+
+	quarantine atomic.Pointer[quarantine.Quarantine]
+	failuresMu sync.Mutex
+	failures   map[[sha256.Size]byte]int
+
+	// pools records the pool queues declared so far.
+	pools      sync.Map
+	router     atomic.Value
+	dispatcher atomic.Value
+	sandbox    atomic.Pointer[agentproto.Sandbox]
+	toolchains atomic.Value
+
+	// signer signs published jobs; verifier, if set, checks results'
+	// signatures.
+	signer   atomic.Pointer[signing.Signer]
+	verifier atomic.Pointer[signing.Verifier]
+}
+
+// Dispatcher takes new jobs and routes and publishes them when it sees
+// fit.
+type Dispatcher interface {
+	Enqueue(job agentproto.Job) error
+}
+
+// SetDispatcher hands jobs created from now on to d instead of publishing
+// them at once.
+func (q *Queue) SetDispatcher(d Dispatcher) {
+	q.dispatcher.Store(d)
+}
+
+func jobsQueueArgs(priority, quorum bool) amqp.Table {
+	if !priority || quorum {
+		return nil
+	}
+	return amqp.Table{"x-max-priority": maxPriority}
+}
+
+// declare declares a queue with args, as a durable quorum queue if quorum
+// is set.
+func declare(ch *amqp.Channel, name string, quorum, noWait bool, args amqp.Table) error {
+	if quorum {
+		a := amqp.Table{"x-queue-type": "quorum"}
+		for k, v := range args {
+			a[k] = v
+		}
+		args = a
+	}
+	if _, err := ch.QueueDeclare(name, quorum, false, false, noWait, args); err != nil {
+		return fmt.Errorf("failed to declare %s queue: %w", name, err)
+	}
+	return nil
+}
+
+// Router picks the agent pool a job is published to.
+type Router interface {
+	Route(job queue.AnalyzeJob) string
+}
+
+// SetRouter sets the router used for jobs published from now on.  Without
+// one, jobs go to the tasks queue.
+func (q *Queue) SetRouter(r Router) {
+	q.router.Store(r)
+}
+
+// SetSandbox attaches s to every job published from now on that does not
+// carry a sandbox already.
+func (q *Queue) SetSandbox(s agentproto.Sandbox) {
+	q.sandbox.Store(&s)
+}
+
+// Toolchains picks the toolchain a job runs with.
+type Toolchains interface {
+	Toolchain(job queue.AnalyzeJob) *agentproto.Toolchain
+}
+
+// SetToolchains tags every job published from now on that does not carry
+// a toolchain already with the one t picks.
+func (q *Queue) SetToolchains(t Toolchains) {
+	q.toolchains.Store(t)
+}
+
+// SetSigning signs jobs published from now on with s and, if v is not
+// nil, drops results not signed by their agent.
+func (q *Queue) SetSigning(s *signing.Signer, v *signing.Verifier) {
+	q.signer.Store(s)
+	q.verifier.Store(v)
+}
+
+// affinityRouter is a Router that can also pick an agent of the pool to
+// publish to, and how long the job may wait for it.
+type affinityRouter interface {
+	Affinity(job queue.AnalyzeJob, pool string) (string, time.Duration)
+}
+
+func (q *Queue) route(job queue.AnalyzeJob) string {
+	if r, ok := q.router.Load().(Router); ok {
+		return r.Route(job)
+	}
+	return ""
+}
+
+// Init connects using the MRVA_RABBITMQ_* environment variables, the same
+// ones deploy.InitRabbitMQ reads.
+func Init(cfg config.Queue, handler agentproto.ResultHandler) (*Queue, error) {
+	url, err := URLFromEnv()
+	if err != nil {
+		return nil, err
+	}
+	return New(url, cfg, handler)
+}
+
+// URLFromEnv is the broker URL given by the MRVA_RABBITMQ_* environment
+// variables.  The host may be an IPv6 literal, bracketed or not.
+func URLFromEnv() (string, error) {
+	for _, key := range []string{"MRVA_RABBITMQ_HOST", "MRVA_RABBITMQ_PORT", "MRVA_RABBITMQ_USER", "MRVA_RABBITMQ_PASSWORD"} {
+		if _, ok := os.LookupEnv(key); !ok {
+			return "", fmt.Errorf("missing required environment variable %s", key)
+		}
+	}
+	port, err := strconv.Atoi(os.Getenv("MRVA_RABBITMQ_PORT"))
+	if err != nil {
+		return "", fmt.Errorf("failed to parse RabbitMQ port: %v", err)
+	}
+	u := url.URL{
+		Scheme: "amqp",
+		User:   url.UserPassword(os.Getenv("MRVA_RABBITMQ_USER"), os.Getenv("MRVA_RABBITMQ_PASSWORD")),
+		Host:   netaddr.JoinHostPort(os.Getenv("MRVA_RABBITMQ_HOST"), strconv.Itoa(port)),
+		Path:   "/",
+	}
+	return u.String(), nil
+}
+
+// New connects to the broker at url.  If handler is nil, results are
+// delivered on Results() for the commander's own consumer loop.  A lost
+// connection is re-established in the background, and the queues and
+// consumers restored.
+func New(url string, cfg config.Queue, handler agentproto.ResultHandler) (*Queue, error) {
+	conn, err := dial(url)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Connected to RabbitMQ")
+	ch, err := setup(conn, cfg.Priority, cfg.Quorum)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	q := &Queue{
+		url:      url,
+		conn:     conn,
+		publish:  newPublisher(ch),
+		closing:  make(chan struct{}),
+		jobs:     make(chan queue.AnalyzeJob),
+		results:  make(chan queue.AnalyzeResult),
+		pool:     cfg.Results,
+		priority: cfg.Priority,
+		quorum:   cfg.Quorum,
+		failures: make(map[[sha256.Size]byte]int),
+		handler:  handler,
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	connected.Set(1)
+	go q.supervise()
+
+	slog.Info("Starting jobs publisher")
+	go q.publishJobs()
+
+	slog.Info("Starting results consumers", "consumers", cfg.Results.Consumers,
+		"prefetch", cfg.Results.Prefetch, "concurrency", cfg.Results.Concurrency)
+	if err := q.consumeResults(ctx); err != nil {
+		q.Close()
+		return nil, err
+	}
+	return q, nil
+}
+
+func (q *Queue) Jobs() chan queue.AnalyzeJob {
+	return q.jobs
+}
+
+func (q *Queue) Results() chan queue.AnalyzeResult {
+	return q.results
+}
+
+// StopConsuming stops taking results off the queue and returns once the
+// results already taken have been handled.  Jobs can still be published.
+func (q *Queue) StopConsuming() {
+	q.cancel()
+	q.wg.Wait()
+}
+
+// Close stops the consumers, waits for in-flight results and disconnects.
+func (q *Queue) Close() {
+	q.StopConsuming()
+	q.closeOnce.Do(func() { close(q.closing) })
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.publish.Close()
+	q.conn.Close()
+}
+
+func (q *Queue) publishJobs() {
+	for job := range q.jobs {
+		j := agentproto.Job{
+			AnalyzeJob:      job,
+			Attempt:         1,
+			LeaseTTLSeconds: int(q.leaseTTL.Load()),
+		}
+		var err error
+		if d, ok := q.dispatcher.Load().(Dispatcher); ok {
+			err = d.Enqueue(j)
+		} else {
+			j.Pool = q.route(job)
+			err = q.Publish(j)
+		}
+		if err != nil {
+			slog.Error("Failed to publish job", "job", job.Spec, "error", err)
+		}
+	}
+}
+
+// Requeue publishes job directly, for jobs dispatched again by the server
+// rather than submitted through the commander.  A job without a pool is
+// routed again.
+func (q *Queue) Requeue(job agentproto.Job) error {
+	if job.Pool == "" {
+		job.Pool = q.route(job.AnalyzeJob)
+	}
+	return q.Publish(job)
+}
+
+// Publish publishes job on its pool's queue and waits for the broker to
+// confirm it.  A job the router sends to a particular agent goes to that
+// agent's queue instead.  A job no queue takes is an error, not dropped.
+func (q *Queue) Publish(job agentproto.Job) error {
+	publish, err := q.publishChannel()
+	if err != nil {
+		return err
+	}
+	name := agentproto.PoolQueueName(job.Pool)
+	if _, ok := q.pools.Load(name); !ok && name != agentproto.TasksQueueName {
+		if err := declare(publish.Channel, name, q.quorum, true, jobsQueueArgs(q.priority, q.quorum)); err != nil {
+			return err
+		}
+		q.pools.Store(name, true)
+	}
+	if r, ok := q.router.Load().(affinityRouter); ok && job.Agent == "" && !job.Preempted {
+		if agent, wait := r.Affinity(job.AnalyzeJob, job.Pool); agent != "" {
+			if err := q.declareAgentQueue(agent, name, wait); err != nil {
+				slog.Warn("Failed to declare agent queue, using the pool's", "agent", agent, "error", err)
+			} else {
+				job.Agent = agent
+				name = agentproto.AgentQueueName(agent)
+			}
+		}
+	}
+
+	if s := q.sandbox.Load(); s != nil && job.Sandbox == nil {
+		job.Sandbox = s
+	}
+	if t, ok := q.toolchains.Load().(Toolchains); ok && job.Toolchain == nil {
+		job.Toolchain = t.Toolchain(job.AnalyzeJob)
+	}
+
+	body, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("failed to marshal job: %w", err)
+	}
+	var priority uint8
+	if q.priority && job.Preempted {
+		priority = maxPriority
+	}
+	var mode uint8
+	if q.quorum {
+		mode = amqp.Persistent
+	}
+
+	var headers amqp.Table
+	if s := q.signer.Load(); s != nil {
+		headers = s.Headers(body)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), publishTimeout)
+	defer cancel()
+
+	slog.Debug("Publishing job", slog.String("job", string(body)))
+	return q.publishConfirmed(ctx, publish, name, amqp.Publishing{
+		ContentType:  "application/json",
+		Headers:      headers,
+		DeliveryMode: mode,
+		Body:         body,
+		Priority:     priority,
+	})
+}
+
+// publishConfirmed publishes msg on queue name, mandatory, and waits for
+// the broker to confirm it.
+func (q *Queue) publishConfirmed(ctx context.Context, publish *publisher, name string, msg amqp.Publishing) error {
+	msg.MessageId = nextMessageID()
+	confirm, err := publish.PublishWithDeferredConfirmWithContext(ctx, "", name, true, false, msg)
+	if err != nil {
+		return err
+	}
+	ok, err := confirm.WaitContext(ctx)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return fmt.Errorf("broker nacked message")
+	}
+	if r, returned := publish.wasReturned(msg.MessageId); returned {
+		unroutable.Inc()
+		// The queue is gone: declare it again on the next attempt.
+		q.pools.Delete(name)
+		return fmt.Errorf("broker returned message unroutable to %s queue: %s", name, r.ReplyText)
+	}
+	return nil
+}
+
+// declareAgentQueue declares an agent's own queue, whose jobs move to the
+// pool's queue after wait.  It uses a channel of its own, since a failed
+// declaration, say because the agent moved to another pool, closes it.
+func (q *Queue) declareAgentQueue(agent, poolQueue string, wait time.Duration) error {
+	name := agentproto.AgentQueueName(agent)
+	if declared, ok := q.pools.Load(name); ok && declared == poolQueue {
+		return nil
+	}
+	ch, err := q.connection().Channel()
+	if err != nil {
+		return err
+	}
+	defer ch.Close()
+	args := amqp.Table{
+		"x-message-ttl":             wait.Milliseconds(),
+		"x-dead-letter-exchange":    "",
+		"x-dead-letter-routing-key": poolQueue,
+	}
+	if err := declare(ch, name, q.quorum, false, args); err != nil {
+		return err
+	}
+	q.pools.Store(name, poolQueue)
+	return nil
+}
@@ -0,0 +1,240 @@
+package rabbitmq
+
+import (
+	"fmt"
+	"log/slog"
+	"time"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/metrics"
+)
+
+// Reconnection backoff bounds.
+const (
+	reconnectMin = time.Second
+	reconnectMax = 30 * time.Second
+)
+
+var (
+	reconnects = metrics.NewCounter("mrvaserver_rabbitmq_reconnects_total",
+		"Connections to RabbitMQ re-established after being lost.")
+	connected = metrics.NewGauge("mrvaserver_rabbitmq_connected",
+		"Whether the server is connected to RabbitMQ.")
+	unroutable = metrics.NewCounter("mrvaserver_rabbitmq_unroutable_total",
+		"Messages the broker returned because no queue took them.")
+)
+
+// consumer is a subscription to a queue, restored on a new channel
+// whenever its channel or the connection is lost.
+type consumer struct {
+	tag      string
+	queue    string
+	prefetch int // 0 leaves QoS alone
+	autoAck  bool
+	handle   func(amqp.Delivery)
+}
+
+// dial connects to the broker, trying tryCount times.
+func dial(url string) (*amqp.Connection, error) {
+	var conn *amqp.Connection
+	var err error
+	for i := 0; i < tryCount; i++ {
+		slog.Info("Attempting to connect to RabbitMQ", slog.Int("attempt", i+1))
+		conn, err = amqp.Dial(url)
+		if err == nil {
+			return conn, nil
+		}
+		slog.Warn("Failed to connect to RabbitMQ", "error", err)
+		if i < tryCount-1 {
+			time.Sleep(retryDelaySec * time.Second)
+		}
+	}
+	return nil, fmt.Errorf("failed to connect: %w", err)
+}
+
+// setup declares the server's queues on a new connection and opens the
+// publishing channel, in confirm mode.
+func setup(conn *amqp.Connection, priority, quorum bool) (*amqp.Channel, error) {
+	ch, err := conn.Channel()
+	if err != nil {
+		return nil, fmt.Errorf("failed to open a channel: %w", err)
+	}
+	for _, name := range []string{resultsQueueName, agentproto.LeasesQueueName, agentproto.AgentsQueueName} {
+		if err := declare(ch, name, quorum, true, nil); err != nil {
+			return nil, err
+		}
+	}
+	if err := declare(ch, agentproto.TasksQueueName, quorum, true, jobsQueueArgs(priority, quorum)); err != nil {
+		return nil, err
+	}
+	if err := ch.Confirm(false); err != nil {
+		return nil, fmt.Errorf("failed to enable publisher confirms: %w", err)
+	}
+	return ch, nil
+}
+
+// connection returns the current connection.
+func (q *Queue) connection() *amqp.Connection {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	return q.conn
+}
+
+// publishChannel returns the publishing channel, opening a new one if a
+// channel error closed it.
+func (q *Queue) publishChannel() (*publisher, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.publish.IsClosed() || q.conn.IsClosed() {
+		return q.publish, nil
+	}
+	ch, err := q.conn.Channel()
+	if err == nil {
+		err = ch.Confirm(false)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to reopen publishing channel: %w", err)
+	}
+	q.publish = newPublisher(ch)
+	return q.publish, nil
+}
+
+// subscribe starts c and restores it after reconnecting.
+func (q *Queue) subscribe(c consumer) error {
+	if err := q.consume(q.connection(), c); err != nil {
+		return err
+	}
+	q.mu.Lock()
+	q.consumers = append(q.consumers, c)
+	q.mu.Unlock()
+	return nil
+}
+
+// consume runs c on a new channel of conn.  If the channel closes while
+// conn stays open, say because the broker cancelled the consumer, c starts
+// again on another; if conn closes, the supervisor restores it.
+func (q *Queue) consume(conn *amqp.Connection, c consumer) error {
+	ch, err := conn.Channel()
+	if err != nil {
+		return fmt.Errorf("failed to open %s channel: %w", c.tag, err)
+	}
+	if c.prefetch > 0 {
+		if err := ch.Qos(c.prefetch, 0, false); err != nil {
+			ch.Close()
+			return fmt.Errorf("failed to set QoS: %w", err)
+		}
+	}
+	msgs, err := ch.Consume(c.queue, c.tag, c.autoAck, false, false, false, nil)
+	if err != nil {
+		ch.Close()
+		return fmt.Errorf("failed to register %s consumer: %w", c.tag, err)
+	}
+	closed := ch.NotifyClose(make(chan *amqp.Error, 1))
+
+	q.wg.Add(1)
+	go func() {
+		defer q.wg.Done()
+		for msg := range msgs {
+			c.handle(msg)
+		}
+		q.restart(conn, c)
+	}()
+	// Cancelling consumption closes msgs, which ends the loop above.
+	go func() {
+		select {
+		case <-q.ctx.Done():
+			ch.Cancel(c.tag, false)
+		case <-closed:
+		}
+	}()
+	return nil
+}
+
+// restart restarts a consumer whose channel of conn closed.
+func (q *Queue) restart(conn *amqp.Connection, c consumer) {
+	for delay := reconnectMin; ; delay = min(2*delay, reconnectMax) {
+		if q.ctx.Err() != nil || conn.IsClosed() {
+			return
+		}
+		slog.Warn("RabbitMQ consumer channel closed, restarting it", "consumer", c.tag)
+		select {
+		case <-q.ctx.Done():
+			return
+		case <-time.After(delay):
+		}
+		err := q.consume(conn, c)
+		if err == nil {
+			return
+		}
+		slog.Warn("Failed to restart RabbitMQ consumer", "consumer", c.tag, "error", err)
+	}
+}
+
+// supervise reconnects when the connection is lost, with backoff,
+// declares the queues again and restores the consumers, until Close.
+func (q *Queue) supervise() {
+	for {
+		conn := q.connection()
+		closed := conn.NotifyClose(make(chan *amqp.Error, 1))
+		select {
+		case <-q.closing:
+			return
+		case err := <-closed:
+			select {
+			case <-q.closing:
+				return
+			default:
+			}
+			connected.Set(0)
+			slog.Error("Lost connection to RabbitMQ, reconnecting", "error", err)
+		}
+
+		for delay := reconnectMin; ; delay = min(2*delay, reconnectMax) {
+			conn, err := amqp.Dial(q.url)
+			if err == nil {
+				var ch *amqp.Channel
+				if ch, err = setup(conn, q.priority, q.quorum); err == nil {
+					q.mu.Lock()
+					q.conn, q.publish = conn, newPublisher(ch)
+					q.mu.Unlock()
+					break
+				}
+				conn.Close()
+			}
+			slog.Warn("Failed to reconnect to RabbitMQ", "error", err, "retry_in", delay)
+			select {
+			case <-q.closing:
+				return
+			case <-time.After(delay):
+			}
+		}
+		// Pool and agent queues are declared again as jobs are published.
+		q.pools.Range(func(k, _ any) bool {
+			q.pools.Delete(k)
+			return true
+		})
+
+		conn = q.connection()
+		q.mu.Lock()
+		consumers := append([]consumer(nil), q.consumers...)
+		q.mu.Unlock()
+		if q.ctx.Err() == nil {
+			for _, c := range consumers {
+				if err := q.consume(conn, c); err != nil {
+					slog.Error("Failed to restore RabbitMQ consumer", "consumer", c.tag, "error", err)
+					go q.restart(conn, c)
+				}
+			}
+		}
+		reconnects.Inc()
+		connected.Set(1)
+		slog.Info("Reconnected to RabbitMQ", "consumers", len(consumers))
+	}
+}
+
+// ResetConnections closes the connection to the broker, so that the
+// supervisor dials it again, for when its address changed.
+func (q *Queue) ResetConnections() {
+	q.connection().Close()
+}
@@ -0,0 +1,56 @@
+// Package readonly serves the parts of a read-only replica that differ
+// from a writer's: it refuses requests that would change anything, and
+// stands in for the job queue, which it neither consumes nor publishes
+// to.  Such a replica reads the state and metadata from databases that
+// may be read replicas, so its answers lag the writer's by their
+// replication delay.
+package readonly
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/web"
+)
+
+// ErrReadOnly is returned for jobs published on a read-only replica.
+var ErrReadOnly = errors.New("replica is read-only")
+
+// Middleware refuses the requests other than GET, HEAD and OPTIONS, except
+// those to the paths in allow, which change only the replica itself.
+func Middleware(allow ...string) func(http.Handler) http.Handler {
+	allowed := make(map[string]bool, len(allow))
+	for _, p := range allow {
+		allowed[p] = true
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+			default:
+				if !allowed[r.URL.Path] {
+					w.Header().Set("Allow", "GET, HEAD, OPTIONS")
+					web.Fail(w, web.Msg(http.StatusMethodNotAllowed, apierr.Forbidden, "readonly.refused",
+						messages.Params{"method": r.Method}), http.StatusMethodNotAllowed)
+					return
+				}
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// Queue is the job queue of a read-only replica.  Its channels are nil,
+// so the commander never receives a result from it.
+type Queue struct{}
+
+func (Queue) Jobs() chan queue.AnalyzeJob       { return nil }
+func (Queue) Results() chan queue.AnalyzeResult { return nil }
+func (Queue) Close()                            {}
+func (Queue) Publish(job agentproto.Job) error  { return ErrReadOnly }
+func (Queue) Requeue(job agentproto.Job) error  { return ErrReadOnly }
+func (Queue) StopConsuming()                    {}
@@ -0,0 +1,260 @@
+// Package redis is a minimal Redis client: the handful of commands the
+// server's caches need, spoken over RESP on a small connection pool.
+package redis
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// ErrNil is returned by Get for a missing key.
+var ErrNil = errors.New("redis: nil")
+
+const dialTimeout = 5 * time.Second
+
+type Client struct {
+	addr     string
+	password string
+	db       int
+	timeout  time.Duration
+	idle     chan *conn
+
+	// gen counts resets; connections from before the last one are not
+	// kept.
+	gen atomic.Int64
+}
+
+type conn struct {
+	c   net.Conn
+	r   *bufio.Reader
+	gen int64
+}
+
+// FromEnv returns a client for MRVA_REDIS_ADDR (host:port), authenticating
+// with MRVA_REDIS_PASSWORD and selecting MRVA_REDIS_DB if they are set.
+func FromEnv() (*Client, error) {
+	addr := os.Getenv("MRVA_REDIS_ADDR")
+	if addr == "" {
+		return nil, fmt.Errorf("missing required environment variable MRVA_REDIS_ADDR")
+	}
+	db := 0
+	if v := os.Getenv("MRVA_REDIS_DB"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid MRVA_REDIS_DB: %w", err)
+		}
+		db = n
+	}
+	c := New(addr, os.Getenv("MRVA_REDIS_PASSWORD"), db)
+	if _, err := c.do("PING"); err != nil {
+		return nil, fmt.Errorf("failed to connect to redis: %w", err)
+	}
+	return c, nil
+}
+
+// New returns a client for addr.  Connections are opened on demand and up
+// to 16 are kept idle.
+func New(addr, password string, db int) *Client {
+	return &Client{
+		addr:     addr,
+		password: password,
+		db:       db,
+		timeout:  time.Second,
+		idle:     make(chan *conn, 16),
+	}
+}
+
+func (c *Client) Get(key string) ([]byte, error) {
+	v, err := c.do("GET", key)
+	if err != nil {
+		return nil, err
+	}
+	if v == nil {
+		return nil, ErrNil
+	}
+	return v.([]byte), nil
+}
+
+// Set stores value under key, expiring after ttl if it is positive.
+func (c *Client) Set(key string, value []byte, ttl time.Duration) error {
+	args := []any{"SET", key, value}
+	if ttl > 0 {
+		args = append(args, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	}
+	_, err := c.do(args...)
+	return err
+}
+
+func (c *Client) Del(keys ...string) error {
+	args := []any{"DEL"}
+	for _, k := range keys {
+		args = append(args, k)
+	}
+	_, err := c.do(args...)
+	return err
+}
+
+// Close closes the idle connections.
+func (c *Client) Close() {
+	for {
+		select {
+		case cn := <-c.idle:
+			cn.c.Close()
+		default:
+			return
+		}
+	}
+}
+
+// ResetConnections closes the idle connections, and those in use once
+// they are done, so that new ones dial addr again.
+func (c *Client) ResetConnections() {
+	c.gen.Add(1)
+	c.Close()
+}
+
+// Addr returns the server's address.
+func (c *Client) Addr() string {
+	return c.addr
+}
+
+func (c *Client) get() (*conn, error) {
+	select {
+	case cn := <-c.idle:
+		return cn, nil
+	default:
+	}
+	gen := c.gen.Load()
+	nc, err := net.DialTimeout("tcp", c.addr, dialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	cn := &conn{c: nc, r: bufio.NewReader(nc), gen: gen}
+	if c.password != "" {
+		if _, err := cn.do(c.timeout, "AUTH", c.password); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	if c.db != 0 {
+		if _, err := cn.do(c.timeout, "SELECT", strconv.Itoa(c.db)); err != nil {
+			nc.Close()
+			return nil, err
+		}
+	}
+	return cn, nil
+}
+
+func (c *Client) put(cn *conn) {
+	if cn.gen != c.gen.Load() {
+		cn.c.Close()
+		return
+	}
+	select {
+	case c.idle <- cn:
+	default:
+		cn.c.Close()
+	}
+}
+
+func (c *Client) do(args ...any) (any, error) {
+	cn, err := c.get()
+	if err != nil {
+		return nil, err
+	}
+	v, err := cn.do(c.timeout, args...)
+	var rerr respError
+	if err != nil && !errors.As(err, &rerr) {
+		// The connection may be mid-reply; don't reuse it.
+		cn.c.Close()
+		return nil, err
+	}
+	c.put(cn)
+	return v, err
+}
+
+type respError string
+
+func (e respError) Error() string { return "redis: " + string(e) }
+
+func (cn *conn) do(timeout time.Duration, args ...any) (any, error) {
+	cn.c.SetDeadline(time.Now().Add(timeout))
+
+	buf := fmt.Appendf(nil, "*%d\r\n", len(args))
+	for _, a := range args {
+		var b []byte
+		switch a := a.(type) {
+		case string:
+			b = []byte(a)
+		case []byte:
+			b = a
+		default:
+			panic(fmt.Sprintf("redis: unsupported argument type %T", a))
+		}
+		buf = fmt.Appendf(buf, "$%d\r\n", len(b))
+		buf = append(buf, b...)
+		buf = append(buf, '\r', '\n')
+	}
+	if _, err := cn.c.Write(buf); err != nil {
+		return nil, err
+	}
+	return cn.read()
+}
+
+// read parses one reply.  Bulk strings are []byte, a nil bulk string is
+// nil, integers are int64 and arrays are []any.
+func (cn *conn) read() (any, error) {
+	line, err := cn.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 {
+		return nil, fmt.Errorf("redis: malformed reply %q", line)
+	}
+	body := line[1 : len(line)-2]
+	switch line[0] {
+	case '+':
+		return body, nil
+	case '-':
+		return nil, respError(body)
+	case ':':
+		return strconv.ParseInt(body, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(cn.r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(body)
+		if err != nil {
+			return nil, err
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = cn.read(); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unknown reply type %q", line[0])
+	}
+}
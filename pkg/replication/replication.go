@@ -0,0 +1,182 @@
+// Package replication copies artifacts to a secondary S3/MinIO endpoint for
+// disaster recovery.  Results are queued for copying as soon as they are
+// ingested; a periodic reconciliation pass compares the buckets and copies
+// whatever the fast path missed, then reports how far behind the secondary
+// is.  Results are only written once a repository's analysis has finished,
+// so the secondary never holds partial output.
+package replication
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+	"mrvaserver/pkg/backup"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/throttle"
+)
+
+var (
+	lagSeconds = metrics.NewGauge("mrvaserver_replication_lag_seconds",
+		"Age of the oldest artifact not yet on the secondary, as of the last reconciliation.")
+	pendingObjects = metrics.NewGauge("mrvaserver_replication_pending_objects",
+		"Artifacts missing from the secondary after the last reconciliation.")
+	lastSuccess = metrics.NewGauge("mrvaserver_replication_last_success_timestamp_seconds",
+		"Time the last reconciliation finished with the secondary up to date.")
+	copiedTotal = metrics.NewCounter("mrvaserver_replication_copied_total",
+		"Artifacts copied to the secondary.")
+	errorsTotal = metrics.NewCounter("mrvaserver_replication_errors_total",
+		"Failed artifact copies.")
+)
+
+type Replicator struct {
+	src, dst *minio.Client
+	prefix   string
+	queue    chan artifactstore.ArtifactLocation
+	limit    *throttle.Throttle
+}
+
+// SecondaryClient connects to the secondary with the DR_MINIO_* environment
+// variables, named after the ARTIFACT_MINIO_* ones of the primary.
+func SecondaryClient() (*minio.Client, error) {
+	for _, key := range []string{"DR_MINIO_ENDPOINT", "DR_MINIO_ID", "DR_MINIO_SECRET"} {
+		if _, ok := os.LookupEnv(key); !ok {
+			return nil, fmt.Errorf("missing required environment variable %s", key)
+		}
+	}
+	return minio.New(os.Getenv("DR_MINIO_ENDPOINT"), &minio.Options{
+		Creds:  credentials.NewStaticV4(os.Getenv("DR_MINIO_ID"), os.Getenv("DR_MINIO_SECRET"), ""),
+		Secure: os.Getenv("DR_MINIO_SECURE") == "true",
+	})
+}
+
+// New returns a replicator from src to dst and starts its copy worker.
+// Secondary buckets are named cfg.BucketPrefix plus the primary's name.
+func New(cfg config.Replication, src, dst *minio.Client) (*Replicator, error) {
+	rp := &Replicator{
+		src:    src,
+		dst:    dst,
+		prefix: cfg.BucketPrefix,
+		queue:  make(chan artifactstore.ArtifactLocation, cfg.Buffer),
+	}
+	ctx := context.Background()
+	for _, bucket := range backup.Buckets {
+		name := rp.prefix + bucket
+		exists, err := dst.BucketExists(ctx, name)
+		if err != nil {
+			return nil, fmt.Errorf("failed to reach secondary: %w", err)
+		}
+		if !exists {
+			if err := dst.MakeBucket(ctx, name, minio.MakeBucketOptions{}); err != nil {
+				return nil, fmt.Errorf("failed to create secondary bucket %s: %w", name, err)
+			}
+		}
+	}
+	go rp.work()
+	return rp, nil
+}
+
+// SetThrottle limits the bandwidth of copies.  It must be called before
+// artifacts are enqueued.
+func (rp *Replicator) SetThrottle(t *throttle.Throttle) {
+	rp.limit = t
+}
+
+// Enqueue schedules loc for copying.  It never blocks; if the queue is full
+// the next reconciliation picks the artifact up.
+func (rp *Replicator) Enqueue(loc artifactstore.ArtifactLocation) {
+	select {
+	case rp.queue <- loc:
+	default:
+		slog.Debug("Replication queue full, leaving artifact to reconciliation", "bucket", loc.Bucket, "key", loc.Key)
+	}
+}
+
+func (rp *Replicator) work() {
+	for loc := range rp.queue {
+		if err := rp.copy(context.Background(), loc.Bucket, loc.Key); err != nil {
+			slog.Warn("Failed to replicate artifact", "bucket", loc.Bucket, "key", loc.Key, "error", err)
+		}
+	}
+}
+
+func (rp *Replicator) copy(ctx context.Context, bucket, key string) error {
+	obj, err := rp.src.GetObject(ctx, bucket, key, minio.GetObjectOptions{})
+	if err != nil {
+		errorsTotal.Inc()
+		return err
+	}
+	defer obj.Close()
+	info, err := obj.Stat()
+	if err != nil {
+		errorsTotal.Inc()
+		return err
+	}
+	// Copies read from the primary and write to the secondary, and belong
+	// to no session in particular.
+	body := rp.limit.Reader(ctx, throttle.Egress, 0, rp.limit.Reader(ctx, throttle.Ingress, 0, obj))
+	_, err = rp.dst.PutObject(ctx, rp.prefix+bucket, key, body, info.Size, minio.PutObjectOptions{
+		ContentType: info.ContentType,
+	})
+	if err != nil {
+		errorsTotal.Inc()
+		return err
+	}
+	copiedTotal.Inc()
+	return nil
+}
+
+// Reconcile copies every artifact that is missing from the secondary or
+// differs in size, and updates the lag metrics.  It is a background task.
+func (rp *Replicator) Reconcile(ctx context.Context) error {
+	var oldest time.Time
+	pending := 0
+	for _, bucket := range backup.Buckets {
+		if exists, err := rp.src.BucketExists(ctx, bucket); err != nil {
+			return fmt.Errorf("failed to reach primary: %w", err)
+		} else if !exists {
+			continue
+		}
+		have := make(map[string]int64)
+		for obj := range rp.dst.ListObjects(ctx, rp.prefix+bucket, minio.ListObjectsOptions{Recursive: true}) {
+			if obj.Err != nil {
+				return fmt.Errorf("failed to list secondary bucket %s: %w", rp.prefix+bucket, obj.Err)
+			}
+			have[obj.Key] = obj.Size
+		}
+
+		for obj := range rp.src.ListObjects(ctx, bucket, minio.ListObjectsOptions{Recursive: true}) {
+			if obj.Err != nil {
+				return fmt.Errorf("failed to list bucket %s: %w", bucket, obj.Err)
+			}
+			if size, ok := have[obj.Key]; ok && size == obj.Size {
+				continue
+			}
+			if err := rp.copy(ctx, bucket, obj.Key); err != nil {
+				if ctx.Err() != nil {
+					return ctx.Err()
+				}
+				slog.Warn("Failed to replicate artifact", "bucket", bucket, "key", obj.Key, "error", err)
+				pending++
+				if oldest.IsZero() || obj.LastModified.Before(oldest) {
+					oldest = obj.LastModified
+				}
+			}
+		}
+	}
+
+	pendingObjects.Set(float64(pending))
+	if pending == 0 {
+		lagSeconds.Set(0)
+		lastSuccess.Set(float64(time.Now().Unix()))
+		return nil
+	}
+	lagSeconds.Set(time.Since(oldest).Seconds())
+	return fmt.Errorf("%d artifacts could not be replicated", pending)
+}
@@ -0,0 +1,66 @@
+package repostats
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+// Register adds the repository statistics:
+//
+//	GET    /repository-stats?flagged=true                    every repository's, or the flagged ones'
+//	GET    /repository-stats/{owner}/{repo}
+func (t *Tracker) Register(r *mux.Router) {
+	r.HandleFunc("/repository-stats", t.list).Methods(http.MethodGet)
+	r.HandleFunc("/repository-stats/{owner}/{repo}", t.get).Methods(http.MethodGet)
+}
+
+// RegisterAdmin adds DELETE /admin/repository-stats/{owner}/{repo}/flags,
+// which resets a repository's flags.
+func (t *Tracker) RegisterAdmin(r *mux.Router) {
+	r.HandleFunc("/admin/repository-stats/{owner}/{repo}/flags", t.reset).Methods(http.MethodDelete)
+}
+
+func nwoOf(r *http.Request) common.NameWithOwner {
+	vars := mux.Vars(r)
+	return common.NameWithOwner{Owner: vars["owner"], Repo: vars["repo"]}
+}
+
+func (t *Tracker) list(w http.ResponseWriter, r *http.Request) {
+	stats, err := t.List(r.Context(), r.URL.Query().Get("flagged") == "true")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, stats)
+}
+
+func (t *Tracker) get(w http.ResponseWriter, r *http.Request) {
+	s, err := t.Get(r.Context(), nwoOf(r))
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "no statistics for the repository", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, s)
+}
+
+func (t *Tracker) reset(w http.ResponseWriter, r *http.Request) {
+	err := t.Reset(r.Context(), nwoOf(r), web.Identity(r))
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "no statistics for the repository", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
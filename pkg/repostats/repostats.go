@@ -0,0 +1,252 @@
+// Package repostats keeps outcome statistics per repository across
+// sessions: how many of its jobs failed, ran out of memory, and how long
+// they took.  Repositories that cross the configured thresholds (see
+// config.RepoStats) are flagged as pathological, and submissions may
+// leave flagged repositories out.
+package repostats
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"sort"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const (
+	nsStats   = "repo-stats"   // owner/repo -> Stats
+	nsFlagged = "repo-flagged" // owner/repo -> Stats, for flagged ones
+)
+
+// ExcludedHeader lists the repositories a submission left out because
+// they are flagged.
+const ExcludedHeader = "X-Mrva-Excluded-Repositories"
+
+// Flags, the reasons a repository is pathological.
+const (
+	FlagFailureRate = "failure_rate"
+	FlagOOM         = "oom"
+	FlagSlow        = "slow"
+)
+
+// Stats are the outcomes of a repository's jobs since Since.  Flags stay
+// set once raised, until reset.
+type Stats struct {
+	Repository  string     `json:"repository"`
+	Jobs        int        `json:"jobs"`
+	Failed      int        `json:"failed"`
+	OOMs        int        `json:"ooms"`
+	Timed       int        `json:"timed"`
+	Seconds     float64    `json:"seconds"`
+	LastSession int        `json:"last_session"`
+	Since       time.Time  `json:"since"`
+	Flags       []string   `json:"flags,omitempty"`
+	FlaggedAt   *time.Time `json:"flagged_at,omitempty"`
+}
+
+func (s Stats) FailureRate() float64 {
+	if s.Jobs == 0 {
+		return 0
+	}
+	return float64(s.Failed) / float64(s.Jobs)
+}
+
+func (s Stats) MeanSeconds() float64 {
+	if s.Timed == 0 {
+		return 0
+	}
+	return s.Seconds / float64(s.Timed)
+}
+
+// flag raises the flags whose thresholds s crosses, and reports whether
+// it raised any.
+func (s *Stats) flag(cfg config.RepoStats) bool {
+	if s.Jobs < cfg.MinJobs {
+		return false
+	}
+	raised := false
+	raise := func(flag string, crossed bool) {
+		if crossed && !slices.Contains(s.Flags, flag) {
+			s.Flags = append(s.Flags, flag)
+			raised = true
+		}
+	}
+	raise(FlagFailureRate, cfg.MaxFailureRate > 0 && s.FailureRate() > cfg.MaxFailureRate)
+	raise(FlagOOM, cfg.MaxOOMs > 0 && s.OOMs >= cfg.MaxOOMs)
+	raise(FlagSlow, cfg.MaxMeanRuntime > 0 && s.Timed > 0 && s.MeanSeconds() > cfg.MaxMeanRuntime.Seconds())
+	return raised
+}
+
+func key(nwo common.NameWithOwner) string {
+	return nwo.Owner + "/" + nwo.Repo
+}
+
+type Tracker struct {
+	cfg       config.RepoStats
+	store     store.Store
+	durations atomic.Pointer[func(common.JobSpec) (time.Duration, bool)]
+}
+
+func New(cfg config.RepoStats, s store.Store) *Tracker {
+	return &Tracker{cfg: cfg, store: s}
+}
+
+// SetDurations sets how long a finished job ran for.  Until it is set,
+// runtimes are not counted.
+func (t *Tracker) SetDurations(f func(common.JobSpec) (time.Duration, bool)) {
+	t.durations.Store(&f)
+}
+
+// HandleResult counts a result against its repository once next has
+// applied it.  Like the toolchain's, it must wrap the dispatcher's
+// handler inside the retry policy's, so that only final results are
+// counted.
+func (t *Tracker) HandleResult(next agentproto.ResultHandler) agentproto.ResultHandler {
+	return func(r agentproto.Result) error {
+		if err := next(r); err != nil {
+			return err
+		}
+		if r.Status != common.StatusSuccess && !r.Failed() {
+			return nil
+		}
+		var took time.Duration
+		var timed bool
+		if f := t.durations.Load(); f != nil {
+			took, timed = (*f)(r.Spec)
+		}
+		ctx := context.Background()
+		k := key(r.Spec.NameWithOwner)
+		var cur Stats
+		raised := false
+		err := store.UpdateJSON(ctx, t.store, nsStats, k, func(s *Stats, found bool) error {
+			if !found {
+				*s = Stats{Repository: k, Since: time.Now().UTC()}
+			}
+			s.Jobs++
+			s.LastSession = r.Spec.SessionID
+			if r.Failed() {
+				s.Failed++
+				if r.FailureClass == agentproto.FailureOOM {
+					s.OOMs++
+				}
+			}
+			if timed {
+				s.Timed++
+				s.Seconds += took.Seconds()
+			}
+			if raised = s.flag(t.cfg); raised {
+				now := time.Now().UTC()
+				s.FlaggedAt = &now
+			}
+			cur = *s
+			return nil
+		})
+		if err != nil {
+			slog.Warn("Failed to count result for its repository", "job", r.Spec, "error", err)
+			return nil
+		}
+		if len(cur.Flags) == 0 {
+			return nil
+		}
+		// The flagged repositories' statistics are kept current too.
+		if err := store.PutJSON(ctx, t.store, nsFlagged, k, cur); err != nil {
+			slog.Warn("Failed to record flagged repository", "repository", k, "error", err)
+			return nil
+		}
+		if raised {
+			slog.Info("Repository flagged as pathological", "repository", k, "flags", cur.Flags,
+				"jobs", cur.Jobs, "failed", cur.Failed, "ooms", cur.OOMs)
+		}
+		return nil
+	}
+}
+
+// Get returns a repository's statistics.
+func (t *Tracker) Get(ctx context.Context, nwo common.NameWithOwner) (Stats, error) {
+	var s Stats
+	err := store.GetJSON(ctx, t.store, nsStats, key(nwo), &s)
+	return s, err
+}
+
+// List returns the statistics of every repository, or of the flagged
+// ones, by repository.
+func (t *Tracker) List(ctx context.Context, flagged bool) ([]Stats, error) {
+	ns := nsStats
+	if flagged {
+		ns = nsFlagged
+	}
+	out, err := store.ListJSON[Stats](ctx, t.store, ns, "")
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Repository < out[j].Repository })
+	return out, nil
+}
+
+// Reset clears a repository's flags and starts its statistics over, so
+// that it is flagged again only on new evidence.
+func (t *Tracker) Reset(ctx context.Context, nwo common.NameWithOwner, by string) error {
+	k := key(nwo)
+	err := store.UpdateJSON(ctx, t.store, nsStats, k, func(s *Stats, found bool) error {
+		if !found {
+			return store.ErrNotFound
+		}
+		*s = Stats{Repository: k, LastSession: s.LastSession, Since: time.Now().UTC()}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := t.store.Delete(ctx, nsFlagged, k); err != nil {
+		return fmt.Errorf("failed to clear repository flags: %w", err)
+	}
+	slog.Info("Repository flags reset", "repository", k, "by", by)
+	return nil
+}
+
+// SubmitHook takes the "exclude_pathological" field and, if it is true,
+// leaves flagged repositories out of the submission, listing them in
+// ExcludedHeader.  It must run after hooks that set the repositories.
+func (t *Tracker) SubmitHook(r *http.Request, sub *gateway.Submission) error {
+	var exclude bool
+	if _, err := sub.TakeExtra("exclude_pathological", &exclude); err != nil || !exclude {
+		return err
+	}
+	flagged, err := t.List(r.Context(), true)
+	if err != nil {
+		return fmt.Errorf("failed to look up flagged repositories: %w", err)
+	}
+	out := make(map[string]bool, len(flagged))
+	for _, s := range flagged {
+		out[s.Repository] = true
+	}
+	var kept, excluded []string
+	for _, nwo := range sub.Msg.Repositories {
+		if out[nwo] {
+			excluded = append(excluded, nwo)
+		} else {
+			kept = append(kept, nwo)
+		}
+	}
+	if len(excluded) == 0 {
+		return nil
+	}
+	if len(kept) == 0 {
+		return web.Msg(http.StatusBadRequest, "", "repostats.all_flagged", nil)
+	}
+	sub.Msg.Repositories = kept
+	sub.Header.Set(ExcludedHeader, strings.Join(excluded, ", "))
+	slog.Info("Submission leaves out flagged repositories", "client", web.Identity(r), "repositories", excluded)
+	return nil
+}
@@ -0,0 +1,123 @@
+package resources
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/web"
+)
+
+// maxSpec bounds a spec; a scheduled analysis carries its query pack.
+const maxSpec = 64 << 20
+
+type kindInfo struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Resources   int    `json:"resources"`
+}
+
+// RegisterAdmin adds the resource API:
+//
+//	GET    /admin/resources             the kinds
+//	GET    /admin/resources/{kind}      a kind's resources, by ID
+//	GET    /admin/resources/{kind}/{id} one resource
+//	PUT    /admin/resources/{kind}/{id} create or replace it with the spec in the body
+//	DELETE /admin/resources/{kind}/{id} delete it
+//
+// PUT answers 201 if it created the resource and 200 otherwise, with the
+// resource; DELETE answers 204 whether or not the resource existed.
+func (r *Registry) RegisterAdmin(mr *mux.Router) {
+	mr.HandleFunc("/admin/resources", r.listKinds).Methods(http.MethodGet)
+	mr.HandleFunc("/admin/resources/{kind}", r.list).Methods(http.MethodGet)
+	mr.HandleFunc("/admin/resources/{kind}/{id}", r.get).Methods(http.MethodGet)
+	mr.HandleFunc("/admin/resources/{kind}/{id}", r.put).Methods(http.MethodPut)
+	mr.HandleFunc("/admin/resources/{kind}/{id}", r.delete).Methods(http.MethodDelete)
+}
+
+func (r *Registry) listKinds(w http.ResponseWriter, req *http.Request) {
+	out := []kindInfo{}
+	for _, k := range r.Kinds() {
+		list, err := r.List(req.Context(), k.Name)
+		if err != nil {
+			web.Fail(w, err, http.StatusInternalServerError)
+			return
+		}
+		out = append(out, kindInfo{Name: k.Name, Description: k.Description, Resources: len(list)})
+	}
+	web.WriteJSON(w, http.StatusOK, out)
+}
+
+func (r *Registry) list(w http.ResponseWriter, req *http.Request) {
+	list, err := r.List(req.Context(), mux.Vars(req)["kind"])
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	for i := range list {
+		if err := r.status(req.Context(), &list[i]); err != nil {
+			web.Fail(w, err, http.StatusInternalServerError)
+			return
+		}
+	}
+	web.WriteJSON(w, http.StatusOK, list)
+}
+
+func (r *Registry) get(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	res, err := r.Get(req.Context(), vars["kind"], vars["id"])
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := r.status(req.Context(), &res); err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	if web.NotModified(w, req, res.ETag()) {
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, res)
+}
+
+func (r *Registry) put(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	body, err := io.ReadAll(http.MaxBytesReader(w, req.Body, maxSpec))
+	if err != nil {
+		web.Fail(w, web.Msg(http.StatusBadRequest, apierr.InvalidRequest, "resources.invalid_spec",
+			messages.Params{"error": err.Error()}), http.StatusBadRequest)
+		return
+	}
+	res, created, err := r.Put(req.Context(), vars["kind"], vars["id"], json.RawMessage(body),
+		precondition(req), web.Identity(req))
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	if err := r.status(req.Context(), &res); err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	code := http.StatusOK
+	if created {
+		code = http.StatusCreated
+	}
+	w.Header().Set("ETag", res.ETag())
+	web.WriteJSON(w, code, res)
+}
+
+func (r *Registry) delete(w http.ResponseWriter, req *http.Request) {
+	vars := mux.Vars(req)
+	if err := r.Delete(req.Context(), vars["kind"], vars["id"], precondition(req)); err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func precondition(req *http.Request) Precondition {
+	return Precondition{IfMatch: req.Header.Get("If-Match"), IfNoneMatch: req.Header.Get("If-None-Match")}
+}
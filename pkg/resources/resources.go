@@ -0,0 +1,328 @@
+// Package resources serves long-lived configuration as declarative
+// resources, for infrastructure-as-code tools such as a Terraform provider
+// to manage: agent pools, quotas, retention policies and scheduled
+// analyses.  Each resource has a kind, an ID the client chooses and which
+// never changes, and a spec, the JSON document the client declares.  The
+// packages acting on a kind define it and read its specs from here; what
+// they learn while acting on a resource, such as a schedule's last run, is
+// reported beside the spec as its status and is never part of it.
+//
+// PUT creates or replaces a resource and is idempotent: putting the spec a
+// resource already has changes nothing, its version included, so that a
+// plan applied twice shows no difference.  Each change bumps the version,
+// which is also the resource's ETag; If-Match makes a PUT or DELETE
+// conditional on it, and If-None-Match: * makes a PUT create only.
+package resources
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const ns = "resources" // kind/id -> Resource
+
+// refresh is how often the specs read by the server pick up resources
+// put on other replicas.
+const refresh = 10 * time.Second
+
+var validID = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]{0,127}$`)
+
+// Resource is a declared resource.  Status is filled in for responses and
+// is not stored.
+type Resource struct {
+	Kind      string          `json:"kind"`
+	ID        string          `json:"id"`
+	Spec      json.RawMessage `json:"spec"`
+	Status    any             `json:"status,omitempty"`
+	Version   int             `json:"version"`
+	CreatedAt time.Time       `json:"created_at"`
+	UpdatedAt time.Time       `json:"updated_at"`
+	UpdatedBy string          `json:"updated_by,omitempty"`
+}
+
+// ETag is the resource's entity tag, its quoted version.
+func (r Resource) ETag() string {
+	return strconv.Quote(strconv.Itoa(r.Version))
+}
+
+// Kind is a type of resource.
+type Kind struct {
+	// Name is the kind's path segment, such as "agent-pools".
+	Name        string
+	Description string
+
+	// Status, if set, reports what is known of a resource beyond its spec.
+	Status func(ctx context.Context, res Resource) (any, error)
+
+	// check validates a spec and returns it re-encoded.
+	check func(id string, spec json.RawMessage) (json.RawMessage, error)
+}
+
+// NewKind defines a kind whose specs are Ts.  A spec is decoded strictly,
+// unknown fields being rejected, then passed to validate, which may
+// normalize it, and stored as the T re-encoded.
+func NewKind[T any](name, description string, validate func(id string, spec *T) error) Kind {
+	return Kind{
+		Name:        name,
+		Description: description,
+		check: func(id string, raw json.RawMessage) (json.RawMessage, error) {
+			var spec T
+			dec := json.NewDecoder(bytes.NewReader(raw))
+			dec.DisallowUnknownFields()
+			if err := dec.Decode(&spec); err != nil {
+				return nil, invalid(err)
+			}
+			if dec.More() {
+				return nil, invalid(errors.New("trailing data after the spec"))
+			}
+			if validate != nil {
+				if err := validate(id, &spec); err != nil {
+					return nil, invalid(err)
+				}
+			}
+			return json.Marshal(spec)
+		},
+	}
+}
+
+func invalid(err error) error {
+	var e *web.Error
+	if errors.As(err, &e) {
+		return err
+	}
+	return web.Msg(http.StatusBadRequest, apierr.InvalidRequest, "resources.invalid_spec",
+		messages.Params{"error": err.Error()})
+}
+
+type cached struct {
+	list   []Resource
+	loaded time.Time
+}
+
+// Registry keeps the resources of the kinds defined in the metadata store.
+type Registry struct {
+	store store.Store
+
+	mu    sync.Mutex
+	kinds map[string]Kind
+	cache map[string]cached
+}
+
+func New(s store.Store) *Registry {
+	return &Registry{store: s, kinds: make(map[string]Kind), cache: make(map[string]cached)}
+}
+
+// Define adds a kind.  Kinds are defined before requests are served.
+func (r *Registry) Define(k Kind) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.kinds[k.Name] = k
+}
+
+func (r *Registry) kind(name string) (Kind, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	k, ok := r.kinds[name]
+	if !ok {
+		return k, web.Msg(http.StatusNotFound, apierr.NotFound, "resources.unknown_kind", messages.Params{"kind": name})
+	}
+	return k, nil
+}
+
+// Kinds returns the kinds defined, by name.
+func (r *Registry) Kinds() []Kind {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	out := make([]Kind, 0, len(r.kinds))
+	for _, k := range r.kinds {
+		out = append(out, k)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	return out
+}
+
+func key(kind, id string) string {
+	return kind + "/" + id
+}
+
+// List returns a kind's resources, by ID, as stored now.
+func (r *Registry) List(ctx context.Context, kind string) ([]Resource, error) {
+	if _, err := r.kind(kind); err != nil {
+		return nil, err
+	}
+	return store.ListJSON[Resource](ctx, r.store, ns, kind+"/")
+}
+
+// cachedList returns a kind's resources as of at most refresh ago.
+func (r *Registry) cachedList(ctx context.Context, kind string) ([]Resource, error) {
+	r.mu.Lock()
+	c, ok := r.cache[kind]
+	r.mu.Unlock()
+	if ok && time.Since(c.loaded) < refresh {
+		return c.list, nil
+	}
+	list, err := store.ListJSON[Resource](ctx, r.store, ns, kind+"/")
+	if err != nil {
+		if ok {
+			return c.list, nil
+		}
+		return nil, err
+	}
+	r.mu.Lock()
+	r.cache[kind] = cached{list: list, loaded: time.Now()}
+	r.mu.Unlock()
+	return list, nil
+}
+
+func (r *Registry) invalidate(kind string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.cache, kind)
+}
+
+// Get returns a resource.
+func (r *Registry) Get(ctx context.Context, kind, id string) (Resource, error) {
+	if _, err := r.kind(kind); err != nil {
+		return Resource{}, err
+	}
+	var res Resource
+	err := store.GetJSON(ctx, r.store, ns, key(kind, id), &res)
+	if errors.Is(err, store.ErrNotFound) {
+		return res, web.Msg(http.StatusNotFound, apierr.NotFound, "resources.unknown",
+			messages.Params{"kind": kind, "id": id})
+	}
+	return res, err
+}
+
+// Precondition makes a change conditional.  IfMatch, if set, is the ETag
+// the resource must have; IfNoneMatch is "*" to require that it not exist.
+type Precondition struct {
+	IfMatch     string
+	IfNoneMatch string
+}
+
+func (p Precondition) check(kind, id string, res Resource, found bool) error {
+	if p.IfNoneMatch == "*" && found {
+		return web.Msg(http.StatusPreconditionFailed, apierr.PreconditionFailed, "resources.exists",
+			messages.Params{"kind": kind, "id": id})
+	}
+	match := strings.TrimPrefix(p.IfMatch, "W/")
+	if match != "" && (!found || match != "*" && match != res.ETag()) {
+		return web.Msg(http.StatusPreconditionFailed, apierr.PreconditionFailed, "resources.version_mismatch",
+			messages.Params{"kind": kind, "id": id, "version": res.Version})
+	}
+	return nil
+}
+
+// Put creates or replaces a resource with spec, and reports whether it
+// was created.  Putting the spec the resource has leaves it as it is.
+func (r *Registry) Put(ctx context.Context, kind, id string, spec json.RawMessage, p Precondition, by string) (Resource, bool, error) {
+	k, err := r.kind(kind)
+	if err != nil {
+		return Resource{}, false, err
+	}
+	if !validID.MatchString(id) {
+		return Resource{}, false, web.Msg(http.StatusBadRequest, apierr.InvalidRequest, "resources.invalid_id",
+			messages.Params{"id": id})
+	}
+	if spec, err = k.check(id, spec); err != nil {
+		return Resource{}, false, err
+	}
+	var out Resource
+	var created bool
+	err = store.UpdateJSON(ctx, r.store, ns, key(kind, id), func(res *Resource, found bool) error {
+		if err := p.check(kind, id, *res, found); err != nil {
+			return err
+		}
+		if found && bytes.Equal(res.Spec, spec) {
+			out = *res
+			return nil
+		}
+		now := time.Now().UTC()
+		if !found {
+			*res = Resource{Kind: kind, ID: id, CreatedAt: now}
+			created = true
+		}
+		res.Spec, res.Version, res.UpdatedAt, res.UpdatedBy = spec, res.Version+1, now, by
+		out = *res
+		return nil
+	})
+	if err != nil {
+		return out, false, err
+	}
+	r.invalidate(kind)
+	return out, created, nil
+}
+
+// Delete deletes a resource.  Deleting a missing resource is not an error
+// unless p requires it to exist.
+func (r *Registry) Delete(ctx context.Context, kind, id string, p Precondition) error {
+	if _, err := r.kind(kind); err != nil {
+		return err
+	}
+	err := r.store.Update(ctx, ns, key(kind, id), func(old []byte) ([]byte, error) {
+		var res Resource
+		if old != nil {
+			if err := json.Unmarshal(old, &res); err != nil {
+				return nil, err
+			}
+		}
+		if err := p.check(kind, id, res, old != nil); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	})
+	if err != nil {
+		return err
+	}
+	r.invalidate(kind)
+	return nil
+}
+
+// status fills in res's status, if its kind reports one.
+func (r *Registry) status(ctx context.Context, res *Resource) error {
+	k, err := r.kind(res.Kind)
+	if err != nil || k.Status == nil {
+		return err
+	}
+	if res.Status, err = k.Status(ctx, *res); err != nil {
+		return fmt.Errorf("failed to read status of %s %s: %w", res.Kind, res.ID, err)
+	}
+	return nil
+}
+
+// Specs decodes the specs of a kind's resources, by ID, as of at most a
+// few seconds ago.  A nil registry has none.
+func Specs[T any](ctx context.Context, r *Registry, kind string) (map[string]T, error) {
+	if r == nil {
+		return nil, nil
+	}
+	list, err := r.cachedList(ctx, kind)
+	if err != nil {
+		return nil, err
+	}
+	out := make(map[string]T, len(list))
+	for _, res := range list {
+		var spec T
+		if err := json.Unmarshal(res.Spec, &spec); err != nil {
+			return nil, fmt.Errorf("invalid stored %s %s: %w", kind, res.ID, err)
+		}
+		out[res.ID] = spec
+	}
+	return out, nil
+}
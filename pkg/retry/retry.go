@@ -0,0 +1,196 @@
+// Package retry retries jobs that agents report as failed, according to
+// the class of failure.  An out-of-memory agent may well succeed on a
+// bigger one and a crashed CLI on a second try, while a query pack that
+// does not compile will fail the same way every time; each class has its
+// own retry count, backoff and, optionally, an alternate agent pool.
+//
+// A failure that will be retried is not applied: the job goes back to
+// queued and a retry is scheduled in the metadata store.  A periodic task
+// dispatches the retries whose backoff has passed.  Once a class's retries
+// are used up, the failure is applied as usual.
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/state"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/store"
+)
+
+const nsRetries = "retries"
+
+var (
+	retriesTotal = metrics.NewCounterVec("mrvaserver_job_retries_total",
+		"Failed jobs scheduled for another attempt, by failure class.", "class")
+	failuresTotal = metrics.NewCounterVec("mrvaserver_job_failures_total",
+		"Job failures applied without a retry, by failure class.", "class")
+)
+
+// Redispatcher publishes a job again as its next attempt.  It is
+// implemented by lease.Manager.
+type Redispatcher interface {
+	Redispatch(ctx context.Context, js common.JobSpec, pool string) (int, error)
+}
+
+// record is a job's retry history and its pending retry, if any.
+type record struct {
+	Spec   common.JobSpec `json:"spec"`
+	Counts map[string]int `json:"counts"`
+
+	// Due is when the pending retry may be dispatched; zero if none is.
+	Due   time.Time `json:"due"`
+	Class string    `json:"class,omitempty"`
+	Pool  string    `json:"pool,omitempty"`
+}
+
+var (
+	errExhausted = errors.New("retries exhausted")
+	errNotDue    = errors.New("no retry due")
+)
+
+// Holder reports whether dispatches of a job are being held back.  It is
+// implemented by dispatch.Dispatcher.
+type Holder interface {
+	Held(js common.JobSpec) bool
+}
+
+type Scheduler struct {
+	cfg      config.Retries
+	store    store.Store
+	st       state.ServerState
+	dispatch Redispatcher
+	hold     Holder
+}
+
+// New returns a scheduler that dispatches retries through dispatch once
+// they are due and hold no longer holds them back.
+func New(cfg config.Retries, st state.ServerState, s store.Store, dispatch Redispatcher, hold Holder) *Scheduler {
+	return &Scheduler{cfg: cfg, store: s, st: st, dispatch: dispatch, hold: hold}
+}
+
+func key(js common.JobSpec) string {
+	return fmt.Sprintf("%d/%s/%s", js.SessionID, js.Owner, js.Repo)
+}
+
+// class returns r's failure class and its policy.
+func (s *Scheduler) class(r agentproto.Result) (string, config.RetryPolicy) {
+	class := r.FailureClass
+	if p, ok := s.cfg.Policies[class]; ok {
+		return class, p
+	}
+	return agentproto.FailureUnknown, s.cfg.Policies[agentproto.FailureUnknown]
+}
+
+func backoff(p config.RetryPolicy, retry int) time.Duration {
+	d := p.Backoff
+	for i := 1; i < retry; i++ {
+		d *= 2
+		if p.MaxBackoff > 0 && d >= p.MaxBackoff {
+			break
+		}
+	}
+	if p.MaxBackoff > 0 {
+		d = min(d, p.MaxBackoff)
+	}
+	return d
+}
+
+// HandleResult schedules a retry for failures whose class allows one, and
+// passes everything else to next.
+func (s *Scheduler) HandleResult(next agentproto.ResultHandler) agentproto.ResultHandler {
+	return func(r agentproto.Result) error {
+		if !r.Failed() {
+			return next(r)
+		}
+		class, p := s.class(r)
+
+		var n int
+		var due time.Time
+		err := store.UpdateJSON(context.Background(), s.store, nsRetries, key(r.Spec), func(rec *record, found bool) error {
+			if rec.Counts[class] >= p.Max {
+				return errExhausted
+			}
+			if rec.Counts == nil {
+				rec.Counts = make(map[string]int)
+			}
+			rec.Spec = r.Spec
+			rec.Counts[class]++
+			n = rec.Counts[class]
+			due = time.Now().UTC().Add(backoff(p, n))
+			rec.Due, rec.Class, rec.Pool = due, class, p.Pool
+			return nil
+		})
+		if errors.Is(err, errExhausted) {
+			failuresTotal.With(class).Inc()
+			return next(r)
+		}
+		if err != nil {
+			return err
+		}
+
+		retriesTotal.With(class).Inc()
+		s.st.SetStatus(r.Spec, common.StatusQueued)
+		slog.Info("Job failed, scheduling retry", "job", r.Spec, "agent", r.Agent, "class", class,
+			"message", r.FailureMessage, "retry", n, "of", p.Max, "due", due, "pool", p.Pool)
+		return nil
+	}
+}
+
+// Dispatch publishes the retries that are due.  It is a background task.
+func (s *Scheduler) Dispatch(ctx context.Context) error {
+	recs, err := store.ListJSON[record](ctx, s.store, nsRetries, "")
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	for _, rec := range recs {
+		if rec.Due.IsZero() || rec.Due.After(now) || s.hold.Held(rec.Spec) {
+			continue
+		}
+		if err := s.dispatchOne(ctx, rec.Spec, now); err != nil {
+			slog.Error("Failed to dispatch retry", "job", rec.Spec, "error", err)
+		}
+	}
+	return nil
+}
+
+// dispatchOne claims the job's pending retry and publishes it, putting
+// the claim back if publishing fails.
+func (s *Scheduler) dispatchOne(ctx context.Context, js common.JobSpec, now time.Time) error {
+	var claimed record
+	err := store.UpdateJSON(ctx, s.store, nsRetries, key(js), func(rec *record, found bool) error {
+		claimed = *rec
+		if !found || rec.Due.IsZero() || rec.Due.After(now) {
+			return errNotDue
+		}
+		rec.Due = time.Time{}
+		return nil
+	})
+	if errors.Is(err, errNotDue) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	attempt, err := s.dispatch.Redispatch(ctx, js, claimed.Pool)
+	if err != nil {
+		if uerr := store.UpdateJSON(ctx, s.store, nsRetries, key(js), func(rec *record, found bool) error {
+			rec.Due = claimed.Due
+			return nil
+		}); uerr != nil {
+			slog.Error("Failed to restore pending retry", "job", js, "error", uerr)
+		}
+		return err
+	}
+	slog.Info("Dispatched retry", "job", js, "class", claimed.Class, "attempt", attempt, "pool", claimed.Pool)
+	return nil
+}
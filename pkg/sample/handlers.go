@@ -0,0 +1,66 @@
+package sample
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+// Register adds samples:
+//
+//	GET  /variant-analyses/{id}/sample   the session's sample
+//	POST /variant-analyses/{id}/promote  submit the repositories it left out
+func (s *Sampler) Register(r *mux.Router) {
+	r.HandleFunc("/variant-analyses/{id:[0-9]+}/sample", s.get).Methods(http.MethodGet)
+	r.HandleFunc("/variant-analyses/{id:[0-9]+}/promote", s.promote).Methods(http.MethodPost)
+}
+
+func (s *Sampler) get(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	sm, err := s.Get(r.Context(), id)
+	if errors.Is(err, store.ErrNotFound) {
+		web.Fail(w, web.Msg(http.StatusNotFound, "", "sample.not_sampled",
+			messages.Params{"session": web.SessionLabel(r.Context(), id)}), http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeSample(w, r, http.StatusOK, sm)
+}
+
+func (s *Sampler) promote(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	sm, err := s.Promote(r, id)
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	writeSample(w, r, http.StatusCreated, sm)
+}
+
+// view is a Sample as clients see it, its sessions named.
+type view struct {
+	Sample
+	Session    string `json:"session"`
+	PromotedTo string `json:"promoted_to,omitempty"`
+}
+
+func writeSample(w http.ResponseWriter, r *http.Request, code int, sm Sample) {
+	v := view{Sample: sm}
+	var err error
+	if v.Session, err = web.SessionName(r.Context(), sm.Session); err == nil && sm.PromotedTo != 0 {
+		v.PromotedTo, err = web.SessionName(r.Context(), sm.PromotedTo)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, code, v)
+}
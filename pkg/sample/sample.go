@@ -0,0 +1,367 @@
+// Package sample runs exploratory variant analyses on a sample of their
+// repositories.  A submission with "sample": 100 analyzes 100 of the
+// selected repositories, chosen by "sample_strategy":
+//
+//	random            any 100 (the default)
+//	largest           those with the largest databases
+//	recently_updated  those whose databases were updated last
+//
+// Once its results look right, the sample is promoted: the repositories
+// left out are submitted as a new session, with the sample's query pack
+// and submission options.
+package sample
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand/v2"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/hohn/mrvacommander/pkg/state"
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/shard"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const (
+	nsSamples    = "samples"           // session -> Sample
+	nsPromotions = "sample-promotions" // promoted session -> sampled session
+)
+
+// Strategies.
+const (
+	Random          = "random"
+	Largest         = "largest"
+	RecentlyUpdated = "recently_updated"
+)
+
+// DatabaseTimes knows when databases were last updated.
+type DatabaseTimes interface {
+	DatabaseTime(nwo common.NameWithOwner) (time.Time, bool)
+}
+
+// Sample is a sampled session and what promoting it submits.
+type Sample struct {
+	Session  int      `json:"session"`
+	Strategy string   `json:"strategy"`
+	Size     int      `json:"size"`
+	Of       int      `json:"of"`
+	Language string   `json:"language"`
+	Rest     []string `json:"rest"`
+
+	// Options are the submission's fields for later hooks, such as
+	// agent_constraints or tags, which the promoted session gets too.
+	Options map[string]json.RawMessage `json:"options,omitempty"`
+
+	PromotedTo int        `json:"promoted_to,omitempty"`
+	PromotedBy string     `json:"promoted_by,omitempty"`
+	PromotedAt *time.Time `json:"promoted_at,omitempty"`
+}
+
+type Sampler struct {
+	store     store.Store
+	state     state.ServerState
+	artifacts artifactstore.Store
+	sizes     gateway.DatabaseSizes
+	times     DatabaseTimes
+	submit    http.Handler
+	shards    *shard.Map
+	versions  *gateway.MetadataVersions
+}
+
+// New submits promotions through submit, the gateway, as provenance
+// replays are.  Databases are ranked by sizes and times, either of which
+// may be nil, leaving out the strategy that needs it.
+func New(s store.Store, st state.ServerState, artifacts artifactstore.Store,
+	sizes gateway.DatabaseSizes, times DatabaseTimes, submit http.Handler) *Sampler {
+	return &Sampler{store: s, state: st, artifacts: artifacts, sizes: sizes, times: times, submit: submit}
+}
+
+// SetShards has a split submission sampled and promoted as one, under its
+// parent session.
+func (s *Sampler) SetShards(m *shard.Map) {
+	s.shards = m
+}
+
+// SetVersions touches a session in v whenever its sample or promotion is
+// recorded.
+func (s *Sampler) SetVersions(v *gateway.MetadataVersions) {
+	s.versions = v
+}
+
+// Get returns a sampled session's sample, or that of the submission it is
+// a shard of.
+func (s *Sampler) Get(ctx context.Context, session int) (Sample, error) {
+	var sm Sample
+	session, err := s.shards.Parent(ctx, session)
+	if err != nil {
+		return sm, err
+	}
+	err = store.GetJSON(ctx, s.store, nsSamples, strconv.Itoa(session), &sm)
+	return sm, err
+}
+
+// SubmitHook takes the "sample" and "sample_strategy" fields and narrows
+// the submission to the sample.  It must run after hooks that set the
+// repositories, and before those that take the options a promotion
+// repeats.
+func (s *Sampler) SubmitHook(r *http.Request, sub *gateway.Submission) error {
+	var size int
+	if _, err := sub.TakeExtra("sample", &size); err != nil {
+		return err
+	}
+	strategy := Random
+	if _, err := sub.TakeExtra("sample_strategy", &strategy); err != nil {
+		return err
+	}
+	if size == 0 {
+		return nil
+	}
+	if size < 0 {
+		return web.Msg(http.StatusBadRequest, "", "sample.invalid_size", nil)
+	}
+	repos := sub.Msg.Repositories
+	picked, err := s.pick(repos, size, strategy)
+	if err != nil {
+		return err
+	}
+	if len(picked) == len(repos) {
+		return nil
+	}
+	in := make(map[string]bool, len(picked))
+	for _, nwo := range picked {
+		in[nwo] = true
+	}
+	sm := Sample{Strategy: strategy, Size: len(picked), Of: len(repos), Language: sub.Msg.Language,
+		Rest: make([]string, 0, len(repos)-len(picked))}
+	for _, nwo := range repos {
+		if !in[nwo] {
+			sm.Rest = append(sm.Rest, nwo)
+		}
+	}
+	if len(sub.Extra) > 0 {
+		sm.Options = make(map[string]json.RawMessage, len(sub.Extra))
+		for name, raw := range sub.Extra {
+			sm.Options[name] = raw
+		}
+	}
+	sub.Msg.Repositories = picked
+	sub.After(func() {
+		if sub.Session == 0 {
+			return
+		}
+		sm.Session = sub.Session
+		if err := store.PutJSON(context.Background(), s.store, nsSamples, strconv.Itoa(sm.Session), sm); err != nil {
+			slog.Error("Failed to record session sample", "session", sm.Session, "error", err)
+			return
+		}
+		s.versions.Touch(context.Background(), sm.Session)
+		slog.Info("Variant analysis sampled", "session", sm.Session, "strategy", strategy,
+			"size", sm.Size, "of", sm.Of)
+	})
+	return nil
+}
+
+// pick chooses size of repos by strategy, in their submitted order.
+func (s *Sampler) pick(repos []string, size int, strategy string) ([]string, error) {
+	switch {
+	case strategy != Random && strategy != Largest && strategy != RecentlyUpdated:
+		return nil, web.Msg(http.StatusBadRequest, "", "sample.unknown_strategy", messages.Params{"strategy": strategy})
+	case size >= len(repos):
+		return repos, nil
+	case strategy == Largest && s.sizes == nil, strategy == RecentlyUpdated && s.times == nil:
+		return nil, web.Msg(http.StatusBadRequest, "", "sample.strategy_unavailable", messages.Params{"strategy": strategy})
+	}
+	rank := make([]int, len(repos))
+	for i := range rank {
+		rank[i] = i
+	}
+	switch strategy {
+	case Random:
+		rand.Shuffle(len(rank), func(i, j int) { rank[i], rank[j] = rank[j], rank[i] })
+	case Largest:
+		// Databases of unknown size come last.
+		keys := make([]int64, len(repos))
+		for i, nwo := range repos {
+			keys[i] = -1
+			if n, ok := s.sizes.DatabaseSize(nameWithOwner(nwo)); ok {
+				keys[i] = n
+			}
+		}
+		sort.SliceStable(rank, func(i, j int) bool { return keys[rank[i]] > keys[rank[j]] })
+	case RecentlyUpdated:
+		keys := make([]time.Time, len(repos))
+		for i, nwo := range repos {
+			keys[i], _ = s.times.DatabaseTime(nameWithOwner(nwo))
+		}
+		sort.SliceStable(rank, func(i, j int) bool { return keys[rank[i]].After(keys[rank[j]]) })
+	}
+	rank = rank[:size]
+	sort.Ints(rank)
+	picked := make([]string, len(rank))
+	for i, k := range rank {
+		picked[i] = repos[k]
+	}
+	return picked, nil
+}
+
+func nameWithOwner(s string) common.NameWithOwner {
+	owner, repo, _ := strings.Cut(s, "/")
+	return common.NameWithOwner{Owner: owner, Repo: repo}
+}
+
+// Promote submits the repositories a sample left out as a new session on
+// behalf of r.  A sample is promoted once.
+func (s *Sampler) Promote(r *http.Request, session int) (Sample, error) {
+	ctx := r.Context()
+	session, err := s.shards.Parent(ctx, session)
+	if err != nil {
+		return Sample{}, err
+	}
+	key := strconv.Itoa(session)
+	now := time.Now().UTC()
+	var sm Sample
+	err = store.UpdateJSON(ctx, s.store, nsSamples, key, func(cur *Sample, found bool) error {
+		if !found {
+			return store.ErrNotFound
+		}
+		if cur.PromotedAt != nil {
+			return web.Msg(http.StatusConflict, apierr.Conflict, "sample.already_promoted",
+				messages.Params{"session": web.SessionLabel(ctx, session), "promoted": web.SessionLabel(ctx, cur.PromotedTo)})
+		}
+		cur.PromotedBy, cur.PromotedAt = web.Identity(r), &now
+		sm = *cur
+		return nil
+	})
+	if errors.Is(err, store.ErrNotFound) {
+		return Sample{}, web.Msg(http.StatusNotFound, "", "sample.not_sampled", messages.Params{"session": web.SessionLabel(ctx, session)})
+	}
+	if err != nil {
+		return Sample{}, err
+	}
+
+	id, err := s.submitRest(r, sm)
+	if err != nil {
+		// Let a later request try again.
+		if uerr := store.UpdateJSON(context.Background(), s.store, nsSamples, key, func(cur *Sample, _ bool) error {
+			cur.PromotedBy, cur.PromotedAt = "", nil
+			return nil
+		}); uerr != nil {
+			slog.Warn("Failed to release sample promotion", "session", session, "error", uerr)
+		}
+		return Sample{}, err
+	}
+	sm.PromotedTo = id
+	err = store.UpdateJSON(context.Background(), s.store, nsSamples, key, func(cur *Sample, _ bool) error {
+		cur.PromotedTo = id
+		return nil
+	})
+	if err == nil {
+		err = s.store.Put(context.Background(), nsPromotions, strconv.Itoa(id), []byte(key))
+	}
+	if err != nil {
+		return sm, fmt.Errorf("failed to record sample promotion: %w", err)
+	}
+	s.versions.Touch(context.Background(), session, id)
+	slog.Info("Variant analysis sample promoted", "session", session, "promoted", id,
+		"repositories", len(sm.Rest), "client", sm.PromotedBy)
+	return sm, nil
+}
+
+// submitRest submits a sample's left-out repositories, with its query
+// pack and options, and returns the new session.  The query pack is read
+// from the first of the sampled session's shards with jobs.
+func (s *Sampler) submitRest(r *http.Request, sm Sample) (int, error) {
+	var jobs []queue.AnalyzeJob
+	var err error
+	for _, id := range s.shards.Sessions(r.Context(), sm.Session) {
+		if jobs, err = s.state.GetJobList(id); err == nil && len(jobs) > 0 {
+			break
+		}
+	}
+	if len(jobs) == 0 {
+		return 0, fmt.Errorf("failed to look up sampled session's jobs: %w", err)
+	}
+	pack, err := s.artifacts.GetQueryPack(jobs[0].QueryPackLocation)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read query pack: %w", err)
+	}
+	sub := map[string]any{}
+	for name, raw := range sm.Options {
+		sub[name] = raw
+	}
+	sub["action_repo_ref"] = "main"
+	sub["language"] = sm.Language
+	sub["query_pack"] = base64.StdEncoding.EncodeToString(pack)
+	sub["repositories"] = sm.Rest
+	body, err := json.Marshal(sub)
+	if err != nil {
+		return 0, err
+	}
+
+	ctx := r.Context()
+	req := r.Clone(ctx)
+	req.Method = http.MethodPost
+	req.URL.Path = "/repositories/0/code-scanning/codeql/variant-analyses"
+	req.URL.RawPath = ""
+	req.URL.RawQuery = ""
+	req.RequestURI = req.URL.RequestURI()
+	req.Body = io.NopCloser(bytes.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	rec := httptest.NewRecorder()
+	s.submit.ServeHTTP(rec, req)
+	if rec.Code < 200 || rec.Code >= 300 {
+		return 0, web.Msg(rec.Code, "", "sample.promote_failed", messages.Params{"error": submitError(rec.Body.Bytes())})
+	}
+	var resp struct {
+		ID int `json:"id"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.ID == 0 {
+		return 0, fmt.Errorf("unexpected promotion submission response: %s", rec.Body.Bytes())
+	}
+	return resp.ID, nil
+}
+
+// submitError is the message of the error response to a promotion's
+// submission.
+func submitError(body []byte) string {
+	var b apierr.Body
+	if json.Unmarshal(body, &b) == nil && b.Message != "" {
+		return b.Message
+	}
+	return string(bytes.TrimSpace(body))
+}
+
+// VariantAnalysisHook reports a sampled session's sample, and the sample
+// a promoted session came from.
+func (s *Sampler) VariantAnalysisHook(va *api.VariantAnalysis) {
+	ctx := context.Background()
+	if sm, err := s.Get(ctx, va.ID); err == nil {
+		va.Sample = &api.Sample{Strategy: sm.Strategy, Size: sm.Size, Of: sm.Of, PromotedTo: sm.PromotedTo}
+	} else if !errors.Is(err, store.ErrNotFound) {
+		slog.Warn("Failed to look up session sample", "session", va.ID, "error", err)
+	}
+	if v, err := s.store.Get(ctx, nsPromotions, strconv.Itoa(va.ID)); err == nil {
+		va.PromotedFrom, _ = strconv.Atoi(string(v))
+	}
+}
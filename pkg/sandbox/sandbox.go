@@ -0,0 +1,59 @@
+// Package sandbox puts the server in control of the envelope jobs run in.
+// Every job carries the configured sandbox policy (see agentproto.Sandbox)
+// and agents that enforce it attest to it in their results.  With
+// sandbox.require, a successful result without an attestation satisfying
+// the policy is not recorded: it becomes a failure of class "sandbox",
+// retried as that class's policy says.
+package sandbox
+
+import (
+	"fmt"
+	"log/slog"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/metrics"
+)
+
+var unattested = metrics.NewCounter("mrvaserver_sandbox_unattested_total",
+	"Results failed for lacking a satisfying sandbox attestation.")
+
+// Policy returns the envelope cfg describes.
+func Policy(cfg config.Sandbox) agentproto.Sandbox {
+	return agentproto.Sandbox{
+		Network:          cfg.Network,
+		ReadOnlyDatabase: cfg.ReadOnlyDatabase,
+		MemoryBytes:      cfg.MemoryLimit,
+	}
+}
+
+// Verify fails successful results whose attestation does not satisfy the
+// policy, before next sees them.
+func Verify(cfg config.Sandbox, next agentproto.ResultHandler) agentproto.ResultHandler {
+	want := Policy(cfg)
+	return func(r agentproto.Result) error {
+		if r.Failed() {
+			return next(r)
+		}
+		var msg string
+		switch {
+		case r.Sandbox == nil:
+			msg = "the agent did not attest to running the job in a sandbox"
+		case !r.Sandbox.Satisfies(want):
+			msg = fmt.Sprintf("the agent's sandbox (network %t, read-only database %t, memory %d, runtime %q) does not satisfy the policy",
+				r.Sandbox.Network, r.Sandbox.ReadOnlyDatabase, r.Sandbox.MemoryBytes, r.Sandbox.Runtime)
+		default:
+			return next(r)
+		}
+		unattested.Inc()
+		slog.Warn("Result rejected for its sandbox", "job", r.Spec, "agent", r.Agent, "reason", msg)
+		r.Status = common.StatusError
+		r.ResultCount = 0
+		r.ResultLocation = artifactstore.ArtifactLocation{}
+		r.FailureClass = agentproto.FailureSandbox
+		r.FailureMessage = msg
+		return next(r)
+	}
+}
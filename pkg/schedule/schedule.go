@@ -0,0 +1,222 @@
+// Package schedule submits variant analyses on a schedule, declared as
+// scheduled-analyses resources (see package resources).  A schedule's
+// spec holds a submission body, as POSTed to
+// /repositories/0/code-scanning/codeql/variant-analyses, and the interval
+// between its runs; it may name a template rather than carry a query pack.
+// A new schedule first runs on the next pass, then every interval after
+// its last run.
+//
+// Runs are submitted through the gateway, so that quotas and the submit
+// hooks apply as to any submission; runs refused for reasons that may
+// pass, such as the server draining, are retried on the next pass.  Each
+// schedule's last run -- its session, or why it was refused -- is the
+// schedule's status.
+package schedule
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/resources"
+	"mrvaserver/pkg/store"
+)
+
+// Kind is the kind of scheduled analyses.
+const Kind = "scheduled-analyses"
+
+const nsRuns = "schedule-runs" // schedule -> Run
+
+const (
+	// Interval is how often schedules are checked for runs due.
+	Interval = time.Minute
+
+	// minInterval bounds how often a schedule may run.
+	minInterval = 5 * time.Minute
+
+	// client is the identity runs are submitted under.
+	client = "scheduled-analyses"
+)
+
+var runsTotal = metrics.NewCounterVec("mrvaserver_scheduled_runs_total",
+	"Scheduled variant analyses submitted, by result.", "result")
+
+// Spec is a scheduled analysis.  Paused schedules do not run.
+type Spec struct {
+	Interval   string          `json:"interval"`
+	Submission json.RawMessage `json:"submission"`
+	Paused     bool            `json:"paused,omitempty"`
+}
+
+func check(id string, spec *Spec) error {
+	d, err := time.ParseDuration(spec.Interval)
+	if err != nil {
+		return fmt.Errorf("interval: %w", err)
+	}
+	if d < minInterval {
+		return fmt.Errorf("interval must be at least %s", minInterval)
+	}
+	var sub map[string]json.RawMessage
+	if err := json.Unmarshal(spec.Submission, &sub); err != nil || sub == nil {
+		return fmt.Errorf("submission must be a JSON object")
+	}
+	return nil
+}
+
+// Run is a schedule's run.
+type Run struct {
+	At      time.Time `json:"at"`
+	Session int       `json:"session,omitempty"`
+	Status  int       `json:"status"`
+	Error   string    `json:"error,omitempty"`
+}
+
+// Status is what is known of a schedule beyond its spec.
+type Status struct {
+	LastRun   *Run       `json:"last_run,omitempty"`
+	NextRunAt *time.Time `json:"next_run_at,omitempty"`
+}
+
+type Scheduler struct {
+	resources *resources.Registry
+	meta      store.Store
+	submit    http.Handler
+}
+
+// New defines the scheduled analysis kind in reg.
+func New(reg *resources.Registry, meta store.Store) *Scheduler {
+	s := &Scheduler{resources: reg, meta: meta}
+	k := resources.NewKind(Kind, "Variant analyses submitted at an interval.", check)
+	k.Status = s.status
+	reg.Define(k)
+	return s
+}
+
+// SetSubmitter submits runs through h, the gateway.
+func (s *Scheduler) SetSubmitter(h http.Handler) {
+	s.submit = h
+}
+
+func (s *Scheduler) lastRun(ctx context.Context, id string) (*Run, error) {
+	var run Run
+	err := store.GetJSON(ctx, s.meta, nsRuns, id, &run)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &run, nil
+}
+
+func (s *Scheduler) status(ctx context.Context, res resources.Resource) (any, error) {
+	var spec Spec
+	if err := json.Unmarshal(res.Spec, &spec); err != nil {
+		return nil, err
+	}
+	var st Status
+	var err error
+	if st.LastRun, err = s.lastRun(ctx, res.ID); err != nil {
+		return nil, err
+	}
+	if !spec.Paused {
+		next := nextRun(spec, st.LastRun, time.Now().UTC())
+		st.NextRunAt = &next
+	}
+	return st, nil
+}
+
+// nextRun is when a schedule runs next: now if it never ran.
+func nextRun(spec Spec, last *Run, now time.Time) time.Time {
+	if last == nil {
+		return now
+	}
+	d, _ := time.ParseDuration(spec.Interval)
+	return last.At.Add(d)
+}
+
+// Run submits the scheduled analyses that are due.  It is a background
+// task.
+func (s *Scheduler) Run(ctx context.Context) error {
+	specs, err := resources.Specs[Spec](ctx, s.resources, Kind)
+	if err != nil {
+		return err
+	}
+	now := time.Now().UTC()
+	for id, spec := range specs {
+		if spec.Paused {
+			continue
+		}
+		last, err := s.lastRun(ctx, id)
+		if err != nil {
+			return err
+		}
+		if now.Before(nextRun(spec, last, now)) {
+			continue
+		}
+		run := Run{At: now}
+		run.Status, run.Session, run.Error = s.post(ctx, spec.Submission)
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if run.Status >= 500 || run.Status == http.StatusTooManyRequests {
+			slog.Warn("Scheduled analysis refused, will retry", "schedule", id, "status", run.Status, "error", run.Error)
+			continue
+		}
+		if err := store.PutJSON(ctx, s.meta, nsRuns, id, run); err != nil {
+			return fmt.Errorf("failed to record run of schedule %s: %w", id, err)
+		}
+		result := "submitted"
+		if run.Session == 0 {
+			result = "failed"
+		}
+		runsTotal.With(result).Inc()
+		slog.Info("Scheduled analysis run", "schedule", id, "result", result, "session", run.Session,
+			"status", run.Status, "error", run.Error)
+	}
+	return nil
+}
+
+// post submits body and returns the response's status and the new
+// session, or the error message.
+func (s *Scheduler) post(ctx context.Context, body []byte) (int, int, string) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "/repositories/0/code-scanning/codeql/variant-analyses",
+		bytes.NewReader(body))
+	if err != nil {
+		return http.StatusInternalServerError, 0, err.Error()
+	}
+	req.RequestURI = req.URL.RequestURI()
+	req.RemoteAddr = client
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Length", strconv.Itoa(len(body)))
+	rec := httptest.NewRecorder()
+	s.submit.ServeHTTP(rec, req)
+	if rec.Code < 200 || rec.Code >= 300 {
+		return rec.Code, 0, submitError(rec.Body.Bytes())
+	}
+	var resp struct {
+		ID int `json:"id"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.ID == 0 {
+		return http.StatusBadGateway, 0, fmt.Sprintf("unexpected submission response: %s", rec.Body.Bytes())
+	}
+	return rec.Code, resp.ID, ""
+}
+
+// submitError is the message of the error response to a submission.
+func submitError(body []byte) string {
+	var b apierr.Body
+	if json.Unmarshal(body, &b) == nil && b.Message != "" {
+		return b.Message
+	}
+	return string(bytes.TrimSpace(body))
+}
@@ -0,0 +1,209 @@
+// Package sessionid gives every variant analysis a ULID, the name clients
+// of the server's own routes know it by.  The commander's numeric IDs stay
+// inside: its state is keyed by them, and the GitHub-compatible routes
+// under /repos/.../code-scanning/codeql/variant-analyses keep them, as the
+// VS Code extension parses them as numbers.  The ULID is time-ordered and
+// unique without coordination, so it can name a session across replicas,
+// backups and imports.
+//
+// A submission's response carries the new session's ULID in the
+// X-MRVA-Session-ULID header and status documents carry it as "ulid".  The
+// GitHub-compatible routes take a ULID in place of the numeric ID as well;
+// the routes under /variant-analyses and /quick-queries take only ULIDs,
+// and their responses name sessions by them.  A submission split into
+// shards is named by its parent's ULID; each shard has its own.  Sessions
+// from before ULIDs, and quick queries, get one when first named.
+// Operators' /admin routes keep the numeric IDs the logs show.
+package sessionid
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const (
+	nsByULID = "session-ulids" // ULID -> numeric ID
+	nsByID   = "session-ids"   // numeric ID -> ULID
+
+	// Header is the submission response header holding the ULID.
+	Header = "X-MRVA-Session-ULID"
+)
+
+type IDs struct {
+	store    store.Store
+	versions *gateway.MetadataVersions
+}
+
+func New(s store.Store) *IDs {
+	return &IDs{store: s}
+}
+
+// SetVersions touches a session in v once its ULID is recorded.
+func (ids *IDs) SetVersions(v *gateway.MetadataVersions) {
+	ids.versions = v
+}
+
+func idKey(id int) string {
+	return strconv.Itoa(id)
+}
+
+// Assign records ulid as the ULID of session id.
+func (ids *IDs) Assign(ctx context.Context, id int, ulid string) error {
+	if err := ids.store.Put(ctx, nsByULID, ulid, []byte(idKey(id))); err != nil {
+		return fmt.Errorf("failed to record session ULID: %w", err)
+	}
+	if err := ids.store.Put(ctx, nsByID, idKey(id), []byte(ulid)); err != nil {
+		return fmt.Errorf("failed to record session ULID: %w", err)
+	}
+	return nil
+}
+
+// ULID returns the ULID of session id, or store.ErrNotFound for sessions
+// not named yet.
+func (ids *IDs) ULID(ctx context.Context, id int) (string, error) {
+	v, err := ids.store.Get(ctx, nsByID, idKey(id))
+	return string(v), err
+}
+
+// Name returns the ULID of session id, giving it one if it has none.
+func (ids *IDs) Name(ctx context.Context, id int) (string, error) {
+	ulid, err := ids.ULID(ctx, id)
+	if !errors.Is(err, store.ErrNotFound) {
+		return ulid, err
+	}
+	fresh, err := NewULID(time.Now())
+	if err != nil {
+		return "", fmt.Errorf("failed to make session ULID: %w", err)
+	}
+	// Another replica may name the session at the same time; the first
+	// name recorded stays.
+	err = ids.store.Update(ctx, nsByID, idKey(id), func(old []byte) ([]byte, error) {
+		if len(old) > 0 {
+			ulid = string(old)
+			return old, nil
+		}
+		ulid = fresh
+		return []byte(fresh), nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to record session ULID: %w", err)
+	}
+	if err := ids.store.Put(ctx, nsByULID, ulid, []byte(idKey(id))); err != nil {
+		return "", fmt.Errorf("failed to record session ULID: %w", err)
+	}
+	return ulid, nil
+}
+
+// Resolve returns the numeric ID of the session named ulid.  Anything
+// else, numeric IDs included, is a 404 web.Error.
+func (ids *IDs) Resolve(ctx context.Context, ulid string) (int, error) {
+	if !IsULID(ulid) {
+		if _, err := strconv.Atoi(ulid); err == nil {
+			return 0, web.Msg(http.StatusNotFound, "", "session.named_by_ulid", messages.Params{"session": ulid})
+		}
+		return 0, web.Msg(http.StatusNotFound, "", "session.unknown", messages.Params{"session": ulid})
+	}
+	v, err := ids.store.Get(ctx, nsByULID, strings.ToUpper(ulid))
+	if errors.Is(err, store.ErrNotFound) {
+		return 0, web.Msg(http.StatusNotFound, "", "session.unknown", messages.Params{"session": ulid})
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(v))
+}
+
+// SubmitHook makes the submission's ULID, returns it in the response
+// header and records it once the commander has assigned the numeric ID.
+func (ids *IDs) SubmitHook(r *http.Request, sub *gateway.Submission) error {
+	ulid, err := NewULID(time.Now())
+	if err != nil {
+		return fmt.Errorf("failed to make session ULID: %w", err)
+	}
+	sub.Header.Set(Header, ulid)
+	sub.After(func() {
+		if sub.Session == 0 {
+			return
+		}
+		ctx := context.Background()
+		if err := ids.Assign(ctx, sub.Session, ulid); err != nil {
+			slog.Error("Failed to assign session ULID", "session", sub.Session, "ulid", ulid, "error", err)
+			return
+		}
+		// The ULID names the parent of a split submission; its shards
+		// get their own.
+		for _, id := range sub.Sessions()[1:] {
+			if _, err := ids.Name(ctx, id); err != nil {
+				slog.Error("Failed to name shard", "session", id, "error", err)
+			}
+		}
+		ids.versions.Touch(ctx, sub.Sessions()...)
+	})
+	return nil
+}
+
+// VariantAnalysisHook adds the session's ULID to its status document.
+func (ids *IDs) VariantAnalysisHook(va *api.VariantAnalysis) {
+	ulid, err := ids.Name(context.Background(), va.ID)
+	if err != nil {
+		slog.Warn("Failed to name session", "session", va.ID, "error", err)
+		return
+	}
+	va.ULID = ulid
+}
+
+var (
+	// ownPath is a session on the server's own routes, compatPath one on
+	// the GitHub-compatible ones.
+	ownPath    = regexp.MustCompile(`^/(?:variant-analyses|quick-queries)/([^/]+)(/|$)`)
+	compatPath = regexp.MustCompile(`/code-scanning/codeql/variant-analyses/([^/]+)(/|$)`)
+)
+
+// Middleware names sessions by ULID for the handlers of a request, and
+// rewrites a ULID in its path, in place of a variant analysis ID, to the
+// session's numeric ID before the request is routed.  On the server's own
+// routes a numeric ID is refused.
+func (ids *IDs) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = web.WithSessionNames(r, ids)
+		m := ownPath.FindStringSubmatchIndex(r.URL.Path)
+		own := m != nil
+		if !own {
+			m = compatPath.FindStringSubmatchIndex(r.URL.Path)
+		}
+		if m == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		name := r.URL.Path[m[2]:m[3]]
+		if !IsULID(name) {
+			if _, err := strconv.Atoi(name); err == nil && own {
+				web.Fail(w, web.Msg(http.StatusNotFound, "", "session.named_by_ulid", messages.Params{"session": name}), http.StatusNotFound)
+				return
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+		id, err := ids.Resolve(r.Context(), name)
+		if err != nil {
+			web.Fail(w, err, http.StatusInternalServerError)
+			return
+		}
+		r.URL.Path = r.URL.Path[:m[2]] + strconv.Itoa(id) + r.URL.Path[m[3]:]
+		r.URL.RawPath = ""
+		next.ServeHTTP(w, r)
+	})
+}
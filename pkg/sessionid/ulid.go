@@ -0,0 +1,45 @@
+package sessionid
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"strings"
+	"time"
+)
+
+// crockford is the base32 alphabet of ULIDs.
+const crockford = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+
+// NewULID returns a ULID for t: 48 bits of milliseconds since the epoch
+// followed by 80 random bits, in 26 characters of Crockford base32.  ULIDs
+// sort by time, and replicas need no coordination to make unique ones.
+func NewULID(t time.Time) (string, error) {
+	var id [16]byte
+	binary.BigEndian.PutUint64(id[:8], uint64(t.UnixMilli())<<16)
+	if _, err := rand.Read(id[6:]); err != nil {
+		return "", err
+	}
+	// 128 bits are 26 groups of 5 bits, the first holding only 3.
+	var out [26]byte
+	hi := binary.BigEndian.Uint64(id[:8])
+	lo := binary.BigEndian.Uint64(id[8:])
+	for i := 25; i >= 0; i-- {
+		out[i] = crockford[lo&31]
+		lo = lo>>5 | hi<<59
+		hi >>= 5
+	}
+	return string(out[:]), nil
+}
+
+// IsULID reports whether s is a ULID, in either case.
+func IsULID(s string) bool {
+	if len(s) != 26 || s[0] > '7' {
+		return false
+	}
+	for _, c := range strings.ToUpper(s) {
+		if !strings.ContainsRune(crockford, c) {
+			return false
+		}
+	}
+	return true
+}
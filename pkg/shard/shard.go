@@ -0,0 +1,133 @@
+// Package shard records the sessions that submissions too large for one
+// session are split into.  The gateway splits them (see config.Sessions)
+// and asks this map for the shards of a session whenever it builds its
+// status: the first shard is the parent, under whose ID the submission is
+// known, and its status and repository tasks cover all of them.  Each
+// shard is an ordinary session otherwise, with its own jobs and dispatch,
+// so no state row holds the whole submission.
+package shard
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const (
+	nsShards  = "shards"        // parent -> shards
+	nsParents = "shard-parents" // shard -> parent
+	nsSkipped = "shard-skipped" // shard -> skipped repositories, of shards with no jobs
+)
+
+type Map struct {
+	store store.Store
+}
+
+func New(s store.Store) *Map {
+	return &Map{store: s}
+}
+
+// RecordShards is a gateway.ShardMap.
+func (m *Map) RecordShards(ctx context.Context, shards []int) error {
+	for _, id := range shards[1:] {
+		if err := m.store.Put(ctx, nsParents, strconv.Itoa(id), []byte(strconv.Itoa(shards[0]))); err != nil {
+			return err
+		}
+	}
+	return store.PutJSON(ctx, m.store, nsShards, strconv.Itoa(shards[0]), shards)
+}
+
+// Shards is a gateway.ShardMap.
+func (m *Map) Shards(ctx context.Context, session int) ([]int, error) {
+	var shards []int
+	err := store.GetJSON(ctx, m.store, nsShards, strconv.Itoa(session), &shards)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	return shards, err
+}
+
+// RecordSkipped is a gateway.ShardMap.
+func (m *Map) RecordSkipped(ctx context.Context, shard int, skipped common.SkippedRepositories) error {
+	return store.PutJSON(ctx, m.store, nsSkipped, strconv.Itoa(shard), skipped)
+}
+
+// Skipped is a gateway.ShardMap.
+func (m *Map) Skipped(ctx context.Context, shard int) (common.SkippedRepositories, error) {
+	var skipped common.SkippedRepositories
+	err := store.GetJSON(ctx, m.store, nsSkipped, strconv.Itoa(shard), &skipped)
+	if errors.Is(err, store.ErrNotFound) {
+		return skipped, nil
+	}
+	return skipped, err
+}
+
+// Sessions returns the shards of a parent session, or the session alone,
+// for the packages acting on a session to act on each of its shards.  A
+// failed lookup is logged.  A nil map has no shards.
+func (m *Map) Sessions(ctx context.Context, session int) []int {
+	if m == nil {
+		return []int{session}
+	}
+	shards, err := m.Shards(ctx, session)
+	if err != nil {
+		slog.Warn("Failed to look up session shards", "session", session, "error", err)
+	}
+	if len(shards) == 0 {
+		return []int{session}
+	}
+	return shards
+}
+
+// Parent returns the parent of a shard, or the session itself.  A nil map
+// has no shards.
+func (m *Map) Parent(ctx context.Context, session int) (int, error) {
+	if m == nil {
+		return session, nil
+	}
+	v, err := m.store.Get(ctx, nsParents, strconv.Itoa(session))
+	if errors.Is(err, store.ErrNotFound) {
+		return session, nil
+	}
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(v))
+}
+
+// Register adds the shard listing:
+//
+//	GET /variant-analyses/{id}/shards  the parent and shards of a session
+func (m *Map) Register(r *mux.Router) {
+	r.HandleFunc("/variant-analyses/{id:[0-9]+}/shards", m.get).Methods(http.MethodGet)
+}
+
+func (m *Map) get(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	parent, err := m.Parent(r.Context(), id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	shards, err := m.Shards(r.Context(), parent)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if shards == nil {
+		shards = []int{parent}
+	}
+	names, err := web.SessionNameList(r.Context(), append([]int{parent}, shards...))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, map[string]any{"parent": names[0], "shards": names[1:]})
+}
@@ -0,0 +1,134 @@
+// Package signing authenticates the messages that pass through the broker,
+// so that whoever controls the broker can neither hand agents forged jobs
+// nor inject forged findings.  The server signs every job it publishes,
+// agents sign their results, and results that are unsigned, signed by an
+// unknown key or signed by an agent other than the one they name are
+// dropped before they reach the state.
+//
+// A signature is Ed25519 over the message body, base64 in the
+// x-mrva-signature header, with the signer's name in x-mrva-signer.
+package signing
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	amqp "github.com/rabbitmq/amqp091-go"
+)
+
+const (
+	SignatureHeader = "x-mrva-signature"
+	SignerHeader    = "x-mrva-signer"
+
+	// AnyAgent in a Verifier's keys is the key of agents without one of
+	// their own, say a fleet sharing a key.
+	AnyAgent = "*"
+)
+
+var (
+	ErrUnsigned  = errors.New("message is not signed")
+	ErrUnknown   = errors.New("message is signed by an unknown key")
+	ErrSignature = errors.New("message signature does not verify")
+)
+
+type Signer struct {
+	name string
+	key  ed25519.PrivateKey
+}
+
+func NewSigner(name string, key ed25519.PrivateKey) *Signer {
+	return &Signer{name: name, key: key}
+}
+
+// Headers returns the headers carrying body's signature.
+func (s *Signer) Headers(body []byte) amqp.Table {
+	return amqp.Table{
+		SignerHeader:    s.name,
+		SignatureHeader: base64.StdEncoding.EncodeToString(ed25519.Sign(s.key, body)),
+	}
+}
+
+// Verifier checks signatures against known public keys, by signer.
+type Verifier struct {
+	keys map[string]ed25519.PublicKey
+}
+
+// NewVerifier takes base64 public keys by signer name.
+func NewVerifier(keys map[string]string) (*Verifier, error) {
+	v := &Verifier{keys: make(map[string]ed25519.PublicKey)}
+	for name, s := range keys {
+		pub, err := ParsePublicKey(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid key of %s: %w", name, err)
+		}
+		v.keys[name] = pub
+	}
+	return v, nil
+}
+
+// Verify checks body's signature and returns who signed it.
+func (v *Verifier) Verify(body []byte, headers amqp.Table) (string, error) {
+	signer, _ := headers[SignerHeader].(string)
+	sig64, _ := headers[SignatureHeader].(string)
+	if signer == "" || sig64 == "" {
+		return "", ErrUnsigned
+	}
+	pub, ok := v.keys[signer]
+	if !ok {
+		if pub, ok = v.keys[AnyAgent]; !ok {
+			return signer, ErrUnknown
+		}
+	}
+	sig, err := base64.StdEncoding.DecodeString(sig64)
+	if err != nil || !ed25519.Verify(pub, body, sig) {
+		return signer, ErrSignature
+	}
+	return signer, nil
+}
+
+// GenerateKey returns a new key pair: the private key's seed and the
+// public key, base64.
+func GenerateKey() (private, public string, err error) {
+	pub, priv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(priv.Seed()), base64.StdEncoding.EncodeToString(pub), nil
+}
+
+// LoadPrivateKey reads a base64 private key, its seed as GenerateKey
+// writes it or the full 64 bytes, from fname.
+func LoadPrivateKey(fname string) (ed25519.PrivateKey, error) {
+	data, err := os.ReadFile(fname)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read signing key: %w", err)
+	}
+	b, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key %s: %w", fname, err)
+	}
+	switch len(b) {
+	case ed25519.SeedSize:
+		return ed25519.NewKeyFromSeed(b), nil
+	case ed25519.PrivateKeySize:
+		return ed25519.PrivateKey(b), nil
+	default:
+		return nil, fmt.Errorf("invalid signing key %s: %d bytes", fname, len(b))
+	}
+}
+
+func ParsePublicKey(s string) (ed25519.PublicKey, error) {
+	b, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("%d bytes, not %d", len(b), ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(b), nil
+}
@@ -0,0 +1,266 @@
+// Package snapshot exports the commander state -- every session and its
+// jobs with their info, status and result -- to a portable bundle, and
+// imports a bundle into any state backend, so a deployment can move
+// between backends (say, the journal and Postgres) without losing history.
+//
+// A bundle is JSON Lines: a header, then each session followed by its jobs
+// in submission order, then an end record with the totals.  A bundle
+// without an end record, or whose totals do not match, is incomplete and
+// is refused by Import.  Artifacts and mrvaserver's metadata are not part
+// of the state and are not exported; session IDs are preserved, so
+// artifact locations and metadata keyed by session stay valid.
+package snapshot
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/hohn/mrvacommander/pkg/state"
+	"mrvaserver/pkg/instance"
+)
+
+const bundleVersion = 1
+
+const (
+	kindHeader  = "header"
+	kindSession = "session"
+	kindJob     = "job"
+	kindEnd     = "end"
+)
+
+// SessionLister is implemented by states that can enumerate their
+// sessions.  Other states are probed by ID; see Options.MaxGap.
+type SessionLister interface {
+	SessionIDs() ([]int, error)
+}
+
+type record struct {
+	Kind string `json:"kind"`
+
+	// header
+	Version    int        `json:"version,omitempty"`
+	ExportedAt *time.Time `json:"exported_at,omitempty"`
+	Instance   string     `json:"instance,omitempty"`
+
+	// session, end
+	Session  int `json:"session,omitempty"`
+	Jobs     int `json:"jobs,omitempty"`
+	Sessions int `json:"sessions,omitempty"`
+
+	// job
+	Job    *queue.AnalyzeJob    `json:"job,omitempty"`
+	Info   *common.JobInfo      `json:"info,omitempty"`
+	Status *common.Status       `json:"status,omitempty"`
+	Result *queue.AnalyzeResult `json:"result,omitempty"`
+}
+
+// Summary counts what was exported or imported.
+type Summary struct {
+	Sessions int
+	Jobs     int
+}
+
+type Options struct {
+	// MaxGap is how many consecutive missing session IDs end the probe of
+	// a state that is not a SessionLister.
+	MaxGap int
+}
+
+// SessionIDs lists the sessions of st, probing states that are not a
+// SessionLister up to maxGap consecutive missing IDs.
+func SessionIDs(st state.ServerState, maxGap int) ([]int, error) {
+	if l, ok := st.(SessionLister); ok {
+		return l.SessionIDs()
+	}
+	var ids []int
+	for id, gap := 1, 0; gap < maxGap; id++ {
+		if _, err := st.GetJobList(id); err != nil {
+			gap++
+			continue
+		}
+		ids = append(ids, id)
+		gap = 0
+	}
+	return ids, nil
+}
+
+// Export writes every session of st to w.
+func Export(st state.ServerState, w io.Writer, opts Options) (Summary, error) {
+	var sum Summary
+	ids, err := SessionIDs(st, opts.MaxGap)
+	if err != nil {
+		return sum, fmt.Errorf("failed to list sessions: %w", err)
+	}
+
+	bw := bufio.NewWriter(w)
+	enc := json.NewEncoder(bw)
+	now := time.Now().UTC()
+	if err := enc.Encode(record{Kind: kindHeader, Version: bundleVersion, ExportedAt: &now, Instance: instance.ID()}); err != nil {
+		return sum, err
+	}
+	for _, id := range ids {
+		jobs, err := st.GetJobList(id)
+		if err != nil {
+			return sum, fmt.Errorf("failed to read jobs of session %d: %w", id, err)
+		}
+		if err := enc.Encode(record{Kind: kindSession, Session: id, Jobs: len(jobs)}); err != nil {
+			return sum, err
+		}
+		for _, job := range jobs {
+			rec := record{Kind: kindJob, Job: &job}
+			if info, err := st.GetJobInfo(job.Spec); err == nil {
+				rec.Info = &info
+			}
+			if status, err := st.GetStatus(job.Spec); err == nil {
+				rec.Status = &status
+			}
+			if result, err := st.GetResult(job.Spec); err == nil {
+				rec.Result = &result
+			}
+			if err := enc.Encode(rec); err != nil {
+				return sum, err
+			}
+		}
+		sum.Sessions++
+		sum.Jobs += len(jobs)
+	}
+	if err := enc.Encode(record{Kind: kindEnd, Sessions: sum.Sessions, Jobs: sum.Jobs}); err != nil {
+		return sum, err
+	}
+	return sum, bw.Flush()
+}
+
+// Verify reads a whole bundle and checks that it is complete.
+func Verify(r io.Reader) (Summary, error) {
+	return read(r, nil)
+}
+
+// Import loads a bundle into st, which must not have any sessions yet.
+// The bundle is verified first, so an incomplete bundle writes nothing.
+// Sessions keep their IDs; IDs missing from the bundle are allocated as
+// empty sessions, and new sessions continue after the last imported one.
+func Import(st state.ServerState, r io.ReadSeeker) (Summary, error) {
+	if _, err := Verify(r); err != nil {
+		return Summary{}, err
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return Summary{}, err
+	}
+	ids, err := SessionIDs(st, 1)
+	if err != nil {
+		return Summary{}, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	if len(ids) > 0 {
+		return Summary{}, fmt.Errorf("target state already has %d sessions; import needs an empty state", len(ids))
+	}
+
+	next := 0
+	return read(r, func(rec record) error {
+		switch rec.Kind {
+		case kindSession:
+			for next < rec.Session {
+				id := st.NextID()
+				if id <= next {
+					return fmt.Errorf("state returned session ID %d after %d", id, next)
+				}
+				next = id
+			}
+			if next > rec.Session {
+				return fmt.Errorf("session %d is already taken in the target state", rec.Session)
+			}
+		case kindJob:
+			js := rec.Job.Spec
+			st.AddJob(*rec.Job)
+			if rec.Info != nil {
+				st.SetJobInfo(js, *rec.Info)
+			}
+			if rec.Result != nil {
+				st.SetResult(js, *rec.Result)
+			}
+			if rec.Status != nil {
+				st.SetStatus(js, *rec.Status)
+			}
+		}
+		return nil
+	})
+}
+
+// read parses a bundle, checking its structure and totals, and passes each
+// session and job record to apply if it is set.
+func read(r io.Reader, apply func(record) error) (Summary, error) {
+	var sum Summary
+	br := bufio.NewReader(r)
+	line, session, remaining, lastSession := 0, 0, 0, 0
+	ended := false
+	for {
+		data, err := br.ReadBytes('\n')
+		if errors.Is(err, io.EOF) && len(data) == 0 {
+			break
+		}
+		if err != nil && !errors.Is(err, io.EOF) {
+			return sum, fmt.Errorf("failed to read bundle: %w", err)
+		}
+		line++
+		var rec record
+		if err := json.Unmarshal(data, &rec); err != nil {
+			return sum, fmt.Errorf("bundle line %d: %w", line, err)
+		}
+		if ended {
+			return sum, fmt.Errorf("bundle line %d: record after end", line)
+		}
+		if line == 1 {
+			if rec.Kind != kindHeader {
+				return sum, fmt.Errorf("bundle line 1: not a state bundle")
+			}
+			if rec.Version != bundleVersion {
+				return sum, fmt.Errorf("bundle version %d is not supported", rec.Version)
+			}
+			continue
+		}
+
+		switch rec.Kind {
+		case kindSession:
+			if remaining > 0 {
+				return sum, fmt.Errorf("bundle line %d: session %d is missing %d jobs", line, session, remaining)
+			}
+			if rec.Session <= lastSession {
+				return sum, fmt.Errorf("bundle line %d: session %d is out of order", line, rec.Session)
+			}
+			session, remaining, lastSession = rec.Session, rec.Jobs, rec.Session
+			sum.Sessions++
+		case kindJob:
+			if rec.Job == nil || rec.Job.Spec.SessionID != session || remaining == 0 {
+				return sum, fmt.Errorf("bundle line %d: job outside its session", line)
+			}
+			remaining--
+			sum.Jobs++
+		case kindEnd:
+			if remaining > 0 {
+				return sum, fmt.Errorf("bundle line %d: session %d is missing %d jobs", line, session, remaining)
+			}
+			if rec.Sessions != sum.Sessions || rec.Jobs != sum.Jobs {
+				return sum, fmt.Errorf("bundle is incomplete: it has %d sessions and %d jobs of %d and %d",
+					sum.Sessions, sum.Jobs, rec.Sessions, rec.Jobs)
+			}
+			ended = true
+			continue
+		default:
+			return sum, fmt.Errorf("bundle line %d: unknown record %q", line, rec.Kind)
+		}
+		if apply != nil {
+			if err := apply(rec); err != nil {
+				return sum, err
+			}
+		}
+	}
+	if !ended {
+		return sum, fmt.Errorf("bundle is incomplete: no end record")
+	}
+	return sum, nil
+}
@@ -0,0 +1,118 @@
+// Package startup tracks a replica from process start until it serves
+// traffic, for Kubernetes startup probes.  The server opens its public
+// listener only once schema migrations have run and every backend is
+// connected; the probe listener answers from the start, so /startupz can
+// say which phase a slow startup is in.
+package startup
+
+import (
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/web"
+)
+
+type phase struct {
+	Name string `json:"name"`
+	Took string `json:"took"`
+}
+
+type status struct {
+	Started bool    `json:"started"`
+	Phase   string  `json:"phase,omitempty"`
+	Elapsed string  `json:"elapsed"`
+	Done    []phase `json:"done"`
+}
+
+type Tracker struct {
+	mu      sync.Mutex
+	start   time.Time
+	phase   string
+	since   time.Time
+	done    []phase
+	started bool
+	took    time.Duration
+}
+
+func New() *Tracker {
+	now := time.Now()
+	return &Tracker{start: now, since: now}
+}
+
+// Phase ends the current phase and begins name.
+func (t *Tracker) Phase(name string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.endPhase()
+	t.phase = name
+	slog.Debug("Startup phase", "phase", name)
+}
+
+// Done ends the last phase; from then on /startupz passes.
+func (t *Tracker) Done() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.endPhase()
+	t.started = true
+	t.took = time.Since(t.start).Round(time.Millisecond)
+	slog.Info("Startup complete", "took", t.took)
+}
+
+func (t *Tracker) endPhase() {
+	now := time.Now()
+	if t.phase != "" {
+		t.done = append(t.done, phase{Name: t.phase, Took: now.Sub(t.since).Round(time.Millisecond).String()})
+	}
+	t.phase, t.since = "", now
+}
+
+func (t *Tracker) status() status {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	elapsed := t.took
+	if !t.started {
+		elapsed = time.Since(t.start).Round(time.Millisecond)
+	}
+	return status{
+		Started: t.started,
+		Phase:   t.phase,
+		Elapsed: elapsed.String(),
+		Done:    append([]phase{}, t.done...),
+	}
+}
+
+// Register adds /startupz and /livez.
+func (t *Tracker) Register(r *mux.Router) {
+	r.HandleFunc("/startupz", t.startupz).Methods(http.MethodGet)
+	r.HandleFunc("/livez", livez).Methods(http.MethodGet)
+}
+
+func (t *Tracker) startupz(w http.ResponseWriter, r *http.Request) {
+	s := t.status()
+	code := http.StatusOK
+	if !s.Started {
+		code = http.StatusServiceUnavailable
+	}
+	web.WriteJSON(w, code, s)
+}
+
+func livez(w http.ResponseWriter, r *http.Request) {
+	w.Write([]byte("ok\n"))
+}
+
+// ListenAndServe serves the probes alone on addr (host:port or
+// unix:/path) until the process exits.
+func (t *Tracker) ListenAndServe(addr string) error {
+	l, err := gateway.Listen(addr)
+	if err != nil {
+		return err
+	}
+	r := mux.NewRouter()
+	t.Register(r)
+	slog.Info("Probe listener started", "addr", l.Addr().String())
+	return http.Serve(l, r)
+}
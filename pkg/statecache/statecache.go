@@ -0,0 +1,219 @@
+// Package statecache puts a Redis read-through cache in front of a
+// state.ServerState.  The VS Code extension polls session status every few
+// seconds and each poll reads the job list and every job's status and
+// info; during large active sessions the cache answers most of those reads.
+//
+// Writes go to the underlying state first and then delete the affected
+// keys, so a reader on any replica sees the new value on its next miss.
+// Entries also expire after a TTL, which bounds staleness should a delete
+// fail.  Errors are not cached, and if Redis is unreachable reads fall
+// through to the underlying state.
+package statecache
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/hohn/mrvacommander/pkg/state"
+	"mrvaserver/pkg/redis"
+)
+
+const prefix = "mrvaserver:state:"
+
+// batchApplier matches ingest.BatchApplier.
+type batchApplier interface {
+	ApplyResults(results []queue.AnalyzeResult) error
+}
+
+// sessionVersioner matches gateway.SessionVersioner.
+type sessionVersioner interface {
+	SessionVersion(sessionID int) (int64, error)
+}
+
+// sessionWatcher matches gateway.SessionWatcher.
+type sessionWatcher interface {
+	WatchSession(ctx context.Context, sessionID int) <-chan struct{}
+}
+
+// sessionDeleter matches trash.SessionDeleter.
+type sessionDeleter interface {
+	DeleteSession(sessionID int) error
+}
+
+type CachedState struct {
+	st  state.ServerState
+	rc  *redis.Client
+	ttl time.Duration
+}
+
+func New(st state.ServerState, rc *redis.Client, ttl time.Duration) *CachedState {
+	return &CachedState{st: st, rc: rc, ttl: ttl}
+}
+
+func specKey(kind string, js common.JobSpec) string {
+	return fmt.Sprintf("%s%s:%d:%s/%s", prefix, kind, js.SessionID, js.Owner, js.Repo)
+}
+
+func jobsKey(sessionID int) string {
+	return fmt.Sprintf("%sjobs:%d", prefix, sessionID)
+}
+
+func repoIDKey(sessionID, jobRepoID int) string {
+	return fmt.Sprintf("%sspec:%d:%d", prefix, sessionID, jobRepoID)
+}
+
+// cached returns the value under key, loading and storing it on a miss.
+func cached[T any](c *CachedState, key string, load func() (T, error)) (T, error) {
+	data, err := c.rc.Get(key)
+	if err == nil {
+		var v T
+		if err := json.Unmarshal(data, &v); err == nil {
+			return v, nil
+		}
+	} else if !errors.Is(err, redis.ErrNil) {
+		slog.Debug("State cache read failed", "key", key, "error", err)
+	}
+
+	v, err := load()
+	if err != nil {
+		return v, err
+	}
+	if data, err := json.Marshal(v); err == nil {
+		if err := c.rc.Set(key, data, c.ttl); err != nil {
+			slog.Debug("State cache write failed", "key", key, "error", err)
+		}
+	}
+	return v, nil
+}
+
+func (c *CachedState) invalidate(keys ...string) {
+	if err := c.rc.Del(keys...); err != nil {
+		slog.Warn("State cache invalidation failed", "keys", keys, "error", err)
+	}
+}
+
+func (c *CachedState) NextID() int {
+	return c.st.NextID()
+}
+
+func (c *CachedState) GetResult(js common.JobSpec) (queue.AnalyzeResult, error) {
+	return cached(c, specKey("result", js), func() (queue.AnalyzeResult, error) {
+		return c.st.GetResult(js)
+	})
+}
+
+func (c *CachedState) GetJobSpecByRepoId(sessionId int, jobRepoId int) (common.JobSpec, error) {
+	// Repo IDs are job list indices and never change once assigned.
+	return cached(c, repoIDKey(sessionId, jobRepoId), func() (common.JobSpec, error) {
+		return c.st.GetJobSpecByRepoId(sessionId, jobRepoId)
+	})
+}
+
+func (c *CachedState) SetResult(js common.JobSpec, ar queue.AnalyzeResult) {
+	c.st.SetResult(js, ar)
+	c.invalidate(specKey("result", js))
+}
+
+func (c *CachedState) GetJobList(sessionId int) ([]queue.AnalyzeJob, error) {
+	return cached(c, jobsKey(sessionId), func() ([]queue.AnalyzeJob, error) {
+		return c.st.GetJobList(sessionId)
+	})
+}
+
+func (c *CachedState) GetJobInfo(js common.JobSpec) (common.JobInfo, error) {
+	return cached(c, specKey("info", js), func() (common.JobInfo, error) {
+		return c.st.GetJobInfo(js)
+	})
+}
+
+func (c *CachedState) SetJobInfo(js common.JobSpec, ji common.JobInfo) {
+	c.st.SetJobInfo(js, ji)
+	c.invalidate(specKey("info", js))
+}
+
+func (c *CachedState) GetStatus(js common.JobSpec) (common.Status, error) {
+	return cached(c, specKey("status", js), func() (common.Status, error) {
+		return c.st.GetStatus(js)
+	})
+}
+
+func (c *CachedState) SetStatus(js common.JobSpec, status common.Status) {
+	c.st.SetStatus(js, status)
+	c.invalidate(specKey("status", js))
+}
+
+func (c *CachedState) AddJob(job queue.AnalyzeJob) {
+	c.st.AddJob(job)
+	c.invalidate(jobsKey(job.Spec.SessionID))
+}
+
+// ApplyResults keeps batched writes available through the cache.
+func (c *CachedState) ApplyResults(results []queue.AnalyzeResult) error {
+	if b, ok := c.st.(batchApplier); ok {
+		if err := b.ApplyResults(results); err != nil {
+			return err
+		}
+	} else {
+		for _, r := range results {
+			c.st.SetResult(r.Spec, r)
+			c.st.SetStatus(r.Spec, r.Status)
+		}
+	}
+	keys := make([]string, 0, 2*len(results))
+	for _, r := range results {
+		keys = append(keys, specKey("result", r.Spec), specKey("status", r.Spec))
+	}
+	if len(keys) > 0 {
+		c.invalidate(keys...)
+	}
+	return nil
+}
+
+// SessionVersion is read from the underlying state, uncached, since it is
+// what tells pollers whether anything changed.
+func (c *CachedState) SessionVersion(sessionID int) (int64, error) {
+	if v, ok := c.st.(sessionVersioner); ok {
+		return v.SessionVersion(sessionID)
+	}
+	return 0, errors.ErrUnsupported
+}
+
+// WatchSession is the underlying state's watch of the session, or nil if
+// it cannot watch sessions.
+func (c *CachedState) WatchSession(ctx context.Context, sessionID int) <-chan struct{} {
+	if w, ok := c.st.(sessionWatcher); ok {
+		return w.WatchSession(ctx, sessionID)
+	}
+	return nil
+}
+
+// DeleteSession deletes the session from the underlying state, then every
+// cached entry of its jobs.  It returns errors.ErrUnsupported if the
+// underlying state cannot delete sessions.
+func (c *CachedState) DeleteSession(sessionID int) error {
+	d, ok := c.st.(sessionDeleter)
+	if !ok {
+		return errors.ErrUnsupported
+	}
+	// The job list is read first, uncached, for the keys to invalidate.
+	jobs, err := c.st.GetJobList(sessionID)
+	if err != nil {
+		slog.Debug("State cache could not list the jobs of a deleted session", "session", sessionID, "error", err)
+	}
+	if err := d.DeleteSession(sessionID); err != nil {
+		return err
+	}
+	keys := []string{jobsKey(sessionID)}
+	for i, job := range jobs {
+		keys = append(keys, repoIDKey(sessionID, i),
+			specKey("result", job.Spec), specKey("info", job.Spec), specKey("status", job.Spec))
+	}
+	c.invalidate(keys...)
+	return nil
+}
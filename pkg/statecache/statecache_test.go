@@ -0,0 +1,226 @@
+package statecache
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"github.com/hohn/mrvacommander/pkg/state"
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/redis"
+	"mrvaserver/pkg/trash"
+)
+
+// The cache is asserted to these where it wraps the state.
+var (
+	_ trash.SessionDeleter     = (*CachedState)(nil)
+	_ gateway.SessionWatcher   = (*CachedState)(nil)
+	_ gateway.SessionVersioner = (*CachedState)(nil)
+)
+
+// fakeRedis answers GET, SET and DEL from memory.
+type fakeRedis struct {
+	mu   sync.Mutex
+	data map[string][]byte
+}
+
+func startRedis(t *testing.T) (*fakeRedis, *redis.Client) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeRedis{data: make(map[string][]byte)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go f.serve(c)
+		}
+	}()
+	rc := redis.New(l.Addr().String(), "", 0)
+	t.Cleanup(func() {
+		rc.Close()
+		l.Close()
+	})
+	return f, rc
+}
+
+func (f *fakeRedis) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		args, err := readCommand(r)
+		if err != nil {
+			return
+		}
+		f.mu.Lock()
+		switch args[0] {
+		case "GET":
+			if v, ok := f.data[args[1]]; ok {
+				fmt.Fprintf(c, "$%d\r\n%s\r\n", len(v), v)
+			} else {
+				io.WriteString(c, "$-1\r\n")
+			}
+		case "SET":
+			f.data[args[1]] = []byte(args[2])
+			io.WriteString(c, "+OK\r\n")
+		case "DEL":
+			n := 0
+			for _, k := range args[1:] {
+				if _, ok := f.data[k]; ok {
+					delete(f.data, k)
+					n++
+				}
+			}
+			fmt.Fprintf(c, ":%d\r\n", n)
+		default:
+			io.WriteString(c, "-ERR unknown command\r\n")
+		}
+		f.mu.Unlock()
+	}
+}
+
+func readCommand(r *bufio.Reader) ([]string, error) {
+	var n int
+	if _, err := fmt.Fscanf(r, "*%d\r\n", &n); err != nil {
+		return nil, err
+	}
+	args := make([]string, n)
+	for i := range args {
+		var size int
+		if _, err := fmt.Fscanf(r, "$%d\r\n", &size); err != nil {
+			return nil, err
+		}
+		b := make([]byte, size+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		args[i] = string(b[:size])
+	}
+	return args, nil
+}
+
+func (f *fakeRedis) has(key string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.data[key]
+	return ok
+}
+
+// watchingState adds session watches and deletes to a LocalState.
+type watchingState struct {
+	*state.LocalState
+	mu      sync.Mutex
+	deleted map[int]bool
+	changed chan struct{}
+}
+
+func (s *watchingState) GetJobList(sessionID int) ([]queue.AnalyzeJob, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.deleted[sessionID] {
+		return nil, fmt.Errorf("session %d not found", sessionID)
+	}
+	return s.LocalState.GetJobList(sessionID)
+}
+
+func (s *watchingState) DeleteSession(sessionID int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.deleted[sessionID] = true
+	return nil
+}
+
+func (s *watchingState) WatchSession(ctx context.Context, sessionID int) <-chan struct{} {
+	return s.changed
+}
+
+func addJob(st state.ServerState) common.JobSpec {
+	js := common.JobSpec{SessionID: st.NextID(), NameWithOwner: common.NameWithOwner{Owner: "mrva", Repo: "alpha"}}
+	st.AddJob(queue.AnalyzeJob{Spec: js, QueryLanguage: "cpp"})
+	st.SetStatus(js, common.StatusSuccess)
+	return js
+}
+
+func TestDeleteSession(t *testing.T) {
+	f, rc := startRedis(t)
+	st := &watchingState{LocalState: state.NewLocalState(0), deleted: make(map[int]bool)}
+	c := New(st, rc, time.Minute)
+	js := addJob(c)
+
+	// Fill the cache.
+	if _, err := c.GetJobList(js.SessionID); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetStatus(js); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.GetJobSpecByRepoId(js.SessionID, 0); err != nil {
+		t.Fatal(err)
+	}
+	keys := []string{jobsKey(js.SessionID), specKey("status", js), repoIDKey(js.SessionID, 0)}
+	for _, k := range keys {
+		if !f.has(k) {
+			t.Fatalf("%s not cached", k)
+		}
+	}
+
+	if err := c.DeleteSession(js.SessionID); err != nil {
+		t.Fatal(err)
+	}
+	if !st.deleted[js.SessionID] {
+		t.Error("DeleteSession was not forwarded to the state")
+	}
+	for _, k := range keys {
+		if f.has(k) {
+			t.Errorf("%s still cached", k)
+		}
+	}
+	if jobs, err := c.GetJobList(js.SessionID); err == nil {
+		t.Errorf("GetJobList() = %v after delete, want an error", jobs)
+	}
+}
+
+func TestDeleteSessionUnsupported(t *testing.T) {
+	_, rc := startRedis(t)
+	c := New(state.NewLocalState(0), rc, time.Minute)
+	js := addJob(c)
+	if err := c.DeleteSession(js.SessionID); !errors.Is(err, errors.ErrUnsupported) {
+		t.Errorf("DeleteSession() = %v, want errors.ErrUnsupported", err)
+	}
+	if _, err := c.GetJobList(js.SessionID); err != nil {
+		t.Errorf("session gone after an unsupported delete: %v", err)
+	}
+}
+
+func TestWatchSession(t *testing.T) {
+	_, rc := startRedis(t)
+	st := &watchingState{LocalState: state.NewLocalState(0), changed: make(chan struct{}, 1)}
+	c := New(st, rc, time.Minute)
+	ch := c.WatchSession(context.Background(), 1)
+	if ch == nil {
+		t.Fatal("WatchSession() = nil, want the state's watch")
+	}
+	st.changed <- struct{}{}
+	select {
+	case <-ch:
+	case <-time.After(time.Second):
+		t.Error("watch did not fire")
+	}
+
+	plain := New(state.NewLocalState(0), rc, time.Minute)
+	if ch := plain.WatchSession(context.Background(), 1); ch != nil {
+		t.Error("WatchSession() of a state without watches is not nil")
+	}
+}
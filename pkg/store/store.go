@@ -0,0 +1,92 @@
+// Package store keeps mrvaserver's own metadata -- saved repo lists,
+// templates and the like -- next to, but separate from, the commander's
+// ServerState.  It is a namespaced key/value store; feature packages keep
+// JSON documents in their own namespace.
+package store
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+)
+
+var ErrNotFound = errors.New("not found")
+
+// Entry is one key/value pair returned by List.
+type Entry struct {
+	Key   string
+	Value []byte
+}
+
+type Store interface {
+	// Get returns the value stored under ns/key, or ErrNotFound.
+	Get(ctx context.Context, ns, key string) ([]byte, error)
+
+	// Put stores value under ns/key, replacing any previous value.
+	Put(ctx context.Context, ns, key string, value []byte) error
+
+	// Delete removes ns/key.  Deleting a missing key is not an error.
+	Delete(ctx context.Context, ns, key string) error
+
+	// List returns the entries of ns whose keys start with prefix, ordered
+	// by key.
+	List(ctx context.Context, ns, prefix string) ([]Entry, error)
+
+	// Update atomically replaces the value under ns/key with fn's result.
+	// fn receives nil if the key is absent; returning nil deletes the key.
+	Update(ctx context.Context, ns, key string, fn func(old []byte) ([]byte, error)) error
+
+	Close()
+}
+
+// GetJSON decodes the value under ns/key into v.
+func GetJSON(ctx context.Context, s Store, ns, key string, v any) error {
+	data, err := s.Get(ctx, ns, key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
+
+// PutJSON stores v, JSON-encoded, under ns/key.
+func PutJSON(ctx context.Context, s Store, ns, key string, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return s.Put(ctx, ns, key, data)
+}
+
+// UpdateJSON is Update for JSON documents of type T.  fn receives the zero
+// value and found == false if the key is absent.
+func UpdateJSON[T any](ctx context.Context, s Store, ns, key string, fn func(v *T, found bool) error) error {
+	return s.Update(ctx, ns, key, func(old []byte) ([]byte, error) {
+		var v T
+		if old != nil {
+			if err := json.Unmarshal(old, &v); err != nil {
+				return nil, err
+			}
+		}
+		if err := fn(&v, old != nil); err != nil {
+			return nil, err
+		}
+		return json.Marshal(v)
+	})
+}
+
+// ListJSON decodes every entry of ns with the given key prefix.
+func ListJSON[T any](ctx context.Context, s Store, ns, prefix string) ([]T, error) {
+	entries, err := s.List(ctx, ns, prefix)
+	if err != nil {
+		return nil, err
+	}
+	out := make([]T, 0, len(entries))
+	for _, e := range entries {
+		var v T
+		if err := json.Unmarshal(e.Value, &v); err != nil {
+			return nil, err
+		}
+		out = append(out, v)
+	}
+	return out, nil
+}
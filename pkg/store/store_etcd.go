@@ -0,0 +1,84 @@
+package store
+
+import (
+	"context"
+	"strings"
+
+	"mrvaserver/pkg/etcd"
+)
+
+// EtcdStore keeps each ns/key under prefix + "kv/<ns>/<key>".  Update is
+// an optimistic transaction, retried if the key changes underneath it.
+type EtcdStore struct {
+	c      *etcd.Client
+	prefix string
+}
+
+func NewEtcdStore(c *etcd.Client, prefix string) *EtcdStore {
+	return &EtcdStore{c: c, prefix: prefix + "kv/"}
+}
+
+func (s *EtcdStore) key(ns, key string) string {
+	return s.prefix + ns + "/" + key
+}
+
+func (s *EtcdStore) Get(ctx context.Context, ns, key string) ([]byte, error) {
+	kv, err := s.c.Get(ctx, s.key(ns, key))
+	if err != nil {
+		return nil, err
+	}
+	if kv == nil {
+		return nil, ErrNotFound
+	}
+	return kv.Value, nil
+}
+
+func (s *EtcdStore) Put(ctx context.Context, ns, key string, value []byte) error {
+	return s.c.Put(ctx, s.key(ns, key), value, 0)
+}
+
+func (s *EtcdStore) Delete(ctx context.Context, ns, key string) error {
+	return s.c.Delete(ctx, s.key(ns, key))
+}
+
+func (s *EtcdStore) List(ctx context.Context, ns, prefix string) ([]Entry, error) {
+	kvs, err := s.c.List(ctx, s.key(ns, prefix), false)
+	if err != nil {
+		return nil, err
+	}
+	var entries []Entry
+	for _, kv := range kvs {
+		entries = append(entries, Entry{Key: strings.TrimPrefix(kv.Key, s.key(ns, "")), Value: kv.Value})
+	}
+	return entries, nil
+}
+
+func (s *EtcdStore) Update(ctx context.Context, ns, key string, fn func(old []byte) ([]byte, error)) error {
+	k := s.key(ns, key)
+	for {
+		kv, err := s.c.Get(ctx, k)
+		if err != nil {
+			return err
+		}
+		var old []byte
+		var rev int64
+		if kv != nil {
+			old, rev = kv.Value, kv.ModRevision
+		}
+
+		value, err := fn(old)
+		if err != nil {
+			return err
+		}
+		op := etcd.OpPut(k, value, 0)
+		if value == nil {
+			op = etcd.OpDelete(k)
+		}
+		ok, err := s.c.Txn(ctx, []etcd.Compare{etcd.ModRevisionIs(k, rev)}, []etcd.Op{op})
+		if err != nil || ok {
+			return err
+		}
+	}
+}
+
+func (s *EtcdStore) Close() {}
@@ -0,0 +1,82 @@
+package store
+
+import (
+	"context"
+	"sort"
+	"strings"
+	"sync"
+)
+
+type MemoryStore struct {
+	data  map[string]map[string][]byte
+	mutex sync.Mutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{data: make(map[string]map[string][]byte)}
+}
+
+func (s *MemoryStore) Get(ctx context.Context, ns, key string) ([]byte, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	v, ok := s.data[ns][key]
+	if !ok {
+		return nil, ErrNotFound
+	}
+	return append([]byte(nil), v...), nil
+}
+
+func (s *MemoryStore) Put(ctx context.Context, ns, key string, value []byte) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.put(ns, key, value)
+	return nil
+}
+
+func (s *MemoryStore) put(ns, key string, value []byte) {
+	if _, ok := s.data[ns]; !ok {
+		s.data[ns] = make(map[string][]byte)
+	}
+	s.data[ns][key] = append([]byte(nil), value...)
+}
+
+func (s *MemoryStore) Delete(ctx context.Context, ns, key string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	delete(s.data[ns], key)
+	return nil
+}
+
+func (s *MemoryStore) List(ctx context.Context, ns, prefix string) ([]Entry, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	var entries []Entry
+	for k, v := range s.data[ns] {
+		if strings.HasPrefix(k, prefix) {
+			entries = append(entries, Entry{Key: k, Value: append([]byte(nil), v...)})
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Key < entries[j].Key })
+	return entries, nil
+}
+
+func (s *MemoryStore) Update(ctx context.Context, ns, key string, fn func(old []byte) ([]byte, error)) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	old, ok := s.data[ns][key]
+	if ok {
+		old = append([]byte(nil), old...)
+	}
+	value, err := fn(old)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		delete(s.data[ns], key)
+		return nil
+	}
+	s.put(ns, key, value)
+	return nil
+}
+
+func (s *MemoryStore) Close() {}
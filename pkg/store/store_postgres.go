@@ -0,0 +1,147 @@
+package store
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+)
+
+const pgSchema = `
+CREATE TABLE IF NOT EXISTS mrvaserver_kv (
+	ns         text        NOT NULL,
+	key        text        NOT NULL,
+	value      bytea       NOT NULL,
+	updated_at timestamptz NOT NULL DEFAULT now(),
+	PRIMARY KEY (ns, key)
+)`
+
+type PostgresStore struct {
+	pool *pgxpool.Pool
+}
+
+// NewPostgresStore connects using dsn and creates the store's table if
+// needed.  An empty dsn uses the standard PG* environment variables.
+func NewPostgresStore(ctx context.Context, dsn string) (*PostgresStore, error) {
+	pool, err := pgxpool.New(ctx, dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	if _, err := pool.Exec(ctx, pgSchema); err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("failed to create store schema: %w", err)
+	}
+	slog.Info("Connected metadata store to postgres")
+	return &PostgresStore{pool: pool}, nil
+}
+
+// NewReadOnlyPostgresStore connects using dsn, which may be a hot standby,
+// without creating the store's table.  Its sessions are read-only, so
+// writes fail.
+func NewReadOnlyPostgresStore(ctx context.Context, dsn string) (*PostgresStore, error) {
+	cfg, err := pgxpool.ParseConfig(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse postgres DSN: %w", err)
+	}
+	cfg.ConnConfig.RuntimeParams["default_transaction_read_only"] = "on"
+	pool, err := pgxpool.NewWithConfig(ctx, cfg)
+	if err != nil {
+		return nil, fmt.Errorf("failed to connect to postgres: %w", err)
+	}
+	slog.Info("Connected read-only metadata store to postgres")
+	return &PostgresStore{pool: pool}, nil
+}
+
+func (s *PostgresStore) Get(ctx context.Context, ns, key string) ([]byte, error) {
+	var value []byte
+	err := s.pool.QueryRow(ctx,
+		`SELECT value FROM mrvaserver_kv WHERE ns = $1 AND key = $2`, ns, key).Scan(&value)
+	if errors.Is(err, pgx.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+	return value, err
+}
+
+func (s *PostgresStore) Put(ctx context.Context, ns, key string, value []byte) error {
+	_, err := s.pool.Exec(ctx, `
+		INSERT INTO mrvaserver_kv (ns, key, value) VALUES ($1, $2, $3)
+		ON CONFLICT (ns, key) DO UPDATE SET value = EXCLUDED.value, updated_at = now()`,
+		ns, key, value)
+	return err
+}
+
+func (s *PostgresStore) Delete(ctx context.Context, ns, key string) error {
+	_, err := s.pool.Exec(ctx, `DELETE FROM mrvaserver_kv WHERE ns = $1 AND key = $2`, ns, key)
+	return err
+}
+
+func (s *PostgresStore) List(ctx context.Context, ns, prefix string) ([]Entry, error) {
+	rows, err := s.pool.Query(ctx, `
+		SELECT key, value FROM mrvaserver_kv
+		WHERE ns = $1 AND left(key, length($2)) = $2
+		ORDER BY key`, ns, prefix)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var entries []Entry
+	for rows.Next() {
+		var e Entry
+		if err := rows.Scan(&e.Key, &e.Value); err != nil {
+			return nil, err
+		}
+		entries = append(entries, e)
+	}
+	return entries, rows.Err()
+}
+
+func (s *PostgresStore) Update(ctx context.Context, ns, key string, fn func(old []byte) ([]byte, error)) error {
+	tx, err := s.pool.Begin(ctx)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback(ctx)
+
+	// Row locks cannot protect a key that does not exist yet, so serialize
+	// on an advisory lock for the key instead.
+	if _, err := tx.Exec(ctx, `SELECT pg_advisory_xact_lock(hashtext($1 || '/' || $2))`, ns, key); err != nil {
+		return err
+	}
+
+	var old []byte
+	err = tx.QueryRow(ctx, `SELECT value FROM mrvaserver_kv WHERE ns = $1 AND key = $2`, ns, key).Scan(&old)
+	if err != nil && !errors.Is(err, pgx.ErrNoRows) {
+		return err
+	}
+
+	value, err := fn(old)
+	if err != nil {
+		return err
+	}
+	if value == nil {
+		_, err = tx.Exec(ctx, `DELETE FROM mrvaserver_kv WHERE ns = $1 AND key = $2`, ns, key)
+	} else {
+		_, err = tx.Exec(ctx, `
+			INSERT INTO mrvaserver_kv (ns, key, value) VALUES ($1, $2, $3)
+			ON CONFLICT (ns, key) DO UPDATE SET value = EXCLUDED.value, updated_at = now()`,
+			ns, key, value)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit(ctx)
+}
+
+func (s *PostgresStore) Close() {
+	s.pool.Close()
+}
+
+// ResetConnections closes the pooled connections, so that new ones dial
+// the database again.  Those in use close when they are released.
+func (s *PostgresStore) ResetConnections() {
+	s.pool.Reset()
+}
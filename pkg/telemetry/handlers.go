@@ -0,0 +1,71 @@
+package telemetry
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+// defaultLimit is how many repositories and predicates a report lists
+// without ?limit=.
+const defaultLimit = 20
+
+// Register adds the telemetry reports:
+//
+//	GET /variant-analyses/{id}/telemetry?limit=20           slowest repositories and predicates
+//	GET /variant-analyses/{id}/telemetry/{owner}/{repo}     one job's telemetry
+func (x *Reports) Register(r *mux.Router) {
+	r.HandleFunc("/variant-analyses/{id:[0-9]+}/telemetry", x.session).Methods(http.MethodGet)
+	r.HandleFunc("/variant-analyses/{id:[0-9]+}/telemetry/{owner}/{repo}", x.job).Methods(http.MethodGet)
+}
+
+func (x *Reports) session(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	limit := defaultLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			http.Error(w, "limit must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		limit = n
+	}
+	rep, err := x.Session(r.Context(), id, limit)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	v := reportView{Report: rep}
+	if v.Session, err = web.SessionName(r.Context(), id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, v)
+}
+
+// reportView is a Report as clients see it, the session named.
+type reportView struct {
+	Report
+	Session string `json:"session"`
+}
+
+func (x *Reports) job(w http.ResponseWriter, r *http.Request) {
+	vars := mux.Vars(r)
+	id, _ := strconv.Atoi(vars["id"])
+	js := common.JobSpec{SessionID: id, NameWithOwner: common.NameWithOwner{Owner: vars["owner"], Repo: vars["repo"]}}
+	j, err := x.Job(r.Context(), js)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "no telemetry for the repository", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, j)
+}
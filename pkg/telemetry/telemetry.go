@@ -0,0 +1,144 @@
+// Package telemetry keeps the query evaluation telemetry agents report
+// with their results (see agentproto.Telemetry), per job, and reports a
+// session's slowest repositories and predicates, for query authors
+// optimizing their queries.  Agents that do not collect telemetry leave it
+// out; their jobs are missing from the reports.
+package telemetry
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/store"
+)
+
+const ns = "query-telemetry" // session/owner/repo -> Job
+
+// maxPredicates bounds the predicates kept per job, the slowest ones.
+const maxPredicates = 100
+
+// Job is one repository's telemetry.
+type Job struct {
+	Repository string `json:"repository"`
+	agentproto.Telemetry
+}
+
+func key(js common.JobSpec) string {
+	return fmt.Sprintf("%d/%s/%s", js.SessionID, js.Owner, js.Repo)
+}
+
+// Record saves the telemetry of each result before next applies it.  A
+// later attempt's replaces an earlier one's.
+func Record(s store.Store, next agentproto.ResultHandler) agentproto.ResultHandler {
+	return func(r agentproto.Result) error {
+		if r.Telemetry == nil {
+			return next(r)
+		}
+		j := Job{Repository: r.Spec.Owner + "/" + r.Spec.Repo, Telemetry: *r.Telemetry}
+		j.Predicates = append([]agentproto.PredicateTiming(nil), j.Predicates...)
+		sort.SliceStable(j.Predicates, func(a, b int) bool { return j.Predicates[a].Seconds > j.Predicates[b].Seconds })
+		j.Predicates = j.Predicates[:min(len(j.Predicates), maxPredicates)]
+		if err := store.PutJSON(context.Background(), s, ns, key(r.Spec), j); err != nil {
+			return fmt.Errorf("failed to record query telemetry: %w", err)
+		}
+		return next(r)
+	}
+}
+
+// Report sums up a session's telemetry.  Repositories lists the slowest
+// jobs, by wall-clock time, and Predicates the predicates that took
+// longest over all jobs.
+type Report struct {
+	Session      int          `json:"session"`
+	Jobs         int          `json:"jobs"`
+	WallSeconds  float64      `json:"wall_seconds"`
+	CPUSeconds   float64      `json:"cpu_seconds"`
+	Tuples       int64        `json:"tuples"`
+	Repositories []Repository `json:"slowest_repositories"`
+	Predicates   []Predicate  `json:"slowest_predicates"`
+}
+
+type Repository struct {
+	Repository  string  `json:"repository"`
+	WallSeconds float64 `json:"wall_seconds"`
+	CPUSeconds  float64 `json:"cpu_seconds,omitempty"`
+	Tuples      int64   `json:"tuples,omitempty"`
+}
+
+// Predicate is one predicate over a session's jobs: its total evaluation
+// time, and the repository where it took longest.
+type Predicate struct {
+	Name              string  `json:"name"`
+	Seconds           float64 `json:"seconds"`
+	Tuples            int64   `json:"tuples,omitempty"`
+	Repositories      int     `json:"repositories"`
+	MaxSeconds        float64 `json:"max_seconds"`
+	SlowestRepository string  `json:"slowest_repository"`
+}
+
+// Reports reads the telemetry of a session's jobs.
+type Reports struct {
+	store store.Store
+}
+
+func New(s store.Store) *Reports {
+	return &Reports{store: s}
+}
+
+// Job returns a job's telemetry.
+func (x *Reports) Job(ctx context.Context, js common.JobSpec) (Job, error) {
+	var j Job
+	err := store.GetJSON(ctx, x.store, ns, key(js), &j)
+	return j, err
+}
+
+// Session reports on a session, with up to limit repositories and
+// predicates.
+func (x *Reports) Session(ctx context.Context, session, limit int) (Report, error) {
+	jobs, err := store.ListJSON[Job](ctx, x.store, ns, strconv.Itoa(session)+"/")
+	if err != nil {
+		return Report{}, err
+	}
+	rep := Report{Session: session, Jobs: len(jobs), Repositories: []Repository{}, Predicates: []Predicate{}}
+	preds := make(map[string]*Predicate)
+	for _, j := range jobs {
+		rep.WallSeconds += j.WallSeconds
+		rep.CPUSeconds += j.CPUSeconds
+		rep.Tuples += j.Tuples
+		rep.Repositories = append(rep.Repositories, Repository{Repository: j.Repository,
+			WallSeconds: j.WallSeconds, CPUSeconds: j.CPUSeconds, Tuples: j.Tuples})
+		for _, pt := range j.Predicates {
+			p := preds[pt.Name]
+			if p == nil {
+				p = &Predicate{Name: pt.Name}
+				preds[pt.Name] = p
+			}
+			p.Seconds += pt.Seconds
+			p.Tuples += pt.Tuples
+			p.Repositories++
+			if pt.Seconds > p.MaxSeconds || p.SlowestRepository == "" {
+				p.MaxSeconds, p.SlowestRepository = pt.Seconds, j.Repository
+			}
+		}
+	}
+	sort.SliceStable(rep.Repositories, func(a, b int) bool {
+		return rep.Repositories[a].WallSeconds > rep.Repositories[b].WallSeconds
+	})
+	rep.Repositories = rep.Repositories[:min(len(rep.Repositories), limit)]
+	for _, p := range preds {
+		rep.Predicates = append(rep.Predicates, *p)
+	}
+	sort.Slice(rep.Predicates, func(a, b int) bool {
+		pa, pb := rep.Predicates[a], rep.Predicates[b]
+		if pa.Seconds != pb.Seconds {
+			return pa.Seconds > pb.Seconds
+		}
+		return pa.Name < pb.Name
+	})
+	rep.Predicates = rep.Predicates[:min(len(rep.Predicates), limit)]
+	return rep, nil
+}
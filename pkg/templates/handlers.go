@@ -0,0 +1,107 @@
+package templates
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+// Register adds the CRUD endpoints for repo lists and templates.
+func (t *Templates) Register(r *mux.Router) {
+	r.HandleFunc("/repo-lists", t.listRepoLists).Methods(http.MethodGet)
+	r.HandleFunc("/repo-lists/{name}", t.getRepoList).Methods(http.MethodGet)
+	r.HandleFunc("/repo-lists/{name}", t.putRepoList).Methods(http.MethodPut)
+	r.HandleFunc("/repo-lists/{name}", t.deleteHandler(nsRepoLists)).Methods(http.MethodDelete)
+
+	r.HandleFunc("/templates", t.listTemplates).Methods(http.MethodGet)
+	r.HandleFunc("/templates/{name}", t.getTemplate).Methods(http.MethodGet)
+	r.HandleFunc("/templates/{name}", t.putTemplate).Methods(http.MethodPut)
+	r.HandleFunc("/templates/{name}", t.deleteHandler(nsTemplates)).Methods(http.MethodDelete)
+}
+
+func (t *Templates) listRepoLists(w http.ResponseWriter, r *http.Request) {
+	lists, err := store.ListJSON[RepoList](r.Context(), t.store, nsRepoLists, "")
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, lists)
+}
+
+func (t *Templates) getRepoList(w http.ResponseWriter, r *http.Request) {
+	l, err := t.RepoList(r.Context(), mux.Vars(r)["name"])
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, l)
+}
+
+func (t *Templates) putRepoList(w http.ResponseWriter, r *http.Request) {
+	var l RepoList
+	if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	l.Name = mux.Vars(r)["name"]
+	l.UpdatedAt = now()
+	if err := l.validate(); err != nil {
+		web.Fail(w, err, http.StatusBadRequest)
+		return
+	}
+	if err := store.PutJSON(r.Context(), t.store, nsRepoLists, l.Name, l); err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, l)
+}
+
+func (t *Templates) listTemplates(w http.ResponseWriter, r *http.Request) {
+	tpls, err := store.ListJSON[Template](r.Context(), t.store, nsTemplates, "")
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, tpls)
+}
+
+func (t *Templates) getTemplate(w http.ResponseWriter, r *http.Request) {
+	tpl, err := t.Template(r.Context(), mux.Vars(r)["name"])
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, tpl)
+}
+
+func (t *Templates) putTemplate(w http.ResponseWriter, r *http.Request) {
+	var tpl Template
+	if err := json.NewDecoder(r.Body).Decode(&tpl); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tpl.Name = mux.Vars(r)["name"]
+	tpl.UpdatedAt = now()
+	if err := tpl.validate(); err != nil {
+		web.Fail(w, err, http.StatusBadRequest)
+		return
+	}
+	if err := store.PutJSON(r.Context(), t.store, nsTemplates, tpl.Name, tpl); err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, tpl)
+}
+
+func (t *Templates) deleteHandler(ns string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if err := t.store.Delete(r.Context(), ns, mux.Vars(r)["name"]); err != nil {
+			web.Fail(w, err, http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
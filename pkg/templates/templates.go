@@ -0,0 +1,185 @@
+// Package templates keeps named repository lists and submission templates,
+// and expands references to them in variant analysis submissions.
+//
+// A submission may name a template and any number of repository lists in
+// addition to, or instead of, the usual fields:
+//
+//	{"template": "nightly-cpp", "repository_lists": ["top-1000"], ...}
+//
+// The template supplies the language and query pack when the submission
+// omits them, and its repository limit is enforced after expansion.
+package templates
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const (
+	nsRepoLists = "repo-lists"
+	nsTemplates = "templates"
+)
+
+var validName = regexp.MustCompile(`^[A-Za-z0-9][A-Za-z0-9._-]*$`)
+
+// RepoList is a saved, named list of owner/repo entries.
+type RepoList struct {
+	Name         string   `json:"name"`
+	Description  string   `json:"description,omitempty"`
+	Repositories []string `json:"repositories"`
+	UpdatedAt    string   `json:"updated_at"`
+}
+
+// Template holds submission defaults.  QueryPack is the same base64 gzipped
+// tar a submission carries.
+type Template struct {
+	Name            string   `json:"name"`
+	Description     string   `json:"description,omitempty"`
+	Language        string   `json:"language,omitempty"`
+	QueryPack       string   `json:"query_pack,omitempty"`
+	RepositoryLists []string `json:"repository_lists,omitempty"`
+	Repositories    []string `json:"repositories,omitempty"`
+	MaxRepositories int      `json:"max_repositories,omitempty"`
+	UpdatedAt       string   `json:"updated_at"`
+}
+
+type Templates struct {
+	store store.Store
+}
+
+func New(s store.Store) *Templates {
+	return &Templates{store: s}
+}
+
+func (t *Templates) RepoList(ctx context.Context, name string) (RepoList, error) {
+	var l RepoList
+	err := store.GetJSON(ctx, t.store, nsRepoLists, name, &l)
+	if errors.Is(err, store.ErrNotFound) {
+		return l, web.Msg(http.StatusNotFound, "", "templates.unknown_list", messages.Params{"name": name})
+	}
+	return l, err
+}
+
+func (t *Templates) Template(ctx context.Context, name string) (Template, error) {
+	var tpl Template
+	err := store.GetJSON(ctx, t.store, nsTemplates, name, &tpl)
+	if errors.Is(err, store.ErrNotFound) {
+		return tpl, web.Msg(http.StatusNotFound, "", "templates.unknown", messages.Params{"name": name})
+	}
+	return tpl, err
+}
+
+// SubmitHook expands "template" and "repository_lists" references.
+func (t *Templates) SubmitHook(r *http.Request, sub *gateway.Submission) error {
+	ctx := r.Context()
+
+	var listNames []string
+	if _, err := sub.TakeExtra("repository_lists", &listNames); err != nil {
+		return err
+	}
+
+	var tplName string
+	found, err := sub.TakeExtra("template", &tplName)
+	if err != nil {
+		return err
+	}
+	maxRepos := 0
+	if found {
+		tpl, err := t.Template(ctx, tplName)
+		if err != nil {
+			return err
+		}
+		if sub.Msg.Language == "" {
+			sub.Msg.Language = tpl.Language
+		} else if tpl.Language != "" && tpl.Language != sub.Msg.Language {
+			return web.Msg(http.StatusBadRequest, "", "templates.language_conflict", messages.Params{
+				"language": sub.Msg.Language, "template": tpl.Name, "template_language": tpl.Language})
+		}
+		if sub.Msg.QueryPack == "" {
+			sub.Msg.QueryPack = tpl.QueryPack
+		}
+		sub.Msg.Repositories = append(sub.Msg.Repositories, tpl.Repositories...)
+		listNames = append(tpl.RepositoryLists, listNames...)
+		maxRepos = tpl.MaxRepositories
+	}
+
+	for _, name := range listNames {
+		l, err := t.RepoList(ctx, name)
+		if err != nil {
+			return err
+		}
+		sub.Msg.Repositories = append(sub.Msg.Repositories, l.Repositories...)
+	}
+	sub.Msg.Repositories = dedup(sub.Msg.Repositories)
+
+	if maxRepos > 0 && len(sub.Msg.Repositories) > maxRepos {
+		return web.Msg(http.StatusBadRequest, "", "templates.too_many_repositories",
+			messages.Params{"n": len(sub.Msg.Repositories), "max": maxRepos, "template": tplName})
+	}
+	return nil
+}
+
+func dedup(repos []string) []string {
+	seen := make(map[string]bool, len(repos))
+	out := repos[:0]
+	for _, r := range repos {
+		if !seen[r] {
+			seen[r] = true
+			out = append(out, r)
+		}
+	}
+	return out
+}
+
+func checkName(name string) error {
+	if !validName.MatchString(name) {
+		return web.Msg(http.StatusBadRequest, "", "templates.invalid_name", messages.Params{"name": name})
+	}
+	return nil
+}
+
+func checkRepositories(repos []string) error {
+	for _, r := range repos {
+		owner, repo, ok := strings.Cut(r, "/")
+		if !ok || owner == "" || repo == "" || strings.Contains(repo, "/") {
+			return web.Msg(http.StatusBadRequest, "", "templates.invalid_repository", messages.Params{"entry": r})
+		}
+	}
+	return nil
+}
+
+func now() string {
+	return time.Now().Format(time.RFC3339)
+}
+
+func (l *RepoList) validate() error {
+	if err := checkName(l.Name); err != nil {
+		return err
+	}
+	return checkRepositories(l.Repositories)
+}
+
+func (tpl *Template) validate() error {
+	if err := checkName(tpl.Name); err != nil {
+		return err
+	}
+	for _, name := range tpl.RepositoryLists {
+		if err := checkName(name); err != nil {
+			return fmt.Errorf("repository_lists: %w", err)
+		}
+	}
+	if tpl.MaxRepositories < 0 {
+		return web.Msg(http.StatusBadRequest, "", "templates.negative_max", nil)
+	}
+	return checkRepositories(tpl.Repositories)
+}
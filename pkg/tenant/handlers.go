@@ -0,0 +1,24 @@
+package tenant
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/web"
+)
+
+// RegisterAdmin adds GET /admin/tenants/{tenant}/settings, the settings that
+// apply to a tenant and which of them are its own.  The settings are
+// declared at /admin/resources/tenant-settings.
+func (t *Tenants) RegisterAdmin(r *mux.Router) {
+	r.HandleFunc("/admin/tenants/{tenant}/settings", t.get).Methods(http.MethodGet)
+}
+
+func (t *Tenants) get(w http.ResponseWriter, r *http.Request) {
+	s, err := t.For(r.Context(), mux.Vars(r)["tenant"])
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, s)
+}
@@ -0,0 +1,302 @@
+// Package tenant layers settings over the server's configuration for
+// individual tenants, identities as web.Identity gives them.  A tenant's
+// settings are declared as resources (see package resources) and replace,
+// for that tenant alone, the configured or declared setting of the same
+// kind:
+//
+//   - retention, the age at which the tenant's sessions are deleted, in
+//     place of the retention policies;
+//   - max_repositories, in place of sessions.max_repositories, which it may
+//     raise as well as lower;
+//   - session_cap and user_cap, in place of usage.session_cap and
+//     usage.user_cap or a quota's storage limit;
+//   - languages, the only query languages the tenant may submit in, in
+//     place of tenants.languages;
+//   - trackers, the issue trackers the tenant may file findings to, in
+//     place of the trackers' own clients lists;
+//   - webhook and notify, where the tenant's sessions are reported as
+//     they complete and which of them, in place of
+//     notifications.webhook and notifications.notify.
+//
+// A setting left out leaves the server's in place.  Where several resources
+// name a tenant they are applied in the order of their IDs, later ones
+// replacing the settings earlier ones make.  Sessions are attributed to
+// the tenant that submitted them as they are created.
+package tenant
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/notify"
+	"mrvaserver/pkg/resources"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+// Kind is the kind of tenant settings.
+const Kind = "tenant-settings"
+
+const nsOwners = "session-tenants" // session -> owner
+
+// Spec is a tenant's declared settings.
+type Spec struct {
+	Tenant          string   `json:"tenant"`
+	Retention       string   `json:"retention,omitempty"`
+	MaxRepositories int      `json:"max_repositories,omitempty"`
+	SessionCap      int64    `json:"session_cap,omitempty"`
+	UserCap         int64    `json:"user_cap,omitempty"`
+	Languages       []string `json:"languages,omitempty"`
+	Trackers        []string `json:"trackers,omitempty"`
+	Webhook         string   `json:"webhook,omitempty"`
+	Notify          string   `json:"notify,omitempty"`
+}
+
+func check(id string, spec *Spec) error {
+	switch {
+	case spec.Tenant == "" || strings.TrimSpace(spec.Tenant) != spec.Tenant:
+		return fmt.Errorf("tenant is required, without surrounding spaces")
+	case spec.MaxRepositories < 0 || spec.SessionCap < 0 || spec.UserCap < 0:
+		return fmt.Errorf("limits must not be negative")
+	}
+	if spec.Webhook != "" {
+		if u, err := url.Parse(spec.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("webhook must be an http or https URL")
+		}
+	}
+	switch spec.Notify {
+	case "", notify.All, notify.Failures, notify.None:
+	default:
+		return fmt.Errorf("notify must be all, failures or none")
+	}
+	if spec.Retention != "" {
+		d, err := time.ParseDuration(spec.Retention)
+		if err != nil {
+			return fmt.Errorf("retention: %w", err)
+		}
+		if d < time.Hour {
+			return fmt.Errorf("retention must be at least 1h")
+		}
+	}
+	return nil
+}
+
+// Settings are the settings that apply to a tenant.  Overrides names
+// those that come from the tenant's own.  A zero limit is none.
+type Settings struct {
+	Tenant          string   `json:"tenant"`
+	Retention       string   `json:"retention,omitempty"`
+	MaxRepositories int      `json:"max_repositories"`
+	SessionCap      int64    `json:"session_cap"`
+	UserCap         int64    `json:"user_cap"`
+	Languages       []string `json:"languages,omitempty"`
+	Trackers        []string `json:"trackers,omitempty"`
+	Webhook         string   `json:"webhook,omitempty"`
+	Notify          string   `json:"notify"`
+	Overrides       []string `json:"overrides"`
+}
+
+func (s *Settings) overridden(name string) bool {
+	return slices.Contains(s.Overrides, name)
+}
+
+type owner struct {
+	Session int    `json:"session"`
+	Tenant  string `json:"tenant"`
+}
+
+type Tenants struct {
+	defaults  Settings
+	resources *resources.Registry
+	store     store.Store
+}
+
+// New defines the tenant settings kind in reg, over the settings of cfg.
+// Sessions' tenants are recorded in s.
+func New(cfg *config.Config, reg *resources.Registry, s store.Store) *Tenants {
+	reg.Define(resources.NewKind(Kind, "Per-tenant retention, limits, languages, issue trackers and notifications.", check))
+	return &Tenants{
+		defaults: Settings{
+			MaxRepositories: cfg.Sessions.MaxRepositories,
+			SessionCap:      cfg.Usage.SessionCap,
+			UserCap:         cfg.Usage.UserCap,
+			Languages:       cfg.Tenants.Languages,
+			Webhook:         cfg.Notifications.Webhook,
+			Notify:          cfg.Notifications.Notify,
+		},
+		resources: reg,
+		store:     s,
+	}
+}
+
+// For returns the settings that apply to tenant.
+func (t *Tenants) For(ctx context.Context, tenant string) (Settings, error) {
+	specs, err := resources.Specs[Spec](ctx, t.resources, Kind)
+	if err != nil {
+		return Settings{}, err
+	}
+	ids := make([]string, 0, len(specs))
+	for id, s := range specs {
+		if s.Tenant == tenant {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	out := t.defaults
+	out.Tenant, out.Overrides = tenant, []string{}
+	set := func(name string) {
+		if !out.overridden(name) {
+			out.Overrides = append(out.Overrides, name)
+		}
+	}
+	for _, id := range ids {
+		s := specs[id]
+		if s.Retention != "" {
+			out.Retention = s.Retention
+			set("retention")
+		}
+		if s.MaxRepositories > 0 {
+			out.MaxRepositories = s.MaxRepositories
+			set("max_repositories")
+		}
+		if s.SessionCap > 0 {
+			out.SessionCap = s.SessionCap
+			set("session_cap")
+		}
+		if s.UserCap > 0 {
+			out.UserCap = s.UserCap
+			set("user_cap")
+		}
+		if s.Languages != nil {
+			out.Languages = s.Languages
+			set("languages")
+		}
+		if s.Trackers != nil {
+			out.Trackers = s.Trackers
+			set("trackers")
+		}
+		if s.Webhook != "" {
+			out.Webhook = s.Webhook
+			set("webhook")
+		}
+		if s.Notify != "" {
+			out.Notify = s.Notify
+			set("notify")
+		}
+	}
+	return out, nil
+}
+
+// override returns the setting name of tenant if the tenant's own
+// settings make it.  Settings that cannot be read make none.
+func override[T any](ctx context.Context, t *Tenants, tenant, name string, get func(Settings) T) (T, bool) {
+	var zero T
+	if tenant == "" {
+		return zero, false
+	}
+	s, err := t.For(ctx, tenant)
+	if err != nil || !s.overridden(name) {
+		return zero, false
+	}
+	return get(s), true
+}
+
+// UserCap is the storage cap of user, if the user's settings set one.
+func (t *Tenants) UserCap(ctx context.Context, user string) (int64, bool) {
+	return override(ctx, t, user, "user_cap", func(s Settings) int64 { return s.UserCap })
+}
+
+// SessionCap is the storage cap of each of user's sessions, if the user's
+// settings set one.
+func (t *Tenants) SessionCap(ctx context.Context, user string) (int64, bool) {
+	return override(ctx, t, user, "session_cap", func(s Settings) int64 { return s.SessionCap })
+}
+
+// Trackers returns the issue trackers client may file to, if the client's
+// settings name them.
+func (t *Tenants) Trackers(ctx context.Context, client string) ([]string, bool) {
+	return override(ctx, t, client, "trackers", func(s Settings) []string { return s.Trackers })
+}
+
+// Notifications returns where the sessions of tenant are reported as they
+// complete, and which of them.
+func (t *Tenants) Notifications(ctx context.Context, tenant string) (notify.Target, error) {
+	s, err := t.For(ctx, tenant)
+	if err != nil {
+		return notify.Target{}, err
+	}
+	return notify.Target{Webhook: s.Webhook, Notify: s.Notify}, nil
+}
+
+// Retention returns how long the sessions of session's tenant are kept,
+// if the tenant's settings say, and the tenant.
+func (t *Tenants) Retention(ctx context.Context, session int) (time.Duration, string, bool) {
+	tenant, err := t.Owner(ctx, session)
+	if err != nil {
+		return 0, "", false
+	}
+	r, ok := override(ctx, t, tenant, "retention", func(s Settings) string { return s.Retention })
+	if !ok {
+		return 0, "", false
+	}
+	d, err := time.ParseDuration(r)
+	return d, tenant, err == nil
+}
+
+// Owner returns the tenant that submitted session, "" if unknown, such as
+// for sessions submitted before tenants were recorded.
+func (t *Tenants) Owner(ctx context.Context, session int) (string, error) {
+	var o owner
+	err := store.GetJSON(ctx, t.store, nsOwners, strconv.Itoa(session), &o)
+	if errors.Is(err, store.ErrNotFound) {
+		return "", nil
+	}
+	return o.Tenant, err
+}
+
+// Private reports whether session is an authenticated tenant's, whose
+// downloads caches must not keep, or may be.
+func (t *Tenants) Private(ctx context.Context, session int) bool {
+	owner, err := t.Owner(ctx, session)
+	return err != nil || strings.HasPrefix(owner, "user:")
+}
+
+// SubmitHook rejects submissions in languages the submitter may not use,
+// applies the submitter's repository limit, and records the submitter as
+// the tenant of the new sessions.
+func (t *Tenants) SubmitHook(r *http.Request, sub *gateway.Submission) error {
+	tenant := web.Identity(r)
+	s, err := t.For(r.Context(), tenant)
+	if err != nil {
+		return web.Errorf(http.StatusServiceUnavailable, "failed to read tenant settings: %v", err)
+	}
+	if len(s.Languages) > 0 && !slices.Contains(s.Languages, sub.Msg.Language) {
+		return web.Msg(http.StatusForbidden, apierr.Forbidden, "tenant.language_not_allowed",
+			messages.Params{"language": sub.Msg.Language, "languages": strings.Join(s.Languages, ", ")})
+	}
+	if s.overridden("max_repositories") {
+		sub.MaxRepositories = s.MaxRepositories
+	}
+	sub.After(func() {
+		for _, id := range sub.Sessions() {
+			o := owner{Session: id, Tenant: tenant}
+			if err := store.PutJSON(context.Background(), t.store, nsOwners, strconv.Itoa(id), o); err != nil {
+				slog.Warn("Failed to record session tenant", "session", id, "error", err)
+			}
+		}
+	})
+	return nil
+}
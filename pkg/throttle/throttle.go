@@ -0,0 +1,228 @@
+// Package throttle limits the bandwidth of artifact and database transfers,
+// so a large MRVA run does not saturate the network link it shares with
+// everything else in the hosting environment.  Transfers are charged to a
+// direction -- ingress for bytes the server receives, egress for bytes it
+// sends -- and, when known, to the session they belong to.  Each direction
+// has a global limit and a limit per session; a transfer goes as fast as
+// the stricter of the two allows.  Limits are per replica.
+package throttle
+
+import (
+	"context"
+	"io"
+	"sync"
+	"time"
+
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/metrics"
+)
+
+type Direction int
+
+const (
+	Ingress Direction = iota
+	Egress
+)
+
+func (d Direction) String() string {
+	if d == Ingress {
+		return "ingress"
+	}
+	return "egress"
+}
+
+// chunk is the most a reader or writer transfers per wait, keeping the
+// rate smooth for large buffers.
+const chunk = 32 << 10
+
+// sessionIdle is how long an unused session limiter is kept.
+const sessionIdle = 10 * time.Minute
+
+var (
+	transferredBytes = metrics.NewCounterVec("mrvaserver_bandwidth_bytes_total",
+		"Bytes of artifact and database transfers, by direction.", "direction")
+	throttledSeconds = metrics.NewCounterVec("mrvaserver_bandwidth_throttled_seconds_total",
+		"Time transfers spent waiting for bandwidth, by direction.", "direction")
+)
+
+// Limiter is a token bucket of bytes holding at most one second's worth.
+// Transfers may overdraw it; the debt is paid off by waiting.  A nil
+// Limiter is unlimited.
+type Limiter struct {
+	rate float64
+
+	mu     sync.Mutex
+	tokens float64
+	last   time.Time
+}
+
+// NewLimiter returns a limiter of bytesPerSecond, or nil if it is 0.
+func NewLimiter(bytesPerSecond int64) *Limiter {
+	if bytesPerSecond <= 0 {
+		return nil
+	}
+	return &Limiter{rate: float64(bytesPerSecond), tokens: float64(bytesPerSecond), last: time.Now()}
+}
+
+// reserve takes n bytes and returns how long to wait before using them.
+func (l *Limiter) reserve(n int) time.Duration {
+	if l == nil {
+		return 0
+	}
+	now := time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.tokens = min(l.rate, l.tokens+now.Sub(l.last).Seconds()*l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	if l.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-l.tokens / l.rate * float64(time.Second))
+}
+
+type sessionKey struct {
+	dir     Direction
+	session int
+}
+
+type sessionLimiter struct {
+	*Limiter
+	used time.Time
+}
+
+// Throttle applies the configured limits.  A nil Throttle is unlimited.
+type Throttle struct {
+	cfg    config.Bandwidth
+	global [2]*Limiter
+
+	mu       sync.Mutex
+	sessions map[sessionKey]*sessionLimiter
+	swept    time.Time
+}
+
+func New(cfg config.Bandwidth) *Throttle {
+	return &Throttle{
+		cfg:      cfg,
+		global:   [2]*Limiter{NewLimiter(cfg.Ingress.Global), NewLimiter(cfg.Egress.Global)},
+		sessions: make(map[sessionKey]*sessionLimiter),
+		swept:    time.Now(),
+	}
+}
+
+func (t *Throttle) perSession(dir Direction) int64 {
+	if dir == Ingress {
+		return t.cfg.Ingress.PerSession
+	}
+	return t.cfg.Egress.PerSession
+}
+
+// session returns the limiter of a session, or nil for unknown sessions
+// (0) and unlimited directions.
+func (t *Throttle) session(dir Direction, session int) *Limiter {
+	rate := t.perSession(dir)
+	if session == 0 || rate <= 0 {
+		return nil
+	}
+	now := time.Now()
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if now.Sub(t.swept) > sessionIdle {
+		t.swept = now
+		for k, sl := range t.sessions {
+			if now.Sub(sl.used) > sessionIdle {
+				delete(t.sessions, k)
+			}
+		}
+	}
+	key := sessionKey{dir, session}
+	sl, ok := t.sessions[key]
+	if !ok {
+		sl = &sessionLimiter{Limiter: NewLimiter(rate)}
+		t.sessions[key] = sl
+	}
+	sl.used = now
+	return sl.Limiter
+}
+
+// Wait charges n bytes transferred for session (0 if unknown) and blocks
+// until the limits allow them or ctx is done.
+func (t *Throttle) Wait(ctx context.Context, dir Direction, session, n int) error {
+	if t == nil || n <= 0 {
+		return nil
+	}
+	transferredBytes.With(dir.String()).Add(float64(n))
+	delay := max(t.global[dir].reserve(n), t.session(dir, session).reserve(n))
+	if delay <= 0 {
+		return nil
+	}
+	throttledSeconds.With(dir.String()).Add(delay.Seconds())
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// Reader returns r limited for session.
+func (t *Throttle) Reader(ctx context.Context, dir Direction, session int, r io.Reader) io.Reader {
+	if t == nil {
+		return r
+	}
+	return &reader{t: t, ctx: ctx, dir: dir, session: session, r: r}
+}
+
+// Writer returns w limited for session.
+func (t *Throttle) Writer(ctx context.Context, dir Direction, session int, w io.Writer) io.Writer {
+	if t == nil {
+		return w
+	}
+	return &writer{t: t, ctx: ctx, dir: dir, session: session, w: w}
+}
+
+type reader struct {
+	t       *Throttle
+	ctx     context.Context
+	dir     Direction
+	session int
+	r       io.Reader
+}
+
+func (r *reader) Read(p []byte) (int, error) {
+	if len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := r.r.Read(p)
+	if werr := r.t.Wait(r.ctx, r.dir, r.session, n); werr != nil && err == nil {
+		err = werr
+	}
+	return n, err
+}
+
+type writer struct {
+	t       *Throttle
+	ctx     context.Context
+	dir     Direction
+	session int
+	w       io.Writer
+}
+
+func (w *writer) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		n := min(len(p), chunk)
+		if err := w.t.Wait(w.ctx, w.dir, w.session, n); err != nil {
+			return written, err
+		}
+		m, err := w.w.Write(p[:n])
+		written += m
+		if err != nil {
+			return written, err
+		}
+		p = p[n:]
+	}
+	return written, nil
+}
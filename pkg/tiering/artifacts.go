@@ -0,0 +1,91 @@
+package tiering
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/artifactstream"
+)
+
+// Artifacts is an artifactstore.Store that recalls moved artifacts before
+// reading them from base, and touches the sessions it saves for.
+type Artifacts struct {
+	t    *Tierer
+	base artifactstore.Store
+}
+
+func NewArtifacts(t *Tierer, base artifactstore.Store) *Artifacts {
+	return &Artifacts{t: t, base: base}
+}
+
+func (a *Artifacts) GetQueryPack(loc artifactstore.ArtifactLocation) ([]byte, error) {
+	if err := a.t.Recall(context.Background(), loc); err != nil {
+		return nil, err
+	}
+	return a.base.GetQueryPack(loc)
+}
+
+func (a *Artifacts) SaveQueryPack(session int, data []byte) (artifactstore.ArtifactLocation, error) {
+	a.t.Touch(session)
+	return a.base.SaveQueryPack(session, data)
+}
+
+func (a *Artifacts) GetResult(loc artifactstore.ArtifactLocation) ([]byte, error) {
+	if err := a.t.Recall(context.Background(), loc); err != nil {
+		return nil, err
+	}
+	return a.base.GetResult(loc)
+}
+
+func (a *Artifacts) OpenResult(loc artifactstore.ArtifactLocation) (io.ReadCloser, int64, error) {
+	if err := a.t.Recall(context.Background(), loc); err != nil {
+		return nil, 0, err
+	}
+	return artifactstream.Open(a.base, loc)
+}
+
+func (a *Artifacts) GetResultSize(loc artifactstore.ArtifactLocation) (int, error) {
+	if err := a.t.Recall(context.Background(), loc); err != nil {
+		return 0, err
+	}
+	return a.base.GetResultSize(loc)
+}
+
+func (a *Artifacts) SaveResult(js common.JobSpec, data []byte) (artifactstore.ArtifactLocation, error) {
+	a.t.Touch(js.SessionID)
+	return a.base.SaveResult(js, data)
+}
+
+// HandleResult touches the session of every result.
+func (t *Tierer) HandleResult(next agentproto.ResultHandler) agentproto.ResultHandler {
+	return func(r agentproto.Result) error {
+		t.Touch(r.Spec.SessionID)
+		return next(r)
+	}
+}
+
+var sessionPath = regexp.MustCompile(`/variant-analyses/(\d+)`)
+
+// Middleware touches the session of status and artifact requests.
+func (t *Tierer) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p := r.URL.Path
+		if m := sessionPath.FindStringSubmatch(p); m != nil {
+			if id, err := strconv.Atoi(m[1]); err == nil {
+				t.Touch(id)
+			}
+		} else if enc, ok := strings.CutPrefix(p, "/download/"); ok {
+			if js, err := common.DecodeJobSpec(enc); err == nil {
+				t.Touch(js.SessionID)
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,234 @@
+// Package tiering moves the artifacts of sessions nobody has touched in a
+// while to a cheaper bucket or storage class.  A session is touched when
+// it is created, when its results arrive and when its status or artifacts
+// are requested.  A periodic pass moves the query pack and results of
+// sessions untouched for long enough; reading a moved artifact moves it
+// back first, so the state's artifact locations never change.
+//
+// Content-addressed artifacts are shared between sessions and stay where
+// they are.  Sessions are tracked from when tiering is enabled.
+package tiering
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/state"
+	"github.com/minio/minio-go/v7"
+	"mrvaserver/pkg/background"
+	"mrvaserver/pkg/cas"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/store"
+)
+
+const (
+	nsAccess = "session-access"
+	nsTiered = "tiered-artifacts"
+)
+
+// touchEvery is how often a session's access time is written while it is
+// in use.
+const touchEvery = time.Hour
+
+var (
+	movedTotal = metrics.NewCounter("mrvaserver_tiering_moved_total",
+		"Artifacts moved to the cold tier.")
+	recalledTotal = metrics.NewCounter("mrvaserver_tiering_recalled_total",
+		"Artifacts moved back from the cold tier on access.")
+)
+
+// Access records when a session was last touched.
+type Access struct {
+	Session    int       `json:"session"`
+	LastAccess time.Time `json:"last_access"`
+	Tiered     bool      `json:"tiered,omitempty"`
+}
+
+// Tiered records where a moved artifact went.
+type Tiered struct {
+	Session int       `json:"session"`
+	Bucket  string    `json:"bucket"`
+	Key     string    `json:"key"`
+	Moved   time.Time `json:"moved"`
+}
+
+type Tierer struct {
+	cfg   config.Tiering
+	mc    *minio.Client
+	meta  store.Store
+	state state.ServerState
+
+	mu      sync.Mutex
+	touched map[int]time.Time
+}
+
+// New returns a tierer moving artifacts of mc into cfg.Bucket, creating
+// the bucket if needed.
+func New(cfg config.Tiering, mc *minio.Client, meta store.Store, st state.ServerState) (*Tierer, error) {
+	if err := common.CreateMinIOBucketIfNotExists(mc, cfg.Bucket); err != nil {
+		return nil, fmt.Errorf("failed to create cold bucket: %w", err)
+	}
+	return &Tierer{cfg: cfg, mc: mc, meta: meta, state: st, touched: make(map[int]time.Time)}, nil
+}
+
+func tieredKey(loc artifactstore.ArtifactLocation) string {
+	return loc.Bucket + "/" + loc.Key
+}
+
+// Touch records that session is in use.
+func (t *Tierer) Touch(session int) {
+	now := time.Now()
+	t.mu.Lock()
+	if now.Sub(t.touched[session]) < touchEvery {
+		t.mu.Unlock()
+		return
+	}
+	t.touched[session] = now
+	t.mu.Unlock()
+
+	a := Access{Session: session, LastAccess: now.UTC()}
+	if err := store.PutJSON(context.Background(), t.meta, nsAccess, strconv.Itoa(session), a); err != nil {
+		slog.Warn("Failed to record session access", "session", session, "error", err)
+	}
+}
+
+// Recall moves loc back from the cold tier if it was moved there.
+func (t *Tierer) Recall(ctx context.Context, loc artifactstore.ArtifactLocation) error {
+	var rec Tiered
+	err := store.GetJSON(ctx, t.meta, nsTiered, tieredKey(loc), &rec)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	_, err = t.mc.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: loc.Bucket, Object: loc.Key},
+		minio.CopySrcOptions{Bucket: rec.Bucket, Object: rec.Key})
+	if err != nil {
+		// A concurrent reader may have moved it back already.
+		if _, serr := t.mc.StatObject(ctx, loc.Bucket, loc.Key, minio.StatObjectOptions{}); serr != nil {
+			return fmt.Errorf("failed to recall artifact from cold tier: %w", err)
+		}
+	}
+	if err := t.meta.Delete(ctx, nsTiered, tieredKey(loc)); err != nil {
+		return err
+	}
+	if err := t.mc.RemoveObject(ctx, rec.Bucket, rec.Key, minio.RemoveObjectOptions{}); err != nil {
+		slog.Warn("Failed to remove recalled artifact from cold tier", "bucket", rec.Bucket, "key", rec.Key, "error", err)
+	}
+	recalledTotal.Inc()
+
+	// The session is in use again and may be tiered again later.
+	t.mu.Lock()
+	delete(t.touched, rec.Session)
+	t.mu.Unlock()
+	t.Touch(rec.Session)
+	slog.Debug("Recalled artifact from cold tier", "bucket", loc.Bucket, "key", loc.Key)
+	return nil
+}
+
+// Run moves the artifacts of sessions untouched for cfg.After to the cold
+// tier.  It is a background task.
+func (t *Tierer) Run(ctx context.Context) error {
+	accesses, err := store.ListJSON[Access](ctx, t.meta, nsAccess, "")
+	if err != nil {
+		return err
+	}
+	cutoff := time.Now().Add(-t.cfg.After)
+	var cold []Access
+	for _, a := range accesses {
+		if !a.Tiered && !a.LastAccess.After(cutoff) {
+			cold = append(cold, a)
+		}
+	}
+	return background.Each(ctx, cold, func(ctx context.Context, a Access) error {
+		n, err := t.tierSession(ctx, a.Session)
+		if err != nil {
+			return fmt.Errorf("failed to tier session %d: %w", a.Session, err)
+		}
+		err = store.UpdateJSON(ctx, t.meta, nsAccess, strconv.Itoa(a.Session), func(v *Access, found bool) error {
+			// A touch while the session was being moved keeps it hot.
+			if found && v.LastAccess.Equal(a.LastAccess) {
+				v.Tiered = true
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		slog.Info("Moved session artifacts to cold tier", "session", a.Session, "artifacts", n)
+		return nil
+	})
+}
+
+func (t *Tierer) tierSession(ctx context.Context, session int) (int, error) {
+	jobs, err := t.state.GetJobList(session)
+	if err != nil {
+		return 0, err
+	}
+	var locs []artifactstore.ArtifactLocation
+	seen := make(map[string]bool)
+	add := func(loc artifactstore.ArtifactLocation) {
+		if loc.Key != "" && loc.Bucket != cas.Bucket && !seen[tieredKey(loc)] {
+			seen[tieredKey(loc)] = true
+			locs = append(locs, loc)
+		}
+	}
+	for _, job := range jobs {
+		add(job.QueryPackLocation)
+		if result, err := t.state.GetResult(job.Spec); err == nil {
+			add(result.ResultLocation)
+		}
+	}
+
+	moved := 0
+	for _, loc := range locs {
+		ok, err := t.move(ctx, session, loc)
+		if err != nil {
+			return moved, err
+		}
+		if ok {
+			moved++
+		}
+	}
+	return moved, nil
+}
+
+// move copies loc to the cold tier, records it, then removes the original.
+// It reports false for artifacts that are gone or already moved.
+func (t *Tierer) move(ctx context.Context, session int, loc artifactstore.ArtifactLocation) (bool, error) {
+	if _, err := t.meta.Get(ctx, nsTiered, tieredKey(loc)); err == nil {
+		return false, nil
+	}
+	if _, err := t.mc.StatObject(ctx, loc.Bucket, loc.Key, minio.StatObjectOptions{}); err != nil {
+		return false, nil
+	}
+
+	rec := Tiered{Session: session, Bucket: t.cfg.Bucket, Key: tieredKey(loc), Moved: time.Now().UTC()}
+	dst := minio.CopyDestOptions{Bucket: rec.Bucket, Object: rec.Key}
+	if t.cfg.StorageClass != "" {
+		dst.ReplaceMetadata = true
+		dst.UserMetadata = map[string]string{"X-Amz-Storage-Class": t.cfg.StorageClass}
+	}
+	if _, err := t.mc.CopyObject(ctx, dst, minio.CopySrcOptions{Bucket: loc.Bucket, Object: loc.Key}); err != nil {
+		return false, fmt.Errorf("failed to copy %s to cold tier: %w", tieredKey(loc), err)
+	}
+	if err := store.PutJSON(ctx, t.meta, nsTiered, tieredKey(loc), rec); err != nil {
+		return false, err
+	}
+	if err := t.mc.RemoveObject(ctx, loc.Bucket, loc.Key, minio.RemoveObjectOptions{}); err != nil {
+		return false, fmt.Errorf("failed to remove %s after moving it: %w", tieredKey(loc), err)
+	}
+	movedTotal.Inc()
+	return true, nil
+}
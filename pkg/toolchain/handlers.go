@@ -0,0 +1,126 @@
+package toolchain
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+// Register adds what a session's jobs run with,
+// GET /variant-analyses/{id}/toolchain.
+func (m *Map) Register(r *mux.Router) {
+	r.HandleFunc("/variant-analyses/{id:[0-9]+}/toolchain", m.session).Methods(http.MethodGet)
+}
+
+// RegisterAdmin adds the toolchain mappings and their canary rollouts:
+//
+//	GET    /admin/toolchains                    the mappings in effect
+//	GET    /admin/toolchains/{language}         one language's
+//	PUT    /admin/toolchains/{language}         replace it
+//	DELETE /admin/toolchains/{language}         go back to the configured one
+//	GET    /admin/toolchains/{language}/rollout the canary against stable
+//	POST   /admin/toolchains/{language}/promote make the canary stable (?force=true if not ready)
+func (m *Map) RegisterAdmin(r *mux.Router) {
+	r.HandleFunc("/admin/toolchains", m.list).Methods(http.MethodGet)
+	r.HandleFunc("/admin/toolchains/{language}", m.get).Methods(http.MethodGet)
+	r.HandleFunc("/admin/toolchains/{language}", m.put).Methods(http.MethodPut)
+	r.HandleFunc("/admin/toolchains/{language}", m.reset).Methods(http.MethodDelete)
+	r.HandleFunc("/admin/toolchains/{language}/rollout", m.getRollout).Methods(http.MethodGet)
+	r.HandleFunc("/admin/toolchains/{language}/promote", m.promote).Methods(http.MethodPost)
+}
+
+func (m *Map) list(w http.ResponseWriter, r *http.Request) {
+	mappings, err := m.mappings(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	out := make([]Mapping, 0, len(mappings))
+	for _, mp := range mappings {
+		out = append(out, mp)
+	}
+	slices.SortFunc(out, func(a, b Mapping) int { return strings.Compare(a.Language, b.Language) })
+	web.WriteJSON(w, http.StatusOK, out)
+}
+
+func (m *Map) get(w http.ResponseWriter, r *http.Request) {
+	mappings, err := m.mappings(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	mp, ok := mappings[mux.Vars(r)["language"]]
+	if !ok {
+		http.Error(w, "no toolchain for this language", http.StatusNotFound)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, mp)
+}
+
+func (m *Map) put(w http.ResponseWriter, r *http.Request) {
+	var mp Mapping
+	if err := json.NewDecoder(r.Body).Decode(&mp); err != nil {
+		http.Error(w, "invalid toolchain: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	mp.Language = mux.Vars(r)["language"]
+	mp, err := m.Set(r.Context(), mp, web.Identity(r))
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, mp)
+}
+
+func (m *Map) reset(w http.ResponseWriter, r *http.Request) {
+	err := m.Reset(r.Context(), mux.Vars(r)["language"])
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "no toolchain was set for this language", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (m *Map) getRollout(w http.ResponseWriter, r *http.Request) {
+	rd, err := m.Readiness(r.Context(), mux.Vars(r)["language"])
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, rd)
+}
+
+func (m *Map) promote(w http.ResponseWriter, r *http.Request) {
+	force, _ := strconv.ParseBool(r.URL.Query().Get("force"))
+	mp, err := m.Promote(r.Context(), mux.Vars(r)["language"], force, web.Identity(r))
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, mp)
+}
+
+func (m *Map) session(w http.ResponseWriter, r *http.Request) {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	t, err := m.SessionToolchain(r.Context(), id)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "no toolchain was picked for this variant analysis", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, t)
+}
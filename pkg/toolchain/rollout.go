@@ -0,0 +1,181 @@
+package toolchain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const nsRolloutStats = "rollout-stats" // language/image@bundle -> Stats
+
+// Stats are the outcomes of the jobs a release ran for a language's
+// sessions.
+type Stats struct {
+	Release
+	Jobs    int       `json:"jobs"`
+	Failed  int       `json:"failed"`
+	Timed   int       `json:"timed"`
+	Seconds float64   `json:"seconds"`
+	Since   time.Time `json:"since"`
+}
+
+func (s Stats) FailureRate() float64 {
+	if s.Jobs == 0 {
+		return 0
+	}
+	return float64(s.Failed) / float64(s.Jobs)
+}
+
+func (s Stats) MeanSeconds() float64 {
+	if s.Timed == 0 {
+		return 0
+	}
+	return s.Seconds / float64(s.Timed)
+}
+
+func statsKey(language string, r Release) string {
+	return language + "/" + r.Image + "@" + r.Bundle
+}
+
+// SetDurations sets how long a finished job ran for, for runtime
+// comparisons.  Until it is set, only failure rates are compared.
+func (m *Map) SetDurations(f func(common.JobSpec) (time.Duration, bool)) {
+	m.durations.Store(&f)
+}
+
+// HandleResult counts the results of jobs that ran with a toolchain
+// against its release, once next has applied them.  It must wrap the
+// dispatcher's handler, which records how long jobs took, inside the
+// retry policy's, so that only final results are counted.
+func (m *Map) HandleResult(next agentproto.ResultHandler) agentproto.ResultHandler {
+	return func(r agentproto.Result) error {
+		if err := next(r); err != nil {
+			return err
+		}
+		if r.Status != common.StatusSuccess && !r.Failed() {
+			return nil
+		}
+		p, err := m.pinOf(r.Spec.SessionID)
+		if err != nil || p == nil {
+			return nil
+		}
+		var took time.Duration
+		var timed bool
+		if f := m.durations.Load(); f != nil {
+			took, timed = (*f)(r.Spec)
+		}
+		rel := Release{Image: p.Image, Bundle: p.Bundle}
+		err = store.UpdateJSON(context.Background(), m.store, nsRolloutStats, statsKey(p.Mapping, rel),
+			func(s *Stats, found bool) error {
+				if !found {
+					*s = Stats{Release: rel, Since: time.Now().UTC()}
+				}
+				s.Jobs++
+				if r.Failed() {
+					s.Failed++
+				}
+				if timed {
+					s.Timed++
+					s.Seconds += took.Seconds()
+				}
+				return nil
+			})
+		if err != nil {
+			slog.Warn("Failed to count result for its toolchain", "job", r.Spec, "error", err)
+		}
+		return nil
+	}
+}
+
+func (m *Map) stats(ctx context.Context, language string, r Release) (Stats, error) {
+	s := Stats{Release: r}
+	err := store.GetJSON(ctx, m.store, nsRolloutStats, statsKey(language, r), &s)
+	if errors.Is(err, store.ErrNotFound) {
+		err = nil
+	}
+	return s, err
+}
+
+// Readiness compares a language's canary with its stable release.
+type Readiness struct {
+	Language      string   `json:"language"`
+	CanaryPercent int      `json:"canary_percent"`
+	Stable        Stats    `json:"stable"`
+	Canary        *Stats   `json:"canary,omitempty"`
+	Ready         bool     `json:"ready"`
+	Reasons       []string `json:"reasons,omitempty"`
+}
+
+// Readiness reports whether a language's canary may be promoted, and if
+// not, why not.
+func (m *Map) Readiness(ctx context.Context, language string) (Readiness, error) {
+	mappings, err := m.mappings(ctx)
+	if err != nil {
+		return Readiness{}, err
+	}
+	mp, ok := mappings[language]
+	if !ok {
+		return Readiness{}, web.Msg(http.StatusNotFound, "", "toolchain.no_mapping", messages.Params{"language": language})
+	}
+	out := Readiness{Language: language, CanaryPercent: mp.CanaryPercent}
+	if out.Stable, err = m.stats(ctx, language, mp.Release); err != nil {
+		return out, err
+	}
+	if mp.Canary.empty() {
+		out.Reasons = []string{"there is no canary"}
+		return out, nil
+	}
+	canary, err := m.stats(ctx, language, *mp.Canary)
+	if err != nil {
+		return out, err
+	}
+	out.Canary = &canary
+
+	cfg, stable := m.rollout, out.Stable
+	if canary.Jobs < cfg.MinJobs {
+		out.Reasons = append(out.Reasons, fmt.Sprintf("the canary has finished %d of %d jobs", canary.Jobs, cfg.MinJobs))
+	}
+	if d := canary.FailureRate() - stable.FailureRate(); d > cfg.MaxFailureIncrease {
+		out.Reasons = append(out.Reasons, fmt.Sprintf("the canary fails %.1f%% of jobs, %.1f points more than stable",
+			100*canary.FailureRate(), 100*d))
+	}
+	if stable.Timed > 0 && canary.Timed > 0 {
+		if ratio := canary.MeanSeconds() / stable.MeanSeconds(); ratio > cfg.MaxRuntimeRatio {
+			out.Reasons = append(out.Reasons, fmt.Sprintf("the canary's jobs take %.2f times as long as stable's", ratio))
+		}
+	}
+	out.Ready = len(out.Reasons) == 0
+	return out, nil
+}
+
+// Promote makes a language's canary its stable release, unless it is not
+// ready and force is false.
+func (m *Map) Promote(ctx context.Context, language string, force bool, by string) (Mapping, error) {
+	rd, err := m.Readiness(ctx, language)
+	if err != nil {
+		return Mapping{}, err
+	}
+	if rd.Canary == nil {
+		return Mapping{}, web.Msg(http.StatusConflict, "", "toolchain.no_canary", messages.Params{"language": language})
+	}
+	if !rd.Ready && !force {
+		return Mapping{}, web.Msg(http.StatusConflict, "", "toolchain.not_ready",
+			messages.Params{"language": language, "reason": rd.Reasons[0]})
+	}
+	mp, err := m.Set(ctx, Mapping{Language: language, Release: rd.Canary.Release}, by)
+	if err != nil {
+		return mp, err
+	}
+	slog.Info("Canary toolchain promoted", "language", language, "image", mp.Image, "bundle", mp.Bundle,
+		"forced", !rd.Ready, "client", by)
+	return mp, nil
+}
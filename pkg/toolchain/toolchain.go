@@ -0,0 +1,295 @@
+// Package toolchain picks the agent image and CodeQL bundle each job runs
+// with.  Mappings come by query language from the configuration and may
+// be replaced at run time through /admin/toolchains, which is how a new
+// CodeQL release is rolled out: set it as a language's canary, raise the
+// canary's share of sessions as confidence grows, then make it the
+// language's stable toolchain.  The final results of each release's jobs
+// are counted, and a canary is reported ready to promote once it has run
+// enough jobs, failing hardly more often and running hardly longer than
+// the stable release (see config.Toolchains).
+//
+// A session's toolchain is picked when its first job is published and
+// kept for the rest of its jobs, retries included, so that its results
+// are comparable whatever the rollout does meanwhile.  The shards of a
+// split submission are sessions of their own and are picked for separately.
+package toolchain
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/queue"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const (
+	nsToolchains        = "toolchains"         // language -> Mapping set at run time
+	nsSessionToolchains = "session-toolchains" // session -> agentproto.Toolchain
+)
+
+const (
+	// AnyLanguage is the mapping of languages without one of their own.
+	AnyLanguage = "*"
+
+	// refresh is how often mappings set on other replicas are picked up.
+	refresh = 10 * time.Second
+
+	// maxPinned bounds the sessions whose toolchain is held in memory.
+	maxPinned = 10000
+)
+
+// Release is an agent image and CodeQL bundle.
+type Release struct {
+	Image  string `json:"image,omitempty"`
+	Bundle string `json:"bundle,omitempty"`
+}
+
+func (r *Release) empty() bool {
+	return r == nil || r.Image == "" && r.Bundle == ""
+}
+
+// Mapping is a language's toolchain: its stable release and, optionally, a
+// canary taking CanaryPercent of its sessions.
+type Mapping struct {
+	Language string `json:"language"`
+	Release
+	Canary        *Release `json:"canary,omitempty"`
+	CanaryPercent int      `json:"canary_percent,omitempty"`
+
+	// Source is "config", or "admin" for a mapping set at run time.
+	Source    string     `json:"source"`
+	UpdatedBy string     `json:"updated_by,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at,omitempty"`
+}
+
+func (m Mapping) validate() error {
+	switch {
+	case m.Language == "":
+		return fmt.Errorf("every toolchain needs a language")
+	case m.Release.empty():
+		return fmt.Errorf("%s: image or bundle is required", m.Language)
+	case m.CanaryPercent < 0 || m.CanaryPercent > 100:
+		return fmt.Errorf("%s: canary_percent must be between 0 and 100", m.Language)
+	case m.CanaryPercent > 0 && m.Canary.empty():
+		return fmt.Errorf("%s: canary_percent needs a canary image or bundle", m.Language)
+	}
+	return nil
+}
+
+// pin is the toolchain picked for a session, and the language of the
+// mapping it was picked from.
+type pin struct {
+	agentproto.Toolchain
+	Mapping string `json:"mapping"`
+}
+
+type Map struct {
+	config    map[string]Mapping
+	rollout   config.Rollout
+	store     store.Store
+	durations atomic.Pointer[func(common.JobSpec) (time.Duration, bool)]
+
+	mu        sync.Mutex
+	overrides map[string]Mapping
+	loaded    time.Time
+	pinned    map[int]*pin
+}
+
+func New(cfg config.Toolchains, s store.Store) (*Map, error) {
+	m := &Map{
+		config:  make(map[string]Mapping),
+		rollout: cfg.Rollout,
+		store:   s,
+		pinned:  make(map[int]*pin),
+	}
+	for i, t := range cfg.Languages {
+		mp := Mapping{
+			Language:      t.Language,
+			Release:       Release{Image: t.Image, Bundle: t.Bundle},
+			CanaryPercent: t.CanaryPercent,
+			Source:        "config",
+		}
+		if t.Canary != nil {
+			mp.Canary = &Release{Image: t.Canary.Image, Bundle: t.Canary.Bundle}
+		}
+		if err := mp.validate(); err != nil {
+			return nil, fmt.Errorf("toolchains.languages[%d]: %w", i, err)
+		}
+		if _, ok := m.config[t.Language]; ok {
+			return nil, fmt.Errorf("toolchains.languages[%d]: duplicate language %q", i, t.Language)
+		}
+		m.config[t.Language] = mp
+	}
+	return m, nil
+}
+
+// mappings returns the mappings in effect by language, reading the ones
+// set at run time at most every refresh.
+func (m *Map) mappings(ctx context.Context) (map[string]Mapping, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.overrides == nil || time.Since(m.loaded) > refresh {
+		list, err := store.ListJSON[Mapping](ctx, m.store, nsToolchains, "")
+		if err != nil && m.overrides == nil {
+			return nil, err
+		}
+		if err == nil {
+			m.overrides = make(map[string]Mapping, len(list))
+			for _, mp := range list {
+				m.overrides[mp.Language] = mp
+			}
+			m.loaded = time.Now()
+		} else {
+			slog.Warn("Failed to refresh toolchain mappings", "error", err)
+		}
+	}
+	out := make(map[string]Mapping, len(m.config)+len(m.overrides))
+	for lang, mp := range m.config {
+		out[lang] = mp
+	}
+	for lang, mp := range m.overrides {
+		out[lang] = mp
+	}
+	return out, nil
+}
+
+// pick returns the toolchain a session of language gets under the mappings
+// in effect, and the language of the mapping it came from, or nil if no
+// mapping covers the language.
+func pick(mappings map[string]Mapping, language string, session int) (*agentproto.Toolchain, string) {
+	mp, ok := mappings[language]
+	if !ok {
+		if mp, ok = mappings[AnyLanguage]; !ok {
+			return nil, ""
+		}
+	}
+	if mp.CanaryPercent > 0 && !mp.Canary.empty() && bucket(language, session) < mp.CanaryPercent {
+		return &agentproto.Toolchain{Image: mp.Canary.Image, Bundle: mp.Canary.Bundle, Stage: "canary"}, mp.Language
+	}
+	return &agentproto.Toolchain{Image: mp.Image, Bundle: mp.Bundle, Stage: "stable"}, mp.Language
+}
+
+// bucket places a session in one of 100 buckets.  Hashing rather than
+// taking the ID modulo 100 keeps consecutive sessions from entering the
+// canary in the order they were submitted.
+func bucket(language string, session int) int {
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s/%d", language, session)
+	return int(h.Sum32() % 100)
+}
+
+// Toolchain implements rabbitmq.Toolchains.  The first job of a session to
+// be published pins its toolchain.
+func (m *Map) Toolchain(job queue.AnalyzeJob) *agentproto.Toolchain {
+	id := job.Spec.SessionID
+	p, err := m.pinOf(id)
+	if err != nil {
+		slog.Error("Failed to read session toolchain", "session", id, "error", err)
+		return nil
+	}
+	if p != nil {
+		return &p.Toolchain
+	}
+
+	ctx := context.Background()
+	mappings, err := m.mappings(ctx)
+	if err != nil {
+		slog.Error("Failed to read toolchain mappings", "error", err)
+		return nil
+	}
+	t, lang := pick(mappings, string(job.QueryLanguage), id)
+	if t == nil {
+		return nil
+	}
+	p = &pin{Toolchain: *t, Mapping: lang}
+	if err := store.PutJSON(ctx, m.store, nsSessionToolchains, strconv.Itoa(id), p); err != nil {
+		slog.Error("Failed to save session toolchain", "session", id, "error", err)
+	}
+	slog.Info("Session toolchain picked", "session", id, "language", job.QueryLanguage,
+		"image", t.Image, "bundle", t.Bundle, "stage", t.Stage)
+	m.keep(id, p)
+	return t
+}
+
+// pinOf returns the toolchain pinned for a session, or nil.
+func (m *Map) pinOf(session int) (*pin, error) {
+	m.mu.Lock()
+	p, ok := m.pinned[session]
+	m.mu.Unlock()
+	if ok {
+		return p, nil
+	}
+	p = new(pin)
+	err := store.GetJSON(context.Background(), m.store, nsSessionToolchains, strconv.Itoa(session), p)
+	if errors.Is(err, store.ErrNotFound) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	m.keep(session, p)
+	return p, nil
+}
+
+func (m *Map) keep(session int, p *pin) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if len(m.pinned) >= maxPinned {
+		clear(m.pinned)
+	}
+	m.pinned[session] = p
+}
+
+// SessionToolchain returns the toolchain a session's jobs run with, or
+// store.ErrNotFound if none was picked.
+func (m *Map) SessionToolchain(ctx context.Context, session int) (agentproto.Toolchain, error) {
+	var p pin
+	err := store.GetJSON(ctx, m.store, nsSessionToolchains, strconv.Itoa(session), &p)
+	return p.Toolchain, err
+}
+
+// Set replaces a language's mapping until it is reset.
+func (m *Map) Set(ctx context.Context, mp Mapping, by string) (Mapping, error) {
+	now := time.Now().UTC()
+	mp.Source, mp.UpdatedBy, mp.UpdatedAt = "admin", by, &now
+	if err := mp.validate(); err != nil {
+		return mp, web.Errorf(http.StatusBadRequest, "%v", err)
+	}
+	if err := store.PutJSON(ctx, m.store, nsToolchains, mp.Language, mp); err != nil {
+		return mp, fmt.Errorf("failed to save toolchain mapping: %w", err)
+	}
+	m.mu.Lock()
+	m.overrides = nil
+	m.mu.Unlock()
+	slog.Info("Toolchain mapping set", "language", mp.Language, "image", mp.Image, "bundle", mp.Bundle,
+		"canary_percent", mp.CanaryPercent, "client", by)
+	return mp, nil
+}
+
+// Reset drops the mapping set for a language at run time, going back to
+// the configured one, if any.
+func (m *Map) Reset(ctx context.Context, language string) error {
+	if _, err := m.store.Get(ctx, nsToolchains, language); err != nil {
+		return err
+	}
+	if err := m.store.Delete(ctx, nsToolchains, language); err != nil {
+		return err
+	}
+	m.mu.Lock()
+	m.overrides = nil
+	m.mu.Unlock()
+	slog.Info("Toolchain mapping reset", "language", language)
+	return nil
+}
@@ -0,0 +1,121 @@
+package trash
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+// Register adds session deletion:
+//
+//	DELETE /repos/{owner}/{repo}/code-scanning/codeql/variant-analyses/{id}
+//	DELETE /repositories/{controller_repo_id}/code-scanning/codeql/variant-analyses/{id}
+func (t *Trash) Register(r *mux.Router) {
+	r.HandleFunc("/repos/{owner}/{repo}/code-scanning/codeql/variant-analyses/{id:[0-9]+}", t.delete).Methods(http.MethodDelete)
+	r.HandleFunc("/repositories/{controller_repo_id}/code-scanning/codeql/variant-analyses/{id:[0-9]+}", t.delete).Methods(http.MethodDelete)
+}
+
+// RegisterAdmin adds the trash:
+//
+//	GET    /admin/trash               deleted sessions
+//	POST   /admin/trash/{id}/restore  restore one
+//	DELETE /admin/trash/{id}          purge one now
+func (t *Trash) RegisterAdmin(r *mux.Router) {
+	r.HandleFunc("/admin/trash", t.list).Methods(http.MethodGet)
+	r.HandleFunc("/admin/trash/{id:[0-9]+}/restore", t.restore).Methods(http.MethodPost)
+	r.HandleFunc("/admin/trash/{id:[0-9]+}", t.purge).Methods(http.MethodDelete)
+}
+
+func sessionOf(r *http.Request) int {
+	id, _ := strconv.Atoi(mux.Vars(r)["id"])
+	return id
+}
+
+func (t *Trash) delete(w http.ResponseWriter, r *http.Request) {
+	e, err := t.Delete(r.Context(), sessionOf(r), web.Identity(r))
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusAccepted, e)
+}
+
+func (t *Trash) list(w http.ResponseWriter, r *http.Request) {
+	entries, err := t.List(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, entries)
+}
+
+func (t *Trash) restore(w http.ResponseWriter, r *http.Request) {
+	e, err := t.Restore(r.Context(), sessionOf(r))
+	if err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, e)
+}
+
+// purge answers 204, or 200 with the entry if the session's jobs were kept
+// in the state.
+func (t *Trash) purge(w http.ResponseWriter, r *http.Request) {
+	if err := t.PurgeNow(r.Context(), sessionOf(r)); err != nil {
+		web.Fail(w, err, http.StatusInternalServerError)
+		return
+	}
+	if e, err := t.Entry(r.Context(), sessionOf(r)); err == nil && e.StateKept {
+		web.WriteJSON(w, http.StatusOK, e)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+var sessionInPath = regexp.MustCompile(`/variant-analyses/([0-9]+)(/|$)`)
+
+// Middleware answers reads of a deleted session's status, repository
+// tasks and results with 410 Gone.
+func (t *Trash) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			next.ServeHTTP(w, r)
+			return
+		}
+		session := 0
+		if m := sessionInPath.FindStringSubmatch(r.URL.Path); m != nil {
+			session, _ = strconv.Atoi(m[1])
+		} else if encoded, ok := strings.CutPrefix(r.URL.Path, "/download/"); ok {
+			if js, err := common.DecodeJobSpec(encoded); err == nil {
+				session = js.SessionID
+			}
+		}
+		if session == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		e, err := t.Entry(r.Context(), session)
+		if errors.Is(err, store.ErrNotFound) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		msg := fmt.Sprintf("variant analysis %d was deleted and will be purged at %s", session, e.PurgeAt.Format(time.RFC3339))
+		if e.PurgedAt != nil {
+			msg = fmt.Sprintf("variant analysis %d was deleted", session)
+		}
+		http.Error(w, msg, http.StatusGone)
+	})
+}
@@ -0,0 +1,184 @@
+package trash
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"sort"
+	"time"
+
+	"mrvaserver/pkg/background"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/resources"
+	"mrvaserver/pkg/snapshot"
+	"mrvaserver/pkg/store"
+)
+
+// RetentionKind is the kind of retention policies.
+const RetentionKind = "retention-policies"
+
+// nsKept records the sessions restored after a retention policy deleted
+// them, which no policy deletes again.
+const nsKept = "retention-kept" // session -> Entry
+
+// byRetention prefixes the DeletedBy of sessions a policy deleted.
+const byRetention = "retention-policy:"
+
+// maxGap bounds the probe for sessions of a state that cannot list them.
+const maxGap = 100
+
+var expiredTotal = metrics.NewCounter("mrvaserver_trash_expired_total",
+	"Sessions deleted by a retention policy.")
+
+// RetentionSpec is a retention policy: the sessions created more than
+// MaxAge ago, a duration such as "720h", that carry all of Tags are
+// deleted, as if by hand, and purged after the grace period.  A policy
+// without tags applies to every session.  Sessions restored from the
+// trash after a policy deleted them are kept for good.
+type RetentionSpec struct {
+	MaxAge string            `json:"max_age"`
+	Tags   map[string]string `json:"tags,omitempty"`
+}
+
+func checkRetention(id string, spec *RetentionSpec) error {
+	d, err := time.ParseDuration(spec.MaxAge)
+	if err != nil {
+		return fmt.Errorf("max_age: %w", err)
+	}
+	if d < time.Hour {
+		return fmt.Errorf("max_age must be at least 1h")
+	}
+	return nil
+}
+
+// SetRetention defines the retention policy kind in reg, for Expire to
+// apply.  tags returns a session's tags.
+func (t *Trash) SetRetention(reg *resources.Registry, tags func(ctx context.Context, session int) (map[string]string, error)) {
+	reg.Define(resources.NewKind(RetentionKind, "How long sessions are kept before they are deleted.", checkRetention))
+	t.resources, t.tags = reg, tags
+}
+
+// SetTenantRetention makes Expire keep the sessions f returns a retention
+// for, that of the session's tenant, as long as it says, in place of the
+// policies.
+func (t *Trash) SetTenantRetention(f func(ctx context.Context, session int) (time.Duration, string, bool)) {
+	t.tenantRetention = f
+}
+
+type policy struct {
+	id     string
+	maxAge time.Duration
+	tags   map[string]string
+}
+
+func (p policy) matches(tags map[string]string) bool {
+	for k, v := range p.tags {
+		if tags[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Expire deletes the sessions a retention policy no longer keeps.  Like
+// any deleted session they are purged after the grace period, artifacts
+// and content-addressed references with them.  It is a background task.
+func (t *Trash) Expire(ctx context.Context) error {
+	specs, err := resources.Specs[RetentionSpec](ctx, t.resources, RetentionKind)
+	if err != nil || len(specs) == 0 && t.tenantRetention == nil {
+		return err
+	}
+	var policies []policy
+	for id, s := range specs {
+		d, _ := time.ParseDuration(s.MaxAge)
+		policies = append(policies, policy{id: id, maxAge: d, tags: s.Tags})
+	}
+	// The shortest policies first, so a session goes by the first to match.
+	sort.Slice(policies, func(i, j int) bool { return policies[i].maxAge < policies[j].maxAge })
+
+	entries, err := t.List(ctx)
+	if err != nil {
+		return err
+	}
+	kept, err := store.ListJSON[Entry](ctx, t.meta, nsKept, "")
+	if err != nil {
+		return err
+	}
+	skip := make(map[int]bool, len(entries)+len(kept))
+	for _, e := range append(entries, kept...) {
+		skip[e.Session] = true
+	}
+	ids, err := snapshot.SessionIDs(t.state, maxGap)
+	if err != nil {
+		return fmt.Errorf("failed to list sessions: %w", err)
+	}
+	var candidates []int
+	for _, id := range ids {
+		if skip[id] {
+			continue
+		}
+		// A split submission goes by its parent.
+		if parent, err := t.shards.Parent(ctx, id); err != nil || parent != id {
+			continue
+		}
+		candidates = append(candidates, id)
+	}
+	now := time.Now()
+	return background.Each(ctx, candidates, func(ctx context.Context, id int) error {
+		created, ok := t.createdAt(id)
+		if !ok {
+			return nil
+		}
+		if t.tenantRetention != nil {
+			if maxAge, tenant, ok := t.tenantRetention(ctx, id); ok {
+				if now.Sub(created) < maxAge {
+					return nil
+				}
+				if _, err := t.Delete(ctx, id, byRetention+"tenant:"+tenant); err != nil {
+					return fmt.Errorf("failed to expire session %d: %w", id, err)
+				}
+				expiredTotal.Inc()
+				slog.Info("Session expired by tenant retention", "session", id, "tenant", tenant, "created_at", created)
+				return nil
+			}
+		}
+		var tags map[string]string
+		tagsRead := false
+		for _, p := range policies {
+			if now.Sub(created) < p.maxAge {
+				continue
+			}
+			if len(p.tags) > 0 && !tagsRead {
+				var err error
+				if tags, err = t.tags(ctx, id); err != nil {
+					return fmt.Errorf("failed to read tags of session %d: %w", id, err)
+				}
+				tagsRead = true
+			}
+			if !p.matches(tags) {
+				continue
+			}
+			if _, err := t.Delete(ctx, id, byRetention+p.id); err != nil {
+				return fmt.Errorf("failed to expire session %d: %w", id, err)
+			}
+			expiredTotal.Inc()
+			slog.Info("Session expired by retention policy", "session", id, "policy", p.id, "created_at", created)
+			return nil
+		}
+		return nil
+	})
+}
+
+// createdAt is when session was submitted, if the state knows.
+func (t *Trash) createdAt(session int) (time.Time, bool) {
+	jobs, err := t.state.GetJobList(session)
+	if err != nil || len(jobs) == 0 {
+		return time.Time{}, false
+	}
+	info, err := t.state.GetJobInfo(jobs[0].Spec)
+	if err != nil {
+		return time.Time{}, false
+	}
+	created, err := time.Parse(time.RFC3339, info.CreatedAt)
+	return created, err == nil
+}
@@ -0,0 +1,407 @@
+// Package trash deletes sessions in two steps.  Deleting a session puts
+// it in the trash: its status and artifacts are no longer served, and its
+// artifacts are tagged mrva-deleted with the time they will be purged, for
+// bucket lifecycle rules and audits to see.  Until then the session can be
+// restored as it was.  After the grace period a background pass purges
+// it for good: its artifacts are removed and, with a state that can delete
+// sessions, its jobs as well.  A tombstone stays, so the session's URLs
+// answer 410 Gone rather than 404.  Retention policies, declared as
+// resources, delete sessions the same way once they are old enough.
+//
+// Content-addressed artifacts are shared between sessions and are left to
+// the CAS sweep.  Without the minio artifact store nothing is tagged or
+// removed.
+package trash
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/state"
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/tags"
+	"mrvaserver/pkg/background"
+	"mrvaserver/pkg/cas"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/resources"
+	"mrvaserver/pkg/shard"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const nsTrash = "trash"
+
+// Tags set on the artifacts of a deleted session.
+const (
+	tagDeleted = "mrva-deleted"
+	tagPurgeAt = "mrva-purge-at"
+)
+
+var purgedTotal = metrics.NewCounter("mrvaserver_trash_purged_total",
+	"Deleted sessions purged for good.")
+
+// Entry records a deleted session.
+type Entry struct {
+	Session   int        `json:"session"`
+	DeletedBy string     `json:"deleted_by,omitempty"`
+	DeletedAt time.Time  `json:"deleted_at"`
+	PurgeAt   time.Time  `json:"purge_at"`
+	PurgedAt  *time.Time `json:"purged_at,omitempty"`
+
+	// StateKept is set on a purged session whose jobs stayed in the
+	// state, which cannot delete them; only its artifacts are gone.
+	StateKept bool `json:"state_kept,omitempty"`
+}
+
+// SessionDeleter is implemented by states that can delete a session's
+// jobs, such as pgstate.PGState.  With other states a purged session's
+// jobs stay in the state, out of reach; so they do where DeleteSession
+// returns errors.ErrUnsupported, as when a cache wraps such a state.
+type SessionDeleter interface {
+	DeleteSession(sessionID int) error
+}
+
+type Trash struct {
+	cfg   config.Trash
+	mc    *minio.Client
+	meta  store.Store
+	state state.ServerState
+
+	// resources are where retention policies are declared, if anywhere.
+	resources *resources.Registry
+	tags      func(ctx context.Context, session int) (map[string]string, error)
+
+	// tenantRetention is how long the sessions of tenants with a
+	// retention of their own are kept.
+	tenantRetention func(ctx context.Context, session int) (time.Duration, string, bool)
+
+	// cas holds the artifacts of sessions stored while it was enabled.
+	cas *cas.Store
+
+	// shards are the sessions split submissions were split into.
+	shards *shard.Map
+}
+
+// New returns the trash.  mc is nil without the minio artifact store.
+func New(cfg config.Trash, mc *minio.Client, meta store.Store, st state.ServerState) *Trash {
+	return &Trash{cfg: cfg, mc: mc, meta: meta, state: st}
+}
+
+// SetCAS has purges release the session's references in the
+// content-addressed store, so its sweep can delete what no other session
+// shares.
+func (t *Trash) SetCAS(s *cas.Store) {
+	t.cas = s
+}
+
+// SetShards has a split submission deleted, restored and purged as one,
+// under its parent session.
+func (t *Trash) SetShards(m *shard.Map) {
+	t.shards = m
+}
+
+// parent returns the session under which session is deleted: its parent,
+// if it is a shard.
+func (t *Trash) parent(ctx context.Context, session int) (int, error) {
+	parent, err := t.shards.Parent(ctx, session)
+	if err != nil {
+		return 0, fmt.Errorf("failed to look up the parent of session %d: %w", session, err)
+	}
+	return parent, nil
+}
+
+func key(session int) string {
+	return strconv.Itoa(session)
+}
+
+// Entry returns the trash entry of session, or of the submission it is a
+// shard of, or store.ErrNotFound if it was not deleted.
+func (t *Trash) Entry(ctx context.Context, session int) (Entry, error) {
+	var e Entry
+	session, err := t.parent(ctx, session)
+	if err != nil {
+		return e, err
+	}
+	err = store.GetJSON(ctx, t.meta, nsTrash, key(session), &e)
+	return e, err
+}
+
+// List returns every entry, purged ones included.
+func (t *Trash) List(ctx context.Context) ([]Entry, error) {
+	return store.ListJSON[Entry](ctx, t.meta, nsTrash, "")
+}
+
+// Delete moves session to the trash, with the rest of its submission if
+// it was split into shards.
+func (t *Trash) Delete(ctx context.Context, session int, by string) (Entry, error) {
+	session, err := t.parent(ctx, session)
+	if err != nil {
+		return Entry{}, err
+	}
+	if !t.exists(ctx, session) {
+		return Entry{}, web.Msg(http.StatusNotFound, "", "trash.unknown", messages.Params{"session": session})
+	}
+	now := time.Now().UTC()
+	e := Entry{Session: session, DeletedBy: by, DeletedAt: now, PurgeAt: now.Add(t.cfg.Grace)}
+	err = store.UpdateJSON(ctx, t.meta, nsTrash, key(session), func(v *Entry, found bool) error {
+		if found {
+			return web.Msg(http.StatusConflict, "", "trash.already_deleted", messages.Params{"session": session})
+		}
+		*v = e
+		return nil
+	})
+	if err != nil {
+		return Entry{}, err
+	}
+	n := t.eachArtifact(ctx, session, func(loc artifactstore.ArtifactLocation) error {
+		return t.tag(ctx, loc, e.PurgeAt)
+	})
+	slog.Info("Session deleted", "session", session, "by", by, "purge_at", e.PurgeAt, "artifacts", n)
+	return e, nil
+}
+
+// Restore takes session out of the trash, unless it has been purged.
+func (t *Trash) Restore(ctx context.Context, session int) (Entry, error) {
+	session, err := t.parent(ctx, session)
+	if err != nil {
+		return Entry{}, err
+	}
+	e, err := t.Entry(ctx, session)
+	if errors.Is(err, store.ErrNotFound) {
+		return e, web.Msg(http.StatusNotFound, "", "trash.not_in_trash", messages.Params{"session": session})
+	}
+	if err != nil {
+		return e, err
+	}
+	if e.PurgedAt != nil {
+		return e, web.Msg(http.StatusGone, "", "trash.purged",
+			messages.Params{"session": session, "purged_at": e.PurgedAt.Format(time.RFC3339)})
+	}
+	t.eachArtifact(ctx, session, func(loc artifactstore.ArtifactLocation) error {
+		return t.untag(ctx, loc)
+	})
+	if strings.HasPrefix(e.DeletedBy, byRetention) {
+		// Restored by hand, it is kept whatever the policies say.
+		if err := store.PutJSON(ctx, t.meta, nsKept, key(session), e); err != nil {
+			return e, err
+		}
+	}
+	if err := t.meta.Delete(ctx, nsTrash, key(session)); err != nil {
+		return e, err
+	}
+	slog.Info("Session restored", "session", session)
+	return e, nil
+}
+
+// Purge purges the sessions whose grace period is over.  It is a
+// background task.
+func (t *Trash) Purge(ctx context.Context) error {
+	entries, err := t.List(ctx)
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	var due []Entry
+	for _, e := range entries {
+		if e.PurgedAt == nil && !now.Before(e.PurgeAt) {
+			due = append(due, e)
+		}
+	}
+	return background.Each(ctx, due, func(ctx context.Context, e Entry) error {
+		if err := t.PurgeNow(ctx, e.Session); err != nil {
+			return fmt.Errorf("failed to purge session %d: %w", e.Session, err)
+		}
+		return nil
+	})
+}
+
+// PurgeNow purges a session in the trash without waiting for its grace
+// period to end.
+func (t *Trash) PurgeNow(ctx context.Context, session int) error {
+	session, err := t.parent(ctx, session)
+	if err != nil {
+		return err
+	}
+	e, err := t.Entry(ctx, session)
+	if errors.Is(err, store.ErrNotFound) {
+		return web.Msg(http.StatusNotFound, "", "trash.not_in_trash", messages.Params{"session": session})
+	}
+	if err != nil {
+		return err
+	}
+	if e.PurgedAt != nil {
+		return nil
+	}
+
+	// Artifacts are looked up again: results may have arrived since the
+	// session was deleted.
+	var failed error
+	n := t.eachArtifact(ctx, session, func(loc artifactstore.ArtifactLocation) error {
+		if t.mc == nil {
+			return nil
+		}
+		err := t.mc.RemoveObject(ctx, loc.Bucket, loc.Key, minio.RemoveObjectOptions{})
+		if err != nil && failed == nil {
+			failed = err
+		}
+		return err
+	})
+	if failed != nil {
+		return fmt.Errorf("failed to remove artifacts: %w", failed)
+	}
+	if err := t.release(ctx, session); err != nil {
+		return fmt.Errorf("failed to release shared artifacts: %w", err)
+	}
+	deleted, err := t.deleteState(ctx, session)
+	if err != nil {
+		return err
+	}
+	err = store.UpdateJSON(ctx, t.meta, nsTrash, key(session), func(v *Entry, found bool) error {
+		if !found {
+			// Restored meanwhile; the artifacts are gone all the same.
+			*v = e
+		}
+		now := time.Now().UTC()
+		v.PurgedAt = &now
+		v.StateKept = !deleted
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	purgedTotal.Inc()
+	if !deleted {
+		slog.Warn("Session purged but its jobs kept, as the state cannot delete them", "session", session, "artifacts", n)
+		return nil
+	}
+	slog.Info("Session purged", "session", session, "artifacts", n)
+	return nil
+}
+
+// deleteState deletes the jobs of the session and its shards from the
+// state, reporting false if the state cannot delete them.
+func (t *Trash) deleteState(ctx context.Context, session int) (bool, error) {
+	sd, ok := t.state.(SessionDeleter)
+	if !ok {
+		return false, nil
+	}
+	for _, id := range t.shards.Sessions(ctx, session) {
+		err := sd.DeleteSession(id)
+		if errors.Is(err, errors.ErrUnsupported) {
+			return false, nil
+		}
+		if err != nil {
+			return false, fmt.Errorf("failed to delete the state of session %d: %w", id, err)
+		}
+	}
+	return true, nil
+}
+
+// exists reports whether the session, or any of its shards, has jobs.
+func (t *Trash) exists(ctx context.Context, session int) bool {
+	for _, id := range t.shards.Sessions(ctx, session) {
+		if _, err := t.state.GetJobList(id); err == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// eachArtifact calls f on the own artifacts of the session and its shards,
+// logging failures, and returns how many there were.
+func (t *Trash) eachArtifact(ctx context.Context, session int, f func(artifactstore.ArtifactLocation) error) int {
+	seen := make(map[artifactstore.ArtifactLocation]bool)
+	visit := func(loc artifactstore.ArtifactLocation) {
+		if loc.Key == "" || loc.Bucket == cas.Bucket || seen[loc] {
+			return
+		}
+		seen[loc] = true
+		if err := f(loc); err != nil {
+			slog.Warn("Failed to update artifact of deleted session", "session", session,
+				"bucket", loc.Bucket, "key", loc.Key, "error", err)
+		}
+	}
+	for _, id := range t.shards.Sessions(ctx, session) {
+		jobs, err := t.state.GetJobList(id)
+		if err != nil {
+			continue
+		}
+		for _, job := range jobs {
+			visit(job.QueryPackLocation)
+			if result, err := t.state.GetResult(job.Spec); err == nil {
+				visit(result.ResultLocation)
+			}
+		}
+	}
+	return len(seen)
+}
+
+// release drops the references the query packs and results of the
+// session and its shards hold in the content-addressed store.
+func (t *Trash) release(ctx context.Context, session int) error {
+	if t.cas == nil {
+		return nil
+	}
+	for _, id := range t.shards.Sessions(ctx, session) {
+		jobs, err := t.state.GetJobList(id)
+		if err != nil {
+			continue
+		}
+		if err := t.cas.Release(ctx, cas.PackOwner(id)); err != nil {
+			return err
+		}
+		for _, job := range jobs {
+			if err := t.cas.Release(ctx, cas.ResultOwner(job.Spec)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// tag adds the trash tags to an artifact's own.
+func (t *Trash) tag(ctx context.Context, loc artifactstore.ArtifactLocation, purgeAt time.Time) error {
+	if t.mc == nil {
+		return nil
+	}
+	return t.updateTags(ctx, loc, func(tg *tags.Tags) error {
+		if err := tg.Set(tagDeleted, "true"); err != nil {
+			return err
+		}
+		return tg.Set(tagPurgeAt, purgeAt.Format(time.RFC3339))
+	})
+}
+
+func (t *Trash) untag(ctx context.Context, loc artifactstore.ArtifactLocation) error {
+	if t.mc == nil {
+		return nil
+	}
+	return t.updateTags(ctx, loc, func(tg *tags.Tags) error {
+		tg.Remove(tagDeleted)
+		tg.Remove(tagPurgeAt)
+		return nil
+	})
+}
+
+func (t *Trash) updateTags(ctx context.Context, loc artifactstore.ArtifactLocation, f func(*tags.Tags) error) error {
+	tg, err := t.mc.GetObjectTagging(ctx, loc.Bucket, loc.Key, minio.GetObjectTaggingOptions{})
+	if err != nil {
+		return err
+	}
+	if err := f(tg); err != nil {
+		return err
+	}
+	if tg.Count() == 0 {
+		return t.mc.RemoveObjectTagging(ctx, loc.Bucket, loc.Key, minio.RemoveObjectTaggingOptions{})
+	}
+	return t.mc.PutObjectTagging(ctx, loc.Bucket, loc.Key, tg, minio.PutObjectTaggingOptions{})
+}
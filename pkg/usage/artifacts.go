@@ -0,0 +1,35 @@
+package usage
+
+import (
+	"context"
+	"io"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"mrvaserver/pkg/artifactstream"
+)
+
+// Artifacts is an artifactstore.Store accounting for the query packs it
+// saves.  Results are accounted for as they arrive, by HandleResult.
+type Artifacts struct {
+	artifactstore.Store
+	a *Accountant
+}
+
+func NewArtifacts(a *Accountant, base artifactstore.Store) *Artifacts {
+	return &Artifacts{Store: base, a: a}
+}
+
+func (s *Artifacts) SaveQueryPack(session int, data []byte) (artifactstore.ArtifactLocation, error) {
+	loc, err := s.Store.SaveQueryPack(session, data)
+	if err != nil {
+		return loc, err
+	}
+	if err := s.a.addPack(context.Background(), session, int64(len(data))); err != nil {
+		return loc, err
+	}
+	return loc, nil
+}
+
+func (s *Artifacts) OpenResult(loc artifactstore.ArtifactLocation) (io.ReadCloser, int64, error) {
+	return artifactstream.Open(s.Store, loc)
+}
@@ -0,0 +1,75 @@
+package usage
+
+import (
+	"errors"
+	"net/http"
+	"sort"
+	"strconv"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+type sessionReport struct {
+	SessionUsage
+	Session    string `json:"session"`
+	Bytes      int64  `json:"bytes"`
+	SessionCap int64  `json:"session_cap,omitempty"`
+	UserBytes  int64  `json:"user_bytes,omitempty"`
+	UserCap    int64  `json:"user_cap,omitempty"`
+}
+
+// Register adds the storage usage of a session.
+func (a *Accountant) Register(r *mux.Router) {
+	r.HandleFunc("/variant-analyses/{id}/usage", a.getSession).Methods(http.MethodGet)
+}
+
+// RegisterAdmin adds the storage usage of every user, largest first.
+func (a *Accountant) RegisterAdmin(r *mux.Router) {
+	r.HandleFunc("/admin/usage", a.listUsers).Methods(http.MethodGet)
+}
+
+func (a *Accountant) getSession(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(mux.Vars(r)["id"])
+	if err != nil {
+		http.Error(w, "variant analysis ID is not an integer", http.StatusBadRequest)
+		return
+	}
+	u, err := a.Session(r.Context(), id)
+	if errors.Is(err, store.ErrNotFound) {
+		http.Error(w, "no usage recorded for session", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rep := sessionReport{SessionUsage: u, Bytes: u.Bytes(), SessionCap: a.cfg.SessionCap, UserCap: a.cfg.UserCap}
+	if rep.Session, err = web.SessionName(r.Context(), id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if u.User != "" {
+		var uu UserUsage
+		if err := store.GetJSON(r.Context(), a.meta, nsUsers, u.User, &uu); err == nil {
+			rep.UserBytes = uu.Bytes
+		}
+	}
+	web.WriteJSON(w, http.StatusOK, rep)
+}
+
+func (a *Accountant) listUsers(w http.ResponseWriter, r *http.Request) {
+	users, err := a.Users(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	sort.Slice(users, func(i, j int) bool {
+		if users[i].Bytes != users[j].Bytes {
+			return users[i].Bytes > users[j].Bytes
+		}
+		return users[i].User < users[j].User
+	})
+	web.WriteJSON(w, http.StatusOK, users)
+}
@@ -0,0 +1,311 @@
+// Package usage accounts for the artifact storage each session and each
+// user takes: the session's query pack and the results of its jobs.  A
+// session's user is the identity (see web.Identity) that submitted it.
+// Optional caps keep one run from filling the bucket: a result that would
+// take its session or user past a cap is deleted and its job failed with
+// a message saying so.  A user's quota, if it sets a storage limit,
+// replaces the user cap for that user (see package quota).
+package usage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/artifactstore"
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/minio/minio-go/v7"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/api"
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/web"
+)
+
+const (
+	nsSessions   = "usage-sessions"
+	nsUsers      = "usage-users"
+	nsJobs       = "usage-jobs"
+	nsRejections = "usage-rejections"
+)
+
+var rejectedTotal = metrics.NewCounterVec("mrvaserver_usage_rejected_total",
+	"Results rejected for exceeding a storage cap, by cap.", "cap")
+
+// SessionUsage is the storage a session takes.
+type SessionUsage struct {
+	Session     int    `json:"session"`
+	User        string `json:"user,omitempty"`
+	PackBytes   int64  `json:"query_pack_bytes"`
+	ResultBytes int64  `json:"result_bytes"`
+	Results     int    `json:"results"`
+	Rejected    int    `json:"rejected_results,omitempty"`
+}
+
+func (u SessionUsage) Bytes() int64 {
+	return u.PackBytes + u.ResultBytes
+}
+
+// UserUsage is the storage a user's sessions take.
+type UserUsage struct {
+	User     string `json:"user"`
+	Bytes    int64  `json:"bytes"`
+	Sessions int    `json:"sessions"`
+}
+
+type jobUsage struct {
+	Bytes int64 `json:"bytes"`
+}
+
+type rejection struct {
+	Message string    `json:"message"`
+	At      time.Time `json:"at"`
+}
+
+// errCap aborts an update that would exceed a cap.
+type errCap struct {
+	cap         string
+	used, limit int64
+	resultBytes int64
+}
+
+func (e *errCap) Error() string {
+	return fmt.Sprintf("storage cap exceeded: the %s would use %d of its %d bytes with this %d-byte result",
+		e.cap, e.used+e.resultBytes, e.limit, e.resultBytes)
+}
+
+type Accountant struct {
+	cfg  config.Usage
+	meta store.Store
+	mc   *minio.Client
+
+	userCaps    func(ctx context.Context, user string) (int64, bool)
+	sessionCaps func(ctx context.Context, user string) (int64, bool)
+}
+
+// New returns an accountant keeping its records in meta.  Result sizes
+// are read from, and rejected results deleted in, the artifact store mc.
+func New(cfg config.Usage, meta store.Store, mc *minio.Client) *Accountant {
+	return &Accountant{cfg: cfg, meta: meta, mc: mc}
+}
+
+// SetUserCaps overrides the configured user cap for the users f returns
+// a cap for, such as those with a quota.
+func (a *Accountant) SetUserCaps(f func(ctx context.Context, user string) (int64, bool)) {
+	a.userCaps = f
+}
+
+// SetSessionCaps overrides the configured session cap for the sessions of
+// the users f returns a cap for.
+func (a *Accountant) SetSessionCaps(f func(ctx context.Context, user string) (int64, bool)) {
+	a.sessionCaps = f
+}
+
+// sessionCap is the storage cap of each of user's sessions; 0 is none.
+func (a *Accountant) sessionCap(ctx context.Context, user string) int64 {
+	if a.sessionCaps != nil && user != "" {
+		if n, ok := a.sessionCaps(ctx, user); ok {
+			return n
+		}
+	}
+	return a.cfg.SessionCap
+}
+
+// userCap is the storage cap of user; 0 is none.
+func (a *Accountant) userCap(ctx context.Context, user string) int64 {
+	if a.userCaps != nil {
+		if n, ok := a.userCaps(ctx, user); ok {
+			return n
+		}
+	}
+	return a.cfg.UserCap
+}
+
+func sessionKey(session int) string {
+	return strconv.Itoa(session)
+}
+
+func jobKey(js common.JobSpec) string {
+	return fmt.Sprintf("%d/%s/%s", js.SessionID, js.Owner, js.Repo)
+}
+
+// addPack records a session's query pack.
+func (a *Accountant) addPack(ctx context.Context, session int, n int64) error {
+	return store.UpdateJSON(ctx, a.meta, nsSessions, sessionKey(session), func(u *SessionUsage, found bool) error {
+		u.Session = session
+		u.PackBytes = n
+		return nil
+	})
+}
+
+// bind makes user the owner of session, charging the user for what the
+// session has stored so far.
+func (a *Accountant) bind(ctx context.Context, session int, user string) error {
+	var charged int64
+	err := store.UpdateJSON(ctx, a.meta, nsSessions, sessionKey(session), func(u *SessionUsage, found bool) error {
+		if u.User != "" {
+			return nil
+		}
+		u.Session, u.User = session, user
+		charged = u.Bytes()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return store.UpdateJSON(ctx, a.meta, nsUsers, user, func(u *UserUsage, found bool) error {
+		u.User = user
+		u.Bytes += charged
+		u.Sessions++
+		return nil
+	})
+}
+
+// addResult records a job's result of n bytes, replacing any earlier one,
+// unless that takes the session or its user past a cap.
+func (a *Accountant) addResult(ctx context.Context, js common.JobSpec, n int64) error {
+	var prev jobUsage
+	if err := store.GetJSON(ctx, a.meta, nsJobs, jobKey(js), &prev); err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	delta := n - prev.Bytes
+
+	// The caps and the user's usage are read before the session's record
+	// is updated: stores hold the record for the whole update.
+	var cur SessionUsage
+	if err := store.GetJSON(ctx, a.meta, nsSessions, sessionKey(js.SessionID), &cur); err != nil && !errors.Is(err, store.ErrNotFound) {
+		return err
+	}
+	user := cur.User
+	sessionLimit := a.sessionCap(ctx, user)
+	if limit := a.userCap(ctx, user); user != "" && limit > 0 && delta > 0 {
+		var uu UserUsage
+		if err := store.GetJSON(ctx, a.meta, nsUsers, user, &uu); err == nil && uu.Bytes+delta > limit {
+			return &errCap{cap: "user", used: uu.Bytes, limit: limit, resultBytes: n}
+		}
+	}
+
+	err := store.UpdateJSON(ctx, a.meta, nsSessions, sessionKey(js.SessionID), func(u *SessionUsage, found bool) error {
+		u.Session = js.SessionID
+		if sessionLimit > 0 && delta > 0 && u.Bytes()+delta > sessionLimit {
+			return &errCap{cap: "session", used: u.Bytes(), limit: sessionLimit, resultBytes: n}
+		}
+		u.ResultBytes += delta
+		if prev.Bytes == 0 {
+			u.Results++
+		}
+		user = u.User
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if err := store.PutJSON(ctx, a.meta, nsJobs, jobKey(js), jobUsage{Bytes: n}); err != nil {
+		return err
+	}
+	if user == "" || delta == 0 {
+		return nil
+	}
+	return store.UpdateJSON(ctx, a.meta, nsUsers, user, func(u *UserUsage, found bool) error {
+		u.User = user
+		u.Bytes += delta
+		return nil
+	})
+}
+
+// HandleResult accounts for each result before it is recorded, and fails
+// the job instead if its result exceeds a cap.  It must wrap the handlers
+// that move results in the artifact store.
+func (a *Accountant) HandleResult(next agentproto.ResultHandler) agentproto.ResultHandler {
+	return func(r agentproto.Result) error {
+		loc := r.ResultLocation
+		if loc.Key == "" {
+			return next(r)
+		}
+		ctx := context.Background()
+		info, err := a.mc.StatObject(ctx, loc.Bucket, loc.Key, minio.StatObjectOptions{})
+		if err != nil {
+			slog.Warn("Failed to size result for usage accounting", "job", r.Spec, "error", err)
+			return next(r)
+		}
+
+		err = a.addResult(ctx, r.Spec, info.Size)
+		var capErr *errCap
+		if !errors.As(err, &capErr) {
+			if err != nil {
+				slog.Warn("Failed to account for result", "job", r.Spec, "error", err)
+			}
+			return next(r)
+		}
+
+		rejectedTotal.With(capErr.cap).Inc()
+		slog.Warn("Rejected result over storage cap", "job", r.Spec, "error", capErr)
+		if err := a.reject(ctx, r.Spec, loc, capErr.Error()); err != nil {
+			slog.Error("Failed to record rejected result", "job", r.Spec, "error", err)
+		}
+		r.Status = common.StatusError
+		r.ResultLocation = artifactstore.ArtifactLocation{}
+		r.ResultCount = 0
+		r.FailureMessage = capErr.Error()
+		return next(r)
+	}
+}
+
+func (a *Accountant) reject(ctx context.Context, js common.JobSpec, loc artifactstore.ArtifactLocation, msg string) error {
+	if err := a.mc.RemoveObject(ctx, loc.Bucket, loc.Key, minio.RemoveObjectOptions{}); err != nil {
+		slog.Warn("Failed to delete rejected result", "bucket", loc.Bucket, "key", loc.Key, "error", err)
+	}
+	err := store.UpdateJSON(ctx, a.meta, nsSessions, sessionKey(js.SessionID), func(u *SessionUsage, found bool) error {
+		u.Session = js.SessionID
+		u.Rejected++
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return store.PutJSON(ctx, a.meta, nsRejections, jobKey(js), rejection{Message: msg, At: time.Now().UTC()})
+}
+
+// SubmitHook charges new sessions to the submitting user once the
+// commander has assigned their ID.
+func (a *Accountant) SubmitHook(r *http.Request, sub *gateway.Submission) error {
+	user := web.Identity(r)
+	sub.After(func() {
+		for _, id := range sub.Sessions() {
+			if err := a.bind(context.Background(), id, user); err != nil {
+				slog.Warn("Failed to record session owner", "session", id, "error", err)
+			}
+		}
+	})
+	return nil
+}
+
+// RepoTaskHook reports why a rejected result's job failed.
+func (a *Accountant) RepoTaskHook(js common.JobSpec, task *api.RepoTask) {
+	if task.AnalysisStatus != api.RepoStatusFailed {
+		return
+	}
+	var rej rejection
+	if err := store.GetJSON(context.Background(), a.meta, nsRejections, jobKey(js), &rej); err == nil {
+		task.FailureMessage, task.FailureCode = rej.Message, apierr.QuotaExceeded
+	}
+}
+
+// Session returns a session's usage.
+func (a *Accountant) Session(ctx context.Context, session int) (SessionUsage, error) {
+	u := SessionUsage{Session: session}
+	err := store.GetJSON(ctx, a.meta, nsSessions, sessionKey(session), &u)
+	return u, err
+}
+
+// Users returns the usage of every user.
+func (a *Accountant) Users(ctx context.Context) ([]UserUsage, error) {
+	return store.ListJSON[UserUsage](ctx, a.meta, nsUsers, "")
+}
@@ -0,0 +1,115 @@
+package usagereport
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// columns are the CSV's.  Its last row is the total.
+var columns = []string{"tenant", "sessions", "repositories", "compute_hours", "storage_bytes"}
+
+func (r Row) record() []string {
+	return []string{r.Tenant, strconv.Itoa(r.Sessions), strconv.Itoa(r.Repositories),
+		strconv.FormatFloat(r.ComputeHours, 'f', 2, 64), strconv.FormatInt(r.StorageBytes, 10)}
+}
+
+// CSV writes the report's tenants, one per row, then the total.
+func (rep Report) CSV() ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	w.Write(columns)
+	for _, r := range rep.Tenants {
+		w.Write(r.record())
+	}
+	total := rep.Total
+	total.Tenant = "total"
+	w.Write(total.record())
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+// JSON writes the report as indented JSON.
+func (rep Report) JSON() ([]byte, error) {
+	return json.MarshalIndent(rep, "", "  ")
+}
+
+// put writes the report as ext, returning the object's name.
+func (x *Reporter) put(ctx context.Context, rep Report, ext, contentType string, data []byte) (string, error) {
+	name := rep.Kind + "/" + rep.Name + "." + ext
+	_, err := x.mc.PutObject(ctx, x.cfg.Bucket, name, bytes.NewReader(data), int64(len(data)),
+		minio.PutObjectOptions{ContentType: contentType})
+	return name, err
+}
+
+// mail sends a summary of the report, with its CSV attached.
+func (x *Reporter) mail(rep Report, table []byte) error {
+	e := x.cfg.Email
+	var auth smtp.Auth
+	if e.Username != "" {
+		host, _, err := net.SplitHostPort(e.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", e.Username, x.password, host)
+	}
+
+	var msg bytes.Buffer
+	mw := multipart.NewWriter(&msg)
+	fmt.Fprintf(&msg, "From: %s\r\n", e.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(e.To, ", "))
+	fmt.Fprintf(&msg, "Subject: MRVA usage report, %s %s\r\n", rep.Kind, rep.Name)
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", mw.Boundary())
+
+	body, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/plain; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+	})
+	if err != nil {
+		return err
+	}
+	qp := quotedprintable.NewWriter(body)
+	fmt.Fprintf(qp, "Usage of the sessions submitted from %s to %s (UTC):\r\n\r\n",
+		rep.From.Format(time.DateOnly), rep.To.Format(time.DateOnly))
+	fmt.Fprintf(qp, "  sessions       %d\r\n", rep.Total.Sessions)
+	fmt.Fprintf(qp, "  repositories   %d\r\n", rep.Total.Repositories)
+	fmt.Fprintf(qp, "  compute hours  %.2f\r\n", rep.Total.ComputeHours)
+	fmt.Fprintf(qp, "  storage bytes  %d\r\n", rep.Total.StorageBytes)
+	fmt.Fprintf(qp, "  tenants        %d\r\n\r\n", len(rep.Tenants))
+	fmt.Fprintf(qp, "The figures per tenant are attached.\r\n")
+	if err := qp.Close(); err != nil {
+		return err
+	}
+
+	attachment, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {"text/csv; charset=utf-8"},
+		"Content-Transfer-Encoding": {"quoted-printable"},
+		"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", "usage-"+rep.Kind+"-"+rep.Name+".csv")},
+	})
+	if err != nil {
+		return err
+	}
+	qp = quotedprintable.NewWriter(attachment)
+	qp.Write(table)
+	if err := qp.Close(); err != nil {
+		return err
+	}
+	if err := mw.Close(); err != nil {
+		return err
+	}
+	return smtp.SendMail(e.Addr, auth, e.From, e.To, msg.Bytes())
+}
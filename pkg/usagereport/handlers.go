@@ -0,0 +1,66 @@
+package usagereport
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/web"
+)
+
+// RegisterAdmin adds the usage reports:
+//
+//	GET  /admin/usage-reports                   the reports exported
+//	GET  /admin/usage-reports/{period}/{name}   a period's report, made afresh; ?format=csv for CSV
+//	POST /admin/usage-reports/{period}/{name}   export a period's report now
+func (x *Reporter) RegisterAdmin(r *mux.Router) {
+	r.HandleFunc("/admin/usage-reports", x.list).Methods(http.MethodGet)
+	r.HandleFunc("/admin/usage-reports/{period}/{name}", x.get).Methods(http.MethodGet)
+	r.HandleFunc("/admin/usage-reports/{period}/{name}", x.export).Methods(http.MethodPost)
+}
+
+func (x *Reporter) list(w http.ResponseWriter, r *http.Request) {
+	list, err := x.Exports(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, list)
+}
+
+func (x *Reporter) get(w http.ResponseWriter, r *http.Request) {
+	p, err := ParsePeriod(mux.Vars(r)["period"], mux.Vars(r)["name"])
+	if err != nil {
+		web.Fail(w, err, http.StatusBadRequest)
+		return
+	}
+	rep, err := x.Generate(r.Context(), p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if r.URL.Query().Get("format") != "csv" {
+		web.WriteJSON(w, http.StatusOK, rep)
+		return
+	}
+	data, err := rep.CSV()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+	w.Write(data)
+}
+
+func (x *Reporter) export(w http.ResponseWriter, r *http.Request) {
+	p, err := ParsePeriod(mux.Vars(r)["period"], mux.Vars(r)["name"])
+	if err != nil {
+		web.Fail(w, err, http.StatusBadRequest)
+		return
+	}
+	e, err := x.Export(r.Context(), p)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, e)
+}
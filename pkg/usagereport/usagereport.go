@@ -0,0 +1,339 @@
+// Package usagereport reports, for capacity planning, how much a week's
+// or a month's sessions used: how many sessions were submitted, how many
+// repositories they analyzed, the compute hours agents spent on them and
+// the artifact storage they take, in total and per tenant.  A tenant is
+// an identity as web.Identity gives it.  After each period the configured
+// ones' reports are exported to a bucket of the artifact store as CSV and
+// JSON, and mailed if recipients are configured.
+//
+// Sessions count in the period they were submitted in.  Compute hours are
+// the time from a job's dispatch to its result; storage is what the
+// sessions take when the report is made, with usage accounting enabled.
+package usagereport
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"github.com/hohn/mrvacommander/pkg/state"
+	"github.com/minio/minio-go/v7"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/messages"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/snapshot"
+	"mrvaserver/pkg/store"
+	"mrvaserver/pkg/usage"
+	"mrvaserver/pkg/web"
+)
+
+const nsExports = "usage-reports" // period/name -> Export
+
+// Interval is how often Run looks for periods to report on.
+const Interval = time.Hour
+
+// maxGap bounds the probe for sessions of a state that cannot list them.
+const maxGap = 100
+
+// unknownTenant stands for the tenant of sessions with none recorded, such
+// as those submitted before tenants were.
+const unknownTenant = "(unknown)"
+
+var exportedTotal = metrics.NewCounterVec("mrvaserver_usage_reports_exported_total",
+	"Usage reports exported, by period.", "period")
+
+// Period is a week, from Monday, or a month, in UTC.
+type Period struct {
+	Kind string    `json:"period"`
+	Name string    `json:"name"`
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+}
+
+// PeriodOf returns the period of kind, "weekly" or "monthly", that t is
+// in.
+func PeriodOf(kind string, t time.Time) Period {
+	t = t.UTC()
+	day := time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, time.UTC)
+	if kind == "weekly" {
+		from := day.AddDate(0, 0, -(int(day.Weekday())+6)%7)
+		year, week := from.ISOWeek()
+		return Period{Kind: kind, Name: fmt.Sprintf("%d-W%02d", year, week), From: from, To: from.AddDate(0, 0, 7)}
+	}
+	from := day.AddDate(0, 0, 1-day.Day())
+	return Period{Kind: kind, Name: from.Format("2006-01"), From: from, To: from.AddDate(0, 1, 0)}
+}
+
+// ParsePeriod returns the period of kind named name, such as 2026-W41 or
+// 2026-09.
+func ParsePeriod(kind, name string) (Period, error) {
+	invalid := func() error {
+		example := PeriodOf(kind, time.Now()).Name
+		return web.Msg(http.StatusBadRequest, "", "usage_reports.invalid_name",
+			messages.Params{"period": kind, "name": name, "example": example})
+	}
+	switch kind {
+	case "weekly":
+		var year, week int
+		if n, _ := fmt.Sscanf(name, "%4d-W%2d", &year, &week); n != 2 || week < 1 || week > 53 {
+			return Period{}, invalid()
+		}
+		// January 4th is in week 1.
+		p := PeriodOf(kind, time.Date(year, 1, 4, 0, 0, 0, 0, time.UTC).AddDate(0, 0, 7*(week-1)))
+		if p.Name != name {
+			return Period{}, invalid()
+		}
+		return p, nil
+	case "monthly":
+		t, err := time.Parse("2006-01", name)
+		if err != nil {
+			return Period{}, invalid()
+		}
+		return PeriodOf(kind, t), nil
+	}
+	return Period{}, web.Msg(http.StatusNotFound, "", "usage_reports.unknown_period", messages.Params{"period": kind})
+}
+
+// Row is the usage of some sessions: those of a tenant, or all of them.
+type Row struct {
+	Tenant       string  `json:"tenant,omitempty"`
+	Sessions     int     `json:"sessions"`
+	Repositories int     `json:"repositories"`
+	ComputeHours float64 `json:"compute_hours"`
+	StorageBytes int64   `json:"storage_bytes"`
+}
+
+func (r *Row) add(o Row) {
+	r.Sessions += o.Sessions
+	r.Repositories += o.Repositories
+	r.ComputeHours += o.ComputeHours
+	r.StorageBytes += o.StorageBytes
+}
+
+// Report is the usage of a period's sessions.  Tenants are ordered by
+// compute hours, the most first.  A report on a period not yet over is
+// not Complete.
+type Report struct {
+	Period
+	GeneratedAt time.Time `json:"generated_at"`
+	Complete    bool      `json:"complete"`
+	Total       Row       `json:"total"`
+	Tenants     []Row     `json:"tenants"`
+}
+
+// Export records a report exported to the bucket.
+type Export struct {
+	Period
+	Objects    []string  `json:"objects"`
+	Mailed     []string  `json:"mailed_to,omitempty"`
+	Total      Row       `json:"total"`
+	ExportedAt time.Time `json:"exported_at"`
+}
+
+type Reporter struct {
+	cfg      config.Reports
+	mc       *minio.Client
+	meta     store.Store
+	state    state.ServerState
+	password string
+
+	usage     *usage.Accountant
+	tenants   func(ctx context.Context, session int) (string, error)
+	durations func(common.JobSpec) (time.Duration, bool)
+}
+
+// New returns a reporter on the sessions of st, exporting to cfg.Bucket
+// in mc and recording the exports in meta.
+func New(cfg config.Reports, mc *minio.Client, meta store.Store, st state.ServerState) (*Reporter, error) {
+	x := &Reporter{cfg: cfg, mc: mc, meta: meta, state: st}
+	if cfg.Email.Username != "" {
+		pw, err := os.ReadFile(cfg.Email.PasswordFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read usage report mail password: %w", err)
+		}
+		x.password = strings.TrimSpace(string(pw))
+	}
+	if err := common.CreateMinIOBucketIfNotExists(mc, cfg.Bucket); err != nil {
+		return nil, fmt.Errorf("failed to create usage report bucket: %w", err)
+	}
+	return x, nil
+}
+
+// SetUsage reads the storage sessions take from a, and takes a session's
+// user there as its tenant if it has none recorded.
+func (x *Reporter) SetUsage(a *usage.Accountant) {
+	x.usage = a
+}
+
+// SetTenants sets how the tenant that submitted a session is found; ""
+// is none recorded.
+func (x *Reporter) SetTenants(f func(ctx context.Context, session int) (string, error)) {
+	x.tenants = f
+}
+
+// SetDurations sets how long an agent took over a finished job.
+func (x *Reporter) SetDurations(f func(common.JobSpec) (time.Duration, bool)) {
+	x.durations = f
+}
+
+// Generate reports on the sessions submitted in p.
+func (x *Reporter) Generate(ctx context.Context, p Period) (Report, error) {
+	now := time.Now().UTC()
+	rep := Report{Period: p, GeneratedAt: now, Complete: !now.Before(p.To), Tenants: []Row{}}
+	ids, err := snapshot.SessionIDs(x.state, maxGap)
+	if err != nil {
+		return rep, fmt.Errorf("failed to list sessions: %w", err)
+	}
+	rows := make(map[string]*Row)
+	for _, id := range ids {
+		if err := ctx.Err(); err != nil {
+			return rep, err
+		}
+		jobs, err := x.state.GetJobList(id)
+		if err != nil || len(jobs) == 0 {
+			continue
+		}
+		info, err := x.state.GetJobInfo(jobs[0].Spec)
+		if err != nil {
+			continue
+		}
+		created, err := time.Parse(time.RFC3339, info.CreatedAt)
+		if err != nil || created.Before(p.From) || !created.Before(p.To) {
+			continue
+		}
+		row := Row{Sessions: 1, Repositories: len(jobs)}
+		for _, job := range jobs {
+			if x.durations == nil {
+				break
+			}
+			if d, ok := x.durations(job.Spec); ok {
+				row.ComputeHours += d.Hours()
+			}
+		}
+		tenant, err := x.tenant(ctx, id)
+		if err != nil {
+			return rep, fmt.Errorf("failed to read the tenant of session %d: %w", id, err)
+		}
+		if x.usage != nil {
+			u, err := x.usage.Session(ctx, id)
+			if err != nil && !errors.Is(err, store.ErrNotFound) {
+				return rep, fmt.Errorf("failed to read the usage of session %d: %w", id, err)
+			}
+			row.StorageBytes = u.Bytes()
+			if tenant == "" {
+				tenant = u.User
+			}
+		}
+		if tenant == "" {
+			tenant = unknownTenant
+		}
+		if rows[tenant] == nil {
+			rows[tenant] = &Row{Tenant: tenant}
+		}
+		rows[tenant].add(row)
+		rep.Total.add(row)
+	}
+	for _, r := range rows {
+		rep.Tenants = append(rep.Tenants, *r)
+	}
+	sort.Slice(rep.Tenants, func(i, j int) bool {
+		a, b := rep.Tenants[i], rep.Tenants[j]
+		if a.ComputeHours != b.ComputeHours {
+			return a.ComputeHours > b.ComputeHours
+		}
+		return a.Tenant < b.Tenant
+	})
+	return rep, nil
+}
+
+func (x *Reporter) tenant(ctx context.Context, session int) (string, error) {
+	if x.tenants == nil {
+		return "", nil
+	}
+	return x.tenants(ctx, session)
+}
+
+// Run exports the reports of the configured periods that have ended since
+// their last export.  It is a background task.
+func (x *Reporter) Run(ctx context.Context) error {
+	var errs []error
+	for _, kind := range x.cfg.Periods {
+		p := PeriodOf(kind, PeriodOf(kind, time.Now()).From.Add(-time.Second))
+		_, err := x.meta.Get(ctx, nsExports, p.Kind+"/"+p.Name)
+		if err == nil {
+			continue
+		}
+		if !errors.Is(err, store.ErrNotFound) {
+			errs = append(errs, err)
+			continue
+		}
+		if _, err := x.Export(ctx, p); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Export makes the report of p, writes it to the bucket and mails it, and
+// records that it did.  Exporting a period again replaces its report.
+func (x *Reporter) Export(ctx context.Context, p Period) (Export, error) {
+	rep, err := x.Generate(ctx, p)
+	if err != nil {
+		return Export{}, fmt.Errorf("failed to make the %s usage report %s: %w", p.Kind, p.Name, err)
+	}
+	e := Export{Period: p, Total: rep.Total}
+	csv, err := rep.CSV()
+	if err != nil {
+		return e, err
+	}
+	json, err := rep.JSON()
+	if err != nil {
+		return e, err
+	}
+	for _, o := range []struct {
+		ext, contentType string
+		data             []byte
+	}{{"csv", "text/csv", csv}, {"json", "application/json", json}} {
+		name, err := x.put(ctx, rep, o.ext, o.contentType, o.data)
+		if err != nil {
+			return e, fmt.Errorf("failed to export the %s usage report %s: %w", p.Kind, p.Name, err)
+		}
+		e.Objects = append(e.Objects, name)
+	}
+	if len(x.cfg.Email.To) > 0 {
+		if err := x.mail(rep, csv); err != nil {
+			return e, fmt.Errorf("failed to mail the %s usage report %s: %w", p.Kind, p.Name, err)
+		}
+		e.Mailed = x.cfg.Email.To
+	}
+	e.ExportedAt = time.Now().UTC()
+	if err := store.PutJSON(ctx, x.meta, nsExports, p.Kind+"/"+p.Name, e); err != nil {
+		return e, fmt.Errorf("failed to record usage report export: %w", err)
+	}
+	exportedTotal.With(p.Kind).Inc()
+	slog.Info("Usage report exported", "period", p.Kind, "name", p.Name, "sessions", rep.Total.Sessions,
+		"tenants", len(rep.Tenants), "mailed", len(e.Mailed))
+	return e, nil
+}
+
+// Exports lists the reports exported, by period and name.
+func (x *Reporter) Exports(ctx context.Context) ([]Export, error) {
+	list, err := store.ListJSON[Export](ctx, x.meta, nsExports, "")
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Kind != list[j].Kind {
+			return list[i].Kind < list[j].Kind
+		}
+		return list[i].From.Before(list[j].From)
+	})
+	return list, nil
+}
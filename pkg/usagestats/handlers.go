@@ -0,0 +1,33 @@
+package usagestats
+
+import (
+	"net/http"
+
+	"github.com/gorilla/mux"
+	"mrvaserver/pkg/web"
+)
+
+// RegisterAdmin adds GET /admin/usage-stats, where reports go and the next one
+// as it would be sent now, and POST /admin/usage-stats/send, which sends
+// it at once.
+func (x *Reporter) RegisterAdmin(r *mux.Router) {
+	r.HandleFunc("/admin/usage-stats", x.get).Methods(http.MethodGet)
+	r.HandleFunc("/admin/usage-stats/send", x.send).Methods(http.MethodPost)
+}
+
+func (x *Reporter) get(w http.ResponseWriter, r *http.Request) {
+	s, err := x.Status(r.Context())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	web.WriteJSON(w, http.StatusOK, s)
+}
+
+func (x *Reporter) send(w http.ResponseWriter, r *http.Request) {
+	if err := x.Send(r.Context()); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	x.get(w, r)
+}
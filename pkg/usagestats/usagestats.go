@@ -0,0 +1,390 @@
+// Package usagestats sends anonymized, aggregate usage figures to the
+// maintainers, so that they can tell which backends and session sizes
+// matter and how often things fail.  It does nothing unless an operator
+// opts in with usage_stats.enabled.
+//
+// Each replica reports what it saw since its last report: how many
+// sessions were submitted through it and how many repositories they
+// named, the sessions counted by size, and the jobs whose results it
+// handled and the requests it answered, with how many of each failed.
+// With them go the server and Go versions, the OS and architecture, and
+// the names of the backends in use, "custom" for those not built in.  An
+// installation is known by a random ID kept in the metadata store, shared
+// by its replicas; times are rounded to the hour.  Nothing names a user,
+// repository, query, result or address.  A report that cannot be sent is
+// kept and added to the next.
+package usagestats
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"runtime"
+	"runtime/debug"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/hohn/mrvacommander/pkg/common"
+	"mrvaserver/pkg/agentproto"
+	"mrvaserver/pkg/config"
+	"mrvaserver/pkg/devstack"
+	"mrvaserver/pkg/gateway"
+	"mrvaserver/pkg/metrics"
+	"mrvaserver/pkg/store"
+)
+
+const ns = "usage-stats" // "installation" -> installation
+
+// schema is the version of the Report document.
+const schema = 1
+
+var sentTotal = metrics.NewCounterVec("mrvaserver_usage_stats_reports_total",
+	"Usage statistics reports sent, by result.", "result")
+
+// builtin are the backends of each kind that are reported by name.
+var builtin = map[string][]string{
+	"state":     {"commander", "postgres", "mysql", "etcd", "journal"},
+	"queue":     {"rabbitmq", devstack.Backend},
+	"artifacts": {"minio", devstack.Backend},
+	"databases": {"hepc", devstack.Backend},
+}
+
+// sizes are the upper bounds of the session size classes, in
+// repositories.
+var sizes = []struct {
+	name string
+	max  int
+}{{"1", 1}, {"2-10", 10}, {"11-100", 100}, {"101-1000", 1000}}
+
+const largest = "over-1000"
+
+// Report is what is sent.
+type Report struct {
+	Schema       int               `json:"schema"`
+	Installation string            `json:"installation"`
+	Version      string            `json:"version"`
+	GoVersion    string            `json:"go_version"`
+	OS           string            `json:"os"`
+	Arch         string            `json:"arch"`
+	Backends     map[string]string `json:"backends"`
+	From         time.Time         `json:"from"`
+	To           time.Time         `json:"to"`
+	Sessions     Sessions          `json:"sessions"`
+	Jobs         Outcomes          `json:"jobs"`
+	Requests     Outcomes          `json:"requests"`
+}
+
+// Sessions counts the sessions submitted, in total and by size class.
+type Sessions struct {
+	Count        int64            `json:"count"`
+	Repositories int64            `json:"repositories"`
+	BySize       map[string]int64 `json:"by_size"`
+}
+
+// Outcomes counts jobs or requests and the failures among them: failed
+// jobs, or requests answered with a server error.
+type Outcomes struct {
+	Total     int64   `json:"total"`
+	Failed    int64   `json:"failed"`
+	ErrorRate float64 `json:"error_rate"`
+}
+
+// counts are what a replica saw since it last reported.
+type counts struct {
+	since                  time.Time
+	sessions, repositories int64
+	bySize                 map[string]int64
+	jobs, failedJobs       int64
+	requests, failedReqs   int64
+}
+
+func newCounts() counts {
+	return counts{since: time.Now(), bySize: map[string]int64{}}
+}
+
+type installation struct {
+	ID string `json:"id"`
+}
+
+// Status is GET /admin/usage-stats: where reports go, the next one as it
+// would be sent now, and how the last attempt went.
+type Status struct {
+	Endpoint  string     `json:"endpoint"`
+	Interval  string     `json:"interval"`
+	Next      Report     `json:"next"`
+	LastSent  *time.Time `json:"last_sent,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+type Reporter struct {
+	cfg      config.UsageStats
+	meta     store.Store
+	client   *http.Client
+	backends map[string]string
+
+	mu        sync.Mutex
+	id        string // the installation's, once read
+	counts    counts
+	lastSent  *time.Time
+	lastError string
+}
+
+// New returns a reporter on a server running cfg, keeping the
+// installation ID in meta.
+func New(cfg *config.Config, meta store.Store) *Reporter {
+	backends := map[string]string{
+		"state":     cfg.State.Backend,
+		"queue":     cfg.Queue.Backend,
+		"artifacts": cfg.Artifacts.Backend,
+		"databases": cfg.Databases.Backend,
+	}
+	for kind, name := range backends {
+		if !slices.Contains(builtin[kind], name) {
+			backends[kind] = "custom"
+		}
+	}
+	return &Reporter{
+		cfg:      cfg.UsageStats,
+		meta:     meta,
+		client:   &http.Client{Timeout: 30 * time.Second},
+		backends: backends,
+		counts:   newCounts(),
+	}
+}
+
+// SubmitHook counts a submission once it has made a session.
+func (x *Reporter) SubmitHook(r *http.Request, sub *gateway.Submission) error {
+	n := len(sub.Msg.Repositories)
+	sub.After(func() {
+		if sub.Session == 0 {
+			return
+		}
+		size := largest
+		for _, s := range sizes {
+			if n <= s.max {
+				size = s.name
+				break
+			}
+		}
+		x.mu.Lock()
+		defer x.mu.Unlock()
+		x.counts.sessions++
+		x.counts.repositories += int64(n)
+		x.counts.bySize[size]++
+	})
+	return nil
+}
+
+// HandleResult counts each result, and whether its job failed, before next
+// applies it.
+func (x *Reporter) HandleResult(next agentproto.ResultHandler) agentproto.ResultHandler {
+	return func(r agentproto.Result) error {
+		failed := r.Status == common.StatusError || r.Status == common.StatusFailed
+		x.mu.Lock()
+		x.counts.jobs++
+		if failed {
+			x.counts.failedJobs++
+		}
+		x.mu.Unlock()
+		return next(r)
+	}
+}
+
+// Middleware counts requests and those answered with a server error.
+func (x *Reporter) Middleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sw := &statusWriter{ResponseWriter: w}
+		defer func() {
+			x.mu.Lock()
+			x.counts.requests++
+			if sw.status >= 500 {
+				x.counts.failedReqs++
+			}
+			x.mu.Unlock()
+		}()
+		next.ServeHTTP(sw, r)
+	})
+}
+
+func outcomes(total, failed int64) Outcomes {
+	o := Outcomes{Total: total, Failed: failed}
+	if total > 0 {
+		o.ErrorRate = float64(failed) / float64(total)
+	}
+	return o
+}
+
+// report is the report of c.
+func (x *Reporter) report(ctx context.Context, c counts) (Report, error) {
+	id, err := x.installation(ctx)
+	if err != nil {
+		return Report{}, err
+	}
+	rep := Report{
+		Schema:       schema,
+		Installation: id,
+		GoVersion:    runtime.Version(),
+		OS:           runtime.GOOS,
+		Arch:         runtime.GOARCH,
+		Backends:     x.backends,
+		From:         c.since.UTC().Truncate(time.Hour),
+		To:           time.Now().UTC().Truncate(time.Hour),
+		Sessions:     Sessions{Count: c.sessions, Repositories: c.repositories, BySize: c.bySize},
+		Jobs:         outcomes(c.jobs, c.failedJobs),
+		Requests:     outcomes(c.requests, c.failedReqs),
+	}
+	if info, ok := debug.ReadBuildInfo(); ok {
+		rep.Version = info.Main.Version
+	}
+	return rep, nil
+}
+
+// installation returns the installation's ID, making one up the first
+// time.
+func (x *Reporter) installation(ctx context.Context) (string, error) {
+	x.mu.Lock()
+	id := x.id
+	x.mu.Unlock()
+	if id != "" {
+		return id, nil
+	}
+	err := store.UpdateJSON(ctx, x.meta, ns, "installation", func(v *installation, found bool) error {
+		if !found || v.ID == "" {
+			b := make([]byte, 16)
+			rand.Read(b)
+			v.ID = hex.EncodeToString(b)
+		}
+		id = v.ID
+		return nil
+	})
+	if err != nil {
+		return "", fmt.Errorf("failed to read the installation ID: %w", err)
+	}
+	x.mu.Lock()
+	x.id = id
+	x.mu.Unlock()
+	return id, nil
+}
+
+// Status returns the reporter's status.
+func (x *Reporter) Status(ctx context.Context) (Status, error) {
+	x.mu.Lock()
+	c := x.counts
+	c.bySize = make(map[string]int64, len(x.counts.bySize))
+	for k, v := range x.counts.bySize {
+		c.bySize[k] = v
+	}
+	s := Status{Endpoint: x.cfg.Endpoint, Interval: x.cfg.Interval.String(), LastSent: x.lastSent, LastError: x.lastError}
+	x.mu.Unlock()
+	var err error
+	s.Next, err = x.report(ctx, c)
+	return s, err
+}
+
+// Run sends a report every interval until ctx is done.
+func (x *Reporter) Run(ctx context.Context) {
+	t := time.NewTicker(x.cfg.Interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if err := x.Send(ctx); err != nil {
+				slog.Warn("Failed to send usage statistics", "endpoint", x.cfg.Endpoint, "error", err)
+			}
+		}
+	}
+}
+
+// Send reports what was seen since the last report.  If it fails the
+// figures are kept for the next.
+func (x *Reporter) Send(ctx context.Context) error {
+	x.mu.Lock()
+	c := x.counts
+	x.counts = newCounts()
+	x.mu.Unlock()
+
+	err := x.post(ctx, c)
+	now := time.Now().UTC()
+	x.mu.Lock()
+	defer x.mu.Unlock()
+	if err != nil {
+		x.lastError = err.Error()
+		x.counts.since = c.since
+		x.counts.sessions += c.sessions
+		x.counts.repositories += c.repositories
+		for k, v := range c.bySize {
+			x.counts.bySize[k] += v
+		}
+		x.counts.jobs += c.jobs
+		x.counts.failedJobs += c.failedJobs
+		x.counts.requests += c.requests
+		x.counts.failedReqs += c.failedReqs
+		sentTotal.With("error").Inc()
+		return err
+	}
+	x.lastSent, x.lastError = &now, ""
+	sentTotal.With("sent").Inc()
+	return nil
+}
+
+// post sends the report of c.
+func (x *Reporter) post(ctx context.Context, c counts) error {
+	rep, err := x.report(ctx, c)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(rep)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, x.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := x.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("endpoint answered %s", resp.Status)
+	}
+	slog.Info("Usage statistics sent", "endpoint", x.cfg.Endpoint, "bytes", len(body),
+		"sessions", rep.Sessions.Count, "jobs", rep.Jobs.Total, "requests", rep.Requests.Total)
+	return nil
+}
+
+// statusWriter records the status of a response.
+type statusWriter struct {
+	http.ResponseWriter
+	status int
+}
+
+func (sw *statusWriter) WriteHeader(code int) {
+	if sw.status == 0 && code >= 200 {
+		sw.status = code
+	}
+	sw.ResponseWriter.WriteHeader(code)
+}
+
+func (sw *statusWriter) Write(p []byte) (int, error) {
+	if sw.status == 0 {
+		sw.status = http.StatusOK
+	}
+	return sw.ResponseWriter.Write(p)
+}
+
+func (sw *statusWriter) Flush() {
+	if f, ok := sw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
@@ -0,0 +1,158 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+)
+
+// Streamer is a document that writes its JSON encoding a part at a time,
+// such as Rows.  WriteJSONTagged and WriteJSONStream stream documents that
+// are; others are encoded whole.
+type Streamer interface {
+	StreamJSON(w io.Writer) error
+}
+
+// ArrayWriter writes a JSON array, each element encoded by a json.Encoder
+// as it is produced, so an array of ten thousand entries takes the memory
+// of one.
+type ArrayWriter struct {
+	w   io.Writer
+	enc *json.Encoder
+	n   int
+	err error
+}
+
+// NewArrayWriter starts an array on w.  Close ends it.
+func NewArrayWriter(w io.Writer) *ArrayWriter {
+	a := &ArrayWriter{w: w, enc: json.NewEncoder(w)}
+	_, a.err = io.WriteString(w, "[")
+	return a
+}
+
+// Write adds v to the array.
+func (a *ArrayWriter) Write(v any) error {
+	if a.err != nil {
+		return a.err
+	}
+	if a.n > 0 {
+		if _, a.err = io.WriteString(a.w, ","); a.err != nil {
+			return a.err
+		}
+	}
+	a.n++
+	a.err = a.enc.Encode(v)
+	return a.err
+}
+
+// Close ends the array.
+func (a *ArrayWriter) Close() error {
+	if a.err != nil {
+		return a.err
+	}
+	_, a.err = io.WriteString(a.w, "]")
+	return a.err
+}
+
+// Rows is a JSON object holding one large array: Head, encoded whole with
+// the array under Key empty, and the array's elements as Each produces
+// them.  Key must name an array of Head itself, not of a value inside it.
+type Rows struct {
+	Head any
+	Key  string
+	Each func(a *ArrayWriter) error
+}
+
+// StreamJSON writes the object to w.
+func (d Rows) StreamJSON(w io.Writer) error {
+	head, err := json.Marshal(d.Head)
+	if err != nil {
+		return err
+	}
+	key, err := json.Marshal(d.Key)
+	if err != nil {
+		return err
+	}
+	marker := append(key, ":[]"...)
+	i := bytes.Index(head, marker)
+	if i < 0 {
+		return fmt.Errorf("document has no empty %s array", key)
+	}
+	bw := bufio.NewWriterSize(w, 32<<10)
+	bw.Write(head[:i+len(marker)-2])
+	a := NewArrayWriter(bw)
+	if err := d.Each(a); err != nil {
+		return err
+	}
+	if err := a.Close(); err != nil {
+		return err
+	}
+	bw.Write(head[i+len(marker):])
+	return bw.Flush()
+}
+
+// streamJSON writes the JSON encoding of v to w, a part at a time if v is
+// a Streamer.
+func streamJSON(w io.Writer, v any) error {
+	if s, ok := v.(Streamer); ok {
+		return s.StreamJSON(w)
+	}
+	return json.NewEncoder(w).Encode(v)
+}
+
+// WriteJSONStream is WriteJSON for large documents, streamed without a
+// Content-Length.  An encoding error past the first bytes cuts the
+// response short.
+func WriteJSONStream(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := streamJSON(w, v); err != nil {
+		slog.Error("Error encoding response as JSON", "error", err)
+	}
+}
+
+// WriteJSONArray streams a JSON array of the elements each produces, as
+// WriteJSONStream does a document.
+func WriteJSONArray(w http.ResponseWriter, code int, each func(a *ArrayWriter) error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	bw := bufio.NewWriterSize(w, 32<<10)
+	a := NewArrayWriter(bw)
+	err := each(a)
+	if err == nil {
+		err = a.Close()
+	}
+	if err == nil {
+		err = bw.Flush()
+	}
+	if err != nil {
+		slog.Error("Error encoding response as JSON", "error", err)
+	}
+}
+
+// measure encodes v without keeping it, for its length and ETag.
+func measure(v any) (int64, string, error) {
+	h := sha256.New()
+	c := &countingWriter{w: h}
+	if err := streamJSON(c, v); err != nil {
+		return 0, "", err
+	}
+	return c.n, `"` + hex.EncodeToString(h.Sum(nil)[:12]) + `"`, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,267 @@
+// Package web holds small HTTP helpers shared by the gateway and the
+// packages that mount endpoints on it.
+package web
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"mrvaserver/pkg/apierr"
+	"mrvaserver/pkg/messages"
+)
+
+// WriteJSON encodes v as the JSON response body with the given status code.
+func WriteJSON(w http.ResponseWriter, code int, v any) {
+	body, err := json.Marshal(v)
+	if err != nil {
+		slog.Error("Error encoding response as JSON", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(code)
+	w.Write(body)
+}
+
+// NotModified sets the response's ETag and, if the request's If-None-Match
+// matches it, answers 304 and returns true.
+func NotModified(w http.ResponseWriter, r *http.Request, etag string) bool {
+	w.Header().Set("ETag", etag)
+	inm := r.Header.Get("If-None-Match")
+	if inm == "" {
+		return false
+	}
+	for _, tag := range strings.Split(inm, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == strings.TrimPrefix(etag, "W/") {
+			w.WriteHeader(http.StatusNotModified)
+			return true
+		}
+	}
+	return false
+}
+
+// WriteJSONTagged is WriteJSON for pollable resources.  Unless the handler
+// has already set an ETag, one is derived from the encoded body, and a
+// matching If-None-Match is answered with 304.  A Streamer is streamed,
+// encoded once to measure it and again to send it.
+func WriteJSONTagged(w http.ResponseWriter, r *http.Request, code int, v any) {
+	n, etag, err := measure(v)
+	if err != nil {
+		slog.Error("Error encoding response as JSON", "error", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if w.Header().Get("ETag") == "" && NotModified(w, r, etag) {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Length", strconv.FormatInt(n, 10))
+	w.WriteHeader(code)
+	if err := streamJSON(w, v); err != nil {
+		slog.Error("Error encoding response as JSON", "error", err)
+	}
+}
+
+// BodyETag is the ETag WriteJSONTagged gives v.
+func BodyETag(v any) (string, error) {
+	_, etag, err := measure(v)
+	return etag, err
+}
+
+// Origin is how the client reached the server, which differs from the
+// request itself behind a reverse proxy.  See middleware.Forwarded.
+type Origin struct {
+	Scheme   string
+	Host     string
+	Prefix   string
+	ClientIP string
+}
+
+type originKey struct{}
+
+// WithOrigin returns r carrying o.
+func WithOrigin(r *http.Request, o Origin) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), originKey{}, o))
+}
+
+// OriginOf returns the request's Origin, derived from the request alone if
+// none was attached.
+func OriginOf(r *http.Request) Origin {
+	if o, ok := r.Context().Value(originKey{}).(Origin); ok {
+		return o
+	}
+	o := Origin{Scheme: "http", Host: r.Host, ClientIP: r.RemoteAddr}
+	if h, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		o.ClientIP = h
+	}
+	if r.TLS != nil {
+		o.Scheme = "https"
+	}
+	return o
+}
+
+type principalKey struct{}
+
+// WithPrincipal returns r authenticated as principal name.
+func WithPrincipal(r *http.Request, name string) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), principalKey{}, name))
+}
+
+// Principal returns the name r was authenticated as, or "" if it was not.
+func Principal(r *http.Request) string {
+	name, _ := r.Context().Value(principalKey{}).(string)
+	return name
+}
+
+type routeKey struct{}
+
+// WithRouteSlot returns r able to record the route it is matched to, and
+// where SetRoute records it.  A request that has a slot keeps it.
+func WithRouteSlot(r *http.Request) (*http.Request, *string) {
+	if p, ok := r.Context().Value(routeKey{}).(*string); ok {
+		return r, p
+	}
+	route := new(string)
+	return r.WithContext(context.WithValue(r.Context(), routeKey{}, route)), route
+}
+
+// SetRoute records the path template of the route r matched, if r has a
+// slot for it.
+func SetRoute(r *http.Request, route string) {
+	if p, ok := r.Context().Value(routeKey{}).(*string); ok {
+		*p = route
+	}
+}
+
+// ExternalBase is the scheme, host and base path under which the client
+// reached us, for building absolute URLs in responses.
+func ExternalBase(r *http.Request) string {
+	o := OriginOf(r)
+	return fmt.Sprintf("%s://%s%s", o.Scheme, o.Host, o.Prefix)
+}
+
+// SessionNames translates between the numeric IDs sessions are kept under
+// and the names clients of the server's own routes know them by.
+type SessionNames interface {
+	Name(ctx context.Context, session int) (string, error)
+	Resolve(ctx context.Context, name string) (int, error)
+}
+
+type sessionNamesKey struct{}
+
+// WithSessionNames returns r naming sessions by n.
+func WithSessionNames(r *http.Request, n SessionNames) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), sessionNamesKey{}, n))
+}
+
+// SessionName returns the name of session for the client of the request
+// ctx is of: what its SessionNames call it, or its decimal ID without any.
+func SessionName(ctx context.Context, session int) (string, error) {
+	if n, ok := ctx.Value(sessionNamesKey{}).(SessionNames); ok {
+		return n.Name(ctx, session)
+	}
+	return strconv.Itoa(session), nil
+}
+
+// SessionNameList is SessionName for several sessions.
+func SessionNameList(ctx context.Context, sessions []int) ([]string, error) {
+	names := make([]string, len(sessions))
+	for i, id := range sessions {
+		var err error
+		if names[i], err = SessionName(ctx, id); err != nil {
+			return nil, err
+		}
+	}
+	return names, nil
+}
+
+// SessionLabel is SessionName for messages: the decimal ID should naming
+// the session fail.
+func SessionLabel(ctx context.Context, session int) string {
+	name, err := SessionName(ctx, session)
+	if err != nil {
+		return strconv.Itoa(session)
+	}
+	return name
+}
+
+// ResolveSession returns the numeric ID of the session the client of the
+// request ctx is of calls name.  A name that is not one, or names no
+// session, is a 404 Error.
+func ResolveSession(ctx context.Context, name string) (int, error) {
+	if n, ok := ctx.Value(sessionNamesKey{}).(SessionNames); ok {
+		return n.Resolve(ctx, name)
+	}
+	id, err := strconv.Atoi(name)
+	if err != nil {
+		return 0, Msg(http.StatusNotFound, "", "session.unknown", messages.Params{"session": name})
+	}
+	return id, nil
+}
+
+// Error is an error that carries the HTTP status code to report it with
+// and, in Kind, its apierr code if more specific than the status's.  An
+// Error from the message catalog carries the message's ID and parameters,
+// so that it can be rendered in the client's locale.
+type Error struct {
+	Code   int
+	Kind   string
+	Msg    string
+	ID     string
+	Params messages.Params
+}
+
+func (e *Error) Error() string { return e.Msg }
+
+// Errorf returns an *Error with a formatted message.
+func Errorf(code int, format string, args ...any) *Error {
+	return &Error{Code: code, Msg: fmt.Sprintf(format, args...)}
+}
+
+// Msg returns an *Error with a message from the catalog, in English.  An
+// empty kind is the status's code.  Errors among the parameters are
+// replaced with their messages.
+func Msg(code int, kind, id string, p messages.Params) *Error {
+	for k, v := range p {
+		if err, ok := v.(error); ok {
+			p[k] = err.Error()
+		}
+	}
+	return &Error{Code: code, Kind: kind, Msg: messages.Builtin.Text(id, p), ID: id, Params: p}
+}
+
+// Fail reports err to the client as an error document, using its status
+// code, kind and message ID if it is an *Error and fallback otherwise.
+func Fail(w http.ResponseWriter, err error, fallback int) {
+	b := apierr.Body{Message: err.Error()}
+	code := fallback
+	var e *Error
+	if errors.As(err, &e) {
+		code, b.Code = e.Code, e.Kind
+		if e.Msg == b.Message {
+			// Not wrapped in context the message would lose.
+			b.MessageID, b.Params = e.ID, e.Params
+		}
+	}
+	apierr.Write(w, code, b)
+}
+
+// Identity names the caller for per-client limits and accounting:
+// user:<name> if it authenticated as a principal (see Principal), else
+// ip:<client address>.  Bearer tokens that do not authenticate anyone are
+// not used, since callers could make up a new one for every request.
+func Identity(r *http.Request) string {
+	if name := Principal(r); name != "" {
+		return "user:" + name
+	}
+	return "ip:" + OriginOf(r).ClientIP
+}